@@ -260,6 +260,14 @@ const (
 	// `next_rates` consumption rate columns to the system.tenant_usage table.
 	V24_2_TenantRates
 
+	// V24_2_InvertedSetAtLeast is the version after which the inverted
+	// expressions sent to remote processors can contain SetAtLeast nodes.
+	V24_2_InvertedSetAtLeast
+
+	// V24_2_GeoInvertedKeyV2 is the version after which all nodes can decode
+	// the geo inverted keys encoded with encoding.GeoInvertedKeyV2.
+	V24_2_GeoInvertedKeyV2
+
 	// *************************************************
 	// Step (1) Add new versions above this comment.
 	// Do not add new versions to a patch release.
@@ -324,6 +332,10 @@ var versionTable = [numKeys]roachpb.Version{
 
 	V24_2_TenantRates: {Major: 24, Minor: 1, Internal: 8},
 
+	V24_2_InvertedSetAtLeast: {Major: 24, Minor: 1, Internal: 10},
+
+	V24_2_GeoInvertedKeyV2: {Major: 24, Minor: 1, Internal: 12},
+
 	// *************************************************
 	// Step (2): Add new versions above this comment.
 	// Do not add new versions to a patch release.
@@ -532,6 +532,17 @@ func (b *Bytes) Reset() {
 	b.buffer = b.buffer[:0]
 }
 
+// ZeroBuffer zeroes out the buffer of the non-inlined values, up to its
+// capacity, so that the values stored in it previously cannot be observed
+// once the buffer is reused. It should only be called right after Reset (which
+// zeroes out the elements, including the inlined values).
+func (b *Bytes) ZeroBuffer() {
+	if b.isWindow {
+		return
+	}
+	clear(b.buffer[:cap(b.buffer)])
+}
+
 // String is used for debugging purposes.
 func (b *Bytes) String() string {
 	var builder strings.Builder
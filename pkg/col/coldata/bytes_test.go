@@ -508,6 +508,26 @@ func TestProportionalSize(t *testing.T) {
 	require.Equal(t, int(fullSize-FlatBytesOverhead)/4, int(quarterSize-FlatBytesOverhead))
 }
 
+func TestZeroBuffer(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	// Use a large value so that elements are not inlined.
+	value := bytes.Repeat([]byte{'a'}, 3*BytesMaxInlineLength)
+	b := NewBytes(4)
+	for i := 0; i < b.Len(); i++ {
+		b.Set(i, value)
+	}
+	b.Reset()
+	b.ZeroBuffer()
+	require.Zero(t, len(b.buffer))
+	for _, c := range b.buffer[:cap(b.buffer)] {
+		require.Zero(t, c)
+	}
+	// The buffer is reused.
+	b.Set(0, value)
+	require.Equal(t, value, b.Get(0))
+}
+
 const letters = "abcdefghijklmnopqrstuvwxyz"
 
 func TestArrowConversion(t *testing.T) {
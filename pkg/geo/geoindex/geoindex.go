@@ -321,6 +321,17 @@ const (
 // rpExprElement implements the RPExprElement interface.
 func (o RPSetOperator) rpExprElement() {}
 
+func (o RPSetOperator) String() string {
+	switch o {
+	case RPSetUnion:
+		return `\U`
+	case RPSetIntersection:
+		return `\I`
+	default:
+		return fmt.Sprintf("RPSetOperator(%d)", int(o))
+	}
+}
+
 // RPKeyExpr is an expression to evaluate over primary keys retrieved for
 // index keys. If we view each index key as a posting list of primary keys,
 // the expression involves union and intersection over the sets represented by
@@ -328,7 +339,8 @@ func (o RPSetOperator) rpExprElement() {}
 // ancestors of different keys (cell ids) and is likely to contain many common
 // keys. This special structure allows us to efficiently and easily eliminate
 // common sub-expressions, hence the interface presents the factored
-// expression. The expression is represented in Reverse Polish notation.
+// expression. The expression is represented in Reverse Polish notation. Unlike
+// the spans of UnionKeySpans, the keys are not in sorted order.
 type RPKeyExpr []RPExprElement
 
 func (x RPKeyExpr) String() string {
@@ -338,12 +350,7 @@ func (x RPKeyExpr) String() string {
 		case Key:
 			elements = append(elements, elem.String())
 		case RPSetOperator:
-			switch elem {
-			case RPSetUnion:
-				elements = append(elements, `\U`)
-			case RPSetIntersection:
-				elements = append(elements, `\I`)
-			}
+			elements = append(elements, elem.String())
 		}
 	}
 	return strings.Join(elements, " ")
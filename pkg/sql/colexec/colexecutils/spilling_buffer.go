@@ -262,7 +262,7 @@ func (b *SpillingBuffer) GetVecWithTuple(
 		// now and then update the memory accounting once we have dequeued into it.
 		b.dequeueScratch = b.unlimitedAllocator.NewMemBatchWithFixedCapacity(
 			b.storedTypes, coldata.BatchSize())
-		b.unlimitedAllocator.ReleaseMemory(colmem.GetBatchMemSize(b.dequeueScratch))
+		b.unlimitedAllocator.ReleaseBatch(b.dequeueScratch)
 	}
 	if !b.doneAppending {
 		b.doneAppending = true
@@ -116,6 +116,8 @@ func TestSpillingBuffer(t *testing.T) {
 		memAcc := testMemMonitor.MakeBoundAccount()
 		defer memAcc.Close(ctx)
 		spillingQueueUnlimitedAllocator := colmem.NewAllocator(ctx, &memAcc, testColumnFactory)
+		// Close must release all memory of the buffer.
+		defer spillingQueueUnlimitedAllocator.AssertEmpty()
 
 		// Create buffer.
 		buf := NewSpillingBuffer(
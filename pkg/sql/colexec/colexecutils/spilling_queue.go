@@ -368,7 +368,7 @@ func (q *SpillingQueue) Dequeue(ctx context.Context) (coldata.Batch, error) {
 			// 3. once the actual data is dequeued from disk into the batch, we
 			//    update the allocator with the actual memory usage.
 			q.dequeueScratch = q.unlimitedAllocator.NewMemBatchWithFixedCapacity(q.typs, coldata.BatchSize())
-			q.unlimitedAllocator.ReleaseMemory(colmem.GetBatchMemSize(q.dequeueScratch))
+			q.unlimitedAllocator.ReleaseBatch(q.dequeueScratch)
 		}
 		ok, err := q.diskQueue.Dequeue(ctx, q.dequeueScratch)
 		if err != nil {
@@ -482,7 +482,7 @@ func (q *SpillingQueue) maybeSpillToDisk(ctx context.Context) error {
 		// We will release the memory a bit early (before enqueueing to the disk
 		// queue) since it simplifies the calculation of how many batches should
 		// be moved.
-		q.unlimitedAllocator.ReleaseMemory(colmem.GetBatchMemSize(tailBatch))
+		q.unlimitedAllocator.ReleaseBatch(tailBatch)
 		q.numInMemoryItems--
 		q.curTailIdx--
 		if q.curTailIdx < 0 {
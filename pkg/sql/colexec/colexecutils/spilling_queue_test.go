@@ -238,6 +238,8 @@ func TestSpillingQueue(t *testing.T) {
 
 			// Close queue.
 			require.NoError(t, q.Close(ctx))
+			// Close must release all memory of the queue.
+			spillingQueueUnlimitedAllocator.AssertEmpty()
 
 			// Verify no directories are left over.
 			directories, err := queueCfg.FS.List(queueCfg.GetPather.GetPath(ctx))
@@ -315,6 +317,8 @@ func TestSpillingQueueDidntSpill(t *testing.T) {
 
 	// Close queue.
 	require.NoError(t, q.Close(ctx))
+	// Close must release all memory of the queue.
+	spillingQueueUnlimitedAllocator.AssertEmpty()
 
 	// Verify no directories are left over.
 	directories, err := queueCfg.FS.List(queueCfg.GetPather.GetPath(ctx))
@@ -415,6 +419,8 @@ func TestSpillingQueueMemoryAccounting(t *testing.T) {
 			// Some sanity checks.
 			require.False(t, q.Spilled())
 			require.NoError(t, q.Close(ctx))
+			// Close must release all memory of the queue.
+			spillingQueueUnlimitedAllocator.AssertEmpty()
 			directories, err := queueCfg.FS.List(queueCfg.GetPather.GetPath(ctx))
 			require.NoError(t, err)
 			require.Equal(t, 0, len(directories))
@@ -522,6 +528,8 @@ func TestSpillingQueueMovingTailWhenSpilling(t *testing.T) {
 
 		// Some sanity checks.
 		require.NoError(t, q.Close(ctx))
+		// Close must release all memory of the queue.
+		spillingQueueUnlimitedAllocator.AssertEmpty()
 		directories, err := queueCfg.FS.List(queueCfg.GetPather.GetPath(ctx))
 		require.NoError(t, err)
 		require.Equal(t, 0, len(directories))
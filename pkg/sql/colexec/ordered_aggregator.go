@@ -297,7 +297,7 @@ func (a *orderedAggregator) Next() coldata.Batch {
 				// coldata.BatchSize(), but we actually want a batch with larger
 				// capacity, so we choose to instantiate the batch with fixed
 				// maximal capacity that can be needed by the aggregator.
-				a.allocator.ReleaseMemory(colmem.GetBatchMemSize(a.scratch.Batch))
+				a.allocator.ReleaseBatch(a.scratch.Batch)
 				newMinCapacity = 2 * coldata.BatchSize()
 				a.scratch.Batch = a.allocator.NewMemBatchWithFixedCapacity(a.outputTypes, newMinCapacity)
 			} else {
@@ -12,7 +12,13 @@ package colmem
 
 import (
 	"context"
+	"fmt"
 	"math"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unsafe"
 
 	"github.com/cockroachdb/cockroach/pkg/col/coldata"
 	"github.com/cockroachdb/cockroach/pkg/col/typeconv"
@@ -22,8 +28,11 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/sql/types"
 	"github.com/cockroachdb/cockroach/pkg/util/buildutil"
 	"github.com/cockroachdb/cockroach/pkg/util/intsets"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
 	"github.com/cockroachdb/cockroach/pkg/util/mon"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
 	"github.com/cockroachdb/errors"
+	"github.com/cockroachdb/redact"
 )
 
 // TODO(yuzefovich): audit all Operators to make sure that all static
@@ -37,10 +46,578 @@ import (
 type Allocator struct {
 	ctx context.Context
 	acc *mon.BoundAccount
+	// used is the number of bytes currently registered with acc through this
+	// allocator itself (i.e. not through its children), including the pending
+	// changes of the buffered accounting mode. Unlike acc.Used(), it doesn't
+	// include the usage of the other components sharing the account.
+	used int64
 	// unlimitedAcc might be nil and is only used in some cases when the
 	// allocation is denied by acc.
 	unlimitedAcc *mon.BoundAccount
 	factory      coldata.ColumnFactory
+	// growthPolicy determines how the capacity of the batches grows when they
+	// are reallocated by ResetMaybeReallocate methods.
+	growthPolicy GrowthPolicy
+	// releasedBatches tracks all batches released via ReleaseBatch in order
+	// to detect double releases. It is only used in test builds.
+	releasedBatches map[coldata.Batch]struct{}
+	// pool, if non-nil, is the free list of batches used by GetPooledBatch and
+	// PutPooledBatch.
+	pool *batchPool
+	// bytesEstimate, if non-nil, is the adaptive estimate of the footprint of
+	// bytes-like values used when deciding on the capacity of the batches in
+	// the ResetMaybeReallocate methods.
+	bytesEstimate *bytesEstimate
+	// decimalEstimate, if non-nil, is the estimate of the footprint of
+	// decimal values used similarly to bytesEstimate.
+	decimalEstimate *decimalEstimate
+	// vecSizer, if non-nil, is the column factory that reports the footprint
+	// of the datum-backed and JSON vectors.
+	vecSizer VecSizer
+	// child is non-nil if the allocator was created via NewChildAllocator.
+	child *childState
+	// children are all child allocators of this allocator.
+	children []*Allocator
+	// buffered, if non-nil, accumulates the changes to the memory account
+	// when the buffered accounting mode is enabled.
+	buffered *bufferedAccounting
+	// zeroOnReset indicates whether the data of the reused batches is zeroed
+	// out (see EnableZeroingOnReset).
+	zeroOnReset bool
+	// numOvergrownResets is the number of consecutive resets in the
+	// ResetMaybeReallocate methods of the batches with over-grown bytes-like
+	// vectors (see shouldShrink).
+	numOvergrownResets int
+	// budgetCallback, if non-nil, is the callback set via SetBudgetCallback.
+	budgetCallback *budgetCallback
+	// governor, if non-nil, is the BatchSizeGovernor this allocator is
+	// registered with.
+	governor *BatchSizeGovernor
+	// maxLiveBatches, if positive, is the maximum number of live batches (see
+	// SetMaxLiveBatches).
+	maxLiveBatches int
+	// maxBatchSize, if positive, overrides coldata.BatchSize() as the maximum
+	// capacity of the batches allocated by the allocator (see
+	// SetMaxBatchSize).
+	maxBatchSize int
+	// minBatchCapacity, if positive, is the floor of the desired capacity of
+	// the batches allocated by the ResetMaybeReallocate methods (see
+	// SetMinBatchCapacity).
+	minBatchCapacity int
+	// numLiveBatches is the number of batches allocated by this allocator that
+	// haven't been released yet.
+	numLiveBatches int
+	// liveBatchStacks contains the stack traces of the allocation sites of
+	// all live batches. It is only used in test builds.
+	liveBatchStacks map[coldata.Batch][]uintptr
+	// windows contains the footprint of the window vectors of each batch
+	// registered via AccountForWindow.
+	windows map[coldata.Batch]int64
+	// appendedCols contains the indices of the columns appended via
+	// MaybeAppendColumn to each batch (see ReleaseAppendedColumns).
+	appendedCols map[coldata.Batch]intsets.Fast
+	// name, if set, is the name of the monitor created via
+	// NewAllocatorWithName which is included in the memory errors.
+	name redact.RedactableString
+	// ownedMonitor, if non-nil, is the monitor created via
+	// NewAllocatorWithName that is stopped in Close.
+	ownedMonitor *mon.BytesMonitor
+	// quota, if non-nil, is the pool from which the quota is acquired before
+	// growing the memory account (see NewAllocatorWithQuota).
+	quota *QuotaPool
+	// fixedWidth, if non-nil, is the fixed-width schema the allocator was
+	// specialized for via NewFixedWidthAllocator.
+	fixedWidth *fixedWidthSchema
+	// mu, if non-nil, protects the accounting state of the allocator created
+	// via NewConcurrentAllocator (see lock).
+	mu *syncutil.Mutex
+	// knobs are the testing knobs of the allocator.
+	knobs TestingKnobs
+	// numGrowths is the number of times the memory account has been asked to
+	// grow since the testing knobs were set. It is only maintained when the
+	// knobs are set.
+	numGrowths int
+	// atomics contains the statistics of the allocator (see Stats). They are
+	// only modified by the goroutine using the allocator but are accessed
+	// atomically so that Stats can be called concurrently.
+	atomics struct {
+		allocatedBytes   int64
+		currentBytes     int64
+		maxBytes         int64
+		numReallocations int64
+		// numResetsByReason is indexed by ReallocReason.
+		numResetsByReason [numReallocReasons]int64
+		// numMemoryLimitedAllocations, copiedBytes, and numChurnWindows are
+		// described in AllocatorStats.
+		numMemoryLimitedAllocations int64
+		copiedBytes                 int64
+		numChurnWindows             int64
+	}
+	// churn tracks the reallocations within the current window of
+	// reallocChurnWindow consecutive resets (see recordReset).
+	churn struct {
+		numResets   int
+		numReallocs int
+	}
+}
+
+// AllocatorStats describes the memory usage of an Allocator over its lifetime.
+// Only the memory registered with the (limited) memory account through the
+// allocator itself is included (i.e. not through its children).
+type AllocatorStats struct {
+	// AllocatedBytes is the cumulative number of bytes registered.
+	AllocatedBytes int64
+	// CurrentBytes is the number of bytes currently registered.
+	CurrentBytes int64
+	// MaxBytes is the high-water mark of CurrentBytes.
+	MaxBytes int64
+	// NumReallocations is the number of times the ResetMaybeReallocate methods
+	// (including the ones of the accounting helpers) returned a newly allocated
+	// batch.
+	NumReallocations int64
+	// NumResetsByReason is the number of times the ResetMaybeReallocate
+	// methods made each decision, indexed by ReallocReason.
+	NumResetsByReason [numReallocReasons]int64
+	// NumMemoryLimitedAllocations is the number of times the
+	// ResetMaybeReallocate methods allocated a new batch without an old batch
+	// (including when the AccountingHelper discarded the old batch) and had to
+	// reduce its capacity because of the memory limit.
+	NumMemoryLimitedAllocations int64
+	// CopiedBytes is the estimated number of bytes copied by AppendBatch and
+	// GrowCapacity (according to the static estimate of the footprint of the
+	// copied rows, see EstimateBatchSizeBytes).
+	CopiedBytes int64
+	// NumChurnWindows is the number of windows of reallocChurnWindow
+	// consecutive resets in which the batch was reallocated more than
+	// reallocChurnThreshold times.
+	NumChurnWindows int64
+}
+
+// Add adds the statistics of another allocator to s, which can be used to
+// aggregate the statistics of all allocators of a flow. Note that MaxBytes
+// becomes the sum of the high-water marks, which is an upper bound on the
+// high-water mark of the combined usage.
+func (s *AllocatorStats) Add(other AllocatorStats) {
+	s.AllocatedBytes += other.AllocatedBytes
+	s.CurrentBytes += other.CurrentBytes
+	s.MaxBytes += other.MaxBytes
+	s.NumReallocations += other.NumReallocations
+	for i := range s.NumResetsByReason {
+		s.NumResetsByReason[i] += other.NumResetsByReason[i]
+	}
+	s.NumMemoryLimitedAllocations += other.NumMemoryLimitedAllocations
+	s.CopiedBytes += other.CopiedBytes
+	s.NumChurnWindows += other.NumChurnWindows
+}
+
+// Stats returns the statistics of the allocator. It can be called concurrently
+// with the usage of the allocator.
+func (a *Allocator) Stats() AllocatorStats {
+	stats := AllocatorStats{
+		AllocatedBytes:   atomic.LoadInt64(&a.atomics.allocatedBytes),
+		CurrentBytes:     atomic.LoadInt64(&a.atomics.currentBytes),
+		MaxBytes:         atomic.LoadInt64(&a.atomics.maxBytes),
+		NumReallocations: atomic.LoadInt64(&a.atomics.numReallocations),
+
+		NumMemoryLimitedAllocations: atomic.LoadInt64(&a.atomics.numMemoryLimitedAllocations),
+		CopiedBytes:                 atomic.LoadInt64(&a.atomics.copiedBytes),
+		NumChurnWindows:             atomic.LoadInt64(&a.atomics.numChurnWindows),
+	}
+	for i := range stats.NumResetsByReason {
+		stats.NumResetsByReason[i] = atomic.LoadInt64(&a.atomics.numResetsByReason[i])
+	}
+	return stats
+}
+
+// recordGrowth updates the statistics after delta bytes have been registered
+// with the memory account.
+func (a *Allocator) recordGrowth(delta int64) {
+	atomic.AddInt64(&a.atomics.allocatedBytes, delta)
+	if cur := atomic.AddInt64(&a.atomics.currentBytes, delta); cur > atomic.LoadInt64(&a.atomics.maxBytes) {
+		atomic.StoreInt64(&a.atomics.maxBytes, cur)
+	}
+	if a.governor != nil {
+		a.governor.adjust(delta)
+	}
+}
+
+// recordRelease updates the statistics after size bytes have been released
+// from the memory account.
+func (a *Allocator) recordRelease(size int64) {
+	atomic.AddInt64(&a.atomics.currentBytes, -size)
+	if a.governor != nil {
+		a.governor.adjust(-size)
+	}
+}
+
+// ErrChildSoftLimitExceeded marks the errors that occur when a child allocator
+// (see Allocator.NewChildAllocator) exceeds its soft limit.
+var ErrChildSoftLimitExceeded = errors.New("child allocator soft limit exceeded")
+
+// childState is the state of an allocator created via NewChildAllocator.
+type childState struct {
+	name      string
+	softLimit int64
+}
+
+func (c *childState) softLimitExceededError(delta, used int64) error {
+	return errors.Mark(errors.Newf(
+		"%s: soft limit of %d bytes exceeded: %d bytes requested, %d bytes already used",
+		c.name, c.softLimit, delta, used,
+	), ErrChildSoftLimitExceeded)
+}
+
+// ErrMaxLiveBatchesExceeded marks the errors that occur when an allocator
+// exceeds its maximum number of live batches (see SetMaxLiveBatches).
+var ErrMaxLiveBatchesExceeded = errors.New("maximum number of live batches exceeded")
+
+// SetMaxLiveBatches sets the maximum number of batches allocated by the
+// allocator (via the NewMemBatch* and ResetMaybeReallocate methods, including
+// the ones of the accounting helpers) that haven't been released (either
+// explicitly via ReleaseBatch or implicitly when the batch is reallocated).
+// Exceeding the maximum is treated as a batch leak, and an assertion failure
+// marked with ErrMaxLiveBatchesExceeded is thrown. It allows to detect the
+// leaks long before the memory budget is exhausted. Zero disables the check.
+func (a *Allocator) SetMaxLiveBatches(maxLiveBatches int) {
+	if maxLiveBatches < 0 {
+		colexecerror.InternalError(errors.AssertionFailedf("invalid maxLiveBatches %d", maxLiveBatches))
+	}
+	a.maxLiveBatches = maxLiveBatches
+}
+
+// SetMaxBatchSize overrides coldata.BatchSize() as the maximum capacity of the
+// batches allocated by the allocator whenever the capacity is decided by the
+// allocator itself (i.e. by NewMemBatchWithMaxCapacity,
+// NewMemBatchWithMaxMemory, and the ResetMaybeReallocate methods, including
+// the ones of the accounting helpers). It allows the individual queries to use
+// smaller (or larger) batches than the global default. maxBatchSize must be in
+// [1, coldata.MaxBatchSize] range.
+//
+// The child allocators created afterwards inherit the override.
+func (a *Allocator) SetMaxBatchSize(maxBatchSize int) {
+	if maxBatchSize < 1 || maxBatchSize > coldata.MaxBatchSize {
+		colexecerror.InternalError(errors.AssertionFailedf(
+			"invalid max batch size %d, should be in [1, %d] range", maxBatchSize, coldata.MaxBatchSize,
+		))
+	}
+	a.maxBatchSize = maxBatchSize
+}
+
+// SetMinBatchCapacity sets the floor of the desired capacity of the batches
+// allocated by the ResetMaybeReallocate methods (including the ones of the
+// accounting helpers), so that the workloads that are known to process many
+// rows (e.g. according to a session setting or the row count estimate of the
+// optimizer) don't have to go through several reallocations while the
+// capacity grows from 1. minBatchCapacity must be in
+// [1, coldata.MaxBatchSize] range.
+//
+// The floor is a request rather than a guarantee: the capacity is still capped
+// by the maximum batch size (coldata.BatchSize() or the override set via
+// SetMaxBatchSize), and the memory limit still applies, so a smaller batch can
+// be allocated when the budget is tight.
+//
+// The child allocators created afterwards inherit the floor.
+func (a *Allocator) SetMinBatchCapacity(minBatchCapacity int) {
+	if minBatchCapacity < 1 || minBatchCapacity > coldata.MaxBatchSize {
+		colexecerror.InternalError(errors.AssertionFailedf(
+			"invalid min batch capacity %d, should be in [1, %d] range", minBatchCapacity, coldata.MaxBatchSize,
+		))
+	}
+	a.minBatchCapacity = minBatchCapacity
+}
+
+// getMaxBatchSize returns the maximum capacity of the batches allocated by the
+// allocator (see SetMaxBatchSize).
+func (a *Allocator) getMaxBatchSize() int {
+	if a.maxBatchSize > 0 {
+		return a.maxBatchSize
+	}
+	return coldata.BatchSize()
+}
+
+// batchAllocated must be called whenever a new batch is about to be
+// allocated. It throws an error if the maximum number of live batches would be
+// exceeded.
+func (a *Allocator) batchAllocated() {
+	a.lock()
+	defer a.unlock()
+	if a.maxLiveBatches > 0 && a.numLiveBatches >= a.maxLiveBatches {
+		colexecerror.InternalError(errors.Mark(errors.AssertionFailedf(
+			"allocator of %s has %d live batches which reaches the maximum of %d, likely a batch leak",
+			a.monitorName(), a.numLiveBatches, a.maxLiveBatches,
+		), ErrMaxLiveBatchesExceeded))
+	}
+	a.numLiveBatches++
+}
+
+// trackBatch must be called once a new batch has been allocated. In test
+// builds, it captures the stack trace of the allocation site.
+func (a *Allocator) trackBatch(b coldata.Batch) {
+	if buildutil.CrdbTestBuild {
+		a.lock()
+		defer a.unlock()
+		if a.liveBatchStacks == nil {
+			a.liveBatchStacks = make(map[coldata.Batch][]uintptr)
+		}
+		pcs := make([]uintptr, 32)
+		// Skip runtime.Callers, trackBatch, and the allocator method.
+		a.liveBatchStacks[b] = pcs[:runtime.Callers(3, pcs)]
+	}
+}
+
+// batchReleased must be called whenever a batch is released. b can be nil if
+// the batch hasn't been allocated after all.
+func (a *Allocator) batchReleased(b coldata.Batch) {
+	a.lock()
+	defer a.unlock()
+	if a.numLiveBatches > 0 {
+		a.numLiveBatches--
+	}
+	if buildutil.CrdbTestBuild && b != nil {
+		delete(a.liveBatchStacks, b)
+	}
+}
+
+// monitorName returns the name of the monitor of the allocator (as well as of
+// the child allocator, if applicable) to be used in the error messages.
+func (a *Allocator) monitorName() redact.RedactableString {
+	name := a.acc.Monitor().Name()
+	if a.child != nil {
+		name = redact.Sprintf("%s (child %s)", name, a.child.name)
+	}
+	return name
+}
+
+// AssertEmpty verifies that all batches allocated by the allocator have been
+// released and that no memory is attributed to the allocator. It should be
+// called once the allocator is no longer used (before its memory account is
+// closed) in order to detect the components that forgot to release their
+// memory. If the verification fails, an assertion failure that includes the
+// stack traces of the allocation sites of all live batches is thrown.
+//
+// The verification is only performed in test builds.
+func (a *Allocator) AssertEmpty() {
+	if !buildutil.CrdbTestBuild {
+		return
+	}
+	a.lock()
+	defer a.unlock()
+	used := a.usedLocked()
+	if used == 0 && a.numLiveBatches == 0 {
+		return
+	}
+	var stacks strings.Builder
+	for _, pcs := range a.liveBatchStacks {
+		stacks.WriteString("\nbatch allocated at:")
+		frames := runtime.CallersFrames(pcs)
+		for {
+			frame, more := frames.Next()
+			fmt.Fprintf(&stacks, "\n\t%s\n\t\t%s:%d", frame.Function, frame.File, frame.Line)
+			if !more {
+				break
+			}
+		}
+	}
+	colexecerror.InternalError(errors.AssertionFailedf(
+		"allocator of %s is not empty: %d bytes are used and %d batches haven't been released%s",
+		a.monitorName(), used, a.numLiveBatches, stacks.String(),
+	))
+}
+
+// VecSizer can be implemented by a coldata.ColumnFactory in order to report
+// the actual memory footprint of the datum-backed and JSON vectors it creates
+// (e.g. based on tree.Datum.Size() of the values that have been set). The
+// Allocator then uses it, rather than its own estimates, whenever it measures
+// such vectors (in PerformOperation, PerformAppend, the ResetMaybeReallocate
+// methods, etc). It is never consulted for the vectors of other types.
+//
+// The footprint of a newly-allocated vector must match what
+// EstimateBatchSizeBytes returns for it since that is what the Allocator
+// registers on allocation.
+type VecSizer interface {
+	// VecSize returns the memory footprint of the elements of vec starting
+	// from startIdx, or false if the Allocator should use its own estimate.
+	VecSize(vec *coldata.Vec, startIdx int) (size int64, ok bool)
+}
+
+// adaptiveEstimateWeight is the weight of the newest observation in the
+// exponentially-weighted moving averages of bytesEstimate and decimalEstimate.
+const adaptiveEstimateWeight = 0.5
+
+// bytesEstimate tracks the exponentially-weighted moving average of the
+// memory footprint per row of a single bytes-like vector as observed on the
+// previously filled batches.
+type bytesEstimate struct {
+	// perRow starts out at coldata.ElementSize, which is what
+	// EstimateBatchSizeBytes assumes.
+	perRow float64
+}
+
+// observe updates the estimate according to the bytes-like vectors of the
+// given batch that has the given type schema. It is a noop if the batch is
+// empty or has no such vectors. The enum vectors are ignored since their
+// footprint is estimated from the type metadata.
+func (e *bytesEstimate) observe(typs []*types.T, b coldata.Batch) {
+	length := b.Length()
+	if length == 0 {
+		return
+	}
+	var total int64
+	var numVecs int
+	for i, vec := range b.ColVecs() {
+		var bytes *coldata.Bytes
+		switch vec.CanonicalTypeFamily() {
+		case types.BytesFamily:
+			if typs[i].Family() == types.EnumFamily {
+				continue
+			}
+			bytes = vec.Bytes()
+		case types.JsonFamily:
+			bytes = &vec.JSON().Bytes
+		default:
+			continue
+		}
+		// Exclude the static footprint that doesn't depend on the values.
+		valuesSize := bytes.Size() - coldata.FlatBytesOverhead - int64(bytes.Len())*coldata.ElementSize
+		if valuesSize < 0 {
+			valuesSize = 0
+		}
+		total += coldata.ElementSize + valuesSize/int64(length)
+		numVecs++
+	}
+	if numVecs == 0 {
+		return
+	}
+	observed := float64(total) / float64(numVecs)
+	e.perRow = adaptiveEstimateWeight*observed + (1-adaptiveEstimateWeight)*e.perRow
+}
+
+// decimalEstimate tracks the exponentially-weighted moving average of the
+// memory footprint of a single decimal value as observed on the previously
+// filled batches. Unlike EstimateBatchSizeBytes, it includes the
+// heap-allocated part of the coefficients that don't fit inline.
+type decimalEstimate struct {
+	// perRow starts out at memsize.Decimal, which is what
+	// EstimateBatchSizeBytes assumes, unless configured otherwise via
+	// SetDecimalSizeEstimate.
+	perRow float64
+}
+
+// observe updates the estimate according to the decimal vectors of the given
+// batch. It is a noop if the batch is empty or has no such vectors.
+func (e *decimalEstimate) observe(b coldata.Batch) {
+	length := b.Length()
+	if length == 0 {
+		return
+	}
+	var total int64
+	var numVecs int
+	for _, vec := range b.ColVecs() {
+		if vec.CanonicalTypeFamily() != types.DecimalFamily {
+			continue
+		}
+		// Only the values up to the length of the batch are representative.
+		decimals := vec.Decimal()[:length:length]
+		total += sizeOfDecimals(decimals, 0 /* startIdx */) / int64(length)
+		numVecs++
+	}
+	if numVecs == 0 {
+		return
+	}
+	observed := float64(total) / float64(numVecs)
+	e.perRow = adaptiveEstimateWeight*observed + (1-adaptiveEstimateWeight)*e.perRow
+}
+
+// EnableAdaptiveBytesEstimation makes the allocator track the actual footprint
+// of the bytes-like and decimal values in the batches passed as old batches to
+// the ResetMaybeReallocate methods and use that (rather than the static
+// estimate of EstimateBatchSizeBytes) when checking whether a batch of some
+// capacity would stay within the memory limit. This allows the operators
+// processing large values to not exceed the memory limit and the ones
+// processing small values to use larger batches.
+func (a *Allocator) EnableAdaptiveBytesEstimation() {
+	a.bytesEstimate = &bytesEstimate{perRow: float64(coldata.ElementSize)}
+	if a.decimalEstimate == nil {
+		a.decimalEstimate = &decimalEstimate{perRow: float64(memsize.Decimal)}
+	}
+}
+
+// SetDecimalSizeEstimate sets the average footprint of a single decimal value
+// (including the heap-allocated part of its coefficient) that the allocator
+// assumes when checking whether a batch of some capacity would stay within
+// the memory limit in the ResetMaybeReallocate methods. It is useful when the
+// caller knows that the decimals are likely to be large (e.g. based on the
+// precision of the type). The estimate is then adapted according to the
+// decimals observed in the batches passed as old batches to the
+// ResetMaybeReallocate methods.
+func (a *Allocator) SetDecimalSizeEstimate(size int64) {
+	if size < memsize.Decimal {
+		colexecerror.InternalError(errors.AssertionFailedf(
+			"decimal size estimate %d is less than the size of apd.Decimal %d", size, memsize.Decimal,
+		))
+	}
+	a.decimalEstimate = &decimalEstimate{perRow: float64(size)}
+}
+
+// enumValueSizeEstimate returns the average footprint of a single value of the
+// given enum type in addition to coldata.ElementSize (which is what
+// EstimateBatchSizeBytes assumes for all bytes-like values). The physical
+// representations are usually short enough to be inlined into the elements of
+// coldata.Bytes, so only the ones longer than coldata.BytesMaxInlineLength
+// contribute to the average. Zero is returned if the type isn't hydrated.
+func enumValueSizeEstimate(t *types.T) float64 {
+	if t.TypeMeta.EnumData == nil {
+		return 0
+	}
+	reps := t.TypeMeta.EnumData.PhysicalRepresentations
+	if len(reps) == 0 {
+		return 0
+	}
+	var total int
+	for _, rep := range reps {
+		if len(rep) > coldata.BytesMaxInlineLength {
+			total += len(rep)
+		}
+	}
+	return float64(total) / float64(len(reps))
+}
+
+// estimateBatchSizeBytes is the same as EstimateBatchSizeBytes but also
+// includes the estimated footprint of the values: the enums are estimated
+// from the type metadata, and the bytes-like and decimal values use the
+// adaptive estimates if they are enabled.
+func (a *Allocator) estimateBatchSizeBytes(typs []*types.T, capacity int) int64 {
+	if a.fixedWidth != nil && a.fixedWidth.matches(typs) {
+		// The adaptive estimates don't apply to the fixed-width types.
+		return a.fixedWidth.estimateBatchSizeBytes(capacity)
+	}
+	estimate := EstimateBatchSizeBytes(typs, capacity)
+	var extraPerRow float64
+	for _, t := range typs {
+		switch typeconv.TypeFamilyToCanonicalTypeFamily(t.Family()) {
+		case types.BytesFamily, types.JsonFamily:
+			if t.Family() == types.EnumFamily {
+				extraPerRow += enumValueSizeEstimate(t)
+			} else if a.bytesEstimate != nil {
+				extraPerRow += a.bytesEstimate.perRow - float64(coldata.ElementSize)
+			}
+		case types.DecimalFamily:
+			if a.decimalEstimate != nil {
+				extraPerRow += a.decimalEstimate.perRow - float64(memsize.Decimal)
+			}
+		}
+	}
+	return estimate + int64(extraPerRow*float64(capacity))
+}
+
+// batchPool is a free list of batches bucketed by their capacity. The memory
+// of the pooled batches stays registered with the allocator.
+type batchPool struct {
+	buckets map[int][]coldata.Batch
+	// numBatches is the total number of batches in all buckets.
+	numBatches int
+	// maxBatches is the maximum number of batches that can be pooled.
+	maxBatches int
 }
 
 // SelVectorSize returns the memory usage of the selection vector of the given
@@ -49,27 +626,63 @@ func SelVectorSize(capacity int) int64 {
 	return int64(capacity) * memsize.Int
 }
 
-func getVecMemoryFootprint(vec *coldata.Vec) int64 {
+// NullsSize returns the memory usage of the nulls bitmap of a vector of the
+// given capacity.
+func NullsSize(capacity int) int64 {
+	if capacity <= 0 {
+		return 0
+	}
+	return int64((capacity-1)/8 + 1)
+}
+
+// getVecMemoryFootprint returns the memory footprint of the vector (including
+// its nulls bitmap and VecOverhead). sizer, if non-nil, is consulted for the datum-backed and
+// JSON vectors.
+func getVecMemoryFootprint(vec *coldata.Vec, sizer VecSizer) int64 {
 	if vec == nil {
 		return 0
 	}
+	overhead := getNullsMemoryFootprint(vec) + VecOverhead
 	switch vec.CanonicalTypeFamily() {
 	case types.BytesFamily:
-		return vec.Bytes().Size()
+		return vec.Bytes().Size() + overhead
 	case types.DecimalFamily:
-		return sizeOfDecimals(vec.Decimal(), 0 /* startIdx */)
+		return sizeOfDecimals(vec.Decimal(), 0 /* startIdx */) + overhead
 	case types.JsonFamily:
-		return vec.JSON().Size()
+		if sizer != nil {
+			if size, ok := sizer.VecSize(vec, 0 /* startIdx */); ok {
+				return size + overhead
+			}
+		}
+		return vec.JSON().Size() + overhead
 	case typeconv.DatumVecCanonicalTypeFamily:
-		return vec.Datum().Size(0 /* startIdx */)
+		return getDatumVecMemoryFootprint(vec, 0 /* startIdx */, sizer) + overhead
+	}
+	return GetFixedSizeTypeSize(vec.Type())*int64(vec.Capacity()) + overhead
+}
+
+// getNullsMemoryFootprint returns the memory footprint of the nulls bitmap of
+// the vector.
+func getNullsMemoryFootprint(vec *coldata.Vec) int64 {
+	return int64(cap(vec.Nulls().NullBitmap()))
+}
+
+// getDatumVecMemoryFootprint returns the memory footprint of the elements of
+// the datum-backed vector starting from startIdx. sizer, if non-nil, is
+// consulted first.
+func getDatumVecMemoryFootprint(vec *coldata.Vec, startIdx int, sizer VecSizer) int64 {
+	if sizer != nil {
+		if size, ok := sizer.VecSize(vec, startIdx); ok {
+			return size
+		}
 	}
-	return EstimateBatchSizeBytes([]*types.T{vec.Type()}, vec.Capacity())
+	return vec.Datum().Size(startIdx)
 }
 
-func getVecsMemoryFootprint(vecs []*coldata.Vec) int64 {
+func getVecsMemoryFootprint(vecs []*coldata.Vec, sizer VecSizer) int64 {
 	var size int64
 	for _, dest := range vecs {
-		size += getVecMemoryFootprint(dest)
+		size += getVecMemoryFootprint(dest, sizer)
 	}
 	return size
 }
@@ -80,6 +693,16 @@ func init() {
 
 // GetBatchMemSize returns the total memory footprint of the batch.
 func GetBatchMemSize(b coldata.Batch) int64 {
+	return getBatchMemSize(b, nil /* sizer */)
+}
+
+// getBatchMemSize returns the total memory footprint of the batch using the
+// VecSizer of the allocator, if any.
+func (a *Allocator) getBatchMemSize(b coldata.Batch) int64 {
+	return getBatchMemSize(b, a.vecSizer)
+}
+
+func getBatchMemSize(b coldata.Batch, sizer VecSizer) int64 {
 	if b == nil || b == coldata.ZeroBatch {
 		return 0
 	}
@@ -88,7 +711,7 @@ func GetBatchMemSize(b coldata.Batch) int64 {
 	// below.
 	usesSel := b.Selection() != nil
 	b.SetSelection(true)
-	memUsage := SelVectorSize(cap(b.Selection())) + getVecsMemoryFootprint(b.ColVecs())
+	memUsage := BatchOverhead + SelVectorSize(cap(b.Selection())) + getVecsMemoryFootprint(b.ColVecs(), sizer)
 	b.SetSelection(usesSel)
 	return memUsage
 }
@@ -111,9 +734,9 @@ func GetProportionalBatchMemSize(b coldata.Batch, length int64) int64 {
 	for _, vec := range b.ColVecs() {
 		switch vec.CanonicalTypeFamily() {
 		case types.BytesFamily, types.JsonFamily:
-			proportionalBatchMemSize += coldata.ProportionalSize(vec, length)
+			proportionalBatchMemSize += coldata.ProportionalSize(vec, length) + NullsSize(int(length))
 		default:
-			proportionalBatchMemSize += getVecMemoryFootprint(vec) * length / int64(vec.Capacity())
+			proportionalBatchMemSize += getVecMemoryFootprint(vec, nil /* sizer */) * length / int64(vec.Capacity())
 		}
 	}
 	return proportionalBatchMemSize
@@ -124,11 +747,13 @@ func GetProportionalBatchMemSize(b coldata.Batch, length int64) int64 {
 func NewAllocator(
 	ctx context.Context, unlimitedAcc *mon.BoundAccount, factory coldata.ColumnFactory,
 ) *Allocator {
-	return &Allocator{
+	a := &Allocator{
 		ctx:     ctx,
 		acc:     unlimitedAcc,
 		factory: factory,
 	}
+	a.vecSizer, _ = factory.(VecSizer)
+	return a
 }
 
 // NewLimitedAllocator constructs a new Allocator instance which works with a
@@ -140,12 +765,376 @@ func NewAllocator(
 func NewLimitedAllocator(
 	ctx context.Context, limitedAcc, unlimitedAcc *mon.BoundAccount, factory coldata.ColumnFactory,
 ) *Allocator {
-	return &Allocator{
+	a := &Allocator{
 		ctx:          ctx,
 		acc:          limitedAcc,
 		unlimitedAcc: unlimitedAcc,
 		factory:      factory,
 	}
+	a.vecSizer, _ = factory.(VecSizer)
+	return a
+}
+
+// NewChildAllocator constructs a new Allocator that shares the memory account
+// of this allocator (so the hard limit of the account applies to the parent and
+// all of its children together) but additionally tracks its own usage against
+// the given soft limit. It is meant for the operators that want to split the
+// memory between several of their components (e.g. the build and the probe
+// sides of a join) so that one component cannot starve the others.
+//
+// If an allocation through the child allocator exceeds its soft limit, then an
+// error marked with ErrChildSoftLimitExceeded is thrown as an expected error,
+// and the operator can catch it in order to spill only the corresponding
+// component to disk. Used of the parent includes the usage of all children.
+//
+// The child allocator doesn't use the unlimited memory account of the parent
+// and cannot have children of its own.
+func (a *Allocator) NewChildAllocator(name string, softLimitBytes int64) *Allocator {
+	if a.child != nil {
+		colexecerror.InternalError(errors.AssertionFailedf("child allocator %s cannot have children", a.child.name))
+	}
+	a.assertNotConcurrent("child allocators")
+	if softLimitBytes <= 0 {
+		colexecerror.InternalError(errors.AssertionFailedf("invalid soft limit %d", softLimitBytes))
+	}
+	child := &Allocator{
+		ctx:              a.ctx,
+		acc:              a.acc,
+		factory:          a.factory,
+		growthPolicy:     a.growthPolicy,
+		vecSizer:         a.vecSizer,
+		child:            &childState{name: name, softLimit: softLimitBytes},
+		governor:         a.governor,
+		maxBatchSize:     a.maxBatchSize,
+		minBatchCapacity: a.minBatchCapacity,
+		name:             a.name,
+		quota:            a.quota,
+		fixedWidth:       a.fixedWidth,
+	}
+	a.children = append(a.children, child)
+	return child
+}
+
+// DefaultBufferedAccountingThreshold is the threshold of the buffered
+// accounting mode that should be used unless the caller has a reason to use
+// a different one.
+const DefaultBufferedAccountingThreshold = 64 << 10 /* 64 KiB */
+
+// bufferedAccounting accumulates the changes to the memory account of an
+// allocator so that the monitor (which is protected by a mutex and is shared
+// by many components) isn't contacted on every small change.
+type bufferedAccounting struct {
+	// threshold is the maximum absolute value of pending.
+	threshold int64
+	// pending is the number of bytes that have been registered with the
+	// allocator but not with the memory account yet. It is negative if more
+	// bytes have been released than registered since the last flush.
+	pending int64
+}
+
+// EnableBufferedAccounting enables the buffered accounting mode in which the
+// changes to the memory usage are accumulated locally and are registered with
+// the memory account only once the pending amount reaches threshold bytes (in
+// either direction) or when Flush is called. As a result, the memory account
+// is never under-reported by more than threshold bytes (and the memory limit
+// is enforced with the same precision).
+//
+// The pending changes are flushed by ReleaseAll and Close, so the monitor
+// observes the peak usage of the allocator once the operator is closed. The
+// caller is responsible for calling Flush before the usage of the memory
+// account is reported otherwise (e.g. in the execution statistics).
+//
+// The buffered accounting mode cannot be used by the child allocators.
+func (a *Allocator) EnableBufferedAccounting(threshold int64) {
+	if a.child != nil {
+		colexecerror.InternalError(errors.AssertionFailedf(
+			"buffered accounting cannot be used by child allocator %s", a.child.name,
+		))
+	}
+	a.assertNotConcurrent("buffered accounting")
+	if threshold <= 0 {
+		colexecerror.InternalError(errors.AssertionFailedf("invalid buffered accounting threshold %d", threshold))
+	}
+	a.Flush()
+	a.buffered = &bufferedAccounting{threshold: threshold}
+}
+
+// Flush registers all changes to the memory usage accumulated in the buffered
+// accounting mode with the memory account. It is a noop if the mode is not
+// enabled.
+func (a *Allocator) Flush() {
+	b := a.buffered
+	if b == nil || b.pending == 0 {
+		return
+	}
+	if b.pending < 0 {
+		a.acc.Shrink(a.ctx, -b.pending)
+	} else if err := a.acc.Grow(a.ctx, b.pending); err != nil {
+		// The pending bytes have already been allocated, so we keep them in
+		// order to not lose track of them.
+		throwMemoryError(a.annotateAccountError(err))
+	}
+	b.pending = 0
+}
+
+// tryFlush is like Flush, but the pending growth is dropped if the memory
+// account cannot be grown instead of throwing an error. It is used when the
+// usage of the allocator is about to be released, so an error only means that
+// the peak usage isn't observed by the monitor.
+func (a *Allocator) tryFlush() {
+	b := a.buffered
+	if b == nil || b.pending == 0 {
+		return
+	}
+	if b.pending < 0 {
+		a.acc.Shrink(a.ctx, -b.pending)
+	} else {
+		_ = a.acc.Grow(a.ctx, b.pending)
+	}
+	b.pending = 0
+}
+
+// budgetCallback is the callback invoked when the usage of the allocator
+// crosses a fraction of the limit of the monitor.
+type budgetCallback struct {
+	threshold float64
+	fn        func(used, limit int64)
+	// crossed is true if the callback has been invoked and the usage hasn't
+	// dropped below the threshold since.
+	crossed bool
+	// running is true while fn is being invoked.
+	running bool
+}
+
+// SetBudgetCallback sets the callback that is invoked when the memory usage of
+// the allocator (see Used) crosses the given fraction of the limit of the
+// monitor of its memory account. This allows the operators that can spill to
+// disk to react as soon as the memory usage becomes high instead of polling
+// it. The callback is invoked at most once per crossing: once it has been
+// invoked, it won't be invoked again until the usage drops below the
+// threshold and then crosses it again.
+//
+// The callback is invoked synchronously, on the goroutine that performs the
+// allocation (after the allocation has been registered), and is never invoked
+// re-entrantly (i.e. the allocations performed by the callback itself don't
+// trigger it). Passing nil fn unsets the callback.
+func (a *Allocator) SetBudgetCallback(threshold float64, fn func(used, limit int64)) {
+	if fn == nil {
+		a.budgetCallback = nil
+		return
+	}
+	a.assertNotConcurrent("budget callback")
+	if threshold <= 0 || threshold > 1 {
+		colexecerror.InternalError(errors.AssertionFailedf("invalid budget callback threshold %f", threshold))
+	}
+	a.budgetCallback = &budgetCallback{threshold: threshold, fn: fn}
+}
+
+// exceeded returns whether the usage of the allocator is at least the
+// threshold of the callback, as well as the usage and the limit.
+func (cb *budgetCallback) exceeded(a *Allocator) (_ bool, used, limit int64) {
+	m := a.acc.Monitor()
+	if m == nil {
+		return false, 0, 0
+	}
+	used, limit = a.Used(), m.Limit()
+	return float64(used) >= cb.threshold*float64(limit), used, limit
+}
+
+// maybeInvokeBudgetCallback invokes the budget callback if the usage has just
+// crossed its threshold.
+func (a *Allocator) maybeInvokeBudgetCallback() {
+	cb := a.budgetCallback
+	if cb == nil || cb.crossed || cb.running {
+		return
+	}
+	if exceeded, used, limit := cb.exceeded(a); exceeded {
+		cb.running = true
+		defer func() {
+			cb.running = false
+			// The callback might have changed the usage (e.g. by spilling to
+			// disk), so it is only invoked again once the usage crosses the
+			// threshold from below.
+			cb.crossed, _, _ = cb.exceeded(a)
+		}()
+		cb.fn(used, limit)
+	}
+}
+
+// maybeRearmBudgetCallback allows the budget callback to be invoked again if
+// the usage has dropped below its threshold.
+func (a *Allocator) maybeRearmBudgetCallback() {
+	if cb := a.budgetCallback; cb != nil && cb.crossed {
+		if exceeded, _, _ := cb.exceeded(a); !exceeded {
+			cb.crossed = false
+		}
+	}
+}
+
+// TestingKnobs are the testing knobs of the Allocator, which allow for
+// deterministically injecting the memory budget exceeded errors.
+//
+// The errors are injected when the allocator registers new memory with its
+// account, which is done by the NewMemBatch*, PerformOperation, PerformAppend,
+// AdjustMemoryUsage* and ResetMaybeReallocate methods (among others) as long
+// as the amount of memory to register is positive.
+type TestingKnobs struct {
+	// FailOnGrowthNum, if positive, makes the allocator reject the Nth (1-based)
+	// registration of new memory.
+	FailOnGrowthNum int
+	// FailOnGrowthIf, if set, is called with the number of bytes of every
+	// registration of new memory, and the registration is rejected if it
+	// returns true.
+	FailOnGrowthIf func(delta int64) bool
+}
+
+// TestingSetKnobs sets the testing knobs of the allocator and resets the count
+// of the registrations of new memory. It should only be used in tests.
+func (a *Allocator) TestingSetKnobs(knobs TestingKnobs) {
+	a.knobs = knobs
+	a.numGrowths = 0
+}
+
+// maybeInjectError returns a memory budget exceeded error if the testing knobs
+// dictate that the growth of the memory account by delta bytes should fail.
+func (a *Allocator) maybeInjectError(delta int64) error {
+	if a.knobs.FailOnGrowthNum <= 0 && a.knobs.FailOnGrowthIf == nil {
+		return nil
+	}
+	a.numGrowths++
+	if a.numGrowths == a.knobs.FailOnGrowthNum || (a.knobs.FailOnGrowthIf != nil && a.knobs.FailOnGrowthIf(delta)) {
+		return mon.NewMemoryBudgetExceededError(delta, a.acc.Used(), a.acc.Monitor().Limit())
+	}
+	return nil
+}
+
+// growAccount grows the memory account of the allocator by delta bytes. If
+// the allocator is a child, then its soft limit is checked too. If
+// afterAllocation is true, then delta is registered with the child even if its
+// soft limit is exceeded (since the memory has already been allocated), and
+// the error is returned afterwards.
+func (a *Allocator) growAccount(delta int64, afterAllocation bool) error {
+	if a.quota == nil {
+		_, err := a.growAccountInternal(delta, afterAllocation)
+		return err
+	}
+	if delta > 0 {
+		// The quota is acquired before locking the allocator since the
+		// acquisition might block until the quota is released by others.
+		if err := a.quota.acquire(a.ctx, delta); err != nil {
+			return a.annotateAccountError(err)
+		}
+	}
+	registered, err := a.growAccountInternal(delta, afterAllocation)
+	if !registered && delta > 0 {
+		a.quota.release(delta)
+	} else if registered && delta < 0 {
+		a.quota.release(-delta)
+	}
+	return err
+}
+
+// growAccountInternal is the implementation of growAccount which also returns
+// whether delta has been registered with the allocator.
+func (a *Allocator) growAccountInternal(
+	delta int64, afterAllocation bool,
+) (registered bool, _ error) {
+	a.lock()
+	defer a.unlock()
+	if err := a.maybeInjectError(delta); err != nil {
+		return false, err
+	}
+	if a.child == nil {
+		if b := a.buffered; b != nil && b.pending+delta < b.threshold {
+			b.pending += delta
+		} else {
+			var pending int64
+			if b != nil {
+				pending = b.pending
+			}
+			if err := a.acc.Grow(a.ctx, pending+delta); err != nil {
+				return false, a.annotateAccountError(err)
+			}
+			if b != nil {
+				b.pending = 0
+			}
+		}
+		a.used += delta
+		a.recordGrowth(delta)
+		a.maybeInvokeBudgetCallback()
+		return true, nil
+	}
+	var softLimitErr error
+	if a.used+delta > a.child.softLimit {
+		softLimitErr = a.child.softLimitExceededError(delta, a.used)
+		if !afterAllocation {
+			return false, softLimitErr
+		}
+	}
+	if err := a.acc.Grow(a.ctx, delta); err != nil {
+		return false, a.annotateAccountError(err)
+	}
+	a.used += delta
+	a.recordGrowth(delta)
+	a.maybeInvokeBudgetCallback()
+	return true, softLimitErr
+}
+
+// WillFit returns whether a new batch of the given type schema and capacity
+// would fit within the budget of the allocator according to the estimated
+// footprint of the batch (the same estimate that is registered by
+// NewMemBatchWithFixedCapacity). See WillFitBytes for more details.
+func (a *Allocator) WillFit(typs []*types.T, capacity int) bool {
+	return a.WillFitBytes(SelVectorSize(capacity) + a.estimateFixedWidthBatchSizeBytes(typs, capacity))
+}
+
+// WillFitBytes returns whether the memory account of the allocator could be
+// grown by size bytes without exceeding the limit of its monitor (as well as
+// the soft limit of the child allocator). It doesn't modify the account and is
+// meant to be used as a cheap heuristic, e.g. by the disk-backed operators to
+// decide to spill to disk before hitting the memory error.
+//
+// The answer is inherently racy since the monitor might be shared with other
+// components (or the other goroutines using the concurrent allocator) that
+// can grow their accounts right after the check. Additionally, only the limit
+// of the monitor itself is consulted (i.e. not the budget of its parents), and
+// the rounding of the reservations done by the monitor is ignored.
+func (a *Allocator) WillFitBytes(size int64) bool {
+	if size <= 0 {
+		return true
+	}
+	a.lock()
+	defer a.unlock()
+	if a.child != nil && a.used+size > a.child.softLimit {
+		return false
+	}
+	need := size
+	if a.buffered != nil {
+		need += a.buffered.pending
+	}
+	// The bytes that have been reserved by the account but aren't used yet
+	// don't have to be requested from the monitor.
+	need -= a.acc.Allocated() - a.acc.Used()
+	if need <= 0 {
+		return true
+	}
+	m := a.acc.Monitor()
+	if m == nil {
+		// The account is standalone unlimited.
+		return true
+	}
+	// NB: the condition is written in this manner to handle the overflow.
+	return m.AllocBytes() <= m.Limit()-need
+}
+
+// throwMemoryError propagates the error that occurred when growing the memory
+// account. The soft limit errors of the child allocators are expected to be
+// caught by the operators, so they are not treated as internal errors.
+func throwMemoryError(err error) {
+	if errors.Is(err, ErrChildSoftLimitExceeded) {
+		colexecerror.ExpectedError(err)
+	}
+	colexecerror.InternalError(err)
 }
 
 // NewMemBatchWithFixedCapacity allocates a new in-memory coldata.Batch with the
@@ -153,48 +1142,219 @@ func NewLimitedAllocator(
 // Note: consider whether you want the dynamic batch size behavior (in which
 // case you should be using ResetMaybeReallocate).
 func (a *Allocator) NewMemBatchWithFixedCapacity(typs []*types.T, capacity int) coldata.Batch {
-	estimatedMemoryUsage := SelVectorSize(capacity) + EstimateBatchSizeBytes(typs, capacity)
-	if err := a.acc.Grow(a.ctx, estimatedMemoryUsage); err != nil {
-		colexecerror.InternalError(err)
+	b, err := a.TryNewMemBatchWithFixedCapacity(typs, capacity)
+	if err != nil {
+		throwMemoryError(err)
+	}
+	return b
+}
+
+// TryNewMemBatchWithFixedCapacity is the same as NewMemBatchWithFixedCapacity
+// but returns the memory error instead of panicking, so it can be used outside
+// of colexecerror.CatchVectorizedRuntimeError. No batch is allocated if the
+// error is returned.
+func (a *Allocator) TryNewMemBatchWithFixedCapacity(
+	typs []*types.T, capacity int,
+) (coldata.Batch, error) {
+	a.batchAllocated()
+	estimatedMemoryUsage := SelVectorSize(capacity) + a.estimateFixedWidthBatchSizeBytes(typs, capacity)
+	if err := a.growAccount(estimatedMemoryUsage, false /* afterAllocation */); err != nil {
+		a.batchReleased(nil /* b */)
+		return nil, err
+	}
+	b := coldata.NewMemBatchWithCapacity(typs, capacity, a.factory)
+	a.trackBatch(b)
+	return b, nil
+}
+
+// EnableBatchPool enables the pool of batches used by GetPooledBatch and
+// PutPooledBatch. At most maxPooledBatches batches are retained by the pool,
+// and their memory stays registered with the allocator while they are pooled.
+func (a *Allocator) EnableBatchPool(maxPooledBatches int) {
+	if maxPooledBatches < 1 {
+		colexecerror.InternalError(errors.AssertionFailedf("invalid maxPooledBatches %d", maxPooledBatches))
+	}
+	a.pool = &batchPool{
+		buckets:    make(map[int][]coldata.Batch),
+		maxBatches: maxPooledBatches,
+	}
+}
+
+// GetPooledBatch returns a batch with the given schema and capacity. If the
+// batch pool is enabled and has such a batch, then that batch is returned (in
+// a "reset" state) without any new allocations or memory accounting; otherwise,
+// a new batch is allocated via NewMemBatchWithFixedCapacity.
+func (a *Allocator) GetPooledBatch(typs []*types.T, capacity int) coldata.Batch {
+	if a.pool != nil {
+		bucket := a.pool.buckets[capacity]
+		for i, b := range bucket {
+			if batchHasTypes(b, typs) {
+				bucket[i] = bucket[len(bucket)-1]
+				bucket[len(bucket)-1] = nil
+				a.pool.buckets[capacity] = bucket[:len(bucket)-1]
+				a.pool.numBatches--
+				return b
+			}
+		}
+	}
+	return a.NewMemBatchWithFixedCapacity(typs, capacity)
+}
+
+// PutPooledBatch returns the batch to the pool of the allocator so that it can
+// be reused by GetPooledBatch. The caller must lose all references to the
+// batch. The memory of the batch is released if the batch pool is disabled or
+// full.
+func (a *Allocator) PutPooledBatch(b coldata.Batch) {
+	if b == nil || b == coldata.ZeroBatch {
+		return
+	}
+	if a.pool == nil {
+		a.ReleaseMemory(a.getBatchMemSize(b))
+		a.batchReleased(b)
+		return
+	}
+	capacity := b.Capacity()
+	if buildutil.CrdbTestBuild {
+		for _, pooled := range a.pool.buckets[capacity] {
+			if pooled == b {
+				colexecerror.InternalError(errors.AssertionFailedf("batch has already been pooled"))
+			}
+		}
+	}
+	if a.pool.numBatches >= a.pool.maxBatches {
+		a.ReleaseMemory(a.getBatchMemSize(b))
+		a.batchReleased(b)
+		return
+	}
+	a.resetBatch(b)
+	a.pool.buckets[capacity] = append(a.pool.buckets[capacity], b)
+	a.pool.numBatches++
+}
+
+// EnableZeroingOnReset makes the allocator zero out the data of all vectors of
+// the batches that are reused by the ResetMaybeReallocate methods (as well as
+// of the batches put into the pool) in addition to resetting them. This is a
+// hardening measure which ensures that the values set in a batch cannot be
+// observed once the batch is reused (e.g. by an operator that erroneously
+// reads beyond the length of the batch). Its cost is proportional to the
+// capacity of the reused batches.
+func (a *Allocator) EnableZeroingOnReset() {
+	a.zeroOnReset = true
+}
+
+// resetBatch resets the given batch so that it can be reused and zeroes out its
+// data if EnableZeroingOnReset has been called.
+func (a *Allocator) resetBatch(b coldata.Batch) {
+	b.ResetInternalBatch()
+	if !a.zeroOnReset {
+		return
+	}
+	for _, vec := range b.ColVecs() {
+		switch vec.CanonicalTypeFamily() {
+		case types.BoolFamily:
+			clear(vec.Bool())
+		case types.IntFamily:
+			switch vec.Type().Width() {
+			case 16:
+				clear(vec.Int16())
+			case 32:
+				clear(vec.Int32())
+			default:
+				clear(vec.Int64())
+			}
+		case types.FloatFamily:
+			clear(vec.Float64())
+		case types.DecimalFamily:
+			clear(vec.Decimal())
+		case types.TimestampTZFamily:
+			clear(vec.Timestamp())
+		case types.IntervalFamily:
+			clear(vec.Interval())
+		case types.BytesFamily:
+			vec.Bytes().ZeroBuffer()
+		case types.JsonFamily:
+			vec.JSON().ZeroBuffer()
+		case typeconv.DatumVecCanonicalTypeFamily:
+			datumVec := vec.Datum()
+			for i := 0; i < datumVec.Len(); i++ {
+				// nil is converted to the NULL datum.
+				datumVec.Set(i, nil)
+			}
+		default:
+			colexecerror.InternalError(errors.AssertionFailedf("unhandled type %s", vec.Type().SQLStringForError()))
+		}
+	}
+}
+
+// batchHasTypes returns whether the vectors of the batch have exactly the
+// given types.
+func batchHasTypes(b coldata.Batch, typs []*types.T) bool {
+	if b.Width() != len(typs) {
+		return false
+	}
+	for i, vec := range b.ColVecs() {
+		if !vec.Type().Identical(typs[i]) {
+			return false
+		}
 	}
-	return coldata.NewMemBatchWithCapacity(typs, capacity, a.factory)
+	return true
 }
 
 // NewMemBatchWithMaxCapacity is a convenience shortcut of
-// NewMemBatchWithFixedCapacity with capacity=coldata.BatchSize() and should
-// only be used in tests (this is enforced by a linter).
+// NewMemBatchWithFixedCapacity with capacity=coldata.BatchSize() (unless
+// overridden via SetMaxBatchSize) and should only be used in tests (this is
+// enforced by a linter).
 func (a *Allocator) NewMemBatchWithMaxCapacity(typs []*types.T) coldata.Batch {
-	return a.NewMemBatchWithFixedCapacity(typs, coldata.BatchSize())
+	return a.NewMemBatchWithFixedCapacity(typs, a.getMaxBatchSize())
+}
+
+// NewMemBatchWithMaxMemory allocates a new in-memory coldata.Batch of the
+// largest capacity (up to coldata.BatchSize(), unless overridden via
+// SetMaxBatchSize) such that the estimated memory
+// footprint of the batch doesn't exceed maxBytes. The capacity is at least 1
+// even if the footprint of a single row exceeds maxBytes.
+// Note: similar to NewMemBatchWithFixedCapacity, consider whether you want the
+// dynamic batch size behavior (in which case you should be using
+// ResetMaybeReallocate).
+func (a *Allocator) NewMemBatchWithMaxMemory(typs []*types.T, maxBytes int64) coldata.Batch {
+	capacity := a.truncateToMemoryLimit(a.getMaxBatchSize(), maxBytes, typs)
+	return a.NewMemBatchWithFixedCapacity(typs, capacity)
 }
 
 // NewMemBatchNoCols creates a "skeleton" of new in-memory coldata.Batch. It
 // allocates memory for the selection vector but does *not* allocate any memory
 // for the column vectors - those will have to be added separately.
 func (a *Allocator) NewMemBatchNoCols(typs []*types.T, capacity int) coldata.Batch {
-	estimatedMemoryUsage := SelVectorSize(capacity)
-	if err := a.acc.Grow(a.ctx, estimatedMemoryUsage); err != nil {
-		colexecerror.InternalError(err)
+	a.batchAllocated()
+	estimatedMemoryUsage := BatchOverhead + SelVectorSize(capacity)
+	if err := a.growAccount(estimatedMemoryUsage, false /* afterAllocation */); err != nil {
+		a.batchReleased(nil /* b */)
+		throwMemoryError(err)
 	}
-	return coldata.NewMemBatchNoCols(typs, capacity)
+	b := coldata.NewMemBatchNoCols(typs, capacity)
+	a.trackBatch(b)
+	return b
 }
 
 // truncateToMemoryLimit returns the largest batch capacity that is still within
 // the memory limit for the given type schema. The returned value is at most
 // minDesiredCapacity and at least 1.
-func truncateToMemoryLimit(minDesiredCapacity int, maxBatchMemSize int64, typs []*types.T) int {
+func (a *Allocator) truncateToMemoryLimit(
+	minDesiredCapacity int, maxBatchMemSize int64, typs []*types.T,
+) int {
 	if maxBatchMemSize == noMemLimit {
 		// If there is no memory limit, then we don't reduce the ask.
 		return minDesiredCapacity
 	}
 	// If we have a memory limit, then make sure that it is sufficient for the
 	// desired capacity, if not, reduce the ask.
-	estimatedMemoryUsage := SelVectorSize(minDesiredCapacity) + EstimateBatchSizeBytes(typs, minDesiredCapacity)
+	estimatedMemoryUsage := SelVectorSize(minDesiredCapacity) + a.estimateBatchSizeBytes(typs, minDesiredCapacity)
 	if estimatedMemoryUsage > maxBatchMemSize {
 		// Perform the binary search to find the maximum allowed capacity.
 		l, r := 1, minDesiredCapacity // [l, r)
 		for l+1 < r {
 			m := (l + r) / 2
-			if SelVectorSize(m)+EstimateBatchSizeBytes(typs, m) > maxBatchMemSize {
+			if SelVectorSize(m)+a.estimateBatchSizeBytes(typs, m) > maxBatchMemSize {
 				r = m
 			} else {
 				l = m
@@ -205,12 +1365,60 @@ func truncateToMemoryLimit(minDesiredCapacity int, maxBatchMemSize int64, typs [
 	return minDesiredCapacity
 }
 
-// growCapacity grows the capacity exponentially or up to minDesiredCapacity
-// (whichever is larger) without exceeding maxBatchSize.
-func growCapacity(oldCapacity int, minDesiredCapacity int, maxBatchSize int) int {
-	newCapacity := oldCapacity * 2
-	if newCapacity < minDesiredCapacity {
+// GrowthPolicyKind describes how the capacity of the batches is grown on
+// reallocation.
+type GrowthPolicyKind int
+
+const (
+	// ExponentialGrowth multiplies the capacity of the old batch by the growth
+	// factor (or grows it up to the desired capacity, whichever is larger).
+	ExponentialGrowth GrowthPolicyKind = iota
+	// ExactGrowth grows the capacity exactly to the desired capacity. It is
+	// meant to be used by the callers that have good estimates of the number of
+	// rows so that the overshoot of the exponential growth is avoided.
+	ExactGrowth
+)
+
+// defaultGrowthFactor is the growth factor of ExponentialGrowth when none is
+// specified.
+const defaultGrowthFactor = 2
+
+// GrowthPolicy determines how the capacity of the batches is grown when they
+// are reallocated by the ResetMaybeReallocate methods. The zero value is the
+// default policy of doubling the capacity.
+//
+// Regardless of the policy, the capacity never exceeds the maximum batch size,
+// and the memory limit is applied after the policy (i.e. the grown capacity
+// might be reduced so that the new batch stays within the limit).
+type GrowthPolicy struct {
+	Kind GrowthPolicyKind
+	// Factor is the factor by which the capacity is multiplied with
+	// ExponentialGrowth. It must be either zero (meaning the default factor of
+	// 2) or greater than 1. It is ignored with ExactGrowth.
+	Factor float64
+}
+
+// growCapacity grows the capacity according to the policy or up to
+// minDesiredCapacity (whichever is larger) without exceeding maxBatchSize.
+func (p GrowthPolicy) growCapacity(oldCapacity int, minDesiredCapacity int, maxBatchSize int) int {
+	var newCapacity int
+	switch p.Kind {
+	case ExactGrowth:
 		newCapacity = minDesiredCapacity
+	default:
+		factor := p.Factor
+		if factor == 0 {
+			factor = defaultGrowthFactor
+		}
+		newCapacity = int(float64(oldCapacity) * factor)
+		if newCapacity <= oldCapacity {
+			// Small capacities might not grow with factors close to 1, so we
+			// make sure that the capacity increases by at least one.
+			newCapacity = oldCapacity + 1
+		}
+		if newCapacity < minDesiredCapacity {
+			newCapacity = minDesiredCapacity
+		}
 	}
 	if newCapacity > maxBatchSize {
 		newCapacity = maxBatchSize
@@ -218,17 +1426,137 @@ func growCapacity(oldCapacity int, minDesiredCapacity int, maxBatchSize int) int
 	return newCapacity
 }
 
+// SetGrowthPolicy sets the policy of growing the capacity of the batches
+// reallocated by the ResetMaybeReallocate methods of the allocator as well as
+// of the AccountingHelper and SetAccountingHelper using the allocator.
+func (a *Allocator) SetGrowthPolicy(policy GrowthPolicy) {
+	if policy.Kind != ExponentialGrowth && policy.Kind != ExactGrowth {
+		colexecerror.InternalError(errors.AssertionFailedf("unknown growth policy kind %d", policy.Kind))
+	}
+	if policy.Kind == ExponentialGrowth && policy.Factor != 0 && !(policy.Factor > 1) {
+		colexecerror.InternalError(errors.AssertionFailedf("invalid growth factor %v", policy.Factor))
+	}
+	a.growthPolicy = policy
+}
+
+// ReallocReason describes the decision made by the ResetMaybeReallocate
+// methods: either why the batch was reallocated or why the old batch was
+// reused.
+type ReallocReason int8
+
+const (
+	// ReuseCapacitySufficient indicates that the old batch was reused since
+	// its capacity was sufficient (or already the maximum).
+	ReuseCapacitySufficient ReallocReason = iota
+	// ReuseMemoryLimitReached indicates that the old batch was reused since
+	// the batch of larger capacity would exceed the memory limit.
+	ReuseMemoryLimitReached
+	// ReallocNoOldBatch indicates that a new batch was allocated since there
+	// was no old batch.
+	ReallocNoOldBatch
+	// ReallocCapacityTooSmall indicates that a new batch of larger capacity
+	// was allocated since the capacity of the old batch was too small.
+	ReallocCapacityTooSmall
+	// ReallocMemoryLimitExceeded indicates that the old batch was discarded
+	// by the AccountingHelper since it exceeded the memory limit by too much,
+	// and a new batch of smaller capacity was allocated.
+	ReallocMemoryLimitExceeded
+	// ReallocOvergrownBytes indicates that the old batch was replaced with a
+	// new batch of the same capacity since its bytes-like vectors had
+	// over-grown buffers.
+	ReallocOvergrownBytes
+	// ReallocAlways indicates that a new batch was allocated since the reuse
+	// of the old batch is not allowed.
+	ReallocAlways
+	// numReallocReasons is the number of ReallocReasons.
+	numReallocReasons
+)
+
+// Reallocated returns whether the reason corresponds to a newly allocated
+// batch.
+func (r ReallocReason) Reallocated() bool {
+	return r != ReuseCapacitySufficient && r != ReuseMemoryLimitReached
+}
+
+// String implements the fmt.Stringer interface.
+func (r ReallocReason) String() string {
+	switch r {
+	case ReuseCapacitySufficient:
+		return "reuse: capacity sufficient"
+	case ReuseMemoryLimitReached:
+		return "reuse: memory limit reached"
+	case ReallocNoOldBatch:
+		return "realloc: no old batch"
+	case ReallocCapacityTooSmall:
+		return "realloc: capacity too small"
+	case ReallocMemoryLimitExceeded:
+		return "realloc: memory limit exceeded"
+	case ReallocOvergrownBytes:
+		return "realloc: over-grown bytes"
+	case ReallocAlways:
+		return "realloc: always"
+	default:
+		return fmt.Sprintf("unknown realloc reason %d", r)
+	}
+}
+
+// SafeValue implements the redact.SafeValue interface.
+func (ReallocReason) SafeValue() {}
+
+const (
+	// reallocChurnWindow is the number of consecutive resets over which the
+	// reallocation churn of an allocator is measured.
+	reallocChurnWindow = 64
+	// reallocChurnThreshold is the number of reallocations within
+	// reallocChurnWindow consecutive resets above which the reallocation
+	// behavior is considered pathological (e.g. because the estimates
+	// oscillate around the memory limit).
+	reallocChurnThreshold = 16
+)
+
+// reallocChurnLogEvery rate-limits the warnings about the reallocation churn
+// across all allocators.
+var reallocChurnLogEvery = log.Every(time.Minute)
+
+// recordReset updates the statistics after the ResetMaybeReallocate methods
+// made the decision described by reason.
+func (a *Allocator) recordReset(reason ReallocReason) {
+	atomic.AddInt64(&a.atomics.numResetsByReason[reason], 1)
+	if reason.Reallocated() {
+		atomic.AddInt64(&a.atomics.numReallocations, 1)
+	}
+	a.lock()
+	defer a.unlock()
+	a.churn.numResets++
+	// The reallocations requested by the caller are not churn.
+	if reason.Reallocated() && reason != ReallocAlways {
+		a.churn.numReallocs++
+	}
+	if a.churn.numResets < reallocChurnWindow {
+		return
+	}
+	if numReallocs := a.churn.numReallocs; numReallocs > reallocChurnThreshold {
+		atomic.AddInt64(&a.atomics.numChurnWindows, 1)
+		if reallocChurnLogEvery.ShouldLog() {
+			log.Warningf(a.ctx, "batch reallocated %d times in the last %d resets, "+
+				"the estimates might be oscillating around the memory limit", numReallocs, reallocChurnWindow)
+		}
+	}
+	a.churn.numResets, a.churn.numReallocs = 0, 0
+}
+
 // resetMaybeReallocate returns a batch that is guaranteed to be in a "reset"
 // state (meaning it is ready to be used) and to have the capacity of at least
 // 1. minDesiredCapacity is a hint about the capacity of the returned batch
 // (subject to the memory limit).
 //
-// The method will grow the allocated capacity of the batch exponentially
-// (possibly incurring a reallocation), until the batch reaches
-// maxBatchSize in capacity or maxBatchMemSize in the memory footprint if
-// desiredCapacitySufficient is false. When that parameter is true and the
-// capacity of old batch is at least minDesiredCapacity, then the old batch is
-// reused.
+// The method will grow the allocated capacity of the batch according to the
+// growth policy of the allocator (exponentially by default, possibly incurring
+// a reallocation), until the batch reaches maxBatchSize in capacity or
+// maxBatchMemSize in the memory footprint if desiredCapacitySufficient is
+// false. When that parameter is true and the capacity of old batch is at least
+// minDesiredCapacity, then the old batch is reused. With ExactGrowth, the
+// desired capacity is always considered sufficient.
 //
 // oldBatchReachedMemSize is true IFF we calculated the memory footprint of the
 // non-nil old batch and it reached maxBatchMemSize. The calculation only occurs
@@ -239,11 +1567,32 @@ func growCapacity(oldCapacity int, minDesiredCapacity int, maxBatchSize int) int
 // If alwaysReallocate=true is used, then the old batch is never reused and a
 // new one is always allocated.
 //
+// If the adaptive bytes estimation is enabled, then the bytes-like values of
+// the old batch are observed before it is reset, and the updated estimate is
+// used when checking the capacities against maxBatchMemSize.
+//
+// Whenever the memory footprint of the old batch is measured and it exceeds the
+// estimate for the old capacity, the measured footprint is projected onto the
+// larger capacities (assuming that the following rows will be similar to the
+// ones in the old batch), and the capacity doesn't grow beyond what fits
+// within maxBatchMemSize according to the projection.
+//
+// If the old batch would be reused, but its bytes-like vectors have over-grown
+// buffers that its values haven't needed for a few consecutive resets (see
+// shouldShrink), then it is replaced with a new batch of the same capacity so
+// that the memory of those buffers is released.
+//
+// The returned reason describes the decision made by the method. The caller is
+// responsible for recording it in the statistics (see recordReset).
+//
 // NOTE: if the reallocation occurs, then the memory under the old batch is
 // released, so it is expected that the caller will lose the references to the
 // old batch.
 // Note: the method assumes that minDesiredCapacity is at least 0 and will clamp
-// minDesiredCapacity to be between 1 and maxBatchSize inclusive.
+// minDesiredCapacity to be between 1 and maxBatchSize inclusive. maxBatchSize
+// is in turn capped by the override set via SetMaxBatchSize, if any, and
+// minDesiredCapacity is raised to the floor set via SetMinBatchCapacity, if
+// any.
 func (a *Allocator) resetMaybeReallocate(
 	typs []*types.T,
 	oldBatch coldata.Batch,
@@ -252,32 +1601,63 @@ func (a *Allocator) resetMaybeReallocate(
 	maxBatchMemSize int64,
 	desiredCapacitySufficient bool,
 	alwaysReallocate bool,
-) (newBatch coldata.Batch, reallocated bool, oldBatchReachedMemSize bool) {
+) (newBatch coldata.Batch, reason ReallocReason, oldBatchReachedMemSize bool) {
+	if a.maxBatchSize > 0 && maxBatchSize > a.maxBatchSize {
+		maxBatchSize = a.maxBatchSize
+	}
 	if minDesiredCapacity < 0 {
 		colexecerror.InternalError(errors.AssertionFailedf("invalid minDesiredCapacity %d", minDesiredCapacity))
-	} else if minDesiredCapacity == 0 {
+	} else if minDesiredCapacity < a.minBatchCapacity {
+		minDesiredCapacity = a.minBatchCapacity
+	}
+	if minDesiredCapacity == 0 {
 		minDesiredCapacity = 1
 	} else if minDesiredCapacity > maxBatchSize {
 		minDesiredCapacity = maxBatchSize
 	}
-	reallocated = true
+	if a.growthPolicy.Kind == ExactGrowth {
+		// The exact growth never goes beyond minDesiredCapacity, so the old
+		// batch of at least that capacity is as good as a new one.
+		desiredCapacitySufficient = true
+	}
 	if oldBatch == nil {
-		minDesiredCapacity = truncateToMemoryLimit(minDesiredCapacity, maxBatchMemSize, typs)
+		truncated := a.truncateToMemoryLimit(minDesiredCapacity, maxBatchMemSize, typs)
+		if truncated < minDesiredCapacity {
+			atomic.AddInt64(&a.atomics.numMemoryLimitedAllocations, 1)
+			minDesiredCapacity = truncated
+		}
 		newBatch = a.NewMemBatchWithFixedCapacity(typs, minDesiredCapacity)
+		reason = ReallocNoOldBatch
 	} else {
+		// The old batch is yet to be reset, so it still contains the values
+		// from its last usage.
+		if a.bytesEstimate != nil {
+			a.bytesEstimate.observe(typs, oldBatch)
+		}
+		if a.decimalEstimate != nil {
+			a.decimalEstimate.observe(oldBatch)
+		}
 		oldCapacity := oldBatch.Capacity()
 		var useOldBatch bool
 		// Avoid calculating the memory footprint if possible.
 		var oldBatchMemSize int64
-		if oldCapacity == maxBatchSize {
-			// If old batch is already of the largest capacity, we will reuse
-			// it.
+		// projectedMaxCapacity, if positive, is the largest capacity that fits
+		// within maxBatchMemSize according to the measured footprint of the
+		// old batch.
+		var projectedMaxCapacity int
+		// limitedByMemory is true if the old batch would be reused because of
+		// the memory limit.
+		var limitedByMemory bool
+		if oldCapacity >= maxBatchSize {
+			// If old batch is already of the largest capacity (or even larger,
+			// which is possible when the caller lowered the maximum), we will
+			// reuse it.
 			useOldBatch = true
 		} else {
 			// Check that if we were to grow the capacity and allocate a new
 			// batch, the new batch would still not exceed the limit.
-			if estimatedMaxCapacity := truncateToMemoryLimit(
-				growCapacity(oldCapacity, minDesiredCapacity, maxBatchSize), maxBatchMemSize, typs,
+			if estimatedMaxCapacity := a.truncateToMemoryLimit(
+				a.growthPolicy.growCapacity(oldCapacity, minDesiredCapacity, maxBatchSize), maxBatchMemSize, typs,
 			); estimatedMaxCapacity < minDesiredCapacity {
 				// Reduce the ask according to the estimated maximum. Note that
 				// we do not set desiredCapacitySufficient to false since this
@@ -290,6 +1670,7 @@ func (a *Allocator) resetMaybeReallocate(
 					// than 10%, we might as well just reuse the old batch.
 					minDesiredCapacity = oldCapacity
 					desiredCapacitySufficient = true
+					limitedByMemory = true
 				}
 			}
 			if desiredCapacitySufficient && oldCapacity >= minDesiredCapacity {
@@ -299,36 +1680,154 @@ func (a *Allocator) resetMaybeReallocate(
 			} else {
 				// Check if the old batch already reached the maximum memory
 				// size, and use it if so.
-				oldBatchMemSize = GetBatchMemSize(oldBatch)
+				oldBatchMemSize = a.getBatchMemSize(oldBatch)
 				oldBatchReachedMemSize = oldBatchMemSize >= maxBatchMemSize
 				useOldBatch = oldBatchReachedMemSize
+				limitedByMemory = oldBatchReachedMemSize
+				if !useOldBatch && maxBatchMemSize != noMemLimit &&
+					oldBatchMemSize > SelVectorSize(oldCapacity)+a.estimateBatchSizeBytes(typs, oldCapacity) {
+					// The estimate above only considers the static footprint
+					// of the types whereas the old batch has grown beyond it
+					// (e.g. when its Bytes vectors contain large values), so we
+					// don't want to grow the capacity beyond what fits
+					// according to the measured footprint.
+					// The fixed overhead doesn't grow with the capacity, so it
+					// is excluded from the projection.
+					fixedOverhead := BatchOverhead + int64(len(typs))*VecOverhead
+					projectedMaxCapacity = int(float64(maxBatchMemSize-fixedOverhead) / float64(oldBatchMemSize-fixedOverhead) * float64(oldCapacity))
+					if projectedMaxCapacity <= oldCapacity || projectedMaxCapacity < int(float64(oldCapacity)*1.1) {
+						// Similar to above, if we cannot grow the capacity of
+						// the old batch by more than 10%, we might as well just
+						// reuse the old batch.
+						useOldBatch = true
+						limitedByMemory = true
+					}
+				}
 			}
 		}
 		// If we want to use the old batch, but the batch reuse is not allowed,
 		// we won't use the old one.
+		var forced bool
 		if useOldBatch && alwaysReallocate {
 			useOldBatch = false
+			forced = true
 			// Make sure that we get the footprint of the old batch so that it
 			// can be correctly released from the allocator (it is the caller's
 			// responsibility to track the memory usage of all previous
 			// batches).
 			if oldBatchMemSize == 0 {
-				oldBatchMemSize = GetBatchMemSize(oldBatch)
+				oldBatchMemSize = a.getBatchMemSize(oldBatch)
 				oldBatchReachedMemSize = oldBatchMemSize >= maxBatchMemSize
 			}
 		}
+		var shrink bool
+		if useOldBatch && a.shouldShrink(oldBatch) {
+			// The footprint of the old batch is dominated by the buffers that
+			// its recent values didn't need, so we replace it with a new batch
+			// of the same capacity. Such a batch didn't really reach the memory
+			// limit.
+			useOldBatch = false
+			shrink = true
+			oldBatchReachedMemSize = false
+			if oldBatchMemSize == 0 {
+				oldBatchMemSize = a.getBatchMemSize(oldBatch)
+			}
+		}
 		if useOldBatch {
-			reallocated = false
-			oldBatch.ResetInternalBatch()
+			reason = ReuseCapacitySufficient
+			if limitedByMemory {
+				reason = ReuseMemoryLimitReached
+			}
+			a.resetBatch(oldBatch)
 			newBatch = oldBatch
 		} else {
+			switch {
+			case forced:
+				reason = ReallocAlways
+			case shrink:
+				reason = ReallocOvergrownBytes
+			default:
+				reason = ReallocCapacityTooSmall
+			}
 			a.ReleaseMemory(oldBatchMemSize)
-			newCapacity := growCapacity(oldCapacity, minDesiredCapacity, maxBatchSize)
-			newCapacity = truncateToMemoryLimit(newCapacity, maxBatchMemSize, typs)
+			a.batchReleased(oldBatch)
+			newCapacity := oldCapacity
+			if !shrink {
+				newCapacity = a.growthPolicy.growCapacity(oldCapacity, minDesiredCapacity, maxBatchSize)
+				newCapacity = a.truncateToMemoryLimit(newCapacity, maxBatchMemSize, typs)
+				if projectedMaxCapacity > 0 && newCapacity > projectedMaxCapacity {
+					newCapacity = projectedMaxCapacity
+				}
+			}
 			newBatch = a.NewMemBatchWithFixedCapacity(typs, newCapacity)
 		}
 	}
-	return newBatch, reallocated, oldBatchReachedMemSize
+	return newBatch, reason, oldBatchReachedMemSize
+}
+
+// getBytesLike returns the underlying Bytes of the given bytes-like vector or
+// nil if the vector is of another type.
+func getBytesLike(vec *coldata.Vec) *coldata.Bytes {
+	switch vec.CanonicalTypeFamily() {
+	case types.BytesFamily:
+		return vec.Bytes()
+	case types.JsonFamily:
+		return &vec.JSON().Bytes
+	}
+	return nil
+}
+
+// bytesShrinkFactor is the factor by which the footprint of the bytes-like
+// vectors of a batch must exceed both their static estimate and the footprint
+// of the values they hold for the vectors to be considered over-grown.
+const bytesShrinkFactor = 4
+
+// bytesShrinkNumResets is the number of consecutive resets of the batches with
+// over-grown bytes-like vectors after which the batch is replaced. It provides
+// the hysteresis so that the workloads with occasional small batches among the
+// large ones don't keep on throwing away and regrowing the buffers.
+const bytesShrinkNumResets = 3
+
+// shouldShrink returns whether the given batch, that is about to be reused by
+// resetMaybeReallocate, should be replaced with a new one because of the
+// over-grown buffers of its bytes-like vectors (e.g. after the batch held a few
+// very large values once). The batch must still contain the values from its
+// last usage.
+//
+// The vectors are over-grown if their footprint exceeds by bytesShrinkFactor
+// both the static estimate and the footprint of the values in the batch, and
+// the batch is replaced only once this has been observed on
+// bytesShrinkNumResets consecutive resets.
+func (a *Allocator) shouldShrink(b coldata.Batch) bool {
+	var footprint, estimate int64
+	for _, vec := range b.ColVecs() {
+		if bytes := getBytesLike(vec); bytes != nil {
+			footprint += bytes.Size()
+			estimate += coldata.FlatBytesOverhead + int64(bytes.Len())*coldata.ElementSize
+		}
+	}
+	overgrown := footprint > bytesShrinkFactor*estimate
+	if overgrown {
+		// Only compute the footprint of the values when necessary since it
+		// requires iterating over all of them.
+		var used int64
+		for _, vec := range b.ColVecs() {
+			if bytes := getBytesLike(vec); bytes != nil {
+				used += bytes.ProportionalSize(int64(b.Length()))
+			}
+		}
+		overgrown = footprint > bytesShrinkFactor*used
+	}
+	if !overgrown {
+		a.numOvergrownResets = 0
+		return false
+	}
+	a.numOvergrownResets++
+	if a.numOvergrownResets < bytesShrinkNumResets {
+		return false
+	}
+	a.numOvergrownResets = 0
+	return true
 }
 
 const noMemLimit = math.MaxInt64
@@ -338,24 +1837,168 @@ const noMemLimit = math.MaxInt64
 // sufficient. This should be used by the callers that know exactly the capacity
 // they need and have no control over that number. It is guaranteed that the
 // returned batch has the capacity of at least requiredCapacity (clamped to
-// [1, coldata.BatchSize()] range).
+// [1, coldata.BatchSize()] range, or the range set via SetMaxBatchSize), so the
+// BatchSizeGovernor is not consulted.
 func (a *Allocator) ResetMaybeReallocateNoMemLimit(
 	typs []*types.T, oldBatch coldata.Batch, requiredCapacity int,
 ) (newBatch coldata.Batch, reallocated bool) {
-	newBatch, reallocated, _ = a.resetMaybeReallocate(
-		typs, oldBatch, requiredCapacity, coldata.BatchSize() /* maxBatchSize */, noMemLimit,
+	newBatch, reason, _ := a.resetMaybeReallocate(
+		typs, oldBatch, requiredCapacity, a.getMaxBatchSize(), noMemLimit,
 		true /* desiredCapacitySufficient */, false, /* alwaysReallocate */
 	)
-	return newBatch, reallocated
+	a.recordReset(reason)
+	return newBatch, reason.Reallocated()
+}
+
+// ResetMaybeReallocateWithMaxCapacity is the same as resetMaybeReallocate when
+// the desired capacity is not sufficient and with the capacity of the returned
+// batch capped at maxCapacity (which in turn is capped at coldata.BatchSize()
+// or the override set via SetMaxBatchSize).
+// This should be used by the callers that want the capacity of their batches
+// to stay well below coldata.BatchSize(), e.g. because the rows are very wide.
+//
+// minDesiredCapacity larger than maxCapacity is clamped to maxCapacity. If the
+// old batch already has the capacity of at least maxCapacity, then it is
+// reused (i.e. it is not reallocated to have a smaller capacity).
+func (a *Allocator) ResetMaybeReallocateWithMaxCapacity(
+	typs []*types.T,
+	oldBatch coldata.Batch,
+	minDesiredCapacity int,
+	maxCapacity int,
+	maxBatchMemSize int64,
+) (newBatch coldata.Batch, reallocated bool) {
+	if maxCapacity < 1 {
+		colexecerror.InternalError(errors.AssertionFailedf("invalid maxCapacity %d", maxCapacity))
+	}
+	if m := a.getMaxBatchSize(); maxCapacity > m {
+		maxCapacity = m
+	}
+	newBatch, reason, _ := a.resetMaybeReallocate(
+		typs, oldBatch, minDesiredCapacity, a.governedMaxBatchSize(maxCapacity), maxBatchMemSize,
+		false /* desiredCapacitySufficient */, false, /* alwaysReallocate */
+	)
+	a.recordReset(reason)
+	return newBatch, reason.Reallocated()
+}
+
+// ResetMaybeReallocateWithTypes is similar to the ResetMaybeReallocate method
+// of the AccountingHelper with the difference that the old batch is allowed to
+// have different types than newTyps. This is useful for the operators that
+// process the inputs of different type schemas that mostly share the types.
+// The vectors of the old batch whose types match newTyps positionally are
+// reused whereas the mismatched ones are replaced with new vectors (of the
+// same capacity), after which the usual logic of deciding whether the old
+// batch should be reused or reallocated applies.
+//
+// The old batch must have the same width as newTyps.
+//
+// NOTE: if the reallocation occurs, then the memory under the old batch is
+// released, so it is expected that the caller will lose the references to the
+// old batch.
+func (a *Allocator) ResetMaybeReallocateWithTypes(
+	newTyps []*types.T, oldBatch coldata.Batch, minDesiredCapacity int, maxBatchMemSize int64,
+) (newBatch coldata.Batch, reallocated bool) {
+	if oldBatch != nil {
+		if oldBatch.Width() != len(newTyps) {
+			colexecerror.InternalError(errors.AssertionFailedf(
+				"old batch has %d columns whereas %d types are given", oldBatch.Width(), len(newTyps),
+			))
+		}
+		for i, t := range newTyps {
+			oldVec := oldBatch.ColVec(i)
+			if oldVec.Type().Identical(t) {
+				continue
+			}
+			// Note that if the batch is reallocated below, then the new vector
+			// is wasted, but we prefer the decision to be made based on the
+			// new type schema.
+			newVec := a.NewVec(t, oldBatch.Capacity())
+			oldVecMemSize := getVecMemoryFootprint(oldVec, a.vecSizer)
+			oldBatch.ReplaceCol(newVec, i)
+			a.ReleaseMemory(oldVecMemSize)
+		}
+	}
+	newBatch, reason, _ := a.resetMaybeReallocate(
+		newTyps, oldBatch, minDesiredCapacity, a.governedMaxBatchSize(a.getMaxBatchSize()), maxBatchMemSize,
+		false /* desiredCapacitySufficient */, false, /* alwaysReallocate */
+	)
+	a.recordReset(reason)
+	return newBatch, reason.Reallocated()
+}
+
+// GrowCapacity returns a batch with the capacity of at least newCapacity that
+// contains all rows of b. Unlike ResetMaybeReallocate methods, it preserves
+// the data: the vectors of b are extended via coldata.Vec.Append and are
+// moved into the returned batch, so the existing rows are only copied when the
+// backing storage of the vector has to be reallocated. In particular:
+//   - the bytes-like vectors (Bytes and JSON) only reallocate the slice of the
+//     element headers whereas the buffer with the non-inlined values is kept
+//     as is;
+//   - the vectors of all other types (including decimals and datum-backed
+//     vectors) reallocate their backing slice (copying the existing values)
+//     unless it already has enough spare capacity.
+//
+// The returned batch is b itself if its capacity is already sufficient;
+// otherwise, b must no longer be used by the caller, and the columns of the
+// returned batch must be re-fetched since they could have been reallocated.
+// The memory account is grown by the estimated growth before any data is
+// touched, so if the memory error is thrown, b remains intact.
+//
+// b must have been allocated by this allocator, must not be a windowed batch,
+// and must not use a selection vector.
+func (a *Allocator) GrowCapacity(b coldata.Batch, newCapacity int) coldata.Batch {
+	oldCapacity := b.Capacity()
+	if newCapacity <= oldCapacity {
+		return b
+	}
+	if b.Selection() != nil {
+		colexecerror.InternalError(errors.AssertionFailedf("cannot grow the capacity of a batch with a selection vector"))
+	}
+	if a.isWindow(b) {
+		colexecerror.InternalError(errors.AssertionFailedf("cannot grow the capacity of a windowed batch"))
+	}
+	typs := make([]*types.T, b.Width())
+	for i, vec := range b.ColVecs() {
+		typs[i] = vec.Type()
+	}
+	// Get the capacity of the selection vector (similar to getBatchMemSize).
+	b.SetSelection(true)
+	oldSelVectorSize := SelVectorSize(cap(b.Selection()))
+	b.SetSelection(false)
+	estimatedDelta := SelVectorSize(newCapacity) - oldSelVectorSize +
+		estimateVecsSizeBytes(typs, newCapacity) - estimateVecsSizeBytes(typs, oldCapacity)
+	if err := a.growAccount(estimatedDelta, false /* afterAllocation */); err != nil {
+		throwMemoryError(err)
+	}
+	before := getVecsMemoryFootprint(b.ColVecs(), a.vecSizer)
+	atomic.AddInt64(&a.atomics.copiedBytes, estimateVecsSizeBytes(typs, b.Length()))
+	newBatch := coldata.NewMemBatchNoCols(typs, newCapacity)
+	for i, vec := range b.ColVecs() {
+		if vec.CanonicalTypeFamily() != types.UnknownFamily {
+			if length := vec.Length(); length < newCapacity {
+				ext := coldata.NewVec(typs[i], newCapacity-length, a.factory)
+				vec.Append(coldata.SliceArgs{Src: ext, DestIdx: length, SrcEndIdx: newCapacity - length})
+			}
+		}
+		newBatch.ReplaceCol(vec, i)
+	}
+	newBatch.SetLength(b.Length())
+	after := getVecsMemoryFootprint(newBatch.ColVecs(), a.vecSizer)
+	// Correct the estimate according to the actual footprint.
+	a.adjustMemoryUsage(SelVectorSize(newCapacity)-oldSelVectorSize+after-before-estimatedDelta, true /* afterAllocation */)
+	a.batchReleased(b)
+	a.batchAllocated()
+	a.trackBatch(newBatch)
+	return newBatch
 }
 
 // NewVec returns a new coldata.Vec of the desired capacity.
 // NOTE: consider whether you should be using MaybeAppendColumn,
 // NewMemBatchWith*, or ResetMaybeReallocate methods.
 func (a *Allocator) NewVec(t *types.T, capacity int) *coldata.Vec {
-	estimatedMemoryUsage := EstimateBatchSizeBytes([]*types.T{t}, capacity)
-	if err := a.acc.Grow(a.ctx, estimatedMemoryUsage); err != nil {
-		colexecerror.InternalError(err)
+	estimatedMemoryUsage := estimateVecsSizeBytes([]*types.T{t}, capacity)
+	if err := a.growAccount(estimatedMemoryUsage, false /* afterAllocation */); err != nil {
+		throwMemoryError(err)
 	}
 	return coldata.NewVec(t, capacity, a.factory)
 }
@@ -375,6 +2018,13 @@ func (a *Allocator) NewVec(t *types.T, capacity int) *coldata.Vec {
 // indicates an error in setting up vector type enforcers during the planning
 // stage.
 //
+// The memory of the appended vector is always attributed to this allocator,
+// even if b itself was allocated by another one (e.g. by the upstream
+// operator), and it can be released via ReleaseAppendedColumns. As a result,
+// the vector at position colIdx can only be reused (case 1 above) by the same
+// allocator that appended it or by the allocator that allocated b, which is
+// asserted in test builds.
+//
 // NOTE: b must be non-zero length batch.
 func (a *Allocator) MaybeAppendColumn(b coldata.Batch, t *types.T, colIdx int) {
 	if b.Length() == 0 {
@@ -399,15 +2049,18 @@ func (a *Allocator) MaybeAppendColumn(b coldata.Batch, t *types.T, colIdx int) {
 		}
 		if presentType.Identical(t) {
 			// We already have the vector of the desired type in place.
+			if buildutil.CrdbTestBuild {
+				a.assertColumnAttributed(b, colIdx)
+			}
 			if presentVec.Capacity() < desiredCapacity {
 				// Unfortunately, the present vector is not of sufficient
 				// capacity, so we need to replace it.
-				oldMemUsage := getVecMemoryFootprint(presentVec)
-				newEstimatedMemoryUsage := EstimateBatchSizeBytes([]*types.T{t}, desiredCapacity)
-				if err := a.acc.Grow(a.ctx, newEstimatedMemoryUsage-oldMemUsage); err != nil {
-					colexecerror.InternalError(err)
+				oldMemUsage := getVecMemoryFootprint(presentVec, a.vecSizer)
+				newEstimatedMemoryUsage := estimateVecsSizeBytes([]*types.T{t}, desiredCapacity)
+				if err := a.growAccount(newEstimatedMemoryUsage-oldMemUsage, false /* afterAllocation */); err != nil {
+					throwMemoryError(err)
 				}
-				b.ReplaceCol(a.NewVec(t, desiredCapacity), colIdx)
+				b.ReplaceCol(coldata.NewVec(t, desiredCapacity, a.factory), colIdx)
 				return
 			}
 			coldata.ResetIfBytesLike(presentVec)
@@ -429,11 +2082,58 @@ func (a *Allocator) MaybeAppendColumn(b coldata.Batch, t *types.T, colIdx int) {
 			t.SQLStringForError(), colIdx, width,
 		))
 	}
-	estimatedMemoryUsage := EstimateBatchSizeBytes([]*types.T{t}, desiredCapacity)
-	if err := a.acc.Grow(a.ctx, estimatedMemoryUsage); err != nil {
-		colexecerror.InternalError(err)
+	estimatedMemoryUsage := estimateVecsSizeBytes([]*types.T{t}, desiredCapacity)
+	if err := a.growAccount(estimatedMemoryUsage, false /* afterAllocation */); err != nil {
+		throwMemoryError(err)
+	}
+	b.AppendCol(coldata.NewVec(t, desiredCapacity, a.factory))
+	a.lock()
+	defer a.unlock()
+	if a.appendedCols == nil {
+		a.appendedCols = make(map[coldata.Batch]intsets.Fast)
+	}
+	cols := a.appendedCols[b]
+	cols.Add(colIdx)
+	a.appendedCols[b] = cols
+}
+
+// assertColumnAttributed throws an assertion failure if the memory of the
+// vector at position colIdx of b is attributed to another allocator, i.e. if
+// the vector hasn't been appended via MaybeAppendColumn of this allocator and
+// b hasn't been allocated by this allocator. It must only be called in test
+// builds.
+func (a *Allocator) assertColumnAttributed(b coldata.Batch, colIdx int) {
+	a.lock()
+	defer a.unlock()
+	if cols, ok := a.appendedCols[b]; ok && cols.Contains(colIdx) {
+		return
+	}
+	if _, ok := a.liveBatchStacks[b]; ok {
+		return
 	}
-	b.AppendCol(a.NewVec(t, desiredCapacity))
+	colexecerror.InternalError(errors.AssertionFailedf(
+		"vector at index %d is reused by allocator of %s whereas its memory is attributed to another allocator",
+		colIdx, a.monitorName(),
+	))
+}
+
+// ReleaseAppendedColumns releases the memory footprint of the vectors appended
+// to the given batch via MaybeAppendColumn of this allocator. It should be
+// called by the components that append the columns to the batches allocated
+// by other allocators (e.g. projections) once they are done with the batch
+// (e.g. when they are closed). It is a noop if no columns have been appended.
+func (a *Allocator) ReleaseAppendedColumns(b coldata.Batch) {
+	a.lock()
+	cols := a.appendedCols[b]
+	delete(a.appendedCols, b)
+	a.unlock()
+	var size int64
+	cols.ForEach(func(colIdx int) {
+		if colIdx < b.Width() {
+			size += getVecMemoryFootprint(b.ColVec(colIdx), a.vecSizer)
+		}
+	})
+	a.ReleaseMemory(size)
 }
 
 // PerformOperation executes 'operation' (that somehow modifies 'destVecs') and
@@ -441,14 +2141,27 @@ func (a *Allocator) MaybeAppendColumn(b coldata.Batch, t *types.T, colIdx int) {
 // NOTE: if some columnar vectors are not modified, they should not be included
 // in 'destVecs' to reduce the performance hit of memory accounting.
 func (a *Allocator) PerformOperation(destVecs []*coldata.Vec, operation func()) {
-	before := getVecsMemoryFootprint(destVecs)
+	if err := a.TryPerformOperation(destVecs, operation); err != nil {
+		throwMemoryError(err)
+	}
+}
+
+// TryPerformOperation is the same as PerformOperation but returns the memory
+// error instead of panicking, so it can be used outside of
+// colexecerror.CatchVectorizedRuntimeError. Note that the operation has
+// already been performed when the error is returned.
+func (a *Allocator) TryPerformOperation(destVecs []*coldata.Vec, operation func()) error {
+	if buildutil.CrdbTestBuild {
+		a.assertNoWindowAliasing(destVecs)
+	}
+	before := getVecsMemoryFootprint(destVecs, a.vecSizer)
 	// To simplify the accounting, we perform the operation first and then will
 	// update the memory account. The minor "drift" in accounting that is
 	// caused by this approach is ok.
 	operation()
-	after := getVecsMemoryFootprint(destVecs)
+	after := getVecsMemoryFootprint(destVecs, a.vecSizer)
 
-	a.AdjustMemoryUsageAfterAllocation(after - before)
+	return a.tryAdjustMemoryUsage(after-before, true /* afterAllocation */)
 }
 
 // PerformAppend is used to account for memory usage during calls to
@@ -463,11 +2176,11 @@ func (a *Allocator) PerformAppend(batch coldata.Batch, operation func()) {
 		case types.DecimalFamily:
 			// Don't add the size of the existing decimals to the 'before' cost, since
 			// they are guaranteed not to be modified by an append operation.
-			before += sizeOfDecimals(dest.Decimal(), prevLength)
+			before += sizeOfDecimals(dest.Decimal(), prevLength) + getNullsMemoryFootprint(dest)
 		case typeconv.DatumVecCanonicalTypeFamily:
-			before += dest.Datum().Size(prevLength)
+			before += getDatumVecMemoryFootprint(dest, prevLength, a.vecSizer) + getNullsMemoryFootprint(dest)
 		default:
-			before += getVecMemoryFootprint(dest)
+			before += getVecMemoryFootprint(dest, a.vecSizer)
 		}
 	}
 	operation()
@@ -475,26 +2188,183 @@ func (a *Allocator) PerformAppend(batch coldata.Batch, operation func()) {
 	for _, dest := range batch.ColVecs() {
 		switch dest.CanonicalTypeFamily() {
 		case types.DecimalFamily:
-			after += sizeOfDecimals(dest.Decimal(), prevLength)
+			after += sizeOfDecimals(dest.Decimal(), prevLength) + getNullsMemoryFootprint(dest)
 		case typeconv.DatumVecCanonicalTypeFamily:
-			after += dest.Datum().Size(prevLength)
+			after += getDatumVecMemoryFootprint(dest, prevLength, a.vecSizer) + getNullsMemoryFootprint(dest)
 		default:
-			after += getVecMemoryFootprint(dest)
+			after += getVecMemoryFootprint(dest, a.vecSizer)
 		}
 	}
 	a.AdjustMemoryUsageAfterAllocation(after - before)
 }
 
-// Used returns the number of bytes currently allocated through this allocator.
+// AppendBatch appends the tuples in [srcStartIdx, srcEndIdx) range of src
+// (honoring the selection vector of src, if any) to the end of dst, and
+// returns the batch containing the result. dst can be nil, in which case a new
+// batch with the schema of src is allocated.
+//
+// If dst doesn't have enough capacity for the new tuples, then a new batch
+// with the capacity grown according to the growth policy of the allocator is
+// allocated, the tuples of dst are copied into it, and the memory of dst is
+// released, so dst must not be used by the caller afterwards. The memory
+// footprint of the copied tuples is accounted for.
+func (a *Allocator) AppendBatch(
+	dst coldata.Batch, src coldata.Batch, srcStartIdx, srcEndIdx int,
+) coldata.Batch {
+	if srcStartIdx < 0 || srcStartIdx > srcEndIdx || srcEndIdx > src.Length() {
+		colexecerror.InternalError(errors.AssertionFailedf(
+			"invalid range [%d, %d) to append from the batch of length %d", srcStartIdx, srcEndIdx, src.Length(),
+		))
+	}
+	var dstLength, dstCapacity int
+	if dst != nil {
+		if dst.Width() != src.Width() {
+			colexecerror.InternalError(errors.AssertionFailedf(
+				"appending the batch of width %d to the batch of width %d", src.Width(), dst.Width(),
+			))
+		}
+		if dst.Selection() != nil {
+			colexecerror.InternalError(errors.AssertionFailedf("appending to the batch with a selection vector"))
+		}
+		dstLength, dstCapacity = dst.Length(), dst.Capacity()
+	}
+	newLength := dstLength + srcEndIdx - srcStartIdx
+	typs := make([]*types.T, src.Width())
+	for i, vec := range src.ColVecs() {
+		typs[i] = vec.Type()
+	}
+	if dst == nil || newLength > dstCapacity {
+		newCapacity := a.growthPolicy.growCapacity(dstCapacity, newLength, math.MaxInt)
+		newDst := a.NewMemBatchWithFixedCapacity(typs, newCapacity)
+		if dstLength > 0 {
+			atomic.AddInt64(&a.atomics.copiedBytes, estimateVecsSizeBytes(typs, dstLength))
+			a.PerformOperation(newDst.ColVecs(), func() {
+				for i, vec := range newDst.ColVecs() {
+					vec.Copy(coldata.SliceArgs{
+						Src:       dst.ColVec(i),
+						SrcEndIdx: dstLength,
+					})
+				}
+			})
+		}
+		newDst.SetLength(dstLength)
+		if dst != nil {
+			a.ReleaseMemory(a.getBatchMemSize(dst))
+			a.batchReleased(dst)
+		}
+		dst = newDst
+	}
+	if newLength > dstLength {
+		atomic.AddInt64(&a.atomics.copiedBytes, estimateVecsSizeBytes(typs, newLength-dstLength))
+		a.PerformOperation(dst.ColVecs(), func() {
+			for i, vec := range dst.ColVecs() {
+				vec.Copy(coldata.SliceArgs{
+					Src:         src.ColVec(i),
+					Sel:         src.Selection(),
+					DestIdx:     dstLength,
+					SrcStartIdx: srcStartIdx,
+					SrcEndIdx:   srcEndIdx,
+				})
+			}
+			dst.SetLength(newLength)
+		})
+	}
+	return dst
+}
+
+// Used returns the number of bytes currently allocated through this allocator
+// (including the changes that haven't been flushed in the buffered accounting
+// mode). The usage of the child allocators rolls up into the parent, but the
+// usage of the other components sharing the memory account (or the monitor)
+// is not included, so it can be used by the operators to make decisions (e.g.
+// whether to spill to disk) based only on their own memory.
 func (a *Allocator) Used() int64 {
-	return a.acc.Used()
+	a.lock()
+	defer a.unlock()
+	return a.usedLocked()
+}
+
+// usedLocked is the same as Used but assumes that the lock is held.
+func (a *Allocator) usedLocked() int64 {
+	used := a.used
+	for _, c := range a.children {
+		used += c.used
+	}
+	return used
 }
 
-// Acc returns the memory account of the Allocator.
+// AllocatorSnapshot describes the current state of an Allocator.
+type AllocatorSnapshot struct {
+	// Used is the number of bytes currently allocated through the allocator
+	// (see Allocator.Used).
+	Used int64
+	// MaxUsed is the high-water mark of the number of bytes allocated through
+	// the allocator itself (i.e. not through its children).
+	MaxUsed int64
+	// NumLiveBatches is the number of batches allocated by the allocator that
+	// haven't been released yet.
+	NumLiveBatches int
+}
+
+// Snapshot returns the current state of the allocator. Unlike Stats, it must
+// be called on the goroutine that uses the allocator.
+func (a *Allocator) Snapshot() AllocatorSnapshot {
+	a.lock()
+	defer a.unlock()
+	return AllocatorSnapshot{
+		Used:           a.usedLocked(),
+		MaxUsed:        atomic.LoadInt64(&a.atomics.maxBytes),
+		NumLiveBatches: a.numLiveBatches,
+	}
+}
+
+// Acc returns the memory account of the Allocator. Note that the account is
+// shared by the parent and all child allocators.
 func (a *Allocator) Acc() *mon.BoundAccount {
 	return a.acc
 }
 
+// SwapAccount binds the allocator (together with its child allocators) to the
+// given memory account instead of the current one. It is meant for the
+// operators that re-plan themselves (e.g. as disk-backed) and want to keep
+// using the same Allocator, which is referenced by their components, but with
+// a different account.
+//
+// The usage of the current account is transferred to the new one: the new
+// account is grown first, and only then the current one is shrunk, so the
+// memory is never unaccounted for. If the new account cannot be grown, then the
+// error is returned and the allocator stays bound to the current account. The
+// pending changes of the buffered accounting mode (if enabled) will be
+// registered with the new account, and the unlimited account of the allocator
+// created via NewLimitedAllocator is not affected.
+//
+// The swap is not synchronized with the other methods of the allocator, so it
+// must be performed on the goroutine that uses the allocator (as well as all
+// of its children). The child allocators cannot swap the account on their own.
+func (a *Allocator) SwapAccount(newAcc *mon.BoundAccount) error {
+	if a.child != nil {
+		return errors.AssertionFailedf("child allocator %s cannot swap the memory account", a.child.name)
+	}
+	if newAcc == nil {
+		return errors.AssertionFailedf("unexpectedly nil memory account")
+	}
+	if newAcc == a.acc {
+		return nil
+	}
+	used := a.acc.Used()
+	if err := newAcc.Grow(a.ctx, used); err != nil {
+		return err
+	}
+	a.acc.Shrink(a.ctx, used)
+	a.acc = newAcc
+	for _, child := range a.children {
+		child.acc = newAcc
+	}
+	// The limit of the monitor might have changed.
+	a.maybeRearmBudgetCallback()
+	return nil
+}
+
 // adjustMemoryUsage adjusts the number of bytes currently allocated through
 // this allocator by delta bytes (which can be both positive or negative).
 //
@@ -507,8 +2377,16 @@ func (a *Allocator) Acc() *mon.BoundAccount {
 // then the unlimited account is grown by delta. The memory error is still
 // thrown.
 func (a *Allocator) adjustMemoryUsage(delta int64, afterAllocation bool) {
+	if err := a.tryAdjustMemoryUsage(delta, afterAllocation); err != nil {
+		throwMemoryError(err)
+	}
+}
+
+// tryAdjustMemoryUsage is the same as adjustMemoryUsage but returns the memory
+// error instead of throwing it.
+func (a *Allocator) tryAdjustMemoryUsage(delta int64, afterAllocation bool) error {
 	if delta > 0 {
-		if err := a.acc.Grow(a.ctx, delta); err != nil {
+		if err := a.growAccount(delta, afterAllocation); err != nil {
 			// If we were given a separate unlimited account and the adjustment
 			// is performed after the allocation has already occurred, then grow
 			// the unlimited account.
@@ -516,14 +2394,15 @@ func (a *Allocator) adjustMemoryUsage(delta int64, afterAllocation bool) {
 				if newErr := a.unlimitedAcc.Grow(a.ctx, delta); newErr != nil {
 					// Prefer the error from the unlimited account since it
 					// indicates that --max-sql-memory pool has been used up.
-					colexecerror.InternalError(newErr)
+					return newErr
 				}
 			}
-			colexecerror.InternalError(err)
+			return err
 		}
 	} else if delta < 0 {
 		a.ReleaseMemory(-delta)
 	}
+	return nil
 }
 
 // AdjustMemoryUsage adjusts the number of bytes currently allocated through
@@ -532,6 +2411,13 @@ func (a *Allocator) AdjustMemoryUsage(delta int64) {
 	a.adjustMemoryUsage(delta, false /* afterAllocation */)
 }
 
+// TryAdjustMemoryUsage is the same as AdjustMemoryUsage but returns the memory
+// error instead of panicking, so it can be used outside of
+// colexecerror.CatchVectorizedRuntimeError.
+func (a *Allocator) TryAdjustMemoryUsage(delta int64) error {
+	return a.tryAdjustMemoryUsage(delta, false /* afterAllocation */)
+}
+
 // AdjustMemoryUsageAfterAllocation is similar to AdjustMemoryUsage with a
 // difference that if 1) the allocator was created via NewLimitedAllocator, and
 // 2) the allocation is denied by the limited memory account, then the unlimited
@@ -542,6 +2428,45 @@ func (a *Allocator) AdjustMemoryUsageAfterAllocation(delta int64) {
 	a.adjustMemoryUsage(delta, true /* afterAllocation */)
 }
 
+// AdjustMemoryUsageAfterRelease reduces the number of bytes attributed to this
+// allocator by -delta bytes (delta must be non-positive). It should be used
+// whenever the caller has released the memory that was previously registered
+// through this allocator.
+//
+// Unlike ReleaseMemory, which silently releases at most the attributed usage,
+// AdjustMemoryUsageAfterRelease treats the release of more bytes than are
+// currently attributed to the allocator (e.g. because the same memory is
+// released twice) as a programming error: it results in an assertion failure
+// in test builds, and the release is clamped with a warning logged otherwise.
+func (a *Allocator) AdjustMemoryUsageAfterRelease(delta int64) {
+	if delta > 0 {
+		colexecerror.InternalError(errors.AssertionFailedf(
+			"unexpectedly positive delta in AdjustMemoryUsageAfterRelease: %d", delta,
+		))
+	}
+	size := -delta
+	if attributed := a.Attributed(); size > attributed {
+		if buildutil.CrdbTestBuild {
+			colexecerror.InternalError(errors.AssertionFailedf(
+				"releasing %d bytes from the allocator with %d bytes attributed", size, attributed,
+			))
+		}
+		log.Warningf(a.ctx, "releasing %d bytes from the allocator with %d bytes attributed, clamping",
+			size, attributed)
+		size = attributed
+	}
+	a.ReleaseMemory(size)
+}
+
+// Attributed returns the number of bytes currently attributed to this
+// allocator itself, i.e. not including the usage of its children. This is the
+// maximum number of bytes that can be released through the allocator.
+func (a *Allocator) Attributed() int64 {
+	a.lock()
+	defer a.unlock()
+	return a.used
+}
+
 // ReleaseMemory reduces the number of bytes currently allocated through this
 // allocator by (at most) size bytes. size must be non-negative.
 func (a *Allocator) ReleaseMemory(size int64) {
@@ -550,20 +2475,181 @@ func (a *Allocator) ReleaseMemory(size int64) {
 	} else if size == 0 {
 		return
 	}
-	if size > a.acc.Used() {
-		size = a.acc.Used()
+	a.lock()
+	defer a.unlock()
+	// Only the memory registered through this allocator can be released.
+	if size > a.used {
+		size = a.used
+	}
+	if size == 0 {
+		return
+	}
+	a.used -= size
+	if a.quota != nil {
+		// The quota is returned once the memory account has been shrunk.
+		defer a.quota.release(size)
+	}
+	if b := a.buffered; b != nil {
+		b.pending -= size
+		if b.pending <= -b.threshold {
+			a.Flush()
+		}
+		a.recordRelease(size)
+		a.maybeRearmBudgetCallback()
+		return
 	}
 	a.acc.Shrink(a.ctx, size)
+	a.recordRelease(size)
+	a.maybeRearmBudgetCallback()
+}
+
+// releaseAccount implements ReleaseAll for an allocator that is not a child:
+// it clears the memory account, which might include the memory registered with
+// it directly via Acc, and resets the usage of the allocator and its children.
+// The pending growth of the buffered accounting mode is registered with the
+// account before it is cleared, so that the monitor observes the peak usage.
+func (a *Allocator) releaseAccount() {
+	a.lock()
+	defer a.unlock()
+	a.tryFlush()
+	a.acc.Shrink(a.ctx, a.acc.Used())
+	// The quota is returned once the memory account has been shrunk.
+	for _, c := range append([]*Allocator{a}, a.children...) {
+		if c.used == 0 {
+			continue
+		}
+		if c.quota != nil {
+			c.quota.release(c.used)
+		}
+		c.recordRelease(c.used)
+		c.used = 0
+		c.maybeRearmBudgetCallback()
+	}
+}
+
+// ReleaseBatch releases the memory footprint of the given batch from the
+// allocator. It should be used by the callers that are done with the batch
+// (e.g. after spilling it to disk) and will lose all references to it. The
+// footprint is computed the same way as when the old batch is released by
+// the ResetMaybeReallocate methods, which matches what has been accounted for
+// the batch as long as all modifications of the batch were accounted for
+// (e.g. via PerformOperation). For the batch registered via AccountForWindow,
+// only the skeleton of the batch and the window wrappers are released.
+//
+// Releasing the same batch twice is a programming error which is detected in
+// test builds.
+func (a *Allocator) ReleaseBatch(b coldata.Batch) {
+	if b == nil || b == coldata.ZeroBatch {
+		return
+	}
+	if buildutil.CrdbTestBuild {
+		a.lock()
+		_, released := a.releasedBatches[b]
+		if !released {
+			if a.releasedBatches == nil {
+				a.releasedBatches = make(map[coldata.Batch]struct{})
+			}
+			a.releasedBatches[b] = struct{}{}
+		}
+		a.unlock()
+		if released {
+			colexecerror.InternalError(errors.AssertionFailedf("batch has already been released"))
+		}
+	}
+	if a.isWindow(b) {
+		// The data of the window vectors is accounted for by the batches the
+		// windows were created over, so only the skeleton of the batch and
+		// the window wrappers are released.
+		a.ReleaseWindow(b)
+		usesSel := b.Selection() != nil
+		b.SetSelection(true)
+		a.ReleaseMemory(BatchOverhead + SelVectorSize(cap(b.Selection())))
+		b.SetSelection(usesSel)
+	} else {
+		a.ReleaseMemory(a.getBatchMemSize(b))
+	}
+	a.batchReleased(b)
+}
+
+// TransferBatchOwnership transfers the memory footprint of the given batch from
+// one allocator to another. It should be used when the batch allocated by one
+// component is handed off to another one that might hold onto it long-term
+// (e.g. from the producer to the consumer goroutine). The footprint is computed
+// the same way as in ReleaseBatch.
+//
+// If the memory account of the destination allocator cannot absorb the
+// footprint, then the memory error is thrown, and the source allocator keeps
+// the ownership of the batch.
+//
+// Neither allocator can be used concurrently with the transfer. Transferring
+// the batch that has already been released or transferred away from the
+// source allocator is a programming error which is detected in test builds.
+func TransferBatchOwnership(from, to *Allocator, b coldata.Batch) {
+	if b == nil || b == coldata.ZeroBatch || from == to {
+		return
+	}
+	if buildutil.CrdbTestBuild {
+		if _, released := from.releasedBatches[b]; released {
+			colexecerror.InternalError(errors.AssertionFailedf("batch has already been released or transferred"))
+		}
+	}
+	size := from.getBatchMemSize(b)
+	to.batchAllocated()
+	if err := to.growAccount(size, false /* afterAllocation */); err != nil {
+		to.batchReleased(nil /* b */)
+		throwMemoryError(err)
+	}
+	if buildutil.CrdbTestBuild {
+		// The allocation site of the batch stays the same.
+		if to.liveBatchStacks == nil {
+			to.liveBatchStacks = make(map[coldata.Batch][]uintptr)
+		}
+		to.liveBatchStacks[b] = from.liveBatchStacks[b]
+		if from.releasedBatches == nil {
+			from.releasedBatches = make(map[coldata.Batch]struct{})
+		}
+		from.releasedBatches[b] = struct{}{}
+		// The batch might be transferred back to the allocator that
+		// previously owned it.
+		delete(to.releasedBatches, b)
+	}
+	from.ReleaseMemory(size)
+	from.batchReleased(b)
 }
 
 // ReleaseAll releases all of the reservations from the allocator. The usage of
 // this method implies that the memory account of the allocator is not shared
-// with any other component.
+// with any other component (other than the child allocators, whose usage is
+// released too), so the whole account is cleared, including the memory that
+// was registered with it directly via Acc. For a child allocator, only its own
+// usage is released.
 func (a *Allocator) ReleaseAll() {
-	a.ReleaseMemory(a.Used())
+	if a.child != nil {
+		a.ReleaseMemory(a.used)
+	} else {
+		a.releaseAccount()
+	}
 	if a.unlimitedAcc != nil {
 		a.unlimitedAcc.Shrink(a.ctx, a.unlimitedAcc.Used())
 	}
+	// All previously released batches are forgotten since the accounting
+	// starts from scratch.
+	a.releasedBatches = nil
+	a.numLiveBatches = 0
+	a.liveBatchStacks = nil
+	a.windows = nil
+	a.appendedCols = nil
+	// The memory of the pooled batches has just been released, so they can
+	// no longer be reused.
+	if a.pool != nil {
+		a.pool.buckets = make(map[int][]coldata.Batch)
+		a.pool.numBatches = 0
+	}
+	// The usage of the children has been released as well.
+	for _, c := range a.children {
+		c.numLiveBatches = 0
+		c.liveBatchStacks = nil
+	}
 }
 
 // sizeOfDecimals returns the size of the given decimals slice. It only accounts
@@ -588,12 +2674,34 @@ func sizeOfDecimals(decimals coldata.Decimals, startIdx int) int64 {
 	return size
 }
 
+// BatchOverhead is the fixed memory footprint of a coldata.MemBatch (including
+// the header of its selection vector) that doesn't depend on the capacity or
+// on the number of vectors.
+const BatchOverhead = int64(unsafe.Sizeof(coldata.MemBatch{}))
+
+// VecOverhead is the fixed memory footprint of a single vector that doesn't
+// depend on its capacity: the coldata.Vec struct (including the header of its
+// nulls bitmap), the pointer to it in the slice of vectors of the batch, and
+// the header of the slice with the values.
+const VecOverhead = int64(unsafe.Sizeof(coldata.Vec{})) + int64(unsafe.Sizeof(&coldata.Vec{})) + int64(unsafe.Sizeof([]byte{}))
+
 // EstimateBatchSizeBytes returns an estimated amount of bytes needed to
-// store a batch in memory that has column types vecTypes.
+// store a batch in memory that has column types vecTypes. It includes the fixed
+// overhead of the batch and of its vectors (see BatchOverhead and VecOverhead)
+// but not the selection vector (see SelVectorSize).
 // WARNING: This only is correct for fixed width types, and returns an
 // estimate for non fixed width types. In future it might be possible to
 // remove the need for estimation by specifying batch sizes in terms of bytes.
 func EstimateBatchSizeBytes(vecTypes []*types.T, batchLength int) int64 {
+	if batchLength == 0 {
+		return 0
+	}
+	return BatchOverhead + estimateVecsSizeBytes(vecTypes, batchLength)
+}
+
+// estimateVecsSizeBytes is the same as EstimateBatchSizeBytes but only
+// includes the vectors of the given types, without the overhead of the batch.
+func estimateVecsSizeBytes(vecTypes []*types.T, batchLength int) int64 {
 	if batchLength == 0 {
 		return 0
 	}
@@ -641,7 +2749,9 @@ func EstimateBatchSizeBytes(vecTypes []*types.T, batchLength int) int64 {
 	// Allocator will measure the old footprint and the updated one and will
 	// update the memory account accordingly.
 	bytesVectorsSize := int64(numBytesVectors) * (coldata.FlatBytesOverhead + int64(batchLength)*coldata.ElementSize)
-	return acc*int64(batchLength) + bytesVectorsSize
+	// Each vector also has a nulls bitmap as well as the fixed overhead.
+	nullsSize := int64(len(vecTypes)) * NullsSize(batchLength)
+	return acc*int64(batchLength) + bytesVectorsSize + nullsSize + int64(len(vecTypes))*VecOverhead
 }
 
 // GetFixedSizeTypeSize returns the size of a type that is not variable in size;
@@ -713,6 +2823,11 @@ type AccountingHelper struct {
 	// each ResetMaybeReallocate call. At the moment, it can only be set by the
 	// SetAccountingHelper.
 	alwaysReallocate bool
+	// perRowAccounting, if set, indicates that the capacity of the batches must
+	// not be memorized since the memory limit is enforced after each row by
+	// the SetAccountingHelper. At the moment, it can only be set by the
+	// SetAccountingHelper.
+	perRowAccounting bool
 }
 
 // discardBatch returns true if the batch with the given memory footprint has
@@ -758,6 +2873,17 @@ func (h *AccountingHelper) Init(allocator *Allocator, memoryLimit int64) {
 func (h *AccountingHelper) ResetMaybeReallocate(
 	typs []*types.T, oldBatch coldata.Batch, tuplesToBeSet int,
 ) (newBatch coldata.Batch, reallocated bool) {
+	newBatch, reason := h.ResetMaybeReallocateWithReason(typs, oldBatch, tuplesToBeSet)
+	return newBatch, reason.Reallocated()
+}
+
+// ResetMaybeReallocateWithReason is the same as ResetMaybeReallocate but
+// returns the reason for the decision made instead of whether the batch was
+// reallocated.
+func (h *AccountingHelper) ResetMaybeReallocateWithReason(
+	typs []*types.T, oldBatch coldata.Batch, tuplesToBeSet int,
+) (newBatch coldata.Batch, reason ReallocReason) {
+	var discarded bool
 	if oldBatch != nil {
 		// First, do a quick check whether the allocator as a whole has exceeded
 		// the limit by too much. (The allocator here is allowed to be shared
@@ -765,16 +2891,18 @@ func (h *AccountingHelper) ResetMaybeReallocate(
 		// mem size, yet the allocator can provide a useful upper bound.)
 		if batchMemSizeUpperBound := h.allocator.Used(); h.discardBatch(batchMemSizeUpperBound) {
 			// Now check whether the precise footprint of the batch is too much.
-			if batchMemSize := GetBatchMemSize(oldBatch); h.discardBatch(batchMemSize) {
+			if batchMemSize := h.allocator.getBatchMemSize(oldBatch); h.discardBatch(batchMemSize) {
 				// The old batch has exceeded the memory limit by too much, so
 				// we release it and will allocate a new one that is at most
 				// half of the capacity.
 				newMaxCapacity := (oldBatch.Capacity() + 1) / 2 // round up
-				if h.maxCapacity == 0 || newMaxCapacity < h.maxCapacity {
+				if !h.perRowAccounting && (h.maxCapacity == 0 || newMaxCapacity < h.maxCapacity) {
 					h.maxCapacity = newMaxCapacity
 				}
 				h.allocator.ReleaseMemory(batchMemSize)
+				h.allocator.batchReleased(oldBatch)
 				oldBatch = nil
+				discarded = true
 			}
 		}
 	}
@@ -788,6 +2916,9 @@ func (h *AccountingHelper) ResetMaybeReallocate(
 	// batches.
 	minDesiredCapacity := tuplesToBeSet
 	desiredCapacitySufficient := tuplesToBeSet > 0
+	// cappedByMemoryLimit is true if the ask is reduced because of the max
+	// capacity memorized when the memory limit was reached.
+	var cappedByMemoryLimit bool
 	if h.maxCapacity > 0 && (h.maxCapacity <= tuplesToBeSet || tuplesToBeSet == 0) {
 		// If we have already exceeded the max capacity, and
 		// - that capacity doesn't exceed the number of tuples to be set, or
@@ -796,11 +2927,22 @@ func (h *AccountingHelper) ResetMaybeReallocate(
 		// allocating larger batch.
 		minDesiredCapacity = h.maxCapacity
 		desiredCapacitySufficient = true
+		cappedByMemoryLimit = h.maxCapacity < tuplesToBeSet || tuplesToBeSet == 0
 	}
 	var oldBatchReachedMemSize bool
-	newBatch, reallocated, oldBatchReachedMemSize = h.allocator.resetMaybeReallocate(
-		typs, oldBatch, minDesiredCapacity, h.maxBatchSize, h.memoryLimit, desiredCapacitySufficient, h.alwaysReallocate,
+	newBatch, reason, oldBatchReachedMemSize = h.allocator.resetMaybeReallocate(
+		typs, oldBatch, minDesiredCapacity, h.allocator.governedMaxBatchSize(h.maxBatchSize), h.memoryLimit,
+		desiredCapacitySufficient, h.alwaysReallocate,
 	)
+	if discarded {
+		reason = ReallocMemoryLimitExceeded
+	} else if reason == ReuseCapacitySufficient && cappedByMemoryLimit {
+		reason = ReuseMemoryLimitReached
+	}
+	h.allocator.recordReset(reason)
+	if h.perRowAccounting {
+		return newBatch, reason
+	}
 	if oldBatchReachedMemSize && h.maxCapacity == 0 {
 		// The old batch has just reached the memory size for the first time, so
 		// we memorize the maximum capacity. Note that this is not strictly
@@ -809,13 +2951,13 @@ func (h *AccountingHelper) ResetMaybeReallocate(
 		// allows us to avoid computing the memory size of the batch on each
 		// call.
 		h.maxCapacity = oldBatch.Capacity()
-	} else if reallocated && GetBatchMemSize(newBatch) >= h.memoryLimit {
+	} else if reason.Reallocated() && h.allocator.getBatchMemSize(newBatch) >= h.memoryLimit {
 		// A new batch has just been allocated and it exceeds the memory limit,
 		// so we memorize its capacity to use from now on. Notably, this will
 		// also ensure that the SetAccountingHelper will use the full capacity
 		// of this batch when variable-width types are present.
 		if buildutil.CrdbTestBuild {
-			if batchMemSize := GetBatchMemSize(newBatch); h.discardBatch(batchMemSize) && newBatch.Capacity() > 1 {
+			if batchMemSize := h.allocator.getBatchMemSize(newBatch); h.discardBatch(batchMemSize) && newBatch.Capacity() > 1 {
 				colexecerror.InternalError(errors.AssertionFailedf(
 					"newly-allocated batch of capacity %d should be discarded right away: "+
 						"memory limit %d, batch mem size %d", newBatch.Capacity(), h.memoryLimit, batchMemSize,
@@ -824,7 +2966,7 @@ func (h *AccountingHelper) ResetMaybeReallocate(
 		}
 		h.maxCapacity = newBatch.Capacity()
 	}
-	return newBatch, reallocated
+	return newBatch, reason
 }
 
 // SetAccountingHelper is a utility struct that should be used by callers that
@@ -876,6 +3018,18 @@ type SetAccountingHelper struct {
 	// varSizeVecIdxs vectors which is accounted for by EstimateBatchSizeBytes.
 	// It serves as the initial value for varSizeDatumSizes values.
 	varSizeEstimatePerRow int64
+
+	// perRowAccounting indicates whether the per-row accounting mode is
+	// enabled (see EnablePerRowAccounting).
+	perRowAccounting bool
+	// batchFixedSize is the estimated footprint of the last batch returned by
+	// ResetMaybeReallocate excluding the variable-length values. It is only
+	// used in the per-row accounting mode.
+	batchFixedSize int64
+	// batchVarLenSize is the footprint of the variable-length values set in
+	// the last batch returned by ResetMaybeReallocate. It is only used in the
+	// per-row accounting mode.
+	batchVarLenSize int64
 }
 
 // Init initializes the helper. The allocator must **not** be shared with any
@@ -922,6 +3076,25 @@ func (h *SetAccountingHelper) SetMaxBatchSize(maxBatchSize int) {
 	h.helper.maxBatchSize = maxBatchSize
 }
 
+// EnablePerRowAccounting enables the per-row accounting mode. It must be
+// called after Init and before the first call to ResetMaybeReallocate.
+//
+// By default, once a batch reaches the memory limit, its capacity is
+// memorized, and all following batches are filled up to that capacity
+// regardless of the width of their rows. In the per-row accounting mode,
+// AccountForSet instead tracks the footprint of the variable-length values of
+// each row set in the current batch, and the batch is done as soon as the
+// footprint of the batch reaches the memory limit. This is meant for the
+// callers that might encounter very wide rows (e.g. large strings) so that a
+// handful of such rows doesn't blow past the memory limit, at the cost of
+// shorter batches. The batches that exceed the memory limit by too much are
+// still discarded by ResetMaybeReallocate, but the capacity of the following
+// batches isn't reduced.
+func (h *SetAccountingHelper) EnablePerRowAccounting() {
+	h.perRowAccounting = true
+	h.helper.perRowAccounting = true
+}
+
 func (h *SetAccountingHelper) getBytesLikeTotalSize() int64 {
 	var bytesLikeTotalSize int64
 	for _, b := range h.bytesLikeVectors {
@@ -938,9 +3111,19 @@ func (h *SetAccountingHelper) getBytesLikeTotalSize() int64 {
 func (h *SetAccountingHelper) ResetMaybeReallocate(
 	typs []*types.T, oldBatch coldata.Batch, tuplesToBeSet int,
 ) (newBatch coldata.Batch, reallocated bool) {
-	newBatch, reallocated = h.helper.ResetMaybeReallocate(typs, oldBatch, tuplesToBeSet)
+	newBatch, reason := h.ResetMaybeReallocateWithReason(typs, oldBatch, tuplesToBeSet)
+	return newBatch, reason.Reallocated()
+}
+
+// ResetMaybeReallocateWithReason is the same as ResetMaybeReallocate but
+// returns the reason for the decision made instead of whether the batch was
+// reallocated.
+func (h *SetAccountingHelper) ResetMaybeReallocateWithReason(
+	typs []*types.T, oldBatch coldata.Batch, tuplesToBeSet int,
+) (newBatch coldata.Batch, reason ReallocReason) {
+	newBatch, reason = h.helper.ResetMaybeReallocateWithReason(typs, oldBatch, tuplesToBeSet)
 	h.curCapacity = newBatch.Capacity()
-	if reallocated && !h.allFixedLength {
+	if reason.Reallocated() && !h.allFixedLength {
 		// Allocator.resetMaybeReallocate has released the precise memory
 		// footprint of the old batch and has accounted for the estimated
 		// footprint of the new batch. This means that we need to update our
@@ -948,9 +3131,9 @@ func (h *SetAccountingHelper) ResetMaybeReallocate(
 		//
 		// Note that the loops below have type switches, but that is acceptable
 		// given that a batch is reallocated limited number of times throughout
-		// the lifetime of the helper's user (namely, at most
-		// log2(coldata.BatchSize())+1 (=11 by default) times since we double
-		// the capacity until coldata.BatchSize()).
+		// the lifetime of the helper's user (namely, with the default growth
+		// policy, at most log2(coldata.BatchSize())+1 (=11 by default) times
+		// since we double the capacity until coldata.BatchSize()).
 		vecs := newBatch.ColVecs()
 		if !h.bytesLikeVecIdxs.Empty() {
 			h.bytesLikeVectors = h.bytesLikeVectors[:0]
@@ -989,14 +3172,23 @@ func (h *SetAccountingHelper) ResetMaybeReallocate(
 				h.varSizeDatumSizes[i] = h.varSizeEstimatePerRow
 			}
 		}
+		if h.perRowAccounting {
+			// The estimated footprint of the decimals and the datums will be
+			// replaced by the actual footprint of the values in AccountForSet.
+			h.batchFixedSize = SelVectorSize(h.curCapacity) + EstimateBatchSizeBytes(typs, h.curCapacity) -
+				int64(h.curCapacity)*h.varSizeEstimatePerRow
+		}
 	}
-	return newBatch, reallocated
+	h.batchVarLenSize = 0
+	return newBatch, reason
 }
 
 // AccountForSet updates the Allocator according to the new variable length
 // values in the row rowIdx in the batch that was returned by the last call to
 // ResetMaybeReallocate. It returns a boolean indicating whether the batch is
 // done (i.e. no more rows should be set on it before it is reset).
+//
+// In the per-row accounting mode, each row must be set only once per batch.
 func (h *SetAccountingHelper) AccountForSet(rowIdx int) (batchDone bool) {
 	// The batch is done if we've just set the last row that the batch has the
 	// capacity for.
@@ -1008,10 +3200,21 @@ func (h *SetAccountingHelper) AccountForSet(rowIdx int) (batchDone bool) {
 		return batchDone
 	}
 
+	// rowVarLenSize is the footprint of the variable-length values of the row.
+	// It is only computed in the per-row accounting mode.
+	var rowVarLenSize int64
 	if len(h.bytesLikeVectors) > 0 {
 		newBytesLikeTotalSize := h.getBytesLikeTotalSize()
 		h.helper.allocator.AdjustMemoryUsageAfterAllocation(newBytesLikeTotalSize - h.prevBytesLikeTotalSize)
 		h.prevBytesLikeTotalSize = newBytesLikeTotalSize
+		if h.perRowAccounting {
+			// Note that the buffers of a reused batch might not grow, so we
+			// use the size of the values themselves (ElementSize has been
+			// included into batchFixedSize).
+			for _, b := range h.bytesLikeVectors {
+				rowVarLenSize += b.ElemSize(rowIdx) - coldata.ElementSize
+			}
+		}
 	}
 
 	if !h.varSizeVecIdxs.Empty() {
@@ -1026,6 +3229,15 @@ func (h *SetAccountingHelper) AccountForSet(rowIdx int) (batchDone bool) {
 		}
 		h.helper.allocator.AdjustMemoryUsageAfterAllocation(newVarLengthDatumSize - h.varSizeDatumSizes[rowIdx])
 		h.varSizeDatumSizes[rowIdx] = newVarLengthDatumSize
+		rowVarLenSize += newVarLengthDatumSize
+	}
+
+	if h.perRowAccounting {
+		// The batch is done once its footprint reaches the memory limit (the
+		// current row is always included). The capacity is not memorized
+		// since the following rows might be of very different width.
+		h.batchVarLenSize += rowVarLenSize
+		return batchDone || h.batchFixedSize+h.batchVarLenSize >= h.helper.memoryLimit
 	}
 
 	// The allocator is not shared with any other components, so we can just use
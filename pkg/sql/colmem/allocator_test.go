@@ -16,6 +16,7 @@ import (
 	"math"
 	"testing"
 
+	"github.com/cockroachdb/apd/v3"
 	"github.com/cockroachdb/cockroach/pkg/col/coldata"
 	"github.com/cockroachdb/cockroach/pkg/col/coldataext"
 	"github.com/cockroachdb/cockroach/pkg/col/typeconv"
@@ -24,16 +25,20 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/sql/colexec/colexecutils"
 	"github.com/cockroachdb/cockroach/pkg/sql/colexecerror"
 	"github.com/cockroachdb/cockroach/pkg/sql/colmem"
+	"github.com/cockroachdb/cockroach/pkg/sql/memsize"
 	"github.com/cockroachdb/cockroach/pkg/sql/randgen"
 	"github.com/cockroachdb/cockroach/pkg/sql/sem/eval"
 	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlerrors"
 	"github.com/cockroachdb/cockroach/pkg/sql/types"
 	"github.com/cockroachdb/cockroach/pkg/testutils/skip"
+	"github.com/cockroachdb/cockroach/pkg/util/buildutil"
 	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
 	"github.com/cockroachdb/cockroach/pkg/util/mon"
 	"github.com/cockroachdb/cockroach/pkg/util/randutil"
 	"github.com/cockroachdb/errors"
+	"github.com/cockroachdb/redact"
 	"github.com/stretchr/testify/require"
 )
 
@@ -111,6 +116,62 @@ func TestMaybeAppendColumn(t *testing.T) {
 	})
 }
 
+// TestMaybeAppendColumnAttribution verifies that the memory of the columns
+// appended via MaybeAppendColumn to the batch allocated by another allocator
+// is attributed to the appending allocator.
+func TestMaybeAppendColumnAttribution(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	rng, _ := randutil.NewTestRand()
+	// Use increment of 1 so that no allocations are "reserved".
+	upstream, upstreamAcc, upstreamCleanup := getAllocator(1 /* increment */)
+	defer upstreamCleanup()
+	projection, projectionAcc, projectionCleanup := getAllocator(1 /* increment */)
+	defer projectionCleanup()
+
+	capacity := rng.Intn(coldata.BatchSize()) + 1
+	b := upstream.NewMemBatchWithFixedCapacity([]*types.T{types.Int}, capacity)
+	b.SetLength(capacity)
+	upstreamUsed := upstreamAcc.Used()
+	require.Equal(t, colmem.GetBatchMemSize(b), upstreamUsed)
+
+	for i := 0; i < 3; i++ {
+		// The first iteration appends the column whereas the others reuse
+		// it.
+		projection.MaybeAppendColumn(b, types.Bytes, 1 /* colIdx */)
+		projection.PerformOperation(b.ColVecs()[1:], func() {
+			for j := 0; j < capacity; j++ {
+				b.ColVec(1).Bytes().Set(j, make([]byte, rng.Intn(2*coldata.BytesMaxInlineLength)))
+			}
+		})
+		// The upstream account is not affected, and the accounts are
+		// reconciled.
+		require.Equal(t, upstreamUsed, upstreamAcc.Used())
+		require.Equal(t, colmem.GetBatchMemSize(b), upstreamAcc.Used()+projectionAcc.Used())
+	}
+
+	if buildutil.CrdbTestBuild {
+		// The appended column cannot be reused by another allocator.
+		other, _, otherCleanup := getAllocator(1 /* increment */)
+		defer otherCleanup()
+		require.Error(t, colexecerror.CatchVectorizedRuntimeError(func() {
+			other.MaybeAppendColumn(b, types.Bytes, 1 /* colIdx */)
+		}))
+	}
+	// The allocator of the batch can reuse its own columns.
+	upstream.MaybeAppendColumn(b, types.Int, 0 /* colIdx */)
+
+	projection.ReleaseAppendedColumns(b)
+	require.Zero(t, projectionAcc.Used())
+	require.Equal(t, upstreamUsed, upstreamAcc.Used())
+	// Releasing again is a noop.
+	projection.ReleaseAppendedColumns(b)
+	require.Zero(t, projectionAcc.Used())
+	upstream.ReleaseBatch(b)
+	require.Zero(t, upstreamAcc.Used())
+}
+
 func TestPerformAppend(t *testing.T) {
 	defer leaktest.AfterTest(t)()
 	defer log.Scope(t).Close(t)
@@ -186,6 +247,117 @@ func TestPerformAppend(t *testing.T) {
 	}
 }
 
+// TestAppendBatch verifies that Allocator.AppendBatch correctly appends the
+// tuples of all canonical type families while honoring the nulls and the
+// selection vectors, and that it precisely accounts for the memory footprint
+// of the resulting batch.
+func TestAppendBatch(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	// Include a type of each canonical type family (as well as of each width
+	// of the integers). The datum-backed type must be the last one.
+	allTypes := []*types.T{
+		types.Bool, types.Bytes, types.Decimal, types.Int2, types.Int4, types.Int,
+		types.Float, types.TimestampTZ, types.Interval, types.Jsonb, types.Geometry,
+	}
+	const decimalIdx = 2
+	const nullProbability = 0.2
+	const selProbability = 0.5
+
+	rng, _ := randutil.NewTestRand()
+	// The source batches are populated without any memory accounting, so they
+	// use a separate allocator.
+	srcAllocator, _, srcCleanup := getAllocator(increment)
+	defer srcCleanup()
+	testAllocator, _, cleanup := getAllocator(increment)
+	defer cleanup()
+
+	getRandomSrcBatch := func(typs []*types.T) coldata.Batch {
+		capacity := rng.Intn(coldata.BatchSize()) + 1
+		b := srcAllocator.NewMemBatchWithFixedCapacity(typs, capacity)
+		for vecIdx, typ := range typs {
+			vec := b.ColVec(vecIdx)
+			converter := colconv.GetDatumToPhysicalFn(typ)
+			for i := 0; i < capacity; i++ {
+				if rng.Float64() < nullProbability {
+					vec.Nulls().SetNull(i)
+					continue
+				}
+				datum := randgen.RandDatum(rng, typ, false /* nullOk */)
+				coldata.SetValueAt(vec, converter(datum), i)
+			}
+		}
+		b.SetLength(capacity)
+		if rng.Float64() < selProbability {
+			b.SetSelection(true)
+			sel := b.Selection()[:0]
+			for i := 0; i < capacity; i++ {
+				if rng.Float64() < 0.5 {
+					sel = append(sel, i)
+				}
+			}
+			b.SetLength(len(sel))
+		}
+		return b
+	}
+
+	// srcTuple identifies a physical tuple in the source batch.
+	type srcTuple struct {
+		b      coldata.Batch
+		rowIdx int
+	}
+	numIterations := rng.Intn(5) + 1
+	for iteration := 0; iteration < numIterations; iteration++ {
+		// The footprint of the datum-backed vectors is overestimated when
+		// they are allocated, so the accounting can only be checked precisely
+		// without them.
+		typs := allTypes
+		withDatums := rng.Float64() < 0.5
+		if !withDatums {
+			typs = allTypes[:len(allTypes)-1]
+		}
+		var dst coldata.Batch
+		var expected []srcTuple
+		numAppends := rng.Intn(10) + 1
+		for i := 0; i < numAppends; i++ {
+			src := getRandomSrcBatch(typs)
+			startIdx := rng.Intn(src.Length() + 1)
+			endIdx := startIdx + rng.Intn(src.Length()-startIdx+1)
+			for idx := startIdx; idx < endIdx; idx++ {
+				rowIdx := idx
+				if sel := src.Selection(); sel != nil {
+					rowIdx = sel[idx]
+				}
+				expected = append(expected, srcTuple{b: src, rowIdx: rowIdx})
+			}
+			dst = testAllocator.AppendBatch(dst, src, startIdx, endIdx)
+			require.Equal(t, len(expected), dst.Length())
+			require.Nil(t, dst.Selection())
+			// The footprint of the old batches (if any were reallocated) must
+			// have been released.
+			if withDatums {
+				require.LessOrEqual(t, colmem.GetBatchMemSize(dst), testAllocator.Used())
+			} else {
+				require.Equal(t, colmem.GetBatchMemSize(dst), testAllocator.Used())
+			}
+		}
+		for i, tuple := range expected {
+			for vecIdx := range typs {
+				expectedValue := coldata.GetValueAt(tuple.b.ColVec(vecIdx), tuple.rowIdx)
+				actualValue := coldata.GetValueAt(dst.ColVec(vecIdx), i)
+				if vecIdx == decimalIdx && expectedValue != nil && actualValue != nil {
+					expectedDecimal, actualDecimal := expectedValue.(apd.Decimal), actualValue.(apd.Decimal)
+					require.Zero(t, expectedDecimal.Cmp(&actualDecimal), "tuple %d of type %s", i, typs[vecIdx])
+					continue
+				}
+				require.Equal(t, expectedValue, actualValue, "tuple %d of type %s", i, typs[vecIdx])
+			}
+		}
+		testAllocator.ReleaseAll()
+	}
+}
+
 // TestAccountingHelper verifies that the colmem.AccountingHelper makes
 // reasonable decisions about when to allocate new batches.
 func TestAccountingHelper(t *testing.T) {
@@ -212,7 +384,8 @@ func TestAccountingHelper(t *testing.T) {
 	// overhead returns the overhead of the batch with a single coldata.Bytes
 	// vector.
 	overhead := func(batchCapacity int) int64 {
-		return colmem.SelVectorSize(batchCapacity) +
+		return colmem.BatchOverhead + colmem.VecOverhead +
+			colmem.SelVectorSize(batchCapacity) +
 			coldata.FlatBytesOverhead +
 			int64(batchCapacity)*coldata.ElementSize
 	}
@@ -222,10 +395,9 @@ func TestAccountingHelper(t *testing.T) {
 		// expectedCapacity specifies the expected capacity of the batch after
 		// ResetMaybeReallocate call of the current iteration.
 		expectedCapacity int
-		// expectedReallocated specifies whether the batch is expected to be
-		// reallocated during the ResetMaybeReallocate call of the current
-		// iteration.
-		expectedReallocated bool
+		// expectedReason specifies the expected decision of the
+		// ResetMaybeReallocate call of the current iteration.
+		expectedReason colmem.ReallocReason
 		// bytesValueSize determines the footprint of the bytes values that are
 		// set during the current iteration. Note that this only affects the
 		// call to ResetMaybeReallocate of the **next** iteration.
@@ -240,9 +412,9 @@ func TestAccountingHelper(t *testing.T) {
 	}
 	errorMessage := func(tc testCase, i iteration) string {
 		return fmt.Sprintf(
-			"tc: limit=%d, tuples=%d, iterations=%d i: cap=%d, realloc=%t, size=%d",
+			"tc: limit=%d, tuples=%d, iterations=%d i: cap=%d, reason=%s, size=%d",
 			tc.memoryLimit, tc.totalTuples, len(tc.iterations), i.expectedCapacity,
-			i.expectedReallocated, i.bytesValueSize,
+			i.expectedReason, i.bytesValueSize,
 		)
 	}
 
@@ -255,12 +427,12 @@ func TestAccountingHelper(t *testing.T) {
 			memoryLimit: math.MaxInt64,
 			totalTuples: 0,
 			iterations: []iteration{
-				{1, true, 100},
-				{2, true, 200},
-				{4, true, 400},
-				{7, true, 700},
-				{7, false, 700},
-				{7, false, 700},
+				{1, colmem.ReallocNoOldBatch, 100},
+				{2, colmem.ReallocCapacityTooSmall, 200},
+				{4, colmem.ReallocCapacityTooSmall, 400},
+				{7, colmem.ReallocCapacityTooSmall, 700},
+				{7, colmem.ReuseCapacitySufficient, 700},
+				{7, colmem.ReuseCapacitySufficient, 700},
 			},
 		},
 		// A couple of tests for when the total number of tuples is known in
@@ -269,28 +441,43 @@ func TestAccountingHelper(t *testing.T) {
 			memoryLimit: math.MaxInt64,
 			totalTuples: 4,
 			iterations: []iteration{
-				{4, true, 400},
+				{4, colmem.ReallocNoOldBatch, 400},
 			},
 		},
 		{
 			memoryLimit: math.MaxInt64,
 			totalTuples: 13,
 			iterations: []iteration{
-				{7, true, 700},
-				{7, false, 600},
+				{7, colmem.ReallocNoOldBatch, 700},
+				{7, colmem.ReuseCapacitySufficient, 600},
 			},
 		},
 		// A test case when the memory limit is exceeded on the third iteration
-		// at which point the batch no longer grows but is reused.
+		// at which point the batch no longer grows but is reused. (The values
+		// are empty on the first two iterations so that the measured footprint
+		// of the old batch doesn't prevent the growth.)
 		{
 			memoryLimit: 300 + overhead(3),
 			totalTuples: 0,
 			iterations: []iteration{
-				{1, true, 100},
-				{2, true, 200},
-				{4, true, 400},
-				{4, false, 400},
-				{4, false, 400},
+				{1, colmem.ReallocNoOldBatch, 0},
+				{2, colmem.ReallocCapacityTooSmall, 0},
+				{4, colmem.ReallocCapacityTooSmall, 400},
+				{4, colmem.ReuseMemoryLimitReached, 400},
+				{4, colmem.ReuseMemoryLimitReached, 400},
+			},
+		},
+		// A test case when the measured footprint of the old batch shows that
+		// the batch of double capacity would exceed the memory limit, so the
+		// old batch is reused.
+		{
+			memoryLimit: 300 + overhead(3),
+			totalTuples: 0,
+			iterations: []iteration{
+				{1, colmem.ReallocNoOldBatch, 100},
+				{2, colmem.ReallocCapacityTooSmall, 200},
+				{2, colmem.ReuseMemoryLimitReached, 200},
+				{2, colmem.ReuseMemoryLimitReached, 200},
 			},
 		},
 		// A test case with values of different sizes with the memory limit
@@ -299,27 +486,27 @@ func TestAccountingHelper(t *testing.T) {
 			memoryLimit: 300 + overhead(3),
 			totalTuples: 0,
 			iterations: []iteration{
-				{1, true, 100},
-				{2, true, 200},
-				{4, true, 400},
+				{1, colmem.ReallocNoOldBatch, 0},
+				{2, colmem.ReallocCapacityTooSmall, 0},
+				{4, colmem.ReallocCapacityTooSmall, 400},
 				// The limit has just been exceeded, but not by too much, so we
 				// reuse the same batch.
-				{4, false, 1400},
+				{4, colmem.ReuseMemoryLimitReached, 1400},
 				// Now the limit has been exceeded by too much - a new batch of
 				// smaller capacity must be allocated.
-				{2, true, 200},
-				{2, false, 200},
-				{2, false, 1200},
+				{2, colmem.ReallocMemoryLimitExceeded, 200},
+				{2, colmem.ReuseMemoryLimitReached, 200},
+				{2, colmem.ReuseMemoryLimitReached, 1200},
 				// Now the limit has been exceeded by too much again - a new
 				// batch of smaller capacity must be allocated.
-				{1, true, 400},
+				{1, colmem.ReallocMemoryLimitExceeded, 400},
 				// The limit has been exceeded but not by too much, so the batch
 				// is reused.
-				{1, false, 1100},
+				{1, colmem.ReuseMemoryLimitReached, 1100},
 				// Now the limit has been exceeded by too much again - a new
 				// batch is allocated, but we cannot reduce the capacity since
 				// we're at the minimum already.
-				{1, true, 100},
+				{1, colmem.ReallocMemoryLimitExceeded, 100},
 			},
 		},
 		// A test case with values of different sizes with the memory limit
@@ -329,16 +516,16 @@ func TestAccountingHelper(t *testing.T) {
 			memoryLimit: 300 + overhead(3),
 			totalTuples: 17,
 			iterations: []iteration{
-				{7, true, 700},
+				{7, colmem.ReallocNoOldBatch, 900},
 				// The limit has been exceeded by too much - a new batch of
 				// smaller capacity must be allocated.
-				{4, true, 400},
+				{4, colmem.ReallocMemoryLimitExceeded, 400},
 				// The limit has just been exceeded, but not by too much, so we
 				// reuse the same batch.
-				{4, false, 1400},
+				{4, colmem.ReuseMemoryLimitReached, 1400},
 				// Now the limit has been exceeded by too much again - a new
 				// batch of smaller capacity must be allocated.
-				{2, true, 100},
+				{2, colmem.ReallocMemoryLimitExceeded, 100},
 			},
 		},
 	} {
@@ -348,11 +535,11 @@ func TestAccountingHelper(t *testing.T) {
 		helper.Init(testAllocator, tc.memoryLimit)
 		tuplesToBeSet := tc.totalTuples
 		var batch coldata.Batch
-		var reallocated bool
+		var reason colmem.ReallocReason
 		for _, iteration := range tc.iterations {
-			batch, reallocated = helper.ResetMaybeReallocate(typs, batch, tuplesToBeSet)
+			batch, reason = helper.ResetMaybeReallocateWithReason(typs, batch, tuplesToBeSet)
 			require.Equal(t, iteration.expectedCapacity, batch.Capacity(), errorMessage(tc, iteration))
-			require.Equal(t, iteration.expectedReallocated, reallocated, errorMessage(tc, iteration))
+			require.Equal(t, iteration.expectedReason, reason, errorMessage(tc, iteration))
 			testAllocator.PerformOperation(batch.ColVecs(), func() {
 				batch.ColVec(0).Bytes().Set(0, v[:iteration.bytesValueSize])
 				batch.SetLength(batch.Capacity())
@@ -450,8 +637,8 @@ func TestSetAccountingHelperMemoryLimit(t *testing.T) {
 	defer leaktest.AfterTest(t)()
 	defer log.Scope(t).Close(t)
 
-	if coldata.BatchSize() < 4 {
-		skip.IgnoreLint(t, "the test assumes coldata.BatchSize() is at least 4")
+	if coldata.BatchSize() < 32 {
+		skip.IgnoreLint(t, "the test assumes coldata.BatchSize() is at least 32")
 	}
 
 	// Use increment of 1 so that no allocations are "reserved".
@@ -486,8 +673,8 @@ func TestSetAccountingHelperMemoryLimit(t *testing.T) {
 	require.Equal(t, smallCap, rowIdx)
 
 	// Attempt to allocate a batch with too large of a capacity.
-	b, reallocated := helper.ResetMaybeReallocate(typs, b, largeCap)
-	require.True(t, reallocated)
+	b, reason := helper.ResetMaybeReallocateWithReason(typs, b, largeCap)
+	require.Equal(t, colmem.ReallocCapacityTooSmall, reason)
 	// We expect that the ask of largeCap is not satisfied and that the batch
 	// of exactly mediumCap is allocated.
 	require.Equal(t, b.Capacity(), mediumCap)
@@ -506,8 +693,8 @@ func TestSetAccountingHelperMemoryLimit(t *testing.T) {
 	// Now try to allocate a batch of medium capacity plus one, but a new batch
 	// won't be allocated because the helper will estimate that it would exceed
 	// the (newly-updated) memory limit.
-	b, reallocated = helper.ResetMaybeReallocate(typs, b, mediumCap+1)
-	require.False(t, reallocated)
+	b, reason = helper.ResetMaybeReallocateWithReason(typs, b, mediumCap+1)
+	require.Equal(t, colmem.ReuseMemoryLimitReached, reason)
 	rowIdx = 0
 	for batchDone := false; !batchDone; {
 		batchDone = helper.AccountForSet(rowIdx)
@@ -516,6 +703,63 @@ func TestSetAccountingHelperMemoryLimit(t *testing.T) {
 	require.Equal(t, b.Capacity(), rowIdx)
 }
 
+// TestSetAccountingHelperPerRowAccounting verifies that in the per-row
+// accounting mode colmem.SetAccountingHelper stops the batch as soon as the
+// rows set into it reach the memory limit.
+func TestSetAccountingHelperPerRowAccounting(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	if coldata.BatchSize() < 16 {
+		skip.IgnoreLint(t, "the test assumes coldata.BatchSize() is at least 16")
+	}
+
+	// Use increment of 1 so that no allocations are "reserved".
+	testAllocator, _, cleanup := getAllocator(1 /* increment */)
+	defer cleanup()
+
+	typs := []*types.T{types.Int, types.Bytes}
+	const memoryLimit = 64 << 10
+	var helper colmem.SetAccountingHelper
+	helper.Init(testAllocator, memoryLimit, typs, false /* alwaysReallocate */)
+	helper.EnablePerRowAccounting()
+
+	var b coldata.Batch
+	for _, tc := range []struct {
+		// valueSize is the size of the Bytes value of each row.
+		valueSize int
+		// expectedRows is the number of rows that fit into each batch.
+		expectedRows int
+	}{
+		// The rows are such that four of them reach the memory limit.
+		{valueSize: memoryLimit / 4, expectedRows: 4},
+		// The rows individually fit within the memory limit, but the
+		// capacity memorized by the previous batches would exceed it.
+		{valueSize: memoryLimit / 2, expectedRows: 2},
+		// The limit is smaller than a single row.
+		{valueSize: 2 * memoryLimit, expectedRows: 1},
+		// The capacity isn't limited by the wide rows seen before.
+		{valueSize: memoryLimit / 4, expectedRows: 4},
+		// Narrow rows use the whole capacity of the batch.
+		{valueSize: 1, expectedRows: 16},
+	} {
+		value := make([]byte, tc.valueSize)
+		for i := 0; i < 3; i++ {
+			b, _ = helper.ResetMaybeReallocate(typs, b, 16 /* tuplesToBeSet */)
+			require.Equal(t, 16, b.Capacity())
+			var rowIdx int
+			for batchDone := false; !batchDone; rowIdx++ {
+				b.ColVec(0).Int64()[rowIdx] = int64(rowIdx)
+				b.ColVec(1).Bytes().Set(rowIdx, value)
+				batchDone = helper.AccountForSet(rowIdx)
+			}
+			require.Equal(t, tc.expectedRows, rowIdx, "value size %d", tc.valueSize)
+			b.SetLength(rowIdx)
+		}
+	}
+	helper.ReleaseMemory()
+}
+
 // TestEstimateBatchSizeBytes verifies that EstimateBatchSizeBytes returns such
 // an estimate that it equals the actual footprint of the newly-created batch
 // with no values set.
@@ -560,3 +804,1786 @@ func TestEstimateBatchSizeBytes(t *testing.T) {
 		}
 	}
 }
+
+// TestSelectionAndNullsAccounting verifies that the selection vector and the
+// nulls bitmaps are included in both the estimated and the measured footprint
+// of the batch.
+func TestSelectionAndNullsAccounting(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	rng, _ := randutil.NewTestRand()
+	testAllocator, memAcc, cleanup := getAllocator(1 /* increment */)
+	defer cleanup()
+
+	typs := []*types.T{types.Bool, types.Int, types.Float}
+	for run := 0; run < 10; run++ {
+		capacity := rng.Intn(coldata.BatchSize()) + 1
+		b := testAllocator.NewMemBatchWithFixedCapacity(typs, capacity)
+		expected := colmem.BatchOverhead + colmem.SelVectorSize(capacity)
+		for i, typ := range typs {
+			require.Equal(t, colmem.NullsSize(capacity), int64(cap(b.ColVec(i).Nulls().NullBitmap())))
+			expected += colmem.GetFixedSizeTypeSize(typ)*int64(capacity) + colmem.NullsSize(capacity) + colmem.VecOverhead
+		}
+		require.Equal(t, expected, colmem.EstimateBatchSizeBytes(typs, capacity)+colmem.SelVectorSize(capacity))
+		require.Equal(t, expected, colmem.GetBatchMemSize(b))
+		require.Equal(t, expected, memAcc.Used())
+		// The selection vector is allocated (and accounted for) upfront, so
+		// using it doesn't change the footprint.
+		b.SetSelection(true)
+		require.Equal(t, expected, colmem.GetBatchMemSize(b))
+		testAllocator.ReleaseBatch(b)
+		require.Zero(t, memAcc.Used())
+	}
+}
+
+// TestBatchOverheadAccounting verifies that the fixed overhead of the batch and
+// of its vectors is accounted for exactly once.
+func TestBatchOverheadAccounting(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	testAllocator, memAcc, cleanup := getAllocator(1 /* increment */)
+	defer cleanup()
+
+	const numCols = 20
+	typs := make([]*types.T, numCols)
+	for i := range typs {
+		typs[i] = types.Int
+	}
+	structOverhead := colmem.BatchOverhead + numCols*colmem.VecOverhead
+	b := testAllocator.NewMemBatchWithFixedCapacity(typs, 1 /* capacity */)
+	// The overhead exceeds the data for such small capacity.
+	require.Greater(t, structOverhead, numCols*memsize.Int64)
+	require.GreaterOrEqual(t, memAcc.Used(), structOverhead)
+	require.Equal(t, colmem.GetBatchMemSize(b), memAcc.Used())
+
+	// Reusing the batch doesn't register the overhead again.
+	used := memAcc.Used()
+	for i := 0; i < 3; i++ {
+		var reallocated bool
+		b, reallocated = testAllocator.ResetMaybeReallocateNoMemLimit(typs, b, 1 /* requiredCapacity */)
+		require.False(t, reallocated)
+		require.Equal(t, used, memAcc.Used())
+	}
+
+	// The overhead of the old batch is released when a new one is allocated.
+	b, _ = testAllocator.ResetMaybeReallocateNoMemLimit(typs, b, 2 /* requiredCapacity */)
+	require.Equal(t, colmem.GetBatchMemSize(b), memAcc.Used())
+	testAllocator.ReleaseBatch(b)
+	require.Zero(t, memAcc.Used())
+}
+
+// TestReleaseBatch verifies that colmem.Allocator.ReleaseBatch returns the
+// memory account to the level it had before the batch was allocated.
+func TestReleaseBatch(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	rng, _ := randutil.NewTestRand()
+	// Use increment of 1 so that no allocations are "reserved".
+	testAllocator, memAcc, cleanup := getAllocator(1 /* increment */)
+	defer cleanup()
+
+	typs := []*types.T{types.Int, types.Bytes, types.Decimal}
+	// Allocate a batch that will stay around so that the account is not
+	// empty.
+	_ = testAllocator.NewMemBatchWithFixedCapacity(typs, 1 /* capacity */)
+	before := memAcc.Used()
+
+	for run := 0; run < 10; run++ {
+		numRows := rng.Intn(coldata.BatchSize()) + 1
+		b := testAllocator.NewMemBatchWithFixedCapacity(typs, numRows)
+		testAllocator.PerformOperation(b.ColVecs(), func() {
+			for i := 0; i < numRows; i++ {
+				b.ColVec(1).Bytes().Set(i, make([]byte, rng.Intn(100)))
+			}
+			b.SetLength(numRows)
+		})
+		require.Less(t, before, memAcc.Used())
+		testAllocator.ReleaseBatch(b)
+		require.Equal(t, before, memAcc.Used())
+
+		if buildutil.CrdbTestBuild {
+			// Releasing the same batch again is detected.
+			require.Error(t, colexecerror.CatchVectorizedRuntimeError(func() {
+				testAllocator.ReleaseBatch(b)
+			}))
+			require.Equal(t, before, memAcc.Used())
+		}
+	}
+
+	// ReleaseAll releases everything, including the batch that wasn't
+	// released explicitly.
+	testAllocator.ReleaseAll()
+	require.Zero(t, memAcc.Used())
+}
+
+// TestMaxLiveBatches verifies that colmem.Allocator detects the batch leaks
+// once the maximum number of live batches is reached.
+func TestMaxLiveBatches(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	testAllocator, _, cleanup := getAllocator(increment)
+	defer cleanup()
+	const maxLiveBatches = 10
+	testAllocator.SetMaxLiveBatches(maxLiveBatches)
+	typs := []*types.T{types.Int}
+
+	// leakBatches allocates the batches without ever releasing them and returns
+	// the number of batches allocated before the error occurred.
+	leakBatches := func(allocator *colmem.Allocator) (numAllocated int, _ error) {
+		return numAllocated, colexecerror.CatchVectorizedRuntimeError(func() {
+			for i := 0; i < 10*maxLiveBatches; i++ {
+				_ = allocator.NewMemBatchWithFixedCapacity(typs, 1 /* capacity */)
+				numAllocated++
+			}
+		})
+	}
+	numAllocated, err := leakBatches(testAllocator)
+	require.True(t, errors.Is(err, colmem.ErrMaxLiveBatchesExceeded), "%v", err)
+	require.Contains(t, err.Error(), "test-mem")
+	require.Equal(t, maxLiveBatches, numAllocated)
+
+	// The batches that are released (both explicitly and when reallocated)
+	// are no longer live.
+	testAllocator.ReleaseAll()
+	require.NoError(t, colexecerror.CatchVectorizedRuntimeError(func() {
+		var b coldata.Batch
+		for i := 0; i < 10*maxLiveBatches; i++ {
+			b, _ = testAllocator.ResetMaybeReallocateNoMemLimit(typs, b, i%coldata.BatchSize()+1)
+			testAllocator.ReleaseBatch(testAllocator.NewMemBatchWithFixedCapacity(typs, 1 /* capacity */))
+		}
+	}))
+
+	// The error identifies the child allocator.
+	testAllocator.ReleaseAll()
+	child := testAllocator.NewChildAllocator("leaky-child", math.MaxInt64)
+	child.SetMaxLiveBatches(maxLiveBatches)
+	numAllocated, err = leakBatches(child)
+	require.True(t, errors.Is(err, colmem.ErrMaxLiveBatchesExceeded), "%v", err)
+	require.Contains(t, err.Error(), "leaky-child")
+	require.Equal(t, maxLiveBatches, numAllocated)
+}
+
+// TestTransferBatchOwnership verifies that colmem.TransferBatchOwnership moves
+// the memory footprint of a batch between the allocators.
+func TestTransferBatchOwnership(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	st := cluster.MakeTestingClusterSettings()
+	evalCtx := eval.MakeTestingEvalContext(st)
+	testColumnFactory := coldataext.NewExtendedColumnFactory(&evalCtx)
+	// makeAllocator returns a new allocator with the given memory limit.
+	makeAllocator := func(limit int64) *colmem.Allocator {
+		testMemMonitor := mon.NewMonitor(mon.Options{
+			Name:      "test-mem",
+			Limit:     limit,
+			Increment: 1,
+			Settings:  st,
+		})
+		testMemMonitor.Start(ctx, nil, mon.NewStandaloneBudget(math.MaxInt64))
+		memAcc := testMemMonitor.MakeBoundAccount()
+		t.Cleanup(func() {
+			memAcc.Close(ctx)
+			testMemMonitor.Stop(ctx)
+		})
+		return colmem.NewAllocator(ctx, &memAcc, testColumnFactory)
+	}
+	from := makeAllocator(math.MaxInt64)
+	to := makeAllocator(math.MaxInt64)
+	transfer := func(from, to *colmem.Allocator, b coldata.Batch) error {
+		return colexecerror.CatchVectorizedRuntimeError(func() {
+			colmem.TransferBatchOwnership(from, to, b)
+		})
+	}
+
+	typs := []*types.T{types.Int, types.Bytes, types.Decimal}
+	// Allocate a batch that will stay around so that the account of the
+	// source allocator is not empty.
+	_ = from.NewMemBatchWithFixedCapacity(typs, 1 /* capacity */)
+	fromBefore := from.Used()
+	b := from.NewMemBatchWithFixedCapacity(typs, 4 /* capacity */)
+	from.PerformOperation(b.ColVecs(), func() {
+		for i := 0; i < 4; i++ {
+			b.ColVec(1).Bytes().Set(i, make([]byte, 100))
+		}
+		b.SetLength(4)
+	})
+	size := colmem.GetBatchMemSize(b)
+	require.Equal(t, fromBefore+size, from.Used())
+
+	// The footprint of the batch is moved to the destination allocator.
+	require.NoError(t, transfer(from, to, b))
+	require.Equal(t, fromBefore, from.Used())
+	require.Equal(t, size, to.Used())
+
+	if buildutil.CrdbTestBuild {
+		// The batch is no longer owned by the source allocator.
+		require.Error(t, transfer(from, to, b))
+		require.Equal(t, fromBefore, from.Used())
+		require.Equal(t, size, to.Used())
+	}
+
+	// The batch can be transferred back and forth.
+	for i := 0; i < 3; i++ {
+		require.NoError(t, transfer(to, from, b))
+		require.Equal(t, fromBefore+size, from.Used())
+		require.Zero(t, to.Used())
+		require.NoError(t, transfer(from, to, b))
+		require.Equal(t, fromBefore, from.Used())
+		require.Equal(t, size, to.Used())
+	}
+
+	// The destination allocator that cannot absorb the footprint of the batch
+	// refuses the transfer, and the source allocator keeps the ownership.
+	limited := makeAllocator(size - 1)
+	err := transfer(to, limited, b)
+	require.True(t, sqlerrors.IsOutOfMemoryError(err), "%v", err)
+	require.Equal(t, size, to.Used())
+	require.Zero(t, limited.Used())
+	to.ReleaseBatch(b)
+	require.Zero(t, to.Used())
+}
+
+// leakBatchForTesting allocates a batch that is never released.
+func leakBatchForTesting(allocator *colmem.Allocator) {
+	_ = allocator.NewMemBatchWithFixedCapacity([]*types.T{types.Int}, 1 /* capacity */)
+}
+
+// TestAssertEmpty verifies that colmem.Allocator.AssertEmpty detects the
+// leaked batches and reports their allocation sites.
+func TestAssertEmpty(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	if !buildutil.CrdbTestBuild {
+		skip.IgnoreLint(t, "AssertEmpty is only effective in test builds")
+	}
+
+	testAllocator, _, cleanup := getAllocator(increment)
+	defer cleanup()
+	typs := []*types.T{types.Int}
+	assertEmpty := func() error {
+		return colexecerror.CatchVectorizedRuntimeError(testAllocator.AssertEmpty)
+	}
+	require.NoError(t, assertEmpty())
+
+	// The batches that have been released (both explicitly and when
+	// reallocated) are not reported.
+	var b coldata.Batch
+	for i := 1; i <= 4; i++ {
+		b, _ = testAllocator.ResetMaybeReallocateNoMemLimit(typs, b, i)
+	}
+	testAllocator.ReleaseBatch(b)
+	require.NoError(t, assertEmpty())
+
+	leakBatchForTesting(testAllocator)
+	err := assertEmpty()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "1 batches haven't been released")
+	require.Contains(t, err.Error(), "leakBatchForTesting")
+	require.Contains(t, err.Error(), "allocator_test.go")
+
+	// The memory that is not attributed to any batch is reported too.
+	testAllocator.ReleaseAll()
+	require.NoError(t, assertEmpty())
+	testAllocator.AdjustMemoryUsage(1)
+	require.Error(t, assertEmpty())
+	testAllocator.ReleaseAll()
+	require.NoError(t, assertEmpty())
+}
+
+// TestBatchPool verifies that colmem.Allocator reuses the pooled batches
+// without changing the memory accounting and that they come back reset.
+func TestBatchPool(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	if coldata.BatchSize() < 2 {
+		skip.IgnoreLint(t, "the test assumes coldata.BatchSize() is at least 2")
+	}
+
+	// Use increment of 1 so that no allocations are "reserved".
+	testAllocator, memAcc, cleanup := getAllocator(1 /* increment */)
+	defer cleanup()
+	const maxPooledBatches = 2
+	testAllocator.EnableBatchPool(maxPooledBatches)
+
+	typs := []*types.T{types.Int, types.Bytes}
+	capacity := coldata.BatchSize()
+	b := testAllocator.GetPooledBatch(typs, capacity)
+	testAllocator.PerformOperation(b.ColVecs(), func() {
+		b.ColVec(0).Int64()[0] = 1
+		b.ColVec(1).Bytes().Set(1, make([]byte, 100))
+		b.ColVec(1).Nulls().SetNull(0)
+	})
+	b.SetLength(2)
+	b.SetSelection(true)
+	used := memAcc.Used()
+
+	// The memory of the pooled batch stays accounted for.
+	testAllocator.PutPooledBatch(b)
+	require.Equal(t, used, memAcc.Used())
+
+	// The batches with different schema or capacity are not reused.
+	other := testAllocator.GetPooledBatch([]*types.T{types.Int, types.Int}, capacity)
+	require.True(t, other != b)
+	other2 := testAllocator.GetPooledBatch(typs, capacity-1)
+	require.True(t, other2 != b)
+	used = memAcc.Used()
+
+	// The pooled batch is reused without any accounting and is reset.
+	reused := testAllocator.GetPooledBatch(typs, capacity)
+	require.True(t, reused == b)
+	require.Equal(t, used, memAcc.Used())
+	require.Zero(t, reused.Length())
+	require.Nil(t, reused.Selection())
+	require.False(t, reused.ColVec(1).MaybeHasNulls())
+	require.NotPanics(t, func() { reused.ColVec(1).Bytes().Set(0, []byte("foo")) })
+
+	// Once the pool is full, the memory of the batches put into it is
+	// released.
+	testAllocator.PutPooledBatch(reused)
+	testAllocator.PutPooledBatch(other)
+	used = memAcc.Used()
+	otherSize := colmem.GetBatchMemSize(other2)
+	testAllocator.PutPooledBatch(other2)
+	require.Equal(t, used-otherSize, memAcc.Used())
+
+	if buildutil.CrdbTestBuild {
+		// Pooling the same batch twice is detected.
+		require.Error(t, colexecerror.CatchVectorizedRuntimeError(func() {
+			testAllocator.PutPooledBatch(reused)
+		}))
+	}
+
+	// ReleaseAll empties the pool.
+	testAllocator.ReleaseAll()
+	require.Zero(t, memAcc.Used())
+	require.True(t, testAllocator.GetPooledBatch(typs, capacity) != b)
+}
+
+func BenchmarkBatchPool(b *testing.B) {
+	defer log.Scope(b).Close(b)
+
+	typs := []*types.T{types.Int, types.Bytes, types.Decimal}
+	for _, pooled := range []bool{false, true} {
+		b.Run(fmt.Sprintf("pooled=%t", pooled), func(b *testing.B) {
+			testAllocator, _, cleanup := getAllocator(increment)
+			defer cleanup()
+			if pooled {
+				testAllocator.EnableBatchPool(1 /* maxPooledBatches */)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				batch := testAllocator.GetPooledBatch(typs, coldata.BatchSize())
+				testAllocator.PutPooledBatch(batch)
+			}
+		})
+	}
+}
+
+// testVecSizer is a coldata.ColumnFactory that reports the footprint of the
+// JSON vectors as if each set value had an additional in-memory overhead of
+// jsonValueOverhead bytes.
+type testVecSizer struct {
+	coldata.ColumnFactory
+	numCalls int
+}
+
+var _ colmem.VecSizer = &testVecSizer{}
+
+const jsonValueOverhead = 1000
+
+func (s *testVecSizer) VecSize(vec *coldata.Vec, startIdx int) (int64, bool) {
+	s.numCalls++
+	if vec.CanonicalTypeFamily() != types.JsonFamily {
+		return 0, false
+	}
+	size := vec.JSON().Size()
+	for i := startIdx; i < vec.JSON().Len(); i++ {
+		if len(vec.JSON().Bytes.Get(i)) > 0 {
+			size += jsonValueOverhead
+		}
+	}
+	return size, true
+}
+
+// TestVecSizer verifies that colmem.Allocator uses the footprint reported by
+// the column factory implementing colmem.VecSizer for JSON vectors.
+func TestVecSizer(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	rng, _ := randutil.NewTestRand()
+	ctx := context.Background()
+	st := cluster.MakeTestingClusterSettings()
+	testMemMonitor := mon.NewMonitor(mon.Options{
+		Name:      "test-mem",
+		Increment: 1,
+		Settings:  st,
+	})
+	testMemMonitor.Start(ctx, nil, mon.NewStandaloneBudget(math.MaxInt64))
+	defer testMemMonitor.Stop(ctx)
+	memAcc := testMemMonitor.MakeBoundAccount()
+	defer memAcc.Close(ctx)
+	evalCtx := eval.MakeTestingEvalContext(st)
+	sizer := &testVecSizer{ColumnFactory: coldataext.NewExtendedColumnFactory(&evalCtx)}
+	testAllocator := colmem.NewAllocator(ctx, &memAcc, sizer)
+
+	// The sizer is never consulted for the fixed-width types.
+	intBatch := testAllocator.NewMemBatchWithFixedCapacity([]*types.T{types.Int}, coldata.BatchSize())
+	testAllocator.PerformOperation(intBatch.ColVecs(), func() {
+		intBatch.ColVec(0).Int64()[0] = 1
+	})
+	testAllocator.ReleaseBatch(intBatch)
+	require.Zero(t, sizer.numCalls)
+
+	// Set large JSON values and verify that the account tracks the "real"
+	// usage, including the overhead reported by the sizer.
+	typs := []*types.T{types.Int, types.Jsonb}
+	numRows := rng.Intn(coldata.BatchSize()) + 1
+	b := testAllocator.NewMemBatchWithFixedCapacity(typs, numRows)
+	realUsage := colmem.GetBatchMemSize(b)
+	require.Equal(t, realUsage, memAcc.Used())
+	for i := 0; i < numRows; i++ {
+		// Encoded JSON values are stored as bytes.
+		v := make([]byte, 10<<10+rng.Intn(10<<10))
+		testAllocator.PerformOperation(b.ColVecs()[1:], func() {
+			b.ColVec(1).JSON().Bytes.Set(i, v)
+		})
+		realUsage += int64(len(v)) + jsonValueOverhead
+	}
+	require.NotZero(t, sizer.numCalls)
+	// The buffer of the Bytes vector might have more capacity than needed.
+	require.GreaterOrEqual(t, memAcc.Used(), realUsage)
+	require.InDelta(t, realUsage, memAcc.Used(), float64(realUsage)*0.3)
+
+	// The batch is released consistently with how it was accounted for.
+	testAllocator.ReleaseBatch(b)
+	require.Zero(t, memAcc.Used())
+}
+
+// TestChildAllocator verifies that the child allocators enforce their soft
+// limits while sharing the memory account of the parent.
+func TestChildAllocator(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	st := cluster.MakeTestingClusterSettings()
+	const parentLimit = 100000
+	testMemMonitor := mon.NewMonitor(mon.Options{
+		Name:      "test-mem",
+		Limit:     parentLimit,
+		Increment: 1,
+		Settings:  st,
+	})
+	testMemMonitor.Start(ctx, nil, mon.NewStandaloneBudget(math.MaxInt64))
+	defer testMemMonitor.Stop(ctx)
+	memAcc := testMemMonitor.MakeBoundAccount()
+	defer memAcc.Close(ctx)
+	evalCtx := eval.MakeTestingEvalContext(st)
+	testColumnFactory := coldataext.NewExtendedColumnFactory(&evalCtx)
+	parent := colmem.NewAllocator(ctx, &memAcc, testColumnFactory)
+
+	// The soft limits add up to more than the parent's budget, so the children
+	// contend for it.
+	const softLimit = parentLimit * 9 / 10
+	build := parent.NewChildAllocator("build", softLimit)
+	probe := parent.NewChildAllocator("probe", softLimit)
+	isSoftLimitErr := func(err error) bool {
+		return errors.Is(err, colmem.ErrChildSoftLimitExceeded)
+	}
+
+	// The usage of the children rolls up into the parent.
+	build.AdjustMemoryUsage(softLimit / 2)
+	probe.AdjustMemoryUsage(softLimit / 4)
+	require.Equal(t, int64(softLimit/2), build.Used())
+	require.Equal(t, int64(softLimit/4), probe.Used())
+	require.Equal(t, int64(softLimit/2+softLimit/4), parent.Used())
+
+	// Exceeding the soft limit of the child is reported via the typed error
+	// and doesn't change the usage.
+	err := colexecerror.CatchVectorizedRuntimeError(func() {
+		build.AdjustMemoryUsage(softLimit)
+	})
+	require.True(t, isSoftLimitErr(err), "%v", err)
+	require.Equal(t, int64(softLimit/2), build.Used())
+
+	// Staying within the soft limit of the child but exceeding the budget of
+	// the parent results in the regular memory error.
+	err = colexecerror.CatchVectorizedRuntimeError(func() {
+		probe.AdjustMemoryUsage(softLimit / 2)
+	})
+	require.Error(t, err)
+	require.False(t, isSoftLimitErr(err), "%v", err)
+	require.Equal(t, int64(softLimit/4), probe.Used())
+
+	// Releasing a child releases only its usage.
+	probe.ReleaseAll()
+	require.Zero(t, probe.Used())
+	require.Equal(t, int64(softLimit/2), build.Used())
+	require.Equal(t, int64(softLimit/2), parent.Used())
+
+	// Now the build side can use the memory released by the probe side. If
+	// the memory has already been allocated, it is registered even though the
+	// soft limit is exceeded.
+	err = colexecerror.CatchVectorizedRuntimeError(func() {
+		build.AdjustMemoryUsageAfterAllocation(softLimit/2 + 1)
+	})
+	require.True(t, isSoftLimitErr(err), "%v", err)
+	require.Equal(t, int64(softLimit+1), build.Used())
+	build.AdjustMemoryUsage(-(softLimit/2 + 1))
+	require.Equal(t, int64(softLimit/2), build.Used())
+
+	b := build.NewMemBatchWithFixedCapacity([]*types.T{types.Int}, 1 /* capacity */)
+	require.Greater(t, build.Used(), int64(softLimit/2))
+	build.ReleaseBatch(b)
+	require.Equal(t, int64(softLimit/2), build.Used())
+	err = colexecerror.CatchVectorizedRuntimeError(func() {
+		build.NewMemBatchWithFixedCapacity([]*types.T{types.Int}, softLimit/8)
+	})
+	require.True(t, isSoftLimitErr(err), "%v", err)
+
+	// Releasing the parent releases the usage of all children.
+	parent.ReleaseAll()
+	require.Zero(t, build.Used())
+	require.Zero(t, parent.Used())
+	require.Zero(t, memAcc.Used())
+}
+
+// TestSwapAccount verifies that colmem.Allocator.SwapAccount transfers the
+// usage between the monitors and that the following operations are
+// registered with the new account.
+func TestSwapAccount(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	st := cluster.MakeTestingClusterSettings()
+	makeMonitor := func(name redact.RedactableString, limit int64) *mon.BytesMonitor {
+		m := mon.NewMonitor(mon.Options{
+			Name:      name,
+			Limit:     limit,
+			Increment: 1,
+			Settings:  st,
+		})
+		m.Start(ctx, nil, mon.NewStandaloneBudget(math.MaxInt64))
+		return m
+	}
+	oldMonitor := makeMonitor("old", math.MaxInt64)
+	defer oldMonitor.Stop(ctx)
+	oldAcc := oldMonitor.MakeBoundAccount()
+	defer oldAcc.Close(ctx)
+	evalCtx := eval.MakeTestingEvalContext(st)
+	testColumnFactory := coldataext.NewExtendedColumnFactory(&evalCtx)
+	allocator := colmem.NewAllocator(ctx, &oldAcc, testColumnFactory)
+	child := allocator.NewChildAllocator("child", math.MaxInt64)
+
+	typs := []*types.T{types.Int, types.Bytes}
+	b := allocator.NewMemBatchWithFixedCapacity(typs, coldata.BatchSize())
+	childBatch := child.NewMemBatchWithFixedCapacity(typs, 1 /* capacity */)
+	used := allocator.Used()
+	require.Equal(t, used, oldMonitor.AllocBytes())
+
+	// The child allocators cannot swap the account on their own.
+	smallMonitor := makeMonitor("small", used-1)
+	defer smallMonitor.Stop(ctx)
+	smallAcc := smallMonitor.MakeBoundAccount()
+	defer smallAcc.Close(ctx)
+	require.Error(t, child.SwapAccount(&smallAcc))
+
+	// The new account that cannot fit the current usage is rejected, and the
+	// allocator stays bound to the old account.
+	err := allocator.SwapAccount(&smallAcc)
+	require.True(t, sqlerrors.IsOutOfMemoryError(err), "%v", err)
+	require.Equal(t, &oldAcc, allocator.Acc())
+	require.Zero(t, smallMonitor.AllocBytes())
+	require.Equal(t, used, oldMonitor.AllocBytes())
+
+	// The usage is transferred to the new account.
+	newMonitor := makeMonitor("new", math.MaxInt64)
+	defer newMonitor.Stop(ctx)
+	newAcc := newMonitor.MakeBoundAccount()
+	defer newAcc.Close(ctx)
+	require.NoError(t, allocator.SwapAccount(&newAcc))
+	require.Equal(t, &newAcc, allocator.Acc())
+	require.Equal(t, &newAcc, child.Acc())
+	require.Zero(t, oldMonitor.AllocBytes())
+	require.Equal(t, used, newMonitor.AllocBytes())
+	require.Equal(t, used, allocator.Used())
+
+	// The following operations of the allocator and its children are
+	// registered with the new account.
+	allocator.PerformOperation(b.ColVecs(), func() {
+		b.ColVec(1).Bytes().Set(0, make([]byte, 100))
+	})
+	child.ReleaseBatch(childBatch)
+	require.Zero(t, child.Used())
+	require.Zero(t, oldMonitor.AllocBytes())
+	require.Equal(t, allocator.Used(), newMonitor.AllocBytes())
+	allocator.ReleaseBatch(b)
+	require.Zero(t, allocator.Used())
+	require.Zero(t, newMonitor.AllocBytes())
+}
+
+// TestAllocatorStats verifies that colmem.Allocator.Stats reflects a scripted
+// sequence of allocations.
+func TestAllocatorStats(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	if coldata.BatchSize() < 32 {
+		skip.IgnoreLint(t, "the test assumes coldata.BatchSize() is at least 32")
+	}
+
+	testAllocator, _, cleanup := getAllocator(increment)
+	defer cleanup()
+	require.Equal(t, colmem.AllocatorStats{}, testAllocator.Stats())
+
+	typs := []*types.T{types.Int}
+	batchSize := func(capacity int) int64 {
+		return colmem.SelVectorSize(capacity) + colmem.EstimateBatchSizeBytes(typs, capacity)
+	}
+	b := testAllocator.NewMemBatchWithFixedCapacity(typs, 2 /* capacity */)
+	testAllocator.AdjustMemoryUsage(100)
+	testAllocator.AdjustMemoryUsage(-50)
+	testAllocator.ReleaseBatch(b)
+	require.Equal(t, colmem.AllocatorStats{
+		AllocatedBytes: batchSize(2) + 100,
+		CurrentBytes:   50,
+		MaxBytes:       batchSize(2) + 100,
+	}, testAllocator.Stats())
+
+	// Two batches are allocated (the first one is released when the second one
+	// is allocated), and then the second one is reused.
+	b, _ = testAllocator.ResetMaybeReallocateNoMemLimit(typs, nil /* oldBatch */, 1 /* requiredCapacity */)
+	b, _ = testAllocator.ResetMaybeReallocateNoMemLimit(typs, b, 32 /* requiredCapacity */)
+	_, _ = testAllocator.ResetMaybeReallocateNoMemLimit(typs, b, 2 /* requiredCapacity */)
+	expected := colmem.AllocatorStats{
+		AllocatedBytes:   batchSize(2) + 100 + batchSize(1) + batchSize(32),
+		CurrentBytes:     50 + batchSize(32),
+		MaxBytes:         50 + batchSize(32),
+		NumReallocations: 2,
+	}
+	expected.NumResetsByReason[colmem.ReallocNoOldBatch] = 1
+	expected.NumResetsByReason[colmem.ReallocCapacityTooSmall] = 1
+	expected.NumResetsByReason[colmem.ReuseCapacitySufficient] = 1
+	require.Equal(t, expected, testAllocator.Stats())
+
+	testAllocator.ReleaseAll()
+	stats := testAllocator.Stats()
+	require.Zero(t, stats.CurrentBytes)
+	require.Equal(t, 50+batchSize(32), stats.MaxBytes)
+}
+
+// TestAllocatorChurnStats drives a workload in which the batch is reallocated
+// on every reset (because the memory limit oscillates) and verifies the
+// statistics about the reallocation churn and the copy volume.
+func TestAllocatorChurnStats(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	const capacity = 4
+	if coldata.BatchSize() < capacity {
+		skip.IgnoreLint(t, "the test assumes coldata.BatchSize() is at least 4")
+	}
+
+	testAllocator, _, cleanup := getAllocator(1 /* increment */)
+	defer cleanup()
+	typs := []*types.T{types.Int}
+
+	// The memory limit only fits half of the desired capacity.
+	memLimit := colmem.SelVectorSize(capacity/2) + colmem.EstimateBatchSizeBytes(typs, capacity/2)
+	// Each window of reallocChurnWindow (64) resets is reported.
+	const numWindows = 3
+	const numResets = numWindows * 64
+	for i := 0; i < numResets/2; i++ {
+		// First, the batch is allocated without an old batch under the
+		// memory limit.
+		b, _ := testAllocator.ResetMaybeReallocateWithMaxCapacity(
+			typs, nil /* oldBatch */, capacity, capacity, memLimit,
+		)
+		require.Equal(t, capacity/2, b.Capacity())
+		// Then the limit is lifted, so the batch is grown.
+		b, _ = testAllocator.ResetMaybeReallocateWithMaxCapacity(
+			typs, b, capacity, capacity, math.MaxInt64,
+		)
+		require.Equal(t, capacity, b.Capacity())
+		testAllocator.ReleaseBatch(b)
+	}
+	stats := testAllocator.Stats()
+	require.Equal(t, int64(numResets), stats.NumReallocations)
+	require.Equal(t, int64(numResets/2), stats.NumMemoryLimitedAllocations)
+	require.Equal(t, int64(numResets/2), stats.NumResetsByReason[colmem.ReallocCapacityTooSmall])
+	require.Equal(t, int64(numWindows), stats.NumChurnWindows)
+
+	// The stable workload doesn't add to the churn.
+	b, _ := testAllocator.ResetMaybeReallocateNoMemLimit(typs, nil /* oldBatch */, capacity)
+	for i := 0; i < 2*64; i++ {
+		b, _ = testAllocator.ResetMaybeReallocateNoMemLimit(typs, b, capacity)
+	}
+	require.Equal(t, int64(numWindows), testAllocator.Stats().NumChurnWindows)
+	testAllocator.ReleaseBatch(b)
+
+	// The rows copied by AppendBatch and GrowCapacity are included in the
+	// copy volume.
+	rowsSize := func(n int) int64 {
+		return colmem.EstimateBatchSizeBytes(typs, n) - colmem.BatchOverhead
+	}
+	src := testAllocator.NewMemBatchWithFixedCapacity(typs, capacity)
+	src.SetLength(capacity)
+	b = testAllocator.AppendBatch(nil /* dst */, src, 0 /* srcStartIdx */, capacity)
+	require.Equal(t, rowsSize(capacity), testAllocator.Stats().CopiedBytes)
+	b = testAllocator.GrowCapacity(b, 2*b.Capacity())
+	require.Equal(t, 2*rowsSize(capacity), testAllocator.Stats().CopiedBytes)
+	testAllocator.ReleaseBatch(b)
+	testAllocator.ReleaseBatch(src)
+
+	// The statistics can be aggregated across the allocators.
+	other, _, otherCleanup := getAllocator(1 /* increment */)
+	defer otherCleanup()
+	other.AdjustMemoryUsage(100)
+	b, _ = other.ResetMaybeReallocateNoMemLimit(typs, nil /* oldBatch */, capacity)
+	var agg colmem.AllocatorStats
+	agg.Add(testAllocator.Stats())
+	agg.Add(other.Stats())
+	require.Equal(t, testAllocator.Stats().NumReallocations+1, agg.NumReallocations)
+	require.Equal(t, testAllocator.Stats().CurrentBytes+other.Stats().CurrentBytes, agg.CurrentBytes)
+	require.Equal(t, int64(numWindows), agg.NumChurnWindows)
+	require.Equal(t, 2*rowsSize(capacity), agg.CopiedBytes)
+	other.ReleaseBatch(b)
+}
+
+// TestAllocatorUsed runs a mixed workload on several allocators that share
+// the same memory account and verifies that colmem.Allocator.Used (as well as
+// the snapshot) reconciles with the manual bookkeeping of each allocator.
+func TestAllocatorUsed(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	rng, _ := randutil.NewTestRand()
+	ctx := context.Background()
+	st := cluster.MakeTestingClusterSettings()
+	testMemMonitor := mon.NewMonitor(mon.Options{
+		Name:      "test-mem",
+		Increment: 1,
+		Settings:  st,
+	})
+	testMemMonitor.Start(ctx, nil, mon.NewStandaloneBudget(math.MaxInt64))
+	defer testMemMonitor.Stop(ctx)
+	memAcc := testMemMonitor.MakeBoundAccount()
+	defer memAcc.Close(ctx)
+	otherAcc := testMemMonitor.MakeBoundAccount()
+	defer otherAcc.Close(ctx)
+	evalCtx := eval.MakeTestingEvalContext(st)
+	testColumnFactory := coldataext.NewExtendedColumnFactory(&evalCtx)
+
+	type allocatorState struct {
+		allocator *colmem.Allocator
+		// expected is the manually tracked usage of the allocator.
+		expected int64
+		maxUsed  int64
+		// adjusted is the part of expected registered via AdjustMemoryUsage.
+		adjusted int64
+		batches  []coldata.Batch
+	}
+	parent := colmem.NewAllocator(ctx, &memAcc, testColumnFactory)
+	states := []*allocatorState{
+		{allocator: parent},
+		{allocator: colmem.NewAllocator(ctx, &otherAcc, testColumnFactory)},
+		{allocator: parent.NewChildAllocator("child", math.MaxInt64)},
+	}
+	// The datum-backed column allows the footprint of the batches to both grow
+	// and shrink within PerformOperation.
+	typs := []*types.T{types.Int, types.Geometry}
+	const datumIdx = 1
+	for i := 0; i < 1000; i++ {
+		s := states[rng.Intn(len(states))]
+		// The allocators are used sequentially, so the change to the
+		// accounts is attributed to the current allocator.
+		before := memAcc.Used() + otherAcc.Used()
+		switch op := rng.Intn(5); {
+		case op == 0 || len(s.batches) == 0:
+			b := s.allocator.NewMemBatchWithFixedCapacity(typs, rng.Intn(8)+1)
+			s.batches = append(s.batches, b)
+		case op == 1:
+			b := s.batches[rng.Intn(len(s.batches))]
+			s.allocator.PerformOperation(b.ColVecs(), func() {
+				var d tree.Datum = tree.DNull
+				if rng.Intn(2) == 0 {
+					d = randgen.RandDatum(rng, typs[datumIdx], false /* nullOk */)
+				}
+				b.ColVec(datumIdx).Datum().Set(rng.Intn(b.Capacity()), d)
+			})
+		case op == 2:
+			idx := rng.Intn(len(s.batches))
+			s.allocator.ReleaseBatch(s.batches[idx])
+			s.batches = append(s.batches[:idx], s.batches[idx+1:]...)
+		case op == 3:
+			delta := int64(rng.Intn(100) + 1)
+			s.allocator.AdjustMemoryUsage(delta)
+			s.adjusted += delta
+		default:
+			delta := int64(rng.Intn(100))
+			if delta > s.adjusted {
+				delta = s.adjusted
+			}
+			s.allocator.ReleaseMemory(delta)
+			s.adjusted -= delta
+		}
+		s.expected += memAcc.Used() + otherAcc.Used() - before
+		if s.expected > s.maxUsed {
+			s.maxUsed = s.expected
+		}
+		// The usage of the child rolls up into the parent.
+		require.Equal(t, states[0].expected+states[2].expected, parent.Used())
+		for _, s := range states[1:] {
+			require.Equal(t, s.expected, s.allocator.Used())
+		}
+		snapshot := s.allocator.Snapshot()
+		require.Equal(t, s.allocator.Used(), snapshot.Used)
+		require.Equal(t, s.maxUsed, snapshot.MaxUsed)
+		require.Equal(t, len(s.batches), snapshot.NumLiveBatches)
+	}
+
+	// Releasing all memory of one allocator doesn't affect the other ones.
+	states[1].allocator.ReleaseAll()
+	require.Zero(t, states[1].allocator.Used())
+	require.Zero(t, otherAcc.Used())
+	require.Equal(t, states[0].expected+states[2].expected, memAcc.Used())
+	// Releasing all memory of a child only releases its own usage.
+	states[2].allocator.ReleaseAll()
+	require.Zero(t, states[2].allocator.Used())
+	require.Equal(t, states[0].expected, memAcc.Used())
+	parent.ReleaseAll()
+	require.Zero(t, parent.Used())
+	require.Zero(t, states[2].allocator.Used())
+	require.Equal(t, colmem.AllocatorSnapshot{MaxUsed: states[0].maxUsed}, parent.Snapshot())
+	require.Zero(t, memAcc.Used())
+}
+
+// TestReleaseAllAcc verifies that ReleaseAll releases the memory registered
+// with the account of the allocator directly via Acc.
+func TestReleaseAllAcc(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	for _, buffered := range []bool{false, true} {
+		t.Run(fmt.Sprintf("buffered=%t", buffered), func(t *testing.T) {
+			testAllocator, memAcc, cleanup := getAllocator(1 /* increment */)
+			defer cleanup()
+			if buffered {
+				testAllocator.EnableBufferedAccounting(colmem.DefaultBufferedAccountingThreshold)
+			}
+			child := testAllocator.NewChildAllocator("child", math.MaxInt64)
+			testAllocator.AdjustMemoryUsage(10)
+			child.AdjustMemoryUsage(20)
+			// The metadata is accounted for directly, e.g. as the inbox does.
+			require.NoError(t, testAllocator.Acc().Grow(ctx, 100))
+			require.Equal(t, int64(30), testAllocator.Used())
+
+			testAllocator.ReleaseAll()
+			require.Zero(t, testAllocator.Used())
+			require.Zero(t, child.Used())
+			require.Zero(t, memAcc.Used())
+
+			// The allocator can still be used afterwards.
+			testAllocator.AdjustMemoryUsage(10)
+			testAllocator.Flush()
+			require.Equal(t, int64(10), testAllocator.Used())
+			require.Equal(t, int64(10), memAcc.Used())
+			testAllocator.ReleaseAll()
+			require.Zero(t, memAcc.Used())
+		})
+	}
+}
+
+func TestBufferedAccounting(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	st := cluster.MakeTestingClusterSettings()
+	const limit = 100000
+	testMemMonitor := mon.NewMonitor(mon.Options{
+		Name:      "test-mem",
+		Limit:     limit,
+		Increment: 1,
+		Settings:  st,
+	})
+	testMemMonitor.Start(ctx, nil, mon.NewStandaloneBudget(math.MaxInt64))
+	defer testMemMonitor.Stop(ctx)
+	memAcc := testMemMonitor.MakeBoundAccount()
+	defer memAcc.Close(ctx)
+	evalCtx := eval.MakeTestingEvalContext(st)
+	testAllocator := colmem.NewAllocator(ctx, &memAcc, coldataext.NewExtendedColumnFactory(&evalCtx))
+	const threshold = 1000
+	testAllocator.EnableBufferedAccounting(threshold)
+
+	// Small changes are accumulated until the threshold is reached.
+	testAllocator.AdjustMemoryUsage(400)
+	testAllocator.AdjustMemoryUsage(500)
+	require.Equal(t, int64(900), testAllocator.Used())
+	require.Zero(t, memAcc.Used())
+	testAllocator.AdjustMemoryUsage(200)
+	require.Equal(t, int64(1100), memAcc.Used())
+	testAllocator.ReleaseMemory(300)
+	require.Equal(t, int64(800), testAllocator.Used())
+	require.Equal(t, int64(1100), memAcc.Used())
+	testAllocator.Flush()
+	require.Equal(t, int64(800), memAcc.Used())
+
+	// The memory account is never under-reported by more than the threshold
+	// (and isn't over-reported by more than that either).
+	rng, _ := randutil.NewTestRand()
+	for i := 0; i < 1000; i++ {
+		// Stay well below the limit of the monitor.
+		if rng.Intn(2) == 0 && testAllocator.Used() < limit/2 {
+			testAllocator.AdjustMemoryUsage(int64(rng.Intn(2 * threshold)))
+		} else {
+			testAllocator.ReleaseMemory(int64(rng.Intn(2 * threshold)))
+		}
+		diff := testAllocator.Used() - memAcc.Used()
+		require.Less(t, diff, int64(threshold))
+		require.Greater(t, diff, int64(-threshold))
+	}
+	testAllocator.Flush()
+	require.Equal(t, testAllocator.Used(), memAcc.Used())
+
+	// The limit is enforced once the pending changes are flushed.
+	testAllocator.ReleaseAll()
+	require.Zero(t, memAcc.Used())
+	testAllocator.AdjustMemoryUsage(limit - threshold/2)
+	testAllocator.AdjustMemoryUsage(threshold / 4)
+	err := colexecerror.CatchVectorizedRuntimeError(func() {
+		testAllocator.AdjustMemoryUsage(threshold)
+	})
+	require.True(t, sqlerrors.IsOutOfMemoryError(err), "%v", err)
+	require.Equal(t, int64(limit-threshold/4), testAllocator.Used())
+	testAllocator.Flush()
+	require.Equal(t, int64(limit-threshold/4), memAcc.Used())
+	testAllocator.ReleaseAll()
+	require.Zero(t, memAcc.Used())
+}
+
+// TestBufferedAccountingFlushOnRelease verifies that the pending changes of the
+// buffered accounting mode reach the memory account when the allocator is
+// closed or its usage is released.
+func TestBufferedAccountingFlushOnRelease(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	st := cluster.MakeTestingClusterSettings()
+	testMemMonitor := mon.NewMonitor(mon.Options{
+		Name:      "test-mem",
+		Increment: 1,
+		Settings:  st,
+	})
+	testMemMonitor.Start(ctx, nil, mon.NewStandaloneBudget(math.MaxInt64))
+	defer testMemMonitor.Stop(ctx)
+	memAcc := testMemMonitor.MakeBoundAccount()
+	defer memAcc.Close(ctx)
+	evalCtx := eval.MakeTestingEvalContext(st)
+	testAllocator := colmem.NewAllocator(ctx, &memAcc, coldataext.NewExtendedColumnFactory(&evalCtx))
+	const threshold = 1000
+	testAllocator.EnableBufferedAccounting(threshold)
+
+	// Close flushes the pending changes to the account owned by the caller.
+	testAllocator.AdjustMemoryUsage(400)
+	require.Zero(t, memAcc.Used())
+	testAllocator.Close()
+	require.Equal(t, int64(400), memAcc.Used())
+	require.Equal(t, int64(400), testMemMonitor.MaximumBytes())
+
+	// ReleaseAll registers the pending growth before clearing the account, so
+	// the monitor observes the peak usage.
+	testAllocator.AdjustMemoryUsage(300)
+	require.Equal(t, int64(400), memAcc.Used())
+	testAllocator.ReleaseAll()
+	require.Zero(t, memAcc.Used())
+	require.Equal(t, int64(700), testMemMonitor.MaximumBytes())
+}
+
+// BenchmarkBufferedAccounting measures the contention on the monitor shared by
+// many allocators that adjust their memory usage concurrently.
+func BenchmarkBufferedAccounting(b *testing.B) {
+	defer log.Scope(b).Close(b)
+
+	ctx := context.Background()
+	st := cluster.MakeTestingClusterSettings()
+	evalCtx := eval.MakeTestingEvalContext(st)
+	testColumnFactory := coldataext.NewExtendedColumnFactory(&evalCtx)
+	for _, buffered := range []bool{false, true} {
+		b.Run(fmt.Sprintf("buffered=%t", buffered), func(b *testing.B) {
+			testMemMonitor := mon.NewMonitor(mon.Options{
+				Name:      "test-mem",
+				Increment: increment,
+				Settings:  st,
+			})
+			testMemMonitor.Start(ctx, nil, mon.NewStandaloneBudget(math.MaxInt64))
+			defer testMemMonitor.Stop(ctx)
+			b.SetParallelism(32)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				memAcc := testMemMonitor.MakeBoundAccount()
+				defer memAcc.Close(ctx)
+				testAllocator := colmem.NewAllocator(ctx, &memAcc, testColumnFactory)
+				if buffered {
+					testAllocator.EnableBufferedAccounting(colmem.DefaultBufferedAccountingThreshold)
+				}
+				for pb.Next() {
+					testAllocator.AdjustMemoryUsage(64)
+					testAllocator.AdjustMemoryUsage(-32)
+				}
+				testAllocator.ReleaseAll()
+			})
+		})
+	}
+}
+
+func TestTryMethods(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	st := cluster.MakeTestingClusterSettings()
+	typs := []*types.T{types.Int}
+	const limit = 1000
+	testMemMonitor := mon.NewMonitor(mon.Options{
+		Name:      "test-mem",
+		Limit:     limit,
+		Increment: 1,
+		Settings:  st,
+	})
+	testMemMonitor.Start(ctx, nil, mon.NewStandaloneBudget(math.MaxInt64))
+	defer testMemMonitor.Stop(ctx)
+	memAcc := testMemMonitor.MakeBoundAccount()
+	defer memAcc.Close(ctx)
+	evalCtx := eval.MakeTestingEvalContext(st)
+	testAllocator := colmem.NewAllocator(ctx, &memAcc, coldataext.NewExtendedColumnFactory(&evalCtx))
+
+	// The errors are returned rather than thrown, and the usage doesn't change.
+	require.NoError(t, testAllocator.TryAdjustMemoryUsage(limit-10))
+	err := testAllocator.TryAdjustMemoryUsage(20)
+	require.True(t, sqlerrors.IsOutOfMemoryError(err), "%v", err)
+	require.Equal(t, int64(limit-10), testAllocator.Used())
+
+	b, err := testAllocator.TryNewMemBatchWithFixedCapacity(typs, 2 /* capacity */)
+	require.True(t, sqlerrors.IsOutOfMemoryError(err), "%v", err)
+	require.Nil(t, b)
+	require.Equal(t, int64(limit-10), testAllocator.Used())
+
+	require.NoError(t, testAllocator.TryAdjustMemoryUsage(-limit/2))
+	b, err = testAllocator.TryNewMemBatchWithFixedCapacity(typs, 2 /* capacity */)
+	require.NoError(t, err)
+	require.Equal(t, 2, b.Capacity())
+	used := testAllocator.Used()
+
+	// Setting a fixed-width value doesn't change the footprint.
+	var performed bool
+	err = testAllocator.TryPerformOperation(b.ColVecs(), func() {
+		performed = true
+		b.ColVec(0).Int64()[0] = 1
+	})
+	require.NoError(t, err)
+	require.True(t, performed)
+	require.Equal(t, used, testAllocator.Used())
+
+	bytesBatch, err := testAllocator.TryNewMemBatchWithFixedCapacity([]*types.T{types.Bytes}, 1 /* capacity */)
+	require.NoError(t, err)
+	used = testAllocator.Used()
+	// The operation is performed even if its allocation is denied.
+	performed = false
+	err = testAllocator.TryPerformOperation(bytesBatch.ColVecs(), func() {
+		performed = true
+		bytesBatch.ColVec(0).Bytes().Set(0, make([]byte, limit))
+	})
+	require.True(t, sqlerrors.IsOutOfMemoryError(err), "%v", err)
+	require.True(t, performed)
+	require.Equal(t, used, testAllocator.Used())
+
+	testAllocator.ReleaseAll()
+}
+
+func TestZeroingOnReset(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	if coldata.BatchSize() < 4 {
+		skip.IgnoreLint(t, "the test assumes coldata.BatchSize() is at least 4")
+	}
+
+	typs := []*types.T{types.Bool, types.Int, types.Float, types.Decimal, types.Bytes}
+	const capacity = 4
+	// Use a large value so that it is not inlined.
+	value := make([]byte, 100)
+	for i := range value {
+		value[i] = 'a'
+	}
+	setValues := func(b coldata.Batch) {
+		for i := 0; i < capacity; i++ {
+			b.ColVec(0).Bool()[i] = true
+			b.ColVec(1).Int64()[i] = 1
+			b.ColVec(2).Float64()[i] = 1
+			b.ColVec(3).Decimal()[i].SetInt64(1)
+			b.ColVec(4).Bytes().Set(i, value)
+		}
+		b.SetLength(capacity)
+	}
+	requireZeroed := func(b coldata.Batch) {
+		require.Zero(t, b.Length())
+		for i := 0; i < capacity; i++ {
+			require.False(t, b.ColVec(0).Bool()[i])
+			require.Zero(t, b.ColVec(1).Int64()[i])
+			require.Zero(t, b.ColVec(2).Float64()[i])
+			require.True(t, b.ColVec(3).Decimal()[i].IsZero())
+			require.Empty(t, b.ColVec(4).Bytes().Get(i))
+		}
+	}
+
+	for _, zeroing := range []bool{false, true} {
+		t.Run(fmt.Sprintf("zeroing=%t", zeroing), func(t *testing.T) {
+			testAllocator, _, cleanup := getAllocator(increment)
+			defer cleanup()
+			if zeroing {
+				testAllocator.EnableZeroingOnReset()
+			}
+			b, _ := testAllocator.ResetMaybeReallocateNoMemLimit(typs, nil /* oldBatch */, capacity)
+			setValues(b)
+			newBatch, reallocated := testAllocator.ResetMaybeReallocateNoMemLimit(typs, b, capacity)
+			require.False(t, reallocated)
+			require.True(t, newBatch == b)
+			if !zeroing {
+				// The stale values of the fixed-width vectors are still
+				// observable.
+				require.Equal(t, int64(1), b.ColVec(1).Int64()[0])
+				return
+			}
+			requireZeroed(b)
+
+			// The batches put into the pool are zeroed out too.
+			testAllocator.EnableBatchPool(1 /* maxPooledBatches */)
+			setValues(b)
+			testAllocator.PutPooledBatch(b)
+			pooled := testAllocator.GetPooledBatch(typs, capacity)
+			require.True(t, pooled == b)
+			requireZeroed(pooled)
+		})
+	}
+}
+
+func BenchmarkZeroingOnReset(b *testing.B) {
+	defer log.Scope(b).Close(b)
+
+	typs := []*types.T{types.Int, types.Decimal, types.Bytes}
+	value := make([]byte, 100)
+	for _, zeroing := range []bool{false, true} {
+		b.Run(fmt.Sprintf("zeroing=%t", zeroing), func(b *testing.B) {
+			testAllocator, _, cleanup := getAllocator(increment)
+			defer cleanup()
+			if zeroing {
+				testAllocator.EnableZeroingOnReset()
+			}
+			batch, _ := testAllocator.ResetMaybeReallocateNoMemLimit(typs, nil /* oldBatch */, coldata.BatchSize())
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				// Set some values so that the Bytes buffer is in use.
+				for j := 0; j < batch.Capacity(); j++ {
+					batch.ColVec(2).Bytes().Set(j, value)
+				}
+				batch.SetLength(batch.Capacity())
+				batch, _ = testAllocator.ResetMaybeReallocateNoMemLimit(typs, batch, coldata.BatchSize())
+			}
+		})
+	}
+}
+
+func TestNewMemBatchWithMaxMemory(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	testAllocator, _, cleanup := getAllocator(increment)
+	defer cleanup()
+	batchSize := func(typs []*types.T, capacity int) int64 {
+		return colmem.SelVectorSize(capacity) + colmem.EstimateBatchSizeBytes(typs, capacity)
+	}
+
+	narrow := []*types.T{types.Bool}
+	wide := make([]*types.T, 100)
+	for i := range wide {
+		wide[i] = types.Decimal
+	}
+	for _, tc := range []struct {
+		typs             []*types.T
+		maxBytes         int64
+		expectedCapacity int
+	}{
+		// The narrow schema is truncated at coldata.BatchSize().
+		{typs: narrow, maxBytes: math.MaxInt64, expectedCapacity: coldata.BatchSize()},
+		{typs: narrow, maxBytes: 64 << 20, expectedCapacity: coldata.BatchSize()},
+		{typs: narrow, maxBytes: batchSize(narrow, coldata.BatchSize()), expectedCapacity: coldata.BatchSize()},
+		// A single row of the wide schema doesn't fit.
+		{typs: wide, maxBytes: batchSize(wide, 1) - 1, expectedCapacity: 1},
+		{typs: wide, maxBytes: 0, expectedCapacity: 1},
+		{typs: wide, maxBytes: batchSize(wide, 1), expectedCapacity: 1},
+	} {
+		b := testAllocator.NewMemBatchWithMaxMemory(tc.typs, tc.maxBytes)
+		require.Equal(t, tc.expectedCapacity, b.Capacity(), "max bytes %d", tc.maxBytes)
+		testAllocator.ReleaseBatch(b)
+	}
+
+	// In between the capacity is the largest one that fits.
+	rng, _ := randutil.NewTestRand()
+	for i := 0; i < 10; i++ {
+		maxBytes := batchSize(wide, 1) + rng.Int63n(batchSize(wide, coldata.BatchSize()))
+		b := testAllocator.NewMemBatchWithMaxMemory(wide, maxBytes)
+		require.LessOrEqual(t, batchSize(wide, b.Capacity()), maxBytes)
+		if b.Capacity() < coldata.BatchSize() {
+			require.Greater(t, batchSize(wide, b.Capacity()+1), maxBytes)
+		}
+		testAllocator.ReleaseBatch(b)
+	}
+}
+
+func TestBudgetCallback(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	st := cluster.MakeTestingClusterSettings()
+	const limit = 1000
+	testMemMonitor := mon.NewMonitor(mon.Options{
+		Name:      "test-mem",
+		Limit:     limit,
+		Increment: 1,
+		Settings:  st,
+	})
+	testMemMonitor.Start(ctx, nil, mon.NewStandaloneBudget(math.MaxInt64))
+	defer testMemMonitor.Stop(ctx)
+	memAcc := testMemMonitor.MakeBoundAccount()
+	defer memAcc.Close(ctx)
+	evalCtx := eval.MakeTestingEvalContext(st)
+	testAllocator := colmem.NewAllocator(ctx, &memAcc, coldataext.NewExtendedColumnFactory(&evalCtx))
+
+	var numCalls int
+	testAllocator.SetBudgetCallback(0.8, func(used, l int64) {
+		numCalls++
+		require.Equal(t, testAllocator.Used(), used)
+		require.Equal(t, int64(limit), l)
+	})
+
+	// The callback fires exactly once when the threshold is crossed.
+	testAllocator.AdjustMemoryUsage(500)
+	testAllocator.AdjustMemoryUsage(200)
+	require.Zero(t, numCalls)
+	testAllocator.AdjustMemoryUsage(200)
+	require.Equal(t, 1, numCalls)
+	testAllocator.AdjustMemoryUsage(50)
+	require.Equal(t, 1, numCalls)
+
+	// Dropping below the threshold allows the callback to fire again once the
+	// threshold is re-crossed (by PerformOperation this time).
+	testAllocator.ReleaseMemory(300)
+	testAllocator.AdjustMemoryUsage(100)
+	require.Equal(t, 1, numCalls)
+	vec := testAllocator.NewVec(types.Bytes, 1 /* capacity */)
+	require.Equal(t, 2, numCalls)
+	testAllocator.ReleaseAll()
+	testAllocator.AdjustMemoryUsage(700)
+	testAllocator.PerformOperation([]*coldata.Vec{vec}, func() {
+		vec.Bytes().Set(0, make([]byte, 150))
+	})
+	require.Equal(t, 3, numCalls)
+	testAllocator.ReleaseAll()
+
+	// The callback is not invoked re-entrantly.
+	numCalls = 0
+	testAllocator.SetBudgetCallback(0.5, func(used, l int64) {
+		numCalls++
+		// Drop below the threshold and then cross it again.
+		testAllocator.ReleaseMemory(used)
+		testAllocator.AdjustMemoryUsage(used)
+	})
+	testAllocator.AdjustMemoryUsage(600)
+	require.Equal(t, 1, numCalls)
+	require.Equal(t, int64(600), testAllocator.Used())
+	// The usage is still above the threshold, so the callback isn't invoked
+	// again.
+	testAllocator.AdjustMemoryUsage(100)
+	require.Equal(t, 1, numCalls)
+	testAllocator.ReleaseAll()
+
+	// The callback can be unset.
+	testAllocator.SetBudgetCallback(0, nil)
+	testAllocator.AdjustMemoryUsage(900)
+	require.Equal(t, 1, numCalls)
+	testAllocator.ReleaseAll()
+}
+
+// TestSetMaxBatchSize verifies that none of the methods of the allocator (as
+// well as of the accounting helpers) that decide on the capacity of the
+// batches exceed the override set via SetMaxBatchSize.
+func TestSetMaxBatchSize(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	rng, _ := randutil.NewTestRand()
+	testAllocator, _, cleanup := getAllocator(1 /* increment */)
+	defer cleanup()
+
+	for _, invalid := range []int{-1, 0, coldata.MaxBatchSize + 1} {
+		require.Error(t, colexecerror.CatchVectorizedRuntimeError(func() {
+			testAllocator.SetMaxBatchSize(invalid)
+		}))
+	}
+	const maxBatchSize = 64
+	testAllocator.SetMaxBatchSize(maxBatchSize)
+	child := testAllocator.NewChildAllocator("child", math.MaxInt64)
+	typs := []*types.T{types.Int, types.Bytes}
+	require.LessOrEqual(t, testAllocator.NewMemBatchWithMaxCapacity(typs).Capacity(), maxBatchSize)
+	require.LessOrEqual(t, testAllocator.NewMemBatchWithMaxMemory(typs, math.MaxInt64).Capacity(), maxBatchSize)
+
+	var b, childBatch, helperBatch, setHelperBatch coldata.Batch
+	var helper colmem.AccountingHelper
+	helper.Init(testAllocator, math.MaxInt64)
+	var setHelper colmem.SetAccountingHelper
+	setHelper.Init(testAllocator, math.MaxInt64, typs, false /* alwaysReallocate */)
+	setHelper.SetMaxBatchSize(coldata.MaxBatchSize)
+	for i := 0; i < 20; i++ {
+		desiredCapacity := rng.Intn(coldata.MaxBatchSize) + 1
+		b, _ = testAllocator.ResetMaybeReallocateNoMemLimit(typs, b, desiredCapacity)
+		require.LessOrEqual(t, b.Capacity(), maxBatchSize)
+		b, _ = testAllocator.ResetMaybeReallocateWithMaxCapacity(
+			typs, b, desiredCapacity, coldata.MaxBatchSize, math.MaxInt64,
+		)
+		require.LessOrEqual(t, b.Capacity(), maxBatchSize)
+		childBatch, _ = child.ResetMaybeReallocateNoMemLimit(typs, childBatch, desiredCapacity)
+		require.LessOrEqual(t, childBatch.Capacity(), maxBatchSize)
+		helperBatch, _ = helper.ResetMaybeReallocate(typs, helperBatch, desiredCapacity)
+		require.LessOrEqual(t, helperBatch.Capacity(), maxBatchSize)
+		setHelperBatch, _ = setHelper.ResetMaybeReallocate(typs, setHelperBatch, 0 /* tuplesToBeSet */)
+		require.LessOrEqual(t, setHelperBatch.Capacity(), maxBatchSize)
+	}
+}
+
+// TestResetMaybeReallocateWithTypes verifies that only the vectors whose types
+// have changed are replaced when the old batch is reused.
+func TestResetMaybeReallocateWithTypes(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	if coldata.BatchSize() < 2 {
+		skip.IgnoreLint(t, "the test assumes coldata.BatchSize() is at least 2")
+	}
+
+	rng, _ := randutil.NewTestRand()
+	// Use increment of 1 so that no allocations are "reserved".
+	testAllocator, memAcc, cleanup := getAllocator(1 /* increment */)
+	defer cleanup()
+
+	oldTyps := []*types.T{types.Int, types.Int, types.Bytes}
+	newTyps := []*types.T{types.Bytes, types.Int, types.Bytes}
+	capacity := rng.Intn(coldata.BatchSize()-1) + 1
+	b := testAllocator.NewMemBatchWithFixedCapacity(oldTyps, capacity)
+	testAllocator.PerformOperation(b.ColVecs(), func() {
+		for i := 0; i < capacity; i++ {
+			b.ColVec(0).Int64()[i] = int64(i)
+			b.ColVec(1).Int64()[i] = int64(i)
+			b.ColVec(2).Bytes().Set(i, make([]byte, rng.Intn(100)))
+		}
+		b.SetLength(capacity)
+	})
+	intCol := &b.ColVec(1).Int64()[0]
+	bytesCol := b.ColVec(2).Bytes()
+
+	// The old batch already has the maximum capacity, so it is reused with
+	// only the first vector being replaced.
+	testAllocator.SetMaxBatchSize(capacity)
+	newBatch, reallocated := testAllocator.ResetMaybeReallocateWithTypes(newTyps, b, capacity, math.MaxInt64)
+	require.False(t, reallocated)
+	require.True(t, newBatch == b)
+	require.Zero(t, newBatch.Length())
+	require.True(t, newBatch.ColVec(0).Type().Identical(types.Bytes))
+	require.Equal(t, capacity, newBatch.ColVec(0).Bytes().Len())
+	require.True(t, intCol == &newBatch.ColVec(1).Int64()[0])
+	require.True(t, bytesCol == newBatch.ColVec(2).Bytes())
+	require.Equal(t, colmem.GetBatchMemSize(newBatch), memAcc.Used())
+
+	// The replaced vector is accounted for as usual.
+	testAllocator.PerformOperation(newBatch.ColVecs()[:1], func() {
+		newBatch.ColVec(0).Bytes().Set(0, make([]byte, 100))
+		newBatch.SetLength(1)
+	})
+	require.Equal(t, colmem.GetBatchMemSize(newBatch), memAcc.Used())
+
+	// Switching back to the old types when the old batch needs to grow
+	// results in a new batch.
+	b = newBatch
+	testAllocator.SetMaxBatchSize(capacity + 1)
+	newBatch, reallocated = testAllocator.ResetMaybeReallocateWithTypes(oldTyps, b, capacity+1, math.MaxInt64)
+	require.True(t, reallocated)
+	require.True(t, newBatch != b)
+	require.Less(t, capacity, newBatch.Capacity())
+	for i, typ := range oldTyps {
+		require.True(t, newBatch.ColVec(i).Type().Identical(typ))
+	}
+	require.Equal(t, colmem.GetBatchMemSize(newBatch), memAcc.Used())
+
+	// The width of the old batch must match.
+	require.Error(t, colexecerror.CatchVectorizedRuntimeError(func() {
+		testAllocator.ResetMaybeReallocateWithTypes(oldTyps[:2], newBatch, capacity, math.MaxInt64)
+	}))
+
+	testAllocator.ReleaseBatch(newBatch)
+	require.Zero(t, memAcc.Used())
+}
+
+// TestWillFit verifies that WillFit and WillFitBytes consult the headroom of
+// the monitor without modifying the memory account.
+func TestWillFit(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	rng, _ := randutil.NewTestRand()
+	ctx := context.Background()
+	st := cluster.MakeTestingClusterSettings()
+	evalCtx := eval.MakeTestingEvalContext(st)
+	typs := []*types.T{types.Int, types.Bytes, types.Decimal}
+	capacity := rng.Intn(coldata.BatchSize()) + 1
+	estimate := colmem.SelVectorSize(capacity) + colmem.EstimateBatchSizeBytes(typs, capacity)
+	const used = 1000
+
+	for _, headroom := range []int64{estimate - 1, estimate} {
+		testMemMonitor := mon.NewMonitor(mon.Options{
+			Name:      "test-mem",
+			Limit:     used + headroom,
+			Increment: 1,
+			Settings:  st,
+		})
+		testMemMonitor.Start(ctx, nil, mon.NewStandaloneBudget(math.MaxInt64))
+		memAcc := testMemMonitor.MakeBoundAccount()
+		testAllocator := colmem.NewAllocator(ctx, &memAcc, coldataext.NewExtendedColumnFactory(&evalCtx))
+		testAllocator.AdjustMemoryUsage(used)
+
+		fits := headroom >= estimate
+		require.Equal(t, fits, testAllocator.WillFit(typs, capacity))
+		require.True(t, testAllocator.WillFitBytes(headroom))
+		require.False(t, testAllocator.WillFitBytes(headroom+1))
+		require.True(t, testAllocator.WillFitBytes(0))
+		// The account hasn't been modified.
+		require.Equal(t, int64(used), memAcc.Used())
+		require.Equal(t, int64(used), testAllocator.Used())
+
+		// The answer matches what actually happens.
+		_, err := testAllocator.TryNewMemBatchWithFixedCapacity(typs, capacity)
+		require.Equal(t, fits, err == nil)
+		if fits {
+			require.False(t, testAllocator.WillFitBytes(1))
+		}
+
+		// The soft limit of the child allocator is consulted too.
+		testAllocator.ReleaseAll()
+		child := testAllocator.NewChildAllocator("child", estimate-1 /* softLimitBytes */)
+		require.True(t, child.WillFitBytes(estimate-1))
+		require.False(t, child.WillFit(typs, capacity))
+
+		memAcc.Close(ctx)
+		testMemMonitor.Stop(ctx)
+	}
+}
+
+// TestGrowCapacity verifies that GrowCapacity preserves all rows of the batch
+// (including the nulls) and keeps the accounting precise.
+func TestGrowCapacity(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	rng, _ := randutil.NewTestRand()
+	// Use increment of 1 so that no allocations are "reserved".
+	testAllocator, memAcc, cleanup := getAllocator(1 /* increment */)
+	defer cleanup()
+
+	typs := []*types.T{types.Int, types.Bytes, types.Decimal}
+	oldCapacity := rng.Intn(coldata.BatchSize()) + 1
+	b := testAllocator.NewMemBatchWithFixedCapacity(typs, oldCapacity)
+	length := rng.Intn(oldCapacity) + 1
+	nulls := make([]bool, length)
+	testAllocator.PerformOperation(b.ColVecs(), func() {
+		for i := 0; i < length; i++ {
+			if nulls[i] = rng.Float64() < 0.2; nulls[i] {
+				for _, vec := range b.ColVecs() {
+					vec.Nulls().SetNull(i)
+				}
+				continue
+			}
+			b.ColVec(0).Int64()[i] = int64(i)
+			// Make sure that some of the values are not inlined.
+			b.ColVec(1).Bytes().Set(i, make([]byte, rng.Intn(2*coldata.BytesMaxInlineLength)+1))
+			b.ColVec(2).Decimal()[i].SetInt64(int64(i))
+		}
+		b.SetLength(length)
+	})
+	require.Equal(t, colmem.GetBatchMemSize(b), memAcc.Used())
+	oldBytes := make([][]byte, length)
+	for i := range oldBytes {
+		oldBytes[i] = b.ColVec(1).Bytes().Get(i)
+	}
+
+	// The batch with the sufficient capacity is returned as is.
+	require.True(t, b == testAllocator.GrowCapacity(b, oldCapacity))
+
+	newCapacity := oldCapacity + rng.Intn(coldata.BatchSize()) + 1
+	grown := testAllocator.GrowCapacity(b, newCapacity)
+	require.LessOrEqual(t, newCapacity, grown.Capacity())
+	require.Equal(t, length, grown.Length())
+	require.Equal(t, colmem.GetBatchMemSize(grown), memAcc.Used())
+	for i := 0; i < length; i++ {
+		for _, vec := range grown.ColVecs() {
+			require.Equal(t, nulls[i], vec.Nulls().NullAt(i))
+		}
+		if nulls[i] {
+			continue
+		}
+		require.Equal(t, int64(i), grown.ColVec(0).Int64()[i])
+		require.Equal(t, oldBytes[i], grown.ColVec(1).Bytes().Get(i))
+		if len(oldBytes[i]) > coldata.BytesMaxInlineLength {
+			// The non-inlined values haven't been copied.
+			require.True(t, &oldBytes[i][0] == &grown.ColVec(1).Bytes().Get(i)[0])
+		}
+		d := grown.ColVec(2).Decimal()[i]
+		v, err := d.Int64()
+		require.NoError(t, err)
+		require.Equal(t, int64(i), v)
+	}
+
+	// The new rows can be set.
+	testAllocator.PerformOperation(grown.ColVecs(), func() {
+		for i := length; i < newCapacity; i++ {
+			grown.ColVec(0).Int64()[i] = int64(i)
+			grown.ColVec(1).Bytes().Set(i, make([]byte, rng.Intn(2*coldata.BytesMaxInlineLength)+1))
+			grown.ColVec(2).Decimal()[i].SetInt64(int64(i))
+		}
+		grown.SetLength(newCapacity)
+	})
+	for i := length; i < newCapacity; i++ {
+		require.False(t, grown.ColVec(0).Nulls().NullAt(i))
+		require.Equal(t, int64(i), grown.ColVec(0).Int64()[i])
+	}
+	require.Equal(t, colmem.GetBatchMemSize(grown), memAcc.Used())
+
+	// The batches with the selection vector and the windowed batches cannot
+	// be grown.
+	grown.SetSelection(true)
+	require.Error(t, colexecerror.CatchVectorizedRuntimeError(func() {
+		testAllocator.GrowCapacity(grown, newCapacity+1)
+	}))
+	grown.SetSelection(false)
+	w := testAllocator.NewMemBatchNoCols(typs, 1 /* capacity */)
+	for i := range typs {
+		w.ReplaceCol(grown.ColVec(i).Window(0, 1), i)
+	}
+	testAllocator.AccountForWindow(w)
+	require.Error(t, colexecerror.CatchVectorizedRuntimeError(func() {
+		testAllocator.GrowCapacity(w, 2)
+	}))
+	testAllocator.ReleaseBatch(w)
+
+	testAllocator.ReleaseBatch(grown)
+	require.Zero(t, memAcc.Used())
+	require.Zero(t, testAllocator.Snapshot().NumLiveBatches)
+}
+
+func BenchmarkGrowCapacity(b *testing.B) {
+	defer log.Scope(b).Close(b)
+
+	typs := []*types.T{types.Int, types.Bytes, types.Decimal}
+	const oldCapacity = 512
+	for _, copyEverything := range []bool{false, true} {
+		b.Run(fmt.Sprintf("copyEverything=%t", copyEverything), func(b *testing.B) {
+			testAllocator, _, cleanup := getAllocator(increment)
+			defer cleanup()
+			value := make([]byte, 2*coldata.BytesMaxInlineLength)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				batch := testAllocator.NewMemBatchWithFixedCapacity(typs, oldCapacity)
+				for j := 0; j < oldCapacity; j++ {
+					batch.ColVec(1).Bytes().Set(j, value)
+				}
+				batch.SetLength(oldCapacity)
+				b.StartTimer()
+				var grown coldata.Batch
+				if copyEverything {
+					grown = testAllocator.NewMemBatchWithFixedCapacity(typs, 2*oldCapacity)
+					testAllocator.PerformOperation(grown.ColVecs(), func() {
+						for j, vec := range grown.ColVecs() {
+							vec.Copy(coldata.SliceArgs{Src: batch.ColVec(j), SrcEndIdx: oldCapacity})
+						}
+						grown.SetLength(oldCapacity)
+					})
+					testAllocator.ReleaseBatch(batch)
+				} else {
+					grown = testAllocator.GrowCapacity(batch, 2*oldCapacity)
+				}
+				b.StopTimer()
+				testAllocator.ReleaseBatch(grown)
+				b.StartTimer()
+			}
+		})
+	}
+}
+
+// TestSetMinBatchCapacity verifies the interaction of the floor set via
+// SetMinBatchCapacity with the maximum batch size and the memory limit.
+func TestSetMinBatchCapacity(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	const minBatchCapacity = 64
+	if coldata.BatchSize() < 2*minBatchCapacity {
+		skip.IgnoreLint(t, "the test assumes coldata.BatchSize() is at least 128")
+	}
+
+	testAllocator, _, cleanup := getAllocator(1 /* increment */)
+	defer cleanup()
+	for _, invalid := range []int{-1, 0, coldata.MaxBatchSize + 1} {
+		require.Error(t, colexecerror.CatchVectorizedRuntimeError(func() {
+			testAllocator.SetMinBatchCapacity(invalid)
+		}))
+	}
+	typs := []*types.T{types.Int, types.Bytes}
+
+	// Without the floor, the capacity starts from 1.
+	b, _ := testAllocator.ResetMaybeReallocateWithMaxCapacity(
+		typs, nil /* oldBatch */, 1 /* minDesiredCapacity */, coldata.BatchSize(), math.MaxInt64,
+	)
+	require.Equal(t, 1, b.Capacity())
+	testAllocator.ReleaseBatch(b)
+
+	// The floor is used as the desired capacity.
+	testAllocator.SetMinBatchCapacity(minBatchCapacity)
+	b, _ = testAllocator.ResetMaybeReallocateWithMaxCapacity(
+		typs, nil /* oldBatch */, 1 /* minDesiredCapacity */, coldata.BatchSize(), math.MaxInt64,
+	)
+	require.Equal(t, minBatchCapacity, b.Capacity())
+	// Larger desired capacities are still respected.
+	b, _ = testAllocator.ResetMaybeReallocateNoMemLimit(typs, b, 2*minBatchCapacity)
+	require.Equal(t, 2*minBatchCapacity, b.Capacity())
+	testAllocator.ReleaseBatch(b)
+	var helper colmem.AccountingHelper
+	helper.Init(testAllocator, math.MaxInt64)
+	b, _ = helper.ResetMaybeReallocate(typs, nil /* oldBatch */, 0 /* tuplesToBeSet */)
+	require.Equal(t, minBatchCapacity, b.Capacity())
+	testAllocator.ReleaseBatch(b)
+
+	// The memory limit takes precedence over the floor.
+	maxBatchMemSize := colmem.SelVectorSize(minBatchCapacity/2) +
+		colmem.EstimateBatchSizeBytes(typs, minBatchCapacity/2)
+	b, _ = testAllocator.ResetMaybeReallocateWithMaxCapacity(
+		typs, nil /* oldBatch */, 1 /* minDesiredCapacity */, coldata.BatchSize(), maxBatchMemSize,
+	)
+	require.Less(t, b.Capacity(), minBatchCapacity)
+	testAllocator.ReleaseBatch(b)
+
+	// So do the maximum capacity and the maximum batch size.
+	b, _ = testAllocator.ResetMaybeReallocateWithMaxCapacity(
+		typs, nil /* oldBatch */, 1 /* minDesiredCapacity */, minBatchCapacity/2, math.MaxInt64,
+	)
+	require.Equal(t, minBatchCapacity/2, b.Capacity())
+	testAllocator.ReleaseBatch(b)
+	testAllocator.SetMinBatchCapacity(coldata.MaxBatchSize)
+	b, _ = testAllocator.ResetMaybeReallocateNoMemLimit(typs, nil /* oldBatch */, 1)
+	require.Equal(t, coldata.BatchSize(), b.Capacity())
+	testAllocator.ReleaseBatch(b)
+	testAllocator.SetMaxBatchSize(minBatchCapacity / 4)
+	b, _ = testAllocator.ResetMaybeReallocateNoMemLimit(typs, nil /* oldBatch */, 1)
+	require.Equal(t, minBatchCapacity/4, b.Capacity())
+	testAllocator.ReleaseBatch(b)
+}
+
+// TestAdjustMemoryUsageAfterRelease verifies that the releases of more bytes
+// than are attributed to the allocator are detected and that the interleaved
+// grows and releases stay balanced.
+func TestAdjustMemoryUsageAfterRelease(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	rng, _ := randutil.NewTestRand()
+	// Use increment of 1 so that no allocations are "reserved".
+	testAllocator, memAcc, cleanup := getAllocator(1 /* increment */)
+	defer cleanup()
+
+	t.Run("double-release", func(t *testing.T) {
+		testAllocator.AdjustMemoryUsage(100)
+		testAllocator.AdjustMemoryUsageAfterRelease(-100)
+		require.Zero(t, testAllocator.Attributed())
+		err := colexecerror.CatchVectorizedRuntimeError(func() {
+			testAllocator.AdjustMemoryUsageAfterRelease(-100)
+		})
+		if buildutil.CrdbTestBuild {
+			require.True(t, errors.HasAssertionFailure(err), "%v", err)
+		} else {
+			// The release is clamped.
+			require.NoError(t, err)
+		}
+		require.Zero(t, testAllocator.Attributed())
+		require.Zero(t, memAcc.Used())
+
+		// The usage of the other components sharing the account isn't
+		// affected by the over-release.
+		require.NoError(t, memAcc.Grow(context.Background(), 50))
+		testAllocator.AdjustMemoryUsage(100)
+		err = colexecerror.CatchVectorizedRuntimeError(func() {
+			testAllocator.AdjustMemoryUsageAfterRelease(-150)
+		})
+		if buildutil.CrdbTestBuild {
+			require.True(t, errors.HasAssertionFailure(err), "%v", err)
+			testAllocator.AdjustMemoryUsageAfterRelease(-100)
+		} else {
+			require.NoError(t, err)
+		}
+		require.Zero(t, testAllocator.Attributed())
+		require.Equal(t, int64(50), memAcc.Used())
+		memAcc.Shrink(context.Background(), 50)
+
+		// Positive deltas are rejected.
+		require.Error(t, colexecerror.CatchVectorizedRuntimeError(func() {
+			testAllocator.AdjustMemoryUsageAfterRelease(1)
+		}))
+	})
+
+	t.Run("interleaved", func(t *testing.T) {
+		var expected int64
+		var held []int64
+		for i := 0; i < 1000; i++ {
+			if len(held) > 0 && rng.Intn(2) == 0 {
+				idx := rng.Intn(len(held))
+				testAllocator.AdjustMemoryUsageAfterRelease(-held[idx])
+				expected -= held[idx]
+				held = append(held[:idx], held[idx+1:]...)
+			} else {
+				size := int64(rng.Intn(1000)) + 1
+				testAllocator.AdjustMemoryUsage(size)
+				expected += size
+				held = append(held, size)
+			}
+			require.Equal(t, expected, testAllocator.Attributed())
+			require.Equal(t, expected, memAcc.Used())
+		}
+		for _, size := range held {
+			testAllocator.AdjustMemoryUsageAfterRelease(-size)
+		}
+		require.Zero(t, testAllocator.Attributed())
+		require.Zero(t, memAcc.Used())
+	})
+}
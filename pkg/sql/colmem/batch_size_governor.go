@@ -0,0 +1,117 @@
+// Copyright 2024 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package colmem
+
+import (
+	"sync/atomic"
+
+	"github.com/cockroachdb/cockroach/pkg/col/coldata"
+	"github.com/cockroachdb/cockroach/pkg/sql/colexecerror"
+	"github.com/cockroachdb/errors"
+)
+
+// governorPressureThreshold is the fraction of the budget of the
+// BatchSizeGovernor after which the recommended capacity starts shrinking.
+const governorPressureThreshold = 0.5
+
+// BatchSizeGovernor coordinates the capacities of the batches allocated by
+// multiple Allocators (e.g. by all operators of a flow) so that they don't
+// collectively overshoot the shared budget even if each one of them stays
+// within its own limits.
+//
+// The governor observes the total number of bytes accounted for by the
+// registered allocators and recommends the maximum capacity that is used by
+// the ResetMaybeReallocate methods of the allocators (as well as of the
+// accounting helpers) instead of coldata.BatchSize(). While less than half of
+// the budget is used, the recommendation is coldata.BatchSize(); afterwards,
+// it shrinks linearly down to 1 when the whole budget is used, and it grows
+// back as the memory is released. Note that the recommendation doesn't shrink
+// the already allocated batches, it only prevents them from growing.
+//
+// The governor is safe for concurrent use.
+type BatchSizeGovernor struct {
+	// budget is the total number of bytes that the registered allocators are
+	// expected to use.
+	budget int64
+	// used is the total number of bytes currently accounted for by the
+	// registered allocators. It is accessed atomically.
+	used int64
+}
+
+// NewBatchSizeGovernor returns a new BatchSizeGovernor with the given budget
+// (usually the limit of the memory monitor of the flow).
+func NewBatchSizeGovernor(budget int64) *BatchSizeGovernor {
+	if budget <= 0 {
+		colexecerror.InternalError(errors.AssertionFailedf("invalid budget %d", budget))
+	}
+	return &BatchSizeGovernor{budget: budget}
+}
+
+// Register registers the allocator with the governor. The memory currently
+// accounted for by the allocator (as well as all of the future changes to it)
+// is included into the usage observed by the governor. The child allocators
+// created afterwards are registered too.
+//
+// Register must be called before the allocator is used concurrently with the
+// governor's other users, and the allocator cannot be registered with more
+// than one governor.
+func (g *BatchSizeGovernor) Register(a *Allocator) {
+	if a.governor != nil {
+		colexecerror.InternalError(errors.AssertionFailedf("allocator is already registered with a governor"))
+	}
+	a.governor = g
+	g.adjust(atomic.LoadInt64(&a.atomics.currentBytes))
+}
+
+// adjust updates the observed usage by delta bytes.
+func (g *BatchSizeGovernor) adjust(delta int64) {
+	atomic.AddInt64(&g.used, delta)
+}
+
+// Used returns the total number of bytes currently accounted for by the
+// registered allocators.
+func (g *BatchSizeGovernor) Used() int64 {
+	return atomic.LoadInt64(&g.used)
+}
+
+// MaxCapacity returns the currently recommended maximum capacity of the
+// batches.
+func (g *BatchSizeGovernor) MaxCapacity() int {
+	maxCapacity := coldata.BatchSize()
+	used := atomic.LoadInt64(&g.used)
+	pressureBytes := int64(float64(g.budget) * governorPressureThreshold)
+	if used <= pressureBytes {
+		return maxCapacity
+	} else if used >= g.budget {
+		return 1
+	}
+	// Shrink the recommendation proportionally to the remaining budget.
+	remaining := float64(g.budget-used) / float64(g.budget-pressureBytes)
+	if c := int(remaining * float64(maxCapacity)); c < maxCapacity {
+		maxCapacity = c
+	}
+	if maxCapacity < 1 {
+		maxCapacity = 1
+	}
+	return maxCapacity
+}
+
+// governedMaxBatchSize returns the maximum capacity of the batches allocated
+// by the ResetMaybeReallocate methods given the maximum that the caller asked
+// for, taking the recommendation of the governor into account.
+func (a *Allocator) governedMaxBatchSize(maxBatchSize int) int {
+	if a.governor != nil {
+		if c := a.governor.MaxCapacity(); c < maxBatchSize {
+			return c
+		}
+	}
+	return maxBatchSize
+}
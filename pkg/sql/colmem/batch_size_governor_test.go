@@ -0,0 +1,111 @@
+// Copyright 2024 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package colmem_test
+
+import (
+	"context"
+	"math"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/col/coldata"
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/colmem"
+	"github.com/cockroachdb/cockroach/pkg/sql/types"
+	"github.com/cockroachdb/cockroach/pkg/testutils/skip"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/mon"
+	"github.com/stretchr/testify/require"
+)
+
+// TestBatchSizeGovernor simulates several allocators that grow their batches
+// under a shared tight memory monitor and verifies that the capacities stop
+// growing once the governor detects the memory pressure (so that the monitor
+// budget is never exceeded).
+func TestBatchSizeGovernor(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	if coldata.BatchSize() < 64 {
+		skip.IgnoreLint(t, "the test assumes coldata.BatchSize() is at least 64")
+	}
+
+	ctx := context.Background()
+	typs := []*types.T{types.Int}
+	const numAllocators = 4
+	// The budget only fits two batches of the maximum capacity, so the
+	// allocators growing their batches independently would exceed it.
+	fullBatchMemSize := colmem.SelVectorSize(coldata.BatchSize()) + colmem.EstimateBatchSizeBytes(typs, coldata.BatchSize())
+	budget := 2 * fullBatchMemSize
+	testMemMonitor := mon.NewMonitor(mon.Options{
+		Name:      "test-mem",
+		Limit:     budget,
+		Increment: 1,
+		Settings:  cluster.MakeTestingClusterSettings(),
+	})
+	testMemMonitor.Start(ctx, nil, mon.NewStandaloneBudget(math.MaxInt64))
+	defer testMemMonitor.Stop(ctx)
+
+	governor := colmem.NewBatchSizeGovernor(budget)
+	require.Equal(t, coldata.BatchSize(), governor.MaxCapacity())
+	allocators := make([]*colmem.Allocator, numAllocators)
+	for i := range allocators {
+		memAcc := testMemMonitor.MakeBoundAccount()
+		defer memAcc.Close(ctx)
+		allocators[i] = colmem.NewAllocator(ctx, &memAcc, coldata.StandardColumnFactory)
+		governor.Register(allocators[i])
+	}
+
+	batches := make([]coldata.Batch, numAllocators)
+	resetMaybeReallocate := func(i int) {
+		maxCapacity := governor.MaxCapacity()
+		var oldCapacity int
+		if batches[i] != nil {
+			oldCapacity = batches[i].Capacity()
+		}
+		batches[i], _ = allocators[i].ResetMaybeReallocateWithMaxCapacity(
+			typs, batches[i], 1 /* minDesiredCapacity */, coldata.BatchSize(), math.MaxInt64, /* maxBatchMemSize */
+		)
+		if c := batches[i].Capacity(); c > oldCapacity {
+			// The batch only grows up to the recommended capacity.
+			require.LessOrEqual(t, c, maxCapacity)
+		}
+	}
+
+	var pressureDetected bool
+	for round := 0; round < 20; round++ {
+		for i := range allocators {
+			resetMaybeReallocate(i)
+			pressureDetected = pressureDetected || governor.MaxCapacity() < coldata.BatchSize()
+		}
+	}
+	require.True(t, pressureDetected)
+	var totalUsed int64
+	for i, a := range allocators {
+		require.Less(t, batches[i].Capacity(), coldata.BatchSize())
+		totalUsed += a.Used()
+	}
+	require.Equal(t, totalUsed, governor.Used())
+	require.LessOrEqual(t, governor.Used(), budget)
+
+	// Once all allocators but one release their memory, the recommendation is
+	// relaxed, and the remaining allocator grows its batch to the maximum
+	// capacity.
+	for _, a := range allocators[1:] {
+		a.ReleaseAll()
+	}
+	require.Equal(t, coldata.BatchSize(), governor.MaxCapacity())
+	for round := 0; round < 20; round++ {
+		resetMaybeReallocate(0 /* i */)
+	}
+	require.Equal(t, coldata.BatchSize(), batches[0].Capacity())
+	require.Equal(t, allocators[0].Used(), governor.Used())
+}
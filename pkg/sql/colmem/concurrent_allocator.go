@@ -0,0 +1,70 @@
+// Copyright 2024 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package colmem
+
+import (
+	"context"
+
+	"github.com/cockroachdb/cockroach/pkg/col/coldata"
+	"github.com/cockroachdb/cockroach/pkg/sql/colexecerror"
+	"github.com/cockroachdb/cockroach/pkg/util/mon"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/cockroachdb/errors"
+)
+
+// NewConcurrentAllocator constructs a new Allocator that can be shared by
+// multiple goroutines, e.g. by the internal goroutines of an operator that fans
+// out its work, so that they don't have to split the budget between separate
+// memory accounts.
+//
+// The following methods of the returned allocator are safe for concurrent use:
+//   - the NewMemBatch* methods,
+//   - PerformOperation, PerformAppend, and AdjustMemoryUsage (including their
+//     variants),
+//   - ReleaseMemory and ReleaseBatch,
+//   - Used, Snapshot, and Stats.
+//
+// All of the changes to the memory account are serialized by a mutex, so the
+// allocator is slightly slower than the one created via NewAllocator and
+// should only be used when the concurrency is needed. The rest of the methods
+// (e.g. ResetMaybeReallocate* and ReleaseAll) can only be used once the
+// goroutines are done with the allocator. The child allocators, the buffered
+// accounting mode, and the budget callback are not supported.
+func NewConcurrentAllocator(
+	ctx context.Context, acc *mon.BoundAccount, factory coldata.ColumnFactory,
+) *Allocator {
+	a := NewAllocator(ctx, acc, factory)
+	a.mu = &syncutil.Mutex{}
+	return a
+}
+
+// lock acquires the mutex of the allocator created via NewConcurrentAllocator
+// and is a noop otherwise.
+func (a *Allocator) lock() {
+	if a.mu != nil {
+		a.mu.Lock()
+	}
+}
+
+// unlock releases the mutex acquired via lock.
+func (a *Allocator) unlock() {
+	if a.mu != nil {
+		a.mu.Unlock()
+	}
+}
+
+// assertNotConcurrent throws an assertion failure if the allocator was created
+// via NewConcurrentAllocator, which doesn't support the given feature.
+func (a *Allocator) assertNotConcurrent(feature string) {
+	if a.mu != nil {
+		colexecerror.InternalError(errors.AssertionFailedf("%s cannot be used with concurrent allocator", feature))
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2024 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package colmem_test
+
+import (
+	"context"
+	"math"
+	"sync"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/col/coldata"
+	"github.com/cockroachdb/cockroach/pkg/col/coldataext"
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/colexecerror"
+	"github.com/cockroachdb/cockroach/pkg/sql/colmem"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/eval"
+	"github.com/cockroachdb/cockroach/pkg/sql/types"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/mon"
+	"github.com/cockroachdb/cockroach/pkg/util/randutil"
+	"github.com/stretchr/testify/require"
+)
+
+// TestConcurrentAllocator verifies that many goroutines can allocate, modify,
+// and release the batches as well as adjust the memory usage through the same
+// concurrent allocator, and that the memory accounted for in the end matches
+// what the goroutines have retained. It is meant to be run under the race
+// detector.
+func TestConcurrentAllocator(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	rng, _ := randutil.NewTestRand()
+	ctx := context.Background()
+	st := cluster.MakeTestingClusterSettings()
+	testMemMonitor := mon.NewMonitor(mon.Options{
+		Name:      "test-mem",
+		Increment: 1,
+		Settings:  st,
+	})
+	testMemMonitor.Start(ctx, nil, mon.NewStandaloneBudget(math.MaxInt64))
+	defer testMemMonitor.Stop(ctx)
+	memAcc := testMemMonitor.MakeBoundAccount()
+	defer memAcc.Close(ctx)
+	evalCtx := eval.MakeTestingEvalContext(st)
+	testAllocator := colmem.NewConcurrentAllocator(ctx, &memAcc, coldataext.NewExtendedColumnFactory(&evalCtx))
+
+	const numGoroutines = 16
+	const numIterations = 200
+	typs := []*types.T{types.Int, types.Bytes}
+	// retained is the number of bytes registered via AdjustMemoryUsage that
+	// each goroutine hasn't released.
+	retained := make([]int64, numGoroutines)
+	seeds := make([]int64, numGoroutines)
+	for i := range seeds {
+		seeds[i] = rng.Int63()
+	}
+	var wg sync.WaitGroup
+	wg.Add(numGoroutines)
+	for g := 0; g < numGoroutines; g++ {
+		go func(g int) {
+			defer wg.Done()
+			rng := randutil.NewTestRandWithSeed(seeds[g])
+			var batches []coldata.Batch
+			for i := 0; i < numIterations; i++ {
+				switch rng.Intn(4) {
+				case 0:
+					batches = append(batches, testAllocator.NewMemBatchWithFixedCapacity(typs, rng.Intn(16)+1))
+				case 1:
+					if len(batches) == 0 {
+						continue
+					}
+					b := batches[rng.Intn(len(batches))]
+					v := make([]byte, rng.Intn(4*coldata.BytesMaxInlineLength))
+					testAllocator.PerformOperation(b.ColVecs(), func() {
+						rowIdx := rng.Intn(b.Capacity())
+						b.ColVec(0).Int64()[rowIdx] = int64(rowIdx)
+						b.ColVec(1).Bytes().Set(rowIdx, v)
+					})
+				case 2:
+					if len(batches) == 0 {
+						continue
+					}
+					idx := rng.Intn(len(batches))
+					testAllocator.ReleaseBatch(batches[idx])
+					batches = append(batches[:idx], batches[idx+1:]...)
+				default:
+					if delta := int64(rng.Intn(100)); rng.Intn(2) == 0 || delta > retained[g] {
+						testAllocator.AdjustMemoryUsage(delta)
+						retained[g] += delta
+					} else {
+						testAllocator.AdjustMemoryUsage(-delta)
+						retained[g] -= delta
+					}
+				}
+			}
+			for _, b := range batches {
+				testAllocator.ReleaseBatch(b)
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	var expected int64
+	for _, r := range retained {
+		expected += r
+	}
+	require.Equal(t, expected, testAllocator.Used())
+	require.Equal(t, expected, memAcc.Used())
+	require.Zero(t, testAllocator.Snapshot().NumLiveBatches)
+	testAllocator.ReleaseAll()
+	require.Zero(t, memAcc.Used())
+
+	// The features that aren't safe for concurrent use are rejected.
+	require.Error(t, colexecerror.CatchVectorizedRuntimeError(func() {
+		testAllocator.NewChildAllocator("child", math.MaxInt64)
+	}))
+	require.Error(t, colexecerror.CatchVectorizedRuntimeError(func() {
+		testAllocator.EnableBufferedAccounting(colmem.DefaultBufferedAccountingThreshold)
+	}))
+	require.Error(t, colexecerror.CatchVectorizedRuntimeError(func() {
+		testAllocator.SetBudgetCallback(0.5 /* threshold */, func(used, limit int64) {})
+	}))
+}
@@ -0,0 +1,117 @@
+// Copyright 2024 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package colmem
+
+import (
+	"context"
+
+	"github.com/cockroachdb/cockroach/pkg/col/coldata"
+	"github.com/cockroachdb/cockroach/pkg/col/typeconv"
+	"github.com/cockroachdb/cockroach/pkg/sql/colexecerror"
+	"github.com/cockroachdb/cockroach/pkg/sql/types"
+	"github.com/cockroachdb/cockroach/pkg/util/mon"
+	"github.com/cockroachdb/errors"
+)
+
+// fixedWidthSchema describes the type schema in which all types have the
+// statically known size (see GetFixedSizeTypeSize). For such schemas, the
+// estimate of the batch footprint is exact and only depends on the capacity,
+// so it is precomputed once.
+type fixedWidthSchema struct {
+	typs []*types.T
+	// bytesPerRow is the total size of a single row of all vectors.
+	bytesPerRow int64
+	// fixedOverhead is the part of the footprint that doesn't depend on the
+	// capacity (the batch and the vector overheads).
+	fixedOverhead int64
+}
+
+// isFixedWidthType returns whether the values of the given type have the
+// statically known size.
+func isFixedWidthType(t *types.T) bool {
+	switch typeconv.TypeFamilyToCanonicalTypeFamily(t.Family()) {
+	case types.BoolFamily,
+		types.IntFamily,
+		types.FloatFamily,
+		types.TimestampTZFamily,
+		types.IntervalFamily:
+		return true
+	}
+	return false
+}
+
+// matches returns whether typs is the schema the estimate was precomputed for.
+// Only the pointer equality of the types is checked in order to keep the check
+// cheap.
+func (s *fixedWidthSchema) matches(typs []*types.T) bool {
+	if len(typs) != len(s.typs) {
+		return false
+	}
+	for i := range typs {
+		if typs[i] != s.typs[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// estimateBatchSizeBytes returns the same value as EstimateBatchSizeBytes for
+// the schema.
+func (s *fixedWidthSchema) estimateBatchSizeBytes(capacity int) int64 {
+	if capacity == 0 {
+		return 0
+	}
+	return s.fixedOverhead + s.bytesPerRow*int64(capacity) + int64(len(s.typs))*NullsSize(capacity)
+}
+
+// NewFixedWidthAllocator constructs a new Allocator (the same as NewAllocator)
+// that is specialized for the given type schema in which all types must have
+// the statically known size (e.g. INT, FLOAT, BOOL, TIMESTAMPTZ). The estimates
+// of the footprint of the batches of that schema, which are used by the
+// ResetMaybeReallocate methods and when allocating new batches, are computed
+// from the precomputed size of a row rather than by examining the types on
+// every call.
+//
+// The allocator can still be used with other schemas, in which case the
+// estimates are computed as usual. The behavior is identical to the allocator
+// created via NewAllocator.
+func NewFixedWidthAllocator(
+	ctx context.Context,
+	unlimitedAcc *mon.BoundAccount,
+	factory coldata.ColumnFactory,
+	typs []*types.T,
+) *Allocator {
+	s := &fixedWidthSchema{
+		typs:          typs,
+		fixedOverhead: BatchOverhead + int64(len(typs))*VecOverhead,
+	}
+	for _, t := range typs {
+		if !isFixedWidthType(t) {
+			colexecerror.InternalError(errors.AssertionFailedf(
+				"type %s is not fixed-width", t.SQLStringForError(),
+			))
+		}
+		s.bytesPerRow += GetFixedSizeTypeSize(t)
+	}
+	a := NewAllocator(ctx, unlimitedAcc, factory)
+	a.fixedWidth = s
+	return a
+}
+
+// estimateFixedWidthBatchSizeBytes returns the same value as
+// EstimateBatchSizeBytes, using the precomputed estimate if the allocator was
+// created via NewFixedWidthAllocator for typs.
+func (a *Allocator) estimateFixedWidthBatchSizeBytes(typs []*types.T, capacity int) int64 {
+	if a.fixedWidth != nil && a.fixedWidth.matches(typs) {
+		return a.fixedWidth.estimateBatchSizeBytes(capacity)
+	}
+	return EstimateBatchSizeBytes(typs, capacity)
+}
@@ -0,0 +1,164 @@
+// Copyright 2024 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package colmem_test
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/col/coldata"
+	"github.com/cockroachdb/cockroach/pkg/col/coldataext"
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/colexecerror"
+	"github.com/cockroachdb/cockroach/pkg/sql/colmem"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/eval"
+	"github.com/cockroachdb/cockroach/pkg/sql/types"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/mon"
+	"github.com/cockroachdb/cockroach/pkg/util/randutil"
+	"github.com/stretchr/testify/require"
+)
+
+var fixedWidthTypes = []*types.T{
+	types.Bool, types.Int, types.Int2, types.Int4, types.Float, types.TimestampTZ, types.Interval,
+}
+
+// getFixedWidthAllocator is the same as getAllocator but returns the allocator
+// created via NewFixedWidthAllocator for the given schema.
+func getFixedWidthAllocator(
+	typs []*types.T,
+) (_ *colmem.Allocator, _ *mon.BoundAccount, cleanup func()) {
+	ctx := context.Background()
+	st := cluster.MakeTestingClusterSettings()
+	testMemMonitor := mon.NewMonitor(mon.Options{
+		Name:      "test-mem",
+		Increment: 1,
+		Settings:  st,
+	})
+	testMemMonitor.Start(ctx, nil, mon.NewStandaloneBudget(math.MaxInt64))
+	memAcc := testMemMonitor.MakeBoundAccount()
+	evalCtx := eval.MakeTestingEvalContext(st)
+	testColumnFactory := coldataext.NewExtendedColumnFactory(&evalCtx)
+	testAllocator := colmem.NewFixedWidthAllocator(ctx, &memAcc, testColumnFactory, typs)
+	cleanup = func() {
+		memAcc.Close(ctx)
+		testMemMonitor.Stop(ctx)
+	}
+	return testAllocator, &memAcc, cleanup
+}
+
+// TestFixedWidthAllocator verifies that the allocator created via
+// NewFixedWidthAllocator behaves identically to the regular allocator.
+func TestFixedWidthAllocator(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	rng, _ := randutil.NewTestRand()
+
+	// The schemas with variable-width types are rejected.
+	require.Error(t, colexecerror.CatchVectorizedRuntimeError(func() {
+		getFixedWidthAllocator([]*types.T{types.Int, types.Bytes})
+	}))
+
+	for run := 0; run < 10; run++ {
+		typs := make([]*types.T, rng.Intn(4)+1)
+		for i := range typs {
+			typs[i] = fixedWidthTypes[rng.Intn(len(fixedWidthTypes))]
+		}
+		regular, regularAcc, regularCleanup := getAllocator(1 /* increment */)
+		fixedWidth, fixedWidthAcc, fixedWidthCleanup := getFixedWidthAllocator(typs)
+
+		// The estimates match.
+		for _, capacity := range []int{0, 1, 7, 8, 9, coldata.BatchSize()} {
+			require.Equal(t, regular.WillFit(typs, capacity), fixedWidth.WillFit(typs, capacity))
+			b1 := regular.NewMemBatchWithFixedCapacity(typs, capacity)
+			b2 := fixedWidth.NewMemBatchWithFixedCapacity(typs, capacity)
+			require.Equal(t, regularAcc.Used(), fixedWidthAcc.Used())
+			regular.ReleaseBatch(b1)
+			fixedWidth.ReleaseBatch(b2)
+		}
+
+		// So do the decisions of the ResetMaybeReallocate methods under the
+		// random memory limits.
+		var b1, b2 coldata.Batch
+		var r1, r2 bool
+		for i := 0; i < 100; i++ {
+			minDesiredCapacity := rng.Intn(coldata.BatchSize() + 1)
+			maxBatchMemSize := colmem.EstimateBatchSizeBytes(typs, rng.Intn(coldata.BatchSize())+1)
+			if rng.Intn(4) == 0 {
+				maxBatchMemSize = math.MaxInt64
+			}
+			if rng.Intn(8) == 0 {
+				// Occasionally start from scratch.
+				regular.ReleaseBatch(b1)
+				fixedWidth.ReleaseBatch(b2)
+				b1, b2 = nil, nil
+			}
+			b1, r1 = regular.ResetMaybeReallocateWithMaxCapacity(
+				typs, b1, minDesiredCapacity, coldata.BatchSize(), maxBatchMemSize,
+			)
+			b2, r2 = fixedWidth.ResetMaybeReallocateWithMaxCapacity(
+				typs, b2, minDesiredCapacity, coldata.BatchSize(), maxBatchMemSize,
+			)
+			require.Equal(t, r1, r2)
+			require.Equal(t, b1.Capacity(), b2.Capacity())
+			require.Equal(t, regularAcc.Used(), fixedWidthAcc.Used())
+		}
+		require.Equal(t, regular.Stats(), fixedWidth.Stats())
+
+		// Other schemas can still be used.
+		otherTyps := []*types.T{types.Int, types.Bytes}
+		b1 = regular.NewMemBatchWithFixedCapacity(otherTyps, coldata.BatchSize())
+		b2 = fixedWidth.NewMemBatchWithFixedCapacity(otherTyps, coldata.BatchSize())
+		require.Equal(t, regularAcc.Used(), fixedWidthAcc.Used())
+
+		regularCleanup()
+		fixedWidthCleanup()
+	}
+}
+
+// BenchmarkResetMaybeReallocateFixedWidth measures the cost of the
+// ResetMaybeReallocate methods which reuse the old batch because of the memory
+// limit (so that the estimates are consulted on every call) for an all-int
+// schema.
+func BenchmarkResetMaybeReallocateFixedWidth(b *testing.B) {
+	defer log.Scope(b).Close(b)
+
+	typs := []*types.T{types.Int, types.Int, types.Int, types.Int}
+	// The memory limit fits just over a half of the maximum capacity.
+	maxBatchMemSize := colmem.SelVectorSize(coldata.BatchSize()/2+1) +
+		colmem.EstimateBatchSizeBytes(typs, coldata.BatchSize()/2+1)
+	for _, fixedWidth := range []bool{false, true} {
+		b.Run(fmt.Sprintf("fixedWidth=%t", fixedWidth), func(b *testing.B) {
+			var testAllocator *colmem.Allocator
+			var cleanup func()
+			if fixedWidth {
+				testAllocator, _, cleanup = getFixedWidthAllocator(typs)
+			} else {
+				testAllocator, _, cleanup = getAllocator(increment)
+			}
+			defer cleanup()
+			batch, _ := testAllocator.ResetMaybeReallocateWithMaxCapacity(
+				typs, nil /* oldBatch */, coldata.BatchSize()/2, coldata.BatchSize(), maxBatchMemSize,
+			)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				batch, _ = testAllocator.ResetMaybeReallocateWithMaxCapacity(
+					typs, batch, coldata.BatchSize(), coldata.BatchSize(), maxBatchMemSize,
+				)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2024 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package colmem
+
+import (
+	"context"
+
+	"github.com/cockroachdb/cockroach/pkg/col/coldata"
+	"github.com/cockroachdb/cockroach/pkg/util/mon"
+	"github.com/cockroachdb/errors"
+	"github.com/cockroachdb/redact"
+)
+
+// NewAllocatorWithName constructs a new Allocator that uses its own memory
+// account bound to a new monitor named after the operator (e.g.
+// "hashjoin.build.4") which is a child of parentMonitor. This makes the usage
+// of the operator identifiable in the monitor tree, and the memory errors
+// returned or thrown by the allocator (and by its child allocators) are
+// annotated with the name, which allows identifying the culprit operator
+// directly from the error message.
+//
+// The extra monitor adds some overhead (every reservation has to go through
+// one more level of the monitor tree), so this constructor is opt-in and
+// should only be used when the attribution is desired. The caller is
+// responsible for calling Close once it is done with the allocator.
+func NewAllocatorWithName(
+	ctx context.Context, parentMonitor *mon.BytesMonitor, factory coldata.ColumnFactory, name string,
+) *Allocator {
+	monitorName := redact.Sprint(redact.SafeString(name))
+	m := mon.NewMonitorInheritWithLimit(monitorName, 0 /* limit */, parentMonitor, false /* longLiving */)
+	m.StartNoReserved(ctx, parentMonitor)
+	acc := m.MakeBoundAccount()
+	a := NewAllocator(ctx, &acc, factory)
+	a.name = monitorName
+	a.ownedMonitor = m
+	return a
+}
+
+// annotateAccountError annotates the error that occurred when growing the
+// memory account with the name of the allocator, if set (see
+// NewAllocatorWithName).
+func (a *Allocator) annotateAccountError(err error) error {
+	if a.name == "" {
+		return err
+	}
+	return errors.Wrapf(err, "%s", a.name)
+}
+
+// Close releases all of the reservations from the allocator, closes its memory
+// account, and stops its monitor if the allocator was created via
+// NewAllocatorWithName. For all other allocators (whose memory accounts are
+// owned by the caller), it only flushes the pending changes of the buffered
+// accounting mode.
+func (a *Allocator) Close() {
+	if a.ownedMonitor == nil {
+		a.tryFlush()
+		return
+	}
+	a.ReleaseAll()
+	a.acc.Close(a.ctx)
+	a.ownedMonitor.Stop(a.ctx)
+	a.ownedMonitor = nil
+}
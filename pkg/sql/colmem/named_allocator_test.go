@@ -0,0 +1,77 @@
+// Copyright 2024 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package colmem_test
+
+import (
+	"context"
+	"math"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/col/coldataext"
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/colexecerror"
+	"github.com/cockroachdb/cockroach/pkg/sql/colmem"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/eval"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlerrors"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/mon"
+	"github.com/stretchr/testify/require"
+)
+
+// TestNamedAllocator verifies that the allocator created via
+// NewAllocatorWithName registers its usage with its own monitor and that the
+// memory errors identify the operator.
+func TestNamedAllocator(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	st := cluster.MakeTestingClusterSettings()
+	const limit = 1000
+	parentMonitor := mon.NewMonitor(mon.Options{
+		Name:      "test-mem",
+		Limit:     limit,
+		Increment: 1,
+		Settings:  st,
+	})
+	parentMonitor.Start(ctx, nil, mon.NewStandaloneBudget(math.MaxInt64))
+	defer parentMonitor.Stop(ctx)
+	evalCtx := eval.MakeTestingEvalContext(st)
+	const name = "hashjoin.build.4"
+	testAllocator := colmem.NewAllocatorWithName(ctx, parentMonitor, coldataext.NewExtendedColumnFactory(&evalCtx), name)
+
+	// The usage is registered with the parent monitor.
+	testAllocator.AdjustMemoryUsage(limit / 2)
+	require.Equal(t, int64(limit/2), parentMonitor.AllocBytes())
+
+	// The budget error is annotated with the name of the operator.
+	err := colexecerror.CatchVectorizedRuntimeError(func() {
+		testAllocator.AdjustMemoryUsage(limit)
+	})
+	require.True(t, sqlerrors.IsOutOfMemoryError(err), "%v", err)
+	require.Contains(t, err.Error(), name)
+
+	// So are the errors of the child allocators.
+	child := testAllocator.NewChildAllocator("child", math.MaxInt64)
+	err = colexecerror.CatchVectorizedRuntimeError(func() {
+		child.AdjustMemoryUsage(limit)
+	})
+	require.True(t, sqlerrors.IsOutOfMemoryError(err), "%v", err)
+	require.Contains(t, err.Error(), name)
+	child.AdjustMemoryUsage(limit / 4)
+
+	// Close releases everything, including the usage of the children.
+	testAllocator.Close()
+	require.Zero(t, parentMonitor.AllocBytes())
+	// Closing again is a noop.
+	testAllocator.Close()
+}
@@ -0,0 +1,142 @@
+// Copyright 2024 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package colmem
+
+import (
+	"context"
+
+	"github.com/cockroachdb/cockroach/pkg/col/coldata"
+	"github.com/cockroachdb/cockroach/pkg/util/mon"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/cockroachdb/errors"
+	"github.com/cockroachdb/redact"
+)
+
+// QuotaAcquisitionMode determines what happens when the QuotaPool doesn't have
+// enough quota to satisfy the request.
+type QuotaAcquisitionMode int8
+
+const (
+	// QuotaAcquisitionError indicates that the memory budget exceeded error is
+	// returned right away (so that, for example, the disk-backed operators
+	// spill to disk).
+	QuotaAcquisitionError QuotaAcquisitionMode = iota
+	// QuotaAcquisitionBlock indicates that the request blocks until the other
+	// allocators release enough quota (or until the context of the allocator
+	// is canceled). Note that if all allocators sharing the pool block, then
+	// they will block forever, so this mode should only be used when at least
+	// one of the allocators is guaranteed to make progress.
+	QuotaAcquisitionBlock
+)
+
+// QuotaPool enforces the cap on the total memory usage of multiple allocators
+// (e.g. of all allocators of a single vectorized flow). Unlike the monitor
+// shared by the allocators, the quota is acquired by each allocator before it
+// grows its memory account and is returned only once the memory is released,
+// so the total usage registered through the allocators sharing the pool never
+// exceeds the cap, regardless of the order in which they ask for memory.
+//
+// QuotaPool is safe for concurrent use.
+type QuotaPool struct {
+	name     redact.RedactableString
+	capacity int64
+	mode     QuotaAcquisitionMode
+	mu       struct {
+		syncutil.Mutex
+		used int64
+		// released, if non-nil, is closed whenever some quota is released in
+		// order to wake up the blocked requests.
+		released chan struct{}
+	}
+}
+
+// NewQuotaPool returns a new QuotaPool with the given capacity in bytes.
+func NewQuotaPool(name string, capacity int64, mode QuotaAcquisitionMode) *QuotaPool {
+	return &QuotaPool{
+		name:     redact.Sprint(redact.SafeString(name)),
+		capacity: capacity,
+		mode:     mode,
+	}
+}
+
+// Capacity returns the capacity of the pool in bytes.
+func (p *QuotaPool) Capacity() int64 {
+	return p.capacity
+}
+
+// Used returns the number of bytes of quota currently acquired from the pool.
+func (p *QuotaPool) Used() int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.mu.used
+}
+
+// acquire acquires n bytes of quota from the pool. Depending on the mode of the
+// pool, it either returns the memory budget exceeded error right away or
+// blocks until enough quota is released if the pool doesn't have n bytes
+// available. The requests exceeding the capacity are never satisfied.
+func (p *QuotaPool) acquire(ctx context.Context, n int64) error {
+	for {
+		p.mu.Lock()
+		if p.mu.used+n <= p.capacity {
+			p.mu.used += n
+			p.mu.Unlock()
+			return nil
+		}
+		if p.mode != QuotaAcquisitionBlock || n > p.capacity {
+			used := p.mu.used
+			p.mu.Unlock()
+			return errors.Wrapf(
+				mon.NewMemoryBudgetExceededError(n, used, p.capacity), "quota pool %s", p.name,
+			)
+		}
+		if p.mu.released == nil {
+			p.mu.released = make(chan struct{})
+		}
+		released := p.mu.released
+		p.mu.Unlock()
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// release returns n bytes of quota to the pool.
+func (p *QuotaPool) release(n int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.mu.used -= n
+	if p.mu.used < 0 {
+		p.mu.used = 0
+	}
+	if p.mu.released != nil {
+		close(p.mu.released)
+		p.mu.released = nil
+	}
+}
+
+// NewAllocatorWithQuota constructs a new Allocator that acquires the quota from
+// the given pool before growing its memory account and returns the quota when
+// the memory is released. The pool is typically shared by multiple allocators
+// (which can use different memory accounts), and the child allocators of the
+// returned allocator use the same pool.
+//
+// With QuotaAcquisitionBlock mode of the pool, the methods of the allocator
+// that grow the memory account might block.
+func NewAllocatorWithQuota(
+	ctx context.Context, acc *mon.BoundAccount, factory coldata.ColumnFactory, quota *QuotaPool,
+) *Allocator {
+	a := NewAllocator(ctx, acc, factory)
+	a.quota = quota
+	return a
+}
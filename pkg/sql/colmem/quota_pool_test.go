@@ -0,0 +1,165 @@
+// Copyright 2024 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package colmem_test
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/col/coldataext"
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/colexecerror"
+	"github.com/cockroachdb/cockroach/pkg/sql/colmem"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/eval"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlerrors"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/mon"
+	"github.com/cockroachdb/cockroach/pkg/util/randutil"
+	"github.com/stretchr/testify/require"
+)
+
+// TestQuotaPool verifies that the total memory usage of multiple allocators
+// sharing a QuotaPool never exceeds the capacity of the pool when they grow
+// and release their accounts concurrently.
+func TestQuotaPool(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	st := cluster.MakeTestingClusterSettings()
+	evalCtx := eval.MakeTestingEvalContext(st)
+	factory := coldataext.NewExtendedColumnFactory(&evalCtx)
+	rng, _ := randutil.NewTestRand()
+
+	const (
+		capacity      = 1000
+		numAllocators = 8
+		numOps        = 200
+	)
+	for _, mode := range []colmem.QuotaAcquisitionMode{
+		colmem.QuotaAcquisitionError, colmem.QuotaAcquisitionBlock,
+	} {
+		t.Run(fmt.Sprintf("block=%t", mode == colmem.QuotaAcquisitionBlock), func(t *testing.T) {
+			// Use increment of 1 so that no allocations are "reserved".
+			monitor := mon.NewMonitor(mon.Options{
+				Name:      "test-mem",
+				Increment: 1,
+				Settings:  st,
+			})
+			monitor.Start(ctx, nil, mon.NewStandaloneBudget(math.MaxInt64))
+			defer monitor.Stop(ctx)
+			quota := colmem.NewQuotaPool("test-quota", capacity, mode)
+
+			// The requests exceeding the capacity are rejected right away
+			// regardless of the mode.
+			acc := monitor.MakeBoundAccount()
+			a := colmem.NewAllocatorWithQuota(ctx, &acc, factory, quota)
+			err := colexecerror.CatchVectorizedRuntimeError(func() {
+				a.AdjustMemoryUsage(capacity + 1)
+			})
+			require.True(t, sqlerrors.IsOutOfMemoryError(err), "%v", err)
+			require.Zero(t, quota.Used())
+			require.Zero(t, monitor.AllocBytes())
+
+			var wg sync.WaitGroup
+			errCh := make(chan error, numAllocators)
+			for i := 0; i < numAllocators; i++ {
+				seed := rng.Int63()
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					errCh <- func() error {
+						rng := randutil.NewTestRandWithSeed(seed)
+						acc := monitor.MakeBoundAccount()
+						defer acc.Close(ctx)
+						a := colmem.NewAllocatorWithQuota(ctx, &acc, factory, quota)
+						var held []int64
+						for op := 0; op < numOps; op++ {
+							// In the blocking mode, at most one chunk is held at
+							// a time so that the blocked allocator doesn't
+							// prevent others from making progress.
+							if len(held) > 0 && (mode == colmem.QuotaAcquisitionBlock || rng.Intn(2) == 0) {
+								idx := rng.Intn(len(held))
+								a.ReleaseMemory(held[idx])
+								held = append(held[:idx], held[idx+1:]...)
+								continue
+							}
+							size := int64(rng.Intn(capacity/2)) + 1
+							if err := colexecerror.CatchVectorizedRuntimeError(func() {
+								a.AdjustMemoryUsage(size)
+							}); err != nil {
+								if mode == colmem.QuotaAcquisitionBlock || !sqlerrors.IsOutOfMemoryError(err) {
+									return err
+								}
+								continue
+							}
+							held = append(held, size)
+							if used := monitor.AllocBytes(); used > capacity {
+								return fmt.Errorf("%d bytes accounted for exceed the quota of %d", used, capacity)
+							}
+							if used := quota.Used(); used > capacity {
+								return fmt.Errorf("%d bytes of quota acquired exceed the capacity %d",
+									used, capacity)
+							}
+						}
+						a.ReleaseAll()
+						return nil
+					}()
+				}()
+			}
+			wg.Wait()
+			close(errCh)
+			for err := range errCh {
+				require.NoError(t, err)
+			}
+			require.Zero(t, quota.Used())
+			require.Zero(t, monitor.AllocBytes())
+		})
+	}
+}
+
+// TestQuotaPoolBlockingCanceled verifies that the blocked quota acquisition is
+// unblocked by the cancellation of the allocator's context.
+func TestQuotaPoolBlockingCanceled(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	st := cluster.MakeTestingClusterSettings()
+	evalCtx := eval.MakeTestingEvalContext(st)
+	factory := coldataext.NewExtendedColumnFactory(&evalCtx)
+	quota := colmem.NewQuotaPool("test-quota", 100 /* capacity */, colmem.QuotaAcquisitionBlock)
+
+	holder := colmem.NewAllocatorWithQuota(context.Background(), nil /* acc */, factory, quota)
+	holder.AdjustMemoryUsage(100)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	waiter := colmem.NewAllocatorWithQuota(ctx, nil /* acc */, factory, quota)
+	errCh := make(chan error)
+	go func() {
+		errCh <- colexecerror.CatchVectorizedRuntimeError(func() {
+			waiter.AdjustMemoryUsage(1)
+		})
+	}()
+	cancel()
+	require.ErrorIs(t, <-errCh, context.Canceled)
+	require.Equal(t, int64(100), quota.Used())
+
+	// Releasing the memory returns the quota.
+	holder.ReleaseMemory(100)
+	require.Zero(t, quota.Used())
+	waiter = colmem.NewAllocatorWithQuota(context.Background(), nil /* acc */, factory, quota)
+	waiter.AdjustMemoryUsage(1)
+	require.Equal(t, int64(1), quota.Used())
+}
@@ -11,19 +11,29 @@
 package colmem
 
 import (
+	"bytes"
 	"context"
 	"math"
+	"strings"
 	"testing"
+	"time"
+	"unsafe"
 
+	"github.com/cockroachdb/apd/v3"
 	"github.com/cockroachdb/cockroach/pkg/col/coldata"
 	"github.com/cockroachdb/cockroach/pkg/col/coldataext"
 	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/colexecerror"
 	"github.com/cockroachdb/cockroach/pkg/sql/execinfra"
+	"github.com/cockroachdb/cockroach/pkg/sql/memsize"
 	"github.com/cockroachdb/cockroach/pkg/sql/sem/eval"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlerrors"
 	"github.com/cockroachdb/cockroach/pkg/sql/types"
 	"github.com/cockroachdb/cockroach/pkg/testutils/skip"
+	"github.com/cockroachdb/cockroach/pkg/util/duration"
 	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
 	"github.com/stretchr/testify/require"
 )
 
@@ -113,4 +123,478 @@ func TestResetMaybeReallocate(t *testing.T) {
 			require.Equal(t, 2*minDesiredCapacity, b.Capacity())
 		}
 	})
+
+	t.Run("MaxCapacity", func(t *testing.T) {
+		if coldata.BatchSize() < 64 {
+			skip.IgnoreLint(t, "the test assumes coldata.BatchSize() is at least 64")
+		}
+
+		const maxCapacity = 16
+		var b coldata.Batch
+		var reallocated bool
+		typs := []*types.T{types.Int}
+
+		// minDesiredCapacity exceeding the max capacity is clamped.
+		b, reallocated = testAllocator.ResetMaybeReallocateWithMaxCapacity(typs, b, 100 /* minDesiredCapacity */, maxCapacity, math.MaxInt64)
+		require.True(t, reallocated)
+		require.Equal(t, maxCapacity, b.Capacity())
+		// The batch of the max capacity is reused.
+		oldBatch := b
+		b, reallocated = testAllocator.ResetMaybeReallocateWithMaxCapacity(typs, b, 100 /* minDesiredCapacity */, maxCapacity, math.MaxInt64)
+		require.False(t, reallocated)
+		require.Equal(t, oldBatch, b)
+
+		// The doubling doesn't exceed the max capacity.
+		b = testAllocator.NewMemBatchWithFixedCapacity(typs, 10)
+		b, reallocated = testAllocator.ResetMaybeReallocateWithMaxCapacity(typs, b, 1 /* minDesiredCapacity */, maxCapacity, math.MaxInt64)
+		require.True(t, reallocated)
+		require.Equal(t, maxCapacity, b.Capacity())
+
+		// The old batch that already exceeds the max capacity is reused rather
+		// than reallocated with smaller capacity.
+		oldBatch = testAllocator.NewMemBatchWithFixedCapacity(typs, 50)
+		b, reallocated = testAllocator.ResetMaybeReallocateWithMaxCapacity(typs, oldBatch, 1 /* minDesiredCapacity */, maxCapacity, math.MaxInt64)
+		require.False(t, reallocated)
+		require.Equal(t, oldBatch, b)
+		require.Equal(t, 50, b.Capacity())
+
+		// The max capacity is capped at coldata.BatchSize().
+		b, reallocated = testAllocator.ResetMaybeReallocateWithMaxCapacity(typs, nil /* oldBatch */, coldata.BatchSize()+1 /* minDesiredCapacity */, coldata.BatchSize()+1 /* maxCapacity */, math.MaxInt64)
+		require.True(t, reallocated)
+		require.Equal(t, coldata.BatchSize(), b.Capacity())
+	})
+
+	t.Run("GrowthFactor", func(t *testing.T) {
+		if coldata.BatchSize() < 150 {
+			skip.IgnoreLint(t, "the test assumes coldata.BatchSize() is at least 150")
+		}
+
+		// Factors that don't grow the capacity are rejected.
+		for _, factor := range []float64{-1, 0.5, 1} {
+			require.Error(t, colexecerror.CatchVectorizedRuntimeError(func() {
+				testAllocator.SetGrowthPolicy(GrowthPolicy{Factor: factor})
+			}))
+		}
+		testAllocator.SetGrowthPolicy(GrowthPolicy{Factor: 1.5})
+		defer testAllocator.SetGrowthPolicy(GrowthPolicy{})
+
+		var b coldata.Batch
+		var reason ReallocReason
+		typs := []*types.T{types.Int}
+		// The capacity grows by at least one when multiplying by the factor
+		// doesn't increase it.
+		for _, expected := range []int{1, 2, 3, 4, 6, 9, 13, 19, 28} {
+			expectedReason := ReallocCapacityTooSmall
+			if b == nil {
+				expectedReason = ReallocNoOldBatch
+			}
+			b, reason, _ = testAllocator.resetMaybeReallocate(typs, b, 1 /* minDesiredCapacity */, coldata.BatchSize(), math.MaxInt64, false /* desiredCapacitySufficient */, false /* alwaysReallocate */)
+			require.Equal(t, expectedReason, reason)
+			require.Equal(t, expected, b.Capacity())
+		}
+
+		// The memory limit still applies after the growth factor: the capacity
+		// of 100 would grow to 150, but only 120 fit within the limit.
+		b = testAllocator.NewMemBatchWithFixedCapacity(typs, 100)
+		maxBatchMemSize := SelVectorSize(120) + EstimateBatchSizeBytes(typs, 120)
+		b, reason, _ = testAllocator.resetMaybeReallocate(typs, b, 1 /* minDesiredCapacity */, coldata.BatchSize(), maxBatchMemSize, false /* desiredCapacitySufficient */, false /* alwaysReallocate */)
+		require.Equal(t, ReallocCapacityTooSmall, reason)
+		require.Equal(t, 120, b.Capacity())
+	})
+
+	t.Run("ExactGrowth", func(t *testing.T) {
+		if coldata.BatchSize() < 100 {
+			skip.IgnoreLint(t, "the test assumes coldata.BatchSize() is at least 100")
+		}
+
+		testAllocator.SetGrowthPolicy(GrowthPolicy{Kind: ExactGrowth})
+		defer testAllocator.SetGrowthPolicy(GrowthPolicy{})
+
+		var b coldata.Batch
+		var reason ReallocReason
+		var reallocated bool
+		typs := []*types.T{types.Int}
+		b, reason, _ = testAllocator.resetMaybeReallocate(typs, b, 10 /* minDesiredCapacity */, coldata.BatchSize(), math.MaxInt64, false /* desiredCapacitySufficient */, false /* alwaysReallocate */)
+		require.Equal(t, ReallocNoOldBatch, reason)
+		require.Equal(t, 10, b.Capacity())
+
+		// The old batch is reused when it has enough capacity, even though the
+		// desired capacity is not sufficient.
+		oldBatch := b
+		b, reason, _ = testAllocator.resetMaybeReallocate(typs, b, 5 /* minDesiredCapacity */, coldata.BatchSize(), math.MaxInt64, false /* desiredCapacitySufficient */, false /* alwaysReallocate */)
+		require.Equal(t, ReuseCapacitySufficient, reason)
+		require.Equal(t, oldBatch, b)
+
+		// The capacity grows exactly to the desired one (rather than doubling
+		// to 20).
+		b, reason, _ = testAllocator.resetMaybeReallocate(typs, b, 17 /* minDesiredCapacity */, coldata.BatchSize(), math.MaxInt64, false /* desiredCapacitySufficient */, false /* alwaysReallocate */)
+		require.Equal(t, ReallocCapacityTooSmall, reason)
+		require.Equal(t, 17, b.Capacity())
+
+		// The memory limit still applies after the exact growth.
+		maxBatchMemSize := SelVectorSize(50) + EstimateBatchSizeBytes(typs, 50)
+		b, reason, _ = testAllocator.resetMaybeReallocate(typs, b, 100 /* minDesiredCapacity */, coldata.BatchSize(), maxBatchMemSize, false /* desiredCapacitySufficient */, false /* alwaysReallocate */)
+		require.Equal(t, ReallocCapacityTooSmall, reason)
+		require.Equal(t, 50, b.Capacity())
+
+		// The desired capacity is truncated at coldata.BatchSize().
+		b, reason, _ = testAllocator.resetMaybeReallocate(typs, b, coldata.BatchSize()+100 /* minDesiredCapacity */, coldata.BatchSize(), math.MaxInt64, false /* desiredCapacitySufficient */, false /* alwaysReallocate */)
+		require.Equal(t, ReallocCapacityTooSmall, reason)
+		require.Equal(t, coldata.BatchSize(), b.Capacity())
+		b, reallocated = testAllocator.ResetMaybeReallocateNoMemLimit(typs, b, coldata.BatchSize()+100 /* requiredCapacity */)
+		require.False(t, reallocated)
+		require.Equal(t, coldata.BatchSize(), b.Capacity())
+	})
+
+	t.Run("AdaptiveBytesEstimation", func(t *testing.T) {
+		if coldata.BatchSize() < 32 {
+			skip.IgnoreLint(t, "the test assumes coldata.BatchSize() is at least 32")
+		}
+
+		typs := []*types.T{types.Bytes}
+		const capacity = 16
+		const largeValueSize = 10 << 10
+		// The memory limit fits 24 large values, but with the static estimate
+		// the batch of double capacity appears to fit easily.
+		maxBatchMemSize := SelVectorSize(24) + EstimateBatchSizeBytes(typs, 24) + 24*largeValueSize
+		require.Less(t, SelVectorSize(2*capacity)+EstimateBatchSizeBytes(typs, 2*capacity), maxBatchMemSize)
+
+		// getGrownCapacity fills the batch of the given capacity with values
+		// of the given size a few times and then returns the capacity that
+		// the batch is grown to.
+		getGrownCapacity := func(allocator *Allocator, valueSize int) int {
+			v := make([]byte, valueSize)
+			b := allocator.NewMemBatchWithFixedCapacity(typs, capacity)
+			for i := 0; i < 5; i++ {
+				var reason ReallocReason
+				b, reason, _ = allocator.resetMaybeReallocate(typs, b, capacity, coldata.BatchSize(), maxBatchMemSize, true /* desiredCapacitySufficient */, false /* alwaysReallocate */)
+				require.Equal(t, ReuseCapacitySufficient, reason)
+				allocator.PerformOperation(b.ColVecs(), func() {
+					for j := 0; j < capacity; j++ {
+						b.ColVec(0).Bytes().Set(j, v)
+					}
+					b.SetLength(capacity)
+				})
+			}
+			b, _, _ = allocator.resetMaybeReallocate(typs, b, 1 /* minDesiredCapacity */, coldata.BatchSize(), maxBatchMemSize, false /* desiredCapacitySufficient */, false /* alwaysReallocate */)
+			return b.Capacity()
+		}
+
+		// Even without the adaptive estimation, the measured footprint of the
+		// old batch prevents the growth beyond the memory limit.
+		grownCapacity := getGrownCapacity(testAllocator, largeValueSize)
+		require.Greater(t, grownCapacity, capacity)
+		require.LessOrEqual(t, grownCapacity, 24)
+
+		adaptiveAllocator := NewAllocator(ctx, &memAcc, testColumnFactory)
+		adaptiveAllocator.EnableAdaptiveBytesEstimation()
+		// The estimate starts out at the static default.
+		require.Equal(t, float64(coldata.ElementSize), adaptiveAllocator.bytesEstimate.perRow)
+		// The small values are inlined, so the estimate stays the same, and
+		// the capacity is doubled.
+		require.Equal(t, 2*capacity, getGrownCapacity(adaptiveAllocator, 1 /* valueSize */))
+		require.Equal(t, float64(coldata.ElementSize), adaptiveAllocator.bytesEstimate.perRow)
+
+		adaptiveAllocator = NewAllocator(ctx, &memAcc, testColumnFactory)
+		adaptiveAllocator.EnableAdaptiveBytesEstimation()
+		// The large values are taken into account, so the batch doesn't grow
+		// beyond what fits within the memory limit.
+		grownCapacity = getGrownCapacity(adaptiveAllocator, largeValueSize)
+		require.Greater(t, adaptiveAllocator.bytesEstimate.perRow, float64(largeValueSize/2))
+		require.Greater(t, grownCapacity, capacity)
+		require.LessOrEqual(t, grownCapacity, 24)
+	})
+
+	t.Run("MeasuredFootprint", func(t *testing.T) {
+		if coldata.BatchSize() < 32 {
+			skip.IgnoreLint(t, "the test assumes coldata.BatchSize() is at least 32")
+		}
+
+		// Use a separate account so that the usage of the allocator is only
+		// due to this test.
+		memAcc := testMemMonitor.MakeBoundAccount()
+		defer memAcc.Close(ctx)
+		allocator := NewAllocator(ctx, &memAcc, testColumnFactory)
+		typs := []*types.T{types.Bytes}
+		const capacity = 16
+		const largeValueSize = 10 << 10
+		// maxBatchMemSizeFor returns the memory limit that fits the batch of
+		// the given capacity with large values.
+		maxBatchMemSizeFor := func(capacity int) int64 {
+			return SelVectorSize(capacity) + EstimateBatchSizeBytes(typs, capacity) + int64(capacity*largeValueSize)
+		}
+		// getGrownBatch fills the batch of capacity 16 with values of the given
+		// size and then returns the batch that it is grown into.
+		getGrownBatch := func(valueSize int, maxBatchMemSize int64) (_ coldata.Batch, reason ReallocReason) {
+			// The static estimate says that the batch of double capacity
+			// fits within the limit easily.
+			require.Less(t, SelVectorSize(2*capacity)+EstimateBatchSizeBytes(typs, 2*capacity), maxBatchMemSize)
+			v := make([]byte, valueSize)
+			b := allocator.NewMemBatchWithFixedCapacity(typs, capacity)
+			allocator.PerformOperation(b.ColVecs(), func() {
+				for j := 0; j < capacity; j++ {
+					b.ColVec(0).Bytes().Set(j, v)
+				}
+				b.SetLength(capacity)
+			})
+			b, reason, _ = allocator.resetMaybeReallocate(typs, b, 1 /* minDesiredCapacity */, coldata.BatchSize(), maxBatchMemSize, false /* desiredCapacitySufficient */, false /* alwaysReallocate */)
+			return b, reason
+		}
+
+		// The small values are inlined, so the capacity is doubled.
+		b, reason := getGrownBatch(1 /* valueSize */, maxBatchMemSizeFor(20))
+		require.Equal(t, ReallocCapacityTooSmall, reason)
+		require.Equal(t, 2*capacity, b.Capacity())
+		require.Equal(t, allocator.getBatchMemSize(b), allocator.Used())
+		allocator.ReleaseAll()
+
+		// The large values take up most of the limit, so the capacity grows
+		// only to what fits according to the measured footprint, and the
+		// footprint of the old batch is fully released.
+		b, reason = getGrownBatch(largeValueSize, maxBatchMemSizeFor(20))
+		require.Equal(t, ReallocCapacityTooSmall, reason)
+		require.Greater(t, b.Capacity(), capacity)
+		require.LessOrEqual(t, b.Capacity(), 20)
+		require.Equal(t, allocator.getBatchMemSize(b), allocator.Used())
+		allocator.ReleaseAll()
+
+		// The large values almost reach the limit, so the old batch is reused.
+		b, reason = getGrownBatch(largeValueSize, maxBatchMemSizeFor(17))
+		require.Equal(t, ReuseMemoryLimitReached, reason)
+		require.Equal(t, capacity, b.Capacity())
+		allocator.ReleaseAll()
+	})
+
+	t.Run("ShrinkOvergrownBytes", func(t *testing.T) {
+		if coldata.BatchSize() < 16 {
+			skip.IgnoreLint(t, "the test assumes coldata.BatchSize() is at least 16")
+		}
+
+		memAcc := testMemMonitor.MakeBoundAccount()
+		defer memAcc.Close(ctx)
+		allocator := NewAllocator(ctx, &memAcc, testColumnFactory)
+		typs := []*types.T{types.Bytes}
+		const capacity = 16
+		const largeValueSize = 10 << 10
+		staticSize := SelVectorSize(capacity) + EstimateBatchSizeBytes(typs, capacity)
+		// fillAndReset fills the batch with values of the given size and then
+		// resets it.
+		fillAndReset := func(b coldata.Batch, valueSize int) (_ coldata.Batch, reallocated bool) {
+			v := make([]byte, valueSize)
+			allocator.PerformOperation(b.ColVecs(), func() {
+				for j := 0; j < capacity; j++ {
+					b.ColVec(0).Bytes().Set(j, v)
+				}
+				b.SetLength(capacity)
+			})
+			return allocator.ResetMaybeReallocateNoMemLimit(typs, b, capacity)
+		}
+
+		// The batch with genuinely large values is never replaced.
+		b := allocator.NewMemBatchWithFixedCapacity(typs, capacity)
+		for i := 0; i < 2*bytesShrinkNumResets; i++ {
+			var reallocated bool
+			b, reallocated = fillAndReset(b, largeValueSize)
+			require.False(t, reallocated)
+		}
+		require.Greater(t, allocator.Used(), int64(capacity*largeValueSize))
+
+		// Neither is the batch that occasionally holds small values.
+		for i := 0; i < 2*bytesShrinkNumResets; i++ {
+			valueSize := largeValueSize
+			if i%bytesShrinkNumResets != 0 {
+				valueSize = 1
+			}
+			var reallocated bool
+			b, reallocated = fillAndReset(b, valueSize)
+			require.False(t, reallocated)
+		}
+
+		// After the burst of the large values is followed by enough batches of
+		// small values, the batch is replaced with a new one of the same
+		// capacity, and its over-grown buffer is released.
+		b, _ = fillAndReset(b, largeValueSize)
+		for i := 1; i < bytesShrinkNumResets; i++ {
+			var reallocated bool
+			b, reallocated = fillAndReset(b, 1 /* valueSize */)
+			require.False(t, reallocated)
+			require.Greater(t, allocator.Used(), int64(capacity*largeValueSize))
+		}
+		b, reallocated := fillAndReset(b, 1 /* valueSize */)
+		require.True(t, reallocated)
+		require.Equal(t, int64(1), allocator.Stats().NumResetsByReason[ReallocOvergrownBytes])
+		require.Equal(t, capacity, b.Capacity())
+		require.Equal(t, staticSize, allocator.Used())
+
+		// The new batch isn't replaced while it stays small.
+		for i := 0; i < 2*bytesShrinkNumResets; i++ {
+			b, reallocated = fillAndReset(b, 1 /* valueSize */)
+			require.False(t, reallocated)
+		}
+		require.Equal(t, staticSize, allocator.Used())
+	})
+
+	t.Run("ValueSizeEstimation", func(t *testing.T) {
+		if coldata.BatchSize() < 16 {
+			skip.IgnoreLint(t, "the test assumes coldata.BatchSize() is at least 16")
+		}
+
+		memAcc := testMemMonitor.MakeBoundAccount()
+		defer memAcc.Close(ctx)
+		const capacity = 16
+		// getEstimateAndFootprint fills the batch of capacity 16 with values
+		// via setValues numRounds times (resetting the batch in-between, so
+		// that the adaptive estimates, if enabled, observe the values) and
+		// returns the estimated and the measured footprints of the batch.
+		getEstimateAndFootprint := func(
+			allocator *Allocator, typs []*types.T, numRounds int, setValues func(b coldata.Batch),
+		) (estimate, footprint int64) {
+			b := allocator.NewMemBatchWithFixedCapacity(typs, capacity)
+			for round := 0; round < numRounds; round++ {
+				if round > 0 {
+					b, _, _ = allocator.resetMaybeReallocate(typs, b, capacity, capacity, math.MaxInt64, true /* desiredCapacitySufficient */, false /* alwaysReallocate */)
+				}
+				allocator.PerformOperation(b.ColVecs(), func() {
+					setValues(b)
+					b.SetLength(capacity)
+				})
+			}
+			estimate = SelVectorSize(capacity) + allocator.estimateBatchSizeBytes(typs, capacity)
+			footprint = allocator.getBatchMemSize(b)
+			require.Equal(t, footprint, allocator.Used())
+			allocator.ReleaseAll()
+			return estimate, footprint
+		}
+
+		t.Run("TimestampAndInterval", func(t *testing.T) {
+			// The timestamps and the intervals are estimated with the exact
+			// sizes of their structs.
+			require.Equal(t, int64(unsafe.Sizeof(time.Time{})), GetFixedSizeTypeSize(types.TimestampTZ))
+			require.Equal(t, int64(unsafe.Sizeof(duration.Duration{})), GetFixedSizeTypeSize(types.Interval))
+			allocator := NewAllocator(ctx, &memAcc, testColumnFactory)
+			typs := []*types.T{types.TimestampTZ, types.Interval}
+			estimate, footprint := getEstimateAndFootprint(allocator, typs, 1 /* numRounds */, func(b coldata.Batch) {
+				for j := 0; j < capacity; j++ {
+					b.ColVec(0).Timestamp()[j] = timeutil.Unix(int64(j), 0 /* nsecs */)
+				}
+			})
+			require.Equal(t, footprint, estimate)
+		})
+
+		t.Run("Decimal", func(t *testing.T) {
+			// The coefficient of this decimal doesn't fit inline, so it
+			// occupies some additional space.
+			largeDecimal, _, err := apd.NewFromString(strings.Repeat("9", 100))
+			require.NoError(t, err)
+			var d apd.Decimal
+			d.Set(largeDecimal)
+			decimalSize := int64(d.Size())
+			require.Greater(t, decimalSize, memsize.Decimal)
+			typs := []*types.T{types.Decimal}
+			setValues := func(b coldata.Batch) {
+				for j := 0; j < capacity; j++ {
+					b.ColVec(0).Decimal()[j].Set(largeDecimal)
+				}
+			}
+
+			// The static estimate only includes the flat struct size.
+			allocator := NewAllocator(ctx, &memAcc, testColumnFactory)
+			estimate, footprint := getEstimateAndFootprint(allocator, typs, 1 /* numRounds */, setValues)
+			require.Less(t, estimate, footprint)
+
+			// The configured average is used as is.
+			allocator = NewAllocator(ctx, &memAcc, testColumnFactory)
+			allocator.SetDecimalSizeEstimate(decimalSize)
+			estimate, footprint = getEstimateAndFootprint(allocator, typs, 1 /* numRounds */, setValues)
+			require.Equal(t, footprint, estimate)
+
+			// The adaptive estimate converges to the observed footprint.
+			allocator = NewAllocator(ctx, &memAcc, testColumnFactory)
+			allocator.EnableAdaptiveBytesEstimation()
+			estimate, footprint = getEstimateAndFootprint(allocator, typs, 8 /* numRounds */, setValues)
+			require.InEpsilon(t, footprint, estimate, 0.01)
+		})
+
+		t.Run("Enum", func(t *testing.T) {
+			longRep := bytes.Repeat([]byte{0x80}, 2*coldata.BytesMaxInlineLength)
+			enumType := types.MakeEnum(152100, 154180)
+			enumType.TypeMeta = types.UserDefinedTypeMetadata{
+				EnumData: &types.EnumMetadata{
+					LogicalRepresentations:  []string{"short", "long"},
+					PhysicalRepresentations: [][]byte{{0x40}, longRep},
+					IsMemberReadOnly:        make([]bool, 2),
+				},
+			}
+			// Use both members equally often.
+			typs := []*types.T{enumType}
+			setValues := func(b coldata.Batch) {
+				for j := 0; j < capacity; j++ {
+					b.ColVec(0).Bytes().Set(j, enumType.TypeMeta.EnumData.PhysicalRepresentations[j%2])
+				}
+			}
+			allocator := NewAllocator(ctx, &memAcc, testColumnFactory)
+			allocator.EnableAdaptiveBytesEstimation()
+			estimate, footprint := getEstimateAndFootprint(allocator, typs, 4 /* numRounds */, setValues)
+			// The estimate includes the average non-inlined representation
+			// while the buffer of the Bytes vector might have some extra
+			// capacity.
+			require.Greater(t, estimate, EstimateBatchSizeBytes(typs, capacity)+SelVectorSize(capacity))
+			require.LessOrEqual(t, estimate, footprint)
+			require.InEpsilon(t, footprint, estimate, 0.1)
+			// The enums don't affect the adaptive estimate of the other
+			// bytes-like values.
+			require.Equal(t, float64(coldata.ElementSize), allocator.bytesEstimate.perRow)
+		})
+	})
+
+	t.Run("InjectedErrors", func(t *testing.T) {
+		if coldata.BatchSize() < 4 {
+			skip.IgnoreLint(t, "the test assumes coldata.BatchSize() is at least 4")
+		}
+
+		// Use a separate account so that the usage of the allocator is only
+		// due to this test.
+		memAcc := testMemMonitor.MakeBoundAccount()
+		defer memAcc.Close(ctx)
+		allocator := NewAllocator(ctx, &memAcc, testColumnFactory)
+		typs := []*types.T{types.Int}
+		resetMaybeReallocate := func(b coldata.Batch, capacity int) (coldata.Batch, error) {
+			err := colexecerror.CatchVectorizedRuntimeError(func() {
+				b, _ = allocator.ResetMaybeReallocateNoMemLimit(typs, b, capacity)
+			})
+			return b, err
+		}
+
+		// The second allocation is rejected.
+		allocator.TestingSetKnobs(TestingKnobs{FailOnGrowthNum: 2})
+		b, err := resetMaybeReallocate(nil /* b */, 2 /* capacity */)
+		require.NoError(t, err)
+		_, err = resetMaybeReallocate(b, 4 /* capacity */)
+		require.True(t, sqlerrors.IsOutOfMemoryError(err), "%v", err)
+		// The old batch has been released before the allocation was
+		// attempted.
+		require.Zero(t, allocator.Used())
+		b, err = resetMaybeReallocate(nil /* b */, 4 /* capacity */)
+		require.NoError(t, err)
+
+		// The allocations larger than a batch of capacity 4 are rejected.
+		allocator.TestingSetKnobs(TestingKnobs{FailOnGrowthIf: func(delta int64) bool {
+			return delta > SelVectorSize(4)+EstimateBatchSizeBytes(typs, 4)
+		}})
+		// The old batch is reused.
+		b, err = resetMaybeReallocate(b, 4 /* capacity */)
+		require.NoError(t, err)
+		require.Equal(t, 4, b.Capacity())
+		_, err = resetMaybeReallocate(b, coldata.BatchSize())
+		if coldata.BatchSize() > 4 {
+			require.True(t, sqlerrors.IsOutOfMemoryError(err), "%v", err)
+		} else {
+			require.NoError(t, err)
+		}
+
+		// Without the knobs the allocations succeed.
+		allocator.TestingSetKnobs(TestingKnobs{})
+		_, err = resetMaybeReallocate(nil /* b */, coldata.BatchSize())
+		require.NoError(t, err)
+	})
 }
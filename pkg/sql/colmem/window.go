@@ -0,0 +1,201 @@
+// Copyright 2024 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package colmem
+
+import (
+	"reflect"
+	"unsafe"
+
+	"github.com/cockroachdb/cockroach/pkg/col/coldata"
+	"github.com/cockroachdb/cockroach/pkg/sql/colexecerror"
+	"github.com/cockroachdb/cockroach/pkg/sql/types"
+	"github.com/cockroachdb/errors"
+)
+
+// getWindowVecMemoryFootprint returns the memory footprint of the window
+// vector that isn't shared with the vector the window was created over: the
+// Vec object itself, its nulls bitmap (which is always copied), and the
+// wrapper object of the bytes-like columns.
+func getWindowVecMemoryFootprint(vec *coldata.Vec) int64 {
+	if vec == nil {
+		return 0
+	}
+	size := VecOverhead + getNullsMemoryFootprint(vec)
+	switch vec.CanonicalTypeFamily() {
+	case types.BytesFamily:
+		size += int64(unsafe.Sizeof(coldata.Bytes{}))
+	case types.JsonFamily:
+		size += int64(unsafe.Sizeof(coldata.JSONs{}))
+	}
+	return size
+}
+
+// AccountForWindow registers the memory footprint of the window vectors of the
+// given batch, i.e. of the vectors created via coldata.Vec.Window over the
+// vectors of other batches that have already been accounted for. Only the
+// overhead of the window wrappers is accounted for since the data is shared
+// with the original vectors; the batch skeleton is expected to be accounted
+// for separately (e.g. via NewMemBatchNoCols).
+//
+// The method can be called again whenever the window vectors of the batch are
+// replaced, in which case only the difference with the previously registered
+// footprint is accounted for. The footprint is released via ReleaseWindow or
+// ReleaseBatch.
+//
+// Windows are read-only, so the window vectors must never be passed to
+// PerformOperation (which is asserted in test builds).
+func (a *Allocator) AccountForWindow(b coldata.Batch) {
+	if b == nil || b == coldata.ZeroBatch {
+		return
+	}
+	var size int64
+	for _, vec := range b.ColVecs() {
+		size += getWindowVecMemoryFootprint(vec)
+	}
+	a.lock()
+	prev := a.windows[b]
+	a.unlock()
+	if err := a.tryAdjustMemoryUsage(size-prev, false /* afterAllocation */); err != nil {
+		throwMemoryError(err)
+	}
+	a.lock()
+	defer a.unlock()
+	if a.windows == nil {
+		a.windows = make(map[coldata.Batch]int64)
+	}
+	a.windows[b] = size
+}
+
+// ReleaseWindow releases the footprint of the window vectors of the given
+// batch registered via AccountForWindow. It is a noop if the batch hasn't been
+// registered.
+func (a *Allocator) ReleaseWindow(b coldata.Batch) {
+	a.lock()
+	size, ok := a.windows[b]
+	delete(a.windows, b)
+	a.unlock()
+	if ok {
+		a.ReleaseMemory(size)
+	}
+}
+
+// isWindow returns whether the batch has been registered via AccountForWindow.
+func (a *Allocator) isWindow(b coldata.Batch) bool {
+	a.lock()
+	defer a.unlock()
+	_, ok := a.windows[b]
+	return ok
+}
+
+// memSpan is the range [start, end) of the memory addresses.
+type memSpan struct {
+	start, end uintptr
+}
+
+func (s memSpan) overlaps(o memSpan) bool {
+	return s.start < o.end && o.start < s.end
+}
+
+// appendSliceSpans appends the spans of the backing arrays of all slices
+// reachable from v without following the pointers (other than the one to the
+// column itself) to spans.
+func appendSliceSpans(spans []memSpan, v reflect.Value) []memSpan {
+	switch v.Kind() {
+	case reflect.Slice:
+		if v.Cap() > 0 {
+			start := v.Pointer()
+			spans = append(spans, memSpan{
+				start: start,
+				end:   start + uintptr(v.Cap())*v.Type().Elem().Size(),
+			})
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			spans = appendSliceSpans(spans, v.Field(i))
+		}
+	}
+	return spans
+}
+
+// getVecSpans returns the spans of the memory backing the column of the
+// vector.
+func getVecSpans(vec *coldata.Vec) []memSpan {
+	v := reflect.ValueOf(vec.Col())
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	return appendSliceSpans(nil, v)
+}
+
+// assertNoWindowAliasing throws an assertion failure if any of the vectors
+// about to be modified via PerformOperation is a window vector or aliases the
+// memory of the vectors of the batches already accounted for by this
+// allocator, which would result in double-counting. It must only be called in
+// test builds.
+func (a *Allocator) assertNoWindowAliasing(destVecs []*coldata.Vec) {
+	a.lock()
+	defer a.unlock()
+	if len(a.windows) == 0 && len(a.liveBatchStacks) == 0 {
+		return
+	}
+	for _, dest := range destVecs {
+		if dest == nil {
+			continue
+		}
+		for b := range a.windows {
+			for _, vec := range b.ColVecs() {
+				if vec == dest {
+					colexecerror.InternalError(errors.AssertionFailedf(
+						"window vector of type %s is modified via PerformOperation; windows are read-only",
+						dest.Type().SQLStringForError(),
+					))
+				}
+			}
+		}
+		owned := false
+		for b := range a.liveBatchStacks {
+			for _, vec := range b.ColVecs() {
+				if vec == dest {
+					owned = true
+					break
+				}
+			}
+		}
+		if owned {
+			continue
+		}
+		destSpans := getVecSpans(dest)
+		if len(destSpans) == 0 {
+			continue
+		}
+		for b := range a.liveBatchStacks {
+			if _, ok := a.windows[b]; ok {
+				continue
+			}
+			for _, vec := range b.ColVecs() {
+				for _, s := range getVecSpans(vec) {
+					for _, ds := range destSpans {
+						if s.overlaps(ds) {
+							colexecerror.InternalError(errors.AssertionFailedf(
+								"vector of type %s passed to PerformOperation aliases the memory already "+
+									"accounted for by the allocator; use AccountForWindow for the windows",
+								dest.Type().SQLStringForError(),
+							))
+						}
+					}
+				}
+			}
+		}
+	}
+}
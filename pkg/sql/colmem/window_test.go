@@ -0,0 +1,100 @@
+// Copyright 2024 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package colmem_test
+
+import (
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/col/coldata"
+	"github.com/cockroachdb/cockroach/pkg/sql/colexecerror"
+	"github.com/cockroachdb/cockroach/pkg/sql/colmem"
+	"github.com/cockroachdb/cockroach/pkg/sql/types"
+	"github.com/cockroachdb/cockroach/pkg/util/buildutil"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/randutil"
+	"github.com/stretchr/testify/require"
+)
+
+// TestAccountForWindow verifies that the windows created over the batches
+// already accounted for by the allocator only add the overhead of the window
+// wrappers and that the memory isn't double-counted.
+func TestAccountForWindow(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	rng, _ := randutil.NewTestRand()
+	// Use increment of 1 so that no allocations are "reserved".
+	testAllocator, memAcc, cleanup := getAllocator(1 /* increment */)
+	defer cleanup()
+
+	typs := []*types.T{types.Int, types.Bytes}
+	numRows := rng.Intn(coldata.BatchSize()) + 1
+	b := testAllocator.NewMemBatchWithFixedCapacity(typs, numRows)
+	testAllocator.PerformOperation(b.ColVecs(), func() {
+		for i := 0; i < numRows; i++ {
+			b.ColVec(0).Int64()[i] = int64(i)
+			b.ColVec(1).Bytes().Set(i, make([]byte, rng.Intn(100)))
+		}
+		b.SetLength(numRows)
+	})
+	before := memAcc.Used()
+	batchSize := colmem.GetBatchMemSize(b)
+
+	w := testAllocator.NewMemBatchNoCols(typs, numRows)
+	skeleton := memAcc.Used() - before
+	for run := 0; run < 10; run++ {
+		start := rng.Intn(numRows)
+		end := start + 1 + rng.Intn(numRows-start)
+		for i := range typs {
+			w.ReplaceCol(b.ColVec(i).Window(start, end), i)
+		}
+		w.SetLength(end - start)
+		testAllocator.AccountForWindow(w)
+		withWindow := memAcc.Used()
+		// Only the overhead of the window wrappers is accounted for.
+		require.Less(t, before+skeleton, withWindow)
+		require.Less(t, withWindow-before-skeleton, batchSize)
+		// Accounting for the same windows again doesn't change anything.
+		testAllocator.AccountForWindow(w)
+		require.Equal(t, withWindow, memAcc.Used())
+		require.Equal(t, withWindow, testAllocator.Used())
+
+		if buildutil.CrdbTestBuild {
+			// Modifying the windows is detected.
+			require.Error(t, colexecerror.CatchVectorizedRuntimeError(func() {
+				testAllocator.PerformOperation(w.ColVecs(), func() {})
+			}))
+			// So is modifying a window that hasn't been registered.
+			window := b.ColVec(1).Window(start, end)
+			require.Error(t, colexecerror.CatchVectorizedRuntimeError(func() {
+				testAllocator.PerformOperation([]*coldata.Vec{window}, func() {})
+			}))
+			// The original vectors can still be modified.
+			testAllocator.PerformOperation(b.ColVecs(), func() {})
+			require.Equal(t, withWindow, memAcc.Used())
+		}
+
+		// The window wrappers can be released separately.
+		testAllocator.ReleaseWindow(w)
+		require.Equal(t, before+skeleton, memAcc.Used())
+	}
+
+	// Releasing the windowed batch releases only the skeleton and the
+	// wrappers.
+	testAllocator.AccountForWindow(w)
+	testAllocator.ReleaseBatch(w)
+	require.Equal(t, before, memAcc.Used())
+	require.Equal(t, before, testAllocator.Used())
+
+	testAllocator.ReleaseBatch(b)
+	require.Zero(t, memAcc.Used())
+}
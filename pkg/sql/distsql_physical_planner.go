@@ -19,6 +19,7 @@ import (
 
 	"github.com/cockroachdb/cockroach/pkg/base"
 	"github.com/cockroachdb/cockroach/pkg/cloud"
+	"github.com/cockroachdb/cockroach/pkg/clusterversion"
 	"github.com/cockroachdb/cockroach/pkg/gossip"
 	"github.com/cockroachdb/cockroach/pkg/jobs"
 	"github.com/cockroachdb/cockroach/pkg/jobs/jobspb"
@@ -42,6 +43,7 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/sql/execinfra/execopnode"
 	"github.com/cockroachdb/cockroach/pkg/sql/execinfrapb"
 	"github.com/cockroachdb/cockroach/pkg/sql/execstats"
+	"github.com/cockroachdb/cockroach/pkg/sql/inverted"
 	"github.com/cockroachdb/cockroach/pkg/sql/opt/exec"
 	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgcode"
 	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
@@ -3439,6 +3441,19 @@ func (dsp *DistSQLPlanner) planZigzagJoin(
 	return plan, nil
 }
 
+// invertedFilterExprProto returns the proto of the inverted expression of an
+// inverted filterer. The SetAtLeast nodes of the expression are expanded into
+// unions and intersections until all nodes of the cluster can evaluate them,
+// since the filterer can be placed on a remote node.
+func invertedFilterExprProto(
+	ctx context.Context, st *cluster.Settings, expr *inverted.SpanExpression,
+) *inverted.SpanExpressionProto {
+	if !st.Version.IsActive(ctx, clusterversion.V24_2_InvertedSetAtLeast) {
+		expr = inverted.ExpandAtLeast(expr)
+	}
+	return expr.ToProto()
+}
+
 func (dsp *DistSQLPlanner) createPlanForInvertedFilter(
 	ctx context.Context, planCtx *PlanningCtx, n *invertedFilterNode,
 ) (*PhysicalPlan, error) {
@@ -3448,7 +3463,7 @@ func (dsp *DistSQLPlanner) createPlanForInvertedFilter(
 	}
 	invertedFiltererSpec := &execinfrapb.InvertedFiltererSpec{
 		InvertedColIdx: uint32(n.invColumn),
-		InvertedExpr:   *n.expression.ToProto(),
+		InvertedExpr:   *invertedFilterExprProto(ctx, dsp.st, n.expression),
 	}
 	if n.preFiltererExpr != nil {
 		invertedFiltererSpec.PreFiltererSpec = &execinfrapb.InvertedFiltererSpec_PreFiltererSpec{
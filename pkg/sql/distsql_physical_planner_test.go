@@ -21,6 +21,7 @@ import (
 	"time"
 
 	"github.com/cockroachdb/cockroach/pkg/base"
+	"github.com/cockroachdb/cockroach/pkg/clusterversion"
 	"github.com/cockroachdb/cockroach/pkg/gossip"
 	"github.com/cockroachdb/cockroach/pkg/keys"
 	"github.com/cockroachdb/cockroach/pkg/kv"
@@ -36,6 +37,7 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/sql/distsql"
 	"github.com/cockroachdb/cockroach/pkg/sql/execinfra"
 	"github.com/cockroachdb/cockroach/pkg/sql/execinfrapb"
+	"github.com/cockroachdb/cockroach/pkg/sql/inverted"
 	"github.com/cockroachdb/cockroach/pkg/sql/physicalplan"
 	"github.com/cockroachdb/cockroach/pkg/sql/physicalplan/replicaoracle"
 	"github.com/cockroachdb/cockroach/pkg/sql/randgen"
@@ -1861,3 +1863,49 @@ func TestClosestInstances(t *testing.T) {
 		})
 	}
 }
+
+// TestInvertedFilterExprProtoMixedVersion verifies that the SetAtLeast nodes of
+// the inverted expressions planned for the inverted filterers are expanded
+// until all nodes of the cluster can evaluate them.
+func TestInvertedFilterExprProtoMixedVersion(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	span := func(start, end string) inverted.Span {
+		return inverted.Span{Start: inverted.EncVal(start), End: inverted.EncVal(end)}
+	}
+	var hasAtLeast func(node *inverted.SpanExpressionProto_Node) bool
+	hasAtLeast = func(node *inverted.SpanExpressionProto_Node) bool {
+		if node == nil {
+			return false
+		}
+		return node.Operator == inverted.SetAtLeast || hasAtLeast(node.Left) || hasAtLeast(node.Right)
+	}
+	for _, tc := range []struct {
+		version    clusterversion.Key
+		expectedOp inverted.SetOperator
+	}{
+		{version: clusterversion.V24_2_InvertedSetAtLeast - 1, expectedOp: inverted.SetUnion},
+		{version: clusterversion.V24_2_InvertedSetAtLeast, expectedOp: inverted.SetAtLeast},
+	} {
+		t.Run(tc.version.String(), func(t *testing.T) {
+			st := cluster.MakeTestingClusterSettingsWithVersions(
+				clusterversion.Latest.Version(),
+				clusterversion.MinSupported.Version(),
+				false, // initializeVersion
+			)
+			require.NoError(t, clusterversion.Initialize(ctx, tc.version.Version(), &st.SV))
+
+			expr := inverted.AtLeastK(2, [][]inverted.Span{
+				{span("a", "c")}, {span("b", "d")}, {span("c", "e")},
+			})
+			before := expr.String()
+			proto := invertedFilterExprProto(ctx, st, expr)
+			require.Equal(t, before, expr.String())
+			require.Equal(t, tc.expectedOp, proto.Node.Operator)
+			require.Equal(t, tc.expectedOp == inverted.SetAtLeast, hasAtLeast(&proto.Node))
+			require.Equal(t, expr.ToProto().SpansToRead, proto.SpansToRead)
+		})
+	}
+}
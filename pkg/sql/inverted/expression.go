@@ -13,7 +13,10 @@ package inverted
 import (
 	"bytes"
 	"fmt"
-	"strconv"
+	"math"
+	"sort"
+	"strings"
+	"unsafe"
 
 	"github.com/cockroachdb/cockroach/pkg/keysbase"
 	"github.com/cockroachdb/cockroach/pkg/util/treeprinter"
@@ -95,6 +98,15 @@ type EncVal []byte
 // construct the Expression.
 
 // Span is a span of the inverted index. Represents [start, end).
+//
+// A span with a nil End is a point span, which is equivalent to [start, start]
+// and to [start, PrefixEnd(start)), but does not store the end key. Point
+// spans reduce the memory used by expressions with many single values, such
+// as those of fine-level geospatial cells. A nil End therefore never means
+// that the span is unbounded or empty. Code outside this package must use
+// EndKey, CompareEnd or IsPoint rather than read End, unless it knows that the
+// span is not a point span. The spans of a SpanExpressionProto always store
+// their end key.
 type Span struct {
 	Start, End EncVal
 }
@@ -105,17 +117,108 @@ func MakeSingleValSpan(val EncVal) Span {
 	return Span{Start: val, End: end}
 }
 
+// MakePointSpan constructs a point span equivalent to [val, val]. Unlike
+// MakeSingleValSpan, it does not allocate the end key.
+func MakePointSpan(val EncVal) Span {
+	return Span{Start: val}
+}
+
+// IsPoint returns true iff the span is a point span, which does not store its
+// end key. A span that is not a point span may still be equivalent to
+// [val, val]; see IsSingleVal.
+func (s Span) IsPoint() bool {
+	return s.End == nil
+}
+
+// EndKey returns the exclusive end key of the span. For a point span, the end
+// key is computed, which allocates.
+func (s Span) EndKey() EncVal {
+	if s.IsPoint() {
+		return keysbase.PrefixEnd(s.Start)
+	}
+	return s.End
+}
+
+// appendEndKey is like EndKey, but appends the end key of a point span to buf
+// instead of allocating it, and returns the extended buf. The end key of a
+// point span does not alias buf if it cannot be computed by incrementing a
+// byte of the start key.
+func (s Span) appendEndKey(buf []byte) (end EncVal, _ []byte) {
+	if !s.IsPoint() {
+		return s.End, buf
+	}
+	if len(s.Start) == 0 {
+		return keysbase.KeyMax, buf
+	}
+	n := len(buf)
+	buf = append(buf, s.Start...)
+	for i := len(buf) - 1; i >= n; i-- {
+		buf[i]++
+		if buf[i] != 0 {
+			return buf[n : i+1 : i+1], buf[:i+1]
+		}
+	}
+	// The key is already a maximal byte string, see keysbase.PrefixEnd.
+	return s.Start, buf[:n]
+}
+
+// CompareEnd compares the exclusive end key of the span with the given key,
+// without allocating the end key of a point span.
+func (s Span) CompareEnd(key EncVal) int {
+	// For short keys, the end key of a point span is computed on the stack.
+	var buf [32]byte
+	end, _ := s.appendEndKey(buf[:0])
+	return bytes.Compare(end, key)
+}
+
+// CompareEnds compares the exclusive end keys of the two spans, without
+// allocating the end keys of point spans.
+func (s Span) CompareEnds(other Span) int {
+	if s.IsPoint() && other.IsPoint() && bytes.Equal(s.Start, other.Start) {
+		return 0
+	}
+	var buf [32]byte
+	end, _ := s.appendEndKey(buf[:0])
+	return -other.CompareEnd(end)
+}
+
+// SetEndFrom sets the end key of the span to the end key of other. If other
+// is a point span, the span becomes a point span if it has the same start key,
+// and otherwise the end key of other is allocated.
+func (s *Span) SetEndFrom(other Span) {
+	if other.IsPoint() && !bytes.Equal(s.Start, other.Start) {
+		s.End = other.EndKey()
+		return
+	}
+	s.End = other.End
+}
+
+// setStart sets the start key of the span, first allocating the end key of a
+// point span if the start key changes.
+func (s *Span) setStart(start EncVal) {
+	if s.IsPoint() && !bytes.Equal(s.Start, start) {
+		s.End = s.EndKey()
+	}
+	s.Start = start
+}
+
 // IsSingleVal returns true iff the span is equivalent to [val, val].
 func (s Span) IsSingleVal() bool {
+	if s.IsPoint() {
+		return true
+	}
 	return bytes.Equal(keysbase.PrefixEnd(s.Start), s.End)
 }
 
 // Equals returns true if this span has the same start and end as the given
-// span.
+// span. A point span is equal to a span that stores the same end key.
 func (s Span) Equals(other Span) bool {
 	if !bytes.Equal(s.Start, other.Start) {
 		return false
 	}
+	if s.IsPoint() != other.IsPoint() {
+		return s.CompareEnds(other) == 0
+	}
 	return bytes.Equal(s.End, other.End)
 }
 
@@ -124,7 +227,41 @@ type Spans []Span
 
 // ContainsKey returns whether the span contains the given key.
 func (s Span) ContainsKey(key EncVal) bool {
-	return bytes.Compare(key, s.Start) >= 0 && bytes.Compare(key, s.End) < 0
+	c := bytes.Compare(key, s.Start)
+	if c < 0 {
+		return false
+	}
+	if s.CompareEnd(key) > 0 {
+		return true
+	}
+	// PrefixEnd cannot increment a maximal key, so [val, val] is represented
+	// with End equal to Start when val is maximal.
+	return c == 0 && s.CompareEnd(s.Start) == 0 && s.IsSingleVal()
+}
+
+// ContainsSpan returns whether the span contains all the keys in the given
+// span.
+func (s Span) ContainsSpan(other Span) bool {
+	return bytes.Compare(s.Start, other.Start) <= 0 && other.CompareEnds(s) <= 0
+}
+
+// Find returns the index of the span that contains the given key, or -1 if
+// there is no such span. The spans must be sorted and non-overlapping.
+func (is Spans) Find(key EncVal) int {
+	// Find the first span that ends after the key.
+	i := sort.Search(len(is), func(i int) bool {
+		return is[i].CompareEnd(key) > 0 || is[i].ContainsKey(key)
+	})
+	if i < len(is) && is[i].ContainsKey(key) {
+		return i
+	}
+	return -1
+}
+
+// ContainsKey returns whether one of the spans contains the given key. The
+// spans must be sorted and non-overlapping.
+func (is Spans) ContainsKey(key EncVal) bool {
+	return is.Find(key) >= 0
 }
 
 // Equals returns true if this Spans has the same spans as the given
@@ -143,29 +280,40 @@ func (is Spans) Equals(other Spans) bool {
 
 // Format pretty-prints the spans.
 func (is Spans) Format(tp treeprinter.Node, label string, redactable bool) {
+	is.format(tp, label, UnknownIndexKind, redactable)
+}
+
+// format is like Format, but formats the keys of the spans as the keys of an
+// index of the given kind, see RegisterKeyFormatter.
+func (is Spans) format(tp treeprinter.Node, label string, kind IndexKind, redactable bool) {
 	if len(is) == 0 {
 		tp.Childf("%s: empty", label)
 		return
 	}
 	if len(is) == 1 {
-		tp.Childf("%s: %s", label, formatSpan(is[0], redactable))
+		tp.Childf("%s: %s", label, formatKindSpan(is[0], kind, redactable))
 		return
 	}
 	n := tp.Child(label)
 	for i := 0; i < len(is); i++ {
-		n.Child(formatSpan(is[i], redactable))
+		n.Child(formatKindSpan(is[i], kind, redactable))
 	}
 }
 
 func formatSpan(span Span, redactable bool) string {
+	return formatKindSpan(span, UnknownIndexKind, redactable)
+}
+
+// formatKindSpan formats a span of the keys of an index of the given kind.
+func formatKindSpan(span Span, kind IndexKind, redactable bool) string {
 	end := span.End
 	spanEndOpenOrClosed := ')'
 	if span.IsSingleVal() {
 		end = span.Start
 		spanEndOpenOrClosed = ']'
 	}
-	output := fmt.Sprintf("[%s, %s%c", strconv.Quote(string(span.Start)),
-		strconv.Quote(string(end)), spanEndOpenOrClosed)
+	output := fmt.Sprintf("[%s, %s%c", formatKey(span.Start, kind),
+		formatKey(end, kind), spanEndOpenOrClosed)
 	if redactable {
 		output = string(redact.Sprintf("%s", redact.Unsafe(output)))
 	}
@@ -191,9 +339,10 @@ func (is Spans) Start(i int) []byte {
 	return is[i].Start
 }
 
-// End implements the span.KeyableInvertedSpans interface.
+// End implements the span.KeyableInvertedSpans interface. The end key of a
+// point span is allocated.
 func (is Spans) End(i int) []byte {
-	return is[i].End
+	return is[i].EndKey()
 }
 
 // Expression is the interface representing an expression or sub-expression
@@ -295,6 +444,65 @@ type Expression interface {
 	Copy() Expression
 }
 
+// SpanOrdering is the order of the FactoredUnionSpans of the nodes of a
+// SpanExpression, which consumers that evaluate the spans of a union in order
+// can rely on, e.g. to stop early under a small LIMIT. The orderings other
+// than OrderByKey are defined in terms of the width of a span, i.e. the number
+// of keys that it covers, which depends on how the keys are encoded, see
+// CompareSpans. Spans of the same width are ordered by key.
+type SpanOrdering uint8
+
+const (
+	// OrderByKey orders the spans by key, which is the order of the
+	// FactoredUnionSpans of all the SpanExpressions that do not record another
+	// ordering.
+	OrderByKey SpanOrdering = iota
+	// OrderByWidthAscending orders the spans by increasing width, so that the
+	// narrowest, and therefore most selective, spans come first.
+	OrderByWidthAscending
+	// OrderByWidthDescending orders the spans by decreasing width, so that the
+	// widest spans, which are the most likely to contain a key, come first.
+	OrderByWidthDescending
+	numSpanOrderings
+)
+
+func (o SpanOrdering) String() string {
+	switch o {
+	case OrderByKey:
+		return "key"
+	case OrderByWidthAscending:
+		return "width-ascending"
+	case OrderByWidthDescending:
+		return "width-descending"
+	default:
+		return fmt.Sprintf("SpanOrdering(%d)", o)
+	}
+}
+
+// CompareSpans compares the given spans according to the ordering, and
+// returns a negative number if a comes first, a positive number if b comes
+// first, and 0 if they are equal. width returns the width of a span, and is
+// not called for OrderByKey.
+func (o SpanOrdering) CompareSpans(a, b Span, width func(Span) uint64) int {
+	switch o {
+	case OrderByWidthAscending, OrderByWidthDescending:
+		aWidth, bWidth := width(a), width(b)
+		if o == OrderByWidthDescending {
+			aWidth, bWidth = bWidth, aWidth
+		}
+		if aWidth != bWidth {
+			if aWidth < bWidth {
+				return -1
+			}
+			return 1
+		}
+	}
+	if c := bytes.Compare(a.Start, b.Start); c != 0 {
+		return c
+	}
+	return a.CompareEnds(b)
+}
+
 // SpanExpression is an implementation of Expression.
 //
 // TODO(sumeer): after integration and experimentation with optimizer costing,
@@ -348,16 +556,568 @@ type SpanExpression struct {
 	// expression, specifically [2, 6) and [5, 6).
 	FactoredUnionSpans Spans
 
+	// UnsortedFactoredUnionSpans is true if the FactoredUnionSpans of this
+	// node are not sorted, e.g. because they are ordered by the likelihood
+	// that they contain a key, so that an evaluation of the union can stop
+	// early. They are still non-overlapping. The functions that combine
+	// SpanExpressions require sorted FactoredUnionSpans, so a SpanExpression
+	// with unsorted FactoredUnionSpans must only be used for evaluation.
+	UnsortedFactoredUnionSpans bool
+
+	// Unconstrained is true if the SpanExpression does not constrain the
+	// inverted column, because its FactoredUnionSpans cover all of the keys of
+	// the column, e.g. the covering of a shape that contains the bounds of a
+	// geospatial index. It is only set on expressions without children, such as
+	// those returned by UnconstrainedSpanExpression, so that the optimizer can
+	// check it without inspecting the spans, and scan the whole index or not
+	// use it at all.
+	Unconstrained bool
+
+	// IndexKind is the kind of the index whose keys the SpanExpression reads.
+	// It is set on the root of the SpanExpressions converted from the keys of
+	// geospatial indexes, and applies to the whole tree. The passes that
+	// interpret the keys, e.g. as s2 cells, require it, and String and Format
+	// use it to decode the keys of the spans, see RegisterKeyFormatter.
+	IndexKind IndexKind
+
+	// Ordering is the order of the FactoredUnionSpans of every node of the
+	// SpanExpression. Like IndexKind, it is set on the root, and applies to the
+	// whole tree. The nodes whose FactoredUnionSpans are not in the order of
+	// their keys also have UnsortedFactoredUnionSpans. The passes that combine
+	// or rewrite the FactoredUnionSpans, such as Normalize, leave the
+	// SpanExpressions of orderings other than OrderByKey as they are, since
+	// they would reorder the spans by key. See CheckOrdering.
+	Ordering SpanOrdering
+
+	// PartialSpansToRead is true if the SpansToRead of the SpanExpression do not
+	// contain all the spans of the tree, but only those that are required before
+	// its children are evaluated, e.g. the spans of an intersection that overlap
+	// the bounds of both of its children. It is only set on the root. Consumers
+	// that evaluate the children on demand read the spans of each node with
+	// VisitNodeSpansToRead. MaterializeSpansToRead completes the SpansToRead and
+	// clears the flag, so the methods of SpanExpression that need all the spans,
+	// such as ToProto, still see them, but callers that access the SpansToRead
+	// field directly must check the flag, since the execution code path relies
+	// on the SpansToRead being the union of all the spans of the tree.
+	PartialSpansToRead bool
+
+	// Flattened is true if the SpanExpression is the union of all the spans of
+	// a more precise expression, which a converter flattened into a single
+	// node because the precise expression was small enough that reading its
+	// spans and re-checking the original predicate on the rows is cheaper than
+	// evaluating it, e.g. the geospatial converters with
+	// ConvertOptions.FlattenBelowNodes. A flattened SpanExpression is not
+	// tight. It is only set on expressions without children, and Format
+	// reports it, so that EXPLAIN shows why a filter has a single node.
+	Flattened bool
+
 	// Operator is the set operation to apply to Left and Right.
 	// When this is union or intersection, both Left and Right are non-nil,
 	// else both are nil.
 	Operator SetOperator
 	Left     Expression
 	Right    Expression
+
+	// K and Operands are only set when Operator is SetAtLeast, which
+	// represents the keys that are contained in at least K of the Operands.
+	// Each operand is a set of spans, which are non-overlapping and sorted,
+	// and 1 <= K <= len(Operands). A row with a key in fewer than K operands
+	// does not satisfy the node, so K = 1 is equivalent to the union of the
+	// operands, and K = len(Operands) to their intersection. See AtLeastK.
+	K        int
+	Operands []Spans
+
+	// stats caches the result of Stats, if statsValid is true. The functions
+	// in this package that modify a SpanExpression in place invalidate it.
+	stats      SpanExprStats
+	statsValid bool
+	// memUsage caches the result of MemUsage, if non-zero. It is invalidated
+	// along with stats.
+	memUsage int64
+	// deferredSpansToRead is true if the SpansToRead of this node have not been
+	// materialized yet, see DeferSpansToRead.
+	deferredSpansToRead bool
+	// boundingFirst and boundingLast cache the spans to read with the smallest
+	// start key and the largest end key, if boundingSpansValid is true, and
+	// hasBoundingSpans is false if there are none, see BoundingSpan. They are
+	// invalidated along with stats.
+	boundingFirst, boundingLast Span
+	boundingSpansValid          bool
+	hasBoundingSpans            bool
 }
 
 var _ Expression = (*SpanExpression)(nil)
 
+// SpanExprStats contains statistics about the shape of a SpanExpression, for
+// use in cost estimation. Only SpanExpression nodes are included; other
+// Expressions in the tree are ignored.
+type SpanExprStats struct {
+	// NumNodes is the number of SpanExpression nodes in the tree.
+	NumNodes int
+	// Depth is the depth of the tree. A SpanExpression without children has a
+	// depth of 1.
+	Depth int
+	// NumFactoredSpans is the total number of FactoredUnionSpans in the tree.
+	// It is equal to NumPointSpans + NumRangeSpans.
+	NumFactoredSpans int
+	// NumPointSpans is the number of FactoredUnionSpans equivalent to
+	// [val, val].
+	NumPointSpans int
+	// NumRangeSpans is the number of FactoredUnionSpans that are not point
+	// spans.
+	NumRangeSpans int
+	// MinNodeSpans and MaxNodeSpans are the minimum and maximum number of
+	// FactoredUnionSpans in a single node.
+	MinNodeSpans int
+	MaxNodeSpans int
+	// NumUnions, NumIntersections and NumAtLeast are the number of nodes with
+	// the SetUnion, SetIntersection and SetAtLeast operators.
+	NumUnions        int
+	NumIntersections int
+	NumAtLeast       int
+}
+
+// Stats returns statistics about the SpanExpression. The statistics are
+// computed lazily and cached on the node, so Stats must only be called once the
+// SpanExpression is fully constructed. The statistics of the children, for
+// instance to estimate the selectivity of an intersection, can be obtained by
+// calling Stats on them.
+func (s *SpanExpression) Stats() SpanExprStats {
+	if !s.statsValid {
+		s.stats, s.statsValid = s.computeStats(), true
+	}
+	return s.stats
+}
+
+// InvalidateCaches invalidates the values cached by Stats, MemUsage and
+// BoundingSpan. It must be called when a SpanExpression is modified in place
+// outside of this package.
+func (s *SpanExpression) InvalidateCaches() {
+	s.statsValid = false
+	s.memUsage = 0
+	s.boundingSpansValid = false
+}
+
+// computeStats returns the statistics of the SpanExpression, using the cached
+// statistics of the nodes in the tree when available, without caching them.
+func (s *SpanExpression) computeStats() SpanExprStats {
+	if s.statsValid {
+		return s.stats
+	}
+	stats := SpanExprStats{
+		NumNodes:         1,
+		Depth:            1,
+		NumFactoredSpans: len(s.FactoredUnionSpans),
+		MinNodeSpans:     len(s.FactoredUnionSpans),
+		MaxNodeSpans:     len(s.FactoredUnionSpans),
+	}
+	for _, span := range s.FactoredUnionSpans {
+		if span.IsSingleVal() {
+			stats.NumPointSpans++
+		} else {
+			stats.NumRangeSpans++
+		}
+	}
+	switch s.Operator {
+	case SetUnion:
+		stats.NumUnions++
+	case SetIntersection:
+		stats.NumIntersections++
+	case SetAtLeast:
+		stats.NumAtLeast++
+	}
+	for _, child := range []Expression{s.Left, s.Right} {
+		c, ok := child.(*SpanExpression)
+		if !ok || c == nil {
+			continue
+		}
+		childStats := c.computeStats()
+		stats.NumNodes += childStats.NumNodes
+		if childStats.Depth+1 > stats.Depth {
+			stats.Depth = childStats.Depth + 1
+		}
+		stats.NumFactoredSpans += childStats.NumFactoredSpans
+		stats.NumPointSpans += childStats.NumPointSpans
+		stats.NumRangeSpans += childStats.NumRangeSpans
+		if childStats.MinNodeSpans < stats.MinNodeSpans {
+			stats.MinNodeSpans = childStats.MinNodeSpans
+		}
+		if childStats.MaxNodeSpans > stats.MaxNodeSpans {
+			stats.MaxNodeSpans = childStats.MaxNodeSpans
+		}
+		stats.NumUnions += childStats.NumUnions
+		stats.NumIntersections += childStats.NumIntersections
+		stats.NumAtLeast += childStats.NumAtLeast
+	}
+	return stats
+}
+
+const (
+	// SpanExpressionOverhead is the size of a SpanExpression node, excluding
+	// its spans, in bytes.
+	SpanExpressionOverhead = int64(unsafe.Sizeof(SpanExpression{}))
+	// SpanOverhead is the size of a Span, excluding its encoded keys, in bytes.
+	SpanOverhead = int64(unsafe.Sizeof(Span{}))
+	// spansOverhead is the size of an operand of a SetAtLeast node, excluding
+	// its spans, in bytes.
+	spansOverhead = int64(unsafe.Sizeof(Spans{}))
+)
+
+// DeferSpansToRead clears the SpansToRead of a SpanExpression without
+// children, so that they are only materialized by the first call to
+// MaterializeSpansToRead, which computes them from the FactoredUnionSpans and
+// caches them. The SpansToRead of such an expression are its
+// FactoredUnionSpans in sorted order, so materializing them only costs a copy
+// and a sort if UnsortedFactoredUnionSpans is set, and nothing otherwise.
+// Consumers that only need the spans to read, e.g. to prefetch them, can then
+// visit them with VisitSpansToRead.
+//
+// The methods of SpanExpression materialize deferred SpansToRead as needed,
+// but callers that access the SpansToRead field of an expression directly
+// must call MaterializeSpansToRead first.
+func (s *SpanExpression) DeferSpansToRead() {
+	if s.Operator != None {
+		panic(errors.AssertionFailedf(
+			"cannot defer the SpansToRead of an expression with operator %d", s.Operator))
+	}
+	s.SpansToRead = nil
+	s.deferredSpansToRead = true
+	s.memUsage = 0
+}
+
+// MaterializeSpansToRead returns the SpansToRead of the SpanExpression, after
+// materializing them if they were deferred by DeferSpansToRead, or completing
+// them if they are partial, see PartialSpansToRead.
+func (s *SpanExpression) MaterializeSpansToRead() Spans {
+	if s.PartialSpansToRead || s.deferredSpansToRead {
+		s.SpansToRead = s.completeSpansToRead()
+		s.PartialSpansToRead, s.deferredSpansToRead = false, false
+		s.memUsage = 0
+	}
+	return s.SpansToRead
+}
+
+// completeSpansToRead returns the SpansToRead that MaterializeSpansToRead
+// would materialize, without modifying the SpanExpression. The returned spans
+// may share the memory of the FactoredUnionSpans and Operands of the tree.
+func (s *SpanExpression) completeSpansToRead() Spans {
+	if s.PartialSpansToRead || s.deferredSpansToRead {
+		// The deferred SpansToRead of an expression without children are its
+		// sorted FactoredUnionSpans, which are also its node spans.
+		return s.nodeSpansToRead()
+	}
+	return s.SpansToRead
+}
+
+// VisitSpansToRead calls fn on each of the SpansToRead of the SpanExpression,
+// in order, and returns the first error returned by fn, after which no more
+// spans are visited. Deferred SpansToRead (see DeferSpansToRead) are visited
+// without materializing them, unless the FactoredUnionSpans they are computed
+// from are unsorted. Partial SpansToRead (see PartialSpansToRead) are
+// completed first.
+func (s *SpanExpression) VisitSpansToRead(fn func(Span) error) error {
+	spans := s.SpansToRead
+	if s.PartialSpansToRead {
+		spans = s.MaterializeSpansToRead()
+	}
+	if s.deferredSpansToRead {
+		if s.UnsortedFactoredUnionSpans {
+			spans = s.MaterializeSpansToRead()
+		} else {
+			spans = s.FactoredUnionSpans
+		}
+	}
+	for _, span := range spans {
+		if err := fn(span); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// VisitNodeSpansToRead calls fn on each of the spans that must be read to
+// evaluate the subtree rooted at the SpanExpression, in order, and returns the
+// first error returned by fn, after which no more spans are visited. The spans
+// are the union of the FactoredUnionSpans and Operands of the node and of its
+// descendants, i.e. the SpansToRead that the node would have if it were the
+// root. They are computed on each call rather than cached, so that the
+// consumers of an expression with PartialSpansToRead can read the spans of
+// each node as they evaluate it, without the tree holding the spans of every
+// node. Children that are not SpanExpressions are ignored.
+func (s *SpanExpression) VisitNodeSpansToRead(fn func(Span) error) error {
+	for _, span := range s.nodeSpansToRead() {
+		if err := fn(span); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nodeSpansToRead implements VisitNodeSpansToRead. The returned spans may
+// share the memory of the FactoredUnionSpans and Operands of the tree.
+func (s *SpanExpression) nodeSpansToRead() Spans {
+	spans := s.FactoredUnionSpans
+	if s.UnsortedFactoredUnionSpans {
+		spans = append(Spans(nil), spans...)
+		sort.Sort(spans)
+	}
+	for _, operand := range s.Operands {
+		spans = unionSpans(spans, operand)
+	}
+	for _, child := range []Expression{s.Left, s.Right} {
+		if c, ok := child.(*SpanExpression); ok && c != nil {
+			spans = unionSpans(spans, c.nodeSpansToRead())
+		}
+	}
+	return spans
+}
+
+// BoundingSpan returns the smallest span that contains all the SpansToRead of
+// the SpanExpression, e.g. to size the initial scan of a prefetcher, and false
+// if there are none. Partial SpansToRead (see PartialSpansToRead) are bounded
+// as if they were complete. Since the SpansToRead are sorted, the span is
+// computed in constant time from the first and the last of them, unless they
+// are deferred from unsorted FactoredUnionSpans or partial, and cached, unless
+// it was set with SetBoundingSpans. The end key of the span is that of the last
+// span, which is allocated if it is a point span, see Span.EndKey.
+func (s *SpanExpression) BoundingSpan() (Span, bool) {
+	if !s.boundingSpansValid {
+		s.boundingFirst, s.boundingLast, s.hasBoundingSpans = s.computeBoundingSpans()
+		s.boundingSpansValid = true
+	}
+	if !s.hasBoundingSpans {
+		return Span{}, false
+	}
+	if s.boundingFirst.Equals(s.boundingLast) {
+		return s.boundingFirst, true
+	}
+	span := Span{Start: s.boundingFirst.Start}
+	span.SetEndFrom(s.boundingLast)
+	// Cache the span itself, so that the end key of a point span is only
+	// allocated once.
+	s.boundingFirst, s.boundingLast = span, span
+	return span, true
+}
+
+// SetBoundingSpans sets the spans from which BoundingSpan computes its result,
+// for constructors that see the smallest and the largest keys of the
+// SpanExpression as they build it, so that BoundingSpan does not need to find
+// them. first and last must be the spans to read with the smallest start key
+// and the largest end key, which may be the same span. They are invalidated by
+// InvalidateCaches, but not by the methods that do not change the keys that are
+// read, such as DeferSpansToRead.
+func (s *SpanExpression) SetBoundingSpans(first, last Span) {
+	s.boundingFirst, s.boundingLast = first, last
+	s.boundingSpansValid, s.hasBoundingSpans = true, true
+}
+
+// computeBoundingSpans returns the spans to read with the smallest start key
+// and the largest end key, and false if there are none.
+func (s *SpanExpression) computeBoundingSpans() (first, last Span, ok bool) {
+	spans := s.SpansToRead
+	switch {
+	case s.PartialSpansToRead:
+		spans = s.nodeSpansToRead()
+	case s.deferredSpansToRead:
+		if s.UnsortedFactoredUnionSpans {
+			for i, span := range s.FactoredUnionSpans {
+				if i == 0 || bytes.Compare(span.Start, first.Start) < 0 {
+					first = span
+				}
+				if i == 0 || span.CompareEnds(last) > 0 {
+					last = span
+				}
+			}
+			return first, last, len(s.FactoredUnionSpans) > 0
+		}
+		spans = s.FactoredUnionSpans
+	}
+	if len(spans) == 0 {
+		return Span{}, Span{}, false
+	}
+	return spans[0], spans[len(spans)-1], true
+}
+
+// MemUsage returns the memory used by the SpanExpression, in bytes, for the
+// memory accounting of SpanExpressions that are buffered. It includes the
+// SpanExpression nodes in the tree, the spans of their SpansToRead and
+// FactoredUnionSpans, and the encoded keys of the spans, but not the spare
+// capacity of the slices. Arrays of spans and keys that are shared, e.g. when
+// SpansToRead and FactoredUnionSpans are the same slice, are counted once, and
+// SpansToRead that are deferred (see DeferSpansToRead) are not counted.
+// Likewise, nodes that are shared by several parents, e.g. after their
+// identical subtrees were deduplicated, are counted once. Children that are not
+// SpanExpressions are ignored.
+//
+// Like Stats, MemUsage is computed lazily and cached on the root, unless it
+// was set with SetMemUsage.
+func (s *SpanExpression) MemUsage() int64 {
+	if s.memUsage == 0 {
+		s.memUsage = s.computeMemUsage()
+	}
+	return s.memUsage
+}
+
+// SetMemUsage sets the value returned by MemUsage, for constructors that
+// compute the memory usage of a SpanExpression incrementally, so that MemUsage
+// does not need to traverse it. memUsage must equal the value that MemUsage
+// would compute.
+func (s *SpanExpression) SetMemUsage(memUsage int64) {
+	s.memUsage = memUsage
+}
+
+// computeMemUsage returns the memory usage of the SpanExpression, without
+// caching it. Arrays of spans and keys are identified by the address of their
+// first element, and nodes that are shared by several parents are counted once.
+func (s *SpanExpression) computeMemUsage() int64 {
+	nodes := make(map[*SpanExpression]struct{})
+	spanArrays := make(map[*Span]int)
+	keys := make(map[*byte]int)
+	var memUsage int64
+	addSpans := func(spans Spans) {
+		if len(spans) == 0 {
+			return
+		}
+		spanArrays[&spans[0]] = max(spanArrays[&spans[0]], len(spans))
+		for i := range spans {
+			for _, key := range [2]EncVal{spans[i].Start, spans[i].End} {
+				if len(key) > 0 {
+					keys[&key[0]] = max(keys[&key[0]], len(key))
+				}
+			}
+		}
+	}
+	var visit func(e *SpanExpression)
+	visit = func(e *SpanExpression) {
+		if _, ok := nodes[e]; ok {
+			return
+		}
+		nodes[e] = struct{}{}
+		memUsage += SpanExpressionOverhead
+		addSpans(e.SpansToRead)
+		addSpans(e.FactoredUnionSpans)
+		memUsage += int64(len(e.Operands)) * spansOverhead
+		for _, operand := range e.Operands {
+			addSpans(operand)
+		}
+		for _, child := range [2]Expression{e.Left, e.Right} {
+			if c, ok := child.(*SpanExpression); ok && c != nil {
+				visit(c)
+			}
+		}
+	}
+	visit(s)
+	for _, n := range spanArrays {
+		memUsage += int64(n) * SpanOverhead
+	}
+	for _, n := range keys {
+		memUsage += int64(n)
+	}
+	return memUsage
+}
+
+// String returns a string representation of the statistics.
+func (s SpanExprStats) String() string {
+	return fmt.Sprintf(
+		"nodes: %d, depth: %d, spans: %d (points: %d, ranges: %d), spans per node: [%d, %d]",
+		s.NumNodes, s.Depth, s.NumFactoredSpans, s.NumPointSpans, s.NumRangeSpans,
+		s.MinNodeSpans, s.MaxNodeSpans,
+	)
+}
+
+// maxEstimatedKeySuffix is the maximum number of trailing bytes in which the
+// start and end keys of a range span may differ for EstimatedKeys to estimate
+// the number of keys in the span.
+const maxEstimatedKeySuffix = 8
+
+// EstimatedKeys returns an estimate of the number of keys in the SpansToRead,
+// and false if the number cannot be estimated. A span equivalent to
+// [val, val] contains a single key. The start and end keys of any other span
+// must have the same length and only differ in their last
+// maxEstimatedKeySuffix bytes, as is the case for spans over the encoded cell
+// IDs of geospatial indexes, and the keys of the span are estimated to be the
+// keys of that length in between. The estimate saturates at math.MaxUint64.
+func (s *SpanExpression) EstimatedKeys() (uint64, bool) {
+	var n uint64
+	for _, span := range s.MaterializeSpansToRead() {
+		spanKeys, ok := estimateSpanKeys(span)
+		if !ok {
+			return 0, false
+		}
+		if n += spanKeys; n < spanKeys {
+			n = math.MaxUint64
+		}
+	}
+	return n, true
+}
+
+// estimateSpanKeys implements EstimatedKeys for a single span.
+func estimateSpanKeys(span Span) (uint64, bool) {
+	if span.IsSingleVal() {
+		return 1, true
+	}
+	if len(span.Start) != len(span.End) {
+		return 0, false
+	}
+	i := 0
+	for i < len(span.Start) && span.Start[i] == span.End[i] {
+		i++
+	}
+	if len(span.Start)-i > maxEstimatedKeySuffix {
+		return 0, false
+	}
+	var start, end uint64
+	for ; i < len(span.Start); i++ {
+		start = start<<8 | uint64(span.Start[i])
+		end = end<<8 | uint64(span.End[i])
+	}
+	if end < start {
+		return 0, false
+	}
+	return end - start, true
+}
+
+// SummaryString returns a one-line summary of the shape of the expression and
+// of the number of keys it reads, for use in EXPLAIN output, e.g.:
+//
+//	union of 132 spans over 2 levels; 3 intersections; est. 940 keys
+//
+// The spans are the FactoredUnionSpans of the tree, and the levels are its
+// depth. The number of SetAtLeast nodes is only included if the tree has any,
+// and the number of keys is only included if EstimatedKeys can estimate it.
+// An empty expression (see IsEmpty) is summarized as such. Like Stats, it
+// must only be called on a fully constructed expression.
+func (s *SpanExpression) SummaryString() string {
+	if s.IsEmpty() {
+		return "empty; matches no rows"
+	}
+	stats := s.Stats()
+	var b strings.Builder
+	fmt.Fprintf(&b, "union of %s over %s; %s",
+		pluralize(stats.NumFactoredSpans, "span"), pluralize(stats.Depth, "level"),
+		pluralize(stats.NumIntersections, "intersection"))
+	if stats.NumAtLeast > 0 {
+		fmt.Fprintf(&b, "; %s", pluralize(stats.NumAtLeast, "at-least-k operation"))
+	}
+	if n, ok := s.EstimatedKeys(); ok {
+		fmt.Fprintf(&b, "; est. %d %s", n, pluralNoun(n == 1, "key"))
+	}
+	return b.String()
+}
+
+// pluralize returns n followed by noun, pluralized if n is not 1.
+func pluralize(n int, noun string) string {
+	return fmt.Sprintf("%d %s", n, pluralNoun(n == 1, noun))
+}
+
+// pluralNoun returns noun, pluralized unless singular is true.
+func pluralNoun(singular bool, noun string) string {
+	if singular {
+		return noun
+	}
+	return noun + "s"
+}
+
 // IsTight implements the Expression interface.
 func (s *SpanExpression) IsTight() bool {
 	return s.Tight
@@ -373,8 +1133,8 @@ func (s *SpanExpression) SetNotTight() {
 // Copy makes a copy of the SpanExpression and returns it. Copy recurses into
 // the children and makes copies of them as well, so the new struct is
 // independent from the old. It does *not* perform a deep copy of the
-// SpansToRead or FactoredUnionSpans slices, however, because those slices are
-// never modified in place and therefore are safe to reuse.
+// SpansToRead, FactoredUnionSpans or Operands slices, however, because those
+// slices are never modified in place and therefore are safe to reuse.
 func (s *SpanExpression) Copy() Expression {
 	res := &SpanExpression{
 		Tight:              s.Tight,
@@ -382,6 +1142,16 @@ func (s *SpanExpression) Copy() Expression {
 		SpansToRead:        s.SpansToRead,
 		FactoredUnionSpans: s.FactoredUnionSpans,
 		Operator:           s.Operator,
+		K:                  s.K,
+		Operands:           s.Operands,
+		Unconstrained:      s.Unconstrained,
+		IndexKind:          s.IndexKind,
+		Ordering:           s.Ordering,
+		PartialSpansToRead: s.PartialSpansToRead,
+		Flattened:          s.Flattened,
+
+		UnsortedFactoredUnionSpans: s.UnsortedFactoredUnionSpans,
+		deferredSpansToRead:        s.deferredSpansToRead,
 	}
 	if s.Left != nil {
 		res.Left = s.Left.Copy()
@@ -392,20 +1162,164 @@ func (s *SpanExpression) Copy() Expression {
 	return res
 }
 
+// Detach makes a deep copy of the SpanExpression and returns it. Unlike Copy,
+// the SpansToRead, FactoredUnionSpans and Operands slices of every
+// SpanExpression in the tree, and the encoded keys of their spans, are copied
+// into memory owned by the returned expression. Detach should be used to retain an expression that
+// shares memory which will be reused, such as an expression returned by a
+// converter that pools its memory across conversions. Children that are not
+// SpanExpressions are copied with Copy.
+func (s *SpanExpression) Detach() *SpanExpression {
+	numSpans, numBytes := s.detachedSize()
+	d := detacher{
+		spans: make(Spans, numSpans),
+		buf:   make([]byte, 0, numBytes),
+	}
+	return d.detach(s)
+}
+
+// detachedSize returns the number of spans and the number of bytes of encoded
+// keys in the SpanExpression and its SpanExpression descendants.
+func (s *SpanExpression) detachedSize() (numSpans, numBytes int) {
+	addSpans := func(spans Spans) {
+		numSpans += len(spans)
+		for i := range spans {
+			numBytes += len(spans[i].Start) + len(spans[i].End)
+		}
+	}
+	addSpans(s.SpansToRead)
+	addSpans(s.FactoredUnionSpans)
+	for _, operand := range s.Operands {
+		addSpans(operand)
+	}
+	for _, child := range [2]Expression{s.Left, s.Right} {
+		if c, ok := child.(*SpanExpression); ok {
+			childSpans, childBytes := c.detachedSize()
+			numSpans += childSpans
+			numBytes += childBytes
+		}
+	}
+	return numSpans, numBytes
+}
+
+// detacher is used by Detach to copy the spans and encoded keys of a
+// SpanExpression into memory allocated upfront.
+type detacher struct {
+	spans Spans
+	buf   []byte
+}
+
+func (d *detacher) detach(s *SpanExpression) *SpanExpression {
+	res := &SpanExpression{
+		Tight:              s.Tight,
+		Unique:             s.Unique,
+		SpansToRead:        d.detachSpans(s.SpansToRead),
+		FactoredUnionSpans: d.detachSpans(s.FactoredUnionSpans),
+		Operator:           s.Operator,
+		K:                  s.K,
+		stats:              s.stats,
+		statsValid:         s.statsValid,
+		Unconstrained:      s.Unconstrained,
+		IndexKind:          s.IndexKind,
+		Ordering:           s.Ordering,
+		PartialSpansToRead: s.PartialSpansToRead,
+		Flattened:          s.Flattened,
+
+		UnsortedFactoredUnionSpans: s.UnsortedFactoredUnionSpans,
+		deferredSpansToRead:        s.deferredSpansToRead,
+	}
+	if s.Operands != nil {
+		res.Operands = make([]Spans, len(s.Operands))
+		for i := range s.Operands {
+			res.Operands[i] = d.detachSpans(s.Operands[i])
+		}
+	}
+	res.Left = d.detachChild(s.Left)
+	res.Right = d.detachChild(s.Right)
+	return res
+}
+
+func (d *detacher) detachChild(child Expression) Expression {
+	switch c := child.(type) {
+	case nil:
+		return nil
+	case *SpanExpression:
+		return d.detach(c)
+	default:
+		return c.Copy()
+	}
+}
+
+func (d *detacher) detachSpans(spans Spans) Spans {
+	if spans == nil {
+		return nil
+	}
+	// Cap the capacity of the result, so that appending to it cannot overwrite
+	// the spans that follow it.
+	res := d.spans[:len(spans):len(spans)]
+	d.spans = d.spans[len(spans):]
+	for i := range spans {
+		res[i] = Span{Start: d.detachKey(spans[i].Start), End: d.detachKey(spans[i].End)}
+	}
+	return res
+}
+
+func (d *detacher) detachKey(key EncVal) EncVal {
+	if key == nil {
+		return nil
+	}
+	n := len(d.buf)
+	d.buf = append(d.buf, key...)
+	return d.buf[n:len(d.buf):len(d.buf)]
+}
+
 func (s *SpanExpression) String() string {
 	tp := treeprinter.New()
-	n := tp.Child("span expression")
+	label := "span expression"
+	if s.IsEmpty() {
+		// Distinguish an expression that matches no rows from one whose spans
+		// are not shown.
+		label = "empty span expression"
+	}
+	n := tp.Child(label)
 	s.Format(n, true /* includeSpansToRead */, false /* redactable */)
+	// Use computeStats, so that String does not cache the statistics of an
+	// expression that is still being constructed.
+	n.Childf("stats: %s", s.computeStats())
 	return tp.String()
 }
 
-// Format pretty-prints the SpanExpression.
+// Format pretty-prints the SpanExpression. If the IndexKind of the
+// SpanExpression is known, the keys of its spans and of the spans of its
+// descendants are formatted with the registered KeyFormatter of the kind.
 func (s *SpanExpression) Format(tp treeprinter.Node, includeSpansToRead, redactable bool) {
+	if s.IndexKind != UnknownIndexKind {
+		tp.Childf("index kind: %s", s.IndexKind)
+	}
+	if s.Ordering != OrderByKey {
+		tp.Childf("ordering: %s", s.Ordering)
+	}
+	if s.Flattened {
+		tp.Child("flattened")
+	}
+	s.format(tp, s.IndexKind, includeSpansToRead, redactable)
+}
+
+// format implements Format for a node of an expression whose keys are those
+// of an index of the given kind.
+func (s *SpanExpression) format(
+	tp treeprinter.Node, kind IndexKind, includeSpansToRead, redactable bool,
+) {
 	tp.Childf("tight: %t, unique: %t", s.Tight, s.Unique)
 	if includeSpansToRead {
-		s.SpansToRead.Format(tp, "to read", redactable)
+		if s.PartialSpansToRead {
+			// Completing the SpansToRead would change the expression.
+			s.SpansToRead.format(tp, "to read (partial)", kind, redactable)
+		} else {
+			s.MaterializeSpansToRead().format(tp, "to read", kind, redactable)
+		}
 	}
-	s.FactoredUnionSpans.Format(tp, "union spans", redactable)
+	s.FactoredUnionSpans.format(tp, "union spans", kind, redactable)
 	if s.Operator == None {
 		return
 	}
@@ -414,53 +1328,152 @@ func (s *SpanExpression) Format(tp treeprinter.Node, includeSpansToRead, redacta
 		tp = tp.Child("UNION")
 	case SetIntersection:
 		tp = tp.Child("INTERSECTION")
+	case SetAtLeast:
+		tp = tp.Childf("AT LEAST %d OF", s.K)
+		for i, operand := range s.Operands {
+			operand.format(tp, fmt.Sprintf("operand %d", i), kind, redactable)
+		}
+		return
 	}
-	formatExpression(tp, s.Left, includeSpansToRead, redactable)
-	formatExpression(tp, s.Right, includeSpansToRead, redactable)
+	formatExpression(tp, s.Left, kind, includeSpansToRead, redactable)
+	formatExpression(tp, s.Right, kind, includeSpansToRead, redactable)
 }
 
-func formatExpression(tp treeprinter.Node, expr Expression, includeSpansToRead, redactable bool) {
+func formatExpression(
+	tp treeprinter.Node, expr Expression, kind IndexKind, includeSpansToRead, redactable bool,
+) {
 	switch e := expr.(type) {
 	case *SpanExpression:
 		n := tp.Child("span expression")
-		e.Format(n, includeSpansToRead, redactable)
+		e.format(n, kind, includeSpansToRead, redactable)
 	default:
 		tp.Child(fmt.Sprintf("%v", e))
 	}
 }
 
 // ToProto constructs a SpanExpressionProto for execution. It should
-// be called on an expression tree that contains only *SpanExpressions.
+// be called on an expression tree that contains only *SpanExpressions. The
+// spans of the proto reference the encoded keys of the expression, see
+// ToSpanExpressionProto.
 func (s *SpanExpression) ToProto() *SpanExpressionProto {
+	return s.ToSpanExpressionProto(false /* copyKeys */)
+}
+
+// ToSpanExpressionProto constructs a SpanExpressionProto for execution, like
+// ToProto. If copyKeys is false, the spans of the proto reference the encoded
+// keys of the expression without copying them, so the proto is only valid
+// while the keys are not modified, e.g. by the reuse of the buffer that they
+// were encoded into. If copyKeys is true, the keys are copied into a single
+// buffer owned by the proto, so that the proto can outlive the keys of the
+// expression. Deferred or partial SpansToRead are completed in the proto
+// without being materialized, so the expression is not modified.
+func (s *SpanExpression) ToSpanExpressionProto(copyKeys bool) *SpanExpressionProto {
 	if s == nil {
 		return nil
 	}
+	spansToRead := s.completeSpansToRead()
+	b := protoBuilder{copyKeys: copyKeys}
+	numBytes := protoSpansKeyBytes(spansToRead, copyKeys) + s.protoKeyBytes(copyKeys)
+	if numBytes > 0 {
+		b.buf = make([]byte, 0, numBytes)
+	}
 	proto := &SpanExpressionProto{
-		SpansToRead: getProtoSpans(s.SpansToRead),
-		Node:        *s.getProtoNode(),
+		SpansToRead: b.getProtoSpans(spansToRead),
+		Node:        *b.getProtoNode(s),
 	}
 	return proto
 }
 
-func getProtoSpans(spans []Span) []SpanExpressionProto_Span {
+// protoKeyBytes returns the number of bytes of the keys allocated by
+// ToSpanExpressionProto for the nodes of the SpanExpression and its
+// descendants, excluding the SpansToRead, see protoSpansKeyBytes.
+func (s *SpanExpression) protoKeyBytes(copyKeys bool) int {
+	numBytes := protoSpansKeyBytes(s.FactoredUnionSpans, copyKeys)
+	switch s.Operator {
+	case SetUnion, SetIntersection:
+		numBytes += s.Left.(*SpanExpression).protoKeyBytes(copyKeys)
+		numBytes += s.Right.(*SpanExpression).protoKeyBytes(copyKeys)
+	case SetAtLeast:
+		for _, operand := range s.Operands {
+			numBytes += protoSpansKeyBytes(operand, copyKeys)
+		}
+	}
+	return numBytes
+}
+
+// protoSpansKeyBytes returns the number of bytes of the keys allocated by
+// ToSpanExpressionProto for the given spans, which are the end keys of the
+// point spans, and if copyKeys is true, all the other keys.
+func protoSpansKeyBytes(spans Spans, copyKeys bool) int {
+	numBytes := 0
+	for i := range spans {
+		// The end key of a point span is at most as long as the start key.
+		if spans[i].IsPoint() {
+			numBytes += len(spans[i].Start)
+		}
+		if copyKeys {
+			numBytes += len(spans[i].Start) + len(spans[i].End)
+		}
+	}
+	return numBytes
+}
+
+// protoBuilder is used by ToSpanExpressionProto to convert the spans of a
+// SpanExpression to their proto representation.
+type protoBuilder struct {
+	copyKeys bool
+	// buf is used for the keys allocated by the conversion, and is sized for
+	// all of them upfront.
+	buf []byte
+}
+
+// getProtoSpans converts the spans to their proto representation. The proto
+// always includes the end key, so that the spans can be decoded by nodes that
+// do not know about point spans.
+func (b *protoBuilder) getProtoSpans(spans []Span) []SpanExpressionProto_Span {
 	out := make([]SpanExpressionProto_Span, len(spans))
 	for i := range spans {
+		span := spans[i]
+		if b.copyKeys {
+			span.Start = b.copyKey(span.Start)
+			span.End = b.copyKey(span.End)
+		}
+		var end EncVal
+		end, b.buf = span.appendEndKey(b.buf)
 		out[i] = SpanExpressionProto_Span{
-			Start: spans[i].Start,
-			End:   spans[i].End,
+			Start: span.Start,
+			End:   end,
 		}
 	}
 	return out
 }
 
-func (s *SpanExpression) getProtoNode() *SpanExpressionProto_Node {
+// copyKey copies the given key into buf, and returns the copy, which is nil
+// iff the key is nil.
+func (b *protoBuilder) copyKey(key EncVal) EncVal {
+	if key == nil {
+		return nil
+	}
+	n := len(b.buf)
+	b.buf = append(b.buf, key...)
+	return b.buf[n:len(b.buf):len(b.buf)]
+}
+
+func (b *protoBuilder) getProtoNode(s *SpanExpression) *SpanExpressionProto_Node {
 	node := &SpanExpressionProto_Node{
-		FactoredUnionSpans: getProtoSpans(s.FactoredUnionSpans),
+		FactoredUnionSpans: b.getProtoSpans(s.FactoredUnionSpans),
 		Operator:           s.Operator,
 	}
-	if node.Operator != None {
-		node.Left = s.Left.(*SpanExpression).getProtoNode()
-		node.Right = s.Right.(*SpanExpression).getProtoNode()
+	switch node.Operator {
+	case SetUnion, SetIntersection:
+		node.Left = b.getProtoNode(s.Left.(*SpanExpression))
+		node.Right = b.getProtoNode(s.Right.(*SpanExpression))
+	case SetAtLeast:
+		node.K = int32(s.K)
+		node.Operands = make([]SpanExpressionProto_SpanSet, len(s.Operands))
+		for i := range s.Operands {
+			node.Operands[i].Spans = b.getProtoSpans(s.Operands[i])
+		}
 	}
 	return node
 }
@@ -524,10 +1537,162 @@ func ExprForSpan(span Span, tight bool) *SpanExpression {
 	}
 }
 
+// EmptySpanExpression returns a SpanExpression that matches no rows, such as
+// the expression of a geospatial predicate on an empty shape. It has no spans
+// and no children, so evaluating it does not require reading the inverted
+// index at all, and a scan that it constrains can be skipped. This differs from
+// NonInvertedColExpression, which represents the absence of a constraint on
+// the inverted column, and requires reading all of it. See IsEmpty.
+//
+// The expression is tight, since no row needs to be re-evaluated.
+func EmptySpanExpression() *SpanExpression {
+	return &SpanExpression{Tight: true}
+}
+
+// UnconstrainedSpanExpression returns a SpanExpression that does not constrain
+// the inverted column, because the given span covers all of its keys, such as
+// the expression of a geospatial predicate whose covering is the whole key
+// space of the index. Evaluating it requires reading all of the inverted index,
+// so the optimizer should prefer another access path. Unlike
+// NonInvertedColExpression, it is a SpanExpression that can be combined with
+// others: it is the identity of intersections and absorbs unions.
+//
+// The expression is not tight, since the rows that it matches must be
+// re-evaluated.
+func UnconstrainedSpanExpression(span Span) *SpanExpression {
+	spans := Spans{span}
+	return &SpanExpression{
+		SpansToRead:        spans,
+		FactoredUnionSpans: spans,
+		Unconstrained:      true,
+	}
+}
+
+// IsEmpty returns true if the SpanExpression matches no rows because it has no
+// FactoredUnionSpans and no children, like the expressions returned by
+// EmptySpanExpression. And returns an empty expression if either of its
+// operands is empty, and Or returns the other operand.
+func (s *SpanExpression) IsEmpty() bool {
+	return s.Operator == None && len(s.FactoredUnionSpans) == 0
+}
+
+// IsEmpty returns true if the SpanExpressionProto was built from an empty
+// SpanExpression (see SpanExpression.IsEmpty), so that it matches no rows.
+func (s *SpanExpressionProto) IsEmpty() bool {
+	return s.Node.Operator == None && len(s.Node.FactoredUnionSpans) == 0
+}
+
+// AtLeastK constructs a SpanExpression that contains the keys contained in at
+// least k of the operands, for approximate predicates that require a row to
+// match at least k of the operands, such as a trigram similarity predicate.
+// Expressing such a predicate as a tree of unions and intersections would
+// require a number of nodes that is combinatorial in k. The spans of each
+// operand must be non-overlapping and sorted, and the operands are not
+// copied. k must be between 1 and len(operands).
+//
+// The expression is tight, since it represents the keys of the operands
+// exactly, so callers must call SetNotTight if they use it to approximate a
+// predicate.
+func AtLeastK(k int, operands [][]Span) *SpanExpression {
+	if k < 1 || k > len(operands) {
+		panic(errors.AssertionFailedf("invalid k %d for %d operands", k, len(operands)))
+	}
+	expr := &SpanExpression{
+		Tight:    true,
+		Operator: SetAtLeast,
+		K:        k,
+		Operands: make([]Spans, len(operands)),
+	}
+	for i := range operands {
+		expr.Operands[i] = operands[i]
+		expr.SpansToRead = unionSpans(expr.SpansToRead, operands[i])
+	}
+	return expr
+}
+
+// ExpandAtLeast returns an expression that is equivalent to expr, in which
+// every SetAtLeast node is replaced by the equivalent tree of unions and
+// intersections of its operands, for the consumers that cannot evaluate
+// SetAtLeast nodes, such as the nodes of a mixed-version cluster that predate
+// the operator. The expanded tree of a node with k of n operands has a number
+// of nodes that is combinatorial in k, see AtLeastK, so the operator should be
+// used whenever the consumers support it. expr is returned as is if it has no
+// SetAtLeast nodes, and is never modified. The SpansToRead of the returned
+// expression are complete, see PartialSpansToRead.
+func ExpandAtLeast(expr *SpanExpression) *SpanExpression {
+	if !expr.hasAtLeast() {
+		return expr
+	}
+	res := expr.Copy().(*SpanExpression)
+	res.expandAtLeast()
+	res.SpansToRead, res.PartialSpansToRead = res.nodeSpansToRead(), false
+	return res
+}
+
+// hasAtLeast returns true if the SpanExpression or any of its descendants is a
+// SetAtLeast node.
+func (s *SpanExpression) hasAtLeast() bool {
+	if s.Operator == SetAtLeast {
+		return true
+	}
+	for _, child := range []Expression{s.Left, s.Right} {
+		if c, ok := child.(*SpanExpression); ok && c != nil && c.hasAtLeast() {
+			return true
+		}
+	}
+	return false
+}
+
+// expandAtLeast implements ExpandAtLeast in place, on a copy of the tree.
+func (s *SpanExpression) expandAtLeast() {
+	switch s.Operator {
+	case SetUnion, SetIntersection:
+		for _, child := range []Expression{s.Left, s.Right} {
+			if c, ok := child.(*SpanExpression); ok {
+				c.expandAtLeast()
+			}
+		}
+	case SetAtLeast:
+		// The node is the union of its FactoredUnionSpans and of the expanded
+		// tree, whose FactoredUnionSpans are factored into those of the node.
+		expanded := atLeastKTree(s.K, s.Operands)
+		s.FactoredUnionSpans = unionSpans(s.FactoredUnionSpans, expanded.FactoredUnionSpans)
+		s.Operator, s.Left, s.Right = expanded.Operator, expanded.Left, expanded.Right
+		s.K, s.Operands = 0, nil
+	}
+	s.InvalidateCaches()
+}
+
+// atLeastKTree returns the tree of unions and intersections of the operands
+// that contains the keys contained in at least k of them, using the fact that
+// a key is in at least k of the operands if it is in the first one and in at
+// least k-1 of the others, or in at least k of the others.
+func atLeastKTree(k int, operands []Spans) *SpanExpression {
+	leaf := func(spans Spans) *SpanExpression {
+		return &SpanExpression{Tight: true, SpansToRead: spans, FactoredUnionSpans: spans}
+	}
+	if k == len(operands) {
+		expr := leaf(operands[0])
+		for _, operand := range operands[1:] {
+			expr = And(expr, leaf(operand)).(*SpanExpression)
+		}
+		return expr
+	}
+	if k == 1 {
+		expr := leaf(operands[0])
+		for _, operand := range operands[1:] {
+			expr = Or(expr, leaf(operand)).(*SpanExpression)
+		}
+		return expr
+	}
+	first := And(leaf(operands[0]), atLeastKTree(k-1, operands[1:]))
+	return Or(first, atLeastKTree(k, operands[1:])).(*SpanExpression)
+}
+
 // ContainsKeys traverses the SpanExpression to determine whether the span
 // expression contains the given keys. It is primarily used for testing.
 func (s *SpanExpression) ContainsKeys(keys [][]byte) (bool, error) {
-	if s.Operator == None && len(s.FactoredUnionSpans) == 0 {
+	if s.IsEmpty() {
 		return false, nil
 	}
 
@@ -547,6 +1712,19 @@ func (s *SpanExpression) ContainsKeys(keys [][]byte) (bool, error) {
 		return false, nil
 	}
 
+	if s.Operator == SetAtLeast {
+		n := 0
+		for _, operand := range s.Operands {
+			for _, key := range keys {
+				if operand.ContainsKey(key) {
+					n++
+					break
+				}
+			}
+		}
+		return n >= s.K, nil
+	}
+
 	// This is either a UNION or INTERSECTION.
 	leftRes, err := s.Left.(*SpanExpression).ContainsKeys(keys)
 	if err != nil {
@@ -570,9 +1748,212 @@ func (s *SpanExpression) ContainsKeys(keys [][]byte) (bool, error) {
 	}
 }
 
+// CheckInvariants returns an error if the SpanExpression is not well-formed.
+// It verifies that:
+//   - every span is non-empty, i.e. Start < End, or Start is a maximal key
+//     and the span is equivalent to [Start, Start].
+//   - the SpansToRead of the root, and the FactoredUnionSpans of every node,
+//     are sorted and non-overlapping.
+//   - every node with a union or intersection operator has two non-nil
+//     children, and every other node has none.
+//   - only SetAtLeast nodes have Operands, whose spans are sorted and
+//     non-overlapping, and their K is between 1 and the number of Operands.
+//   - the SpansToRead of the root contain all the FactoredUnionSpans and
+//     Operands of the tree.
+//   - Flattened nodes have no children, and are not tight.
+//   - the Ordering of the root is valid. The order of the FactoredUnionSpans
+//     is not checked, since it depends on the width of the spans, see
+//     CheckOrdering.
+//
+// Children that are not SpanExpressions are not checked. Deferred SpansToRead
+// (see DeferSpansToRead) are checked as if they were materialized, and partial
+// SpansToRead (see PartialSpansToRead) as if they were completed, after
+// checking that they are sorted, non-overlapping and contained in the complete
+// SpansToRead. CheckInvariants is intended to be used in tests, and in
+// crdb_test builds.
+func (s *SpanExpression) CheckInvariants() error {
+	if s.Ordering >= numSpanOrderings {
+		return errors.AssertionFailedf("invalid ordering %s", s.Ordering)
+	}
+	// Check the deferred or partial SpansToRead without materializing them, so
+	// that the check does not change the expression.
+	spansToRead := s.completeSpansToRead()
+	if err := checkSpans(spansToRead); err != nil {
+		return errors.Wrap(err, "invalid SpansToRead")
+	}
+	if s.PartialSpansToRead {
+		if err := checkSpans(s.SpansToRead); err != nil {
+			return errors.Wrap(err, "invalid partial SpansToRead")
+		}
+		for _, span := range s.SpansToRead {
+			if !spansCover(spansToRead, span) {
+				return errors.AssertionFailedf("partial SpansToRead contain span %s outside the tree",
+					formatSpan(span, false /* redactable */))
+			}
+		}
+	}
+	return s.checkNode(spansToRead)
+}
+
+// CheckOrdering returns an error if the FactoredUnionSpans of a node of the
+// SpanExpression are not in its Ordering, given the width of the spans, which
+// is not called for OrderByKey. Children that are not SpanExpressions are not
+// checked. Like CheckInvariants, CheckOrdering is intended to be used in tests,
+// and in crdb_test builds.
+func (s *SpanExpression) CheckOrdering(width func(Span) uint64) error {
+	return s.checkNodeOrdering(s.Ordering, width)
+}
+
+// checkNodeOrdering checks the order of the FactoredUnionSpans of a node of
+// the SpanExpression, given the Ordering of the root.
+func (s *SpanExpression) checkNodeOrdering(ordering SpanOrdering, width func(Span) uint64) error {
+	spans := s.FactoredUnionSpans
+	for i := 1; i < len(spans); i++ {
+		if ordering.CompareSpans(spans[i-1], spans[i], width) > 0 {
+			return errors.AssertionFailedf("spans %s and %s are not ordered by %s",
+				formatSpan(spans[i-1], false /* redactable */),
+				formatSpan(spans[i], false /* redactable */), ordering)
+		}
+	}
+	for _, child := range [2]Expression{s.Left, s.Right} {
+		if c, ok := child.(*SpanExpression); ok && c != nil {
+			if err := c.checkNodeOrdering(ordering, width); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkSpans checks that the spans are non-empty, sorted and non-overlapping.
+func checkSpans(spans Spans) error {
+	for i, span := range spans {
+		if c := -span.CompareEnd(span.Start); c > 0 || (c == 0 && !span.IsSingleVal()) {
+			return errors.AssertionFailedf("empty span %s", formatSpan(span, false /* redactable */))
+		}
+		if i > 0 && spans[i-1].CompareEnd(span.Start) > 0 {
+			return errors.AssertionFailedf("unsorted or overlapping spans %s and %s",
+				formatSpan(spans[i-1], false /* redactable */), formatSpan(span, false /* redactable */))
+		}
+	}
+	return nil
+}
+
+// checkNode checks the invariants of a node of the SpanExpression, given the
+// SpansToRead of the root.
+func (s *SpanExpression) checkNode(spansToRead Spans) error {
+	factoredSpans := s.FactoredUnionSpans
+	if s.UnsortedFactoredUnionSpans {
+		factoredSpans = append(Spans(nil), factoredSpans...)
+		sort.Slice(factoredSpans, func(i, j int) bool {
+			return bytes.Compare(factoredSpans[i].Start, factoredSpans[j].Start) < 0
+		})
+	}
+	if err := checkSpans(factoredSpans); err != nil {
+		return errors.Wrap(err, "invalid FactoredUnionSpans")
+	}
+	for _, span := range s.FactoredUnionSpans {
+		if !spansCover(spansToRead, span) {
+			return errors.AssertionFailedf("SpansToRead do not contain factored span %s",
+				formatSpan(span, false /* redactable */))
+		}
+	}
+	if s.Operator != SetAtLeast && (s.K != 0 || s.Operands != nil) {
+		return errors.AssertionFailedf("%v node has operands", s.Operator)
+	}
+	if s.Unconstrained && s.Operator != None {
+		return errors.AssertionFailedf("unconstrained %v node", s.Operator)
+	}
+	if s.Flattened && s.Operator != None {
+		return errors.AssertionFailedf("flattened %v node", s.Operator)
+	}
+	if s.Flattened && s.Tight {
+		return errors.AssertionFailedf("flattened node is tight")
+	}
+	switch s.Operator {
+	case None:
+		if s.Left != nil || s.Right != nil {
+			return errors.AssertionFailedf("node without operator has children")
+		}
+		return nil
+	case SetAtLeast:
+		if s.Left != nil || s.Right != nil {
+			return errors.AssertionFailedf("%v node has children", s.Operator)
+		}
+		if s.K < 1 || s.K > len(s.Operands) {
+			return errors.AssertionFailedf("invalid K %d for %d operands", s.K, len(s.Operands))
+		}
+		for _, operand := range s.Operands {
+			if err := checkSpans(operand); err != nil {
+				return errors.Wrap(err, "invalid Operands")
+			}
+			for _, span := range operand {
+				if !spansCover(spansToRead, span) {
+					return errors.AssertionFailedf("SpansToRead do not contain operand span %s",
+						formatSpan(span, false /* redactable */))
+				}
+			}
+		}
+		return nil
+	case SetUnion, SetIntersection:
+	default:
+		return errors.AssertionFailedf("invalid operator %v", s.Operator)
+	}
+	for _, child := range []Expression{s.Left, s.Right} {
+		switch c := child.(type) {
+		case nil:
+			return errors.AssertionFailedf("%v node has a nil child", s.Operator)
+		case *SpanExpression:
+			if c == nil {
+				return errors.AssertionFailedf("%v node has a nil child", s.Operator)
+			}
+			if err := c.checkNode(spansToRead); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// spansCover returns true if the union of spans contains span. The spans must
+// be sorted and non-overlapping, but may be contiguous.
+func spansCover(spans Spans, span Span) bool {
+	i := spans.Find(span.Start)
+	if i < 0 {
+		return false
+	}
+	cover := spans[i]
+	for !cover.ContainsSpan(span) {
+		if i+1 == len(spans) || spans[i].CompareEnd(spans[i+1].Start) != 0 {
+			return false
+		}
+		i++
+		cover.SetEndFrom(spans[i])
+	}
+	return true
+}
+
 // And of two boolean expressions. This function may modify both the left and
-// right Expressions.
+// right Expressions. If either of them is an empty SpanExpression, the result
+// is that expression, since it matches no rows. If either of them is an
+// unconstrained SpanExpression (see UnconstrainedSpanExpression), the result
+// is the other expression, which is not tight unless both are.
 func And(left, right Expression) Expression {
+	if isEmptyExpression(left) {
+		return left
+	}
+	if isEmptyExpression(right) {
+		return right
+	}
+	if isUnconstrainedExpression(left) {
+		left, right = right, left
+	}
+	if isUnconstrainedExpression(right) {
+		if !right.IsTight() {
+			left.SetNotTight()
+		}
+		return left
+	}
 	switch l := left.(type) {
 	case *SpanExpression:
 		switch r := right.(type) {
@@ -606,8 +1987,30 @@ func And(left, right Expression) Expression {
 }
 
 // Or of two boolean expressions. This function may modify both the left and
-// right Expressions.
+// right Expressions. If either of them is an empty SpanExpression, the result
+// is the other Expression. If either of them is an unconstrained
+// SpanExpression (see UnconstrainedSpanExpression), the result is that
+// expression, which is not tight unless both are, or the other Expression if
+// it is a NonInvertedColExpression.
 func Or(left, right Expression) Expression {
+	if isEmptyExpression(left) {
+		return right
+	}
+	if isEmptyExpression(right) {
+		return left
+	}
+	if isUnconstrainedExpression(right) {
+		left, right = right, left
+	}
+	if isUnconstrainedExpression(left) {
+		if _, ok := right.(NonInvertedColExpression); ok {
+			return right
+		}
+		if !right.IsTight() {
+			left.SetNotTight()
+		}
+		return left
+	}
 	switch l := left.(type) {
 	case *SpanExpression:
 		switch r := right.(type) {
@@ -637,6 +2040,19 @@ func Or(left, right Expression) Expression {
 	}
 }
 
+// isEmptyExpression returns true if expr is an empty SpanExpression.
+func isEmptyExpression(expr Expression) bool {
+	s, ok := expr.(*SpanExpression)
+	return ok && s.IsEmpty()
+}
+
+// isUnconstrainedExpression returns true if expr is an unconstrained
+// SpanExpression.
+func isUnconstrainedExpression(expr Expression) bool {
+	s, ok := expr.(*SpanExpression)
+	return ok && s.Unconstrained
+}
+
 // Helper that applies op to a left-side that is a *SpanExpression and
 // a right-side that is an unknown implementation of Expression.
 func opSpanExpressionAndDefault(
@@ -646,7 +2062,7 @@ func opSpanExpressionAndDefault(
 		Tight: left.IsTight() && right.IsTight(),
 		// The SpansToRead is a lower-bound in this case. Note that
 		// such an expression is only used for Join costing.
-		SpansToRead: left.SpansToRead,
+		SpansToRead: left.MaterializeSpansToRead(),
 		Operator:    op,
 		Left:        left,
 		Right:       right,
@@ -656,6 +2072,7 @@ func opSpanExpressionAndDefault(
 		// about the right-side.
 		expr.FactoredUnionSpans = left.FactoredUnionSpans
 		left.FactoredUnionSpans = nil
+		left.InvalidateCaches()
 	}
 	// Else SetIntersection -- we can't factor anything if one side is
 	// unknown.
@@ -675,7 +2092,7 @@ func intersectSpanExpressions(left, right *SpanExpression) *SpanExpression {
 		// what would be computed if a caller traversed the tree and explicitly
 		// unioned all the FactoredUnionSpans, and no looser, since the execution
 		// code path relies on this property.)
-		SpansToRead:        unionSpans(left.SpansToRead, right.SpansToRead),
+		SpansToRead:        unionSpans(left.MaterializeSpansToRead(), right.MaterializeSpansToRead()),
 		FactoredUnionSpans: intersectSpans(left.FactoredUnionSpans, right.FactoredUnionSpans),
 		Operator:           SetIntersection,
 		Left:               left,
@@ -684,6 +2101,8 @@ func intersectSpanExpressions(left, right *SpanExpression) *SpanExpression {
 	if expr.FactoredUnionSpans != nil {
 		left.FactoredUnionSpans = subtractSpans(left.FactoredUnionSpans, expr.FactoredUnionSpans)
 		right.FactoredUnionSpans = subtractSpans(right.FactoredUnionSpans, expr.FactoredUnionSpans)
+		left.InvalidateCaches()
+		right.InvalidateCaches()
 	}
 	tryPruneChildren(expr)
 	return expr
@@ -696,7 +2115,7 @@ func unionSpanExpressions(left, right *SpanExpression) *SpanExpression {
 		// Whenever one side is empty, we keep the Unique property from the
 		// other side.
 		Unique:             (left.Unique && len(right.FactoredUnionSpans) == 0) || (right.Unique && len(left.FactoredUnionSpans) == 0),
-		SpansToRead:        unionSpans(left.SpansToRead, right.SpansToRead),
+		SpansToRead:        unionSpans(left.MaterializeSpansToRead(), right.MaterializeSpansToRead()),
 		FactoredUnionSpans: unionSpans(left.FactoredUnionSpans, right.FactoredUnionSpans),
 		Operator:           SetUnion,
 		Left:               left,
@@ -704,6 +2123,8 @@ func unionSpanExpressions(left, right *SpanExpression) *SpanExpression {
 	}
 	left.FactoredUnionSpans = nil
 	right.FactoredUnionSpans = nil
+	left.InvalidateCaches()
+	right.InvalidateCaches()
 	tryPruneChildren(expr)
 	return expr
 }
@@ -711,13 +2132,10 @@ func unionSpanExpressions(left, right *SpanExpression) *SpanExpression {
 // tryPruneChildren takes an expr with two child *SpanExpression and removes
 // children when safe to do so.
 func tryPruneChildren(expr *SpanExpression) {
-	isEmptyExpr := func(e *SpanExpression) bool {
-		return len(e.FactoredUnionSpans) == 0 && e.Left == nil && e.Right == nil
-	}
-	if isEmptyExpr(expr.Left.(*SpanExpression)) {
+	if expr.Left.(*SpanExpression).IsEmpty() {
 		expr.Left = nil
 	}
-	if isEmptyExpr(expr.Right.(*SpanExpression)) {
+	if expr.Right.(*SpanExpression).IsEmpty() {
 		expr.Right = nil
 	}
 	if expr.Operator == SetUnion {
@@ -730,6 +2148,8 @@ func tryPruneChildren(expr *SpanExpression) {
 			expr.Operator = child.Operator
 			expr.Left = child.Left
 			expr.Right = child.Right
+			expr.K = child.K
+			expr.Operands = child.Operands
 
 			// If child.FactoredUnionSpans is non-empty, we need to recalculate
 			// SpansToRead since it may have contained some spans that were
@@ -742,6 +2162,9 @@ func tryPruneChildren(expr *SpanExpression) {
 				if expr.Right != nil {
 					expr.SpansToRead = unionSpans(expr.SpansToRead, expr.Right.(*SpanExpression).SpansToRead)
 				}
+				for _, operand := range expr.Operands {
+					expr.SpansToRead = unionSpans(expr.SpansToRead, operand)
+				}
 			}
 		}
 		promoteLeft := expr.Left != nil && expr.Right == nil
@@ -761,7 +2184,7 @@ func tryPruneChildren(expr *SpanExpression) {
 			expr.Left = nil
 		}
 	}
-	if expr.Left == nil && expr.Right == nil {
+	if expr.Left == nil && expr.Right == nil && expr.Operator != SetAtLeast {
 		expr.Operator = None
 		expr.SpansToRead = expr.FactoredUnionSpans
 	}
@@ -864,12 +2287,12 @@ func intersectSpans(left []Span, right []Span) []Span {
 		cmpEndStart := cmpExcEndWithIncStart(mergeSpan, right[j])
 		if cmpEndStart > 0 {
 			// The intersection of these spans is non-empty.
-			mergeSpan.Start = right[j].Start
-			mergeSpanEnd := mergeSpan.End
+			mergeSpan.setStart(right[j].Start)
+			mergeSpanEnd := mergeSpan
 			cmpEnds := cmpEnds(mergeSpan, right[j])
 			if cmpEnds > 0 {
 				// The right span constrains the end of the intersection.
-				mergeSpan.End = right[j].End
+				mergeSpan.SetEndFrom(right[j])
 			}
 			// Else the mergeSpan is not constrained by the right span,
 			// so it is already ready to be appended to the output.
@@ -886,8 +2309,8 @@ func intersectSpans(left []Span, right []Span) []Span {
 				// have a start <= the next span from the left and it has
 				// something leftover.
 				i++
-				mergeSpan.Start = mergeSpan.End
-				mergeSpan.End = right[j].End
+				mergeSpan = Span{Start: mergeSpan.EndKey()}
+				mergeSpan.SetEndFrom(right[j])
 				swapLeftRight()
 			} else if cmpEnds == 0 {
 				// Both spans end at the same key, so both are consumed.
@@ -898,8 +2321,8 @@ func intersectSpans(left []Span, right []Span) []Span {
 				// The right span constrained the end of the intersection.
 				// So there is something left of the original mergeSpan.
 				j++
-				mergeSpan.Start = mergeSpan.End
-				mergeSpan.End = mergeSpanEnd
+				mergeSpan = Span{Start: mergeSpan.EndKey()}
+				mergeSpan.SetEndFrom(mergeSpanEnd)
 			}
 		} else {
 			// Intersection is empty
@@ -939,7 +2362,7 @@ func subtractSpans(left []Span, right []Span) []Span {
 				// There is some part of mergeSpan before the right span starts. Add it
 				// to the output.
 				out = append(out, Span{Start: mergeSpan.Start, End: right[j].Start})
-				mergeSpan.Start = right[j].Start
+				mergeSpan.setStart(right[j].Start)
 			}
 			// Else cmpStart == 0, since the right side is a subset of the left.
 
@@ -954,7 +2377,7 @@ func subtractSpans(left []Span, right []Span) []Span {
 			}
 
 			// Invariant: cmpEnd > 0, since the right side is a subset of the left.
-			mergeSpan.Start = right[j].End
+			mergeSpan.setStart(right[j].EndKey())
 			j++
 		} else {
 			// Right span starts after mergeSpan ends.
@@ -978,7 +2401,7 @@ func subtractSpans(left []Span, right []Span) []Span {
 // [a, a\x00), [a, c) == +1
 // [a, c), [d, e) == -1
 func cmpExcEndWithIncStart(left, right Span) int {
-	return bytes.Compare(left.End, right.Start)
+	return left.CompareEnd(right.Start)
 }
 
 // Extends the left span using the right span. Will return true iff
@@ -987,13 +2410,13 @@ func cmpExcEndWithIncStart(left, right Span) int {
 func extendSpanEnd(left *Span, right Span, cmpExcEndIncStart int) bool {
 	if cmpExcEndIncStart == 0 {
 		// Definitely extends.
-		left.End = right.End
+		left.SetEndFrom(right)
 		return true
 	}
 	// cmpExcEndIncStart > 0, so left covers at least right.start. But may not
 	// cover right.end.
-	if bytes.Compare(left.End, right.End) < 0 {
-		left.End = right.End
+	if left.CompareEnds(right) < 0 {
+		left.SetEndFrom(right)
 		return true
 	}
 	return false
@@ -1001,7 +2424,7 @@ func extendSpanEnd(left *Span, right Span, cmpExcEndIncStart int) bool {
 
 // Compares the end keys of left and right.
 func cmpEnds(left, right Span) int {
-	return bytes.Compare(left.End, right.End)
+	return left.CompareEnds(right)
 }
 
 // Representing multi-column constraints
@@ -11,16 +11,22 @@
 package inverted
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
+	"math"
 	"math/rand"
+	"sort"
 	"strings"
 	"testing"
 
 	"github.com/cockroachdb/cockroach/pkg/testutils/datapathutils"
 	"github.com/cockroachdb/cockroach/pkg/util/encoding"
 	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/randutil"
 	"github.com/cockroachdb/cockroach/pkg/util/treeprinter"
 	"github.com/cockroachdb/datadriven"
+	"github.com/cockroachdb/errors"
 	"github.com/gogo/protobuf/proto"
 	"github.com/stretchr/testify/require"
 )
@@ -123,7 +129,8 @@ func getExprCopy(
 
 func toString(expr Expression) string {
 	tp := treeprinter.New()
-	formatExpression(tp, expr, true /* includeSpansToRead */, false /* redactable */)
+	formatExpression(
+		tp, expr, UnknownIndexKind, true /* includeSpansToRead */, false /* redactable */)
 	return tp.String()
 }
 
@@ -486,3 +493,1165 @@ func TestContainsKeys(t *testing.T) {
 		})
 	}
 }
+
+func TestCheckInvariants(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	leaf := func(spans ...Span) *SpanExpression {
+		return &SpanExpression{FactoredUnionSpans: spans}
+	}
+	maxKey := string([]byte{0xff, 0xff})
+	tests := []struct {
+		name     string
+		expr     *SpanExpression
+		expected string
+	}{
+		{
+			name: "valid",
+			expr: &SpanExpression{
+				SpansToRead:        []Span{span("a", "c"), span("c", "g"), single(maxKey)},
+				FactoredUnionSpans: []Span{span("a", "b"), single(maxKey)},
+				Operator:           SetIntersection,
+				Left:               leaf(span("b", "e")),
+				Right:              &UnknownExpression{},
+			},
+		},
+		{
+			name: "empty span",
+			expr: &SpanExpression{
+				SpansToRead:        []Span{span("a", "c")},
+				FactoredUnionSpans: []Span{span("b", "b")},
+			},
+			expected: "invalid FactoredUnionSpans: empty span",
+		},
+		{
+			name: "inverted span",
+			expr: &SpanExpression{
+				SpansToRead: []Span{span("c", "a")},
+			},
+			expected: "invalid SpansToRead: empty span",
+		},
+		{
+			name: "unsorted",
+			expr: &SpanExpression{
+				SpansToRead:        []Span{span("a", "z")},
+				FactoredUnionSpans: []Span{span("d", "e"), span("a", "b")},
+			},
+			expected: "invalid FactoredUnionSpans: unsorted or overlapping spans",
+		},
+		{
+			name: "marked unsorted",
+			expr: &SpanExpression{
+				SpansToRead:                []Span{span("a", "z")},
+				FactoredUnionSpans:         []Span{span("d", "e"), span("a", "b")},
+				UnsortedFactoredUnionSpans: true,
+			},
+		},
+		{
+			name: "flattened",
+			expr: &SpanExpression{
+				SpansToRead:        []Span{span("a", "c")},
+				FactoredUnionSpans: []Span{span("a", "c")},
+				Flattened:          true,
+			},
+		},
+		{
+			name: "flattened with children",
+			expr: &SpanExpression{
+				SpansToRead: []Span{span("a", "c")},
+				Flattened:   true,
+				Operator:    SetUnion,
+				Left:        leaf(span("a", "b")),
+				Right:       leaf(span("b", "c")),
+			},
+			expected: "flattened SetUnion node",
+		},
+		{
+			name: "marked unsorted and overlapping",
+			expr: &SpanExpression{
+				SpansToRead:                []Span{span("a", "z")},
+				FactoredUnionSpans:         []Span{span("d", "e"), span("a", "e")},
+				UnsortedFactoredUnionSpans: true,
+			},
+			expected: "invalid FactoredUnionSpans: unsorted or overlapping spans",
+		},
+		{
+			name: "overlapping",
+			expr: &SpanExpression{
+				SpansToRead: []Span{span("a", "z")},
+				Operator:    SetUnion,
+				Left:        leaf(span("a", "c"), span("b", "d")),
+				Right:       leaf(span("e", "f")),
+			},
+			expected: "invalid FactoredUnionSpans: unsorted or overlapping spans",
+		},
+		{
+			name: "overlapping spans to read",
+			expr: &SpanExpression{
+				SpansToRead: []Span{span("a", "c"), span("b", "d")},
+			},
+			expected: "invalid SpansToRead: unsorted or overlapping spans",
+		},
+		{
+			name: "nil child",
+			expr: &SpanExpression{
+				Operator: SetUnion,
+				Left:     leaf(),
+			},
+			expected: "SetUnion node has a nil child",
+		},
+		{
+			name: "nil SpanExpression child",
+			expr: &SpanExpression{
+				Operator: SetIntersection,
+				Left:     (*SpanExpression)(nil),
+				Right:    leaf(),
+			},
+			expected: "SetIntersection node has a nil child",
+		},
+		{
+			name: "children without operator",
+			expr: &SpanExpression{
+				Left:  leaf(),
+				Right: leaf(),
+			},
+			expected: "node without operator has children",
+		},
+		{
+			name: "spans to read do not cover",
+			expr: &SpanExpression{
+				SpansToRead: []Span{span("a", "c"), span("d", "g")},
+				Operator:    SetIntersection,
+				Left:        leaf(span("b", "e")),
+				Right:       leaf(span("e", "f")),
+			},
+			expected: "SpansToRead do not contain factored span",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.expr.CheckInvariants()
+			if tt.expected == "" {
+				require.NoError(t, err)
+			} else {
+				require.ErrorContains(t, err, tt.expected)
+			}
+		})
+	}
+}
+
+func TestSpanExpressionStats(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	left := &SpanExpression{FactoredUnionSpans: []Span{single("a"), span("b", "d")}}
+	right := &SpanExpression{
+		FactoredUnionSpans: []Span{single("x")},
+		Operator:           SetUnion,
+		Left:               &SpanExpression{FactoredUnionSpans: []Span{span("m", "o")}},
+		Right:              &UnknownExpression{},
+	}
+	expr := &SpanExpression{
+		Operator: SetIntersection,
+		Left:     left,
+		Right:    right,
+	}
+	require.Equal(t, SpanExprStats{
+		NumNodes:         4,
+		Depth:            3,
+		NumFactoredSpans: 4,
+		NumPointSpans:    2,
+		NumRangeSpans:    2,
+		MinNodeSpans:     0,
+		MaxNodeSpans:     2,
+		NumUnions:        1,
+		NumIntersections: 1,
+	}, expr.Stats())
+	require.Equal(t, SpanExprStats{
+		NumNodes:         1,
+		Depth:            1,
+		NumFactoredSpans: 2,
+		NumPointSpans:    1,
+		NumRangeSpans:    1,
+		MinNodeSpans:     2,
+		MaxNodeSpans:     2,
+	}, left.Stats())
+
+	// The cached statistics are invalidated when the children are modified by
+	// Or.
+	expr2 := Or(left, &SpanExpression{FactoredUnionSpans: []Span{single("a")}}).(*SpanExpression)
+	require.Equal(t, 0, left.Stats().NumFactoredSpans)
+	require.Equal(t, expr2.Stats().NumFactoredSpans, len(expr2.FactoredUnionSpans))
+
+	// Direct modifications of the fields are only reflected once the cached
+	// statistics are invalidated.
+	left.FactoredUnionSpans = []Span{single("b")}
+	require.Equal(t, 0, left.Stats().NumPointSpans)
+	left.InvalidateCaches()
+	require.Equal(t, 1, left.Stats().NumPointSpans)
+}
+
+func TestSpanExpressionSummaryString(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	leaf := func(spans ...Span) *SpanExpression {
+		return &SpanExpression{Tight: true, SpansToRead: spans, FactoredUnionSpans: spans}
+	}
+	testCases := []struct {
+		expr     *SpanExpression
+		keys     uint64
+		expected string
+	}{
+		{
+			expr:     leaf(single("a")),
+			keys:     1,
+			expected: "union of 1 span over 1 level; 0 intersections; est. 1 key",
+		},
+		{
+			// The keys of [b\x00, b\x10) differ in their last byte.
+			expr: Or(leaf(single("a")), leaf(span("b\x00", "b\x10"))).(*SpanExpression),
+			keys: 17,
+			expected: "union of 2 spans over 1 level; 0 intersections; " +
+				"est. 17 keys",
+		},
+		{
+			expr: And(
+				leaf(span("a\x00\x00", "a\x01\x00")), leaf(span("a\x00\x80", "a\x02\x00")),
+			).(*SpanExpression),
+			keys: 512,
+			expected: "union of 3 spans over 2 levels; 1 intersection; " +
+				"est. 512 keys",
+		},
+		{
+			// The keys of [a, bb) have different lengths.
+			expr:     Or(leaf(span("a", "bb")), leaf(single("c"))).(*SpanExpression),
+			expected: "union of 2 spans over 1 level; 0 intersections",
+		},
+		{
+			expr: And(
+				AtLeastK(2, [][]Span{{single("a")}, {single("b")}, {single("c")}}),
+				leaf(span("a", "d")),
+			).(*SpanExpression),
+			keys: 3,
+			expected: "union of 1 span over 2 levels; 1 intersection; " +
+				"1 at-least-k operation; est. 3 keys",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.expected, func(t *testing.T) {
+			require.Equal(t, tc.expected, tc.expr.SummaryString())
+			keys, ok := tc.expr.EstimatedKeys()
+			require.Equal(t, tc.keys != 0, ok)
+			require.Equal(t, tc.keys, keys)
+		})
+	}
+
+	// The estimate saturates.
+	maxSpan := span("\x00\x00\x00\x00\x00\x00\x00\x00", "\xff\xff\xff\xff\xff\xff\xff\xff")
+	keys, ok := leaf(maxSpan, span("a\x00", "a\x02")).EstimatedKeys()
+	require.True(t, ok)
+	require.Equal(t, uint64(math.MaxUint64), keys)
+	// The keys of the span differ in more than their last 8 bytes.
+	wideSpan := span("\x00\x00\x00\x00\x00\x00\x00\x00\x00", "\x01\x00\x00\x00\x00\x00\x00\x00\x00")
+	_, ok = leaf(wideSpan).EstimatedKeys()
+	require.False(t, ok)
+}
+
+func TestEmptySpanExpression(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	leaf := func(spans ...Span) *SpanExpression {
+		return &SpanExpression{Tight: true, SpansToRead: spans, FactoredUnionSpans: spans}
+	}
+	empty := EmptySpanExpression()
+	require.True(t, empty.IsEmpty())
+	require.True(t, empty.IsTight())
+	require.NoError(t, empty.CheckInvariants())
+	require.False(t, leaf(single("a")).IsEmpty())
+	require.False(t, AtLeastK(1, [][]Span{{single("a")}}).IsEmpty())
+	require.Equal(t, `empty span expression
+ ├── tight: true, unique: false
+ ├── to read: empty
+ ├── union spans: empty
+ └── stats: nodes: 1, depth: 1, spans: 0 (points: 0, ranges: 0), spans per node: [0, 0]
+`, empty.String())
+	require.Equal(t, "empty; matches no rows", empty.SummaryString())
+	contains, err := empty.ContainsKeys([][]byte{[]byte("a")})
+	require.NoError(t, err)
+	require.False(t, contains)
+
+	// And with an empty expression is empty, and Or with an empty expression
+	// is the other expression, whatever its type.
+	others := []Expression{
+		leaf(single("a")),
+		And(leaf(single("a")), leaf(span("a", "c"))),
+		NonInvertedColExpression{},
+	}
+	for _, other := range others {
+		require.Same(t, empty, And(empty, other))
+		require.Same(t, empty, And(other.Copy(), empty))
+		require.Equal(t, other, Or(empty, other))
+		require.Equal(t, other, Or(other, empty))
+	}
+	// An intersection whose children are disjoint is not recognized as empty.
+	require.False(t, And(leaf(single("a")), leaf(single("b"))).(*SpanExpression).IsEmpty())
+
+	// The proto round trips.
+	exprProto := empty.ToProto()
+	require.True(t, exprProto.IsEmpty())
+	require.False(t, leaf(single("a")).ToProto().IsEmpty())
+	b, err := proto.Marshal(exprProto)
+	require.NoError(t, err)
+	var decoded SpanExpressionProto
+	require.NoError(t, proto.Unmarshal(b, &decoded))
+	require.True(t, decoded.IsEmpty())
+	require.Empty(t, decoded.SpansToRead)
+}
+
+func TestUnconstrainedSpanExpression(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	leaf := func(spans ...Span) *SpanExpression {
+		return &SpanExpression{Tight: true, SpansToRead: spans, FactoredUnionSpans: spans}
+	}
+	all := span("", "z")
+	unconstrained := func() *SpanExpression { return UnconstrainedSpanExpression(all) }
+	u := unconstrained()
+	require.True(t, u.Unconstrained)
+	require.False(t, u.IsTight())
+	require.False(t, u.IsEmpty())
+	require.NoError(t, u.CheckInvariants())
+	require.True(t, u.Copy().(*SpanExpression).Unconstrained)
+	require.True(t, u.Detach().Unconstrained)
+	contains, err := u.ContainsKeys([][]byte{[]byte("a")})
+	require.NoError(t, err)
+	require.True(t, contains)
+
+	// And with an unconstrained expression is the other expression, which is
+	// no longer tight, and Or with an unconstrained expression is the
+	// unconstrained expression, unless the other is a NonInvertedColExpression.
+	for _, other := range []func() Expression{
+		func() Expression { return leaf(single("a")) },
+		func() Expression { return And(leaf(single("a")), leaf(span("a", "c"))) },
+		func() Expression { return &UnknownExpression{tight: true} },
+	} {
+		o := other()
+		require.Same(t, o, And(unconstrained(), o))
+		require.False(t, o.IsTight())
+		o = other()
+		require.Same(t, o, And(o, unconstrained()))
+		require.False(t, o.IsTight())
+		u := unconstrained()
+		require.Same(t, u, Or(u, other()))
+		u = unconstrained()
+		require.Same(t, u, Or(other(), u))
+	}
+	require.Equal(t, NonInvertedColExpression{}, And(unconstrained(), NonInvertedColExpression{}))
+	require.Equal(t, NonInvertedColExpression{}, Or(NonInvertedColExpression{}, unconstrained()))
+	empty := EmptySpanExpression()
+	require.Same(t, empty, And(unconstrained(), empty))
+	u = unconstrained()
+	require.Same(t, u, Or(empty, u))
+
+	// Only expressions without children may be unconstrained.
+	invalid := And(leaf(single("a")), leaf(single("b"))).(*SpanExpression)
+	invalid.Unconstrained = true
+	require.Error(t, invalid.CheckInvariants())
+}
+
+func TestSpansFind(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	maxKey := string([]byte{0xff, 0xff})
+	spans := Spans{span("b", "d"), single("d"), span("f", "h"), single(maxKey)}
+	for _, tc := range []struct {
+		key      string
+		expected int
+	}{
+		{key: "a", expected: -1},
+		// Start is inclusive.
+		{key: "b", expected: 0},
+		{key: "c", expected: 0},
+		// End is exclusive.
+		{key: "d", expected: 1},
+		// The end of a single value span is the PrefixEnd of the value.
+		{key: "d\x00", expected: 1},
+		{key: "e", expected: -1},
+		{key: "f", expected: 2},
+		{key: "g\xff", expected: 2},
+		{key: "h", expected: -1},
+		{key: string([]byte{0xff}), expected: -1},
+		// The end of a span on a maximal key is not greater than its start.
+		{key: maxKey, expected: 3},
+		{key: maxKey + "\x00", expected: -1},
+	} {
+		key := EncVal(tc.key)
+		require.Equal(t, tc.expected, spans.Find(key), "key %q", tc.key)
+		require.Equal(t, tc.expected >= 0, spans.ContainsKey(key), "key %q", tc.key)
+		for i := range spans {
+			require.Equal(t, i == tc.expected, spans[i].ContainsKey(key), "key %q", tc.key)
+		}
+	}
+	require.Equal(t, -1, Spans(nil).Find(EncVal("a")))
+}
+
+func TestSpanContainsSpan(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	require.True(t, span("b", "f").ContainsSpan(span("b", "f")))
+	require.True(t, span("b", "f").ContainsSpan(span("c", "e")))
+	require.True(t, span("b", "f").ContainsSpan(single("e")))
+	require.False(t, span("b", "f").ContainsSpan(single("f")))
+	require.False(t, span("b", "f").ContainsSpan(span("a", "c")))
+	require.False(t, span("b", "f").ContainsSpan(span("e", "g")))
+	require.True(t, single("b").ContainsSpan(single("b")))
+	require.False(t, single("b").ContainsSpan(span("b", "c\x00")))
+}
+
+func TestSpanExpressionDetach(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	// The keys of all the spans share a single buffer.
+	buf := []byte("abcdefgh")
+	key := func(i int) EncVal { return buf[i : i+1 : i+1] }
+	span := func(i, j int) Span { return Span{Start: key(i), End: key(j)} }
+	left := &SpanExpression{FactoredUnionSpans: Spans{span(0, 2)}}
+	right := &SpanExpression{FactoredUnionSpans: Spans{span(1, 3)}}
+	expr := &SpanExpression{
+		SpansToRead:        Spans{span(0, 5)},
+		FactoredUnionSpans: Spans{span(3, 5)},
+		Operator:           SetIntersection,
+		Left:               left,
+		Right: &SpanExpression{
+			Operator: SetUnion, Left: right, Right: NonInvertedColExpression{},
+		},
+	}
+	expected := expr.String()
+	detached := expr.Detach()
+	require.Equal(t, expected, detached.String())
+
+	// Modifying the buffer and the spans of the original expression does not
+	// affect the detached expression.
+	for i := range buf {
+		buf[i] = 'z'
+	}
+	expr.SpansToRead[0] = span(6, 7)
+	left.FactoredUnionSpans = append(left.FactoredUnionSpans[:0], span(6, 7))
+	require.NotEqual(t, expected, expr.String())
+	require.Equal(t, expected, detached.String())
+
+	// Appending to the spans of the detached expression does not overwrite
+	// other spans.
+	detachedLeft := detached.Left.(*SpanExpression)
+	detachedLeft.FactoredUnionSpans = append(detachedLeft.FactoredUnionSpans, span(6, 7))
+	detachedRight := detached.Right.(*SpanExpression).Left.(*SpanExpression)
+	require.True(t, detachedRight.FactoredUnionSpans[0].Equals(
+		Span{Start: EncVal("b"), End: EncVal("d")}))
+}
+
+func TestSpanExpressionToSpanExpressionProto(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	// The keys of all the spans share a single buffer, and the point spans
+	// include a maximal key, whose end key is the start key.
+	buf := []byte("abcdefgh\xff")
+	key := func(i int) EncVal { return buf[i : i+1 : i+1] }
+	span := func(i, j int) Span { return Span{Start: key(i), End: key(j)} }
+	point := func(i int) Span { return MakePointSpan(key(i)) }
+	expr := &SpanExpression{
+		SpansToRead:        Spans{span(0, 5), point(8)},
+		FactoredUnionSpans: Spans{point(8)},
+		Operator:           SetIntersection,
+		Left:               &SpanExpression{FactoredUnionSpans: Spans{span(0, 2), point(3)}},
+		Right:              &SpanExpression{FactoredUnionSpans: Spans{span(1, 5)}},
+	}
+	expected := proto.MarshalTextString(expr.ToProto())
+	referenced := expr.ToSpanExpressionProto(false /* copyKeys */)
+	copied := expr.ToSpanExpressionProto(true /* copyKeys */)
+	require.Equal(t, expected, proto.MarshalTextString(referenced))
+	require.Equal(t, expected, proto.MarshalTextString(copied))
+
+	// Modifying the buffer modifies the proto that references the keys, but
+	// not the proto with copied keys.
+	for i := range buf {
+		buf[i] = 'z'
+	}
+	require.NotEqual(t, expected, proto.MarshalTextString(referenced))
+	require.Equal(t, expected, proto.MarshalTextString(copied))
+	require.Nil(t, (*SpanExpression)(nil).ToSpanExpressionProto(true /* copyKeys */))
+}
+
+func BenchmarkSpanExpressionToSpanExpressionProto(b *testing.B) {
+	// The spans of the expression are a mix of point spans and other spans,
+	// whose keys share a single buffer, like the spans of the expressions
+	// built by the geo converters.
+	const numSpans = 1024
+	keys := make([]byte, 0, 2*numSpans*binary.MaxVarintLen64)
+	var spans Spans
+	for i := 0; i < numSpans; i++ {
+		n := len(keys)
+		keys = encoding.EncodeUvarintAscending(keys, uint64(2*i))
+		start := EncVal(keys[n:len(keys):len(keys)])
+		if i%2 == 0 {
+			spans = append(spans, MakePointSpan(start))
+			continue
+		}
+		n = len(keys)
+		keys = encoding.EncodeUvarintAscending(keys, uint64(2*i+1))
+		spans = append(spans, Span{Start: start, End: keys[n:len(keys):len(keys)]})
+	}
+	expr := &SpanExpression{SpansToRead: spans, FactoredUnionSpans: spans}
+	for _, copyKeys := range []bool{false, true} {
+		b.Run(fmt.Sprintf("copyKeys=%t", copyKeys), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_ = expr.ToSpanExpressionProto(copyKeys)
+			}
+		})
+	}
+}
+
+func TestSpanExpressionMemUsage(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	// The keys of all the spans share a single buffer.
+	buf := []byte("abcdefgh")
+	key := func(i int) EncVal { return buf[i : i+1 : i+1] }
+	span := func(i, j int) Span { return Span{Start: key(i), End: key(j)} }
+	left := &SpanExpression{FactoredUnionSpans: Spans{span(0, 2)}}
+	right := &SpanExpression{FactoredUnionSpans: Spans{span(1, 3)}}
+	expr := &SpanExpression{
+		SpansToRead:        Spans{span(0, 5)},
+		FactoredUnionSpans: Spans{span(3, 5)},
+		Operator:           SetIntersection,
+		Left:               left,
+		Right: &SpanExpression{
+			Operator: SetUnion, Left: right, Right: NonInvertedColExpression{},
+		},
+	}
+	// There are 4 nodes and 4 spans, and the keys are the bytes at 5 distinct
+	// offsets of the buffer.
+	require.Equal(t, 4*SpanExpressionOverhead+4*SpanOverhead+5, expr.MemUsage())
+
+	// The keys of the detached expression are copied individually.
+	require.Equal(t, 4*SpanExpressionOverhead+4*SpanOverhead+8, expr.Detach().MemUsage())
+
+	// The spans of a leaf whose SpansToRead and FactoredUnionSpans are the same
+	// slice are counted once.
+	spans := Spans{span(0, 1), span(2, 4)}
+	leaf := &SpanExpression{SpansToRead: spans, FactoredUnionSpans: spans}
+	require.Equal(t, SpanExpressionOverhead+2*SpanOverhead+4, leaf.MemUsage())
+	leaf.FactoredUnionSpans = Spans{span(0, 1)}
+	require.Equal(t, SpanExpressionOverhead+2*SpanOverhead+4, leaf.MemUsage())
+	leaf.InvalidateCaches()
+	require.Equal(t, SpanExpressionOverhead+3*SpanOverhead+4, leaf.MemUsage())
+	leaf.SetMemUsage(1)
+	require.Equal(t, int64(1), leaf.MemUsage())
+}
+
+func TestDeferSpansToRead(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	buf := []byte("abcdefgh")
+	key := func(i int) EncVal { return buf[i : i+1 : i+1] }
+	span := func(i, j int) Span { return Span{Start: key(i), End: key(j)} }
+	visit := func(expr *SpanExpression) Spans {
+		var spans Spans
+		require.NoError(t, expr.VisitSpansToRead(func(span Span) error {
+			spans = append(spans, span)
+			return nil
+		}))
+		return spans
+	}
+	for _, unsorted := range []bool{false, true} {
+		t.Run(fmt.Sprintf("unsorted=%t", unsorted), func(t *testing.T) {
+			// eager and deferred are the same leaf, whose SpansToRead are
+			// respectively materialized and deferred.
+			leaf := func() *SpanExpression {
+				spans := Spans{span(0, 1), span(2, 4), span(5, 6)}
+				expr := &SpanExpression{Tight: true, SpansToRead: spans, FactoredUnionSpans: spans}
+				if unsorted {
+					expr.FactoredUnionSpans = Spans{spans[1], spans[2], spans[0]}
+					expr.UnsortedFactoredUnionSpans = true
+				}
+				return expr
+			}
+			eager, deferred := leaf(), leaf()
+			deferred.DeferSpansToRead()
+			require.Nil(t, deferred.SpansToRead)
+			require.NoError(t, deferred.CheckInvariants())
+			require.Nil(t, deferred.SpansToRead)
+			require.Equal(t, eager.String(), deferred.Copy().(*SpanExpression).String())
+			require.Equal(t, eager.String(), deferred.Detach().String())
+
+			// Converting the expression to a proto does not materialize the
+			// spans to read.
+			require.Equal(t, eager.ToProto(), deferred.ToProto())
+			require.Equal(t, eager.ToSpanExpressionProto(true /* copyKeys */),
+				deferred.ToSpanExpressionProto(true /* copyKeys */))
+			require.Nil(t, deferred.SpansToRead)
+
+			// Visiting the spans to read does not materialize them either, unless
+			// the FactoredUnionSpans are unsorted.
+			require.Equal(t, eager.SpansToRead, visit(deferred))
+			require.Equal(t, unsorted, deferred.SpansToRead != nil)
+			require.Equal(t, eager.SpansToRead, visit(deferred))
+			require.Equal(t, eager.MemUsage(), deferred.MemUsage())
+			require.Equal(t, eager.ToProto(), deferred.ToProto())
+			require.Equal(t, eager.SpansToRead, deferred.MaterializeSpansToRead())
+			require.Equal(t, eager.SpansToRead, deferred.SpansToRead)
+			require.Equal(t, eager.SpansToRead, visit(deferred))
+
+			// The spans to read of an expression that combines a deferred
+			// expression include its spans.
+			deferred = leaf()
+			deferred.DeferSpansToRead()
+			other := &SpanExpression{
+				SpansToRead: Spans{span(6, 7)}, FactoredUnionSpans: Spans{span(6, 7)},
+			}
+			expected := Or(leaf(), other.Copy()).(*SpanExpression)
+			require.Equal(t, expected.String(), Or(deferred, other).(*SpanExpression).String())
+		})
+	}
+
+	// The visit stops at the first error.
+	spans := Spans{span(0, 1), span(2, 4)}
+	expr := &SpanExpression{SpansToRead: spans, FactoredUnionSpans: spans}
+	expr.DeferSpansToRead()
+	n := 0
+	err := expr.VisitSpansToRead(func(Span) error {
+		n++
+		return errors.New("stop")
+	})
+	require.EqualError(t, err, "stop")
+	require.Equal(t, 1, n)
+
+	// Only the SpansToRead of an expression without children can be deferred.
+	require.Panics(t, func() {
+		(&SpanExpression{
+			Operator: SetUnion, Left: expr.Copy(), Right: expr.Copy(),
+		}).DeferSpansToRead()
+	})
+}
+
+func TestPartialSpansToRead(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	span := func(start, end string) Span { return Span{Start: EncVal(start), End: EncVal(end)} }
+	visit := func(visitFn func(func(Span) error) error) Spans {
+		var spans Spans
+		require.NoError(t, visitFn(func(span Span) error {
+			spans = append(spans, span)
+			return nil
+		}))
+		return spans
+	}
+	// makeExpr returns the intersection of two unions of spans, whose
+	// SpansToRead are complete.
+	makeExpr := func() *SpanExpression {
+		left := Or(ExprForSpan(span("a", "c"), true), ExprForSpan(span("e", "f"), true))
+		right := Or(ExprForSpan(span("b", "d"), true), ExprForSpan(span("g", "h"), true))
+		return And(left, right).(*SpanExpression)
+	}
+	complete := makeExpr()
+	require.Equal(t, SetIntersection, complete.Operator)
+	require.Equal(t, Spans{span("a", "d"), span("e", "f"), span("g", "h")}, complete.SpansToRead)
+
+	// Only the spans within the bounds of both children are read upfront.
+	partial := makeExpr()
+	partial.SpansToRead = Spans{span("a", "d"), span("e", "f")}
+	partial.PartialSpansToRead = true
+	require.NoError(t, partial.CheckInvariants())
+	require.Equal(t, complete.SpansToRead, visit(partial.VisitNodeSpansToRead))
+	left, right := partial.Left.(*SpanExpression), partial.Right.(*SpanExpression)
+	require.Equal(t, left.FactoredUnionSpans, visit(left.VisitNodeSpansToRead))
+	require.Equal(t, right.FactoredUnionSpans, visit(right.VisitNodeSpansToRead))
+	require.True(t, partial.PartialSpansToRead)
+
+	// Formatting the expression does not complete the SpansToRead.
+	require.Contains(t, partial.String(), "to read (partial)")
+	require.True(t, partial.PartialSpansToRead)
+
+	// Converting the expression to a proto completes the spans in the proto
+	// without changing the expression.
+	before := partial.String()
+	require.Equal(t, complete.ToProto(), partial.ToProto())
+	require.True(t, partial.PartialSpansToRead)
+	require.Equal(t, before, partial.String())
+
+	// The other methods that need all the spans complete them.
+	require.Equal(t, complete.SpansToRead, visit(partial.VisitSpansToRead))
+	require.False(t, partial.PartialSpansToRead)
+	require.Equal(t, complete.SpansToRead, partial.SpansToRead)
+	require.Equal(t, complete.String(), partial.String())
+
+	// Partial SpansToRead must be contained in the spans of the tree.
+	partial = makeExpr()
+	partial.SpansToRead = Spans{span("a", "d"), span("x", "y")}
+	partial.PartialSpansToRead = true
+	require.Error(t, partial.CheckInvariants())
+
+	// The visit stops at the first error.
+	n := 0
+	err := complete.VisitNodeSpansToRead(func(Span) error {
+		n++
+		return errors.New("stop")
+	})
+	require.EqualError(t, err, "stop")
+	require.Equal(t, 1, n)
+}
+
+func TestBoundingSpan(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	span := func(start, end string) Span { return Span{Start: EncVal(start), End: EncVal(end)} }
+	point := func(val string) Span { return MakePointSpan(EncVal(val)) }
+
+	_, ok := EmptySpanExpression().BoundingSpan()
+	require.False(t, ok)
+
+	testCases := []struct {
+		spans    Spans
+		expected Span
+	}{
+		{spans: Spans{span("b", "d")}, expected: span("b", "d")},
+		{spans: Spans{span("b", "d"), span("f", "h")}, expected: span("b", "h")},
+		// The end key of a point span is its PrefixEnd.
+		{spans: Spans{span("b", "d"), point("g")}, expected: span("b", "h")},
+		{spans: Spans{point("b"), point("g\xff")}, expected: span("b", "h")},
+		// A single point span is its own bounding span.
+		{spans: Spans{point("g")}, expected: point("g")},
+	}
+	for _, tc := range testCases {
+		expr := &SpanExpression{SpansToRead: tc.spans, FactoredUnionSpans: tc.spans}
+		bounding, ok := expr.BoundingSpan()
+		require.True(t, ok)
+		require.Equal(t, tc.expected, bounding)
+		require.Equal(t, tc.expected.IsPoint(), bounding.IsPoint())
+
+		// The bounding span of deferred SpansToRead, computed from sorted or
+		// unsorted FactoredUnionSpans, is the same.
+		deferred := expr.Copy().(*SpanExpression)
+		if len(tc.spans) > 1 {
+			deferred.FactoredUnionSpans = append(Spans{tc.spans[len(tc.spans)-1]},
+				tc.spans[:len(tc.spans)-1]...)
+			deferred.UnsortedFactoredUnionSpans = true
+		}
+		deferred.DeferSpansToRead()
+		bounding, ok = deferred.BoundingSpan()
+		require.True(t, ok)
+		require.Equal(t, tc.expected, bounding)
+		require.Nil(t, deferred.SpansToRead)
+	}
+
+	// The bounding span of partial SpansToRead is that of the complete
+	// SpansToRead.
+	left := Or(ExprForSpan(span("a", "c"), true), ExprForSpan(span("e", "f"), true))
+	right := Or(ExprForSpan(span("b", "d"), true), ExprForSpan(point("g"), true))
+	expr := And(left, right).(*SpanExpression)
+	expr.SpansToRead = Spans{span("a", "d")}
+	expr.PartialSpansToRead = true
+	bounding, ok := expr.BoundingSpan()
+	require.True(t, ok)
+	require.Equal(t, span("a", "h"), bounding)
+	require.True(t, expr.PartialSpansToRead)
+
+	// The bounding span is cached, so the end key of a point span is only
+	// allocated once, until the statistics are invalidated.
+	expr = &SpanExpression{SpansToRead: Spans{span("b", "d"), point("g")}}
+	require.Equal(t, float64(1), testing.AllocsPerRun(1, func() {
+		expr.InvalidateCaches()
+		_, _ = expr.BoundingSpan()
+	}))
+	require.Zero(t, testing.AllocsPerRun(10, func() { _, _ = expr.BoundingSpan() }))
+
+	// Constructors can set the spans that the bounding span is computed from.
+	expr = &SpanExpression{SpansToRead: Spans{span("b", "d"), span("f", "h")}}
+	expr.SetBoundingSpans(span("c", "d"), point("f"))
+	bounding, _ = expr.BoundingSpan()
+	require.Equal(t, span("c", "g"), bounding)
+	expr.InvalidateCaches()
+	bounding, _ = expr.BoundingSpan()
+	require.Equal(t, span("b", "h"), bounding)
+}
+
+func TestSpanOrdering(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	span := func(start, end string) Span { return Span{Start: EncVal(start), End: EncVal(end)} }
+	// The width of a span of single-byte keys is the number of keys it covers.
+	width := func(s Span) uint64 { return uint64(s.EndKey()[0] - s.Start[0]) }
+	spans := Spans{span("a", "d"), span("e", "f"), span("g", "h"), span("m", "q")}
+	for _, tc := range []struct {
+		ordering SpanOrdering
+		expected Spans
+	}{
+		{ordering: OrderByKey, expected: spans},
+		{
+			ordering: OrderByWidthAscending,
+			expected: Spans{span("e", "f"), span("g", "h"), span("a", "d"), span("m", "q")},
+		},
+		{
+			ordering: OrderByWidthDescending,
+			expected: Spans{span("m", "q"), span("a", "d"), span("e", "f"), span("g", "h")},
+		},
+	} {
+		t.Run(tc.ordering.String(), func(t *testing.T) {
+			ordered := append(Spans(nil), spans...)
+			sort.Slice(ordered, func(i, j int) bool {
+				return tc.ordering.CompareSpans(ordered[i], ordered[j], width) < 0
+			})
+			require.Equal(t, tc.expected, ordered)
+
+			// The ordering applies to every node of the expression.
+			leaf := &SpanExpression{FactoredUnionSpans: ordered}
+			expr := &SpanExpression{
+				SpansToRead:                spans,
+				FactoredUnionSpans:         ordered,
+				UnsortedFactoredUnionSpans: tc.ordering != OrderByKey,
+				Ordering:                   tc.ordering,
+				Operator:                   SetUnion,
+				Left:                       leaf,
+				Right:                      &SpanExpression{FactoredUnionSpans: spans[:1]},
+			}
+			leaf.UnsortedFactoredUnionSpans = expr.UnsortedFactoredUnionSpans
+			require.NoError(t, expr.CheckInvariants())
+			require.NoError(t, expr.CheckOrdering(width))
+			leaf.FactoredUnionSpans = Spans{ordered[1], ordered[0]}
+			require.Error(t, expr.CheckOrdering(width))
+			if tc.ordering != OrderByKey {
+				require.Contains(t, expr.String(), "ordering: "+tc.ordering.String())
+			}
+
+			// The ordering is copied with the expression.
+			require.Equal(t, tc.ordering, expr.Copy().(*SpanExpression).Ordering)
+			require.Equal(t, tc.ordering, expr.Detach().Ordering)
+		})
+	}
+
+	invalid := &SpanExpression{Ordering: numSpanOrderings}
+	require.Error(t, invalid.CheckInvariants())
+	// Expressions that are not ordered by key are not normalized.
+	ordered := &SpanExpression{Ordering: OrderByWidthAscending}
+	require.Same(t, ordered, Normalize(ordered, 0 /* maxGrowth */))
+}
+
+func TestPointSpans(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	point := func(val string) Span { return MakePointSpan(EncVal(val)) }
+	p := point("b")
+	require.True(t, p.IsPoint())
+	require.False(t, single("b").IsPoint())
+	require.True(t, p.IsSingleVal())
+	require.Equal(t, EncVal("c"), p.EndKey())
+	require.True(t, p.Equals(single("b")))
+	require.True(t, single("b").Equals(p))
+	require.False(t, p.Equals(span("b", "d")))
+	require.True(t, p.ContainsKey(EncVal("b")))
+	require.False(t, p.ContainsKey(EncVal("c")))
+	require.Equal(t, 0, p.CompareEnd(EncVal("c")))
+	require.Equal(t, 1, p.CompareEnd(EncVal("b\xff")))
+	require.Equal(t, -1, p.CompareEnd(EncVal("c\x00")))
+	require.Equal(t, 0, p.CompareEnds(point("b\xff")))
+	require.Equal(t, -1, p.CompareEnds(span("a", "d")))
+	require.Equal(t, 1, p.CompareEnds(span("b", "b\x00")))
+
+	// PrefixEnd cannot increment a maximal key.
+	maximal := point("\xff\xff")
+	require.Equal(t, EncVal("\xff\xff"), maximal.EndKey())
+	require.True(t, maximal.ContainsKey(EncVal("\xff\xff")))
+	require.True(t, maximal.Equals(single("\xff\xff")))
+
+	// The proto of a point span includes the end key.
+	expr := &SpanExpression{
+		SpansToRead:        Spans{point("a"), span("b", "d"), point("d\xff")},
+		FactoredUnionSpans: Spans{point("a"), span("b", "d"), point("d\xff")},
+	}
+	require.NoError(t, expr.CheckInvariants())
+	for _, protoSpans := range [][]SpanExpressionProto_Span{
+		expr.ToProto().SpansToRead, expr.ToProto().Node.FactoredUnionSpans,
+	} {
+		require.Equal(t, []SpanExpressionProto_Span{
+			{Start: []byte("a"), End: []byte("b")},
+			{Start: []byte("b"), End: []byte("d")},
+			{Start: []byte("d\xff"), End: []byte("e")},
+		}, protoSpans)
+	}
+
+	// The set operations produce equivalent spans, whether single values are
+	// represented by point spans or not.
+	rng, _ := randutil.NewTestRand()
+	// The keys include 0xff bytes, but are not maximal.
+	randKey := func() EncVal {
+		key := EncVal{"ab"[rng.Intn(2)]}
+		if rng.Intn(2) == 0 {
+			key = append(key, "ab\xff"[rng.Intn(3)])
+		}
+		return key
+	}
+	randSpans := func() (points, singles Spans) {
+		var candidates Spans
+		for i := rng.Intn(6); i > 0; i-- {
+			if rng.Intn(2) == 0 {
+				candidates = append(candidates, MakePointSpan(randKey()))
+			} else if start, end := randKey(), randKey(); bytes.Compare(start, end) < 0 {
+				candidates = append(candidates, Span{Start: start, End: end})
+			}
+		}
+		sort.Slice(candidates, func(i, j int) bool {
+			return bytes.Compare(candidates[i].Start, candidates[j].Start) < 0
+		})
+		for _, s := range candidates {
+			if len(points) > 0 && points[len(points)-1].CompareEnd(s.Start) > 0 {
+				continue
+			}
+			points = append(points, s)
+			if s.IsPoint() {
+				s = MakeSingleValSpan(s.Start)
+			}
+			singles = append(singles, s)
+		}
+		return points, singles
+	}
+	requireEquivalent := func(expected, actual Spans) {
+		require.Equal(t, len(expected), len(actual), "%v vs %v", expected, actual)
+		for i := range expected {
+			require.True(t, expected[i].Equals(actual[i]), "%v vs %v", expected, actual)
+			require.False(t, expected[i].IsPoint(), "%v", expected)
+		}
+		require.NoError(t, checkSpans(actual))
+	}
+	for i := 0; i < 1000; i++ {
+		leftPoints, leftSingles := randSpans()
+		rightPoints, rightSingles := randSpans()
+		requireEquivalent(
+			unionSpans(leftSingles, rightSingles), unionSpans(leftPoints, rightPoints))
+		intersection := intersectSpans(leftSingles, rightSingles)
+		requireEquivalent(intersection, intersectSpans(leftPoints, rightPoints))
+		requireEquivalent(
+			subtractSpans(leftSingles, intersection),
+			subtractSpans(leftPoints, intersectSpans(leftPoints, rightPoints)))
+	}
+}
+
+func TestAtLeastK(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	// The keys of the spans are distinct single bytes.
+	operands := [][]Span{{span("a", "c")}, {span("b", "d")}, {span("e", "g")}}
+	expr := AtLeastK(2, operands)
+	require.NoError(t, expr.CheckInvariants())
+	require.True(t, expr.IsTight())
+	checkEqual(t, []Span{span("a", "d"), span("e", "g")}, expr.SpansToRead)
+	require.Equal(t, `span expression
+ ├── tight: true, unique: false
+ ├── to read
+ │    ├── ["a", "d")
+ │    └── ["e", "g")
+ ├── union spans: empty
+ ├── AT LEAST 2 OF
+ │    ├── operand 0: ["a", "c")
+ │    ├── operand 1: ["b", "d")
+ │    └── operand 2: ["e", "g")
+ └── stats: nodes: 1, depth: 1, spans: 0 (points: 0, ranges: 0), spans per node: [0, 0]
+`, expr.String())
+
+	// The SpansToRead are a new slice of 2 spans, whose keys are those of the
+	// operands.
+	require.Equal(t, SpanExpressionOverhead+3*spansOverhead+5*SpanOverhead+6, expr.MemUsage())
+	detached := expr.Detach()
+	require.Equal(t, expr.String(), detached.String())
+	require.Equal(t, SpanExpressionOverhead+3*spansOverhead+5*SpanOverhead+10, detached.MemUsage())
+	require.Equal(t, expr.String(), expr.Copy().(*SpanExpression).String())
+
+	// The proto round trips.
+	exprProto := expr.ToProto()
+	require.Equal(t, SetAtLeast, exprProto.Node.Operator)
+	require.Equal(t, int32(2), exprProto.Node.K)
+	require.Len(t, exprProto.Node.Operands, 3)
+	require.Equal(t, []SpanExpressionProto_Span{{Start: []byte("b"), End: []byte("d")}},
+		exprProto.Node.Operands[1].Spans)
+	b, err := proto.Marshal(exprProto)
+	require.NoError(t, err)
+	var decoded SpanExpressionProto
+	require.NoError(t, proto.Unmarshal(b, &decoded))
+	require.Equal(t, proto.MarshalTextString(exprProto), proto.MarshalTextString(&decoded))
+	require.Equal(t, proto.MarshalTextString(exprProto),
+		proto.MarshalTextString(expr.ToSpanExpressionProto(true /* copyKeys */)))
+
+	// Keys must be contained in at least K operands, and keys in the same
+	// operand count once.
+	for _, tc := range []struct {
+		keys     []string
+		expected bool
+	}{
+		{keys: nil, expected: false},
+		{keys: []string{"a"}, expected: false},
+		{keys: []string{"a", "aa"}, expected: false},
+		{keys: []string{"b"}, expected: true},
+		{keys: []string{"a", "c"}, expected: true},
+		{keys: []string{"c", "e"}, expected: true},
+		{keys: []string{"d", "f"}, expected: false},
+	} {
+		var keys [][]byte
+		for _, key := range tc.keys {
+			keys = append(keys, []byte(key))
+		}
+		actual, err := expr.ContainsKeys(keys)
+		require.NoError(t, err)
+		require.Equal(t, tc.expected, actual, "%q", tc.keys)
+	}
+
+	// SetAtLeast nodes are combined like other nodes without children.
+	union := Or(expr, ExprForSpan(span("x", "y"), true /* tight */)).(*SpanExpression)
+	require.NoError(t, union.CheckInvariants())
+	require.Equal(t, SetAtLeast, union.Operator)
+	require.Equal(t, 2, union.K)
+	checkEqual(t, []Span{span("x", "y")}, union.FactoredUnionSpans)
+	checkEqual(t, []Span{span("a", "d"), span("e", "g"), span("x", "y")}, union.SpansToRead)
+	intersection := And(AtLeastK(2, operands), ExprForSpan(span("x", "y"), true /* tight */))
+	require.NoError(t, intersection.(*SpanExpression).CheckInvariants())
+	require.Equal(t, SetIntersection, intersection.(*SpanExpression).Operator)
+	require.Same(t, union, Normalize(union, 10 /* maxGrowth */))
+
+	// The SetAtLeast child of the intersection is expanded, and an expression
+	// without SetAtLeast nodes is returned as is.
+	expanded := ExpandAtLeast(intersection.(*SpanExpression))
+	require.False(t, expanded.hasAtLeast())
+	require.True(t, intersection.(*SpanExpression).hasAtLeast())
+	require.Same(t, expanded, ExpandAtLeast(expanded))
+
+	require.Panics(t, func() { AtLeastK(0, operands) })
+	require.Panics(t, func() { AtLeastK(4, operands) })
+
+	// The invariants of SetAtLeast nodes are checked.
+	for _, tc := range []struct {
+		expr     *SpanExpression
+		expected string
+	}{
+		{
+			expr: &SpanExpression{SpansToRead: expr.SpansToRead, Operator: SetAtLeast, K: 4,
+				Operands: expr.Operands},
+			expected: "invalid K 4 for 3 operands",
+		},
+		{
+			expr: &SpanExpression{SpansToRead: expr.SpansToRead, Operator: SetAtLeast, K: 1,
+				Operands: []Spans{{span("a", "c"), span("b", "d")}}},
+			expected: "invalid Operands: unsorted or overlapping spans",
+		},
+		{
+			expr: &SpanExpression{SpansToRead: expr.SpansToRead, Operator: SetAtLeast, K: 1,
+				Operands: []Spans{{span("a", "e")}}},
+			expected: "SpansToRead do not contain operand span",
+		},
+		{
+			expr: &SpanExpression{Operator: SetAtLeast, K: 1, Operands: []Spans{{}},
+				Left: &SpanExpression{}, Right: &SpanExpression{}},
+			expected: "SetAtLeast node has children",
+		},
+		{
+			expr:     &SpanExpression{K: 1, Operands: []Spans{{}}},
+			expected: "None node has operands",
+		},
+	} {
+		require.ErrorContains(t, tc.expr.CheckInvariants(), tc.expected)
+	}
+}
+
+func TestAtLeastKRandomized(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	rng, _ := randutil.NewTestRand()
+	const letters = "abcdefgh"
+	randKey := func() string {
+		return string(letters[rng.Intn(len(letters))])
+	}
+	randSpans := func() []Span {
+		var spans []Span
+		for start := 0; start < len(letters); start++ {
+			if rng.Intn(3) == 0 {
+				end := start + 1 + rng.Intn(2)
+				spans = append(spans, span(letters[start:start+1], string(rune('a'+end))))
+				start = end
+			}
+		}
+		return spans
+	}
+	spanExpr := func(spans []Span) *SpanExpression {
+		return &SpanExpression{Tight: true, SpansToRead: spans, FactoredUnionSpans: spans}
+	}
+	for i := 0; i < 200; i++ {
+		n := 1 + rng.Intn(4)
+		operands := make([][]Span, n)
+		for j := range operands {
+			operands[j] = randSpans()
+		}
+		// The degenerate cases are the union and the intersection of the
+		// operands.
+		var union, intersection Expression
+		for _, operand := range operands {
+			if union == nil {
+				union, intersection = spanExpr(operand), spanExpr(operand)
+				continue
+			}
+			union = Or(union, spanExpr(operand))
+			intersection = And(intersection, spanExpr(operand))
+		}
+		// The expanded expressions are the trees of unions and intersections
+		// of the operands, which are equivalent to the SetAtLeast nodes. Some
+		// of them are unioned with another span, so that the SetAtLeast node
+		// has FactoredUnionSpans, or intersected with it, so that it is the
+		// child of another node.
+		exprs := make([]*SpanExpression, n+1)
+		expanded := make([]*SpanExpression, n+1)
+		for k := 1; k <= n; k++ {
+			exprs[k] = AtLeastK(k, operands)
+			require.NoError(t, exprs[k].CheckInvariants())
+			expr := exprs[k].Copy().(*SpanExpression)
+			switch rng.Intn(3) {
+			case 1:
+				expr = Or(expr, spanExpr(randSpans())).(*SpanExpression)
+			case 2:
+				expr = And(expr, spanExpr(randSpans())).(*SpanExpression)
+			}
+			before := expr.String()
+			expanded[k] = ExpandAtLeast(expr)
+			require.Equal(t, before, expr.String())
+			require.False(t, expanded[k].hasAtLeast())
+			require.NoError(t, expanded[k].CheckInvariants())
+			require.Equal(t, expr.Tight, expanded[k].Tight)
+			exprs[k] = expr
+		}
+		for j := 0; j < 20; j++ {
+			var keys [][]byte
+			for l := rng.Intn(4); l > 0; l-- {
+				keys = append(keys, []byte(randKey()))
+			}
+			numOperands := 0
+			for _, operand := range operands {
+				for _, key := range keys {
+					if Spans(operand).ContainsKey(key) {
+						numOperands++
+						break
+					}
+				}
+			}
+			for k := 1; k <= n; k++ {
+				expected, err := exprs[k].ContainsKeys(keys)
+				require.NoError(t, err)
+				if exprs[k].Operator == SetAtLeast && len(exprs[k].FactoredUnionSpans) == 0 {
+					require.Equal(t, numOperands >= k, expected)
+				}
+				actual, err := expanded[k].ContainsKeys(keys)
+				require.NoError(t, err)
+				require.Equal(t, expected, actual)
+			}
+			expected, err := union.(*SpanExpression).ContainsKeys(keys)
+			require.NoError(t, err)
+			require.Equal(t, expected, numOperands >= 1)
+			expected, err = intersection.(*SpanExpression).ContainsKeys(keys)
+			require.NoError(t, err)
+			require.Equal(t, expected, numOperands >= n)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package inverted
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/cockroachdb/errors"
+)
+
+// KeyEncoder encodes the keys of an inverted column whose values are indexed
+// under uint64 keys, such as the s2 cell IDs of geospatial indexes, into the
+// EncVals of the spans of a SpanExpression. The encoding must preserve the
+// order of the keys.
+//
+// KeyEncoder is defined in this package, which does not depend on any
+// particular encoding, so that the packages that compute the keys can build
+// SpanExpressions without depending on the packages that encode them.
+type KeyEncoder interface {
+	// EncodeKey appends the encoding of k to b, and returns the encoded key
+	// and the extended b. The encoded key aliases b, and has no spare
+	// capacity, so that appending to b does not modify it.
+	EncodeKey(k uint64, b []byte) (EncVal, []byte)
+
+	// EncodeEndKey is like EncodeKey, but encodes the exclusive end key of a
+	// span whose inclusive end key is k. This is the encoding of k+1 if k is
+	// less than math.MaxUint64, and otherwise the PrefixEnd of the encoding of
+	// k, which may not alias b.
+	EncodeEndKey(k uint64, b []byte) (EncVal, []byte)
+}
+
+// IndexKind identifies the kind of inverted index whose keys a SpanExpression
+// reads, which determines how the passes and the formatting that interpret the
+// keys decode them, e.g. as the s2 cell IDs of a geospatial index. The keys of
+// a SpanExpression of UnknownIndexKind are opaque.
+type IndexKind uint8
+
+const (
+	// UnknownIndexKind is the kind of the indexes whose keys are not
+	// interpreted, which is the kind of all the SpanExpressions that are not
+	// converted from the keys of a geospatial index.
+	UnknownIndexKind IndexKind = iota
+	// GeometryIndexKind is the kind of geometry inverted indexes, whose keys
+	// are the s2 cell IDs of face 0, which form a quadtree over the bounds of
+	// the index, and a key for the shapes that exceed the bounds.
+	GeometryIndexKind
+	// GeographyIndexKind is the kind of geography inverted indexes, whose keys
+	// are the s2 cell IDs of all the faces of the s2 cube.
+	GeographyIndexKind
+	numIndexKinds
+)
+
+func (k IndexKind) String() string {
+	switch k {
+	case UnknownIndexKind:
+		return "unknown"
+	case GeometryIndexKind:
+		return "geometry"
+	case GeographyIndexKind:
+		return "geography"
+	default:
+		return fmt.Sprintf("IndexKind(%d)", k)
+	}
+}
+
+// KeyFormatter formats an encoded key of an index of some IndexKind, e.g. as
+// the cell that it identifies. It returns false if the key cannot be decoded,
+// in which case the key is formatted as a quoted string.
+type KeyFormatter func(key EncVal) (string, bool)
+
+// keyFormatters are the registered KeyFormatters, by IndexKind.
+var keyFormatters [numIndexKinds]KeyFormatter
+
+// RegisterKeyFormatter registers the KeyFormatter of the keys of the indexes of
+// the given kind, which is used to format the spans of the SpanExpressions of
+// that kind. Like KeyEncoder, it allows the packages that encode the keys to
+// decode them, without this package depending on them. It must be called
+// during initialization, since the formatters are not synchronized.
+func RegisterKeyFormatter(kind IndexKind, f KeyFormatter) {
+	if kind == UnknownIndexKind || kind >= numIndexKinds {
+		panic(errors.AssertionFailedf("cannot register a key formatter for %s", kind))
+	}
+	keyFormatters[kind] = f
+}
+
+// formatKey formats the given key of an index of the given kind, with the
+// registered KeyFormatter if any.
+func formatKey(key EncVal, kind IndexKind) string {
+	if f := keyFormatters[kind]; f != nil {
+		if s, ok := f(key); ok {
+			return s
+		}
+	}
+	return strconv.Quote(string(key))
+}
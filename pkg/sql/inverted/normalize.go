@@ -0,0 +1,245 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package inverted
+
+// Normalize rewrites intersections of unions that share an operand, using the
+// distributive law:
+//
+//	(A \union B) \intersection (A \union C) => A \union (B \intersection C)
+//
+// Such expressions arise when several predicates over the same inverted
+// column are combined, e.g. multi-shape geospatial predicates, and the
+// rewritten expression evaluates A once instead of twice, and intersects
+// smaller sets.
+//
+// A SpanExpression node represents the union of its FactoredUnionSpans and of
+// the set operation applied to its children, so the operands of a union are
+// the FactoredUnionSpans of its nodes and the intersections below it. An
+// intersection is a common operand of both sides if the intersections have
+// the same shape and their nodes have the same sets of FactoredUnionSpans,
+// after coalescing contiguous spans. Common spans are not considered, since
+// they are already factored out when the intersection is built with And.
+//
+// The rewrites are applied in a single bottom-up pass, and a rewrite is only
+// applied if the number of SpanExpression nodes in the tree doesn't grow by
+// more than maxGrowth in total. A negative maxGrowth requires the rewrites to
+// shrink the tree by at least -maxGrowth nodes.
+//
+// Normalize does not modify expr. If no rewrite applies, or expr contains
+// children that are not SpanExpressions, SetAtLeast nodes or nodes with
+// UnsortedFactoredUnionSpans, or its Ordering is not OrderByKey, expr is
+// returned. Otherwise a new expression is
+// returned, whose SpansToRead are recomputed and may be narrower than those
+// of expr if a rewrite eliminated an intersection with an empty set. The new
+// expression shares the spans of expr.
+func Normalize(expr *SpanExpression, maxGrowth int) *SpanExpression {
+	if expr == nil || expr.Ordering != OrderByKey || !canNormalize(expr) {
+		return expr
+	}
+	n := normalizer{maxGrowth: maxGrowth}
+	res := n.normalize(expr.Copy().(*SpanExpression))
+	if !n.rewritten {
+		return expr
+	}
+	res.Tight = expr.Tight
+	res.SpansToRead = res.factoredSpansUnion()
+	res.InvalidateCaches()
+	return res
+}
+
+// canNormalize returns true if every node of the tree is a SpanExpression
+// with sorted FactoredUnionSpans and without Operands.
+func canNormalize(s *SpanExpression) bool {
+	if s.UnsortedFactoredUnionSpans || s.Operator == SetAtLeast {
+		return false
+	}
+	for _, child := range [2]Expression{s.Left, s.Right} {
+		if child == nil {
+			continue
+		}
+		c, ok := child.(*SpanExpression)
+		if !ok || c == nil || !canNormalize(c) {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizer implements Normalize.
+type normalizer struct {
+	maxGrowth int
+	// growth is the number of nodes added to the tree by the rewrites so far.
+	growth    int
+	rewritten bool
+}
+
+// normalize normalizes the children of s, and then rewrites s if it is an
+// intersection of unions with a common operand. It returns the normalized
+// node, which may be s itself. s and its children must not be shared with
+// the expression passed to Normalize.
+func (n *normalizer) normalize(s *SpanExpression) *SpanExpression {
+	if s.Operator == None {
+		return s
+	}
+	s.Left = n.normalize(s.Left.(*SpanExpression))
+	s.Right = n.normalize(s.Right.(*SpanExpression))
+	if s.Operator != SetIntersection {
+		return s
+	}
+
+	var left, right unionOperands
+	left.collect(s.Left.(*SpanExpression))
+	right.collect(s.Right.(*SpanExpression))
+	var common []*SpanExpression
+	for i := 0; i < len(left.intersections); i++ {
+		for j := range right.intersections {
+			if equalSpanExpressions(left.intersections[i], right.intersections[j]) {
+				common = append(common, left.intersections[i])
+				left.remove(i)
+				right.remove(j)
+				i--
+				break
+			}
+		}
+	}
+	if len(common) == 0 {
+		return s
+	}
+
+	// The FactoredUnionSpans of s are unioned with the common operands, and
+	// the result is unioned with the intersection of the remaining operands.
+	res := unionSpanExpressions(
+		makeUnion(s.FactoredUnionSpans, common),
+		intersectSpanExpressions(
+			makeUnion(left.spans, left.intersections),
+			makeUnion(right.spans, right.intersections),
+		),
+	)
+	growth := res.numNodes() - s.numNodes()
+	if n.growth+growth > n.maxGrowth {
+		return s
+	}
+	n.growth += growth
+	n.rewritten = true
+	res.Tight = s.Tight
+	// The unions below the root may produce duplicate keys.
+	res.Unique = false
+	return res
+}
+
+// unionOperands are the operands of a union of SpanExpressions: the union of
+// the FactoredUnionSpans of its nodes, and the intersections below it.
+type unionOperands struct {
+	spans         Spans
+	intersections []*SpanExpression
+}
+
+// collect adds the operands of the union represented by s.
+func (u *unionOperands) collect(s *SpanExpression) {
+	u.spans = unionSpans(u.spans, s.FactoredUnionSpans)
+	switch s.Operator {
+	case SetUnion:
+		u.collect(s.Left.(*SpanExpression))
+		u.collect(s.Right.(*SpanExpression))
+	case SetIntersection:
+		// The intersection does not include the FactoredUnionSpans of s, which
+		// are a separate operand of the union.
+		u.intersections = append(u.intersections, &SpanExpression{
+			Tight:       s.Tight,
+			SpansToRead: s.SpansToRead,
+			Operator:    SetIntersection,
+			Left:        s.Left,
+			Right:       s.Right,
+		})
+	}
+}
+
+// remove removes the i-th intersection.
+func (u *unionOperands) remove(i int) {
+	u.intersections = append(u.intersections[:i], u.intersections[i+1:]...)
+}
+
+// makeUnion returns a SpanExpression that is the union of the given spans and
+// intersections. The intersections are copied, since the functions that
+// combine SpanExpressions modify them.
+func makeUnion(spans Spans, intersections []*SpanExpression) *SpanExpression {
+	res := &SpanExpression{
+		Tight:              true,
+		SpansToRead:        spans,
+		FactoredUnionSpans: spans,
+	}
+	for _, e := range intersections {
+		res = unionSpanExpressions(res, e.Copy().(*SpanExpression))
+	}
+	return res
+}
+
+// equalSpanExpressions returns true if the trees have the same shape, up to the
+// order of the children of each node, and their nodes have the same sets of
+// FactoredUnionSpans, after coalescing contiguous spans.
+func equalSpanExpressions(a, b *SpanExpression) bool {
+	if a.Operator != b.Operator ||
+		!coalesceSpans(a.FactoredUnionSpans).Equals(coalesceSpans(b.FactoredUnionSpans)) {
+		return false
+	}
+	if a.Operator == None {
+		return true
+	}
+	al, ar := a.Left.(*SpanExpression), a.Right.(*SpanExpression)
+	bl, br := b.Left.(*SpanExpression), b.Right.(*SpanExpression)
+	return (equalSpanExpressions(al, bl) && equalSpanExpressions(ar, br)) ||
+		(equalSpanExpressions(al, br) && equalSpanExpressions(ar, bl))
+}
+
+// coalesceSpans returns the sorted, non-overlapping spans with contiguous spans
+// merged. The spans are returned as is if none are contiguous.
+func coalesceSpans(spans Spans) Spans {
+	var res Spans
+	for i := 1; i < len(spans); i++ {
+		if spans[i-1].CompareEnd(spans[i].Start) != 0 {
+			if res != nil {
+				res = append(res, spans[i])
+			}
+			continue
+		}
+		if res == nil {
+			res = append(make(Spans, 0, len(spans)), spans[:i]...)
+		}
+		res[len(res)-1].SetEndFrom(spans[i])
+	}
+	if res == nil {
+		return spans
+	}
+	return res
+}
+
+// numNodes returns the number of nodes in the tree, without using or caching
+// the statistics of the nodes.
+func (s *SpanExpression) numNodes() int {
+	n := 1
+	for _, child := range [2]Expression{s.Left, s.Right} {
+		if c, ok := child.(*SpanExpression); ok && c != nil {
+			n += c.numNodes()
+		}
+	}
+	return n
+}
+
+// factoredSpansUnion returns the union of the FactoredUnionSpans of the tree.
+func (s *SpanExpression) factoredSpansUnion() Spans {
+	spans := s.FactoredUnionSpans
+	for _, child := range [2]Expression{s.Left, s.Right} {
+		if c, ok := child.(*SpanExpression); ok && c != nil {
+			spans = unionSpans(spans, c.factoredSpansUnion())
+		}
+	}
+	return spans
+}
@@ -0,0 +1,177 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package inverted
+
+import (
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/randutil"
+	"github.com/stretchr/testify/require"
+)
+
+// requireSameKeys checks that the expressions contain the same sets of keys,
+// using ContainsKeys as the reference evaluator.
+func requireSameKeys(t *testing.T, expected, actual *SpanExpression, keySets [][][]byte) {
+	for _, keys := range keySets {
+		e, err := expected.ContainsKeys(keys)
+		require.NoError(t, err)
+		a, err := actual.ContainsKeys(keys)
+		require.NoError(t, err)
+		require.Equal(t, e, a, "keys %q\nexpected:\n%s\nactual:\n%s", keys, expected, actual)
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	leaf := func(start, end string) *SpanExpression {
+		return ExprForSpan(span(start, end), true /* tight */)
+	}
+	// A is the intersection of [a, c) and [b, d), which is factored into
+	// [b, c) \union ([a, b) \intersection [c, d)).
+	a := func() Expression { return And(leaf("a", "c"), leaf("b", "d")) }
+	expr := And(Or(a(), leaf("e", "f")), Or(a(), leaf("g", "h"))).(*SpanExpression)
+	require.NoError(t, expr.CheckInvariants())
+	orig := expr.String()
+
+	// The rewrite doesn't change the number of nodes, since the intersection of
+	// [e, f) and [g, h) is not simplified.
+	require.Same(t, expr, Normalize(expr, -1 /* maxGrowth */))
+	res := Normalize(expr, 0 /* maxGrowth */)
+	require.NotSame(t, expr, res)
+	require.Equal(t, orig, expr.String())
+	require.NoError(t, res.CheckInvariants())
+	require.Equal(t, SetUnion, res.Operator)
+	require.Equal(t, expr.Stats().NumNodes, res.Stats().NumNodes)
+	require.True(t, res.Tight)
+	checkEqual(t, expr.SpansToRead, res.SpansToRead)
+	checkEqual(t, []Span{span("b", "c")}, res.FactoredUnionSpans)
+
+	var keySets [][][]byte
+	for _, keys := range [][]string{
+		{}, {"a"}, {"a", "c"}, {"b"}, {"a", "e"}, {"a", "c", "e"}, {"e", "g"}, {"c", "e", "g"},
+	} {
+		var keySet [][]byte
+		for _, key := range keys {
+			keySet = append(keySet, []byte(key))
+		}
+		keySets = append(keySets, keySet)
+	}
+	requireSameKeys(t, expr, res, keySets)
+
+	// If one side is the common operand, the intersection is eliminated, and
+	// the SpansToRead are narrowed.
+	expr = And(a(), Or(a(), leaf("g", "h"))).(*SpanExpression)
+	res = Normalize(expr, 0 /* maxGrowth */)
+	require.NoError(t, res.CheckInvariants())
+	require.Less(t, res.Stats().NumNodes, expr.Stats().NumNodes)
+	checkEqual(t, []Span{span("a", "d")}, res.SpansToRead)
+	requireSameKeys(t, expr, res, keySets)
+
+	// Intersections that only differ in contiguous spans are common operands.
+	b := func(spans ...Span) Expression {
+		return And(&SpanExpression{
+			Tight:              true,
+			SpansToRead:        spans,
+			FactoredUnionSpans: spans,
+		}, leaf("x", "y"))
+	}
+	expr = And(
+		Or(b(span("a", "b"), span("b", "c")), leaf("e", "f")),
+		Or(b(span("a", "c")), leaf("g", "h")),
+	).(*SpanExpression)
+	require.NotSame(t, expr, Normalize(expr, 0 /* maxGrowth */))
+	expr = And(
+		Or(b(span("a", "b"), span("b\x00", "c")), leaf("e", "f")),
+		Or(b(span("a", "c")), leaf("g", "h")),
+	).(*SpanExpression)
+	require.Same(t, expr, Normalize(expr, 0 /* maxGrowth */))
+
+	// Expressions with unknown children are not normalized.
+	expr = And(Or(a(), leaf("e", "f")), Or(a(), &UnknownExpression{})).(*SpanExpression)
+	require.Same(t, expr, Normalize(expr, 10 /* maxGrowth */))
+}
+
+func TestNormalizeRandomized(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	rng, _ := randutil.NewTestRand()
+	const letters = "abcdef"
+	randKey := func() string {
+		key := string(letters[rng.Intn(len(letters))])
+		if rng.Intn(3) == 0 {
+			key += string(letters[rng.Intn(len(letters))])
+		}
+		return key
+	}
+	var randSpec func(depth int) spanExprForTest
+	randSpec = func(depth int) spanExprForTest {
+		if depth == 0 || rng.Intn(4) == 0 {
+			var spec spanExprForTest
+			for i := rng.Intn(2) + 1; i > 0; i-- {
+				start, end := randKey(), randKey()
+				if start == end {
+					end += "\x00"
+				} else if start > end {
+					start, end = end, start
+				}
+				spec.unionSpans = append(spec.unionSpans, []string{start, end})
+			}
+			return spec
+		}
+		operator := SetUnion
+		if rng.Intn(2) == 0 {
+			operator = SetIntersection
+		}
+		if operator == SetIntersection && rng.Intn(2) == 0 {
+			// Build (A \union B) \intersection (A \union C).
+			common := randSpec(depth - 1)
+			return spanExprForTest{
+				operator: SetIntersection,
+				children: []spanExprForTest{
+					{operator: SetUnion, children: []spanExprForTest{common, randSpec(depth - 1)}},
+					{operator: SetUnion, children: []spanExprForTest{randSpec(depth - 1), common}},
+				},
+			}
+		}
+		return spanExprForTest{
+			operator: operator,
+			children: []spanExprForTest{randSpec(depth - 1), randSpec(depth - 1)},
+		}
+	}
+	randKeySets := func() [][][]byte {
+		keySets := make([][][]byte, 100)
+		for i := range keySets {
+			for j := rng.Intn(4); j > 0; j-- {
+				keySets[i] = append(keySets[i], []byte(randKey()))
+			}
+		}
+		return keySets
+	}
+
+	var numRewritten int
+	for i := 0; i < 500; i++ {
+		expr := randSpec(4).makeSpanExpression()
+		orig := expr.String()
+		maxGrowth := rng.Intn(5) - 2
+		res := Normalize(expr, maxGrowth)
+		require.Equal(t, orig, expr.String())
+		if res == expr {
+			continue
+		}
+		numRewritten++
+		require.NoError(t, res.CheckInvariants(), "%s", res)
+		require.LessOrEqual(t, res.numNodes(), expr.numNodes()+maxGrowth)
+		requireSameKeys(t, expr, res, randKeySets())
+	}
+	require.Greater(t, numRewritten, 0)
+}
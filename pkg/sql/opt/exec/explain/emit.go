@@ -827,8 +827,10 @@ func (e *emitter) emitNodeAttributes(n *Node) error {
 		if a.InvColumn != 0 {
 			ob.Attr("inverted column", a.Input.Columns()[a.InvColumn].Name)
 		}
-		if a.InvFilter != nil && len(a.InvFilter.SpansToRead) > 0 {
-			ob.Attr("num spans", len(a.InvFilter.SpansToRead))
+		if a.InvFilter != nil {
+			if n := len(a.InvFilter.MaterializeSpansToRead()); n > 0 {
+				ob.Attr("num spans", n)
+			}
 		}
 
 	case invertedJoinOp:
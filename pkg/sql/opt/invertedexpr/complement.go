@@ -0,0 +1,155 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package invertedexpr
+
+import (
+	"bytes"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/inverted"
+	"github.com/cockroachdb/errors"
+)
+
+// ErrCannotNegate marks errors returned by Not for SpanExpressions whose
+// negation cannot be represented by a SpanExpression that is a superset of
+// the rows that do not satisfy them.
+var ErrCannotNegate = errors.New("span expression cannot be negated")
+
+// Complement returns the spans of the keys in universe that are not in any of
+// the given spans, sorted and non-overlapping. The spans need not be sorted,
+// and the parts of them that are outside universe are ignored. The end key of
+// universe is exclusive, like that of any span, so for an index whose keys are
+// the encodings of all the uint64 values, such as a geospatial index, it is
+// the PrefixEnd of the encoding of math.MaxUint64, which is also the end key
+// of a span whose last key is math.MaxUint64 (see GeoKeyEncoder.EncodeEndKey).
+//
+// The spans are not modified. The returned spans share the keys of universe
+// and of the given spans.
+func Complement(spans inverted.Spans, universe inverted.Span) inverted.Spans {
+	spans = mergeSpans(spans, nil)
+	universeEnd := universe.EndKey()
+	var out inverted.Spans
+	// start is the first key of universe that is not known to be in spans.
+	start := universe.Start
+	for _, span := range spans {
+		if bytes.Compare(span.Start, universeEnd) >= 0 {
+			break
+		}
+		if span.CompareEnd(start) <= 0 {
+			continue
+		}
+		if bytes.Compare(span.Start, start) > 0 {
+			out = append(out, inverted.Span{Start: start, End: span.Start})
+		}
+		start = span.EndKey()
+	}
+	if bytes.Compare(start, universeEnd) < 0 {
+		out = append(out, inverted.Span{Start: start, End: universeEnd})
+	}
+	return out
+}
+
+// Not returns the negation of the given SpanExpression over the keys in
+// universe, which must contain the keys of all the rows. The negation is
+// pushed down to the leaves using De Morgan's laws, so that the union of the
+// FactoredUnionSpans of a node and its children is replaced by the
+// intersection of the Complement of the spans and the negation of the
+// children, an intersection by the union of the negations of its children,
+// and a union by their intersection. The negation of "at least K of N
+// operands" is "at least N-K+1 of the complements of the operands". The
+// negation of an empty expression is unconstrained (see
+// inverted.UnconstrainedSpanExpression), and vice versa. The expression is not
+// modified.
+//
+// A row satisfies the negation if it has a key in the complement of the spans
+// of a leaf, but a row with several keys, such as the cells of the covering
+// of a shape, can have keys both in and out of the spans. The negation is
+// therefore a superset of the rows that do not satisfy the expression, and is
+// never tight, so callers must re-check the rows. This only holds if the
+// expression itself is tight, since the negation of a superset is a subset,
+// which misses rows that a re-check cannot recover. Not returns an error
+// marked with ErrCannotNegate if a node of the expression is not tight, such
+// as the expression of a geospatial covering, or has children that are not
+// SpanExpressions.
+func Not(
+	expr *inverted.SpanExpression, universe inverted.Span,
+) (*inverted.SpanExpression, error) {
+	if expr.IsEmpty() {
+		return inverted.UnconstrainedSpanExpression(universe), nil
+	}
+	if !expr.Tight {
+		return nil, errors.Mark(errors.Newf(
+			"cannot negate a %v node that is not tight, since the negation would miss rows",
+			expr.Operator,
+		), ErrCannotNegate)
+	}
+	if expr.Unconstrained {
+		return inverted.EmptySpanExpression(), nil
+	}
+	factoredSpans := expr.FactoredUnionSpans
+	if expr.UnsortedFactoredUnionSpans {
+		factoredSpans = sortAndPruneSpans(append(inverted.Spans(nil), factoredSpans...))
+	}
+	var notSpans *inverted.SpanExpression
+	if len(factoredSpans) > 0 {
+		notSpans = notSpansExpr(Complement(factoredSpans, universe))
+		if notSpans.IsEmpty() {
+			// The spans contain all the keys, so every row satisfies expr.
+			return notSpans, nil
+		}
+	}
+	var notOp *inverted.SpanExpression
+	switch expr.Operator {
+	case inverted.None:
+	case inverted.SetUnion, inverted.SetIntersection:
+		left, leftOk := expr.Left.(*inverted.SpanExpression)
+		right, rightOk := expr.Right.(*inverted.SpanExpression)
+		if !leftOk || !rightOk {
+			return nil, errors.Mark(errors.Newf(
+				"cannot negate a %v node with children that are not span expressions",
+				expr.Operator,
+			), ErrCannotNegate)
+		}
+		notLeft, err := Not(left, universe)
+		if err != nil {
+			return nil, err
+		}
+		notRight, err := Not(right, universe)
+		if err != nil {
+			return nil, err
+		}
+		if expr.Operator == inverted.SetUnion {
+			notOp = And(notLeft, notRight)
+		} else {
+			notOp = Or(notLeft, notRight)
+		}
+	case inverted.SetAtLeast:
+		operands := make([][]inverted.Span, len(expr.Operands))
+		for i, operand := range expr.Operands {
+			operands[i] = Complement(operand, universe)
+		}
+		notOp = inverted.AtLeastK(len(operands)-expr.K+1, operands)
+		notOp.SetNotTight()
+	default:
+		return nil, errors.AssertionFailedf("invalid operator %v", expr.Operator)
+	}
+	// And treats nil as the absence of a constraint, which is the negation of
+	// the absent spans or operator.
+	return And(notSpans, notOp), nil
+}
+
+// notSpansExpr returns the SpanExpression of a leaf of the negation of an
+// expression, with the given spans, which is not tight.
+func notSpansExpr(spans inverted.Spans) *inverted.SpanExpression {
+	if len(spans) == 0 {
+		return inverted.EmptySpanExpression()
+	}
+	return &inverted.SpanExpression{SpansToRead: spans, FactoredUnionSpans: spans}
+}
@@ -0,0 +1,215 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package invertedexpr
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/geo/geoindex"
+	"github.com/cockroachdb/cockroach/pkg/sql/inverted"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/randutil"
+	"github.com/cockroachdb/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestComplement(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	span := func(start, end string) inverted.Span {
+		return inverted.Span{Start: inverted.EncVal(start), End: inverted.EncVal(end)}
+	}
+	point := func(val string) inverted.Span {
+		return inverted.MakePointSpan(inverted.EncVal(val))
+	}
+	universe := span("b", "y")
+	testCases := []struct {
+		spans    inverted.Spans
+		expected inverted.Spans
+	}{
+		{spans: nil, expected: inverted.Spans{universe}},
+		{spans: inverted.Spans{span("a", "z")}, expected: nil},
+		{spans: inverted.Spans{span("b", "y")}, expected: nil},
+		{spans: inverted.Spans{span("a", "b"), span("y", "z")}, expected: inverted.Spans{universe}},
+		{
+			// Unsorted and overlapping spans, partly outside universe, and a
+			// point span, whose end key is the PrefixEnd of its start key.
+			spans: inverted.Spans{span("x", "z"), point("g"), span("c", "e"), span("a", "c"),
+				span("d", "f")},
+			expected: inverted.Spans{span("f", "g"), span("h", "x")},
+		},
+		{
+			spans:    inverted.Spans{span("c", "d"), span("d", "e"), point("w"), point("x")},
+			expected: inverted.Spans{span("b", "c"), span("e", "w")},
+		},
+	}
+	for _, tc := range testCases {
+		original := append(inverted.Spans(nil), tc.spans...)
+		require.Equal(t, tc.expected, Complement(tc.spans, universe), "spans %v", tc.spans)
+		require.Equal(t, original, tc.spans)
+	}
+
+	// The universe of a geospatial index with a prefix ends at the PrefixEnd
+	// of the encoding of math.MaxUint64, which is the end key of the spans
+	// that contain math.MaxUint64.
+	enc := GeoKeyEncoder{Prefix: []byte("prefix")}
+	geoSpan := func(enc GeoKeyEncoder, start, end geoindex.Key) inverted.Span {
+		span, _ := geoToSpan(enc, geoindex.KeySpan{Start: start, End: end}, nil)
+		return span
+	}
+	geoUniverse := geoSpan(enc, 0, math.MaxUint64)
+	require.Equal(t, inverted.Spans{geoSpan(enc, 0, 4)},
+		Complement(inverted.Spans{geoSpan(enc, 5, math.MaxUint64)}, geoUniverse))
+	require.Equal(t, inverted.Spans{geoSpan(enc, 5, 5)}, Complement(inverted.Spans{
+		geoSpan(enc, 6, math.MaxUint64), geoSpan(enc, 0, 4),
+	}, geoUniverse))
+	require.Equal(t, inverted.Spans{geoSpan(enc, 5, math.MaxUint64)},
+		Complement(inverted.Spans{geoSpan(enc, 0, 4)}, geoUniverse))
+	require.Empty(t, Complement(inverted.Spans{
+		geoSpan(enc, 0, 4),
+		geoSpan(enc, 5, math.MaxUint64-1),
+		geoSpan(enc, math.MaxUint64, math.MaxUint64),
+	}, geoUniverse))
+	// The spans of other prefixes are outside the universe.
+	other := GeoKeyEncoder{Prefix: []byte("prefiy")}
+	require.Equal(t, inverted.Spans{geoUniverse},
+		Complement(inverted.Spans{geoSpan(other, 0, math.MaxUint64)}, geoUniverse))
+}
+
+// setTight marks all the nodes of expr as tight.
+func setTight(expr *inverted.SpanExpression) {
+	expr.Tight = true
+	if left, ok := expr.Left.(*inverted.SpanExpression); ok {
+		setTight(left)
+	}
+	if right, ok := expr.Right.(*inverted.SpanExpression); ok {
+		setTight(right)
+	}
+}
+
+// checkNot checks that Not(expr) evaluates to the negation of expr for rows
+// with a single key in [0, maxKey], and that it is satisfied by the rows with
+// several keys that do not satisfy expr.
+func checkNot(t *testing.T, rng *rand.Rand, expr *inverted.SpanExpression, maxKey int) {
+	universe, _ := geoToSpan(GeoKeyEncoder{}, geoindex.KeySpan{Start: 0, End: math.MaxUint64}, nil)
+	original := expr.Copy().(*inverted.SpanExpression)
+	not, err := Not(expr, universe)
+	require.NoError(t, err)
+	require.Empty(t, Diff(original, expr))
+	if !not.IsEmpty() {
+		require.False(t, not.Tight)
+		require.NoError(t, not.CheckInvariants())
+	}
+	encKey := func(k geoindex.Key) inverted.EncVal {
+		enc, _ := geoKeyToEncInvertedVal(GeoKeyEncoder{}, k, false /* end */, nil)
+		return enc
+	}
+	for _, k := range []geoindex.Key{0, geoindex.Key(maxKey), math.MaxUint64} {
+		keys := []inverted.EncVal{encKey(k)}
+		require.Equal(t, !Evaluate(expr, keys), Evaluate(not, keys), "key %d:\n%s", k, not)
+	}
+	for k := 1; k < maxKey; k++ {
+		keys := []inverted.EncVal{encKey(geoindex.Key(k))}
+		require.Equal(t, !Evaluate(expr, keys), Evaluate(not, keys), "key %d:\n%s", k, not)
+	}
+	for i := 0; i < 20; i++ {
+		var keys []inverted.EncVal
+		for k := 0; k <= maxKey; k++ {
+			if rng.Intn(3) == 0 {
+				keys = append(keys, encKey(geoindex.Key(k)))
+			}
+		}
+		if len(keys) > 0 && !Evaluate(expr, keys) {
+			require.True(t, Evaluate(not, keys), "keys %v:\n%s", keys, not)
+		}
+	}
+}
+
+func TestNot(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	rng, _ := randutil.NewTestRand()
+	const maxKey = 8
+	universe, _ := geoToSpan(GeoKeyEncoder{}, geoindex.KeySpan{Start: 0, End: math.MaxUint64}, nil)
+
+	// The negation of an empty expression is unconstrained, and vice versa.
+	unconstrained, err := Not(inverted.EmptySpanExpression(), universe)
+	require.NoError(t, err)
+	require.True(t, unconstrained.Unconstrained)
+	require.Equal(t, inverted.Spans{universe}, unconstrained.SpansToRead)
+	// An unconstrained expression is not tight, since it matches the rows
+	// that do not satisfy the predicate it approximates.
+	_, err = Not(unconstrained, universe)
+	require.True(t, errors.Is(err, ErrCannotNegate), "%v", err)
+	unconstrained.Tight = true
+	empty, err := Not(unconstrained, universe)
+	require.NoError(t, err)
+	require.True(t, empty.IsEmpty())
+
+	// The expressions of geospatial coverings are not tight, and cannot be
+	// negated.
+	_, expr := randGeoSpanExpr(t, rng, maxKey)
+	_, err = Not(expr, universe)
+	require.True(t, errors.Is(err, ErrCannotNegate), "%v", err)
+	nonSpanExpr := &inverted.SpanExpression{
+		Tight:    true,
+		Operator: inverted.SetUnion,
+		Left:     expr,
+		Right:    inverted.NonInvertedColExpression{},
+	}
+	setTight(expr)
+	_, err = Not(nonSpanExpr, universe)
+	require.True(t, errors.Is(err, ErrCannotNegate), "%v", err)
+
+	for i := 0; i < 200; i++ {
+		var expr *inverted.SpanExpression
+		if rng.Intn(2) == 0 {
+			_, expr = randGeoSpanExpr(t, rng, maxKey)
+		} else {
+			expr = randSpanExprTree(rng, 3 /* depth */, maxKey)
+		}
+		setTight(expr)
+		checkNot(t, rng, expr, maxKey)
+	}
+}
+
+func TestNotAtLeastK(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	rng, _ := randutil.NewTestRand()
+	const maxKey = 8
+	randSpans := func() inverted.Spans {
+		var spans inverted.Spans
+		for k := 0; k < maxKey; k++ {
+			if rng.Intn(3) == 0 {
+				key := geoindex.Key(k)
+				span, _ := geoToSpan(GeoKeyEncoder{}, geoindex.KeySpan{Start: key, End: key}, nil)
+				spans = append(spans, span)
+			}
+		}
+		return spans
+	}
+	for i := 0; i < 100; i++ {
+		operands := make([][]inverted.Span, 1+rng.Intn(4))
+		for j := range operands {
+			operands[j] = randSpans()
+		}
+		expr := inverted.AtLeastK(1+rng.Intn(len(operands)), operands)
+		checkNot(t, rng, expr, maxKey)
+		// The negation of the factored spans is intersected with that of
+		// "at least K of N".
+		expr.FactoredUnionSpans = randSpans()
+		expr.SpansToRead = mergeSpans(expr.SpansToRead, expr.FactoredUnionSpans)
+		checkNot(t, rng, expr, maxKey)
+	}
+}
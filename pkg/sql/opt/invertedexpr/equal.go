@@ -0,0 +1,124 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package invertedexpr
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/inverted"
+)
+
+// Equal returns true iff the given SpanExpressions are structurally equal.
+// See Diff.
+func Equal(a, b *inverted.SpanExpression) bool {
+	return Diff(a, b) == ""
+}
+
+// Diff returns a description of the first difference between the given
+// SpanExpressions, or the empty string if they are structurally equal. Two
+// SpanExpressions are structurally equal if they have the same Tight, Unique,
+// Unconstrained, Flattened, IndexKind, Ordering and UnsortedFactoredUnionSpans
+// fields, the same SpansToRead and FactoredUnionSpans, compared byte-wise and
+// in order, the same Operator, K and Operands, the latter in order, and equal
+// children. Nil and empty spans are equal, and deferred SpansToRead are
+// materialized to be compared. Since union and intersection are commutative,
+// the children may be in either order. Children that are not SpanExpressions
+// must be equal according to ==.
+//
+// Equal and Diff are intended for tests, which should prefer them to comparing
+// formatted expressions or using reflect.DeepEqual.
+func Diff(a, b *inverted.SpanExpression) string {
+	return diffSpanExprs("root", a, b)
+}
+
+func diffSpanExprs(path string, a, b *inverted.SpanExpression) string {
+	switch {
+	case a == b:
+		return ""
+	case a == nil:
+		return fmt.Sprintf("%s: nil vs non-nil", path)
+	case b == nil:
+		return fmt.Sprintf("%s: non-nil vs nil", path)
+	case a.Tight != b.Tight:
+		return fmt.Sprintf("%s: Tight %t vs %t", path, a.Tight, b.Tight)
+	case a.Unique != b.Unique:
+		return fmt.Sprintf("%s: Unique %t vs %t", path, a.Unique, b.Unique)
+	case a.Unconstrained != b.Unconstrained:
+		return fmt.Sprintf("%s: Unconstrained %t vs %t", path, a.Unconstrained, b.Unconstrained)
+	case a.Flattened != b.Flattened:
+		return fmt.Sprintf("%s: Flattened %t vs %t", path, a.Flattened, b.Flattened)
+	case a.IndexKind != b.IndexKind:
+		return fmt.Sprintf("%s: IndexKind %s vs %s", path, a.IndexKind, b.IndexKind)
+	case a.Ordering != b.Ordering:
+		return fmt.Sprintf("%s: Ordering %s vs %s", path, a.Ordering, b.Ordering)
+	case !a.MaterializeSpansToRead().Equals(b.MaterializeSpansToRead()):
+		return fmt.Sprintf("%s: SpansToRead %s vs %s",
+			path, formatSpans(a.SpansToRead), formatSpans(b.SpansToRead))
+	case a.UnsortedFactoredUnionSpans != b.UnsortedFactoredUnionSpans:
+		return fmt.Sprintf("%s: UnsortedFactoredUnionSpans %t vs %t",
+			path, a.UnsortedFactoredUnionSpans, b.UnsortedFactoredUnionSpans)
+	case !a.FactoredUnionSpans.Equals(b.FactoredUnionSpans):
+		return fmt.Sprintf("%s: FactoredUnionSpans %s vs %s",
+			path, formatSpans(a.FactoredUnionSpans), formatSpans(b.FactoredUnionSpans))
+	case a.Operator != b.Operator:
+		return fmt.Sprintf("%s: Operator %s vs %s", path, a.Operator, b.Operator)
+	case a.K != b.K:
+		return fmt.Sprintf("%s: K %d vs %d", path, a.K, b.K)
+	case len(a.Operands) != len(b.Operands):
+		return fmt.Sprintf("%s: %d vs %d Operands", path, len(a.Operands), len(b.Operands))
+	}
+	for i := range a.Operands {
+		if !a.Operands[i].Equals(b.Operands[i]) {
+			return fmt.Sprintf("%s: Operands[%d] %s vs %s",
+				path, i, formatSpans(a.Operands[i]), formatSpans(b.Operands[i]))
+		}
+	}
+	leftDiff := diffChildren(path+".Left", a.Left, b.Left)
+	rightDiff := diffChildren(path+".Right", a.Right, b.Right)
+	if leftDiff == "" && rightDiff == "" {
+		return ""
+	}
+	if diffChildren(path+".Left", a.Left, b.Right) == "" &&
+		diffChildren(path+".Right", a.Right, b.Left) == "" {
+		return ""
+	}
+	if leftDiff != "" {
+		return leftDiff
+	}
+	return rightDiff
+}
+
+func diffChildren(path string, a, b inverted.Expression) string {
+	aSpanExpr, aOk := a.(*inverted.SpanExpression)
+	bSpanExpr, bOk := b.(*inverted.SpanExpression)
+	if aOk && bOk {
+		return diffSpanExprs(path, aSpanExpr, bSpanExpr)
+	}
+	if a != b {
+		return fmt.Sprintf("%s: %T vs %T", path, a, b)
+	}
+	return ""
+}
+
+// formatSpans formats the given spans for Diff.
+func formatSpans(spans inverted.Spans) string {
+	var b strings.Builder
+	b.WriteByte('[')
+	for i, span := range spans {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		fmt.Fprintf(&b, "[%q, %q)", span.Start, span.EndKey())
+	}
+	b.WriteByte(']')
+	return b.String()
+}
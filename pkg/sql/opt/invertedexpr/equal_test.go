@@ -0,0 +1,119 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package invertedexpr
+
+import (
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/inverted"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiff(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	span := func(start, end string) inverted.Span {
+		return inverted.Span{Start: inverted.EncVal(start), End: inverted.EncVal(end)}
+	}
+	leaf := func(spans ...inverted.Span) *inverted.SpanExpression {
+		return &inverted.SpanExpression{FactoredUnionSpans: spans}
+	}
+	node := func(
+		op inverted.SetOperator, left, right inverted.Expression, spans ...inverted.Span,
+	) *inverted.SpanExpression {
+		return &inverted.SpanExpression{
+			SpansToRead:        inverted.Spans{span("a", "z")},
+			FactoredUnionSpans: spans,
+			Operator:           op,
+			Left:               left,
+			Right:              right,
+		}
+	}
+	a, b, c := span("a", "b"), span("c", "d"), span("e", "f")
+
+	testCases := []struct {
+		a, b     *inverted.SpanExpression
+		expected string
+	}{
+		{nil, nil, ""},
+		{leaf(a), leaf(a), ""},
+		// Nil and empty spans are equal.
+		{
+			&inverted.SpanExpression{FactoredUnionSpans: inverted.Spans{}},
+			&inverted.SpanExpression{},
+			"",
+		},
+		// The children may be in either order.
+		{
+			node(inverted.SetIntersection, leaf(a), leaf(b)),
+			node(inverted.SetIntersection, leaf(b), leaf(a)),
+			"",
+		},
+		{
+			node(inverted.SetUnion, leaf(a), inverted.NonInvertedColExpression{}),
+			node(inverted.SetUnion, inverted.NonInvertedColExpression{}, leaf(a)),
+			"",
+		},
+		{leaf(a), nil, "root: non-nil vs nil"},
+		{&inverted.SpanExpression{Tight: true}, leaf(), "root: Tight true vs false"},
+		{&inverted.SpanExpression{Unique: true}, leaf(), "root: Unique true vs false"},
+		{
+			&inverted.SpanExpression{SpansToRead: inverted.Spans{a}}, leaf(),
+			"root: SpansToRead [[\"a\", \"b\")] vs []",
+		},
+		// FactoredUnionSpans are sorted, so their order is compared.
+		{leaf(a, b), leaf(b, a), "root: FactoredUnionSpans " +
+			"[[\"a\", \"b\"), [\"c\", \"d\")] vs [[\"c\", \"d\"), [\"a\", \"b\")]"},
+		{
+			node(inverted.SetIntersection, leaf(a), leaf(b)),
+			node(inverted.SetUnion, leaf(a), leaf(b)),
+			"root: Operator SetIntersection vs SetUnion",
+		},
+		{
+			node(inverted.SetIntersection, leaf(a), node(inverted.SetUnion, leaf(b), leaf(c))),
+			node(inverted.SetIntersection, leaf(a), node(inverted.SetUnion, leaf(b), leaf(a))),
+			"root.Right.Right: FactoredUnionSpans [[\"e\", \"f\")] vs [[\"a\", \"b\")]",
+		},
+		{
+			node(inverted.SetUnion, leaf(a), inverted.NonInvertedColExpression{}),
+			node(inverted.SetUnion, leaf(a), leaf(b)),
+			"root.Right: inverted.NonInvertedColExpression vs *inverted.SpanExpression",
+		},
+		{
+			inverted.AtLeastK(2, [][]inverted.Span{{a}, {b}, {c}}),
+			inverted.AtLeastK(2, [][]inverted.Span{{a}, {b}, {c}}),
+			"",
+		},
+		{
+			inverted.AtLeastK(1, [][]inverted.Span{{a}, {b}, {c}}),
+			inverted.AtLeastK(2, [][]inverted.Span{{a}, {b}, {c}}),
+			"root: K 1 vs 2",
+		},
+		{
+			inverted.AtLeastK(1, [][]inverted.Span{{a}, {c}}),
+			inverted.AtLeastK(1, [][]inverted.Span{{a, c}}),
+			"root: 2 vs 1 Operands",
+		},
+		// Operands are compared in order.
+		{
+			inverted.AtLeastK(1, [][]inverted.Span{{a}, {c}}),
+			inverted.AtLeastK(1, [][]inverted.Span{{c}, {a}}),
+			"root: Operands[0] [[\"a\", \"b\")] vs [[\"e\", \"f\")]",
+		},
+	}
+	for _, tc := range testCases {
+		require.Equal(t, tc.expected, Diff(tc.a, tc.b))
+		require.Equal(t, tc.expected == "", Equal(tc.a, tc.b))
+		require.Equal(t, tc.expected == "", Equal(tc.b, tc.a))
+		require.Equal(t, tc.expected == "", Diff(tc.b, tc.a) == "")
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package invertedexpr
+
+import (
+	"github.com/cockroachdb/cockroach/pkg/sql/inverted"
+	"github.com/cockroachdb/errors"
+)
+
+// Evaluate returns true iff the given SpanExpression is satisfied by a row
+// whose inverted column has exactly the given keys. A key satisfies a span if
+// Start <= key < End, and a node is satisfied if a key satisfies one of its
+// FactoredUnionSpans, or if its operator applied to its children is
+// satisfied. A SetAtLeast node is satisfied if keys satisfy at least K of its
+// Operands.
+//
+// Evaluate is a straightforward implementation of the set semantics of a
+// SpanExpression, and is not optimized. It is intended to be used as an
+// oracle when testing the construction of SpanExpressions. Nodes that are
+// shared by several parents, e.g. by Intern, are evaluated once.
+func Evaluate(expr *inverted.SpanExpression, keys []inverted.EncVal) bool {
+	e := evaluator{keys: keys}
+	return e.evaluate(expr)
+}
+
+// evaluator evaluates a SpanExpression for Evaluate.
+type evaluator struct {
+	keys []inverted.EncVal
+	// results memoizes the results of the nodes with children, which may be
+	// shared. It is allocated lazily.
+	results map[*inverted.SpanExpression]bool
+}
+
+func (e *evaluator) evaluate(expr *inverted.SpanExpression) bool {
+	for _, span := range expr.FactoredUnionSpans {
+		for _, key := range e.keys {
+			if span.ContainsKey(key) {
+				return true
+			}
+		}
+	}
+	switch expr.Operator {
+	case inverted.None:
+		return false
+	case inverted.SetUnion, inverted.SetIntersection:
+		if result, ok := e.results[expr]; ok {
+			return result
+		}
+		var result bool
+		if expr.Operator == inverted.SetUnion {
+			result = e.evaluate(expr.Left.(*inverted.SpanExpression)) ||
+				e.evaluate(expr.Right.(*inverted.SpanExpression))
+		} else {
+			result = e.evaluate(expr.Left.(*inverted.SpanExpression)) &&
+				e.evaluate(expr.Right.(*inverted.SpanExpression))
+		}
+		if e.results == nil {
+			e.results = make(map[*inverted.SpanExpression]bool)
+		}
+		e.results[expr] = result
+		return result
+	case inverted.SetAtLeast:
+		n := 0
+		for _, operand := range expr.Operands {
+			for _, key := range e.keys {
+				if operand.ContainsKey(key) {
+					n++
+					break
+				}
+			}
+		}
+		return n >= expr.K
+	default:
+		panic(errors.AssertionFailedf("invalid operator %v", expr.Operator))
+	}
+}
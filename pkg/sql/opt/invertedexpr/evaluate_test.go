@@ -0,0 +1,82 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package invertedexpr
+
+import (
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/inverted"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEvaluate(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	span := func(start, end string) inverted.Span {
+		return inverted.Span{Start: inverted.EncVal(start), End: inverted.EncVal(end)}
+	}
+	leaf := func(spans ...inverted.Span) *inverted.SpanExpression {
+		return &inverted.SpanExpression{FactoredUnionSpans: spans}
+	}
+	node := func(
+		op inverted.SetOperator, left, right *inverted.SpanExpression, spans ...inverted.Span,
+	) *inverted.SpanExpression {
+		return &inverted.SpanExpression{
+			FactoredUnionSpans: spans, Operator: op, Left: left, Right: right,
+		}
+	}
+
+	// [a, c) ∪ ([d, f) ∩ [e, g))
+	intersection := node(
+		inverted.SetIntersection, leaf(span("d", "f")), leaf(span("e", "g")), span("a", "c"),
+	)
+	// [a, b) ∪ [x, y)
+	union := node(inverted.SetUnion, leaf(span("a", "b")), leaf(span("x", "y")))
+	// [x, y) ∪ at least 2 of [a, c), [b, d) and [e, f).
+	atLeast := inverted.AtLeastK(2, [][]inverted.Span{
+		{span("a", "c")}, {span("b", "d")}, {span("e", "f")},
+	})
+	atLeast.FactoredUnionSpans = inverted.Spans{span("x", "y")}
+
+	testCases := []struct {
+		expr     *inverted.SpanExpression
+		keys     []string
+		expected bool
+	}{
+		{expr: leaf(), keys: []string{"a"}, expected: false},
+		{expr: intersection, keys: nil, expected: false},
+		{expr: intersection, keys: []string{"a"}, expected: true},
+		{expr: intersection, keys: []string{"b"}, expected: true},
+		// End is exclusive.
+		{expr: intersection, keys: []string{"c"}, expected: false},
+		{expr: intersection, keys: []string{"d"}, expected: false},
+		{expr: intersection, keys: []string{"e"}, expected: true},
+		// The children of an intersection may be satisfied by different keys.
+		{expr: intersection, keys: []string{"d", "f"}, expected: true},
+		{expr: intersection, keys: []string{"d", "g"}, expected: false},
+		{expr: union, keys: []string{"b", "c"}, expected: false},
+		{expr: union, keys: []string{"c", "x"}, expected: true},
+		{expr: atLeast, keys: []string{"x"}, expected: true},
+		{expr: atLeast, keys: []string{"a"}, expected: false},
+		{expr: atLeast, keys: []string{"b"}, expected: true},
+		{expr: atLeast, keys: []string{"a", "e"}, expected: true},
+		// Keys in the same operand count once.
+		{expr: atLeast, keys: []string{"a", "aa"}, expected: false},
+	}
+	for _, tc := range testCases {
+		var keys []inverted.EncVal
+		for _, k := range tc.keys {
+			keys = append(keys, inverted.EncVal(k))
+		}
+		require.Equal(t, tc.expected, Evaluate(tc.expr, keys), "keys %v", tc.keys)
+	}
+}
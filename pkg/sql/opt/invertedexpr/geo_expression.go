@@ -11,101 +11,1045 @@
 package invertedexpr
 
 import (
+	"bytes"
+	"cmp"
+	"context"
+	"fmt"
 	"math"
+	"slices"
 	"sort"
+	"strings"
+	"time"
 
 	"github.com/cockroachdb/cockroach/pkg/geo/geoindex"
+	"github.com/cockroachdb/cockroach/pkg/geo/geopb"
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
 	"github.com/cockroachdb/cockroach/pkg/sql/inverted"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgcode"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
+	"github.com/cockroachdb/cockroach/pkg/util"
+	"github.com/cockroachdb/cockroach/pkg/util/buildutil"
+	"github.com/cockroachdb/cockroach/pkg/util/ctxgroup"
 	"github.com/cockroachdb/cockroach/pkg/util/encoding"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
 	"github.com/cockroachdb/errors"
+	"github.com/golang/geo/s2"
 )
 
 // This file contains functions to encode geoindex.{UnionKeySpans, RPKeyExpr}
 // into a SpanExpression. These functions are in this package since they
 // need to use keyside.Encode to convert geoindex.Key to invertedexpr.EncVal and
 // that cannot be done in the geoindex package as it introduces a circular
-// dependency.
+// dependency. The keys are encoded by an inverted.KeyEncoder, which is
+// GeoKeyEncoder unless ConvertOptions.KeyEncoder is set.
+//
+// geoindex returns empty UnionKeySpans and RPKeyExprs for empty shapes, which
+// cannot satisfy any geospatial predicate. These are converted to
+// inverted.EmptySpanExpression, which matches no rows, so that callers can
+// tell them apart from the inverted.NonInvertedColExpression of a predicate
+// that does not constrain the index. Note that an empty SpanExpression has no
+// SpansToRead, so it cannot be used as the constraint of an inverted index
+// scan.
 //
 // TODO(sumeer): change geoindex to produce SpanExpressions directly.
 
-func geoKeyToEncInvertedVal(k geoindex.Key, end bool, b []byte) (inverted.EncVal, []byte) {
-	// geoindex.KeySpan.End is inclusive, while InvertedSpan.end is exclusive.
-	// For all but k == math.MaxUint64, we can account for this before the key
-	// encoding. For k == math.MaxUint64, we must PrefixEnd after, which incurs
-	// a separate memory allocation.
-	prefixEnd := false
-	if end {
-		if k < math.MaxUint64 {
-			k++
-		} else {
-			prefixEnd = true
+var (
+	// ErrRPKeyExprOperandUnderflow marks errors returned when a set operator in
+	// a geoindex.RPKeyExpr is applied to fewer than two operands.
+	ErrRPKeyExprOperandUnderflow = errors.New("set operator with fewer than two operands")
+
+	// ErrRPKeyExprLeftoverOperands marks errors returned when a
+	// geoindex.RPKeyExpr does not reduce to a single expression.
+	ErrRPKeyExprLeftoverOperands = errors.New("operands left over at end of expression")
+
+	// ErrTooManySpans marks errors returned when the SpanExpression of a
+	// conversion would read more spans than ConvertOptions.MaxSpans.
+	ErrTooManySpans = errors.New("too many spans to read")
+
+	// ErrExceedsMemoryBudget marks errors returned when the estimated memory
+	// usage of the SpanExpression of a conversion exceeds
+	// ConvertOptions.MaxBytes.
+	ErrExceedsMemoryBudget = errors.New("conversion would exceed memory budget")
+
+	// ErrIndexKindRequired marks errors returned when a pass that interprets
+	// the keys of a SpanExpression as s2 cells, such as the orderings by width
+	// of ConvertOptions.SpanOrdering, is applied without an
+	// inverted.IndexKind.
+	ErrIndexKindRequired = errors.New("index kind required")
+)
+
+// ConvertOptions are options for the conversion of geoindex.UnionKeySpans and
+// geoindex.RPKeyExprs to SpanExpressions.
+type ConvertOptions struct {
+	// InputSorted attests that the input is sorted, i.e. the spans of the
+	// geoindex.UnionKeySpans are sorted, or the keys of the geoindex.RPKeyExpr
+	// appear in increasing order. The conversion then does not sort the
+	// encoded spans. In test builds the attestation is verified, and if it
+	// does not hold an assertion failure is logged and the spans are sorted
+	// anyway.
+	InputSorted bool
+
+	// KeyVersion is the version of the encoding of the geo inverted keys. The
+	// zero value is the current version. Callers must only select a version
+	// that all nodes can decode, based on the cluster version.
+	KeyVersion encoding.GeoInvertedKeyVersion
+
+	// KeyEncoder, if non-nil, encodes the keys instead of the GeoKeyEncoder of
+	// the prefix key and KeyVersion of the conversion, which are then ignored.
+	// Tests use it to make the spans human-readable. It must be safe for
+	// concurrent use if Parallelism is set.
+	KeyEncoder inverted.KeyEncoder
+
+	// Sink, if non-nil, is notified of the statistics of the converted
+	// SpanExpressions.
+	Sink ConvertSink
+
+	// CountSink, if non-nil, accumulates the number of spans to read and of
+	// nodes of the converted SpanExpressions.
+	CountSink ConvertCountSink
+
+	// Parallelism is the maximum number of goroutines used to encode the keys
+	// of a geoindex.RPKeyExpr, which dominates the cost of converting very
+	// large expressions. Values less than 2 mean that the keys are encoded
+	// sequentially, as are the keys of small expressions regardless of
+	// Parallelism. The operators are always applied sequentially, and the
+	// result is identical to that of a sequential conversion.
+	Parallelism int
+
+	// MaxSpans, if positive, is the maximum number of spans to read of the
+	// converted SpanExpression, which bounds the memory used by the conversion
+	// of the coverings of very large or complex shapes. The spans are counted
+	// after contiguous spans are coalesced and contained spans are pruned, as
+	// in SpanExpression.SpansToRead. If the limit is exceeded, the conversion
+	// returns an error with pgcode.ProgramLimitExceeded, marked with
+	// ErrTooManySpans.
+	MaxSpans int
+
+	// MaxBytes, if positive, is the budget for the memory used by the
+	// converted SpanExpression, as estimated by EstimateConvertedSize. Unlike
+	// MaxSpans, it is checked before any key is encoded, so a conversion that
+	// exceeds it allocates nothing. If the budget is exceeded, the conversion
+	// returns an error with pgcode.ProgramLimitExceeded, marked with
+	// ErrExceedsMemoryBudget.
+	MaxBytes int64
+
+	// OrderSpansByWidth orders the FactoredUnionSpans of each node of the
+	// converted SpanExpression by decreasing width, rather than by key, and
+	// sets SpanExpression.UnsortedFactoredUnionSpans if that changes their
+	// order. The width of a span is the number of s2 cell IDs that it covers,
+	// so the spans of coarse cells come first. These are the most likely to
+	// contain the keys of a row, so an evaluation that checks the spans of a
+	// union in order can stop sooner. The SpansToRead remain sorted by key.
+	// It is equivalent to a SpanOrdering of inverted.OrderByWidthDescending.
+	OrderSpansByWidth bool
+
+	// SpanOrdering is the order of the FactoredUnionSpans of each node of the
+	// converted SpanExpression, which is recorded on its root, see
+	// inverted.SpanExpression.Ordering, so that consumers can rely on it. The
+	// zero value, inverted.OrderByKey, orders them by key.
+	// inverted.OrderByWidthAscending orders them by increasing width, as
+	// defined by OrderSpansByWidth, so that the spans of the finest cells,
+	// which are the most selective, come first, and an evaluation that checks
+	// the spans in order under a small LIMIT can produce its first rows sooner.
+	// The conversion returns an assertion error if it conflicts with
+	// OrderSpansByWidth. The SpansToRead remain sorted by key.
+	SpanOrdering inverted.SpanOrdering
+
+	// DeferSpansToRead defers the materialization of the SpansToRead of the
+	// converted SpanExpressions that have a single node, i.e. those of
+	// geoindex.UnionKeySpans and of geoindex.RPKeyExprs with only unions, see
+	// inverted.SpanExpression.DeferSpansToRead. This avoids a copy of the spans
+	// when OrderSpansByWidth is also set. Callers must access the spans to
+	// read with SpanExpression.VisitSpansToRead or MaterializeSpansToRead.
+	DeferSpansToRead bool
+
+	// PromoteFactoredSpans applies PromoteFactoredSpans to the converted
+	// SpanExpression of a geoindex.RPKeyExpr, so that the spans common to
+	// both children of nodes deep in the tree are evaluated once. It allocates
+	// the FactoredUnionSpans of the nodes that it changes.
+	PromoteFactoredSpans bool
+
+	// PartialSpansToRead restricts the SpansToRead of the converted
+	// SpanExpression of a geoindex.RPKeyExpr whose root is an intersection to
+	// the FactoredUnionSpans of the root and the spans that overlap the bounds
+	// of both of its children, i.e. the range of keys between the smallest and
+	// the largest key of each child, and sets
+	// inverted.SpanExpression.PartialSpansToRead if that excludes any span. For
+	// the intersections of shapes that barely overlap, such as the coverings of
+	// adjacent shapes, this excludes most of the spans, so a consumer that
+	// evaluates the children on demand only prefetches the spans that both
+	// children may need, and reads the others with
+	// inverted.SpanExpression.VisitNodeSpansToRead. The SpansToRead of other
+	// expressions are complete.
+	PartialSpansToRead bool
+
+	// FlattenBelowNodes, if positive, flattens the converted SpanExpression of
+	// a geoindex.RPKeyExpr that has fewer than FlattenBelowNodes nodes into a
+	// single node, whose FactoredUnionSpans are the union of all the keys of
+	// the expression, ignoring its operators, like the fallback of
+	// GeoRPKeyExprToSpanExprWithFallback. Small expressions, such as the
+	// intersection of the coverings of two small shapes, are cheaper to
+	// evaluate as the union of their spans, followed by a re-check of the
+	// original predicate on the rows, than as a tree. The flattened expression
+	// reads the same spans, is not tight, and is marked with
+	// inverted.SpanExpression.Flattened. The zero value disables flattening,
+	// so that it can be plumbed from a cluster setting whose default is
+	// DefaultFlattenBelowNodes.
+	FlattenBelowNodes int
+
+	// BoundingBox and SRID, if the caller supplies them, describe the shape
+	// whose covering is converted. They are not used by the conversion, but
+	// are included in the summary of the input that is attached to the errors
+	// of the conversion of a geoindex.RPKeyExpr, see withRPKeyExprDetail, so
+	// that the shape can be identified from the logs.
+	BoundingBox *geopb.BoundingBox
+	SRID        geopb.SRID
+
+	// IndexKind is the kind of the index whose keys are converted, which is
+	// recorded on the converted SpanExpression, see
+	// inverted.SpanExpression.IndexKind. Geometry and geography indexes number
+	// their s2 cells differently, so the options that interpret the keys as
+	// cells, i.e. the orderings by width, require it, and the conversion
+	// returns an error marked with ErrIndexKindRequired if it is unknown.
+	IndexKind inverted.IndexKind
+}
+
+// DefaultFlattenBelowNodes is the recommended value of
+// ConvertOptions.FlattenBelowNodes, which flattens the intersections of two
+// unions of keys, i.e. the trees of 3 nodes, but not larger trees.
+const DefaultFlattenBelowNodes = 4
+
+// minKeysPerConvertWorker is the minimum number of keys encoded by each
+// goroutine when ConvertOptions.Parallelism is set, so that the cost of
+// starting the goroutines is amortized.
+const minKeysPerConvertWorker = 1024
+
+// ConvertInput identifies the kind of input of a conversion.
+type ConvertInput int
+
+const (
+	// ConvertUnionKeySpans identifies the conversion of geoindex.UnionKeySpans.
+	ConvertUnionKeySpans ConvertInput = iota
+	// ConvertRPKeyExpr identifies the conversion of a geoindex.RPKeyExpr.
+	ConvertRPKeyExpr
+)
+
+// ConvertSink receives the statistics of the SpanExpressions built by the
+// converters, e.g. to update telemetry counters or metric histograms owned by
+// the caller.
+type ConvertSink interface {
+	// RecordConversion is called for each conversion that returns a
+	// non-empty SpanExpression, with the kind of the input and the statistics
+	// of the SpanExpression. The conversions of empty inputs are not recorded.
+	RecordConversion(input ConvertInput, stats inverted.SpanExprStats)
+}
+
+// ConvertCountSink accumulates the sizes of the SpanExpressions built by the
+// converters. It is intended to be aggregated per query, e.g. to find the
+// queries whose geospatial predicates generate pathological numbers of
+// inverted spans, so it only receives counts, which are cheaper to aggregate
+// than the statistics passed to a ConvertSink. Like a ConvertSink, it is not
+// notified of the conversions of empty inputs, nor of failed conversions.
+type ConvertCountSink interface {
+	// AddSpans adds the number of spans to read of a converted SpanExpression.
+	AddSpans(n int)
+	// AddNodes adds the number of nodes of a converted SpanExpression.
+	AddNodes(n int)
+}
+
+// recordCounts adds the number of spans to read and of nodes of a converted
+// SpanExpression to the CountSink of the options, if any.
+func (opts ConvertOptions) recordCounts(numSpans, numNodes int) {
+	if opts.CountSink != nil {
+		opts.CountSink.AddSpans(numSpans)
+		opts.CountSink.AddNodes(numNodes)
+	}
+}
+
+// testingConvertHook, if set, is called at the start of the conversions that
+// recover from panics, with the kind of their input. Tests use it to inject
+// panics.
+var testingConvertHook func(input ConvertInput)
+
+// convertPanicError converts the value r recovered from a panic during the
+// conversion of input, a geoindex.UnionKeySpans or geoindex.RPKeyExpr, into an
+// assertion failure error. The error includes a summary of the input: its
+// length, and its first and last elements. The conversions run on the query
+// path, so a malformed input, e.g. from a corrupted geometry, must fail the
+// query instead of crashing the node.
+func convertPanicError(r interface{}, input interface{}) error {
+	err, ok := r.(error)
+	if !ok {
+		err = errors.Newf("%v", r)
+	}
+	var first, last interface{}
+	switch in := input.(type) {
+	case geoindex.UnionKeySpans:
+		if len(in) > 0 {
+			first, last = in[:1], in[len(in)-1:]
+		}
+		return errors.WithAssertionFailure(errors.Wrapf(err,
+			"converting geoindex.UnionKeySpans of length %d (first: %v, last: %v)",
+			len(in), first, last))
+	case geoindex.RPKeyExpr:
+		if len(in) > 0 {
+			first, last = in[:1], in[len(in)-1:]
+		}
+		return errors.WithAssertionFailure(errors.Wrapf(err,
+			"converting geoindex.RPKeyExpr of length %d (first: %v, last: %v)",
+			len(in), first, last))
+	}
+	return errors.WithAssertionFailure(err)
+}
+
+// sortSpans sorts the given spans in place, unless the options attest that
+// they are already sorted. In test builds, the attestation is verified, and if
+// it does not hold, an assertion failure is logged to ctx and the spans are
+// sorted, so that the conversion proceeds.
+func (opts ConvertOptions) sortSpans(ctx context.Context, spans inverted.Spans) {
+	if opts.InputSorted {
+		if !buildutil.CrdbTestBuild || slices.IsSortedFunc(spans, cmpSpans) {
+			return
 		}
+		log.Errorf(ctx, "%v", errors.AssertionFailedf(
+			"spans of input attested to be sorted are not sorted: %v", spans))
+	}
+	sortSpans(spans)
+}
+
+// spanOrdering returns the ordering of the FactoredUnionSpans selected by the
+// options, see ConvertOptions.SpanOrdering.
+func (opts ConvertOptions) spanOrdering() inverted.SpanOrdering {
+	if opts.OrderSpansByWidth && opts.SpanOrdering == inverted.OrderByKey {
+		return inverted.OrderByWidthDescending
+	}
+	return opts.SpanOrdering
+}
+
+// checkSpanOrdering returns an error if the ordering of the options conflicts
+// with OrderSpansByWidth, or interprets the keys as s2 cells without an
+// inverted.IndexKind.
+func (opts ConvertOptions) checkSpanOrdering() error {
+	ordering := opts.spanOrdering()
+	if opts.OrderSpansByWidth && ordering != inverted.OrderByWidthDescending {
+		return errors.AssertionFailedf(
+			"ConvertOptions.OrderSpansByWidth conflicts with ConvertOptions.SpanOrdering %s",
+			ordering,
+		)
+	}
+	if opts.IndexKind != inverted.UnknownIndexKind || ordering == inverted.OrderByKey {
+		return nil
+	}
+	return errors.Mark(errors.AssertionFailedf(
+		"ConvertOptions.SpanOrdering %s requires ConvertOptions.IndexKind", ordering,
+	), ErrIndexKindRequired)
+}
+
+// emptySpanExpr returns an empty SpanExpression of the IndexKind and ordering
+// of the options, see inverted.EmptySpanExpression.
+func (opts ConvertOptions) emptySpanExpr() *inverted.SpanExpression {
+	spanExpr := inverted.EmptySpanExpression()
+	spanExpr.IndexKind = opts.IndexKind
+	spanExpr.Ordering = opts.spanOrdering()
+	return spanExpr
+}
+
+// checkMaxSpans returns an error if the given SpanExpression reads more spans
+// than allowed by the options.
+func (opts ConvertOptions) checkMaxSpans(spanExpr *inverted.SpanExpression) error {
+	if opts.MaxSpans <= 0 || len(spanExpr.SpansToRead) <= opts.MaxSpans {
+		return nil
 	}
+	err := pgerror.Newf(pgcode.ProgramLimitExceeded,
+		"geospatial index constraint with %d spans exceeds the maximum of %d spans",
+		len(spanExpr.SpansToRead), opts.MaxSpans)
+	err = errors.WithHint(err,
+		"Consider lowering the s2_max_cells or s2_max_level parameters of the index.")
+	return errors.Mark(err, ErrTooManySpans)
+}
+
+// GeoKeyEncoder is the inverted.KeyEncoder of geospatial inverted indexes. It
+// encodes the s2 cell ID of a geoindex.Key with the given version of the geo
+// inverted key encoding, preceded by Prefix, which is empty for single-column
+// inverted indexes. See GeoUnionKeySpansToSpanExprWithPrefix.
+type GeoKeyEncoder struct {
+	Prefix  []byte
+	Version encoding.GeoInvertedKeyVersion
+}
+
+var _ inverted.KeyEncoder = GeoKeyEncoder{}
+
+// EncodeKey implements the inverted.KeyEncoder interface.
+func (e GeoKeyEncoder) EncodeKey(k uint64, b []byte) (inverted.EncVal, []byte) {
 	prev := len(b)
-	b = encoding.EncodeGeoInvertedAscending(b)
-	b = encoding.EncodeUvarintAscending(b, uint64(k))
+	b = append(b, e.Prefix...)
+	b = encoding.EncodeGeoInvertedAscendingWithVersion(b, e.Version)
+	b = encoding.EncodeUvarintAscending(b, k)
 	// Set capacity so that the caller appending does not corrupt later keys.
-	enc := b[prev:len(b):len(b)]
-	if prefixEnd {
-		enc = roachpb.Key(enc).PrefixEnd()
+	return b[prev:len(b):len(b)], b
+}
+
+// EncodeEndKey implements the inverted.KeyEncoder interface.
+func (e GeoKeyEncoder) EncodeEndKey(k uint64, b []byte) (inverted.EncVal, []byte) {
+	// For all but k == math.MaxUint64, the end key is the encoding of k+1. For
+	// k == math.MaxUint64, we must PrefixEnd after the encoding, which incurs
+	// a separate memory allocation. PrefixEnd is applied to the entire key,
+	// including the prefix, and since the geoInvertedIndexMarker is never
+	// 0xff, it never carries into the prefix.
+	if k < math.MaxUint64 {
+		return e.EncodeKey(k+1, b)
+	}
+	enc, b := e.EncodeKey(k, b)
+	return inverted.EncVal(roachpb.Key(enc).PrefixEnd()), b
+}
+
+// keyEncoder returns the inverted.KeyEncoder of a conversion of keys preceded
+// by prefixKey.
+func (opts ConvertOptions) keyEncoder(prefixKey []byte) inverted.KeyEncoder {
+	if opts.KeyEncoder != nil {
+		return opts.KeyEncoder
+	}
+	return GeoKeyEncoder{Prefix: prefixKey, Version: opts.KeyVersion}
+}
+
+// geoKeyToEncInvertedVal encodes k with the given encoder, appending it to b.
+// geoindex.KeySpan.End is inclusive, while inverted.Span.End is exclusive, so
+// if end is true, the exclusive end key of a span whose inclusive end key is
+// k is encoded. The returned key usually aliases b, so b must not be reused
+// while the key is in use. See inverted.SpanExpression.Detach.
+func geoKeyToEncInvertedVal(
+	enc inverted.KeyEncoder, k geoindex.Key, end bool, b []byte,
+) (inverted.EncVal, []byte) {
+	if end {
+		return enc.EncodeEndKey(uint64(k), b)
 	}
-	return enc, b
+	return enc.EncodeKey(uint64(k), b)
+}
+
+func geoToSpan(
+	enc inverted.KeyEncoder, span geoindex.KeySpan, b []byte,
+) (inverted.Span, []byte) {
+	start, b := geoKeyToEncInvertedVal(enc, span.Start, false, b)
+	end, b := geoKeyToEncInvertedVal(enc, span.End, true, b)
+	return inverted.Span{Start: start, End: end}, b
 }
 
-func geoToSpan(span geoindex.KeySpan, b []byte) (inverted.Span, []byte) {
-	start, b := geoKeyToEncInvertedVal(span.Start, false, b)
-	end, b := geoKeyToEncInvertedVal(span.End, true, b)
+// geoToPointSpan is like geoToSpan for the span [k, k], but returns a point
+// span, which does not store the end key, if the encoded end key equals the
+// PrefixEnd of the encoded start key. This is the case unless incrementing k
+// carries into another byte of its encoding, so the end key of the point span
+// is byte-identical to the one geoToSpan would encode.
+func geoToPointSpan(
+	enc inverted.KeyEncoder, k geoindex.Key, b []byte,
+) (inverted.Span, []byte) {
+	start, b := geoKeyToEncInvertedVal(enc, k, false, b)
+	span := inverted.MakePointSpan(start)
+	if geoEnc, ok := enc.(GeoKeyEncoder); ok {
+		// Encode the end key into scratch memory, which is on the stack for
+		// short prefixes, and only store it if necessary. The scratch memory
+		// would escape to the heap if it were passed to an arbitrary encoder.
+		var scratch [32]byte
+		end, _ := geoEnc.EncodeEndKey(uint64(k), scratch[:0])
+		if span.CompareEnd(end) == 0 {
+			return span, b
+		}
+		n := len(b)
+		b = append(b, end...)
+		return inverted.Span{Start: start, End: b[n:len(b):len(b)]}, b
+	}
+	// Encode the end key after the start key, and only keep it if necessary.
+	n := len(b)
+	end, b := geoKeyToEncInvertedVal(enc, k, true, b)
+	if span.CompareEnd(end) == 0 {
+		return span, b[:n]
+	}
 	return inverted.Span{Start: start, End: end}, b
 }
 
+// geoSpanBufferSize returns the size of a buffer that can hold the encoded
+// start and end keys of numSpans spans with the given prefix.
+func geoSpanBufferSize(prefix []byte, numSpans int) int {
+	return geoKeyBufferSize(prefix, 2*numSpans)
+}
+
+// checkMaxBytes returns an error if the given estimate of the memory usage of a
+// SpanExpression exceeds the budget of the options.
+func (opts ConvertOptions) checkMaxBytes(estimate int64) error {
+	if opts.MaxBytes <= 0 || estimate <= opts.MaxBytes {
+		return nil
+	}
+	err := pgerror.Newf(pgcode.ProgramLimitExceeded,
+		"geospatial index constraint of an estimated %d bytes exceeds the budget of %d bytes",
+		estimate, opts.MaxBytes)
+	err = errors.WithHint(err,
+		"Consider lowering the s2_max_cells or s2_max_level parameters of the index.")
+	return errors.Mark(err, ErrExceedsMemoryBudget)
+}
+
+// geoKeyBufferSize returns the size of a buffer that can hold numKeys encoded
+// keys with the given prefix. Each key is the prefix, followed by the
+// geoInvertedIndexMarker (1 byte) and a varint.
+func geoKeyBufferSize(prefix []byte, numKeys int) int {
+	return numKeys * (len(prefix) + 1 + encoding.MaxVarintLen)
+}
+
+// geoKeysAreContiguous returns true if the inclusive end key of a
+// geoindex.KeySpan is immediately followed by the start key of another, so
+// that the two spans can be represented as a single span.
+func geoKeysAreContiguous(end, start geoindex.Key) bool {
+	return end < math.MaxUint64 && end+1 == start
+}
+
 // GeoUnionKeySpansToSpanExpr converts geoindex.UnionKeySpans to a
-// SpanExpression.
+// SpanExpression. Spans that are contiguous in the key space (e.g. the range of
+// a covering cell, followed by the ancestor cell that sorts immediately after
+// it) are coalesced into a single span by KeySpansToSpanExpr. Empty
+// UnionKeySpans are converted to an empty SpanExpression, see
+// inverted.EmptySpanExpression, and sorted UnionKeySpans that cover all the
+// keys, such as the covering of a shape that contains the bounds of the index,
+// to an unconstrained SpanExpression, see
+// inverted.UnconstrainedSpanExpression.
 func GeoUnionKeySpansToSpanExpr(ukSpans geoindex.UnionKeySpans) inverted.Expression {
+	return GeoUnionKeySpansToSpanExprWithPrefix(ukSpans, nil /* prefixKey */)
+}
+
+// GeoUnionKeySpansToSpanExprWithPrefix is like GeoUnionKeySpansToSpanExpr, but
+// prepends prefixKey to the start and end keys of every span. It is used for
+// multi-column inverted indexes, in which case prefixKey is the encoding of
+// the constrained values of the non-inverted prefix columns.
+func GeoUnionKeySpansToSpanExprWithPrefix(
+	ukSpans geoindex.UnionKeySpans, prefixKey []byte,
+) inverted.Expression {
+	// The conversion can only fail if ConvertOptions.MaxSpans or MaxBytes is
+	// set. Panics are not recovered, since there is no error to return.
+	expr, _ := geoUnionKeySpansToSpanExpr(
+		context.Background(), ukSpans, prefixKey, ConvertOptions{},
+	)
+	return expr
+}
+
+// GeoUnionKeySpansToSpanExprWithOptions is like
+// GeoUnionKeySpansToSpanExprWithPrefix, but accepts options for the conversion.
+// The geoindex.UnionKeySpans returned by geoindex are sorted, so the
+// conversion of these can set ConvertOptions.InputSorted. An error is
+// returned if ConvertOptions.MaxSpans or MaxBytes is exceeded, and an
+// assertion failure error is returned if the conversion panics. A false
+// ConvertOptions.InputSorted attestation is logged to ctx in test builds.
+func GeoUnionKeySpansToSpanExprWithOptions(
+	ctx context.Context, ukSpans geoindex.UnionKeySpans, prefixKey []byte, opts ConvertOptions,
+) (_ inverted.Expression, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = convertPanicError(r, ukSpans)
+		}
+	}()
+	if testingConvertHook != nil {
+		testingConvertHook(ConvertUnionKeySpans)
+	}
+	return geoUnionKeySpansToSpanExpr(ctx, ukSpans, prefixKey, opts)
+}
+
+// geoUnionKeySpansToSpanExpr implements
+// GeoUnionKeySpansToSpanExprWithOptions, without recovering from panics.
+func geoUnionKeySpansToSpanExpr(
+	ctx context.Context, ukSpans geoindex.UnionKeySpans, prefixKey []byte, opts ConvertOptions,
+) (inverted.Expression, error) {
+	if err := opts.checkSpanOrdering(); err != nil {
+		return nil, err
+	}
 	if len(ukSpans) == 0 {
-		return inverted.NonInvertedColExpression{}
+		return opts.emptySpanExpr(), nil
+	}
+	if geoKeySpansCoverAllKeys(ukSpans) {
+		spanExpr := geoUnconstrainedSpanExpr(opts.keyEncoder(prefixKey))
+		spanExpr.IndexKind = opts.IndexKind
+		spanExpr.Ordering = opts.spanOrdering()
+		if opts.Sink != nil {
+			opts.Sink.RecordConversion(ConvertUnionKeySpans, spanExpr.Stats())
+		}
+		opts.recordCounts(1 /* numSpans */, 1 /* numNodes */)
+		return spanExpr, nil
+	}
+	// The spans are coalesced into a single node, whose SpansToRead and
+	// FactoredUnionSpans are the same slice.
+	if err := opts.checkMaxBytes(geoSpanExprMemUsage(
+		1 /* numNodes */, len(ukSpans), geoSpanBufferSize(prefixKey, len(ukSpans)),
+	)); err != nil {
+		return nil, err
+	}
+	// Avoid per-span heap allocations.
+	b := make([]byte, 0, geoSpanBufferSize(prefixKey, len(ukSpans)))
+	spans := make(inverted.Spans, 0, len(ukSpans))
+	enc := opts.keyEncoder(prefixKey)
+	for _, ukSpan := range ukSpans {
+		var span inverted.Span
+		span, b = geoToSpan(enc, ukSpan, b)
+		spans = append(spans, span)
+	}
+	opts.sortSpans(ctx, spans)
+	spanExpr := sortedKeySpansToSpanExpr(spans)
+	spanExpr.IndexKind = opts.IndexKind
+	setBoundingSpans(spanExpr)
+	if err := opts.checkMaxSpans(spanExpr); err != nil {
+		return nil, err
 	}
-	// Avoid per-span heap allocations. Each of the 2 keys in a span is the
-	// geoInvertedIndexMarker (1 byte) followed by a varint.
-	b := make([]byte, 0, len(ukSpans)*(2*encoding.MaxVarintLen+2))
-	spans := make([]inverted.Span, len(ukSpans))
-	for i, ukSpan := range ukSpans {
-		spans[i], b = geoToSpan(ukSpan, b)
+	if opts.DeferSpansToRead {
+		spanExpr.DeferSpansToRead()
 	}
-	return &inverted.SpanExpression{
-		SpansToRead:        spans,
-		FactoredUnionSpans: spans,
+	orderSpans(spanExpr, opts.spanOrdering(), len(prefixKey))
+	// The SpansToRead and FactoredUnionSpans are the same slice, unless the
+	// FactoredUnionSpans were reordered or the SpansToRead were deferred, and
+	// the coalesced spans do not share keys.
+	keyBytes := 0
+	for i := range spanExpr.FactoredUnionSpans {
+		span := &spanExpr.FactoredUnionSpans[i]
+		keyBytes += len(span.Start) + len(span.End)
 	}
+	numSpans := len(spanExpr.FactoredUnionSpans)
+	if spanExpr.UnsortedFactoredUnionSpans && !opts.DeferSpansToRead {
+		numSpans *= 2
+	}
+	spanExpr.SetMemUsage(geoSpanExprMemUsage(1 /* numNodes */, numSpans, keyBytes))
+	if opts.Sink != nil {
+		opts.Sink.RecordConversion(ConvertUnionKeySpans, spanExpr.Stats())
+	}
+	opts.recordCounts(len(spanExpr.FactoredUnionSpans), 1 /* numNodes */)
+	return spanExpr, nil
 }
 
-// GeoRPKeyExprToSpanExpr converts geoindex.RPKeyExpr to SpanExpression.
-func GeoRPKeyExprToSpanExpr(rpExpr geoindex.RPKeyExpr) (inverted.Expression, error) {
-	if len(rpExpr) == 0 {
-		return inverted.NonInvertedColExpression{}, nil
+// geoKeySpansCoverAllKeys returns true if the given spans cover all the geo
+// keys, i.e. they coalesce to the single span [0, math.MaxUint64]. Only sorted
+// spans are detected, in a single pass that stops at the first gap.
+func geoKeySpansCoverAllKeys(ukSpans geoindex.UnionKeySpans) bool {
+	if len(ukSpans) == 0 || ukSpans[0].Start != 0 {
+		return false
+	}
+	end := ukSpans[0].End
+	for _, ukSpan := range ukSpans[1:] {
+		if ukSpan.Start > end && !geoKeysAreContiguous(end, ukSpan.Start) {
+			return false
+		}
+		end = max(end, ukSpan.End)
+	}
+	return end == math.MaxUint64
+}
+
+// geoUnconstrainedSpanExpr returns an unconstrained SpanExpression, whose span
+// contains all the geo keys encoded by enc.
+func geoUnconstrainedSpanExpr(enc inverted.KeyEncoder) *inverted.SpanExpression {
+	span, _ := geoToSpan(enc, geoindex.KeySpan{Start: 0, End: math.MaxUint64}, nil /* b */)
+	spanExpr := inverted.UnconstrainedSpanExpression(span)
+	setBoundingSpans(spanExpr)
+	return spanExpr
+}
+
+// GeoMultiUnionKeySpansToSpanExpr converts the union of several
+// geoindex.UnionKeySpans, such as the coverings of the constant shapes of an
+// ST_Union, to a single SpanExpression, which is the SpanExpression that
+// GeoUnionKeySpansToSpanExpr converts their concatenation to. The sets are
+// merged in a single pass, in which the overlapping and contiguous spans of
+// different sets are coalesced before they are encoded into a single buffer.
+// This is much cheaper than combining the SpanExpressions of the sets with Or,
+// which sorts and merges the encoded spans of every pair.
+//
+// The spans of each set should be sorted and non-overlapping, as those
+// returned by geoindex are. A set whose spans are not sorted is sorted first,
+// on a copy. If all the sets are empty, the union is converted to an empty
+// SpanExpression, see inverted.EmptySpanExpression, and if it covers all the
+// keys, to an unconstrained SpanExpression, see
+// inverted.UnconstrainedSpanExpression.
+func GeoMultiUnionKeySpansToSpanExpr(spanSets []geoindex.UnionKeySpans) *inverted.SpanExpression {
+	m := keySpanMerger{sets: make([]geoindex.UnionKeySpans, 0, len(spanSets))}
+	numSpans := 0
+	for _, set := range spanSets {
+		if len(set) == 0 {
+			continue
+		}
+		if !slices.IsSortedFunc(set, cmpKeySpans) {
+			set = slices.Clone(set)
+			slices.SortFunc(set, cmpKeySpans)
+		}
+		m.sets = append(m.sets, set)
+		numSpans += len(set)
+	}
+	if numSpans == 0 {
+		return inverted.EmptySpanExpression()
+	}
+	m.init()
+	// There are at most as many coalesced spans as input spans, so the spans
+	// and their keys are allocated upfront.
+	b := make([]byte, 0, geoSpanBufferSize(nil /* prefix */, numSpans))
+	spans := make(inverted.Spans, 0, numSpans)
+	enc := GeoKeyEncoder{}
+	keyBytes := 0
+	appendSpan := func(ukSpan geoindex.KeySpan) {
+		var span inverted.Span
+		span, b = geoToSpan(enc, ukSpan, b)
+		spans = append(spans, span)
+		keyBytes += len(span.Start) + len(span.End)
+	}
+	cur, _ := m.next()
+	for next, ok := m.next(); ok; next, ok = m.next() {
+		if next.Start > cur.End && !geoKeysAreContiguous(cur.End, next.Start) {
+			appendSpan(cur)
+			cur = next
+		} else if next.End > cur.End {
+			cur.End = next.End
+		}
+	}
+	if len(spans) == 0 && cur.Start == 0 && cur.End == math.MaxUint64 {
+		return geoUnconstrainedSpanExpr(enc)
+	}
+	appendSpan(cur)
+	spanExpr := &inverted.SpanExpression{SpansToRead: spans, FactoredUnionSpans: spans}
+	setBoundingSpans(spanExpr)
+	if buildutil.CrdbTestBuild {
+		if err := spanExpr.CheckInvariants(); err != nil {
+			panic(err)
+		}
+	}
+	spanExpr.SetMemUsage(geoSpanExprMemUsage(1 /* numNodes */, len(spans), keyBytes))
+	return spanExpr
+}
+
+// cmpKeySpans orders geoindex.KeySpans by their start key.
+func cmpKeySpans(a, b geoindex.KeySpan) int {
+	return cmp.Compare(a.Start, b.Start)
+}
+
+// keySpanMerger merges non-empty sorted geoindex.UnionKeySpans into a single
+// sequence of spans sorted by their start key. It keeps a min-heap of the
+// sets, ordered by the start key of their next span.
+type keySpanMerger struct {
+	// sets are the spans of each set that have not been returned by next.
+	sets []geoindex.UnionKeySpans
+	// heap contains the indexes in sets of the sets that are not exhausted.
+	heap []int
+}
+
+func (m *keySpanMerger) init() {
+	m.heap = make([]int, len(m.sets))
+	for i := range m.heap {
+		m.heap[i] = i
+	}
+	for i := len(m.heap)/2 - 1; i >= 0; i-- {
+		m.down(i)
+	}
+}
+
+// next returns the span with the smallest start key that has not been
+// returned yet, and false if there is none.
+func (m *keySpanMerger) next() (geoindex.KeySpan, bool) {
+	if len(m.heap) == 0 {
+		return geoindex.KeySpan{}, false
+	}
+	i := m.heap[0]
+	span := m.sets[i][0]
+	if m.sets[i] = m.sets[i][1:]; len(m.sets[i]) == 0 {
+		m.heap[0] = m.heap[len(m.heap)-1]
+		m.heap = m.heap[:len(m.heap)-1]
+	}
+	m.down(0)
+	return span, true
+}
+
+// down restores the heap order of the subtree rooted at the i-th element of
+// the heap, whose children are ordered.
+func (m *keySpanMerger) down(i int) {
+	less := func(i, j int) bool {
+		return m.sets[m.heap[i]][0].Start < m.sets[m.heap[j]][0].Start
+	}
+	for {
+		smallest := i
+		for _, child := range [2]int{2*i + 1, 2*i + 2} {
+			if child < len(m.heap) && less(child, smallest) {
+				smallest = child
+			}
+		}
+		if smallest == i {
+			return
+		}
+		m.heap[i], m.heap[smallest] = m.heap[smallest], m.heap[i]
+		i = smallest
+	}
+}
+
+// GeoUnionKeySpansVisit encodes the spans of ukSpans like
+// GeoUnionKeySpansToSpanExpr, and calls visit with each of them in order,
+// without materializing them. It is intended for consumers that do not need a
+// SpanExpression, such as prefetchers of the spans, and avoids using memory
+// proportional to the number of spans. Unlike GeoUnionKeySpansToSpanExpr,
+// contiguous spans are not coalesced. If visit returns an error, the iteration
+// stops and the error is returned.
+//
+// The keys of the span passed to visit are encoded into a buffer that is
+// reused for the next span, so visit must not retain them after it returns.
+// In race builds, the buffer is overwritten after each call to visit, so that
+// tests detect retained keys.
+func GeoUnionKeySpansVisit(
+	ukSpans geoindex.UnionKeySpans, visit func(inverted.Span) error,
+) error {
+	b := make([]byte, 0, geoSpanBufferSize(nil /* prefix */, 1 /* numSpans */))
+	var enc inverted.KeyEncoder = GeoKeyEncoder{Version: encoding.GeoInvertedKeyV1}
+	for _, ukSpan := range ukSpans {
+		var span inverted.Span
+		span, b = geoToSpan(enc, ukSpan, b[:0])
+		if err := visit(span); err != nil {
+			return err
+		}
+		if util.RaceEnabled {
+			for i := range b {
+				b[i] = 0xff
+			}
+		}
+	}
+	return nil
+}
+
+// GeoRPKeyExprToSpanExpr converts geoindex.RPKeyExpr to SpanExpression. An
+// empty rpExpr is converted to an empty SpanExpression, see
+// inverted.EmptySpanExpression. If rpExpr is malformed, the returned error is
+// marked with either ErrRPKeyExprOperandUnderflow or
+// ErrRPKeyExprLeftoverOperands. If the conversion panics, e.g. because rpExpr
+// has an unexpected shape, an assertion failure error is returned instead. The
+// returned expression does not share memory with any other expression, unlike
+// those returned by a GeoSpanExprConverter. Duplicate keys in rpExpr are
+// logged to ctx, see checkDuplicateKeys.
+func GeoRPKeyExprToSpanExpr(
+	ctx context.Context, rpExpr geoindex.RPKeyExpr,
+) (inverted.Expression, error) {
+	return GeoRPKeyExprToSpanExprWithPrefix(ctx, rpExpr, nil /* prefixKey */)
+}
+
+// GeoRPKeyExprToSpanExprWithPrefix is like GeoRPKeyExprToSpanExpr, but
+// prepends prefixKey to the start and end keys of every span. See
+// GeoUnionKeySpansToSpanExprWithPrefix.
+func GeoRPKeyExprToSpanExprWithPrefix(
+	ctx context.Context, rpExpr geoindex.RPKeyExpr, prefixKey []byte,
+) (inverted.Expression, error) {
+	return GeoRPKeyExprToSpanExprWithOptions(ctx, rpExpr, prefixKey, ConvertOptions{})
+}
+
+// GeoRPKeyExprToSpanExprWithOptions is like GeoRPKeyExprToSpanExprWithPrefix,
+// but accepts options for the conversion. If ConvertOptions.MaxSpans is
+// exceeded, the returned error is marked with ErrTooManySpans, and if
+// ConvertOptions.MaxBytes is exceeded, with ErrExceedsMemoryBudget.
+func GeoRPKeyExprToSpanExprWithOptions(
+	ctx context.Context, rpExpr geoindex.RPKeyExpr, prefixKey []byte, opts ConvertOptions,
+) (inverted.Expression, error) {
+	var c GeoSpanExprConverter
+	return c.RPKeyExprToSpanExprWithOptions(ctx, rpExpr, prefixKey, opts)
+}
+
+// GeoRPKeyExprToSpanExprWithFallback converts geoindex.RPKeyExpr to
+// SpanExpression, like GeoRPKeyExprToSpanExpr. If the SpanExpression would
+// have more than maxNodes nodes, or rpExpr is malformed, it instead returns a
+// conservative SpanExpression that is the union of all the keys in rpExpr,
+// ignoring the operators, and true. The conservative SpanExpression has a
+// single node, and is not tight, so the original predicate must be
+// re-evaluated on the rows that it produces. If rpExpr has no keys, the
+// returned SpanExpression is empty, see inverted.EmptySpanExpression.
+func GeoRPKeyExprToSpanExprWithFallback(
+	ctx context.Context, rpExpr geoindex.RPKeyExpr, maxNodes int,
+) (_ *inverted.SpanExpression, fallback bool) {
+	expr, err := GeoRPKeyExprToSpanExpr(ctx, rpExpr)
+	if err == nil {
+		spanExpr := expr.(*inverted.SpanExpression)
+		if spanExpr.IsEmpty() || spanExpr.Stats().NumNodes <= maxNodes {
+			return spanExpr, false
+		}
 	}
-	spansToRead := make([]inverted.Span, 0, len(rpExpr))
-	var b []byte // avoid per-expr heap allocations
-	var stack []*inverted.SpanExpression
+	ukSpans := make(geoindex.UnionKeySpans, 0, len(rpExpr))
 	for _, elem := range rpExpr {
+		if k, ok := elem.(geoindex.Key); ok {
+			ukSpans = append(ukSpans, geoindex.KeySpan{Start: k, End: k})
+		}
+	}
+	spanExpr := GeoUnionKeySpansToSpanExpr(ukSpans).(*inverted.SpanExpression)
+	spanExpr.Tight = false
+	return spanExpr, true
+}
+
+// GeoSpanExprConverter converts geoindex.RPKeyExprs to SpanExpressions, reusing
+// the memory of the SpanExpression nodes, their spans, and the operator stack
+// across conversions. It is intended for callers that perform a conversion per
+// row, such as inverted joins. The zero value is ready to use.
+//
+// The SpanExpressions returned by the converter share memory owned by the
+// converter, and are invalidated by the next call to Reset. Use
+// SpanExpression.Detach to retain an expression across calls to Reset. The
+// encoded keys are not reused, so a SpanExpressionProto built from a returned
+// expression with ToProto remains valid after Reset.
+//
+// When the geoindex.RPKeyExpr is a union of keys, the SpansToRead of the
+// returned expression are the same slice as its FactoredUnionSpans, as for the
+// expressions returned by GeoUnionKeySpansToSpanExpr, so modifying the spans of
+// one modifies the other.
+type GeoSpanExprConverter struct {
+	// nodes is used to allocate SpanExpression nodes. The FactoredUnionSpans
+	// slice of each node is retained across calls to Reset, so that its memory
+	// can be reused. Each of these slices is owned by exactly one node.
+	nodes []inverted.SpanExpression
+	// spans is used to allocate the SpansToRead of the returned expressions
+	// that do not share the FactoredUnionSpans of their root.
+	spans []inverted.Span
+	stack []*inverted.SpanExpression
+}
+
+// Reset invalidates all the SpanExpressions returned by the converter, and
+// makes their memory available for reuse.
+func (c *GeoSpanExprConverter) Reset() {
+	c.nodes = c.nodes[:0]
+	c.spans = c.spans[:0]
+}
+
+// reserve ensures that numNodes nodes and numSpans spans can be allocated
+// without growing the slabs, since growing would move the nodes that are
+// still referenced.
+func (c *GeoSpanExprConverter) reserve(numNodes, numSpans int) {
+	if cap(c.nodes)-len(c.nodes) < numNodes {
+		// Expressions returned since the last Reset keep referencing the old
+		// slab, so it must not be copied into the new one.
+		c.nodes = make([]inverted.SpanExpression, 0, max(2*cap(c.nodes), numNodes))
+	}
+	if cap(c.spans)-len(c.spans) < numSpans {
+		c.spans = make([]inverted.Span, 0, max(2*cap(c.spans), numSpans))
+	}
+}
+
+// newNode returns an empty SpanExpression, whose FactoredUnionSpans has
+// length zero but may have spare capacity from a previous conversion.
+//
+// REQUIRES: a node was reserved.
+func (c *GeoSpanExprConverter) newNode() *inverted.SpanExpression {
+	c.nodes = c.nodes[:len(c.nodes)+1]
+	n := &c.nodes[len(c.nodes)-1]
+	*n = inverted.SpanExpression{FactoredUnionSpans: n.FactoredUnionSpans[:0]}
+	return n
+}
+
+// RPKeyExprToSpanExpr converts geoindex.RPKeyExpr to SpanExpression. See
+// GeoRPKeyExprToSpanExpr.
+func (c *GeoSpanExprConverter) RPKeyExprToSpanExpr(
+	ctx context.Context, rpExpr geoindex.RPKeyExpr,
+) (inverted.Expression, error) {
+	return c.RPKeyExprToSpanExprWithPrefix(ctx, rpExpr, nil /* prefixKey */)
+}
+
+// RPKeyExprToSpanExprWithPrefix converts geoindex.RPKeyExpr to
+// SpanExpression. See GeoRPKeyExprToSpanExprWithPrefix.
+func (c *GeoSpanExprConverter) RPKeyExprToSpanExprWithPrefix(
+	ctx context.Context, rpExpr geoindex.RPKeyExpr, prefixKey []byte,
+) (inverted.Expression, error) {
+	return c.RPKeyExprToSpanExprWithOptions(ctx, rpExpr, prefixKey, ConvertOptions{})
+}
+
+// RPKeyExprToSpanExprWithOptions converts geoindex.RPKeyExpr to
+// SpanExpression. See GeoRPKeyExprToSpanExprWithOptions. If the conversion
+// panics, the SpanExpressions returned by the converter since the last call to
+// Reset remain valid. The errors of the conversion carry a summary of rpExpr
+// as a detail, see withRPKeyExprDetail.
+func (c *GeoSpanExprConverter) RPKeyExprToSpanExprWithOptions(
+	ctx context.Context, rpExpr geoindex.RPKeyExpr, prefixKey []byte, opts ConvertOptions,
+) (_ inverted.Expression, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = convertPanicError(r, rpExpr)
+		}
+		if err != nil {
+			err = opts.withRPKeyExprDetail(err, rpExpr)
+		}
+	}()
+	if testingConvertHook != nil {
+		testingConvertHook(ConvertRPKeyExpr)
+	}
+	return c.rpKeyExprToSpanExpr(ctx, rpExpr, prefixKey, opts)
+}
+
+// rpKeyExprToSpanExpr implements RPKeyExprToSpanExprWithOptions, without
+// recovering from panics.
+func (c *GeoSpanExprConverter) rpKeyExprToSpanExpr(
+	ctx context.Context, rpExpr geoindex.RPKeyExpr, prefixKey []byte, opts ConvertOptions,
+) (inverted.Expression, error) {
+	if err := opts.checkSpanOrdering(); err != nil {
+		return nil, err
+	}
+	if len(rpExpr) == 0 {
+		return opts.emptySpanExpr(), nil
+	}
+	// The expression is scanned once upfront, so that the memory of the
+	// conversion can be allocated at once rather than grown as it proceeds.
+	counts := countRPKeyExpr(rpExpr)
+	numKeys, numIntersections := counts.numKeys, counts.numIntersections
+	unionOnly := numIntersections == 0
+	if err := opts.checkMaxBytes(
+		estimateRPKeyExprMemUsage(prefixKey, numKeys, numIntersections),
+	); err != nil {
+		return nil, err
+	}
+	// Size the buffer for the encoded keys upfront, since growing it would
+	// waste the capacity used by the keys encoded so far. The spans of the keys
+	// are almost always point spans, so the buffer is sized for their start
+	// keys and the few end keys that need to be stored.
+	b := make([]byte, 0, geoKeyBufferSize(prefixKey, numKeys+counts.numEndKeys))
+	if unionOnly {
+		return c.unionRPKeysToSpanExpr(ctx, rpExpr, prefixKey, opts, numKeys, b)
+	}
+	// Each element of the expression creates at most one node and one span.
+	c.reserve(len(rpExpr), len(rpExpr))
+	if cap(c.stack) < counts.maxDepth {
+		c.stack = make([]*inverted.SpanExpression, 0, counts.maxDepth)
+	}
+	// leafSpans backs the FactoredUnionSpans of the leaves whose nodes do not
+	// have enough memory from a previous conversion, so that the leaves do not
+	// allocate a slice each. A leaf that is followed by a chain of unions of
+	// keys has room for their spans, which are merged into it, and every other
+	// leaf has room for its own span, so numKeys+numUnionedKeys spans suffice.
+	// It is allocated when the first such leaf is created.
+	var leafSpans inverted.Spans
+	// Each key is a span to read. The keys in the RPKeyExpr should be unique,
+	// but duplicates are pruned from the SpansToRead after they are sorted, see
+	// checkDuplicateKeys. The spans of the keys are copied into the
+	// FactoredUnionSpans of the leaves,
+	// which are owned by the nodes so that they can be reused, so the
+	// SpansToRead cannot share their memory.
+	spansToRead := c.spans[len(c.spans) : len(c.spans)+numKeys : cap(c.spans)]
+	keyBytes, err := encodeRPKeys(ctx, rpExpr, prefixKey, opts, spansToRead, b)
+	if err != nil {
+		return nil, err
+	}
+	stack := c.stack[:0]
+	keyIdx := 0
+	for i, elem := range rpExpr {
 		switch e := elem.(type) {
 		case geoindex.Key:
-			var span inverted.Span
-			span, b = geoToSpan(geoindex.KeySpan{Start: e, End: e}, b)
-			// The keys in the RPKeyExpr are unique, so simply append to spansToRead.
-			spansToRead = append(spansToRead, span)
-			stack = append(stack, &inverted.SpanExpression{
-				FactoredUnionSpans: []inverted.Span{span},
-			})
+			span := spansToRead[keyIdx]
+			keyIdx++
+			node := c.newNode()
+			if n := 1 + numUnionedKeysAfter(rpExpr, i); cap(node.FactoredUnionSpans) < n {
+				if leafSpans == nil {
+					leafSpans = make(inverted.Spans, numKeys+counts.numUnionedKeys)
+				}
+				// The capacity is limited, so that appending to the
+				// FactoredUnionSpans of the leaf does not overwrite those of
+				// other leaves. mergeUnionSpans merges into the operand with
+				// the larger capacity, which is this leaf for the chain of
+				// unions that follows it.
+				node.FactoredUnionSpans = leafSpans[:0:n]
+				leafSpans = leafSpans[n:]
+			}
+			node.FactoredUnionSpans = append(node.FactoredUnionSpans, span)
+			stack = append(stack, node)
 		case geoindex.RPSetOperator:
 			if len(stack) < 2 {
-				return nil, errors.Errorf("malformed expression: %s", rpExpr)
+				return nil, rpKeyExprUnderflowError(e, i, len(stack))
 			}
 			node0, node1 := stack[len(stack)-1], stack[len(stack)-2]
 			var node *inverted.SpanExpression
 			stack = stack[:len(stack)-2]
 			switch e {
 			case geoindex.RPSetIntersection:
-				node = makeSpanExpression(inverted.SetIntersection, node0, node1)
+				node = c.makeSpanExpression(inverted.SetIntersection, node0, node1)
 			case geoindex.RPSetUnion:
 				if node0.Operator == inverted.None {
 					node0, node1 = node1, node0
@@ -113,40 +1057,924 @@ func GeoRPKeyExprToSpanExpr(rpExpr geoindex.RPKeyExpr) (inverted.Expression, err
 				if node1.Operator == inverted.None {
 					// node1 can be discarded after unioning its FactoredUnionSpans.
 					node = node0
-					// Union into the one with the larger capacity. This optimizes
-					// the case of many unions. We will sort the spans later.
-					if cap(node.FactoredUnionSpans) < cap(node1.FactoredUnionSpans) {
-						node.FactoredUnionSpans = append(node1.FactoredUnionSpans, node.FactoredUnionSpans...)
-					} else {
-						node.FactoredUnionSpans = append(node.FactoredUnionSpans, node1.FactoredUnionSpans...)
-					}
+					mergeUnionSpans(node, node1)
 				} else {
-					node = makeSpanExpression(inverted.SetUnion, node0, node1)
+					node = c.makeSpanExpression(inverted.SetUnion, node0, node1)
 				}
 			}
 			stack = append(stack, node)
 		}
 	}
+	c.stack = stack[:0]
 	if len(stack) != 1 {
-		return inverted.NonInvertedColExpression{}, errors.Errorf("malformed expression: %s", rpExpr)
+		return inverted.NonInvertedColExpression{}, rpKeyExprLeftoverError(len(stack), len(rpExpr))
+	}
+	c.spans = c.spans[:len(c.spans)+len(spansToRead)]
+	spanExpr := stack[0]
+	spanExpr.IndexKind = opts.IndexKind
+	// The spans to read are in the order of the keys in the RPKeyExpr.
+	opts.sortSpans(ctx, spansToRead)
+	checkDuplicateKeys(ctx, spansToRead, len(prefixKey))
+	spanExpr.SpansToRead = pruneSortedSpans(spansToRead)
+	// Sort the FactoredUnionSpans of the root, which are only unsorted if a
+	// union could not merge the spans of its operands in order. The others are
+	// already sorted in makeSpanExpression.
+	spanExpr.FactoredUnionSpans = sortAndPruneNodeSpans(spanExpr)
+	if err := opts.checkMaxSpans(spanExpr); err != nil {
+		return nil, err
+	}
+	if opts.FlattenBelowNodes > 0 && spanExpr.Stats().NumNodes < opts.FlattenBelowNodes {
+		flattenSpanExpr(spanExpr)
+	}
+	if opts.PromoteFactoredSpans {
+		PromoteFactoredSpans(spanExpr)
+	}
+	setBoundingSpans(spanExpr)
+	if opts.PartialSpansToRead {
+		restrictSpansToReadToChildBounds(spanExpr)
+	}
+	orderSpans(spanExpr, opts.spanOrdering(), len(prefixKey))
+	if buildutil.CrdbTestBuild {
+		if err := spanExpr.CheckInvariants(); err != nil {
+			return nil, errors.Wrapf(err, "converting %s", rpExpr)
+		}
+	}
+	// The expression is fully constructed, so populate the cached statistics
+	// of the root eagerly.
+	stats := spanExpr.Stats()
+	if len(spanExpr.SpansToRead) == numKeys {
+		// Every span in the tree is one of the SpansToRead, unless there were
+		// duplicate keys, in which case MemUsage is computed lazily.
+		spanExpr.SetMemUsage(geoSpanExprMemUsage(
+			stats.NumNodes, len(spanExpr.SpansToRead)+stats.NumFactoredSpans, keyBytes,
+		))
 	}
-	spanExpr := *stack[0]
-	spanExpr.SpansToRead = spansToRead
-	sort.Sort(spanExpr.SpansToRead)
-	// Sort the FactoredUnionSpans of the root. The others are already sorted
-	// in makeSpanExpression.
-	sort.Sort(spanExpr.FactoredUnionSpans)
-	return &spanExpr, nil
+	if opts.Sink != nil {
+		opts.Sink.RecordConversion(ConvertRPKeyExpr, stats)
+	}
+	opts.recordCounts(len(spanExpr.SpansToRead), stats.NumNodes)
+	return spanExpr, nil
+}
+
+// unionRPKeysToSpanExpr converts rpExpr, which has numKeys keys and no
+// operators other than geoindex.RPSetUnion, to a SpanExpression, using b for
+// the encoded keys. The union of keys is a single node, whose
+// FactoredUnionSpans are the spans of the keys, so the keys are encoded
+// directly into the FactoredUnionSpans of the node, without building a node
+// per key, and the SpansToRead are the same slice as the FactoredUnionSpans.
+// The result is identical to that of applying the operators.
+func (c *GeoSpanExprConverter) unionRPKeysToSpanExpr(
+	ctx context.Context,
+	rpExpr geoindex.RPKeyExpr,
+	prefixKey []byte,
+	opts ConvertOptions,
+	numKeys int,
+	b []byte,
+) (inverted.Expression, error) {
+	depth := 0
+	for i, elem := range rpExpr {
+		if e, ok := elem.(geoindex.RPSetOperator); ok {
+			if depth < 2 {
+				return nil, rpKeyExprUnderflowError(e, i, depth)
+			}
+			depth--
+		} else {
+			depth++
+		}
+	}
+	if depth != 1 {
+		return inverted.NonInvertedColExpression{}, rpKeyExprLeftoverError(depth, len(rpExpr))
+	}
+	c.reserve(1 /* numNodes */, 0 /* numSpans */)
+	spanExpr := c.newNode()
+	spans := spanExpr.FactoredUnionSpans
+	if cap(spans) < numKeys {
+		spans = make(inverted.Spans, numKeys)
+	}
+	spans = spans[:numKeys]
+	keyBytes, err := encodeRPKeys(ctx, rpExpr, prefixKey, opts, spans, b)
+	if err != nil {
+		return nil, err
+	}
+	opts.sortSpans(ctx, spans)
+	checkDuplicateKeys(ctx, spans, len(prefixKey))
+	spans = pruneSortedSpans(spans)
+	// The SpansToRead alias the FactoredUnionSpans, which are owned by the node
+	// and reused after Reset, like the FactoredUnionSpans of any other node.
+	spanExpr.FactoredUnionSpans = spans
+	spanExpr.SpansToRead = spans
+	spanExpr.IndexKind = opts.IndexKind
+	setBoundingSpans(spanExpr)
+	if err := opts.checkMaxSpans(spanExpr); err != nil {
+		return nil, err
+	}
+	if opts.DeferSpansToRead {
+		spanExpr.DeferSpansToRead()
+	}
+	orderSpans(spanExpr, opts.spanOrdering(), len(prefixKey))
+	if buildutil.CrdbTestBuild {
+		if err := spanExpr.CheckInvariants(); err != nil {
+			return nil, errors.Wrapf(err, "converting %s", rpExpr)
+		}
+	}
+	stats := spanExpr.Stats()
+	if len(spans) == numKeys {
+		// The FactoredUnionSpans are no longer the same slice as the
+		// SpansToRead if they were reordered, unless the SpansToRead were
+		// deferred.
+		numSpans := len(spans)
+		if spanExpr.UnsortedFactoredUnionSpans && !opts.DeferSpansToRead {
+			numSpans *= 2
+		}
+		spanExpr.SetMemUsage(geoSpanExprMemUsage(1 /* numNodes */, numSpans, keyBytes))
+	}
+	if opts.Sink != nil {
+		opts.Sink.RecordConversion(ConvertRPKeyExpr, stats)
+	}
+	opts.recordCounts(len(spans), 1 /* numNodes */)
+	return spanExpr, nil
+}
+
+// flattenSpanExpr implements ConvertOptions.FlattenBelowNodes for spanExpr,
+// whose SpansToRead are complete, sorted and pruned, by replacing it with a
+// single node whose FactoredUnionSpans are its SpansToRead. The spans are
+// copied into the FactoredUnionSpans of the node, which the node owns, see
+// GeoSpanExprConverter. An expression without children is left as it is.
+func flattenSpanExpr(spanExpr *inverted.SpanExpression) {
+	if spanExpr.Operator == inverted.None {
+		return
+	}
+	spanExpr.FactoredUnionSpans = append(spanExpr.FactoredUnionSpans[:0], spanExpr.SpansToRead...)
+	spanExpr.Operator = inverted.None
+	spanExpr.Left = nil
+	spanExpr.Right = nil
+	spanExpr.Tight = false
+	spanExpr.Flattened = true
+	spanExpr.InvalidateCaches()
+}
+
+// setBoundingSpans sets the spans from which the bounding span of spanExpr is
+// computed to the first and the last of its SpansToRead, which must be
+// complete, sorted and pruned, so that the passes that then defer, reorder or
+// restrict the SpansToRead do not change the bounding span, see
+// inverted.SpanExpression.BoundingSpan.
+func setBoundingSpans(spanExpr *inverted.SpanExpression) {
+	if spans := spanExpr.SpansToRead; len(spans) > 0 {
+		spanExpr.SetBoundingSpans(spans[0], spans[len(spans)-1])
+	}
+}
+
+// restrictSpansToReadToChildBounds implements
+// ConvertOptions.PartialSpansToRead for spanExpr, whose SpansToRead are
+// complete and whose FactoredUnionSpans are sorted. The SpansToRead are
+// filtered in place.
+func restrictSpansToReadToChildBounds(spanExpr *inverted.SpanExpression) {
+	if spanExpr.Operator != inverted.SetIntersection {
+		return
+	}
+	left, leftOk := spanExpr.Left.(*inverted.SpanExpression)
+	right, rightOk := spanExpr.Right.(*inverted.SpanExpression)
+	if !leftOk || !rightOk {
+		return
+	}
+	leftFirst, leftLast, leftOk := subtreeBounds(left)
+	rightFirst, rightLast, rightOk := subtreeBounds(right)
+	if !leftOk || !rightOk {
+		return
+	}
+	// The spans in bounds overlap [start, end).
+	start := leftFirst.Start
+	if bytes.Compare(rightFirst.Start, start) > 0 {
+		start = rightFirst.Start
+	}
+	end := leftLast
+	if rightLast.CompareEnds(end) < 0 {
+		end = rightLast
+	}
+	endKey := end.EndKey()
+	spans := spanExpr.SpansToRead
+	factored := spanExpr.FactoredUnionSpans
+	out := spans[:0]
+	for _, span := range spans {
+		// Skip the factored spans that end before span, so that factored[0]
+		// is the first that may overlap it.
+		for len(factored) > 0 && factored[0].CompareEnd(span.Start) <= 0 {
+			factored = factored[1:]
+		}
+		inBounds := bytes.Compare(span.Start, endKey) < 0 && span.CompareEnd(start) > 0
+		if inBounds || (len(factored) > 0 && span.CompareEnd(factored[0].Start) > 0) {
+			out = append(out, span)
+		}
+	}
+	if len(out) < len(spans) {
+		spanExpr.SpansToRead = out
+		spanExpr.PartialSpansToRead = true
+	}
+}
+
+// subtreeBounds returns the spans of the subtree rooted at node with the
+// smallest start key and the largest end key, and false if it has no spans.
+func subtreeBounds(node *inverted.SpanExpression) (first, last inverted.Span, ok bool) {
+	for _, span := range node.FactoredUnionSpans {
+		if !ok || bytes.Compare(span.Start, first.Start) < 0 {
+			first = span
+		}
+		if !ok || span.CompareEnds(last) > 0 {
+			last = span
+		}
+		ok = true
+	}
+	for _, child := range []inverted.Expression{node.Left, node.Right} {
+		c, isSpanExpr := child.(*inverted.SpanExpression)
+		if !isSpanExpr {
+			continue
+		}
+		if childFirst, childLast, childOk := subtreeBounds(c); childOk {
+			if !ok || bytes.Compare(childFirst.Start, first.Start) < 0 {
+				first = childFirst
+			}
+			if !ok || childLast.CompareEnds(last) > 0 {
+				last = childLast
+			}
+			ok = true
+		}
+	}
+	return first, last, ok
+}
+
+// withRPKeyExprDetail attaches a compact summary of rpExpr, and of the shape
+// described by the BoundingBox and SRID of the options, to err with
+// errors.WithDetailf, so that it is included in the logs and in the verbose
+// form of the error, but not in its message. The summary consists of the
+// number of keys and operators of rpExpr, and the minimum and maximum cell IDs
+// of its keys, which locate the covering without including it.
+func (opts ConvertOptions) withRPKeyExprDetail(err error, rpExpr geoindex.RPKeyExpr) error {
+	numKeys := 0
+	var minKey, maxKey geoindex.Key
+	for _, elem := range rpExpr {
+		if k, ok := elem.(geoindex.Key); ok {
+			if numKeys == 0 || k < minKey {
+				minKey = k
+			}
+			if numKeys == 0 || k > maxKey {
+				maxKey = k
+			}
+			numKeys++
+		}
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d keys, %d operators", numKeys, len(rpExpr)-numKeys)
+	if numKeys > 0 {
+		fmt.Fprintf(&b, ", cell IDs %d to %d", minKey, maxKey)
+	}
+	if bbox := opts.BoundingBox; bbox != nil {
+		fmt.Fprintf(&b, ", bounding box (%g %g, %g %g)", bbox.LoX, bbox.LoY, bbox.HiX, bbox.HiY)
+	}
+	if opts.SRID != 0 {
+		fmt.Fprintf(&b, ", SRID %d", opts.SRID)
+	}
+	return errors.WithDetailf(err, "geoindex.RPKeyExpr: %s", b.String())
+}
+
+// rpKeyExprUnderflowError returns the error for the set operator op at index i
+// of a geoindex.RPKeyExpr, which is applied to a stack of the given depth.
+func rpKeyExprUnderflowError(op geoindex.RPSetOperator, i, depth int) error {
+	return errors.Mark(errors.Errorf(
+		"malformed expression: operator %s at index %d with stack depth %d",
+		op, i, depth), ErrRPKeyExprOperandUnderflow)
+}
+
+// rpKeyExprLeftoverError returns the error for a geoindex.RPKeyExpr of the
+// given length that leaves a stack of the given depth.
+func rpKeyExprLeftoverError(depth, length int) error {
+	return errors.Mark(errors.Errorf(
+		"malformed expression: stack depth %d at end of expression of length %d",
+		depth, length), ErrRPKeyExprLeftoverOperands)
+}
+
+// encodeRPKeys encodes the keys of rpExpr, in order, as the spans in spans,
+// which has one span per key, using b for the encoded keys, and returns the
+// total length of the encoded keys. b should have the capacity for one key per
+// span. Each goroutine uses its own part of b, and allocates if it needs more
+// memory, which does not change the encoded keys. If the encoding of a range
+// of keys panics, all goroutines are waited for, and the panic is returned as
+// an assertion failure error.
+func encodeRPKeys(
+	ctx context.Context,
+	rpExpr geoindex.RPKeyExpr,
+	prefixKey []byte,
+	opts ConvertOptions,
+	spans inverted.Spans,
+	b []byte,
+) (keyBytes int, _ error) {
+	enc := opts.keyEncoder(prefixKey)
+	numWorkers := 1
+	if opts.Parallelism > 1 {
+		numWorkers = min(opts.Parallelism, len(spans)/minKeysPerConvertWorker)
+	}
+	if numWorkers <= 1 {
+		return encodeRPKeyRange(rpExpr, enc, spans[:0], b), nil
+	}
+	workerKeyBytes := make([]int, numWorkers)
+	encodeWorkerRange := func(
+		w int, elems geoindex.RPKeyExpr, workerSpans inverted.Spans, workerBuf []byte,
+	) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = convertPanicError(r, rpExpr)
+			}
+		}()
+		workerKeyBytes[w] = encodeRPKeyRange(elems, enc, workerSpans, workerBuf)
+		return nil
+	}
+	// Each worker encodes a contiguous range of the keys into its own part of
+	// b, which is sized for the keys it encodes.
+	keySize := geoKeyBufferSize(prefixKey, 1 /* numKeys */)
+	g := ctxgroup.WithContext(ctx)
+	var lastErr error
+	elemIdx, keyIdx := 0, 0
+	for w := 0; w < numWorkers; w++ {
+		startElemIdx, startKeyIdx := elemIdx, keyIdx
+		endKeyIdx := (w + 1) * len(spans) / numWorkers
+		for ; keyIdx < endKeyIdx; elemIdx++ {
+			if _, ok := rpExpr[elemIdx].(geoindex.Key); ok {
+				keyIdx++
+			}
+		}
+		elems := rpExpr[startElemIdx:elemIdx]
+		workerSpans := spans[startKeyIdx:startKeyIdx:endKeyIdx]
+		workerBuf := b[startKeyIdx*keySize : startKeyIdx*keySize : endKeyIdx*keySize]
+		if w == numWorkers-1 {
+			// Encode the last range on this goroutine.
+			lastErr = encodeWorkerRange(w, elems, workerSpans, workerBuf)
+			break
+		}
+		g.GoCtx(func(context.Context) error {
+			return encodeWorkerRange(w, elems, workerSpans, workerBuf)
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return 0, err
+	}
+	if lastErr != nil {
+		return 0, lastErr
+	}
+	for _, n := range workerKeyBytes {
+		keyBytes += n
+	}
+	return keyBytes, nil
+}
+
+// encodeRPKeyRange appends the spans of the keys of rpExpr, encoded with enc,
+// to spans, which must have the capacity for them, using b for the encoded
+// keys, and returns the total length of the encoded keys.
+func encodeRPKeyRange(
+	rpExpr geoindex.RPKeyExpr, enc inverted.KeyEncoder, spans inverted.Spans, b []byte,
+) (keyBytes int) {
+	for _, elem := range rpExpr {
+		if k, ok := elem.(geoindex.Key); ok {
+			var span inverted.Span
+			span, b = geoToPointSpan(enc, k, b)
+			spans = append(spans, span)
+			keyBytes += len(span.Start) + len(span.End)
+		}
+	}
+	return keyBytes
+}
+
+// EstimateConvertedSize returns an estimate of the number of spans to read of
+// the SpanExpression that rpExpr is converted to, and of its MemUsage. It only
+// counts the keys and operators of rpExpr, without encoding anything, so it is
+// much cheaper than the conversion, and can be used to decide whether to
+// convert rpExpr at all. The estimates assume that the keys are unique and
+// have no prefix, and that their encodings have the maximum length, so they
+// are usually a bit larger than the actual values. See also
+// ConvertOptions.MaxBytes.
+func EstimateConvertedSize(rpExpr geoindex.RPKeyExpr) (spans int, bytes int64) {
+	counts := countRPKeyExpr(rpExpr)
+	return counts.numKeys, estimateRPKeyExprMemUsage(
+		nil /* prefixKey */, counts.numKeys, counts.numIntersections,
+	)
+}
+
+// rpKeyExprCounts are the counts of the elements of a geoindex.RPKeyExpr that
+// determine the memory of its conversion, see countRPKeyExpr.
+type rpKeyExprCounts struct {
+	numKeys          int
+	numIntersections int
+	// maxDepth is the maximum depth of the operand stack when the expression
+	// is evaluated, i.e. the maximum number of pending subexpressions.
+	maxDepth int
+	// numEndKeys is an upper bound on the number of keys whose point spans
+	// store their end keys, see geoKeyEndCarries.
+	numEndKeys int
+	// numUnionedKeys is the number of keys that are immediately followed by a
+	// union, i.e. that are unioned into the preceding subexpression.
+	numUnionedKeys int
+}
+
+// countRPKeyExpr counts the elements of rpExpr in a single pass, which does
+// not allocate.
+func countRPKeyExpr(rpExpr geoindex.RPKeyExpr) rpKeyExprCounts {
+	var counts rpKeyExprCounts
+	depth := 0
+	for i, elem := range rpExpr {
+		switch e := elem.(type) {
+		case geoindex.Key:
+			counts.numKeys++
+			if geoKeyEndCarries(e) {
+				counts.numEndKeys++
+			}
+			if i+1 < len(rpExpr) && rpExpr[i+1] == geoindex.RPSetUnion {
+				counts.numUnionedKeys++
+			}
+			depth++
+			counts.maxDepth = max(counts.maxDepth, depth)
+		case geoindex.RPSetOperator:
+			if e == geoindex.RPSetIntersection {
+				counts.numIntersections++
+			}
+			depth--
+		}
+	}
+	return counts
+}
+
+// numUnionedKeysAfter returns the number of keys that follow the element at
+// index i of rpExpr and are each immediately followed by a union, so that they
+// are unioned one by one into the subexpression that ends at i.
+func numUnionedKeysAfter(rpExpr geoindex.RPKeyExpr, i int) int {
+	n := 0
+	for j := i + 1; j+1 < len(rpExpr); j += 2 {
+		if _, ok := rpExpr[j].(geoindex.Key); !ok || rpExpr[j+1] != geoindex.RPSetUnion {
+			break
+		}
+		n++
+	}
+	return n
+}
+
+// geoKeyEndCarries returns true if incrementing k may carry into another byte
+// of its encoding, in which case the end key of the point span of k is not the
+// PrefixEnd of its start key and is stored by geoToPointSpan.
+func geoKeyEndCarries(k geoindex.Key) bool {
+	return uint8(k) == math.MaxUint8 ||
+		encoding.EncodedLengthUvarintAscending(uint64(k)) !=
+			encoding.EncodedLengthUvarintAscending(uint64(k)+1)
+}
+
+// estimateRPKeyExprMemUsage returns an estimate of the MemUsage of the
+// SpanExpression of an RPKeyExpr with the given number of keys and
+// intersections, whose keys are prefixed by prefixKey.
+func estimateRPKeyExprMemUsage(prefixKey []byte, numKeys, numIntersections int) int64 {
+	keyBytes := geoKeyBufferSize(prefixKey, numKeys)
+	if numIntersections == 0 {
+		// The keys are unioned into a single node, whose SpansToRead and
+		// FactoredUnionSpans are the same slice.
+		return geoSpanExprMemUsage(1 /* numNodes */, numKeys, keyBytes)
+	}
+	// Every intersection is a node with two children, and unions are mostly
+	// merged into their operands. Every key is both a span to read and a
+	// factored span of some node.
+	return geoSpanExprMemUsage(2*numIntersections+1, 2*numKeys, keyBytes)
 }
 
-func makeSpanExpression(
+// geoSpanExprMemUsage returns the value of SpanExpression.MemUsage for a
+// SpanExpression with the given number of nodes, and of spans in distinct
+// arrays, whose keys do not share memory and have the given total length.
+func geoSpanExprMemUsage(numNodes, numSpans, keyBytes int) int64 {
+	return int64(numNodes)*inverted.SpanExpressionOverhead +
+		int64(numSpans)*inverted.SpanOverhead + int64(keyBytes)
+}
+
+// sortSpans sorts the given spans in place. Spans that are already sorted,
+// such as those encoded from geoindex.UnionKeySpans, are only verified to be
+// sorted. Unlike sort.Sort and sort.Slice, it does not allocate.
+func sortSpans(spans inverted.Spans) {
+	for i := 1; i < len(spans); i++ {
+		if cmpSpans(spans[i-1], spans[i]) > 0 {
+			slices.SortFunc(spans, cmpSpans)
+			return
+		}
+	}
+}
+
+// sortAndPruneSpans sorts the given spans in place, and removes the spans that
+// are contained in other spans, including duplicates. A geoindex.RPKeyExpr
+// should not contain duplicate keys, but the spans of duplicate keys would
+// otherwise overlap. Similarly, a fine-level span that is contained in a
+// coarse-level span does not change the union of the spans.
+func sortAndPruneSpans(spans inverted.Spans) inverted.Spans {
+	sortSpans(spans)
+	return pruneSortedSpans(spans)
+}
+
+// sortAndPruneNodeSpans is like sortAndPruneSpans for the FactoredUnionSpans
+// of a node under construction, which are only sorted if mergeUnionSpans
+// marked them with UnsortedFactoredUnionSpans. The mark is cleared.
+func sortAndPruneNodeSpans(node *inverted.SpanExpression) inverted.Spans {
+	if node.UnsortedFactoredUnionSpans {
+		slices.SortFunc(node.FactoredUnionSpans, cmpSpans)
+		node.UnsortedFactoredUnionSpans = false
+	}
+	return pruneSortedSpans(node.FactoredUnionSpans)
+}
+
+// mergeUnionSpans unions the FactoredUnionSpans of src into those of dst,
+// leaving src with no spans. Both nodes are leaves of an expression under
+// construction, so the spans are not pruned.
+//
+// If the spans of both nodes are sorted, they are merged like in a merge join,
+// and the spans of dst remain sorted. The merge moves the spans of src and the
+// spans of dst that sort after the first span of src, so it takes time
+// proportional to the number of spans of src if the keys of a
+// geoindex.RPKeyExpr appear in increasing order, as for a long union of keys.
+// If the merge would move more spans of dst than there are spans of src, the
+// spans of src are appended instead, and dst is marked with
+// UnsortedFactoredUnionSpans, so that its spans are sorted once in
+// sortAndPruneNodeSpans instead of being moved by every union.
+func mergeUnionSpans(dst, src *inverted.SpanExpression) {
+	// Union into the one with the larger capacity. This optimizes the case of
+	// many unions.
+	if cap(dst.FactoredUnionSpans) < cap(src.FactoredUnionSpans) {
+		// Swap the slices, so that each node continues to own a distinct slice.
+		dst.FactoredUnionSpans, src.FactoredUnionSpans =
+			src.FactoredUnionSpans, dst.FactoredUnionSpans
+	}
+	a, b := dst.FactoredUnionSpans, src.FactoredUnionSpans
+	src.FactoredUnionSpans = b[:0]
+	unsorted := dst.UnsortedFactoredUnionSpans || src.UnsortedFactoredUnionSpans
+	src.UnsortedFactoredUnionSpans = false
+	if len(b) == 0 {
+		dst.UnsortedFactoredUnionSpans = unsorted
+		return
+	}
+	// The spans of a before pos do not sort after any span of b. In the common
+	// case, none do.
+	pos := len(a)
+	if !unsorted && len(a) > 0 && cmpSpans(a[len(a)-1], b[0]) > 0 {
+		pos = sort.Search(len(a), func(i int) bool { return cmpSpans(a[i], b[0]) > 0 })
+	}
+	if unsorted || len(a)-pos > len(b) {
+		dst.FactoredUnionSpans = append(a, b...)
+		dst.UnsortedFactoredUnionSpans = true
+		return
+	}
+	i, j := len(a)-1, len(b)-1
+	a = append(a, b...)
+	for k := len(a) - 1; j >= 0; k-- {
+		if i >= pos && cmpSpans(a[i], b[j]) > 0 {
+			a[k] = a[i]
+			i--
+		} else {
+			a[k] = b[j]
+			j--
+		}
+	}
+	dst.FactoredUnionSpans = a
+}
+
+// duplicateKeyLogLimiter rate-limits the reports of duplicate keys in
+// checkDuplicateKeys.
+var duplicateKeyLogLimiter = log.Every(10 * time.Second)
+
+// checkDuplicateKeys logs the duplicate keys among the given sorted spans of
+// the keys of a geoindex.RPKeyExpr, whose encodings are preceded by a prefix
+// of the given length. geoindex never emits the same cell twice, so a
+// duplicate is a bug there, which is logged as an error in test builds and as
+// a warning otherwise. The duplicates are harmless, since pruneSortedSpans
+// removes them from the SpansToRead and the unions and intersections of the
+// same key are idempotent, so the conversion proceeds in all builds.
+func checkDuplicateKeys(ctx context.Context, spans inverted.Spans, prefixLen int) {
+	dup, numDups := findDuplicateKeys(spans)
+	if numDups == 0 || !duplicateKeyLogLimiter.ShouldLog() {
+		return
+	}
+	var err error
+	if k, ok := decodeGeoKey(dup, prefixLen); ok {
+		err = errors.AssertionFailedf(
+			"geoindex.RPKeyExpr has %d duplicate keys, including cell %d", numDups, k)
+	} else {
+		err = errors.AssertionFailedf(
+			"geoindex.RPKeyExpr has %d duplicate keys, including key %x", numDups, dup)
+	}
+	if buildutil.CrdbTestBuild {
+		log.Errorf(ctx, "%v", err)
+	} else {
+		log.Warningf(ctx, "%v", err)
+	}
+}
+
+// findDuplicateKeys returns the number of spans among the given sorted spans
+// of keys that have the same start key as the previous span, and the start
+// key of the first of them.
+func findDuplicateKeys(spans inverted.Spans) (dup inverted.EncVal, numDups int) {
+	for i := 1; i < len(spans); i++ {
+		if bytes.Equal(spans[i-1].Start, spans[i].Start) {
+			if numDups == 0 {
+				dup = spans[i].Start
+			}
+			numDups++
+		}
+	}
+	return dup, numDups
+}
+
+// pruneSortedSpans removes the spans that are contained in other spans from
+// the given sorted spans, in place.
+func pruneSortedSpans(spans inverted.Spans) inverted.Spans {
+	if len(spans) < 2 {
+		return spans
+	}
+	out := spans[:1]
+	// maxEnd is the span in out with the largest end key. Since the spans are
+	// sorted, a span is contained in one of the spans in out iff its end key
+	// is not larger than that of maxEnd.
+	maxEnd := spans[0]
+	for _, span := range spans[1:] {
+		if span.CompareEnds(maxEnd) <= 0 {
+			continue
+		}
+		// The span is not contained in a previous span, but it contains the
+		// previous spans with the same start key, which are sorted last.
+		for len(out) > 0 && bytes.Equal(out[len(out)-1].Start, span.Start) {
+			out = out[:len(out)-1]
+		}
+		out = append(out, span)
+		maxEnd = span
+	}
+	return out
+}
+
+func (c *GeoSpanExprConverter) makeSpanExpression(
 	op inverted.SetOperator, n0 *inverted.SpanExpression, n1 *inverted.SpanExpression,
 ) *inverted.SpanExpression {
-	sort.Sort(n0.FactoredUnionSpans)
-	sort.Sort(n1.FactoredUnionSpans)
-	return &inverted.SpanExpression{
-		Operator: op,
-		Left:     n0,
-		Right:    n1,
+	n0.FactoredUnionSpans = sortAndPruneNodeSpans(n0)
+	n1.FactoredUnionSpans = sortAndPruneNodeSpans(n1)
+	expr := c.newNode()
+	expr.Operator = op
+	expr.Left = n0
+	expr.Right = n1
+	if op == inverted.SetIntersection {
+		factorCommonSpans(expr)
+	}
+	return expr
+}
+
+// factorCommonSpans hoists the spans present in the FactoredUnionSpans of both
+// children of an intersection into the FactoredUnionSpans of the
+// intersection, since (A \union B) \intersection (A \union C) is equivalent to
+// A \union (B \intersection C). If this leaves a child with no spans and no
+// children, the child represents the empty set, and so does the intersection
+// of the children, so both children are discarded.
+//
+// REQUIRES: the FactoredUnionSpans of both children are sorted.
+func factorCommonSpans(expr *inverted.SpanExpression) {
+	left := expr.Left.(*inverted.SpanExpression)
+	right := expr.Right.(*inverted.SpanExpression)
+	common := appendCommonSpans(
+		expr.FactoredUnionSpans[:0], left.FactoredUnionSpans, right.FactoredUnionSpans,
+	)
+	if len(common) == 0 {
+		return
+	}
+	expr.FactoredUnionSpans = common
+	left.FactoredUnionSpans = removeSpans(left.FactoredUnionSpans, common)
+	right.FactoredUnionSpans = removeSpans(right.FactoredUnionSpans, common)
+	if left.IsEmpty() || right.IsEmpty() {
+		expr.Operator = inverted.None
+		expr.Left = nil
+		expr.Right = nil
+	}
+}
+
+// appendCommonSpans appends the spans present in both l and r to dst, and
+// returns the extended dst.
+//
+// REQUIRES: l and r are sorted.
+func appendCommonSpans(dst, l, r inverted.Spans) inverted.Spans {
+	for i, j := 0, 0; i < len(l) && j < len(r); {
+		switch cmpSpans(l[i], r[j]) {
+		case 0:
+			dst = append(dst, l[i])
+			i++
+			j++
+		case -1:
+			i++
+		default:
+			j++
+		}
+	}
+	return dst
+}
+
+// removeSpans removes the spans in toRemove from spans, in place.
+//
+// REQUIRES: spans and toRemove are sorted, and toRemove is a subset of spans.
+func removeSpans(spans, toRemove inverted.Spans) inverted.Spans {
+	out := spans[:0]
+	j := 0
+	for i := range spans {
+		if j < len(toRemove) && cmpSpans(spans[i], toRemove[j]) == 0 {
+			j++
+			continue
+		}
+		out = append(out, spans[i])
+	}
+	return out
+}
+
+// cmpSpans orders spans by their start key, and then by their end key.
+func cmpSpans(a, b inverted.Span) int {
+	if c := bytes.Compare(a.Start, b.Start); c != 0 {
+		return c
+	}
+	return a.CompareEnds(b)
+}
+
+// orderSpans orders the FactoredUnionSpans of every node of spanExpr, whose
+// FactoredUnionSpans are sorted by key, by the given ordering, whose width of a
+// span is geoSpanWidth, and records the ordering on spanExpr, see
+// ConvertOptions.SpanOrdering. The keys of the spans are preceded by a prefix
+// of the given length. FactoredUnionSpans that are the same slice as the
+// SpansToRead are copied before they are reordered, since the SpansToRead must
+// remain sorted.
+func orderSpans(spanExpr *inverted.SpanExpression, ordering inverted.SpanOrdering, prefixLen int) {
+	spanExpr.Ordering = ordering
+	if ordering == inverted.OrderByKey {
+		return
+	}
+	width := func(span inverted.Span) uint64 {
+		return geoSpanWidth(span, prefixLen)
+	}
+	cmpWidths := func(a, b inverted.Span) int {
+		return ordering.CompareSpans(a, b, width)
+	}
+	var orderNode func(e *inverted.SpanExpression)
+	orderNode = func(e *inverted.SpanExpression) {
+		spans := e.FactoredUnionSpans
+		if !slices.IsSortedFunc(spans, cmpWidths) {
+			if len(e.SpansToRead) > 0 && &spans[0] == &e.SpansToRead[0] {
+				spans = slices.Clone(spans)
+			}
+			slices.SortFunc(spans, cmpWidths)
+			e.FactoredUnionSpans = spans
+			e.UnsortedFactoredUnionSpans = true
+		}
+		if e.Operator != inverted.None {
+			orderNode(e.Left.(*inverted.SpanExpression))
+			orderNode(e.Right.(*inverted.SpanExpression))
+		}
+	}
+	orderNode(spanExpr)
+	if buildutil.CrdbTestBuild {
+		if err := spanExpr.CheckOrdering(width); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// decodeGeoKey decodes the geoindex.Key of the given key encoded by
+// GeoKeyEncoder, which is preceded by a prefix of the given length. It returns
+// false if the key cannot be decoded, e.g. if it is the PrefixEnd of an
+// encoded key.
+func decodeGeoKey(key inverted.EncVal, prefixLen int) (uint64, bool) {
+	// Skip the prefix and the marker of the encoding.
+	if len(key) < prefixLen+1 {
+		return 0, false
+	}
+	_, k, err := encoding.DecodeUvarintAscending(key[prefixLen+1:])
+	return k, err == nil
+}
+
+// geoSpanWidth returns the number of s2 cell IDs covered by the given span of
+// encoded geo keys, whose keys are preceded by a prefix of the given length. A
+// span of the single key of a cell covers the cell IDs of the cell and its
+// descendants, since the shapes indexed under the descendants are also
+// contained in the cell. The width of a span whose keys cannot be decoded is 1.
+func geoSpanWidth(span inverted.Span, prefixLen int) uint64 {
+	start, ok := decodeGeoKey(span.Start, prefixLen)
+	if !ok {
+		return 1
+	}
+	end := start + 1
+	if !span.IsPoint() {
+		if end, ok = decodeGeoKey(span.End, prefixLen); !ok {
+			// The end key of a span that includes math.MaxUint64 is the PrefixEnd
+			// of its encoding, which cannot be decoded.
+			return max(math.MaxUint64-start, 1)
+		}
+	}
+	if end-start != 1 {
+		return max(end-start, 1)
+	}
+	if c := s2.CellID(start); c.IsValid() {
+		return uint64(c.RangeMax()-c.RangeMin()) + 1
+	}
+	return 1
+}
+
+// GeoDWithinToSpanExpr converts the coverings computed for a distance query
+// (such as ST_DWithin) to a SpanExpression. The interior covering contains
+// the keys of shapes that certainly satisfy the query, while the exterior
+// covering contains the keys of all shapes that may satisfy it. The returned
+// expression is the union of the interior spans, which are tight since
+// matching rows do not need to be re-evaluated, and the exterior spans minus
+// the interior spans, which are not tight. Following the usual propagation of
+// tightness through a union, the root is only tight if there are no candidate
+// spans outside of the interior.
+func GeoDWithinToSpanExpr(interior, exterior geoindex.UnionKeySpans) *inverted.SpanExpression {
+	interior = normalizeGeoKeySpans(interior)
+	candidates := subtractGeoKeySpans(normalizeGeoKeySpans(exterior), interior)
+	makeNode := func(ukSpans geoindex.UnionKeySpans, tight bool) *inverted.SpanExpression {
+		if len(ukSpans) == 0 {
+			return nil
+		}
+		expr := GeoUnionKeySpansToSpanExpr(ukSpans).(*inverted.SpanExpression)
+		expr.Tight = tight
+		return expr
+	}
+	certain := makeNode(interior, true /* tight */)
+	uncertain := makeNode(candidates, false /* tight */)
+	switch {
+	case certain == nil && uncertain == nil:
+		// Nothing can satisfy the query.
+		return inverted.EmptySpanExpression()
+	case uncertain == nil:
+		return certain
+	case certain == nil:
+		return uncertain
+	}
+	spansToRead := make(inverted.Spans, 0, len(certain.SpansToRead)+len(uncertain.SpansToRead))
+	spansToRead = append(spansToRead, certain.SpansToRead...)
+	spansToRead = append(spansToRead, uncertain.SpansToRead...)
+	sortSpans(spansToRead)
+	// Only the root of a SpanExpression has SpansToRead.
+	certain.SpansToRead = nil
+	uncertain.SpansToRead = nil
+	certain.InvalidateCaches()
+	uncertain.InvalidateCaches()
+	expr := &inverted.SpanExpression{
+		Tight:       certain.Tight && uncertain.Tight,
+		SpansToRead: spansToRead,
+		Operator:    inverted.SetUnion,
+		Left:        certain,
+		Right:       uncertain,
+	}
+	setBoundingSpans(expr)
+	if buildutil.CrdbTestBuild {
+		if err := expr.CheckInvariants(); err != nil {
+			panic(errors.Wrapf(err, "converting interior %s and exterior %s", interior, exterior))
+		}
+	}
+	return expr
+}
+
+// normalizeGeoKeySpans returns the given spans sorted, with overlapping and
+// contiguous spans merged.
+func normalizeGeoKeySpans(ukSpans geoindex.UnionKeySpans) geoindex.UnionKeySpans {
+	if len(ukSpans) == 0 {
+		return nil
+	}
+	sorted := append(geoindex.UnionKeySpans(nil), ukSpans...)
+	slices.SortFunc(sorted, func(a, b geoindex.KeySpan) int { return cmp.Compare(a.Start, b.Start) })
+	out := sorted[:1]
+	for _, span := range sorted[1:] {
+		last := &out[len(out)-1]
+		if span.Start <= last.End || geoKeysAreContiguous(last.End, span.Start) {
+			if span.End > last.End {
+				last.End = span.End
+			}
+			continue
+		}
+		out = append(out, span)
+	}
+	return out
+}
+
+// subtractGeoKeySpans returns the keys in a that are not in b. Both a and b
+// must be normalized, see normalizeGeoKeySpans.
+func subtractGeoKeySpans(a, b geoindex.UnionKeySpans) geoindex.UnionKeySpans {
+	var out geoindex.UnionKeySpans
+	j := 0
+	for _, span := range a {
+		for j < len(b) && b[j].End < span.Start {
+			j++
+		}
+		cur, done := span.Start, false
+		for k := j; k < len(b) && b[k].Start <= span.End; k++ {
+			if b[k].Start > cur {
+				out = append(out, geoindex.KeySpan{Start: cur, End: b[k].Start - 1})
+			}
+			if b[k].End >= span.End {
+				done = true
+				break
+			}
+			cur = b[k].End + 1
+		}
+		if !done {
+			out = append(out, geoindex.KeySpan{Start: cur, End: span.End})
+		}
 	}
+	return out
 }
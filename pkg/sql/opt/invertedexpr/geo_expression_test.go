@@ -11,11 +11,30 @@
 package invertedexpr
 
 import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"math/rand"
+	"slices"
+	"sort"
 	"testing"
 
 	"github.com/cockroachdb/cockroach/pkg/geo/geoindex"
+	"github.com/cockroachdb/cockroach/pkg/geo/geopb"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
 	"github.com/cockroachdb/cockroach/pkg/sql/inverted"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/invertedexpr/invertedexprtestutils"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgcode"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
+	"github.com/cockroachdb/cockroach/pkg/util"
+	"github.com/cockroachdb/cockroach/pkg/util/buildutil"
+	"github.com/cockroachdb/cockroach/pkg/util/encoding"
 	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/randutil"
+	"github.com/cockroachdb/errors"
+	"github.com/golang/geo/s2"
 	"github.com/stretchr/testify/require"
 )
 
@@ -29,13 +48,14 @@ func TestUnionKeySpansToSpanExpr(t *testing.T) {
 	cases := []testCase{
 		{
 			uks: []geoindex.KeySpan{{Start: 5, End: 5}, {Start: 10, End: 10}, {Start: 1, End: 3}},
-			expected: "spans_to_read:<start:\"B\\215\" end:\"B\\216\" > " +
+			// The spans are sorted.
+			expected: "spans_to_read:<start:\"B\\211\" end:\"B\\214\" > " +
+				"spans_to_read:<start:\"B\\215\" end:\"B\\216\" > " +
 				"spans_to_read:<start:\"B\\222\" end:\"B\\223\" > " +
-				"spans_to_read:<start:\"B\\211\" end:\"B\\214\" > " +
 				"node:<" +
+				"factored_union_spans:<start:\"B\\211\" end:\"B\\214\" > " +
 				"factored_union_spans:<start:\"B\\215\" end:\"B\\216\" > " +
-				"factored_union_spans:<start:\"B\\222\" end:\"B\\223\" > " +
-				"factored_union_spans:<start:\"B\\211\" end:\"B\\214\" > > ",
+				"factored_union_spans:<start:\"B\\222\" end:\"B\\223\" > > ",
 		},
 	}
 	for _, c := range cases {
@@ -43,13 +63,88 @@ func TestUnionKeySpansToSpanExpr(t *testing.T) {
 		require.Equal(t, c.expected, spanExpr.ToProto().String())
 	}
 
-	// Test with nil union key spans.
+	// Nil union key spans, such as those of an empty shape, match no rows.
 	expr := GeoUnionKeySpansToSpanExpr(nil)
-	require.Equal(t, inverted.NonInvertedColExpression{}, expr)
+	require.True(t, expr.(*inverted.SpanExpression).IsEmpty())
+}
+
+// intersectsKeySpans mirrors the UnionKeySpans constructed by geoindex for an
+// intersects query: the range of each cell in the covering, and each of
+// their ancestors.
+func intersectsKeySpans(covering s2.CellUnion) geoindex.UnionKeySpans {
+	var ukSpans geoindex.UnionKeySpans
+	seen := make(map[s2.CellID]struct{})
+	for _, c := range covering {
+		ukSpans = append(ukSpans, geoindex.KeySpan{
+			Start: geoindex.Key(c.RangeMin()), End: geoindex.Key(c.RangeMax()),
+		})
+		for l := c.Level() - 1; l >= 0; l-- {
+			p := c.Parent(l)
+			if _, ok := seen[p]; ok {
+				break
+			}
+			seen[p] = struct{}{}
+			ukSpans = append(ukSpans, geoindex.KeySpan{Start: geoindex.Key(p), End: geoindex.Key(p)})
+		}
+	}
+	sort.Slice(ukSpans, func(i, j int) bool { return ukSpans[i].Start < ukSpans[j].Start })
+	return ukSpans
+}
+
+func TestUnionKeySpansToSpanExprCoalesce(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	t.Run("contiguous", func(t *testing.T) {
+		uks := geoindex.UnionKeySpans{
+			{Start: 1, End: 3}, {Start: 4, End: 4}, {Start: 5, End: 7}, {Start: 10, End: 10},
+		}
+		spanExpr := GeoUnionKeySpansToSpanExpr(uks).(*inverted.SpanExpression)
+		require.Equal(t,
+			"spans_to_read:<start:\"B\\211\" end:\"B\\220\" > "+
+				"spans_to_read:<start:\"B\\222\" end:\"B\\223\" > "+
+				"node:<"+
+				"factored_union_spans:<start:\"B\\211\" end:\"B\\220\" > "+
+				"factored_union_spans:<start:\"B\\222\" end:\"B\\223\" > > ",
+			spanExpr.ToProto().String())
+	})
+
+	t.Run("long thin rectangle", func(t *testing.T) {
+		rc := &s2.RegionCoverer{MinLevel: 0, MaxLevel: 30, LevelMod: 1, MaxCells: 256}
+		rect := s2.RectFromLatLng(s2.LatLngFromDegrees(10, 10)).AddPoint(s2.LatLngFromDegrees(10.1, 30))
+		uks := intersectsKeySpans(rc.Covering(rect))
+		spanExpr := GeoUnionKeySpansToSpanExpr(uks).(*inverted.SpanExpression)
+		// The ancestors of neighboring cells in the covering are typically
+		// contiguous with the ranges of those cells, so at least a quarter of
+		// the spans are coalesced away.
+		require.Less(t, 4*len(spanExpr.SpansToRead), 3*len(uks))
+		require.Equal(t, spanExpr.SpansToRead, spanExpr.FactoredUnionSpans)
+		require.True(t, sort.IsSorted(spanExpr.SpansToRead))
+		for i := 1; i < len(spanExpr.SpansToRead); i++ {
+			// Coalesced spans are never contiguous.
+			prev, cur := spanExpr.SpansToRead[i-1], spanExpr.SpansToRead[i]
+			require.Equal(t, -1, prev.CompareEnd(cur.Start))
+		}
+		// The output must be equivalent to the union of the input spans,
+		// including at the boundaries of each span.
+		uncoalesced := &inverted.SpanExpression{}
+		for _, uk := range uks {
+			span, _ := geoToSpan(GeoKeyEncoder{}, uk, nil)
+			uncoalesced.FactoredUnionSpans = append(uncoalesced.FactoredUnionSpans, span)
+		}
+		for _, uk := range uks {
+			for _, k := range []geoindex.Key{uk.Start - 1, uk.Start, uk.End, uk.End + 1} {
+				enc, _ := geoKeyToEncInvertedVal(
+					GeoKeyEncoder{}, k, false /* end */, nil)
+				keys := []inverted.EncVal{enc}
+				require.Equal(t, Evaluate(uncoalesced, keys), Evaluate(spanExpr, keys), "key %d", k)
+			}
+		}
+	})
 }
 
 func TestRPKeyExprToSpanExpr(t *testing.T) {
 	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
 
 	type testCase struct {
 		rpx      geoindex.RPKeyExpr
@@ -85,7 +180,7 @@ func TestRPKeyExprToSpanExpr(t *testing.T) {
 		{
 			// Malformed.
 			rpx: []geoindex.RPExprElement{geoindex.Key(5), geoindex.RPSetUnion},
-			err: "malformed expression: F0/L30/000000000000000000000000000002 \\U",
+			err: "malformed expression: operator \\U at index 1 with stack depth 1",
 		},
 		{
 			// Expression as represented in the proto: 7 ∩ (5 U 10 U 3 U 4 U (2 ∩ 1))
@@ -120,7 +215,7 @@ func TestRPKeyExprToSpanExpr(t *testing.T) {
 		},
 	}
 	for _, c := range cases {
-		rpx, err := GeoRPKeyExprToSpanExpr(c.rpx)
+		rpx, err := GeoRPKeyExprToSpanExpr(ctx, c.rpx)
 		if len(c.err) == 0 {
 			require.NoError(t, err)
 			require.Equal(t, c.expected, rpx.(*inverted.SpanExpression).ToProto().String())
@@ -129,8 +224,2950 @@ func TestRPKeyExprToSpanExpr(t *testing.T) {
 		}
 	}
 
-	// Test with nil RPKeyExpr.
-	expr, err := GeoRPKeyExprToSpanExpr(nil)
+	// A nil RPKeyExpr, such as that of an empty shape, matches no rows.
+	expr, err := GeoRPKeyExprToSpanExpr(ctx, nil)
+	require.NoError(t, err)
+	require.True(t, expr.(*inverted.SpanExpression).IsEmpty())
+}
+
+func TestRPKeyExprToSpanExprMalformed(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	type testCase struct {
+		name string
+		rpx  geoindex.RPKeyExpr
+		mark error
+		err  string
+	}
+	cases := []testCase{
+		{
+			name: "underflow",
+			rpx: []geoindex.RPExprElement{
+				geoindex.Key(5), geoindex.Key(10), geoindex.RPSetUnion, geoindex.RPSetIntersection,
+			},
+			mark: ErrRPKeyExprOperandUnderflow,
+			err:  "malformed expression: operator \\I at index 3 with stack depth 1",
+		},
+		{
+			name: "leftover",
+			rpx: []geoindex.RPExprElement{
+				geoindex.Key(5), geoindex.Key(10), geoindex.Key(1), geoindex.RPSetUnion,
+			},
+			mark: ErrRPKeyExprLeftoverOperands,
+			err:  "malformed expression: stack depth 2 at end of expression of length 4",
+		},
+		{
+			name: "operator only",
+			rpx:  []geoindex.RPExprElement{geoindex.RPSetUnion},
+			mark: ErrRPKeyExprOperandUnderflow,
+			err:  "malformed expression: operator \\U at index 0 with stack depth 0",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := GeoRPKeyExprToSpanExpr(ctx, c.rpx)
+			require.Error(t, err)
+			require.Equal(t, c.err, err.Error())
+			require.True(t, errors.Is(err, c.mark))
+			for _, other := range []error{ErrRPKeyExprOperandUnderflow, ErrRPKeyExprLeftoverOperands} {
+				if other != c.mark {
+					require.False(t, errors.Is(err, other))
+				}
+			}
+		})
+	}
+}
+
+func TestRPKeyExprToSpanExprErrorDetail(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	bbox := &geopb.BoundingBox{LoX: -74.5, HiX: -73, LoY: 40.25, HiY: 41}
+	testCases := []struct {
+		name     string
+		rpx      geoindex.RPKeyExpr
+		opts     ConvertOptions
+		mark     error
+		expected string
+	}{
+		{
+			name: "malformed",
+			rpx: geoindex.RPKeyExpr{
+				geoindex.Key(10), geoindex.Key(5), geoindex.RPSetUnion, geoindex.RPSetIntersection,
+			},
+			mark:     ErrRPKeyExprOperandUnderflow,
+			expected: "geoindex.RPKeyExpr: 2 keys, 2 operators, cell IDs 5 to 10",
+		},
+		{
+			name: "malformed with shape",
+			rpx: geoindex.RPKeyExpr{
+				geoindex.Key(10), geoindex.Key(5), geoindex.Key(7), geoindex.RPSetUnion,
+			},
+			opts: ConvertOptions{BoundingBox: bbox, SRID: 4326},
+			mark: ErrRPKeyExprLeftoverOperands,
+			expected: "geoindex.RPKeyExpr: 3 keys, 1 operators, cell IDs 5 to 10, " +
+				"bounding box (-74.5 40.25, -73 41), SRID 4326",
+		},
+		{
+			name:     "operator only",
+			rpx:      geoindex.RPKeyExpr{geoindex.RPSetUnion},
+			opts:     ConvertOptions{SRID: 4326},
+			mark:     ErrRPKeyExprOperandUnderflow,
+			expected: "geoindex.RPKeyExpr: 0 keys, 1 operators, SRID 4326",
+		},
+		{
+			name: "too many spans",
+			rpx: geoindex.RPKeyExpr{
+				geoindex.Key(1), geoindex.Key(5), geoindex.RPSetIntersection,
+			},
+			opts: ConvertOptions{MaxSpans: 1, BoundingBox: bbox, SRID: 4326},
+			mark: ErrTooManySpans,
+			expected: "geoindex.RPKeyExpr: 2 keys, 1 operators, cell IDs 1 to 5, " +
+				"bounding box (-74.5 40.25, -73 41), SRID 4326",
+		},
+		{
+			name: "exceeds memory budget",
+			rpx: geoindex.RPKeyExpr{
+				geoindex.Key(1), geoindex.Key(5), geoindex.RPSetIntersection,
+			},
+			opts:     ConvertOptions{MaxBytes: 1},
+			mark:     ErrExceedsMemoryBudget,
+			expected: "geoindex.RPKeyExpr: 2 keys, 1 operators, cell IDs 1 to 5",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := GeoRPKeyExprToSpanExprWithOptions(ctx, tc.rpx, nil /* prefixKey */, tc.opts)
+			require.True(t, errors.Is(err, tc.mark), "%v", err)
+			require.Equal(t, []string{tc.expected}, errors.GetAllDetails(err))
+			// The detail is not part of the message.
+			require.NotContains(t, err.Error(), "geoindex.RPKeyExpr:")
+			require.Contains(t, fmt.Sprintf("%+v", err), tc.expected)
+
+			// A conversion that succeeds has no error to attach the detail to.
+			opts := tc.opts
+			opts.MaxSpans, opts.MaxBytes = 0, 0
+			if _, err := GeoRPKeyExprToSpanExprWithOptions(
+				ctx, geoindex.RPKeyExpr{geoindex.Key(1), geoindex.Key(5), geoindex.RPSetIntersection},
+				nil /* prefixKey */, opts,
+			); err != nil {
+				t.Fatalf("unexpected error: %+v", err)
+			}
+		})
+	}
+}
+
+// evalRPKeyExpr evaluates rpx over the set of keys, as a test oracle for the
+// converted SpanExpressions.
+func evalRPKeyExpr(rpx geoindex.RPKeyExpr, keys map[geoindex.Key]struct{}) bool {
+	var stack []bool
+	for _, elem := range rpx {
+		switch e := elem.(type) {
+		case geoindex.Key:
+			_, ok := keys[e]
+			stack = append(stack, ok)
+		case geoindex.RPSetOperator:
+			b0, b1 := stack[len(stack)-1], stack[len(stack)-2]
+			stack = stack[:len(stack)-2]
+			if e == geoindex.RPSetUnion {
+				stack = append(stack, b0 || b1)
+			} else {
+				stack = append(stack, b0 && b1)
+			}
+		}
+	}
+	return stack[0]
+}
+
+func TestRPKeyExprToSpanExprDuplicateKeys(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	prefix := []byte("prefix")
+	for _, tc := range []struct {
+		rpx geoindex.RPKeyExpr
+		// numSpans is the number of distinct keys.
+		numSpans int
+	}{
+		{rpx: geoindex.RPKeyExpr{geoindex.Key(5), geoindex.Key(5), geoindex.RPSetUnion}, numSpans: 1},
+		{
+			rpx: geoindex.RPKeyExpr{
+				geoindex.Key(5), geoindex.Key(10), geoindex.Key(5), geoindex.RPSetUnion,
+				geoindex.RPSetIntersection, geoindex.Key(10), geoindex.RPSetUnion,
+			},
+			numSpans: 2,
+		},
+	} {
+		rpx := tc.rpx
+		// The duplicates are logged to the context of the caller.
+		expr, err := GeoRPKeyExprToSpanExprWithPrefix(ctx, rpx, prefix)
+		require.NoError(t, err)
+		spanExpr := expr.(*inverted.SpanExpression)
+		require.NoError(t, spanExpr.CheckInvariants())
+		// The duplicate keys are read once.
+		require.Len(t, spanExpr.SpansToRead, tc.numSpans, "%s", rpx)
+		memUsage := spanExpr.MemUsage()
+		spanExpr.InvalidateCaches()
+		require.Equal(t, spanExpr.MemUsage(), memUsage, "%s", rpx)
+		for _, keys := range [][]geoindex.Key{nil, {5}, {10}, {5, 10}} {
+			keySet := make(map[geoindex.Key]struct{})
+			var encKeys []inverted.EncVal
+			for _, k := range keys {
+				keySet[k] = struct{}{}
+				enc, _ := geoKeyToEncInvertedVal(GeoKeyEncoder{Prefix: prefix}, k, false /* end */, nil)
+				encKeys = append(encKeys, enc)
+			}
+			require.Equal(t, evalRPKeyExpr(rpx, keySet), Evaluate(spanExpr, encKeys),
+				"%s with keys %v", rpx, keys)
+		}
+	}
+
+	// The duplicates are reported with the cell ID of the key.
+	var spans inverted.Spans
+	for _, k := range []geoindex.Key{3, 5, 5, 5, 7, 9, 9} {
+		span, _ := geoToPointSpan(GeoKeyEncoder{Prefix: prefix}, k, nil)
+		spans = append(spans, span)
+	}
+	dup, numDups := findDuplicateKeys(spans)
+	require.Equal(t, 3, numDups)
+	k, ok := decodeGeoKey(dup, len(prefix))
+	require.True(t, ok)
+	require.Equal(t, uint64(5), k)
+	_, numDups = findDuplicateKeys(spans[:3])
+	require.Equal(t, 1, numDups)
+	_, numDups = findDuplicateKeys(spans[3:6])
+	require.Zero(t, numDups)
+}
+
+// randRPKeyExpr returns a random well-formed RPKeyExpr with numKeys keys in
+// [0, maxKey). Keys may be repeated in different branches of the expression.
+func randRPKeyExpr(rng *rand.Rand, numKeys int, maxKey int) geoindex.RPKeyExpr {
+	if numKeys == 1 {
+		return geoindex.RPKeyExpr{geoindex.Key(rng.Intn(maxKey))}
+	}
+	n := 1 + rng.Intn(numKeys-1)
+	rpx := append(randRPKeyExpr(rng, n, maxKey), randRPKeyExpr(rng, numKeys-n, maxKey)...)
+	if rng.Intn(2) == 0 {
+		return append(rpx, geoindex.RPSetUnion)
+	}
+	return append(rpx, geoindex.RPSetIntersection)
+}
+
+func TestPruneSortedSpans(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	span := func(start, end string) inverted.Span {
+		return inverted.Span{Start: inverted.EncVal(start), End: inverted.EncVal(end)}
+	}
+	testCases := []struct {
+		spans, expected inverted.Spans
+	}{
+		{nil, nil},
+		{inverted.Spans{span("a", "b")}, inverted.Spans{span("a", "b")}},
+		{
+			inverted.Spans{span("a", "b"), span("a", "b"), span("c", "d")},
+			inverted.Spans{span("a", "b"), span("c", "d")},
+		},
+		// A span that contains the previous spans with the same start key.
+		{
+			inverted.Spans{span("a", "b"), span("a", "c"), span("a", "d")},
+			inverted.Spans{span("a", "d")},
+		},
+		// Fine-level spans contained in a coarse-level span.
+		{
+			inverted.Spans{span("a", "m"), span("b", "c"), span("d", "d\x00"), span("l", "m")},
+			inverted.Spans{span("a", "m")},
+		},
+		// Overlapping spans are not pruned.
+		{
+			inverted.Spans{span("a", "c"), span("b", "d"), span("c", "d")},
+			inverted.Spans{span("a", "c"), span("b", "d")},
+		},
+	}
+	for _, tc := range testCases {
+		require.Equal(t, tc.expected, pruneSortedSpans(tc.spans))
+	}
+
+	// The union of the spans is unchanged.
+	rng, _ := randutil.NewTestRand()
+	for i := 0; i < 100; i++ {
+		var spans inverted.Spans
+		for j := 0; j < rng.Intn(10); j++ {
+			start := 'a' + rng.Intn(10)
+			end := start + 1 + rng.Intn(4)
+			spans = append(spans, span(string(rune(start)), string(rune(end))))
+		}
+		expr := &inverted.SpanExpression{FactoredUnionSpans: append(inverted.Spans(nil), spans...)}
+		pruned := &inverted.SpanExpression{FactoredUnionSpans: sortAndPruneSpans(spans)}
+		for k := 'a'; k < 'p'; k++ {
+			keys := []inverted.EncVal{inverted.EncVal(string(k))}
+			require.Equal(t, Evaluate(expr, keys), Evaluate(pruned, keys), "%v", spans)
+		}
+		for j := 1; j < len(pruned.FactoredUnionSpans); j++ {
+			require.False(t, pruned.FactoredUnionSpans[j-1].ContainsSpan(pruned.FactoredUnionSpans[j]))
+			require.False(t, pruned.FactoredUnionSpans[j].ContainsSpan(pruned.FactoredUnionSpans[j-1]))
+		}
+	}
+}
+
+func BenchmarkSortAndPruneSpans(b *testing.B) {
+	// A multi-resolution covering, with the ranges of coarse-level cells and
+	// the leaf cells of points, some of which are in the coarse-level cells.
+	rng, _ := randutil.NewTestRand()
+	var spans inverted.Spans
+	for i := 0; i < 64; i++ {
+		cell := s2.CellIDFromLatLng(
+			s2.LatLngFromDegrees(rng.Float64()*20, rng.Float64()*20)).Parent(10)
+		span, _ := geoToSpan(GeoKeyEncoder{}, geoindex.KeySpan{
+			Start: geoindex.Key(cell.RangeMin()), End: geoindex.Key(cell.RangeMax()),
+		}, nil /* b */)
+		spans = append(spans, span)
+		for j := 0; j < 16; j++ {
+			offset := rng.Uint64() % uint64(cell.RangeMax()-cell.RangeMin())
+			leaf := geoindex.Key(cell.RangeMin() + s2.CellID(offset))
+			if j%4 == 0 {
+				leaf = geoindex.Key(s2.CellIDFromLatLng(s2.LatLngFromDegrees(-rng.Float64()*20, 0)))
+			}
+			span, _ := geoToSpan(
+				GeoKeyEncoder{}, geoindex.KeySpan{Start: leaf, End: leaf}, nil)
+			spans = append(spans, span)
+		}
+	}
+	scratch := make(inverted.Spans, len(spans))
+	var numPruned int
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		copy(scratch, spans)
+		numPruned = len(sortAndPruneSpans(scratch))
+	}
+	b.ReportMetric(float64(len(spans)), "spans-in")
+	b.ReportMetric(float64(numPruned), "spans-out")
+}
+
+func TestMergeUnionSpans(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	span := func(start, end string) inverted.Span {
+		return inverted.Span{Start: inverted.EncVal(start), End: inverted.EncVal(end)}
+	}
+	rng, _ := randutil.NewTestRand()
+	randSpans := func() inverted.Spans {
+		spans := make(inverted.Spans, 0, rng.Intn(8))
+		for j := cap(spans); j > 0; j-- {
+			start := 'a' + rng.Intn(10)
+			spans = append(spans, span(string(rune(start)), string(rune(start+1+rng.Intn(3)))))
+		}
+		if rng.Intn(2) == 0 {
+			slices.SortFunc(spans, cmpSpans)
+		}
+		return spans
+	}
+	isSorted := func(spans inverted.Spans) bool { return slices.IsSortedFunc(spans, cmpSpans) }
+	var numMerged int
+	for i := 0; i < 1000; i++ {
+		dst := &inverted.SpanExpression{FactoredUnionSpans: randSpans()}
+		dst.UnsortedFactoredUnionSpans = !isSorted(dst.FactoredUnionSpans)
+		// Union a few operands into dst, as a chain of unions of keys does.
+		expected := append(inverted.Spans{}, dst.FactoredUnionSpans...)
+		for j := rng.Intn(4) + 1; j > 0; j-- {
+			src := &inverted.SpanExpression{FactoredUnionSpans: randSpans()}
+			src.UnsortedFactoredUnionSpans = !isSorted(src.FactoredUnionSpans)
+			expected = append(expected, src.FactoredUnionSpans...)
+			mergeUnionSpans(dst, src)
+			require.Empty(t, src.FactoredUnionSpans)
+			require.False(t, src.UnsortedFactoredUnionSpans)
+			if !dst.UnsortedFactoredUnionSpans {
+				numMerged++
+				require.True(t, isSorted(dst.FactoredUnionSpans), "%v", dst.FactoredUnionSpans)
+			}
+		}
+		// The result is identical to that of appending the spans and sorting
+		// them.
+		require.Equal(t, sortAndPruneSpans(expected), sortAndPruneNodeSpans(dst))
+		require.False(t, dst.UnsortedFactoredUnionSpans)
+	}
+	require.Greater(t, numMerged, 0)
+
+	// Spans unioned in increasing order are merged without moving the spans
+	// of dst.
+	dst := &inverted.SpanExpression{FactoredUnionSpans: inverted.Spans{span("a", "b")}}
+	for _, k := range "cegik" {
+		src := &inverted.SpanExpression{FactoredUnionSpans: inverted.Spans{span(string(k), "z")}}
+		mergeUnionSpans(dst, src)
+		require.False(t, dst.UnsortedFactoredUnionSpans)
+	}
+	require.Len(t, dst.FactoredUnionSpans, 6)
+}
+
+// BenchmarkGeoRPKeyExprToSpanExprSkewedUnion measures the conversion of a
+// long chain of unions of the keys of a 50k-cell covering, intersected with
+// another key so that the operators are applied one at a time.
+func BenchmarkGeoRPKeyExprToSpanExprSkewedUnion(b *testing.B) {
+	ctx := context.Background()
+	const numCells = 50000
+	rng, _ := randutil.NewTestRand()
+	cells := make([]geoindex.Key, numCells)
+	start := s2.CellIDFromLatLng(s2.LatLngFromDegrees(40, -74)).Parent(20)
+	for i, c := 0, start; i < numCells; i, c = i+1, c.Next() {
+		cells[i] = geoindex.Key(c)
+	}
+	for _, shuffle := range []bool{false, true} {
+		b.Run(fmt.Sprintf("shuffled=%t", shuffle), func(b *testing.B) {
+			keys := append([]geoindex.Key(nil), cells...)
+			if shuffle {
+				rng.Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+			}
+			rpx := geoindex.RPKeyExpr{keys[0]}
+			for _, k := range keys[1:] {
+				rpx = append(rpx, k, geoindex.RPSetUnion)
+			}
+			rpx = append(rpx, geoindex.Key(start.Parent(10)), geoindex.RPSetIntersection)
+			var c GeoSpanExprConverter
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				c.Reset()
+				if _, err := c.RPKeyExprToSpanExpr(ctx, rpx); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestRPKeyExprToSpanExprFactoring(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	// (5 U 6) ∩ (5 U 7) is factored into 5 U (6 ∩ 7).
+	rpx := geoindex.RPKeyExpr{
+		geoindex.Key(5), geoindex.Key(6), geoindex.RPSetUnion,
+		geoindex.Key(5), geoindex.Key(7), geoindex.RPSetUnion,
+		geoindex.RPSetIntersection,
+	}
+	expr, err := GeoRPKeyExprToSpanExpr(ctx, rpx)
+	require.NoError(t, err)
+	require.Equal(t,
+		"factored_union_spans:<start:\"B\\215\" end:\"B\\216\" > "+
+			"operator:SetIntersection "+
+			"left:<factored_union_spans:<start:\"B\\217\" end:\"B\\220\" > > "+
+			"right:<factored_union_spans:<start:\"B\\216\" end:\"B\\217\" > > ",
+		expr.(*inverted.SpanExpression).ToProto().Node.String())
+	require.Equal(t, inverted.SpanExprStats{
+		NumNodes: 3, Depth: 2, NumFactoredSpans: 3, NumPointSpans: 3, MinNodeSpans: 1, MaxNodeSpans: 1,
+		NumIntersections: 1,
+	}, expr.(*inverted.SpanExpression).Stats())
+
+	// 5 ∩ (5 U 6) is factored into 5, since the intersection of the empty set
+	// with 6 is empty.
+	rpx = geoindex.RPKeyExpr{
+		geoindex.Key(5), geoindex.Key(5), geoindex.Key(6), geoindex.RPSetUnion,
+		geoindex.RPSetIntersection,
+	}
+	expr, err = GeoRPKeyExprToSpanExpr(ctx, rpx)
+	require.NoError(t, err)
+	require.Equal(t,
+		"factored_union_spans:<start:\"B\\215\" end:\"B\\216\" > ",
+		expr.(*inverted.SpanExpression).ToProto().Node.String())
+
+	// Randomized expressions over a small key space, so that factoring is
+	// common, evaluated over random key sets.
+	rng, _ := randutil.NewTestRand()
+	const maxKey = 8
+	for i := 0; i < 200; i++ {
+		rpx := randRPKeyExpr(rng, 1+rng.Intn(12), maxKey)
+		expr, err := GeoRPKeyExprToSpanExpr(ctx, rpx)
+		require.NoError(t, err)
+		spanExpr := expr.(*inverted.SpanExpression)
+		require.NoError(t, spanExpr.CheckInvariants(), "%s", rpx)
+		for j := 0; j < 20; j++ {
+			keys := make(map[geoindex.Key]struct{})
+			var encKeys []inverted.EncVal
+			for k := 0; k < maxKey; k++ {
+				if rng.Intn(3) == 0 {
+					keys[geoindex.Key(k)] = struct{}{}
+					enc, _ := geoKeyToEncInvertedVal(
+						GeoKeyEncoder{}, geoindex.Key(k), false /* end */, nil)
+					encKeys = append(encKeys, enc)
+				}
+			}
+			require.Equal(t, evalRPKeyExpr(rpx, keys), Evaluate(spanExpr, encKeys),
+				"%s with keys %v", rpx, keys)
+		}
+	}
+}
+
+func TestRPKeyExprToSpanExprWithFallback(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	expr, fallback := GeoRPKeyExprToSpanExprWithFallback(ctx, nil /* rpExpr */, 1 /* maxNodes */)
+	require.True(t, expr.IsEmpty())
+	require.False(t, fallback)
+
+	rng, _ := randutil.NewTestRand()
+	const maxKey = 8
+	numFallbacks := 0
+	for i := 0; i < 200; i++ {
+		rpx := randRPKeyExpr(rng, 1+rng.Intn(12), maxKey)
+		if rng.Intn(10) == 0 {
+			// Make the expression malformed.
+			rpx = append(rpx, geoindex.RPSetUnion)
+		}
+		maxNodes := 1 + rng.Intn(6)
+		expr, fallback := GeoRPKeyExprToSpanExprWithFallback(ctx, rpx, maxNodes)
+		require.NoError(t, expr.CheckInvariants())
+		precise, err := GeoRPKeyExprToSpanExpr(ctx, rpx)
+		if err == nil && precise.(*inverted.SpanExpression).Stats().NumNodes <= maxNodes {
+			require.False(t, fallback)
+			require.Empty(t, Diff(precise.(*inverted.SpanExpression), expr))
+			continue
+		}
+		require.True(t, fallback, "%s", rpx)
+		preciseSpanExpr, _ := precise.(*inverted.SpanExpression)
+		require.False(t, expr.Tight)
+		require.Equal(t, 1, expr.Stats().NumNodes)
+		numFallbacks++
+		if err != nil {
+			continue
+		}
+		// The fallback expression is a superset of the precise expression.
+		for j := 0; j < 20; j++ {
+			keys := make(map[geoindex.Key]struct{})
+			var encKeys []inverted.EncVal
+			for k := 0; k < maxKey; k++ {
+				if rng.Intn(3) == 0 {
+					keys[geoindex.Key(k)] = struct{}{}
+					enc, _ := geoKeyToEncInvertedVal(
+						GeoKeyEncoder{}, geoindex.Key(k), false /* end */, nil)
+					encKeys = append(encKeys, enc)
+				}
+			}
+			require.Equal(t, evalRPKeyExpr(rpx, keys), Evaluate(preciseSpanExpr, encKeys))
+			if evalRPKeyExpr(rpx, keys) {
+				require.True(t, Evaluate(expr, encKeys), "%s with keys %v", rpx, keys)
+			}
+		}
+	}
+	require.Greater(t, numFallbacks, 0)
+}
+
+func TestConvertOptionsFlattenBelowNodes(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	const maxKey = 8
+	encKey := func(k geoindex.Key) inverted.EncVal {
+		enc, _ := geoKeyToEncInvertedVal(GeoKeyEncoder{}, k, false /* end */, nil)
+		return enc
+	}
+	var c GeoSpanExprConverter
+	for _, rpx := range []geoindex.RPKeyExpr{
+		// An intersection of two unions of keys, which has 3 nodes.
+		{
+			geoindex.Key(1), geoindex.Key(2), geoindex.RPSetUnion,
+			geoindex.Key(3), geoindex.Key(4), geoindex.RPSetUnion,
+			geoindex.RPSetIntersection,
+		},
+		// A union of two intersections of keys, which has 7 nodes.
+		{
+			geoindex.Key(1), geoindex.Key(5), geoindex.RPSetIntersection,
+			geoindex.Key(3), geoindex.Key(7), geoindex.RPSetIntersection,
+			geoindex.RPSetUnion,
+		},
+	} {
+		precise, err := GeoRPKeyExprToSpanExpr(ctx, rpx)
+		require.NoError(t, err)
+		preciseSpanExpr := precise.(*inverted.SpanExpression)
+		numNodes := preciseSpanExpr.Stats().NumNodes
+		require.Greater(t, numNodes, 1)
+
+		// The expression is only flattened if it has fewer than
+		// FlattenBelowNodes nodes.
+		for _, flattenBelowNodes := range []int{0, numNodes - 1, numNodes, numNodes + 1} {
+			c.Reset()
+			expr, err := c.RPKeyExprToSpanExprWithOptions(ctx, rpx, nil /* prefixKey */, ConvertOptions{
+				FlattenBelowNodes: flattenBelowNodes,
+			})
+			require.NoError(t, err)
+			spanExpr := expr.(*inverted.SpanExpression)
+			require.NoError(t, spanExpr.CheckInvariants())
+			if flattenBelowNodes <= numNodes {
+				require.False(t, spanExpr.Flattened)
+				require.Empty(t, Diff(preciseSpanExpr, spanExpr))
+				require.NotContains(t, spanExpr.String(), "flattened")
+				continue
+			}
+			require.True(t, spanExpr.Flattened)
+			require.False(t, spanExpr.Tight)
+			require.Contains(t, spanExpr.String(), "flattened")
+			require.Equal(t, 1, spanExpr.Stats().NumNodes)
+			require.True(t, preciseSpanExpr.SpansToRead.Equals(spanExpr.SpansToRead))
+			require.True(t, preciseSpanExpr.SpansToRead.Equals(spanExpr.FactoredUnionSpans))
+			memUsage := spanExpr.MemUsage()
+			spanExpr.InvalidateCaches()
+			require.Equal(t, spanExpr.MemUsage(), memUsage)
+
+			// The flattened expression is satisfied by the rows with any of the
+			// keys, which include all the rows that satisfy rpx.
+			for k := geoindex.Key(0); k < maxKey; k++ {
+				keys := []inverted.EncVal{encKey(k)}
+				require.Equal(t, spanExpr.SpansToRead.ContainsKey(keys[0]), Evaluate(spanExpr, keys))
+				if Evaluate(preciseSpanExpr, keys) {
+					require.True(t, Evaluate(spanExpr, keys), "key %d", k)
+				}
+			}
+		}
+		// The default flattens the intersection of two unions, but not larger
+		// trees.
+		expr, err := GeoRPKeyExprToSpanExprWithOptions(ctx, rpx, nil /* prefixKey */, ConvertOptions{
+			FlattenBelowNodes: DefaultFlattenBelowNodes,
+		})
+		require.NoError(t, err)
+		require.Equal(t, numNodes == 3, expr.(*inverted.SpanExpression).Flattened)
+	}
+
+	// Expressions without children are not flattened.
+	rpx := geoindex.RPKeyExpr{geoindex.Key(1), geoindex.Key(2), geoindex.RPSetUnion}
+	expr, err := GeoRPKeyExprToSpanExprWithOptions(ctx, rpx, nil /* prefixKey */, ConvertOptions{
+		FlattenBelowNodes: 10,
+	})
 	require.NoError(t, err)
-	require.Equal(t, inverted.NonInvertedColExpression{}, expr)
+	require.False(t, expr.(*inverted.SpanExpression).Flattened)
+}
+
+func TestGeoSpanExprConverter(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	// A reused converter must produce the same expressions as a fresh one,
+	// and the protos of earlier expressions must remain valid after Reset.
+	rng, _ := randutil.NewTestRand()
+	var c GeoSpanExprConverter
+	for i := 0; i < 50; i++ {
+		c.Reset()
+		var protos []*inverted.SpanExpressionProto
+		var expected []string
+		for j := 0; j < 1+rng.Intn(4); j++ {
+			rpx := randRPKeyExpr(rng, 1+rng.Intn(12), 8 /* maxKey */)
+			expr, err := c.RPKeyExprToSpanExpr(ctx, rpx)
+			require.NoError(t, err)
+			freshExpr, err := GeoRPKeyExprToSpanExpr(ctx, rpx)
+			require.NoError(t, err)
+			requireEqualExprs(t, freshExpr, expr, "%s", rpx)
+			proto := expr.(*inverted.SpanExpression).ToProto()
+			freshProto := freshExpr.(*inverted.SpanExpression).ToProto()
+			require.Equal(t, freshProto.String(), proto.String(), "%s", rpx)
+			protos = append(protos, proto)
+			expected = append(expected, proto.String())
+		}
+		for j := range protos {
+			require.Equal(t, expected[j], protos[j].String())
+		}
+	}
+}
+
+func TestGeoSpanExprConverterDetach(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	// A detached expression must be unaffected by the reuse of the memory of
+	// the converter, and by modifications of the keys of the original
+	// expression.
+	rng, _ := randutil.NewTestRand()
+	var c GeoSpanExprConverter
+	for i := 0; i < 50; i++ {
+		c.Reset()
+		rpx := randRPKeyExpr(rng, 1+rng.Intn(12), 8 /* maxKey */)
+		expr, err := c.RPKeyExprToSpanExpr(ctx, rpx)
+		require.NoError(t, err)
+		spanExpr := expr.(*inverted.SpanExpression)
+		expected := spanExpr.String()
+		detached := spanExpr.Detach()
+		require.Equal(t, expected, detached.String())
+
+		var scribble func(e *inverted.SpanExpression)
+		scribble = func(e *inverted.SpanExpression) {
+			for _, spans := range []inverted.Spans{e.SpansToRead, e.FactoredUnionSpans} {
+				for _, span := range spans {
+					for j := range span.Start {
+						span.Start[j] = 0xff
+					}
+					for j := range span.End {
+						span.End[j] = 0xff
+					}
+				}
+			}
+			for _, child := range []inverted.Expression{e.Left, e.Right} {
+				if child != nil {
+					scribble(child.(*inverted.SpanExpression))
+				}
+			}
+		}
+		scribble(spanExpr)
+		c.Reset()
+		for j := 0; j < 4; j++ {
+			_, err := c.RPKeyExprToSpanExpr(ctx, randRPKeyExpr(rng, 1+rng.Intn(12), 8 /* maxKey */))
+			require.NoError(t, err)
+		}
+		require.Equal(t, expected, detached.String(), "%s", rpx)
+		freshExpr, err := GeoRPKeyExprToSpanExpr(ctx, rpx)
+		require.NoError(t, err)
+		require.Empty(t, Diff(freshExpr.(*inverted.SpanExpression), detached), "%s", rpx)
+		require.NoError(t, detached.CheckInvariants())
+	}
+}
+
+func BenchmarkGeoRPKeyExprToSpanExpr(b *testing.B) {
+	ctx := context.Background()
+	rng, _ := randutil.NewTestRand()
+	var rpxs []geoindex.RPKeyExpr
+	for i := 0; i < 64; i++ {
+		rpxs = append(rpxs, randRPKeyExpr(rng, 1+rng.Intn(64), 1<<20 /* maxKey */))
+	}
+	b.Run("unpooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := GeoRPKeyExprToSpanExpr(ctx, rpxs[i%len(rpxs)]); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		var c GeoSpanExprConverter
+		for i := 0; i < b.N; i++ {
+			c.Reset()
+			if _, err := c.RPKeyExprToSpanExpr(ctx, rpxs[i%len(rpxs)]); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestRPKeyExprToSpanExprAllocs(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	// The encoded keys share a single buffer, so once the memory of the
+	// converter has been warmed up the number of allocations does not depend
+	// on the number of keys. The keys have the longest varint encoding.
+	unionOfKeys := func(n int) geoindex.RPKeyExpr {
+		rpx := geoindex.RPKeyExpr{geoindex.Key(1 << 63)}
+		for i := 1; i < n; i++ {
+			rpx = append(rpx, geoindex.Key(1<<63)+geoindex.Key(i), geoindex.RPSetUnion)
+		}
+		return rpx
+	}
+	allocs := func(rpx geoindex.RPKeyExpr) float64 {
+		var c GeoSpanExprConverter
+		return testing.AllocsPerRun(10, func() {
+			c.Reset()
+			if _, err := c.RPKeyExprToSpanExpr(ctx, rpx); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+	require.Equal(t, allocs(unionOfKeys(1)), allocs(unionOfKeys(100)))
+
+	// Without a converter, the memory of the conversion is sized by a scan of
+	// the expression and allocated upfront, so the number of allocations does
+	// not depend on the number of keys either.
+	freshAllocs := func(rpx geoindex.RPKeyExpr) float64 {
+		return testing.AllocsPerRun(10, func() {
+			if _, err := GeoRPKeyExprToSpanExpr(ctx, rpx); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+	require.Equal(t, freshAllocs(unionOfKeys(2)), freshAllocs(unionOfKeys(100)))
+	require.Equal(t,
+		freshAllocs(intersectionOfUnions(2, 2)), freshAllocs(intersectionOfUnions(64, 8)))
+	require.Equal(t,
+		freshAllocs(intersectionOfUnions(2, 1)), freshAllocs(intersectionOfUnions(300, 1)))
+}
+
+// intersectionOfUnions returns an RPKeyExpr that is the intersection of
+// numUnions unions of unionSize consecutive keys, which have the longest
+// varint encoding, like the expression of a covering whose cells are unioned
+// with their ancestors. The intersections are nested, so the operand stack
+// grows with numUnions.
+func intersectionOfUnions(numUnions, unionSize int) geoindex.RPKeyExpr {
+	var rpx geoindex.RPKeyExpr
+	k := geoindex.Key(1 << 63)
+	for i := 0; i < numUnions; i++ {
+		for j := 0; j < unionSize; j++ {
+			rpx = append(rpx, k)
+			k++
+			if j > 0 {
+				rpx = append(rpx, geoindex.RPSetUnion)
+			}
+		}
+	}
+	for i := 1; i < numUnions; i++ {
+		rpx = append(rpx, geoindex.RPSetIntersection)
+	}
+	return rpx
+}
+
+func BenchmarkGeoRPKeyExprToSpanExprPresized(b *testing.B) {
+	ctx := context.Background()
+	for _, numUnions := range []int{8, 512} {
+		for _, unionSize := range []int{1, 8} {
+			rpx := intersectionOfUnions(numUnions, unionSize)
+			b.Run(fmt.Sprintf("unions=%d/size=%d", numUnions, unionSize), func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					if _, err := GeoRPKeyExprToSpanExpr(ctx, rpx); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestGeoSpanExprWithPrefix(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	keys := []geoindex.Key{0, 1, 5, 6, 7, 1 << 40, math.MaxUint64 - 1, math.MaxUint64}
+	prefixes := [][]byte{nil, {0x12}, {0x12, 0x89, 0x00}, {0xff, 0xff}}
+	for _, prefix := range prefixes {
+		uks := geoindex.UnionKeySpans{
+			{Start: 1, End: 1}, {Start: 5, End: 6}, {Start: math.MaxUint64 - 1, End: math.MaxUint64},
+		}
+		rpx := geoindex.RPKeyExpr{
+			geoindex.Key(1), geoindex.Key(math.MaxUint64), geoindex.RPSetUnion,
+			geoindex.Key(5), geoindex.Key(6), geoindex.RPSetUnion, geoindex.RPSetIntersection,
+		}
+		ukExpr := GeoUnionKeySpansToSpanExprWithPrefix(uks, prefix).(*inverted.SpanExpression)
+		rpExpr, err := GeoRPKeyExprToSpanExprWithPrefix(ctx, rpx, prefix)
+		require.NoError(t, err)
+		for _, expr := range []*inverted.SpanExpression{ukExpr, rpExpr.(*inverted.SpanExpression)} {
+			require.NoError(t, expr.CheckInvariants())
+			require.True(t, sort.IsSorted(expr.SpansToRead))
+			for _, span := range SpansAsRoachpbSpans(expr.SpansToRead) {
+				require.True(t, span.Valid(), "%x-%x", span.Key, span.EndKey)
+				require.True(t, bytes.HasPrefix(span.Key, prefix), "%x", span.Key)
+				// The end of the span must not extend beyond the keys with the
+				// prefix.
+				require.True(t, len(prefix) == 0 || bytes.HasPrefix(span.EndKey, prefix),
+					"%x", span.EndKey)
+			}
+		}
+
+		// The prefixed expressions must be satisfied by exactly the prefixed
+		// keys that satisfy the unprefixed expressions, and never by keys with
+		// another prefix.
+		ukExprNoPrefix := GeoUnionKeySpansToSpanExpr(uks).(*inverted.SpanExpression)
+		rpExprNoPrefix, err := GeoRPKeyExprToSpanExpr(ctx, rpx)
+		require.NoError(t, err)
+		otherPrefix := append(append([]byte(nil), prefix...), 0x00)
+		encode := func(prefix []byte, keys ...geoindex.Key) []inverted.EncVal {
+			var encs []inverted.EncVal
+			for _, k := range keys {
+				enc, _ := geoKeyToEncInvertedVal(GeoKeyEncoder{Prefix: prefix}, k, false /* end */, nil)
+				encs = append(encs, enc)
+			}
+			return encs
+		}
+		for _, k0 := range keys {
+			for _, k1 := range keys {
+				for _, c := range []struct {
+					noPrefix, withPrefix *inverted.SpanExpression
+				}{
+					{ukExprNoPrefix, ukExpr},
+					{rpExprNoPrefix.(*inverted.SpanExpression), rpExpr.(*inverted.SpanExpression)},
+				} {
+					require.Equal(t,
+						Evaluate(c.noPrefix, encode(nil, k0, k1)),
+						Evaluate(c.withPrefix, encode(prefix, k0, k1)), "keys %d, %d", k0, k1)
+					require.False(t, Evaluate(c.withPrefix, encode(otherPrefix, k0, k1)))
+				}
+			}
+		}
+	}
+}
+
+func TestGeoToPointSpan(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	// The end key of a point span is identical to the encoded end key.
+	var numPoints int
+	for _, prefix := range [][]byte{nil, {0x12}, {0xff, 0xff}} {
+		for _, k := range []geoindex.Key{
+			0, 1, 109, 110, 0xff, 0x1ff, 0x100ff, 1 << 40, math.MaxUint64 - 1, math.MaxUint64,
+		} {
+			for _, version := range []encoding.GeoInvertedKeyVersion{
+				encoding.GeoInvertedKeyV1, encoding.GeoInvertedKeyV2,
+			} {
+				enc := GeoKeyEncoder{Prefix: prefix, Version: version}
+				expected, _ := geoToSpan(enc, geoindex.KeySpan{Start: k, End: k}, nil)
+				span, _ := geoToPointSpan(enc, k, nil)
+				require.Equal(t, expected.Start, span.Start)
+				require.Equal(t, expected.End, span.EndKey(), "%x %d", prefix, k)
+				// As a roachpb.Span, the encoded span contains the point span.
+				require.True(t, SpanAsRoachpbSpan(expected).Contains(SpanAsRoachpbSpan(span)))
+				if span.IsPoint() {
+					numPoints++
+				}
+			}
+		}
+	}
+	require.NotZero(t, numPoints)
+}
+
+// coveredByRPKeyExpr mirrors the RPKeyExpr constructed by geoindex for a
+// covered-by query: the union of the keys of the cells of the covering and
+// their ancestors, arranged in a quad-tree, in which the subtrees of the
+// children of a cell are intersected.
+func coveredByRPKeyExpr(covering s2.CellUnion) geoindex.RPKeyExpr {
+	presentCells := make(map[s2.CellID]struct{})
+	for _, c := range covering {
+		for l := c.Level(); l >= 0; l-- {
+			presentCells[c.Parent(l)] = struct{}{}
+		}
+	}
+	var gen func(c s2.CellID, expr geoindex.RPKeyExpr) geoindex.RPKeyExpr
+	gen = func(c s2.CellID, expr geoindex.RPKeyExpr) geoindex.RPKeyExpr {
+		expr = append(expr, geoindex.Key(c))
+		if c.IsLeaf() {
+			return expr
+		}
+		numChildren := 0
+		for _, child := range c.Children() {
+			if _, ok := presentCells[child]; !ok {
+				continue
+			}
+			expr = gen(child, expr)
+			if numChildren++; numChildren > 1 {
+				expr = append(expr, geoindex.RPSetIntersection)
+			}
+		}
+		if numChildren > 0 {
+			expr = append(expr, geoindex.RPSetUnion)
+		}
+		return expr
+	}
+	var expr geoindex.RPKeyExpr
+	numFaces := 0
+	for face := 0; face < 6; face++ {
+		if _, ok := presentCells[s2.CellIDFromFace(face)]; !ok {
+			continue
+		}
+		expr = gen(s2.CellIDFromFace(face), expr)
+		if numFaces++; numFaces > 1 {
+			expr = append(expr, geoindex.RPSetIntersection)
+		}
+	}
+	return expr
+}
+
+func BenchmarkGeoRPKeyExprToSpanExprPolygon(b *testing.B) {
+	ctx := context.Background()
+	for _, maxCells := range []int{16, 256} {
+		b.Run(fmt.Sprintf("cells=%d", maxCells), func(b *testing.B) {
+			rpx := coveredByRPKeyExpr(testPolygonCovering(maxCells))
+			var memUsage, pointEndKeyBytes int64
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				expr, err := GeoRPKeyExprToSpanExpr(ctx, rpx)
+				if err != nil {
+					b.Fatal(err)
+				}
+				memUsage = expr.(*inverted.SpanExpression).MemUsage()
+				if i == 0 {
+					for _, span := range expr.(*inverted.SpanExpression).SpansToRead {
+						if span.IsPoint() {
+							pointEndKeyBytes += int64(len(span.EndKey()))
+						}
+					}
+				}
+			}
+			// The memory used by the expression, and the memory it would use if
+			// the end keys of the point spans were stored.
+			b.ReportMetric(float64(memUsage), "mem-bytes")
+			b.ReportMetric(float64(memUsage+pointEndKeyBytes), "mem-bytes-without-points")
+		})
+	}
+}
+
+func TestGeoDWithinToSpanExpr(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	encode := func(k geoindex.Key) inverted.EncVal {
+		enc, _ := geoKeyToEncInvertedVal(
+			GeoKeyEncoder{}, k, false /* end */, nil)
+		return enc
+	}
+	contains := func(ukSpans geoindex.UnionKeySpans, k geoindex.Key) bool {
+		for _, span := range ukSpans {
+			if span.Start <= k && k <= span.End {
+				return true
+			}
+		}
+		return false
+	}
+
+	t.Run("interior and candidates", func(t *testing.T) {
+		interior := geoindex.UnionKeySpans{{Start: 4, End: 6}, {Start: 10, End: 10}}
+		exterior := geoindex.UnionKeySpans{{Start: 2, End: 12}}
+		expr := GeoDWithinToSpanExpr(interior, exterior)
+		require.False(t, expr.Tight)
+		require.Equal(t, inverted.SetUnion, expr.Operator)
+		certain := expr.Left.(*inverted.SpanExpression)
+		uncertain := expr.Right.(*inverted.SpanExpression)
+		require.True(t, certain.Tight)
+		require.False(t, uncertain.Tight)
+		// The interior spans are a subset of the spans to read.
+		for _, span := range certain.FactoredUnionSpans {
+			i := expr.SpansToRead.Find(span.Start)
+			require.True(t, i >= 0 && expr.SpansToRead[i].ContainsSpan(span))
+		}
+		for k := geoindex.Key(0); k < 15; k++ {
+			keys := []inverted.EncVal{encode(k)}
+			require.Equal(t, contains(interior, k), Evaluate(certain, keys), "key %d", k)
+			require.Equal(t, contains(exterior, k) && !contains(interior, k),
+				Evaluate(uncertain, keys), "key %d", k)
+		}
+	})
+
+	t.Run("interior only", func(t *testing.T) {
+		interior := geoindex.UnionKeySpans{{Start: 4, End: 6}}
+		expr := GeoDWithinToSpanExpr(interior, interior)
+		require.True(t, expr.Tight)
+		require.Equal(t, inverted.None, expr.Operator)
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		expr := GeoDWithinToSpanExpr(nil, nil)
+		require.True(t, expr.Tight)
+		require.Empty(t, expr.SpansToRead)
+	})
+
+	t.Run("random", func(t *testing.T) {
+		rng, _ := randutil.NewTestRand()
+		const maxKey = 32
+		randSpans := func() geoindex.UnionKeySpans {
+			var ukSpans geoindex.UnionKeySpans
+			for i := rng.Intn(5); i > 0; i-- {
+				start := geoindex.Key(rng.Intn(maxKey))
+				ukSpans = append(ukSpans, geoindex.KeySpan{
+					Start: start, End: start + geoindex.Key(rng.Intn(4)),
+				})
+			}
+			return ukSpans
+		}
+		for i := 0; i < 200; i++ {
+			interior, exterior := randSpans(), randSpans()
+			expr := GeoDWithinToSpanExpr(interior, exterior)
+			require.NoError(t, expr.CheckInvariants())
+			tight := true
+			for k := geoindex.Key(0); k < maxKey+4; k++ {
+				keys := []inverted.EncVal{encode(k)}
+				require.Equal(t, contains(interior, k) || contains(exterior, k),
+					Evaluate(expr, keys), "key %d, interior %s, exterior %s", k, interior, exterior)
+				require.Equal(t, contains(interior, k) || contains(exterior, k),
+					expr.SpansToRead.ContainsKey(keys[0]))
+				if contains(exterior, k) && !contains(interior, k) {
+					tight = false
+				}
+			}
+			require.Equal(t, tight, expr.Tight, "interior %s, exterior %s", interior, exterior)
+			if expr.Operator == inverted.SetUnion {
+				// The interior is tight, and the candidates are not.
+				require.True(t, expr.Left.(*inverted.SpanExpression).Tight)
+				require.False(t, expr.Right.(*inverted.SpanExpression).Tight)
+			}
+		}
+	})
+}
+
+func BenchmarkSortSpans(b *testing.B) {
+	rng, _ := randutil.NewTestRand()
+	const numSpans = 256
+	var ukSpans geoindex.UnionKeySpans
+	for i := 0; i < numSpans; i++ {
+		start := geoindex.Key(rng.Intn(1 << 30))
+		end := start + geoindex.Key(rng.Intn(8))
+		ukSpans = append(ukSpans, geoindex.KeySpan{Start: start, End: end})
+	}
+	unsorted := make(inverted.Spans, numSpans)
+	for i := range ukSpans {
+		unsorted[i], _ = geoToSpan(GeoKeyEncoder{}, ukSpans[i], nil /* b */)
+	}
+	sorted := append(inverted.Spans(nil), unsorted...)
+	sortSpans(sorted)
+	spans := make(inverted.Spans, numSpans)
+	for _, input := range []struct {
+		name  string
+		spans inverted.Spans
+	}{{"unsorted", unsorted}, {"sorted", sorted}} {
+		b.Run(input.name, func(b *testing.B) {
+			b.Run("sort.Sort", func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					copy(spans, input.spans)
+					sort.Sort(spans)
+				}
+			})
+			b.Run("sortSpans", func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					copy(spans, input.spans)
+					sortSpans(spans)
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkGeoUnionKeySpansToSpanExpr(b *testing.B) {
+	ctx := context.Background()
+	rng, _ := randutil.NewTestRand()
+	for _, numSpans := range []int{16, 256, 4096} {
+		var ukSpans geoindex.UnionKeySpans
+		start := geoindex.Key(0)
+		for i := 0; i < numSpans; i++ {
+			// The spans produced by geoindex are sorted and non-overlapping.
+			start += geoindex.Key(2 + rng.Intn(1<<10))
+			ukSpans = append(ukSpans, geoindex.KeySpan{Start: start, End: start})
+		}
+		for _, inputSorted := range []bool{false, true} {
+			b.Run(fmt.Sprintf("spans=%d/input-sorted=%t", numSpans, inputSorted), func(b *testing.B) {
+				b.ReportAllocs()
+				opts := ConvertOptions{InputSorted: inputSorted}
+				for i := 0; i < b.N; i++ {
+					if _, err := GeoUnionKeySpansToSpanExprWithOptions(
+						ctx, ukSpans, nil /* prefixKey */, opts,
+					); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestGeoMultiUnionKeySpansToSpanExpr(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	rng, _ := randutil.NewTestRand()
+	for i := 0; i < 200; i++ {
+		// The sets start near the same key, so their spans overlap.
+		spanSets := make([]geoindex.UnionKeySpans, rng.Intn(6))
+		var concat geoindex.UnionKeySpans
+		var maxKey geoindex.Key
+		for j := range spanSets {
+			set := invertedexprtestutils.RandomUnionKeySpans(rng, rng.Intn(8))
+			if len(set) > 1 && rng.Intn(4) == 0 {
+				// Unsorted sets are sorted on a copy.
+				slices.Reverse(set)
+			}
+			spanSets[j] = set
+			concat = append(concat, set...)
+			for _, span := range set {
+				maxKey = max(maxKey, span.End+2)
+			}
+		}
+		concatCopy := slices.Clone(concat)
+		expr := GeoMultiUnionKeySpansToSpanExpr(spanSets)
+		require.Equal(t, concatCopy, slices.Concat(spanSets...), "the input was modified")
+		if len(concat) == 0 {
+			require.True(t, expr.IsEmpty())
+			continue
+		}
+
+		// The expression is the conversion of the concatenation of the sets,
+		// and evaluates like the pairwise union of the conversions of the sets.
+		expected := GeoUnionKeySpansToSpanExpr(concat).(*inverted.SpanExpression)
+		require.Equal(t, "", Diff(expected, expr), "%v", spanSets)
+		memUsage := expr.MemUsage()
+		expr.InvalidateCaches()
+		require.Equal(t, expr.MemUsage(), memUsage)
+		var pairwise *inverted.SpanExpression
+		for _, set := range spanSets {
+			pairwise = Or(pairwise, GeoUnionKeySpansToSpanExpr(set).(*inverted.SpanExpression))
+		}
+		contains := func(keys map[geoindex.Key]struct{}) bool {
+			for _, span := range concat {
+				for k := span.Start; k <= span.End; k++ {
+					if _, ok := keys[k]; ok {
+						return true
+					}
+				}
+			}
+			return false
+		}
+		require.NoError(t, checkEvaluate(expr, maxKey, contains), "%v", spanSets)
+		require.NoError(t, checkEvaluate(pairwise, maxKey, contains), "%v", spanSets)
+	}
+	require.True(t, GeoMultiUnionKeySpansToSpanExpr(nil).IsEmpty())
+}
+
+func TestGeoUnionKeySpansToSpanExprUnconstrained(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	prefixKey := []byte{0x12, 0x89, 0x00}
+	universe, _ := geoToSpan(
+		GeoKeyEncoder{Prefix: prefixKey},
+		geoindex.KeySpan{Start: 0, End: math.MaxUint64}, nil /* b */)
+	testCases := []struct {
+		ukSpans       geoindex.UnionKeySpans
+		unconstrained bool
+	}{
+		{ukSpans: geoindex.UnionKeySpans{{Start: 0, End: math.MaxUint64}}, unconstrained: true},
+		// Contiguous and overlapping spans are coalesced.
+		{
+			ukSpans:       geoindex.UnionKeySpans{{Start: 0, End: 10}, {Start: 11, End: math.MaxUint64}},
+			unconstrained: true,
+		},
+		{
+			ukSpans: geoindex.UnionKeySpans{
+				{Start: 0, End: 10}, {Start: 5, End: 20}, {Start: 21, End: math.MaxUint64},
+			},
+			unconstrained: true,
+		},
+		{ukSpans: geoindex.UnionKeySpans{{Start: 1, End: math.MaxUint64}}},
+		{ukSpans: geoindex.UnionKeySpans{{Start: 0, End: math.MaxUint64 - 1}}},
+		{ukSpans: geoindex.UnionKeySpans{{Start: 0, End: 10}, {Start: 12, End: math.MaxUint64}}},
+	}
+	for _, tc := range testCases {
+		var sink testConvertCountSink
+		expr, err := GeoUnionKeySpansToSpanExprWithOptions(
+			ctx, tc.ukSpans, prefixKey, ConvertOptions{CountSink: &sink})
+		require.NoError(t, err)
+		spanExpr := expr.(*inverted.SpanExpression)
+		require.Equal(t, tc.unconstrained, spanExpr.Unconstrained, "%v", tc.ukSpans)
+		require.NoError(t, spanExpr.CheckInvariants())
+		require.Equal(t, len(spanExpr.SpansToRead), sink.numSpans)
+		require.Equal(t, 1, sink.numNodes)
+		// The merged sets are also detected, in any order.
+		sets := make([]geoindex.UnionKeySpans, len(tc.ukSpans))
+		for i := range tc.ukSpans {
+			sets[len(sets)-1-i] = tc.ukSpans[i : i+1]
+		}
+		require.Equal(t, tc.unconstrained, GeoMultiUnionKeySpansToSpanExpr(sets).Unconstrained)
+		if !tc.unconstrained {
+			continue
+		}
+		require.Equal(t, inverted.Spans{universe}, spanExpr.SpansToRead)
+		require.Equal(t, inverted.Spans{universe}, spanExpr.FactoredUnionSpans)
+		require.False(t, spanExpr.Tight)
+	}
+}
+
+func BenchmarkGeoMultiUnionKeySpansToSpanExpr(b *testing.B) {
+	rng, _ := randutil.NewTestRand()
+	// The coverings of 16 shapes with about 1000 cells each, which overlap.
+	spanSets := make([]geoindex.UnionKeySpans, 16)
+	for i := range spanSets {
+		start := geoindex.Key(rng.Intn(1 << 20))
+		for j := 0; j < 1000; j++ {
+			start += geoindex.Key(2 + rng.Intn(1<<10))
+			end := start + geoindex.Key(rng.Intn(4))
+			spanSets[i] = append(spanSets[i], geoindex.KeySpan{Start: start, End: end})
+			start = end
+		}
+	}
+	b.Run("multi", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_ = GeoMultiUnionKeySpansToSpanExpr(spanSets)
+		}
+	})
+	b.Run("pairwise", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var expr *inverted.SpanExpression
+			for _, set := range spanSets {
+				expr = Or(expr, GeoUnionKeySpansToSpanExpr(set).(*inverted.SpanExpression))
+			}
+		}
+	})
+}
+
+func BenchmarkGeoRPKeyExprToSpanExprInputSorted(b *testing.B) {
+	ctx := context.Background()
+	rng, _ := randutil.NewTestRand()
+	for _, numKeys := range []int{16, 256, 4096} {
+		rpx := sortedRPKeyExpr(randRPKeyExpr(rng, numKeys, 1<<30 /* maxKey */))
+		for _, inputSorted := range []bool{false, true} {
+			b.Run(fmt.Sprintf("keys=%d/input-sorted=%t", numKeys, inputSorted), func(b *testing.B) {
+				b.ReportAllocs()
+				opts := ConvertOptions{InputSorted: inputSorted}
+				var c GeoSpanExprConverter
+				for i := 0; i < b.N; i++ {
+					c.Reset()
+					_, err := c.RPKeyExprToSpanExprWithOptions(ctx, rpx, nil /* prefixKey */, opts)
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// sortedRPKeyExpr returns a copy of rpx, with its keys replaced by the same
+// keys in increasing order.
+func sortedRPKeyExpr(rpx geoindex.RPKeyExpr) geoindex.RPKeyExpr {
+	var keys []geoindex.Key
+	for _, elem := range rpx {
+		if k, ok := elem.(geoindex.Key); ok {
+			keys = append(keys, k)
+		}
+	}
+	slices.Sort(keys)
+	res := make(geoindex.RPKeyExpr, len(rpx))
+	for i, elem := range rpx {
+		if _, ok := elem.(geoindex.Key); ok {
+			elem, keys = keys[0], keys[1:]
+		}
+		res[i] = elem
+	}
+	return res
+}
+
+func TestConvertOptionsInputSorted(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	// Attesting that the input is sorted must not change the result. In test
+	// builds, a false attestation is detected and logged, and the spans are
+	// sorted anyway.
+	rng, _ := randutil.NewTestRand()
+	for i := 0; i < 100; i++ {
+		var ukSpans geoindex.UnionKeySpans
+		for j := 0; j < rng.Intn(20); j++ {
+			start := geoindex.Key(rng.Intn(64))
+			end := start + geoindex.Key(rng.Intn(4))
+			ukSpans = append(ukSpans, geoindex.KeySpan{Start: start, End: end})
+		}
+		ukSpans = normalizeGeoKeySpans(ukSpans)
+		expected := GeoUnionKeySpansToSpanExpr(ukSpans)
+		actual, err := GeoUnionKeySpansToSpanExprWithOptions(
+			ctx, ukSpans, nil /* prefixKey */, ConvertOptions{InputSorted: true})
+		require.NoError(t, err)
+		requireEqualExprs(t, expected, actual, "%s", ukSpans)
+
+		rpx := randRPKeyExpr(rng, 1+rng.Intn(12), 1<<10 /* maxKey */)
+		for _, rpx := range []geoindex.RPKeyExpr{sortedRPKeyExpr(rpx), rpx} {
+			sorted := slices.Equal(rpx, sortedRPKeyExpr(rpx))
+			if !buildutil.CrdbTestBuild && !sorted {
+				continue
+			}
+			expected, err := GeoRPKeyExprToSpanExpr(ctx, rpx)
+			require.NoError(t, err)
+			actual, err := GeoRPKeyExprToSpanExprWithOptions(
+				ctx, rpx, nil /* prefixKey */, ConvertOptions{InputSorted: true})
+			require.NoError(t, err)
+			requireEqualExprs(t, expected, actual, "%s", rpx)
+		}
+	}
+}
+
+// requireEqualExprs checks that the given expressions are equal, using Diff if
+// both are SpanExpressions.
+func requireEqualExprs(
+	t *testing.T, expected, actual inverted.Expression, msgAndArgs ...interface{},
+) {
+	expectedSpanExpr, expectedOk := expected.(*inverted.SpanExpression)
+	actualSpanExpr, actualOk := actual.(*inverted.SpanExpression)
+	if expectedOk && actualOk {
+		require.Empty(t, Diff(expectedSpanExpr, actualSpanExpr), msgAndArgs...)
+		return
+	}
+	require.Equal(t, expected, actual, msgAndArgs...)
+}
+
+// testConvertSink is a ConvertSink that aggregates the statistics of the
+// conversions.
+type testConvertSink struct {
+	conversions [2]int
+	numSpans    [2]int
+	maxDepth    [2]int
+}
+
+func (s *testConvertSink) RecordConversion(input ConvertInput, stats inverted.SpanExprStats) {
+	s.conversions[input]++
+	s.numSpans[input] += stats.NumFactoredSpans
+	s.maxDepth[input] = max(s.maxDepth[input], stats.Depth)
+}
+
+func TestConvertSink(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	var sink testConvertSink
+	var expected testConvertSink
+	opts := ConvertOptions{Sink: &sink}
+	ukSpansList := []geoindex.UnionKeySpans{
+		nil,
+		{{Start: 1, End: 1}},
+		{{Start: 1, End: 2}, {Start: 6, End: 8}, {Start: 10, End: 10}},
+	}
+	for _, ukSpans := range ukSpansList {
+		expr, err := GeoUnionKeySpansToSpanExprWithOptions(ctx, ukSpans, nil /* prefixKey */, opts)
+		require.NoError(t, err)
+		if spanExpr := expr.(*inverted.SpanExpression); !spanExpr.IsEmpty() {
+			expected.RecordConversion(ConvertUnionKeySpans, spanExpr.Stats())
+		}
+	}
+	rpxs := []geoindex.RPKeyExpr{
+		nil,
+		{geoindex.Key(5)},
+		{geoindex.Key(5), geoindex.Key(6), geoindex.RPSetUnion},
+		{geoindex.Key(5), geoindex.Key(6), geoindex.RPSetIntersection, geoindex.Key(7),
+			geoindex.RPSetUnion},
+		// A malformed expression is not recorded.
+		{geoindex.Key(5), geoindex.RPSetIntersection},
+	}
+	var c GeoSpanExprConverter
+	for _, rpx := range rpxs {
+		expr, err := c.RPKeyExprToSpanExprWithOptions(ctx, rpx, nil /* prefixKey */, opts)
+		if err != nil {
+			continue
+		}
+		if spanExpr := expr.(*inverted.SpanExpression); !spanExpr.IsEmpty() {
+			expected.RecordConversion(ConvertRPKeyExpr, spanExpr.Stats())
+		}
+	}
+	require.Equal(t, [2]int{2, 3}, sink.conversions)
+	require.Equal(t, [2]int{4, 6}, sink.numSpans)
+	require.Equal(t, [2]int{1, 2}, sink.maxDepth)
+	require.Equal(t, expected, sink)
+}
+
+// testConvertCountSink is a ConvertCountSink that counts the spans and nodes
+// of the conversions.
+type testConvertCountSink struct {
+	numSpans, numNodes int
+}
+
+func (s *testConvertCountSink) AddSpans(n int) { s.numSpans += n }
+func (s *testConvertCountSink) AddNodes(n int) { s.numNodes += n }
+
+func TestConvertCountSink(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	var sink, expected testConvertCountSink
+	opts := ConvertOptions{CountSink: &sink}
+	record := func(expr inverted.Expression) {
+		if spanExpr := expr.(*inverted.SpanExpression); !spanExpr.IsEmpty() {
+			expected.numSpans += len(spanExpr.MaterializeSpansToRead())
+			expected.numNodes += spanExpr.Stats().NumNodes
+		}
+	}
+	// The spans to read are counted after contiguous spans are coalesced.
+	for _, ukSpans := range []geoindex.UnionKeySpans{
+		nil,
+		{{Start: 1, End: 1}},
+		{{Start: 1, End: 2}, {Start: 3, End: 4}, {Start: 10, End: 10}},
+	} {
+		expr, err := GeoUnionKeySpansToSpanExprWithOptions(ctx, ukSpans, nil /* prefixKey */, opts)
+		require.NoError(t, err)
+		record(expr)
+	}
+	require.Equal(t, testConvertCountSink{numSpans: 3, numNodes: 2}, sink)
+
+	// Expressions with and without intersections, whose spans are deferred or
+	// not, are counted, but malformed expressions are not.
+	var c GeoSpanExprConverter
+	for _, deferSpansToRead := range []bool{false, true} {
+		opts.DeferSpansToRead = deferSpansToRead
+		for _, rpx := range []geoindex.RPKeyExpr{
+			nil,
+			{geoindex.Key(5)},
+			{geoindex.Key(5), geoindex.Key(7), geoindex.RPSetUnion},
+			{geoindex.Key(5), geoindex.Key(7), geoindex.RPSetIntersection, geoindex.Key(9),
+				geoindex.RPSetUnion},
+			coveredByRPKeyExpr(testPolygonCovering(16)),
+			{geoindex.Key(5), geoindex.RPSetIntersection},
+		} {
+			c.Reset()
+			expr, err := c.RPKeyExprToSpanExprWithOptions(ctx, rpx, nil /* prefixKey */, opts)
+			if err != nil {
+				continue
+			}
+			record(expr)
+		}
+	}
+	require.Equal(t, expected, sink)
+
+	// The counts accumulate across the conversions of a query until the
+	// caller resets the sink.
+	sink = testConvertCountSink{}
+	for i := 0; i < 3; i++ {
+		_, err := GeoRPKeyExprToSpanExprWithOptions(
+			ctx, geoindex.RPKeyExpr{geoindex.Key(1), geoindex.Key(3), geoindex.RPSetIntersection},
+			nil /* prefixKey */, opts)
+		require.NoError(t, err)
+	}
+	require.Equal(t, testConvertCountSink{numSpans: 6, numNodes: 9}, sink)
+}
+
+func TestConvertOptionsKeyVersion(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	// The keys of the expressions are encoded with the given version, and the
+	// expressions only contain keys encoded with that version.
+	ukSpans := geoindex.UnionKeySpans{{Start: 1, End: 2}, {Start: 6, End: 8}}
+	rpx := geoindex.RPKeyExpr{
+		geoindex.Key(1), geoindex.Key(6), geoindex.RPSetIntersection, geoindex.Key(8),
+		geoindex.RPSetUnion,
+	}
+	for _, version := range []encoding.GeoInvertedKeyVersion{
+		encoding.GeoInvertedKeyV1, encoding.GeoInvertedKeyV2,
+	} {
+		opts := ConvertOptions{KeyVersion: version}
+		ukExpr, err := GeoUnionKeySpansToSpanExprWithOptions(ctx, ukSpans, nil /* prefixKey */, opts)
+		require.NoError(t, err)
+		rpExpr, err := GeoRPKeyExprToSpanExprWithOptions(ctx, rpx, nil /* prefixKey */, opts)
+		require.NoError(t, err)
+		for _, expr := range []*inverted.SpanExpression{
+			ukExpr.(*inverted.SpanExpression), rpExpr.(*inverted.SpanExpression),
+		} {
+			for _, span := range expr.SpansToRead {
+				decodedVersion, err := encoding.DecodeGeoInvertedKeyVersion(span.Start)
+				require.NoError(t, err)
+				require.Equal(t, version, decodedVersion)
+			}
+			for _, keyVersion := range []encoding.GeoInvertedKeyVersion{
+				encoding.GeoInvertedKeyV1, encoding.GeoInvertedKeyV2,
+			} {
+				var keys []inverted.EncVal
+				for _, k := range []geoindex.Key{1, 6, 8} {
+					enc, _ := geoKeyToEncInvertedVal(
+						GeoKeyEncoder{Version: keyVersion}, k, false /* end */, nil)
+					keys = append(keys, enc)
+				}
+				require.Equal(t, keyVersion == version, Evaluate(expr, keys))
+			}
+		}
+	}
+}
+
+func TestConvertOptionsParallelism(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	rng, _ := randutil.NewTestRand()
+	for i := 0; i < 20; i++ {
+		numKeys := 1 + rng.Intn(8*minKeysPerConvertWorker)
+		rpx := randRPKeyExpr(rng, numKeys, 4*numKeys /* maxKey */)
+		if rng.Intn(10) == 0 {
+			rpx = append(rpx, geoindex.Key(math.MaxUint64), geoindex.RPSetUnion)
+		}
+		var prefixKey []byte
+		if rng.Intn(2) == 0 {
+			prefixKey = []byte{0x12, 0x89, 0x00}
+		}
+		expected, err := GeoRPKeyExprToSpanExprWithPrefix(ctx, rpx, prefixKey)
+		require.NoError(t, err)
+		parallelism := 2 + rng.Intn(8)
+		actual, err := GeoRPKeyExprToSpanExprWithOptions(
+			ctx, rpx, prefixKey, ConvertOptions{Parallelism: parallelism},
+		)
+		require.NoError(t, err)
+		requireEqualExprs(t, expected, actual, "parallelism %d", parallelism)
+		require.Equal(t,
+			expected.(*inverted.SpanExpression).Stats(), actual.(*inverted.SpanExpression).Stats())
+	}
+
+	// A panic while encoding the keys, whether on one of the goroutines or on
+	// the calling one, which encodes the last range of keys, is returned as an
+	// assertion failure.
+	const numKeys = 4 * minKeysPerConvertWorker
+	rpx := geoindex.RPKeyExpr{geoindex.Key(0)}
+	for k := 1; k < numKeys; k++ {
+		rpx = append(rpx, geoindex.Key(k), geoindex.RPSetUnion)
+	}
+	for _, rpx := range []geoindex.RPKeyExpr{
+		rpx, append(rpx[:len(rpx):len(rpx)], geoindex.Key(0), geoindex.RPSetIntersection),
+	} {
+		for _, panicKey := range []uint64{0, numKeys - 1} {
+			var c GeoSpanExprConverter
+			_, err := c.RPKeyExprToSpanExprWithOptions(ctx, rpx, nil /* prefixKey */, ConvertOptions{
+				KeyEncoder:  panickingKeyEncoder{panicKey: panicKey},
+				Parallelism: 4,
+			})
+			require.True(t, errors.HasAssertionFailure(err), "%v", err)
+			require.ErrorContains(t, err, "injected panic")
+			// The converter remains usable.
+			_, err = c.RPKeyExprToSpanExprWithOptions(
+				ctx, rpx, nil /* prefixKey */, ConvertOptions{Parallelism: 4})
+			require.NoError(t, err)
+		}
+	}
+}
+
+// panickingKeyEncoder is an inverted.KeyEncoder that panics when it encodes
+// panicKey, and otherwise encodes the keys like GeoKeyEncoder.
+type panickingKeyEncoder struct {
+	GeoKeyEncoder
+	panicKey uint64
+}
+
+func (e panickingKeyEncoder) EncodeKey(k uint64, b []byte) (inverted.EncVal, []byte) {
+	if k == e.panicKey {
+		panic(errors.Newf("injected panic encoding key %d", k))
+	}
+	return e.GeoKeyEncoder.EncodeKey(k, b)
+}
+
+func TestConvertOptionsMaxSpans(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	// The limit applies to the spans to read, after contiguous spans are
+	// coalesced and duplicate keys are pruned, rather than to the input.
+	requireTooManySpans := func(err error) {
+		require.True(t, errors.Is(err, ErrTooManySpans), "%v", err)
+		require.Equal(t, pgcode.ProgramLimitExceeded, pgerror.GetPGCode(err))
+	}
+	ukSpans := geoindex.UnionKeySpans{
+		{Start: 1, End: 1}, {Start: 2, End: 2}, {Start: 3, End: 3}, {Start: 10, End: 10},
+	}
+	expr, err := GeoUnionKeySpansToSpanExprWithOptions(
+		ctx, ukSpans, nil /* prefixKey */, ConvertOptions{MaxSpans: 2})
+	require.NoError(t, err)
+	require.Len(t, expr.(*inverted.SpanExpression).SpansToRead, 2)
+	_, err = GeoUnionKeySpansToSpanExprWithOptions(
+		ctx, ukSpans, nil /* prefixKey */, ConvertOptions{MaxSpans: 1})
+	requireTooManySpans(err)
+
+	for _, rpx := range []geoindex.RPKeyExpr{
+		{
+			geoindex.Key(1), geoindex.Key(2), geoindex.RPSetUnion, geoindex.Key(1),
+			geoindex.RPSetUnion, geoindex.Key(5), geoindex.RPSetUnion,
+		},
+		{
+			geoindex.Key(1), geoindex.Key(2), geoindex.RPSetUnion, geoindex.Key(1),
+			geoindex.RPSetUnion, geoindex.Key(5), geoindex.RPSetIntersection,
+		},
+	} {
+		var c GeoSpanExprConverter
+		expr, err := c.RPKeyExprToSpanExprWithOptions(
+			ctx, rpx, nil /* prefixKey */, ConvertOptions{MaxSpans: 3})
+		require.NoError(t, err, "%s", rpx)
+		require.Len(t, expr.(*inverted.SpanExpression).SpansToRead, 3, "%s", rpx)
+		_, err = c.RPKeyExprToSpanExprWithOptions(
+			ctx, rpx, nil /* prefixKey */, ConvertOptions{MaxSpans: 2})
+		requireTooManySpans(err)
+	}
+}
+
+func TestEstimateConvertedSize(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	rng, _ := randutil.NewTestRand()
+	// estimateFactor bounds the ratio between the estimated and the actual
+	// memory usage, in both directions.
+	const estimateFactor = 2
+	for _, n := range []int{1, 4, 16, 64, 256, 1024} {
+		covering := testPolygonCovering(n)
+		for _, rpx := range []geoindex.RPKeyExpr{
+			coveredByRPKeyExpr(covering),
+			unionRPKeyExpr(covering),
+			// The keys are random cell IDs, which are almost certainly unique.
+			randRPKeyExpr(rng, n, math.MaxInt64),
+		} {
+			spans, bytes := EstimateConvertedSize(rpx)
+			expr, err := GeoRPKeyExprToSpanExpr(ctx, rpx)
+			require.NoError(t, err)
+			spanExpr := expr.(*inverted.SpanExpression)
+			require.GreaterOrEqual(t, spans, len(spanExpr.SpansToRead), "%s", rpx)
+			actual := spanExpr.MemUsage()
+			require.LessOrEqual(t, bytes, estimateFactor*actual, "%s", rpx)
+			require.LessOrEqual(t, actual, estimateFactor*bytes, "%s", rpx)
+
+			// The budget is checked against the estimate, before encoding
+			// the keys.
+			_, err = GeoRPKeyExprToSpanExprWithOptions(
+				ctx, rpx, nil /* prefixKey */, ConvertOptions{MaxBytes: bytes})
+			require.NoError(t, err)
+			_, err = GeoRPKeyExprToSpanExprWithOptions(
+				ctx, rpx, nil /* prefixKey */, ConvertOptions{MaxBytes: bytes - 1})
+			require.True(t, errors.Is(err, ErrExceedsMemoryBudget), "%v", err)
+			require.Equal(t, pgcode.ProgramLimitExceeded, pgerror.GetPGCode(err))
+		}
+	}
+
+	// The budget also applies to the conversion of UnionKeySpans.
+	ukSpans := geoindex.UnionKeySpans{{Start: 1, End: 3}, {Start: 10, End: 10}}
+	_, err := GeoUnionKeySpansToSpanExprWithOptions(
+		ctx, ukSpans, nil /* prefixKey */, ConvertOptions{MaxBytes: 1 << 20})
+	require.NoError(t, err)
+	_, err = GeoUnionKeySpansToSpanExprWithOptions(
+		ctx, ukSpans, nil /* prefixKey */, ConvertOptions{MaxBytes: 1})
+	require.True(t, errors.Is(err, ErrExceedsMemoryBudget), "%v", err)
+}
+
+// testPolygonCovering returns the interior covering of a polygon over
+// Manhattan with at most maxCells cells.
+func testPolygonCovering(maxCells int) s2.CellUnion {
+	loop := s2.LoopFromPoints([]s2.Point{
+		s2.PointFromLatLng(s2.LatLngFromDegrees(40.70, -74.02)),
+		s2.PointFromLatLng(s2.LatLngFromDegrees(40.75, -74.01)),
+		s2.PointFromLatLng(s2.LatLngFromDegrees(40.88, -73.93)),
+		s2.PointFromLatLng(s2.LatLngFromDegrees(40.80, -73.93)),
+		s2.PointFromLatLng(s2.LatLngFromDegrees(40.71, -73.97)),
+	})
+	// The points are in clockwise order, so the loop must be inverted to
+	// contain the polygon rather than its complement.
+	loop.Normalize()
+	rc := &s2.RegionCoverer{MinLevel: 0, MaxLevel: 30, MaxCells: maxCells}
+	return rc.InteriorCovering(s2.PolygonFromLoops([]*s2.Loop{loop}))
+}
+
+// unionRPKeyExpr returns the union of the keys of the cells of the covering
+// and their ancestors.
+func unionRPKeyExpr(covering s2.CellUnion) geoindex.RPKeyExpr {
+	var rpx geoindex.RPKeyExpr
+	seen := make(map[s2.CellID]struct{})
+	for _, c := range covering {
+		for l := c.Level(); l >= 0; l-- {
+			if _, ok := seen[c.Parent(l)]; ok {
+				break
+			}
+			seen[c.Parent(l)] = struct{}{}
+			rpx = append(rpx, geoindex.Key(c.Parent(l)))
+			if len(rpx) > 1 {
+				rpx = append(rpx, geoindex.RPSetUnion)
+			}
+		}
+	}
+	return rpx
+}
+
+func TestConvertOptionsOrderSpansByWidth(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	// Ordering the spans by width only changes the order of the
+	// FactoredUnionSpans of each node, and the spans of coarser cells come
+	// first.
+	prefixKey := []byte{0x12, 0x89, 0x00}
+	var requireOrdered func(expected, actual *inverted.SpanExpression)
+	requireOrdered = func(expected, actual *inverted.SpanExpression) {
+		spans := actual.FactoredUnionSpans
+		require.Equal(t, !slices.IsSortedFunc(spans, cmpSpans), actual.UnsortedFactoredUnionSpans)
+		for i := 1; i < len(spans); i++ {
+			require.GreaterOrEqual(t,
+				geoSpanWidth(spans[i-1], len(prefixKey)), geoSpanWidth(spans[i], len(prefixKey)))
+		}
+		sorted := slices.Clone(spans)
+		slices.SortFunc(sorted, cmpSpans)
+		require.True(t, expected.FactoredUnionSpans.Equals(sorted))
+		require.Equal(t, expected.Operator, actual.Operator)
+		if expected.Operator != inverted.None {
+			requireOrdered(
+				expected.Left.(*inverted.SpanExpression), actual.Left.(*inverted.SpanExpression))
+			requireOrdered(
+				expected.Right.(*inverted.SpanExpression), actual.Right.(*inverted.SpanExpression))
+		}
+	}
+	requireEquivalent := func(expected, actual inverted.Expression) {
+		expectedSpanExpr := expected.(*inverted.SpanExpression)
+		actualSpanExpr := actual.(*inverted.SpanExpression)
+		require.NoError(t, actualSpanExpr.CheckInvariants())
+		require.True(t, expectedSpanExpr.SpansToRead.Equals(actualSpanExpr.SpansToRead))
+		require.True(t, slices.IsSortedFunc(actualSpanExpr.SpansToRead, cmpSpans))
+		require.Equal(t, expectedSpanExpr.Stats(), actualSpanExpr.Stats())
+		memUsage := actualSpanExpr.MemUsage()
+		actualSpanExpr.InvalidateCaches()
+		require.Equal(t, actualSpanExpr.MemUsage(), memUsage)
+		requireOrdered(expectedSpanExpr, actualSpanExpr)
+	}
+	opts := ConvertOptions{OrderSpansByWidth: true, IndexKind: inverted.GeographyIndexKind}
+	for _, maxCells := range []int{4, 16, 64} {
+		covering := testPolygonCovering(maxCells)
+		ukSpans := intersectsKeySpans(covering)
+		expected := GeoUnionKeySpansToSpanExprWithPrefix(ukSpans, prefixKey)
+		actual, err := GeoUnionKeySpansToSpanExprWithOptions(ctx, ukSpans, prefixKey, opts)
+		require.NoError(t, err)
+		requireEquivalent(expected, actual)
+		require.True(t, actual.(*inverted.SpanExpression).UnsortedFactoredUnionSpans)
+
+		for _, rpx := range []geoindex.RPKeyExpr{
+			unionRPKeyExpr(covering), coveredByRPKeyExpr(covering),
+		} {
+			var c GeoSpanExprConverter
+			expected, err := GeoRPKeyExprToSpanExprWithPrefix(ctx, rpx, prefixKey)
+			require.NoError(t, err)
+			actual, err := c.RPKeyExprToSpanExprWithOptions(ctx, rpx, prefixKey, opts)
+			require.NoError(t, err)
+			requireEquivalent(expected, actual)
+		}
+	}
+}
+
+func TestConvertOptionsSpanOrdering(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	prefixKey := []byte{0x12, 0x89, 0x00}
+	width := func(span inverted.Span) uint64 {
+		return geoSpanWidth(span, len(prefixKey))
+	}
+	// requireOrdered checks that the FactoredUnionSpans of every node of actual
+	// are those of expected, in the given ordering.
+	var requireOrdered func(ordering inverted.SpanOrdering, expected, actual *inverted.SpanExpression)
+	requireOrdered = func(ordering inverted.SpanOrdering, expected, actual *inverted.SpanExpression) {
+		spans := actual.FactoredUnionSpans
+		require.Equal(t, !slices.IsSortedFunc(spans, cmpSpans), actual.UnsortedFactoredUnionSpans)
+		for i := 1; i < len(spans); i++ {
+			prev, cur := width(spans[i-1]), width(spans[i])
+			switch ordering {
+			case inverted.OrderByKey:
+				require.Negative(t, cmpSpans(spans[i-1], spans[i]))
+			case inverted.OrderByWidthAscending:
+				require.LessOrEqual(t, prev, cur)
+			case inverted.OrderByWidthDescending:
+				require.GreaterOrEqual(t, prev, cur)
+			}
+		}
+		sorted := slices.Clone(spans)
+		slices.SortFunc(sorted, cmpSpans)
+		require.True(t, expected.FactoredUnionSpans.Equals(sorted))
+		if expected.Operator != inverted.None {
+			requireOrdered(ordering,
+				expected.Left.(*inverted.SpanExpression), actual.Left.(*inverted.SpanExpression))
+			requireOrdered(ordering,
+				expected.Right.(*inverted.SpanExpression), actual.Right.(*inverted.SpanExpression))
+		}
+	}
+	covering := testPolygonCovering(16)
+	ukSpans := intersectsKeySpans(covering)
+	rpxs := []geoindex.RPKeyExpr{unionRPKeyExpr(covering), coveredByRPKeyExpr(covering)}
+	for _, tc := range []struct {
+		opts     ConvertOptions
+		expected inverted.SpanOrdering
+	}{
+		{opts: ConvertOptions{}, expected: inverted.OrderByKey},
+		{
+			opts:     ConvertOptions{SpanOrdering: inverted.OrderByWidthAscending},
+			expected: inverted.OrderByWidthAscending,
+		},
+		{
+			opts:     ConvertOptions{SpanOrdering: inverted.OrderByWidthDescending},
+			expected: inverted.OrderByWidthDescending,
+		},
+		{
+			opts:     ConvertOptions{OrderSpansByWidth: true},
+			expected: inverted.OrderByWidthDescending,
+		},
+		{
+			opts: ConvertOptions{
+				OrderSpansByWidth: true, SpanOrdering: inverted.OrderByWidthDescending,
+			},
+			expected: inverted.OrderByWidthDescending,
+		},
+	} {
+		t.Run(tc.expected.String(), func(t *testing.T) {
+			opts := tc.opts
+			opts.IndexKind = inverted.GeographyIndexKind
+			check := func(expected, actual inverted.Expression) {
+				actualSpanExpr := actual.(*inverted.SpanExpression)
+				require.Equal(t, tc.expected, actualSpanExpr.Ordering)
+				require.NoError(t, actualSpanExpr.CheckInvariants())
+				require.NoError(t, actualSpanExpr.CheckOrdering(width))
+				requireOrdered(tc.expected, expected.(*inverted.SpanExpression), actualSpanExpr)
+				if tc.expected != inverted.OrderByKey {
+					require.Contains(t, actualSpanExpr.String(), "ordering: "+tc.expected.String())
+				}
+			}
+			expected := GeoUnionKeySpansToSpanExprWithPrefix(ukSpans, prefixKey)
+			actual, err := GeoUnionKeySpansToSpanExprWithOptions(ctx, ukSpans, prefixKey, opts)
+			require.NoError(t, err)
+			check(expected, actual)
+			// The covering has cells of several levels, so ordering them by
+			// width changes their order.
+			require.Equal(t, tc.expected != inverted.OrderByKey,
+				actual.(*inverted.SpanExpression).UnsortedFactoredUnionSpans)
+			for _, rpx := range rpxs {
+				expected, err := GeoRPKeyExprToSpanExprWithPrefix(ctx, rpx, prefixKey)
+				require.NoError(t, err)
+				var c GeoSpanExprConverter
+				actual, err := c.RPKeyExprToSpanExprWithOptions(ctx, rpx, prefixKey, opts)
+				require.NoError(t, err)
+				check(expected, actual)
+			}
+			// The ordering is recorded on empty and unconstrained expressions.
+			empty, err := GeoRPKeyExprToSpanExprWithOptions(ctx, nil, prefixKey, opts)
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, empty.(*inverted.SpanExpression).Ordering)
+			unconstrained, err := GeoUnionKeySpansToSpanExprWithOptions(
+				ctx, geoindex.UnionKeySpans{{Start: 0, End: math.MaxUint64}}, prefixKey, opts,
+			)
+			require.NoError(t, err)
+			require.True(t, unconstrained.(*inverted.SpanExpression).Unconstrained)
+			require.Equal(t, tc.expected, unconstrained.(*inverted.SpanExpression).Ordering)
+		})
+	}
+
+	// The narrowest spans come first in one ordering, and last in the other, so
+	// each fails the check of the other.
+	ascending, err := GeoUnionKeySpansToSpanExprWithOptions(ctx, ukSpans, prefixKey, ConvertOptions{
+		SpanOrdering: inverted.OrderByWidthAscending, IndexKind: inverted.GeographyIndexKind,
+	})
+	require.NoError(t, err)
+	ascendingSpanExpr := ascending.(*inverted.SpanExpression)
+	ascendingSpanExpr.Ordering = inverted.OrderByWidthDescending
+	require.Error(t, ascendingSpanExpr.CheckOrdering(width))
+	ascendingSpanExpr.Ordering = inverted.OrderByKey
+	require.Error(t, ascendingSpanExpr.CheckOrdering(width))
+	ascendingSpanExpr.Ordering = inverted.OrderByWidthAscending
+
+	// The passes that would reorder the spans by key leave the expression as
+	// it is.
+	original := ascendingSpanExpr.Copy().(*inverted.SpanExpression)
+	require.Same(t, ascendingSpanExpr, inverted.Normalize(ascendingSpanExpr, 0 /* maxGrowth */))
+	require.Same(t, ascendingSpanExpr, PromoteFactoredSpans(ascendingSpanExpr))
+	require.Same(t, ascendingSpanExpr, Simplify(ascendingSpanExpr))
+	require.Empty(t, Diff(original, ascendingSpanExpr))
+
+	// The orderings by width require an index kind, and conflicting orderings
+	// are rejected.
+	_, err = GeoUnionKeySpansToSpanExprWithOptions(ctx, ukSpans, prefixKey, ConvertOptions{
+		SpanOrdering: inverted.OrderByWidthAscending,
+	})
+	require.True(t, errors.Is(err, ErrIndexKindRequired), "%v", err)
+	_, err = GeoRPKeyExprToSpanExprWithOptions(ctx, rpxs[0], prefixKey, ConvertOptions{
+		OrderSpansByWidth: true, SpanOrdering: inverted.OrderByWidthAscending,
+		IndexKind: inverted.GeographyIndexKind,
+	})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "conflicts with")
+}
+
+func BenchmarkEvaluateOrderSpansByWidth(b *testing.B) {
+	ctx := context.Background()
+	// The keys of the rows are skewed towards coarse cells: each row has the
+	// key of an ancestor of a cell of the covering, at a level that is
+	// geometrically distributed from the level of the face.
+	rng, _ := randutil.NewTestRand()
+	covering := testPolygonCovering(256)
+	rows := make([][]inverted.EncVal, 1024)
+	for i := range rows {
+		c := covering[rng.Intn(len(covering))]
+		level := 0
+		for level < c.Level() && rng.Intn(4) == 0 {
+			level++
+		}
+		key, _ := geoKeyToEncInvertedVal(
+			GeoKeyEncoder{}, geoindex.Key(c.Parent(level)),
+			false /* end */, nil,
+		)
+		rows[i] = []inverted.EncVal{key}
+	}
+	ukSpans := intersectsKeySpans(covering)
+	for _, orderByWidth := range []bool{false, true} {
+		b.Run(fmt.Sprintf("order-by-width=%t", orderByWidth), func(b *testing.B) {
+			expr, err := GeoUnionKeySpansToSpanExprWithOptions(
+				ctx, ukSpans, nil /* prefixKey */, ConvertOptions{
+					OrderSpansByWidth: orderByWidth, IndexKind: inverted.GeographyIndexKind,
+				},
+			)
+			if err != nil {
+				b.Fatal(err)
+			}
+			spanExpr := expr.(*inverted.SpanExpression)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if !Evaluate(spanExpr, rows[i%len(rows)]) {
+					b.Fatal("row does not satisfy the expression")
+				}
+			}
+		})
+	}
+}
+
+func TestConvertOptionsDeferSpansToRead(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	rng, _ := randutil.NewTestRand()
+	visit := func(expr *inverted.SpanExpression) inverted.Spans {
+		var spans inverted.Spans
+		require.NoError(t, expr.VisitSpansToRead(func(span inverted.Span) error {
+			spans = append(spans, span)
+			return nil
+		}))
+		return spans
+	}
+	// requireDeferred checks that the deferred SpansToRead of actual, visited
+	// before and after converting actual to a proto, are the SpansToRead of
+	// expected, and that the expressions are otherwise identical.
+	requireDeferred := func(expected, actual inverted.Expression) {
+		expectedSpanExpr := expected.(*inverted.SpanExpression)
+		actualSpanExpr := actual.(*inverted.SpanExpression)
+		require.Nil(t, actualSpanExpr.SpansToRead)
+		require.NoError(t, actualSpanExpr.CheckInvariants())
+		memUsage := actualSpanExpr.MemUsage()
+		actualSpanExpr.InvalidateCaches()
+		require.Equal(t, actualSpanExpr.MemUsage(), memUsage)
+
+		require.True(t, expectedSpanExpr.SpansToRead.Equals(visit(actualSpanExpr)))
+		// Only unsorted FactoredUnionSpans are materialized by the visit.
+		require.Equal(t,
+			actualSpanExpr.UnsortedFactoredUnionSpans, actualSpanExpr.SpansToRead != nil)
+		require.Equal(t,
+			SpansToReadAsRoachpbSpans(expectedSpanExpr, nil /* indexPrefix */),
+			SpansToReadAsRoachpbSpans(actualSpanExpr, nil /* indexPrefix */))
+		// Converting to a proto does not materialize the SpansToRead.
+		require.Equal(t, expectedSpanExpr.ToProto(), actualSpanExpr.ToProto())
+		require.Equal(t,
+			actualSpanExpr.UnsortedFactoredUnionSpans, actualSpanExpr.SpansToRead != nil)
+		require.True(t, expectedSpanExpr.SpansToRead.Equals(visit(actualSpanExpr)))
+		require.True(t,
+			expectedSpanExpr.SpansToRead.Equals(actualSpanExpr.MaterializeSpansToRead()))
+		require.Equal(t, "", Diff(expectedSpanExpr, actualSpanExpr))
+	}
+	for _, orderSpansByWidth := range []bool{false, true} {
+		opts := ConvertOptions{
+			OrderSpansByWidth: orderSpansByWidth, IndexKind: inverted.GeographyIndexKind,
+		}
+		deferredOpts := opts
+		deferredOpts.DeferSpansToRead = true
+		for _, n := range []int{1, 4, 16, 64} {
+			ukSpans := invertedexprtestutils.RandomUnionKeySpans(rng, n)
+			expected, err := GeoUnionKeySpansToSpanExprWithOptions(
+				ctx, ukSpans, nil /* prefixKey */, opts)
+			require.NoError(t, err)
+			actual, err := GeoUnionKeySpansToSpanExprWithOptions(
+				ctx, ukSpans, nil /* prefixKey */, deferredOpts)
+			require.NoError(t, err)
+			requireDeferred(expected, actual)
+
+			// The RPKeyExprs only have unions.
+			for _, rpx := range []geoindex.RPKeyExpr{
+				unionRPKeyExpr(testPolygonCovering(n)),
+				invertedexprtestutils.RandomRPKeyExprWithSkew(
+					rng, n, 0 /* maxDepth */, invertedexprtestutils.DefaultSkew),
+			} {
+				expected, err := GeoRPKeyExprToSpanExprWithOptions(ctx, rpx, nil /* prefixKey */, opts)
+				require.NoError(t, err)
+				var c GeoSpanExprConverter
+				actual, err := c.RPKeyExprToSpanExprWithOptions(ctx, rpx, nil /* prefixKey */, deferredOpts)
+				require.NoError(t, err)
+				requireDeferred(expected, actual)
+			}
+		}
+	}
+
+	// The SpansToRead of expressions with more than one node are not deferred.
+	rpx := coveredByRPKeyExpr(testPolygonCovering(16))
+	expr, err := GeoRPKeyExprToSpanExprWithOptions(
+		ctx, rpx, nil /* prefixKey */, ConvertOptions{DeferSpansToRead: true})
+	require.NoError(t, err)
+	require.NotNil(t, expr.(*inverted.SpanExpression).SpansToRead)
+}
+
+func TestConvertOptionsPromoteFactoredSpans(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	rng, _ := randutil.NewTestRand()
+	opts := ConvertOptions{PromoteFactoredSpans: true}
+	// requireMemUsage checks that the memory usage of expr computed during the
+	// conversion equals the memory usage computed by traversing it.
+	requireMemUsage := func(expr *inverted.SpanExpression) {
+		memUsage := expr.MemUsage()
+		expr.InvalidateCaches()
+		require.Equal(t, expr.MemUsage(), memUsage)
+	}
+
+	// The coverings of the same polygon at different resolutions share the
+	// keys of the coarse cells, which the conversion of their union does not
+	// factor, unlike that of their intersection.
+	for _, maxCells := range [][2]int{{4, 16}, {16, 64}, {64, 256}} {
+		coverings := [2]s2.CellUnion{
+			testPolygonCovering(maxCells[0]), testPolygonCovering(maxCells[1]),
+		}
+		rpx := append(coveredByRPKeyExpr(coverings[0]), coveredByRPKeyExpr(coverings[1])...)
+		rpx = append(rpx, geoindex.RPSetUnion)
+		expected, err := GeoRPKeyExprToSpanExpr(ctx, rpx)
+		require.NoError(t, err)
+		actual, err := GeoRPKeyExprToSpanExprWithOptions(ctx, rpx, nil /* prefixKey */, opts)
+		require.NoError(t, err)
+		expectedSpanExpr := expected.(*inverted.SpanExpression)
+		actualSpanExpr := actual.(*inverted.SpanExpression)
+		require.True(t, expectedSpanExpr.SpansToRead.Equals(actualSpanExpr.SpansToRead))
+		requireMemUsage(actualSpanExpr)
+		before, after := expectedSpanExpr.Stats(), actualSpanExpr.Stats()
+		t.Logf("cells=%v: %d nodes and %d factored spans, promoted to %d nodes and %d spans",
+			maxCells, before.NumNodes, before.NumFactoredSpans, after.NumNodes, after.NumFactoredSpans)
+		require.LessOrEqual(t, after.NumNodes, before.NumNodes)
+		require.Less(t, after.NumFactoredSpans, before.NumFactoredSpans)
+
+		// The rows have the keys of ancestors of the cells of the coverings.
+		for i := 0; i < 1000; i++ {
+			var keys []inverted.EncVal
+			for n := 1 + rng.Intn(3); n > 0; n-- {
+				covering := coverings[rng.Intn(2)]
+				c := covering[rng.Intn(len(covering))]
+				key, _ := geoKeyToEncInvertedVal(
+					GeoKeyEncoder{}, geoindex.Key(c.Parent(rng.Intn(c.Level()+1))),
+					false /* end */, nil,
+				)
+				keys = append(keys, key)
+			}
+			require.Equal(t, Evaluate(expectedSpanExpr, keys), Evaluate(actualSpanExpr, keys))
+		}
+	}
+
+	// Random expressions with many duplicate keys.
+	var c GeoSpanExprConverter
+	for i := 0; i < 200; i++ {
+		rpx := invertedexprtestutils.RandomRPKeyExprWithSkew(
+			rng, 1+rng.Intn(32), 1+rng.Intn(6),
+			invertedexprtestutils.Skew{Contiguous: 0.25, Duplicate: 0.5, Nested: 0.9},
+		)
+		var maxKey geoindex.Key
+		for _, elem := range rpx {
+			if k, ok := elem.(geoindex.Key); ok && k >= maxKey {
+				maxKey = k + 1
+			}
+		}
+		c.Reset()
+		expr, err := c.RPKeyExprToSpanExprWithOptions(ctx, rpx, nil /* prefixKey */, opts)
+		require.NoError(t, err)
+		spanExpr := expr.(*inverted.SpanExpression)
+		requireMemUsage(spanExpr)
+		require.NoError(t, checkEvaluate(spanExpr, maxKey, func(keys map[geoindex.Key]struct{}) bool {
+			return evalRPKeyExpr(rpx, keys)
+		}), "%s", rpx)
+	}
+}
+
+// overlappingShapesRPKeyExpr returns the intersection of the unions of the
+// keys of the coverings of two shapes that are adjacent along the Hilbert
+// curve, each of which is covered by numCells consecutive cells, and which
+// overlap in the last numShared cells of the first shape. The keys of an
+// RPKeyExpr are unique, so the second shape covers the shared cells with their
+// children.
+func overlappingShapesRPKeyExpr(numCells, numShared int) geoindex.RPKeyExpr {
+	parent := s2.CellIDFromLatLng(s2.LatLngFromDegrees(40.75, -73.98)).Parent(8)
+	var rpx geoindex.RPKeyExpr
+	appendKey := func(c s2.CellID, first bool) {
+		rpx = append(rpx, geoindex.Key(c))
+		if !first {
+			rpx = append(rpx, geoindex.RPSetUnion)
+		}
+	}
+	c := parent.ChildBeginAtLevel(16)
+	for i := 0; i < numCells; i++ {
+		appendKey(c, i == 0)
+		c = c.Next()
+	}
+	c = parent.ChildBeginAtLevel(16).Advance(int64(numCells - numShared))
+	for i := 0; i < numCells; i++ {
+		if i < numShared {
+			for j, child := range c.Children() {
+				appendKey(child, i == 0 && j == 0)
+			}
+		} else {
+			appendKey(c, i == 0)
+		}
+		c = c.Next()
+	}
+	return append(rpx, geoindex.RPSetIntersection)
+}
+
+func TestConvertOptionsPartialSpansToRead(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	visit := func(visitFn func(func(inverted.Span) error) error) inverted.Spans {
+		var spans inverted.Spans
+		require.NoError(t, visitFn(func(span inverted.Span) error {
+			spans = append(spans, span)
+			return nil
+		}))
+		return spans
+	}
+	opts := ConvertOptions{PartialSpansToRead: true}
+	for _, maxCells := range []int{4, 16, 64} {
+		rpx := overlappingShapesRPKeyExpr(maxCells, 2 /* numShared */)
+		expected, err := GeoRPKeyExprToSpanExpr(ctx, rpx)
+		require.NoError(t, err)
+		expectedSpanExpr := expected.(*inverted.SpanExpression)
+		var c GeoSpanExprConverter
+		actual, err := c.RPKeyExprToSpanExprWithOptions(ctx, rpx, nil /* prefixKey */, opts)
+		require.NoError(t, err)
+		actualSpanExpr := actual.(*inverted.SpanExpression)
+		require.NoError(t, actualSpanExpr.CheckInvariants())
+		require.Equal(t, inverted.SetIntersection, actualSpanExpr.Operator)
+		require.True(t, actualSpanExpr.PartialSpansToRead)
+		memUsage := actualSpanExpr.MemUsage()
+		actualSpanExpr.InvalidateCaches()
+		require.Equal(t, actualSpanExpr.MemUsage(), memUsage)
+
+		// The partial SpansToRead are a subset of the complete SpansToRead,
+		// which include the factored spans of the root.
+		partial := actualSpanExpr.SpansToRead
+		complete := expectedSpanExpr.SpansToRead
+		require.Less(t, len(partial), len(complete))
+		// The partial SpansToRead are the keys between the first child of the
+		// shared cells in the second shape and the last shared cell in the
+		// first shape: the 2 shared cells, and all but the last 2 of their 8
+		// children, since the key of a cell is between those of its second and
+		// third children.
+		require.Len(t, partial, 8)
+		for _, span := range partial {
+			require.Contains(t, complete, span)
+		}
+		for _, span := range actualSpanExpr.FactoredUnionSpans {
+			require.True(t, partial.ContainsKey(span.Start))
+		}
+
+		// The spans of the nodes are complete, and the tree is unchanged.
+		left := actualSpanExpr.Left.(*inverted.SpanExpression)
+		right := actualSpanExpr.Right.(*inverted.SpanExpression)
+		require.Equal(t, mergeSpans(complete, nil),
+			mergeSpans(visit(actualSpanExpr.VisitNodeSpansToRead), nil))
+		require.Equal(t, mergeSpans(complete, nil), mergeSpans(
+			mergeSpans(actualSpanExpr.FactoredUnionSpans, visit(left.VisitNodeSpansToRead)),
+			visit(right.VisitNodeSpansToRead),
+		))
+		require.Equal(t, expectedSpanExpr.Stats(), actualSpanExpr.Stats())
+		require.True(t, actualSpanExpr.PartialSpansToRead)
+
+		// Materializing the SpansToRead completes them.
+		require.Equal(t,
+			mergeSpans(complete, nil), mergeSpans(actualSpanExpr.MaterializeSpansToRead(), nil))
+		require.False(t, actualSpanExpr.PartialSpansToRead)
+		require.NoError(t, actualSpanExpr.CheckInvariants())
+	}
+
+	// The SpansToRead of expressions whose root is not an intersection are
+	// complete.
+	for _, rpx := range []geoindex.RPKeyExpr{
+		unionRPKeyExpr(testPolygonCovering(16)),
+		{
+			geoindex.Key(1), geoindex.Key(5), geoindex.RPSetIntersection,
+			geoindex.Key(3), geoindex.Key(7), geoindex.RPSetIntersection,
+			geoindex.RPSetUnion,
+		},
+	} {
+		expected, err := GeoRPKeyExprToSpanExpr(ctx, rpx)
+		require.NoError(t, err)
+		actual, err := GeoRPKeyExprToSpanExprWithOptions(ctx, rpx, nil /* prefixKey */, opts)
+		require.NoError(t, err)
+		require.False(t, actual.(*inverted.SpanExpression).PartialSpansToRead)
+		require.Equal(t, "",
+			Diff(expected.(*inverted.SpanExpression), actual.(*inverted.SpanExpression)))
+	}
+}
+
+// BenchmarkGeoRPKeyExprToSpanExprPartial reports the number of spans and keys
+// read upfront for the intersection of two shapes with a small overlap, with
+// and without ConvertOptions.PartialSpansToRead.
+func BenchmarkGeoRPKeyExprToSpanExprPartial(b *testing.B) {
+	ctx := context.Background()
+	for _, numShared := range []int{1, 8} {
+		rpx := overlappingShapesRPKeyExpr(256 /* numCells */, numShared)
+		for _, partial := range []bool{false, true} {
+			b.Run(fmt.Sprintf("shared=%d/partial=%t", numShared, partial), func(b *testing.B) {
+				opts := ConvertOptions{PartialSpansToRead: partial}
+				var c GeoSpanExprConverter
+				var spansToRead inverted.Spans
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					c.Reset()
+					expr, err := c.RPKeyExprToSpanExprWithOptions(ctx, rpx, nil /* prefixKey */, opts)
+					if err != nil {
+						b.Fatal(err)
+					}
+					spansToRead = expr.(*inverted.SpanExpression).SpansToRead
+				}
+				keys, _ := (&inverted.SpanExpression{SpansToRead: spansToRead}).EstimatedKeys()
+				b.ReportMetric(float64(len(spansToRead)), "spans-read")
+				b.ReportMetric(float64(keys), "keys-read")
+			})
+		}
+	}
+}
+
+func TestGeoSpanExprBoundingSpan(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	prefix := []byte("prefix")
+	enc := GeoKeyEncoder{Prefix: prefix}
+	start := func(k uint64) inverted.EncVal {
+		key, _ := enc.EncodeKey(k, nil)
+		return key
+	}
+	end := func(k uint64) inverted.EncVal {
+		key, _ := enc.EncodeEndKey(k, nil)
+		return key
+	}
+	// checkBoundingSpan checks that the bounding span of expr, which was
+	// populated by the conversion, spans the keys in [first, last], and that it
+	// is the bounding span that is computed from the SpansToRead.
+	checkBoundingSpan := func(expr inverted.Expression, first, last uint64) {
+		t.Helper()
+		spanExpr := expr.(*inverted.SpanExpression)
+		span, ok := spanExpr.BoundingSpan()
+		require.True(t, ok)
+		require.Equal(t, start(first), span.Start)
+		require.Equal(t, end(last), span.EndKey())
+		spanExpr.InvalidateCaches()
+		recomputed, ok := spanExpr.BoundingSpan()
+		require.True(t, ok)
+		require.True(t, span.Equals(recomputed), "%v != %v", span, recomputed)
+	}
+
+	// The end key of a span that contains math.MaxUint64 is the PrefixEnd of
+	// its encoding.
+	ukSpans := geoindex.UnionKeySpans{{Start: 3, End: 7}, {Start: 10, End: math.MaxUint64}}
+	checkBoundingSpan(GeoUnionKeySpansToSpanExprWithPrefix(ukSpans, prefix), 3, math.MaxUint64)
+	// The other converters do not have a prefix.
+	enc = GeoKeyEncoder{}
+	checkBoundingSpan(GeoMultiUnionKeySpansToSpanExpr(
+		[]geoindex.UnionKeySpans{{{Start: 3, End: 7}}, {{Start: 5, End: 9}}},
+	), 3, 9)
+	checkBoundingSpan(GeoDWithinToSpanExpr(
+		geoindex.UnionKeySpans{{Start: 5, End: 6}},
+		geoindex.UnionKeySpans{{Start: 2, End: 9}},
+	), 2, 9)
+	enc = GeoKeyEncoder{Prefix: prefix}
+	rpx := geoindex.RPKeyExpr{
+		geoindex.Key(1), geoindex.Key(math.MaxUint64), geoindex.RPSetIntersection,
+		geoindex.Key(5), geoindex.RPSetUnion,
+	}
+	for _, opts := range []ConvertOptions{
+		{},
+		{DeferSpansToRead: true},
+		{OrderSpansByWidth: true, IndexKind: inverted.GeographyIndexKind},
+		{PromoteFactoredSpans: true},
+	} {
+		expr, err := GeoRPKeyExprToSpanExprWithOptions(ctx, rpx, prefix, opts)
+		require.NoError(t, err)
+		checkBoundingSpan(expr, 1, math.MaxUint64)
+	}
+	// The bounding span of the partial SpansToRead of an intersection is that
+	// of the complete SpansToRead.
+	rpx = overlappingShapesRPKeyExpr(16 /* numCells */, 2 /* numShared */)
+	expected, err := GeoRPKeyExprToSpanExprWithPrefix(ctx, rpx, prefix)
+	require.NoError(t, err)
+	expectedSpan, ok := expected.(*inverted.SpanExpression).BoundingSpan()
+	require.True(t, ok)
+	var c GeoSpanExprConverter
+	actual, err := c.RPKeyExprToSpanExprWithOptions(
+		ctx, rpx, prefix, ConvertOptions{PartialSpansToRead: true},
+	)
+	require.NoError(t, err)
+	actualSpanExpr := actual.(*inverted.SpanExpression)
+	require.True(t, actualSpanExpr.PartialSpansToRead)
+	actualSpan, ok := actualSpanExpr.BoundingSpan()
+	require.True(t, ok)
+	require.True(t, expectedSpan.Equals(actualSpan), "%v != %v", expectedSpan, actualSpan)
+
+	// An empty expression has no bounding span.
+	expr, err := GeoRPKeyExprToSpanExpr(ctx, nil)
+	require.NoError(t, err)
+	if spanExpr, ok := expr.(*inverted.SpanExpression); ok {
+		_, ok := spanExpr.BoundingSpan()
+		require.False(t, ok)
+	}
+}
+
+func TestGeoSpanExprMemUsage(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	// requireMemUsage checks that the memory usage of expr computed during the
+	// conversion equals the memory usage computed by traversing it.
+	requireMemUsage := func(expr inverted.Expression, msgAndArgs ...interface{}) {
+		spanExpr, ok := expr.(*inverted.SpanExpression)
+		if !ok {
+			return
+		}
+		memUsage := spanExpr.MemUsage()
+		spanExpr.InvalidateCaches()
+		require.Equal(t, spanExpr.MemUsage(), memUsage, msgAndArgs...)
+	}
+	rng, _ := randutil.NewTestRand()
+	var c GeoSpanExprConverter
+	for i := 0; i < 200; i++ {
+		var prefixKey []byte
+		if rng.Intn(2) == 0 {
+			prefixKey = []byte{0x12, 0x89, 0x00}
+		}
+		var ukSpans geoindex.UnionKeySpans
+		for j := 0; j < 1+rng.Intn(20); j++ {
+			start := geoindex.Key(rng.Intn(64))
+			end := start + geoindex.Key(rng.Intn(4))
+			ukSpans = append(ukSpans, geoindex.KeySpan{Start: start, End: end})
+		}
+		ukSpans = append(ukSpans, geoindex.KeySpan{Start: math.MaxUint64, End: math.MaxUint64})
+		requireMemUsage(GeoUnionKeySpansToSpanExprWithPrefix(ukSpans, prefixKey), ukSpans)
+
+		// The memory usage of expressions with unique keys is computed during
+		// the conversion, and otherwise lazily.
+		numKeys := 1 + rng.Intn(12)
+		rpx := randRPKeyExpr(rng, numKeys, 8 /* maxKey */)
+		if rng.Intn(2) == 0 {
+			perm := rng.Perm(2 * numKeys)
+			for j := range rpx {
+				if _, ok := rpx[j].(geoindex.Key); ok {
+					rpx[j], perm = geoindex.Key(perm[0]), perm[1:]
+				}
+			}
+		}
+		if rng.Intn(4) == 0 {
+			rpx = append(rpx, geoindex.Key(math.MaxUint64), geoindex.RPSetIntersection)
+		}
+		c.Reset()
+		expr, err := c.RPKeyExprToSpanExprWithPrefix(ctx, rpx, prefixKey)
+		require.NoError(t, err)
+		requireMemUsage(expr, rpx)
+	}
+}
+
+func TestRPKeyExprToSpanExprUnionOfKeys(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	// The expression for a union of keys is a single node, whose SpansToRead
+	// and FactoredUnionSpans are the same slice.
+	rng, _ := randutil.NewTestRand()
+	var c GeoSpanExprConverter
+	for i := 0; i < 100; i++ {
+		rpx := randRPKeyExpr(rng, 1+rng.Intn(20), 32 /* maxKey */)
+		for j := range rpx {
+			if _, ok := rpx[j].(geoindex.RPSetOperator); ok {
+				rpx[j] = geoindex.RPSetUnion
+			}
+		}
+		var spans inverted.Spans
+		for _, elem := range rpx {
+			if k, ok := elem.(geoindex.Key); ok {
+				span, _ := geoToPointSpan(GeoKeyEncoder{}, k, nil)
+				spans = append(spans, span)
+			}
+		}
+		spans = sortAndPruneSpans(spans)
+		expected := &inverted.SpanExpression{SpansToRead: spans, FactoredUnionSpans: spans}
+
+		// Reuse the converter across expressions with and without intersections,
+		// since the FactoredUnionSpans of the node are reused after Reset.
+		c.Reset()
+		_, err := c.RPKeyExprToSpanExpr(ctx, randRPKeyExpr(rng, 1+rng.Intn(8), 32 /* maxKey */))
+		require.NoError(t, err)
+		c.Reset()
+		expr, err := c.RPKeyExprToSpanExpr(ctx, rpx)
+		require.NoError(t, err)
+		requireEqualExprs(t, expected, expr, "%s", rpx)
+		spanExpr := expr.(*inverted.SpanExpression)
+		require.Same(t, &spanExpr.SpansToRead[0], &spanExpr.FactoredUnionSpans[0])
+		_, err = c.RPKeyExprToSpanExpr(ctx, randRPKeyExpr(rng, 1+rng.Intn(8), 32 /* maxKey */))
+		require.NoError(t, err)
+		requireEqualExprs(t, expected, expr, "%s", rpx)
+	}
+}
+
+func BenchmarkGeoRPKeyExprToSpanExprUnion(b *testing.B) {
+	ctx := context.Background()
+	// The expression for the covering of a shape that intersects the indexed
+	// shapes is a union of the keys of the cells and their ancestors.
+	rng, _ := randutil.NewTestRand()
+	for _, numKeys := range []int{256, 4096} {
+		b.Run(fmt.Sprintf("keys=%d", numKeys), func(b *testing.B) {
+			rpx := geoindex.RPKeyExpr{geoindex.Key(rng.Uint64())}
+			for i := 1; i < numKeys; i++ {
+				rpx = append(rpx, geoindex.Key(rng.Uint64()), geoindex.RPSetUnion)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := GeoRPKeyExprToSpanExpr(ctx, rpx); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkGeoRPKeyExprToSpanExprParallelism(b *testing.B) {
+	ctx := context.Background()
+	// The expression for a large covering is dominated by the unions of the
+	// keys of the cells and their ancestors. The keys are increasing, so that
+	// sorting the spans does not dominate the conversion.
+	rng, _ := randutil.NewTestRand()
+	k := geoindex.Key(rng.Intn(1 << 20))
+	rpx := geoindex.RPKeyExpr{k}
+	for i := 1; i < 1<<15; i++ {
+		k += geoindex.Key(1 + rng.Intn(1<<20))
+		rpx = append(rpx, k, geoindex.RPSetUnion)
+	}
+	for _, parallelism := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("parallelism=%d", parallelism), func(b *testing.B) {
+			opts := ConvertOptions{Parallelism: parallelism}
+			var c GeoSpanExprConverter
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				c.Reset()
+				if _, err := c.RPKeyExprToSpanExprWithOptions(ctx, rpx, nil /* prefixKey */, opts); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestGeoUnionKeySpansVisit(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ukSpans := geoindex.UnionKeySpans{
+		{Start: 1, End: 2}, {Start: 3, End: 3}, {Start: 1000, End: 2000},
+		{Start: math.MaxUint64 - 1, End: math.MaxUint64},
+	}
+	var expected inverted.Spans
+	for _, ukSpan := range ukSpans {
+		span, _ := geoToSpan(GeoKeyEncoder{}, ukSpan, nil /* b */)
+		expected = append(expected, span)
+	}
+
+	// The visited spans are equal to the encoded spans, as long as they are
+	// copied.
+	var copied, retained inverted.Spans
+	require.NoError(t, GeoUnionKeySpansVisit(ukSpans, func(span inverted.Span) error {
+		copied = append(copied, inverted.Span{
+			Start: append(inverted.EncVal(nil), span.Start...),
+			End:   append(inverted.EncVal(nil), span.End...),
+		})
+		retained = append(retained, span)
+		return nil
+	}))
+	require.Equal(t, expected, copied)
+	if util.RaceEnabled {
+		// In race builds, the retained spans are overwritten.
+		require.NotEqual(t, expected, retained)
+	}
+
+	// The iteration stops at the first error.
+	numVisited := 0
+	err := GeoUnionKeySpansVisit(ukSpans, func(span inverted.Span) error {
+		numVisited++
+		if numVisited == 2 {
+			return errors.New("boom")
+		}
+		return nil
+	})
+	require.EqualError(t, err, "boom")
+	require.Equal(t, 2, numVisited)
+}
+
+func BenchmarkGeoUnionKeySpansVisit(b *testing.B) {
+	var ukSpans geoindex.UnionKeySpans
+	for i := 0; i < 4096; i++ {
+		start := geoindex.Key(i * 4)
+		ukSpans = append(ukSpans, geoindex.KeySpan{Start: start, End: start + 1})
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := GeoUnionKeySpansVisit(ukSpans, func(inverted.Span) error { return nil }); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestGeoSpanExprSummaryString(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	toSpanExpr := func(rpx geoindex.RPKeyExpr) *inverted.SpanExpression {
+		expr, err := GeoRPKeyExprToSpanExpr(ctx, rpx)
+		require.NoError(t, err)
+		return expr.(*inverted.SpanExpression)
+	}
+	testCases := []struct {
+		name     string
+		expr     *inverted.SpanExpression
+		expected string
+	}{
+		{
+			name: "union-key-spans",
+			expr: GeoUnionKeySpansToSpanExpr(geoindex.UnionKeySpans{
+				{Start: 1, End: 1}, {Start: 5, End: 8},
+			}).(*inverted.SpanExpression),
+			expected: "union of 2 spans over 1 level; 0 intersections; est. 5 keys",
+		},
+		{
+			name: "rp-key-expr",
+			expr: toSpanExpr(geoindex.RPKeyExpr{
+				geoindex.Key(5), geoindex.Key(6), geoindex.RPSetUnion,
+				geoindex.Key(5), geoindex.Key(7), geoindex.RPSetUnion,
+				geoindex.RPSetIntersection,
+			}),
+			expected: "union of 3 spans over 2 levels; 1 intersection; est. 3 keys",
+		},
+		{
+			name: "dwithin",
+			expr: GeoDWithinToSpanExpr(
+				geoindex.UnionKeySpans{{Start: 4, End: 6}, {Start: 10, End: 10}},
+				geoindex.UnionKeySpans{{Start: 2, End: 12}},
+			),
+			expected: "union of 5 spans over 2 levels; 0 intersections; est. 11 keys",
+		},
+		{
+			name: "intersects-polygon",
+			expr: GeoUnionKeySpansToSpanExpr(
+				intersectsKeySpans(testPolygonCovering(16)),
+			).(*inverted.SpanExpression),
+			expected: "union of 39 spans over 1 level; 0 intersections; est. 962072674318 keys",
+		},
+		{
+			name:     "covered-by-polygon",
+			expr:     toSpanExpr(coveredByRPKeyExpr(testPolygonCovering(16))),
+			expected: "union of 46 spans over 8 levels; 15 intersections; est. 46 keys",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.expected, tc.expr.SummaryString())
+		})
+	}
+}
+
+func TestGeoConvertRecoversFromPanics(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	defer func() { testingConvertHook = nil }()
+	var panicValue interface{}
+	testingConvertHook = func(ConvertInput) {
+		if panicValue != nil {
+			panic(panicValue)
+		}
+	}
+	rpx := geoindex.RPKeyExpr{geoindex.Key(5), geoindex.Key(6), geoindex.RPSetIntersection}
+	uks := geoindex.UnionKeySpans{{Start: 1, End: 1}, {Start: 5, End: 8}}
+
+	// A SpanExpression returned by the converter before the panic remains
+	// valid.
+	var c GeoSpanExprConverter
+	before, err := c.RPKeyExprToSpanExpr(ctx, rpx)
+	require.NoError(t, err)
+	beforeStr := before.(*inverted.SpanExpression).String()
+
+	for _, v := range []interface{}{errors.New("injected"), "injected"} {
+		panicValue = v
+		_, err = c.RPKeyExprToSpanExpr(ctx, rpx)
+		require.Error(t, err)
+		require.True(t, errors.HasAssertionFailure(err))
+		require.Contains(t, err.Error(), fmt.Sprintf(
+			"converting geoindex.RPKeyExpr of length 3 (first: %s, last: %s): injected",
+			rpx[:1], rpx[2:]))
+
+		_, err = GeoRPKeyExprToSpanExpr(ctx, rpx)
+		require.True(t, errors.HasAssertionFailure(err))
+
+		_, err = GeoUnionKeySpansToSpanExprWithOptions(ctx, uks, nil /* prefixKey */, ConvertOptions{})
+		require.True(t, errors.HasAssertionFailure(err))
+		require.Contains(t, err.Error(), fmt.Sprintf(
+			"converting geoindex.UnionKeySpans of length 2 (first: %s, last: %s): injected",
+			uks[:1], uks[1:]))
+
+		// The fallback is used if the conversion panics.
+		expr, fallback := GeoRPKeyExprToSpanExprWithFallback(ctx, rpx, 10 /* maxNodes */)
+		require.True(t, fallback)
+		require.False(t, expr.Tight)
+	}
+	require.Equal(t, beforeStr, before.(*inverted.SpanExpression).String())
+
+	// The converter can be reused after a panic.
+	panicValue = nil
+	after, err := c.RPKeyExprToSpanExpr(ctx, rpx)
+	require.NoError(t, err)
+	require.Equal(t, beforeStr, after.(*inverted.SpanExpression).String())
+}
+
+func TestGeoKeyEncoder(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	// The encoded keys are locked, since they are stored in geospatial inverted
+	// indexes.
+	prefix := []byte{0x12, 0x89}
+	testCases := []struct {
+		enc        GeoKeyEncoder
+		k          uint64
+		start, end string
+	}{
+		{GeoKeyEncoder{}, 0, "4288", "4289"},
+		{GeoKeyEncoder{}, 1, "4289", "428a"},
+		{GeoKeyEncoder{}, 255, "42f6ff", "42f70100"},
+		{GeoKeyEncoder{}, 256, "42f70100", "42f70101"},
+		{GeoKeyEncoder{}, 0x1234567890abcdef, "42fd1234567890abcdef", "42fd1234567890abcdf0"},
+		{GeoKeyEncoder{}, math.MaxUint64, "42fdffffffffffffffff", "42fe"},
+		{GeoKeyEncoder{Prefix: prefix}, 1, "12894289", "1289428a"},
+		{GeoKeyEncoder{Prefix: prefix}, math.MaxUint64, "128942fdffffffffffffffff", "128942fe"},
+		{GeoKeyEncoder{Version: encoding.GeoInvertedKeyV2}, 1, "5589", "558a"},
+		{GeoKeyEncoder{Version: encoding.GeoInvertedKeyV2}, 255, "55f6ff", "55f70100"},
+	}
+	for _, tc := range testCases {
+		b := []byte("x")
+		start, b := tc.enc.EncodeKey(tc.k, b)
+		require.Equal(t, tc.start, hex.EncodeToString(start))
+		end, b := tc.enc.EncodeEndKey(tc.k, b)
+		require.Equal(t, tc.end, hex.EncodeToString(end))
+		// The keys are appended to b, and appending to b does not modify them.
+		require.Equal(t, tc.start, hex.EncodeToString(b[1:1+len(start)]))
+		require.Equal(t, tc.start, hex.EncodeToString(start))
+	}
+}
+
+// hexKeyEncoder is an inverted.KeyEncoder that encodes keys as 16 hexadecimal
+// digits, which makes the spans of SpanExpressions human-readable.
+type hexKeyEncoder struct{}
+
+var _ inverted.KeyEncoder = hexKeyEncoder{}
+
+func (hexKeyEncoder) EncodeKey(k uint64, b []byte) (inverted.EncVal, []byte) {
+	prev := len(b)
+	b = fmt.Appendf(b, "%016x", k)
+	return b[prev:len(b):len(b)], b
+}
+
+func (e hexKeyEncoder) EncodeEndKey(k uint64, b []byte) (inverted.EncVal, []byte) {
+	if k < math.MaxUint64 {
+		return e.EncodeKey(k+1, b)
+	}
+	enc, b := e.EncodeKey(k, b)
+	return inverted.EncVal(roachpb.Key(enc).PrefixEnd()), b
+}
+
+func TestConvertOptionsKeyEncoder(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	opts := ConvertOptions{KeyEncoder: hexKeyEncoder{}}
+	uks := geoindex.UnionKeySpans{{Start: 1, End: 1}, {Start: 5, End: 8}, {Start: 0xff, End: 0xff}}
+	expr, err := GeoUnionKeySpansToSpanExprWithOptions(ctx, uks, nil /* prefixKey */, opts)
+	require.NoError(t, err)
+	require.Equal(t, `span expression
+ ├── tight: false, unique: false
+ ├── to read
+ │    ├── ["0000000000000001", "0000000000000001"]
+ │    ├── ["0000000000000005", "0000000000000009")
+ │    └── ["00000000000000ff", "0000000000000100")
+ ├── union spans
+ │    ├── ["0000000000000001", "0000000000000001"]
+ │    ├── ["0000000000000005", "0000000000000009")
+ │    └── ["00000000000000ff", "0000000000000100")
+ └── stats: nodes: 1, depth: 1, spans: 3 (points: 1, ranges: 2), spans per node: [3, 3]
+`, expr.(*inverted.SpanExpression).String())
+
+	rpx := geoindex.RPKeyExpr{
+		geoindex.Key(5), geoindex.Key(6), geoindex.RPSetUnion,
+		geoindex.Key(5), geoindex.Key(0x1ff), geoindex.RPSetUnion,
+		geoindex.RPSetIntersection,
+	}
+	for _, parallelism := range []int{0, 4} {
+		opts.Parallelism = parallelism
+		expr, err = GeoRPKeyExprToSpanExprWithOptions(ctx, rpx, nil /* prefixKey */, opts)
+		require.NoError(t, err)
+		require.Equal(t, `span expression
+ ├── tight: false, unique: false
+ ├── to read
+ │    ├── ["0000000000000005", "0000000000000005"]
+ │    ├── ["0000000000000006", "0000000000000006"]
+ │    └── ["00000000000001ff", "0000000000000200")
+ ├── union spans: ["0000000000000005", "0000000000000005"]
+ ├── INTERSECTION
+ │    ├── span expression
+ │    │    ├── tight: false, unique: false
+ │    │    ├── to read: empty
+ │    │    └── union spans: ["00000000000001ff", "0000000000000200")
+ │    └── span expression
+ │         ├── tight: false, unique: false
+ │         ├── to read: empty
+ │         └── union spans: ["0000000000000006", "0000000000000006"]
+ └── stats: nodes: 3, depth: 2, spans: 3 (points: 2, ranges: 1), spans per node: [1, 1]
+`, expr.(*inverted.SpanExpression).String())
+	}
+}
+
+// unoptimizedRPKeyExprToSpanExpr converts rpx to a SpanExpression by combining
+// the expressions of its keys with And and Or, without the factoring and
+// merging of unions of GeoRPKeyExprToSpanExpr.
+func unoptimizedRPKeyExprToSpanExpr(rpx geoindex.RPKeyExpr) *inverted.SpanExpression {
+	var stack []*inverted.SpanExpression
+	for _, elem := range rpx {
+		switch e := elem.(type) {
+		case geoindex.Key:
+			expr := GeoUnionKeySpansToSpanExpr(geoindex.UnionKeySpans{{Start: e, End: e}})
+			stack = append(stack, expr.(*inverted.SpanExpression))
+		case geoindex.RPSetOperator:
+			left, right := stack[len(stack)-2], stack[len(stack)-1]
+			stack = stack[:len(stack)-2]
+			if e == geoindex.RPSetUnion {
+				stack = append(stack, Or(left, right))
+			} else {
+				stack = append(stack, And(left, right))
+			}
+		}
+	}
+	return stack[0]
+}
+
+// checkEvaluate returns an error if expr does not evaluate to expected on
+// sets of keys in [0, maxKey). The sets are chosen deterministically, so that
+// the inputs on which the check fails can be shrunk.
+func checkEvaluate(
+	expr *inverted.SpanExpression,
+	maxKey geoindex.Key,
+	expected func(keys map[geoindex.Key]struct{}) bool,
+) error {
+	if err := expr.CheckInvariants(); err != nil {
+		return err
+	}
+	rng := rand.New(rand.NewSource(int64(maxKey)))
+	for i := 0; i < 20; i++ {
+		keys := make(map[geoindex.Key]struct{})
+		var encKeys []inverted.EncVal
+		for k := geoindex.Key(0); k < maxKey; k++ {
+			if rng.Intn(3) == 0 {
+				keys[k] = struct{}{}
+				enc, _ := geoKeyToEncInvertedVal(GeoKeyEncoder{}, k, false /* end */, nil)
+				encKeys = append(encKeys, enc)
+			}
+		}
+		if expected, actual := expected(keys), Evaluate(expr, encKeys); expected != actual {
+			return errors.Newf("evaluates to %t instead of %t with keys %v:\n%s",
+				actual, expected, keys, expr)
+		}
+	}
+	return nil
+}
+
+func TestGeoRPKeyExprToSpanExprProperties(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	var conv GeoSpanExprConverter
+	// check returns an error if the conversions of rpx do not agree with each
+	// other and with evalRPKeyExpr.
+	check := func(rpx geoindex.RPKeyExpr) error {
+		var maxKey geoindex.Key
+		for _, elem := range rpx {
+			if k, ok := elem.(geoindex.Key); ok && k >= maxKey {
+				maxKey = k + 1
+			}
+		}
+		expected := func(keys map[geoindex.Key]struct{}) bool {
+			return evalRPKeyExpr(rpx, keys)
+		}
+		conv.Reset()
+		converted, err := conv.RPKeyExprToSpanExpr(ctx, rpx)
+		if err != nil {
+			return errors.Wrap(err, "converter")
+		}
+		if err := checkEvaluate(converted.(*inverted.SpanExpression), maxKey, expected); err != nil {
+			return errors.Wrap(err, "converter")
+		}
+		for _, opts := range []ConvertOptions{{}, {
+			OrderSpansByWidth: true, IndexKind: inverted.GeographyIndexKind,
+		}} {
+			expr, err := GeoRPKeyExprToSpanExprWithOptions(ctx, rpx, nil /* prefixKey */, opts)
+			if err != nil {
+				return errors.Wrapf(err, "options %+v", opts)
+			}
+			if err := checkEvaluate(expr.(*inverted.SpanExpression), maxKey, expected); err != nil {
+				return errors.Wrapf(err, "options %+v", opts)
+			}
+		}
+		unoptimized := unoptimizedRPKeyExprToSpanExpr(rpx)
+		return errors.Wrap(checkEvaluate(unoptimized, maxKey, expected), "unoptimized")
+	}
+
+	rng, _ := randutil.NewTestRand()
+	skews := []invertedexprtestutils.Skew{
+		invertedexprtestutils.DefaultSkew,
+		{Contiguous: 0.9},
+		{Duplicate: 0.9, Nested: 1},
+		{Nested: 1},
+	}
+	for _, skew := range skews {
+		for i := 0; i < 100; i++ {
+			rpx := invertedexprtestutils.RandomRPKeyExprWithSkew(
+				rng, 1+rng.Intn(16), rng.Intn(6) /* maxDepth */, skew)
+			if err := check(rpx); err != nil {
+				shrunk := invertedexprtestutils.ShrinkRPKeyExpr(rpx, func(rpx geoindex.RPKeyExpr) bool {
+					return check(rpx) != nil
+				})
+				t.Fatalf("%s: %v\nshrunk to %s: %v", rpx, err, shrunk, check(shrunk))
+			}
+		}
+	}
+}
+
+func TestGeoUnionKeySpansToSpanExprProperties(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	// check returns an error if the conversion of spans does not agree with
+	// the union of the expressions of the individual spans, or with the keys
+	// of the spans.
+	check := func(spans geoindex.UnionKeySpans) error {
+		var maxKey geoindex.Key
+		if len(spans) > 0 {
+			maxKey = spans[len(spans)-1].End + 2
+		}
+		expected := func(keys map[geoindex.Key]struct{}) bool {
+			for k := range keys {
+				for _, span := range spans {
+					if span.Start <= k && k <= span.End {
+						return true
+					}
+				}
+			}
+			return false
+		}
+		expr := GeoUnionKeySpansToSpanExpr(spans).(*inverted.SpanExpression)
+		if expr.IsEmpty() != (len(spans) == 0) {
+			return errors.Newf("expression of %d spans is empty: %t", len(spans), expr.IsEmpty())
+		}
+		if err := checkEvaluate(expr, maxKey, expected); err != nil {
+			return err
+		}
+		unoptimized := inverted.EmptySpanExpression()
+		for _, span := range spans {
+			expr := GeoUnionKeySpansToSpanExpr(geoindex.UnionKeySpans{span})
+			unoptimized = Or(unoptimized, expr.(*inverted.SpanExpression))
+		}
+		return errors.Wrap(checkEvaluate(unoptimized, maxKey, expected), "unoptimized")
+	}
+
+	rng, _ := randutil.NewTestRand()
+	skews := []invertedexprtestutils.Skew{
+		invertedexprtestutils.DefaultSkew,
+		{},
+		{Contiguous: 1},
+	}
+	for _, skew := range skews {
+		for i := 0; i < 100; i++ {
+			spans := invertedexprtestutils.RandomUnionKeySpansWithSkew(rng, rng.Intn(16), skew)
+			if err := check(spans); err != nil {
+				shrunk := invertedexprtestutils.ShrinkUnionKeySpans(spans,
+					func(spans geoindex.UnionKeySpans) bool {
+						return check(spans) != nil
+					})
+				t.Fatalf("%v: %v\nshrunk to %v: %v", spans, err, shrunk, check(shrunk))
+			}
+		}
+	}
 }
@@ -0,0 +1,87 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package invertedexpr
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"strings"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/inverted"
+	"github.com/cockroachdb/cockroach/pkg/util/encoding"
+	"github.com/golang/geo/s2"
+)
+
+func init() {
+	inverted.RegisterKeyFormatter(inverted.GeometryIndexKind, formatGeometryKey)
+	inverted.RegisterKeyFormatter(inverted.GeographyIndexKind, formatGeographyKey)
+}
+
+// decodeUnprefixedGeoKey decodes a key encoded by a GeoKeyEncoder without a
+// prefix. It returns false if the key is not such a key, e.g. if it is the key
+// of a multi-column index, which is preceded by the encoding of the prefix
+// columns, or the PrefixEnd of an encoded key.
+func decodeUnprefixedGeoKey(key inverted.EncVal) (uint64, bool) {
+	if _, err := encoding.DecodeGeoInvertedKeyVersion(key); err != nil {
+		return 0, false
+	}
+	rem, k, err := encoding.DecodeUvarintAscending(key[1:])
+	if err != nil || len(rem) > 0 {
+		return 0, false
+	}
+	return k, true
+}
+
+// formatGeographyKey is the inverted.KeyFormatter of geography indexes, which
+// formats the s2 cell of a key as its face, level and position, which is the
+// index of the cell along the Hilbert curve of the face among the cells of its
+// level. The end keys of spans of several cells are usually not valid cell
+// IDs, and are formatted as numbers.
+func formatGeographyKey(key inverted.EncVal) (string, bool) {
+	k, ok := decodeUnprefixedGeoKey(key)
+	if !ok {
+		return "", false
+	}
+	c := s2.CellID(k)
+	if !c.IsValid() {
+		return fmt.Sprintf("key(%d)", k), true
+	}
+	// The position of a cell is followed by a 1 bit, and padded with zeros.
+	pos := c.Pos() >> (bits.TrailingZeros64(c.Pos()) + 1)
+	return fmt.Sprintf("cell(face=%d, level=%d, pos=%d)", c.Face(), c.Level(), pos), true
+}
+
+// formatGeometryKey is the inverted.KeyFormatter of geometry indexes, which
+// formats the s2 cell of a key, which is on face 0, as its path in the
+// quadtree over the bounds of the index, i.e. the positions of its ancestors
+// among their siblings, starting from the child of the root. The key of the
+// shapes that exceed the bounds, math.MaxUint64, is formatted as such.
+func formatGeometryKey(key inverted.EncVal) (string, bool) {
+	k, ok := decodeUnprefixedGeoKey(key)
+	if !ok {
+		return "", false
+	}
+	if k == math.MaxUint64 {
+		return "exceeds-bounds", true
+	}
+	c := s2.CellID(k)
+	if !c.IsValid() || c.Face() != 0 {
+		return fmt.Sprintf("key(%d)", k), true
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "quadtree(level=%d, path=", c.Level())
+	for level := 1; level <= c.Level(); level++ {
+		b.WriteByte("0123"[c.ChildPosition(level)])
+	}
+	b.WriteByte(')')
+	return b.String(), true
+}
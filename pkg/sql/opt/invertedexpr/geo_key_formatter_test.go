@@ -0,0 +1,160 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package invertedexpr
+
+import (
+	"context"
+	"math"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/geo/geoindex"
+	"github.com/cockroachdb/cockroach/pkg/sql/inverted"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/errors"
+	"github.com/golang/geo/s2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGeoKeyFormatters(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	encKey := func(k uint64) inverted.EncVal {
+		enc, _ := geoKeyToEncInvertedVal(GeoKeyEncoder{}, geoindex.Key(k), false /* end */, nil)
+		return enc
+	}
+	cell := s2.CellIDFromFace(0).Children()[2].Children()[1]
+	testCases := []struct {
+		key       inverted.EncVal
+		geometry  string
+		geography string
+	}{
+		{
+			key:       encKey(uint64(cell)),
+			geometry:  "quadtree(level=2, path=21)",
+			geography: "cell(face=0, level=2, pos=9)",
+		},
+		{
+			key:       encKey(uint64(s2.CellIDFromFace(3))),
+			geometry:  "key(8070450532247928832)",
+			geography: "cell(face=3, level=0, pos=0)",
+		},
+		{
+			key:       encKey(uint64(s2.CellIDFromFace(0))),
+			geometry:  "quadtree(level=0, path=)",
+			geography: "cell(face=0, level=0, pos=0)",
+		},
+		{
+			// The lowest set bit of a cell ID is at the position of its level.
+			key:       encKey(uint64(cell) + 2),
+			geometry:  "key(1369094286720630786)",
+			geography: "key(1369094286720630786)",
+		},
+		{
+			key:       encKey(math.MaxUint64),
+			geometry:  "exceeds-bounds",
+			geography: "key(18446744073709551615)",
+		},
+	}
+	for _, tc := range testCases {
+		s, ok := formatGeometryKey(tc.key)
+		require.True(t, ok)
+		require.Equal(t, tc.geometry, s)
+		s, ok = formatGeographyKey(tc.key)
+		require.True(t, ok)
+		require.Equal(t, tc.geography, s)
+	}
+
+	// Keys with a prefix, and the PrefixEnd of the keys, are not decoded.
+	prefixed, _ := geoKeyToEncInvertedVal(
+		GeoKeyEncoder{Prefix: []byte{0x12, 0x89}}, geoindex.Key(cell), false /* end */, nil)
+	end, _ := geoKeyToEncInvertedVal(GeoKeyEncoder{}, math.MaxUint64, true /* end */, nil)
+	for _, key := range []inverted.EncVal{prefixed, end, nil} {
+		_, ok := formatGeometryKey(key)
+		require.False(t, ok)
+		_, ok = formatGeographyKey(key)
+		require.False(t, ok)
+	}
+}
+
+func TestConvertOptionsIndexKind(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	cell := geoindex.Key(s2.CellIDFromFace(0).Children()[2])
+	uks := geoindex.UnionKeySpans{{Start: cell, End: cell}}
+	rpx := geoindex.RPKeyExpr{cell, geoindex.Key(math.MaxUint64), geoindex.RPSetUnion}
+	expected := map[inverted.IndexKind]string{
+		inverted.UnknownIndexKind: `span expression
+ ├── tight: false, unique: false
+ ├── to read
+ │    ├── ["B\xfd\x14\x00\x00\x00\x00\x00\x00\x00", "B\xfd\x14\x00\x00\x00\x00\x00\x00\x00"]
+ │    └── ["B\xfd\xff\xff\xff\xff\xff\xff\xff\xff", "B\xfd\xff\xff\xff\xff\xff\xff\xff\xff"]
+ ├── union spans
+ │    ├── ["B\xfd\x14\x00\x00\x00\x00\x00\x00\x00", "B\xfd\x14\x00\x00\x00\x00\x00\x00\x00"]
+ │    └── ["B\xfd\xff\xff\xff\xff\xff\xff\xff\xff", "B\xfd\xff\xff\xff\xff\xff\xff\xff\xff"]
+ └── stats: nodes: 1, depth: 1, spans: 2 (points: 2, ranges: 0), spans per node: [2, 2]
+`,
+		inverted.GeometryIndexKind: `span expression
+ ├── index kind: geometry
+ ├── tight: false, unique: false
+ ├── to read
+ │    ├── [quadtree(level=1, path=2), quadtree(level=1, path=2)]
+ │    └── [exceeds-bounds, exceeds-bounds]
+ ├── union spans
+ │    ├── [quadtree(level=1, path=2), quadtree(level=1, path=2)]
+ │    └── [exceeds-bounds, exceeds-bounds]
+ └── stats: nodes: 1, depth: 1, spans: 2 (points: 2, ranges: 0), spans per node: [2, 2]
+`,
+		inverted.GeographyIndexKind: `span expression
+ ├── index kind: geography
+ ├── tight: false, unique: false
+ ├── to read
+ │    ├── [cell(face=0, level=1, pos=2), cell(face=0, level=1, pos=2)]
+ │    └── [key(18446744073709551615), key(18446744073709551615)]
+ ├── union spans
+ │    ├── [cell(face=0, level=1, pos=2), cell(face=0, level=1, pos=2)]
+ │    └── [key(18446744073709551615), key(18446744073709551615)]
+ └── stats: nodes: 1, depth: 1, spans: 2 (points: 2, ranges: 0), spans per node: [2, 2]
+`,
+	}
+	for _, kind := range []inverted.IndexKind{
+		inverted.UnknownIndexKind, inverted.GeometryIndexKind, inverted.GeographyIndexKind,
+	} {
+		opts := ConvertOptions{IndexKind: kind}
+		expr, err := GeoUnionKeySpansToSpanExprWithOptions(ctx, uks, nil /* prefixKey */, opts)
+		require.NoError(t, err)
+		require.Equal(t, kind, expr.(*inverted.SpanExpression).IndexKind)
+		var c GeoSpanExprConverter
+		rpExpr, err := c.RPKeyExprToSpanExprWithOptions(ctx, rpx, nil /* prefixKey */, opts)
+		require.NoError(t, err)
+		require.Equal(t, kind, rpExpr.(*inverted.SpanExpression).IndexKind)
+		require.Equal(t, expected[kind], rpExpr.(*inverted.SpanExpression).String())
+
+		// The empty expressions record the kind too, so that they differ from
+		// the empty expressions of other kinds.
+		empty, err := GeoUnionKeySpansToSpanExprWithOptions(ctx, nil, nil /* prefixKey */, opts)
+		require.NoError(t, err)
+		require.Equal(t, kind, empty.(*inverted.SpanExpression).IndexKind)
+		require.Equal(t, kind != inverted.UnknownIndexKind,
+			Diff(empty.(*inverted.SpanExpression), inverted.EmptySpanExpression()) != "")
+	}
+
+	// Ordering the spans by width interprets the keys as cells, so it
+	// requires the kind of the index.
+	opts := ConvertOptions{OrderSpansByWidth: true}
+	_, err := GeoUnionKeySpansToSpanExprWithOptions(ctx, uks, nil /* prefixKey */, opts)
+	require.True(t, errors.Is(err, ErrIndexKindRequired), "%v", err)
+	_, err = GeoRPKeyExprToSpanExprWithOptions(ctx, rpx, nil /* prefixKey */, opts)
+	require.True(t, errors.Is(err, ErrIndexKindRequired), "%v", err)
+	opts.IndexKind = inverted.GeometryIndexKind
+	_, err = GeoRPKeyExprToSpanExprWithOptions(ctx, rpx, nil /* prefixKey */, opts)
+	require.NoError(t, err)
+}
@@ -0,0 +1,147 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package invertedexpr
+
+import (
+	"encoding/binary"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/inverted"
+)
+
+// Intern deduplicates the identical subtrees of the given SpanExpression, in
+// place, and returns it. Every subtree that is identical to a subtree visited
+// before it is replaced by a pointer to that subtree, so that it is stored
+// once. This is the case, for instance, for the subtrees of the filters on
+// the same column of shapes that overlap, which have the same covering cells.
+//
+// Two subtrees are identical if their roots have the same Tight, Unique,
+// Unconstrained, UnsortedFactoredUnionSpans, PartialSpansToRead, Flattened,
+// IndexKind and Ordering fields, the same SpansToRead, FactoredUnionSpans,
+// Operator, K and Operands, compared byte-wise and in order, and identical
+// children, in either order for unions and intersections. Subtrees with
+// children that are not SpanExpressions are not deduplicated.
+//
+// The nodes of the returned expression may be shared by several parents, so
+// it must not be modified in place, e.g. by And, Or or Simplify. MemUsage
+// counts the shared nodes once, and Evaluate evaluates them once.
+func Intern(expr *inverted.SpanExpression) *inverted.SpanExpression {
+	if expr == nil {
+		return nil
+	}
+	in := interner{
+		ids:   make(map[*inverted.SpanExpression]uint64),
+		nodes: make(map[string]*inverted.SpanExpression),
+	}
+	in.intern(expr)
+	if in.replaced {
+		expr.InvalidateCaches()
+	}
+	return expr
+}
+
+// interner implements Intern by hash consing: each distinct subtree is
+// identified by a key that encodes its root and the ids of its children.
+type interner struct {
+	// ids are the ids of the visited nodes. Nodes that are replaced by an
+	// identical node have the id of that node.
+	ids map[*inverted.SpanExpression]uint64
+	// nodes are the distinct nodes, by key.
+	nodes map[string]*inverted.SpanExpression
+	// buf is used to build the keys of the nodes.
+	buf []byte
+	// replaced is true if any subtree was replaced.
+	replaced bool
+}
+
+// intern deduplicates the subtrees of expr, and returns the node that expr is
+// to be replaced by, which is expr itself unless an identical subtree was
+// visited before.
+func (in *interner) intern(expr *inverted.SpanExpression) *inverted.SpanExpression {
+	if _, ok := in.ids[expr]; ok {
+		// The node is already shared.
+		return expr
+	}
+	left, leftOk := expr.Left.(*inverted.SpanExpression)
+	right, rightOk := expr.Right.(*inverted.SpanExpression)
+	if leftOk {
+		if c := in.intern(left); c != left {
+			expr.Left, left, in.replaced = c, c, true
+		}
+	}
+	if rightOk {
+		if c := in.intern(right); c != right {
+			expr.Right, right, in.replaced = c, c, true
+		}
+	}
+	if (expr.Left != nil && !leftOk) || (expr.Right != nil && !rightOk) {
+		// The node has children that are not SpanExpressions, so it is only
+		// identical to itself.
+		in.ids[expr] = uint64(len(in.ids)) + 1<<63
+		return expr
+	}
+	key := in.key(expr, left, right)
+	if c, ok := in.nodes[key]; ok {
+		in.ids[expr] = in.ids[c]
+		return c
+	}
+	in.nodes[key] = expr
+	in.ids[expr] = uint64(len(in.nodes))
+	return expr
+}
+
+// key returns the key that identifies the subtree rooted at expr, whose
+// children, if any, are left and right and have been interned.
+func (in *interner) key(expr, left, right *inverted.SpanExpression) string {
+	b := in.buf[:0]
+	var flags byte
+	for i, f := range []bool{
+		expr.Tight, expr.Unique, expr.Unconstrained, expr.UnsortedFactoredUnionSpans,
+		expr.PartialSpansToRead, expr.Flattened,
+	} {
+		if f {
+			flags |= 1 << i
+		}
+	}
+	b = append(b, byte(expr.Operator), flags, byte(expr.IndexKind), byte(expr.Ordering))
+	b = binary.AppendUvarint(b, uint64(expr.K))
+	b = appendSpansKey(b, expr.MaterializeSpansToRead())
+	b = appendSpansKey(b, expr.FactoredUnionSpans)
+	b = binary.AppendUvarint(b, uint64(len(expr.Operands)))
+	for _, operand := range expr.Operands {
+		b = appendSpansKey(b, operand)
+	}
+	if expr.Operator == inverted.SetUnion || expr.Operator == inverted.SetIntersection {
+		// Unions and intersections are commutative, so their children are
+		// ordered by id.
+		leftID, rightID := in.ids[left], in.ids[right]
+		b = binary.AppendUvarint(b, min(leftID, rightID))
+		b = binary.AppendUvarint(b, max(leftID, rightID))
+	}
+	in.buf = b
+	return string(b)
+}
+
+// appendSpansKey appends an unambiguous encoding of spans to b. The end key of
+// a point span is encoded differently from an empty end key.
+func appendSpansKey(b []byte, spans inverted.Spans) []byte {
+	b = binary.AppendUvarint(b, uint64(len(spans)))
+	for _, span := range spans {
+		b = binary.AppendUvarint(b, uint64(len(span.Start)))
+		b = append(b, span.Start...)
+		if span.IsPoint() {
+			b = append(b, 0)
+			continue
+		}
+		b = binary.AppendUvarint(b, uint64(len(span.End))+1)
+		b = append(b, span.End...)
+	}
+	return b
+}
@@ -0,0 +1,167 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package invertedexpr
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/geo/geoindex"
+	"github.com/cockroachdb/cockroach/pkg/sql/inverted"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/invertedexpr/invertedexprtestutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/randutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIntern(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	span := func(start, end string) inverted.Span {
+		return inverted.Span{Start: inverted.EncVal(start), End: inverted.EncVal(end)}
+	}
+	leaf := func(spans ...inverted.Span) *inverted.SpanExpression {
+		return &inverted.SpanExpression{SpansToRead: spans, FactoredUnionSpans: spans}
+	}
+	node := func(
+		op inverted.SetOperator, left, right *inverted.SpanExpression,
+	) *inverted.SpanExpression {
+		return &inverted.SpanExpression{
+			SpansToRead: inverted.Spans{span("a", "z")}, Operator: op, Left: left, Right: right,
+		}
+	}
+
+	// (([a, b) ∩ [c, d)) ∪ ([c, d) ∩ [a, b))) ∩ (([a, b) ∩ [c, d)) ∪ [e, f))
+	intersection := func() *inverted.SpanExpression {
+		return node(inverted.SetIntersection, leaf(span("a", "b")), leaf(span("c", "d")))
+	}
+	swapped := node(inverted.SetIntersection, leaf(span("c", "d")), leaf(span("a", "b")))
+	left := node(inverted.SetUnion, intersection(), swapped)
+	right := node(inverted.SetUnion, intersection(), leaf(span("e", "f")))
+	expr := node(inverted.SetIntersection, left, right)
+	original := expr.Copy().(*inverted.SpanExpression)
+
+	require.Same(t, expr, Intern(expr))
+	require.Equal(t, original.SpansToRead, expr.SpansToRead)
+	require.Less(t, expr.MemUsage(), original.MemUsage())
+	// Both children of left, and the left child of right, are the same
+	// intersection, since intersections are commutative.
+	require.Same(t, left.Left, left.Right)
+	require.Same(t, left.Left, right.Left)
+	// The identical leaves of the different intersections were deduplicated
+	// before the intersections, and the remaining leaf is distinct.
+	shared := left.Left.(*inverted.SpanExpression)
+	require.NotSame(t, shared.Left, shared.Right)
+	require.NotSame(t, shared.Left, right.Right)
+	require.NotSame(t, shared.Right, right.Right)
+	for _, keys := range [][]string{nil, {"a"}, {"a", "c"}, {"e"}, {"a", "c", "e"}} {
+		var encKeys []inverted.EncVal
+		for _, k := range keys {
+			encKeys = append(encKeys, inverted.EncVal(k))
+		}
+		require.Equal(t, Evaluate(original, encKeys), Evaluate(expr, encKeys), "keys %v", keys)
+	}
+
+	// Interning an interned expression does not change it.
+	memUsage := expr.MemUsage()
+	Intern(expr)
+	require.Equal(t, memUsage, expr.MemUsage())
+	require.Nil(t, Intern(nil))
+
+	// Deferred SpansToRead are compared as if they were materialized.
+	deferred := leaf(span("a", "b"))
+	deferred.DeferSpansToRead()
+	expr = node(inverted.SetIntersection, leaf(span("a", "b")), deferred)
+	Intern(expr)
+	require.Same(t, expr.Left, expr.Right)
+}
+
+func TestInternRandom(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	rng, _ := randutil.NewTestRand()
+	for i := 0; i < 200; i++ {
+		// Few distinct keys, so that the subexpressions are often duplicated.
+		rpx := invertedexprtestutils.RandomRPKeyExprWithSkew(
+			rng, 1+rng.Intn(20), 1+rng.Intn(6),
+			invertedexprtestutils.Skew{Contiguous: 0.25, Duplicate: 0.75, Nested: 0.9},
+		)
+		var maxKey geoindex.Key
+		for _, elem := range rpx {
+			if k, ok := elem.(geoindex.Key); ok && k >= maxKey {
+				maxKey = k + 1
+			}
+		}
+		expr := unoptimizedRPKeyExprToSpanExpr(rpx)
+		memUsage := expr.MemUsage()
+		interned := Intern(expr.Copy().(*inverted.SpanExpression))
+		require.LessOrEqual(t, interned.MemUsage(), memUsage, "%s", rpx)
+		require.NoError(t, checkEvaluate(interned, maxKey, func(keys map[geoindex.Key]struct{}) bool {
+			return evalRPKeyExpr(rpx, keys)
+		}), "%s", rpx)
+	}
+}
+
+// duplicatedSpanExpr returns a balanced SpanExpression of the given depth whose
+// leaves are the points of 8 distinct keys, in order. Unions and intersections
+// alternate at each level, so all the subtrees of depth 3 or more at the same
+// level are identical.
+func duplicatedSpanExpr(depth int, i int) *inverted.SpanExpression {
+	if depth == 0 {
+		key := inverted.EncVal{byte('a' + i%8)}
+		spans := inverted.Spans{{Start: key, End: key}}
+		return &inverted.SpanExpression{
+			Tight: true, Unique: true, SpansToRead: spans, FactoredUnionSpans: spans,
+		}
+	}
+	op := inverted.SetUnion
+	if depth%2 == 0 {
+		op = inverted.SetIntersection
+	}
+	return &inverted.SpanExpression{
+		Tight:       true,
+		SpansToRead: inverted.Spans{{Start: inverted.EncVal("a"), End: inverted.EncVal("i")}},
+		Operator:    op,
+		Left:        duplicatedSpanExpr(depth-1, 2*i),
+		Right:       duplicatedSpanExpr(depth-1, 2*i+1),
+	}
+}
+
+func BenchmarkIntern(b *testing.B) {
+	const depth = 12
+	rows := [][]inverted.EncVal{
+		{inverted.EncVal("a"), inverted.EncVal("c"), inverted.EncVal("e"), inverted.EncVal("g")},
+		{inverted.EncVal("b"), inverted.EncVal("d"), inverted.EncVal("f"), inverted.EncVal("h")},
+		{inverted.EncVal("a"), inverted.EncVal("h")},
+	}
+	original := duplicatedSpanExpr(depth, 0)
+	interned := Intern(duplicatedSpanExpr(depth, 0))
+	b.Logf("memory usage: original %d bytes, interned %d bytes",
+		original.MemUsage(), interned.MemUsage())
+	for _, tc := range []struct {
+		name string
+		expr *inverted.SpanExpression
+	}{{"original", original}, {"interned", interned}} {
+		b.Run(fmt.Sprintf("evaluate/%s", tc.name), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				Evaluate(tc.expr, rows[i%len(rows)])
+			}
+		})
+	}
+	b.Run("intern", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			expr := original.Copy().(*inverted.SpanExpression)
+			b.StartTimer()
+			Intern(expr)
+		}
+	})
+}
@@ -0,0 +1,245 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+// Package invertedexprtestutils provides random geospatial index keys for
+// testing their conversion to inverted.SpanExpressions, and shrinkers that
+// minimize the inputs on which a test fails.
+package invertedexprtestutils
+
+import (
+	"math/rand"
+
+	"github.com/cockroachdb/cockroach/pkg/geo/geoindex"
+)
+
+// Skew controls the shape of the random inputs. Each field is a probability
+// in [0, 1].
+type Skew struct {
+	// Contiguous is the probability that a span of a UnionKeySpans starts
+	// right after the end of the previous span, or that a key of an RPKeyExpr
+	// is the successor of the previous key.
+	Contiguous float64
+	// Duplicate is the probability that a key of an RPKeyExpr repeats one of
+	// the previous keys.
+	Duplicate float64
+	// Nested is the probability that a subexpression of an RPKeyExpr that is
+	// above the maximum depth combines two nested subexpressions, rather than
+	// being a chain of unions of keys.
+	Nested float64
+}
+
+// DefaultSkew is the Skew used by RandomUnionKeySpans and RandomRPKeyExpr.
+var DefaultSkew = Skew{Contiguous: 0.25, Duplicate: 0.25, Nested: 0.75}
+
+// maxSpanGap and maxSpanLen bound the gap between consecutive spans generated
+// by RandomUnionKeySpansWithSkew, and the number of keys of a span.
+const (
+	maxSpanGap = 4
+	maxSpanLen = 4
+)
+
+// RandomUnionKeySpans returns n random sorted and non-overlapping spans, using
+// DefaultSkew.
+func RandomUnionKeySpans(rng *rand.Rand, n int) geoindex.UnionKeySpans {
+	return RandomUnionKeySpansWithSkew(rng, n, DefaultSkew)
+}
+
+// RandomUnionKeySpansWithSkew returns n random sorted and non-overlapping
+// spans. The spans are over a small key space, starting at 0, so that their
+// keys can be enumerated by tests.
+func RandomUnionKeySpansWithSkew(rng *rand.Rand, n int, skew Skew) geoindex.UnionKeySpans {
+	spans := make(geoindex.UnionKeySpans, 0, n)
+	// next is the smallest key that follows the previous span.
+	var next geoindex.Key
+	for i := 0; i < n; i++ {
+		start := next
+		if i == 0 {
+			start += geoindex.Key(rng.Intn(maxSpanGap))
+		} else if rng.Float64() >= skew.Contiguous {
+			start += geoindex.Key(1 + rng.Intn(maxSpanGap))
+		}
+		end := start + geoindex.Key(rng.Intn(maxSpanLen))
+		spans = append(spans, geoindex.KeySpan{Start: start, End: end})
+		next = end + 1
+	}
+	return spans
+}
+
+// RandomRPKeyExpr returns a random well-formed RPKeyExpr with nKeys keys and
+// at most maxDepth nested operators, using DefaultSkew.
+func RandomRPKeyExpr(rng *rand.Rand, nKeys int, maxDepth int) geoindex.RPKeyExpr {
+	return RandomRPKeyExprWithSkew(rng, nKeys, maxDepth, DefaultSkew)
+}
+
+// RandomRPKeyExprWithSkew returns a random well-formed RPKeyExpr with nKeys
+// keys in [0, 3*nKeys). Operators are nested at most maxDepth levels deep;
+// below that, the remaining keys are combined by a chain of unions, which is
+// converted to a single SpanExpression.
+func RandomRPKeyExprWithSkew(
+	rng *rand.Rand, nKeys int, maxDepth int, skew Skew,
+) geoindex.RPKeyExpr {
+	g := rpKeyExprGenerator{
+		rng:    rng,
+		skew:   skew,
+		maxKey: 2 * nKeys,
+		rpx:    make(geoindex.RPKeyExpr, 0, 2*nKeys-1),
+	}
+	g.generate(nKeys, maxDepth)
+	return g.rpx
+}
+
+type rpKeyExprGenerator struct {
+	rng    *rand.Rand
+	skew   Skew
+	maxKey int
+	// keys are the keys generated so far, in order.
+	keys []geoindex.Key
+	rpx  geoindex.RPKeyExpr
+}
+
+func (g *rpKeyExprGenerator) generate(nKeys int, depth int) {
+	if nKeys > 1 && depth > 0 && g.rng.Float64() < g.skew.Nested {
+		n := 1 + g.rng.Intn(nKeys-1)
+		g.generate(n, depth-1)
+		g.generate(nKeys-n, depth-1)
+		if g.rng.Intn(2) == 0 {
+			g.rpx = append(g.rpx, geoindex.RPSetUnion)
+		} else {
+			g.rpx = append(g.rpx, geoindex.RPSetIntersection)
+		}
+		return
+	}
+	g.appendKey()
+	for i := 1; i < nKeys; i++ {
+		g.appendKey()
+		g.rpx = append(g.rpx, geoindex.RPSetUnion)
+	}
+}
+
+func (g *rpKeyExprGenerator) appendKey() {
+	var k geoindex.Key
+	switch r := g.rng.Float64(); {
+	case len(g.keys) > 0 && r < g.skew.Duplicate:
+		k = g.keys[g.rng.Intn(len(g.keys))]
+	case len(g.keys) > 0 && r < g.skew.Duplicate+g.skew.Contiguous:
+		// Since there are fewer contiguous keys than keys, the key is less
+		// than 3*nKeys.
+		k = g.keys[len(g.keys)-1] + 1
+	default:
+		k = geoindex.Key(g.rng.Intn(g.maxKey))
+	}
+	g.keys = append(g.keys, k)
+	g.rpx = append(g.rpx, k)
+}
+
+// ShrinkRPKeyExpr returns a minimal RPKeyExpr on which fails returns true,
+// derived from rpx, on which fails must return true. It repeatedly replaces an
+// operator and its operands by one of the operands, or a key by a smaller key,
+// as long as fails returns true on the result, so the returned expression is
+// well-formed if rpx is.
+func ShrinkRPKeyExpr(
+	rpx geoindex.RPKeyExpr, fails func(geoindex.RPKeyExpr) bool,
+) geoindex.RPKeyExpr {
+	for {
+		shrunk := false
+		for _, c := range shrinkRPKeyExprCandidates(rpx) {
+			if fails(c) {
+				rpx, shrunk = c, true
+				break
+			}
+		}
+		if !shrunk {
+			return rpx
+		}
+	}
+}
+
+// shrinkRPKeyExprCandidates returns the expressions derived from rpx by
+// replacing one operator by one of its operands, the largest replacements
+// first, followed by those derived by replacing one key by a smaller key.
+func shrinkRPKeyExprCandidates(rpx geoindex.RPKeyExpr) []geoindex.RPKeyExpr {
+	// starts[i] is the index of the first element of the subexpression whose
+	// root is rpx[i].
+	starts := make([]int, len(rpx))
+	for i, elem := range rpx {
+		if _, ok := elem.(geoindex.RPSetOperator); ok {
+			// The right operand is rooted at i-1, and the left operand right
+			// before the start of the right operand.
+			starts[i] = starts[starts[i-1]-1]
+		} else {
+			starts[i] = i
+		}
+	}
+	var candidates []geoindex.RPKeyExpr
+	replace := func(start, end int, operand geoindex.RPKeyExpr) {
+		c := make(geoindex.RPKeyExpr, 0, len(rpx)-(end-start)+len(operand))
+		c = append(c, rpx[:start]...)
+		c = append(c, operand...)
+		candidates = append(candidates, append(c, rpx[end:]...))
+	}
+	for i := len(rpx) - 1; i >= 0; i-- {
+		if _, ok := rpx[i].(geoindex.RPSetOperator); ok {
+			rightStart, leftStart := starts[i-1], starts[i]
+			replace(leftStart, i+1, rpx[leftStart:rightStart])
+			replace(leftStart, i+1, rpx[rightStart:i])
+		}
+	}
+	for i, elem := range rpx {
+		if k, ok := elem.(geoindex.Key); ok && k > 0 {
+			replace(i, i+1, geoindex.RPKeyExpr{geoindex.Key(0)})
+			if k > 1 {
+				replace(i, i+1, geoindex.RPKeyExpr{k / 2})
+			}
+		}
+	}
+	return candidates
+}
+
+// ShrinkUnionKeySpans returns a minimal UnionKeySpans on which fails returns
+// true, derived from spans, on which fails must return true. It repeatedly
+// removes a span, or replaces a span by its first key, as long as fails
+// returns true on the result, so the returned spans are sorted and
+// non-overlapping if spans are.
+func ShrinkUnionKeySpans(
+	spans geoindex.UnionKeySpans, fails func(geoindex.UnionKeySpans) bool,
+) geoindex.UnionKeySpans {
+	for {
+		shrunk := false
+		for _, c := range shrinkUnionKeySpansCandidates(spans) {
+			if fails(c) {
+				spans, shrunk = c, true
+				break
+			}
+		}
+		if !shrunk {
+			return spans
+		}
+	}
+}
+
+// shrinkUnionKeySpansCandidates returns the spans derived from spans by
+// removing one span, followed by those derived by replacing one span by its
+// first key.
+func shrinkUnionKeySpansCandidates(spans geoindex.UnionKeySpans) []geoindex.UnionKeySpans {
+	var candidates []geoindex.UnionKeySpans
+	for i := range spans {
+		c := make(geoindex.UnionKeySpans, 0, len(spans)-1)
+		c = append(c, spans[:i]...)
+		candidates = append(candidates, append(c, spans[i+1:]...))
+	}
+	for i, span := range spans {
+		if span.End > span.Start {
+			c := append(geoindex.UnionKeySpans(nil), spans...)
+			c[i].End = c[i].Start
+			candidates = append(candidates, c)
+		}
+	}
+	return candidates
+}
@@ -0,0 +1,165 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package invertedexprtestutils
+
+import (
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/geo/geoindex"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/randutil"
+	"github.com/stretchr/testify/require"
+)
+
+// rpKeyExprDepth returns the number of keys of rpx, and the nesting depth of
+// its operators, not counting the unions of chains of unions of keys. It
+// fails the test if rpx is not well-formed.
+func rpKeyExprDepth(t *testing.T, rpx geoindex.RPKeyExpr) (numKeys int, depth int) {
+	type subexpr struct {
+		depth int
+		// chain is true if the subexpression is a key or a chain of unions of
+		// keys.
+		chain bool
+	}
+	var stack []subexpr
+	for _, elem := range rpx {
+		switch e := elem.(type) {
+		case geoindex.Key:
+			numKeys++
+			stack = append(stack, subexpr{chain: true})
+		case geoindex.RPSetOperator:
+			require.GreaterOrEqual(t, len(stack), 2, "%v", rpx)
+			left, right := stack[len(stack)-2], stack[len(stack)-1]
+			stack = stack[:len(stack)-2]
+			if e == geoindex.RPSetUnion && left.chain && right.chain {
+				stack = append(stack, subexpr{chain: true})
+				continue
+			}
+			d := left.depth
+			if right.depth > d {
+				d = right.depth
+			}
+			stack = append(stack, subexpr{depth: d + 1})
+		}
+	}
+	require.Len(t, stack, 1, "%v", rpx)
+	return numKeys, stack[0].depth
+}
+
+func TestRandomRPKeyExpr(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	rng, _ := randutil.NewTestRand()
+	skews := []Skew{
+		DefaultSkew,
+		{},
+		{Contiguous: 1},
+		{Duplicate: 1},
+		{Nested: 1},
+	}
+	for _, skew := range skews {
+		for i := 0; i < 100; i++ {
+			nKeys, maxDepth := 1+rng.Intn(20), rng.Intn(6)
+			rpx := RandomRPKeyExprWithSkew(rng, nKeys, maxDepth, skew)
+			numKeys, depth := rpKeyExprDepth(t, rpx)
+			require.Equal(t, nKeys, numKeys, "%v", rpx)
+			require.LessOrEqual(t, depth, maxDepth, "%v", rpx)
+			var prev geoindex.Key
+			for j, elem := range rpx {
+				k, ok := elem.(geoindex.Key)
+				if !ok {
+					continue
+				}
+				require.Less(t, int(k), 3*nKeys, "%v", rpx)
+				if j > 0 && skew.Contiguous == 1 {
+					require.Equal(t, prev+1, k, "%v", rpx)
+				}
+				prev = k
+			}
+		}
+	}
+	// Without nesting, the keys are combined by a chain of unions.
+	rpx := RandomRPKeyExprWithSkew(rng, 3, 5 /* maxDepth */, Skew{Contiguous: 1})
+	require.Len(t, rpx, 5)
+	require.Equal(t, geoindex.RPSetUnion, rpx[2])
+	require.Equal(t, geoindex.RPSetUnion, rpx[4])
+}
+
+func TestRandomUnionKeySpans(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	rng, _ := randutil.NewTestRand()
+	for _, skew := range []Skew{DefaultSkew, {}, {Contiguous: 1}} {
+		for i := 0; i < 100; i++ {
+			n := rng.Intn(20)
+			spans := RandomUnionKeySpansWithSkew(rng, n, skew)
+			require.Len(t, spans, n)
+			for j, span := range spans {
+				require.LessOrEqual(t, span.Start, span.End, "%v", spans)
+				if j == 0 {
+					continue
+				}
+				if skew.Contiguous == 1 {
+					require.Equal(t, spans[j-1].End+1, span.Start, "%v", spans)
+				} else {
+					require.Less(t, spans[j-1].End, span.Start, "%v", spans)
+				}
+			}
+		}
+	}
+}
+
+func TestShrinkRPKeyExpr(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	rng, _ := randutil.NewTestRand()
+	// hasIntersection fails on the expressions that contain an intersection.
+	hasIntersection := func(rpx geoindex.RPKeyExpr) bool {
+		for _, elem := range rpx {
+			if elem == geoindex.RPSetIntersection {
+				return true
+			}
+		}
+		return false
+	}
+	for i := 0; i < 100; i++ {
+		rpx := RandomRPKeyExprWithSkew(rng, 2+rng.Intn(20), 5 /* maxDepth */, Skew{Nested: 1})
+		if !hasIntersection(rpx) {
+			continue
+		}
+		require.Equal(t,
+			geoindex.RPKeyExpr{geoindex.Key(0), geoindex.Key(0), geoindex.RPSetIntersection},
+			ShrinkRPKeyExpr(rpx, hasIntersection))
+	}
+
+	// An expression on which the test does not fail after shrinking is not
+	// modified.
+	rpx := geoindex.RPKeyExpr{geoindex.Key(3), geoindex.Key(5), geoindex.RPSetUnion}
+	require.Equal(t, rpx, ShrinkRPKeyExpr(rpx, func(x geoindex.RPKeyExpr) bool {
+		return len(x) == 3 && x[0] == geoindex.Key(3) && x[1] == geoindex.Key(5)
+	}))
+}
+
+func TestShrinkUnionKeySpans(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	rng, _ := randutil.NewTestRand()
+	for i := 0; i < 100; i++ {
+		spans := RandomUnionKeySpans(rng, 2+rng.Intn(20))
+		shrunk := ShrinkUnionKeySpans(spans, func(s geoindex.UnionKeySpans) bool {
+			return len(s) >= 2
+		})
+		require.Len(t, shrunk, 2)
+		require.Equal(t, shrunk[0].Start, shrunk[0].End)
+		require.Equal(t, shrunk[1].Start, shrunk[1].End)
+		require.Less(t, shrunk[0].End, shrunk[1].Start)
+	}
+}
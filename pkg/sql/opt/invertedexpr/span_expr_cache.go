@@ -0,0 +1,115 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package invertedexpr
+
+import (
+	"unsafe"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/inverted"
+	"github.com/cockroachdb/cockroach/pkg/util/cache"
+)
+
+// SpanExprCache is an LRU cache of SpanExpressions, keyed by a key provided by
+// the caller that identifies the input of their conversion, such as a hash of
+// the EWKB of a shape. It is intended for inverted joins, which convert the
+// shape of every lookup row to a SpanExpression, even if many rows have the
+// same shape.
+//
+// The cached SpanExpressions are detached, and are shared by all the callers
+// that get them from the cache, so they must not be modified. The memory used
+// by the cache, including the MemUsage of the SpanExpressions, is bounded by
+// the budget passed to NewSpanExprCache, and the least recently used
+// expressions are evicted when the budget is exceeded.
+//
+// SpanExprCache is not safe for concurrent use.
+type SpanExprCache struct {
+	maxBytes int64
+	// bytes is the memory used by the entries of the cache.
+	bytes int64
+	cache *cache.UnorderedCache
+	// hits and misses are the number of calls to Get that found and did not
+	// find an expression, respectively.
+	hits, misses int64
+}
+
+// spanExprCacheEntryOverhead is the memory used by an entry of the cache, in
+// addition to its key and SpanExpression.
+const spanExprCacheEntryOverhead = int64(unsafe.Sizeof(cache.Entry{}))
+
+// NewSpanExprCache returns a new SpanExprCache that uses at most maxBytes of
+// memory.
+func NewSpanExprCache(maxBytes int64) *SpanExprCache {
+	c := &SpanExprCache{maxBytes: maxBytes}
+	c.cache = cache.NewUnorderedCache(cache.Config{
+		Policy: cache.CacheLRU,
+		ShouldEvict: func(_ int, _, _ interface{}) bool {
+			return c.bytes > c.maxBytes
+		},
+		OnEvicted: func(key, value interface{}) {
+			c.bytes -= spanExprCacheEntrySize(key.(string), value.(*inverted.SpanExpression))
+		},
+	})
+	return c
+}
+
+// spanExprCacheEntrySize returns the memory used by the entry of the cache for
+// the given key and SpanExpression.
+func spanExprCacheEntrySize(key string, expr *inverted.SpanExpression) int64 {
+	return spanExprCacheEntryOverhead + int64(len(key)) + expr.MemUsage()
+}
+
+// Get returns the SpanExpression cached for the given key, and true, or false
+// if there is none. The returned expression must not be modified.
+func (c *SpanExprCache) Get(key string) (*inverted.SpanExpression, bool) {
+	v, ok := c.cache.Get(key)
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	return v.(*inverted.SpanExpression), true
+}
+
+// Add caches a detached copy of expr for the given key, replacing the
+// expression cached for the key, if any, and returns the copy, which must not
+// be modified. expr itself is not retained, so it can share memory that is
+// reused, such as an expression returned by a GeoSpanExprConverter. The copy
+// is not cached if it alone exceeds the budget of the cache.
+func (c *SpanExprCache) Add(key string, expr *inverted.SpanExpression) *inverted.SpanExpression {
+	expr = expr.Detach()
+	// The entry of the key, if any, is replaced by the cache without calling
+	// OnEvicted, so it is deleted first to update the memory used.
+	c.cache.Del(key)
+	c.bytes += spanExprCacheEntrySize(key, expr)
+	c.cache.Add(key, expr)
+	return expr
+}
+
+// Hits returns the number of calls to Get that found a SpanExpression.
+func (c *SpanExprCache) Hits() int64 {
+	return c.hits
+}
+
+// Misses returns the number of calls to Get that did not find a
+// SpanExpression.
+func (c *SpanExprCache) Misses() int64 {
+	return c.misses
+}
+
+// Len returns the number of cached SpanExpressions.
+func (c *SpanExprCache) Len() int {
+	return c.cache.Len()
+}
+
+// Bytes returns the memory used by the cache.
+func (c *SpanExprCache) Bytes() int64 {
+	return c.bytes
+}
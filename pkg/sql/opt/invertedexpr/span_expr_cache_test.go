@@ -0,0 +1,109 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package invertedexpr
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/geo/geoindex"
+	"github.com/cockroachdb/cockroach/pkg/sql/inverted"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpanExprCache(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	// intersect returns the intersection of the keys.
+	intersect := func(keys ...geoindex.Key) geoindex.RPKeyExpr {
+		rpx := geoindex.RPKeyExpr{keys[0]}
+		for _, k := range keys[1:] {
+			rpx = append(rpx, k, geoindex.RPSetIntersection)
+		}
+		return rpx
+	}
+	// The expressions are returned by a converter, which reuses their memory
+	// after Reset.
+	var conv GeoSpanExprConverter
+	convert := func(keys ...geoindex.Key) *inverted.SpanExpression {
+		conv.Reset()
+		expr, err := conv.RPKeyExprToSpanExpr(ctx, intersect(keys...))
+		require.NoError(t, err)
+		return expr.(*inverted.SpanExpression)
+	}
+	expected := func(keys ...geoindex.Key) string {
+		expr, err := GeoRPKeyExprToSpanExpr(ctx, intersect(keys...))
+		require.NoError(t, err)
+		return expr.(*inverted.SpanExpression).String()
+	}
+	entrySize := func(key string, keys ...geoindex.Key) int64 {
+		return spanExprCacheEntrySize(key, convert(keys...).Detach())
+	}
+
+	// The budget fits the expressions of a and b, but not also that of c.
+	sizeA, sizeB := entrySize("a", 1, 2), entrySize("b", 3, 4)
+	c := NewSpanExprCache(sizeA + sizeB)
+
+	_, ok := c.Get("a")
+	require.False(t, ok)
+	a := c.Add("a", convert(1, 2))
+	b := c.Add("b", convert(3, 4))
+	require.Equal(t, 2, c.Len())
+	require.Equal(t, sizeA+sizeB, c.Bytes())
+
+	// The cached expressions are not invalidated by the reuse of the memory of
+	// the converter, and are shared by the callers.
+	convert(5, 6)
+	got, ok := c.Get("a")
+	require.True(t, ok)
+	require.Same(t, a, got)
+	require.Equal(t, expected(1, 2), got.String())
+	got, ok = c.Get("b")
+	require.True(t, ok)
+	require.Same(t, b, got)
+	require.Equal(t, expected(3, 4), got.String())
+	require.Equal(t, int64(2), c.Hits())
+	require.Equal(t, int64(1), c.Misses())
+
+	// Adding c exceeds the budget, so the least recently used expression, a,
+	// is evicted.
+	c.Add("c", convert(5, 6))
+	require.Equal(t, 2, c.Len())
+	require.LessOrEqual(t, c.Bytes(), sizeA+sizeB)
+	_, ok = c.Get("a")
+	require.False(t, ok)
+	got, ok = c.Get("c")
+	require.True(t, ok)
+	require.Equal(t, expected(5, 6), got.String())
+	require.Equal(t, int64(3), c.Hits())
+	require.Equal(t, int64(2), c.Misses())
+
+	// Replacing the expression of a key updates the memory used.
+	bytes := c.Bytes()
+	c.Add("c", convert(7))
+	require.Equal(t, 2, c.Len())
+	require.Equal(t, bytes-entrySize("c", 5, 6)+entrySize("c", 7), c.Bytes())
+	got, ok = c.Get("c")
+	require.True(t, ok)
+	require.Equal(t, expected(7), got.String())
+
+	// An expression that exceeds the budget alone is not cached, and evicts
+	// all the others.
+	small := NewSpanExprCache(sizeA - 1)
+	small.Add("a", convert(1, 2))
+	require.Equal(t, 0, small.Len())
+	require.Equal(t, int64(0), small.Bytes())
+	c.Add("big", convert(1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12))
+	require.Equal(t, 0, c.Len())
+	require.Equal(t, int64(0), c.Bytes())
+}
@@ -0,0 +1,603 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package invertedexpr
+
+import (
+	"bytes"
+	"slices"
+	"sort"
+
+	"github.com/cockroachdb/cockroach/pkg/keysbase"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/sql/inverted"
+	"github.com/cockroachdb/cockroach/pkg/util/buildutil"
+)
+
+// This file contains functions to build SpanExpressions from spans of encoded
+// inverted keys, and to combine and simplify SpanExpressions built by the
+// converters in this package, such as GeoUnionKeySpansToSpanExpr and
+// GeoRPKeyExprToSpanExpr.
+
+// KeySpansToSpanExpr returns a SpanExpression that is the union of the given
+// spans of encoded inverted keys, or nil if there are no spans. The spans are
+// sorted, and overlapping and contiguous spans are coalesced, so they are
+// modified in place. The spans are used for both the SpansToRead and the
+// FactoredUnionSpans of the SpanExpression.
+//
+// KeySpansToSpanExpr is used by the geo converters in this package, and can be
+// used for any other inverted column.
+func KeySpansToSpanExpr(spans inverted.Spans) *inverted.SpanExpression {
+	if len(spans) == 0 {
+		return nil
+	}
+	sortSpans(spans)
+	return sortedKeySpansToSpanExpr(spans)
+}
+
+// sortedKeySpansToSpanExpr is like KeySpansToSpanExpr, but the spans must be
+// non-empty and sorted.
+func sortedKeySpansToSpanExpr(spans inverted.Spans) *inverted.SpanExpression {
+	spans = coalesceSortedSpans(spans)
+	expr := &inverted.SpanExpression{
+		SpansToRead:        spans,
+		FactoredUnionSpans: spans,
+	}
+	if buildutil.CrdbTestBuild {
+		if err := expr.CheckInvariants(); err != nil {
+			panic(err)
+		}
+	}
+	return expr
+}
+
+// EncodeInvertedSpans returns a span for each of the given encoded inverted
+// keys, that contains only that key.
+func EncodeInvertedSpans(keys [][]byte) inverted.Spans {
+	spans := make(inverted.Spans, len(keys))
+	for i, key := range keys {
+		spans[i] = inverted.MakeSingleValSpan(key)
+	}
+	return spans
+}
+
+// And returns the intersection of two SpanExpressions. A nil SpanExpression
+// represents the absence of a constraint, so it is the identity, and And
+// returns the other SpanExpression. An empty SpanExpression (see
+// inverted.EmptySpanExpression) matches no rows, so if either expression is
+// empty, And returns it. Like a nil SpanExpression, an unconstrained
+// SpanExpression (see inverted.UnconstrainedSpanExpression) is the identity,
+// but the other SpanExpression is then only tight if both are. The spans
+// common to the FactoredUnionSpans of both expressions are factored into the
+// FactoredUnionSpans of the intersection.
+//
+// And may modify both left and right, which must be fully constructed, i.e.
+// their FactoredUnionSpans must be sorted.
+func And(left, right *inverted.SpanExpression) *inverted.SpanExpression {
+	if left == nil {
+		return right
+	}
+	if right == nil {
+		return left
+	}
+	if left.IsEmpty() {
+		return left
+	}
+	if right.IsEmpty() {
+		return right
+	}
+	if left.Unconstrained {
+		left, right = right, left
+	}
+	if right.Unconstrained {
+		left.Tight = left.Tight && right.Tight
+		left.InvalidateCaches()
+		return left
+	}
+	// The FactoredUnionSpans of the children are modified in place below, and
+	// may share memory with their SpansToRead (see GeoUnionKeySpansToSpanExpr).
+	left.FactoredUnionSpans = append(inverted.Spans(nil), left.FactoredUnionSpans...)
+	right.FactoredUnionSpans = append(inverted.Spans(nil), right.FactoredUnionSpans...)
+	expr := &inverted.SpanExpression{
+		Tight:       left.Tight && right.Tight,
+		Unique:      left.Unique && right.Unique,
+		SpansToRead: mergeSpans(left.MaterializeSpansToRead(), right.MaterializeSpansToRead()),
+		Operator:    inverted.SetIntersection,
+		Left:        left,
+		Right:       right,
+	}
+	factorCommonSpans(expr)
+	left.InvalidateCaches()
+	right.InvalidateCaches()
+	return expr
+}
+
+// mergeSpans returns the union of the given spans, with overlapping and
+// contiguous spans merged. The result is sorted.
+func mergeSpans(left, right inverted.Spans) inverted.Spans {
+	spans := make(inverted.Spans, 0, len(left)+len(right))
+	spans = append(spans, left...)
+	spans = append(spans, right...)
+	return coalesceSpans(spans)
+}
+
+// coalesceSpans sorts the given spans in place, and merges overlapping and
+// contiguous spans.
+func coalesceSpans(spans inverted.Spans) inverted.Spans {
+	sortSpans(spans)
+	return coalesceSortedSpans(spans)
+}
+
+// coalesceSortedSpans is like coalesceSpans, but the spans must be sorted.
+func coalesceSortedSpans(spans inverted.Spans) inverted.Spans {
+	if len(spans) < 2 {
+		return spans
+	}
+	out := spans[:1]
+	for _, span := range spans[1:] {
+		last := &out[len(out)-1]
+		if last.CompareEnd(span.Start) < 0 {
+			out = append(out, span)
+			continue
+		}
+		if last.CompareEnds(span) < 0 {
+			last.SetEndFrom(span)
+		}
+	}
+	return out
+}
+
+// Or returns the union of two SpanExpressions. A nil SpanExpression is the
+// identity, and Or returns the other SpanExpression. Note that this treats a
+// nil SpanExpression as the empty set, unlike And, which treats it as the
+// absence of a constraint, so that in both cases it is the identity of the
+// operation. An empty SpanExpression is also the identity. An unconstrained
+// SpanExpression (see inverted.UnconstrainedSpanExpression) matches all rows,
+// so if either expression is unconstrained, Or returns it, and it is only
+// tight if both are.
+//
+// If one of the SpanExpressions has no children, its FactoredUnionSpans are
+// merged into the FactoredUnionSpans of the other, like the RPSetUnion case in
+// GeoRPKeyExprToSpanExpr. Otherwise, the SpanExpressions become the children
+// of a union.
+//
+// Or may modify both left and right, which must be fully constructed.
+func Or(left, right *inverted.SpanExpression) *inverted.SpanExpression {
+	if left == nil {
+		return right
+	}
+	if right == nil {
+		return left
+	}
+	if left.IsEmpty() {
+		return right
+	}
+	if right.IsEmpty() {
+		return left
+	}
+	if right.Unconstrained {
+		left, right = right, left
+	}
+	if left.Unconstrained {
+		left.Tight = left.Tight && right.Tight
+		left.InvalidateCaches()
+		return left
+	}
+	if left.Operator == inverted.None {
+		left, right = right, left
+	}
+	spansToRead := mergeSpans(left.MaterializeSpansToRead(), right.MaterializeSpansToRead())
+	if right.Operator == inverted.None {
+		// right can be discarded after unioning its FactoredUnionSpans.
+		left.Tight = left.Tight && right.Tight
+		left.Unique = false
+		left.SpansToRead = spansToRead
+		left.FactoredUnionSpans = mergeSpans(left.FactoredUnionSpans, right.FactoredUnionSpans)
+		left.InvalidateCaches()
+		return left
+	}
+	return &inverted.SpanExpression{
+		Tight:       left.Tight && right.Tight,
+		SpansToRead: spansToRead,
+		Operator:    inverted.SetUnion,
+		Left:        left,
+		Right:       right,
+	}
+}
+
+// Simplify removes degenerate nodes from the given SpanExpression, in place,
+// and returns it. It applies the following rules, where an empty node is one
+// without FactoredUnionSpans and without children:
+//   - a union with an empty child is replaced by the other child.
+//   - an intersection with an empty child is empty.
+//   - a union with an unconstrained child (see
+//     inverted.UnconstrainedSpanExpression) is unconstrained.
+//   - an intersection with an unconstrained child is replaced by the other
+//     child.
+//   - a union or intersection of identical children is replaced by one of
+//     the children.
+//   - spans in the FactoredUnionSpans of a node that are also in the
+//     FactoredUnionSpans of one of its ancestors are removed, since the
+//     ancestor already unions them.
+//
+// When a node is replaced by one of its children, the FactoredUnionSpans of
+// the node are merged into those of the child. The SpansToRead only shrink:
+// spans that no longer overlap any of the FactoredUnionSpans are removed.
+// Expressions whose Ordering is not inverted.OrderByKey are left as they are.
+func Simplify(expr *inverted.SpanExpression) *inverted.SpanExpression {
+	if expr == nil || expr.Ordering != inverted.OrderByKey {
+		return expr
+	}
+	simplifyNode(expr, nil /* ancestorSpans */)
+	var remaining inverted.Spans
+	collectFactoredSpans(expr, &remaining)
+	remaining = mergeSpans(remaining, nil)
+	spansToRead := make(inverted.Spans, 0, len(expr.MaterializeSpansToRead()))
+	for _, span := range expr.SpansToRead {
+		if overlapsSpans(remaining, span) {
+			spansToRead = append(spansToRead, span)
+		}
+	}
+	expr.SpansToRead = spansToRead
+	return expr
+}
+
+// simplifyNode applies the rules of Simplify to the subtree rooted at expr,
+// given the FactoredUnionSpans of its ancestors, sorted by cmpSpans.
+func simplifyNode(expr *inverted.SpanExpression, ancestorSpans inverted.Spans) {
+	defer expr.InvalidateCaches()
+	if len(ancestorSpans) > 0 {
+		// Do not modify FactoredUnionSpans in place, since it may share memory
+		// with SpansToRead.
+		var spans inverted.Spans
+		for _, span := range expr.FactoredUnionSpans {
+			if !containsExactSpan(ancestorSpans, span) {
+				spans = append(spans, span)
+			}
+		}
+		expr.FactoredUnionSpans = spans
+	}
+	if expr.Operator == inverted.None {
+		return
+	}
+	if len(expr.FactoredUnionSpans) > 0 {
+		childAncestorSpans := make(inverted.Spans, 0, len(ancestorSpans)+len(expr.FactoredUnionSpans))
+		childAncestorSpans = append(childAncestorSpans, ancestorSpans...)
+		childAncestorSpans = append(childAncestorSpans, expr.FactoredUnionSpans...)
+		slices.SortFunc(childAncestorSpans, cmpSpans)
+		ancestorSpans = childAncestorSpans
+	}
+	left, leftOk := expr.Left.(*inverted.SpanExpression)
+	right, rightOk := expr.Right.(*inverted.SpanExpression)
+	if leftOk {
+		simplifyNode(left, ancestorSpans)
+	}
+	if rightOk {
+		simplifyNode(right, ancestorSpans)
+	}
+	if !leftOk || !rightOk {
+		return
+	}
+	switch {
+	case expr.Operator == inverted.SetUnion && left.IsEmpty():
+		replaceWithChild(expr, right)
+	case expr.Operator == inverted.SetUnion && right.IsEmpty():
+		replaceWithChild(expr, left)
+	case expr.Operator == inverted.SetIntersection && (left.IsEmpty() || right.IsEmpty()):
+		expr.Operator = inverted.None
+		expr.Left = nil
+		expr.Right = nil
+	case expr.Operator == inverted.SetUnion && (left.Unconstrained || right.Unconstrained):
+		if right.Unconstrained {
+			left, right = right, left
+		}
+		// The spans of the unconstrained child cover those of expr.
+		replaceWithChild(expr, left)
+		expr.Unconstrained = true
+	case expr.Operator == inverted.SetIntersection && left.Unconstrained:
+		replaceWithChild(expr, right)
+	case expr.Operator == inverted.SetIntersection && right.Unconstrained:
+		replaceWithChild(expr, left)
+	case spanExprsEqual(left, right):
+		replaceWithChild(expr, left)
+	}
+}
+
+// replaceWithChild replaces expr with the union of its FactoredUnionSpans and
+// the given child.
+func replaceWithChild(expr, child *inverted.SpanExpression) {
+	expr.FactoredUnionSpans = mergeSpans(expr.FactoredUnionSpans, child.FactoredUnionSpans)
+	expr.Operator = child.Operator
+	expr.Left = child.Left
+	expr.Right = child.Right
+	expr.K = child.K
+	expr.Operands = child.Operands
+}
+
+// spanExprsEqual returns true if the given SpanExpressions have the same
+// FactoredUnionSpans, operators and operands, and equal children. Children
+// that are not SpanExpressions are only equal if they are the same object.
+func spanExprsEqual(a, b *inverted.SpanExpression) bool {
+	if a == b {
+		return true
+	}
+	if a.Operator != b.Operator || !a.FactoredUnionSpans.Equals(b.FactoredUnionSpans) ||
+		a.K != b.K || len(a.Operands) != len(b.Operands) {
+		return false
+	}
+	for i := range a.Operands {
+		if !a.Operands[i].Equals(b.Operands[i]) {
+			return false
+		}
+	}
+	if a.Operator != inverted.SetUnion && a.Operator != inverted.SetIntersection {
+		return true
+	}
+	childrenEqual := func(a, b inverted.Expression) bool {
+		aSpanExpr, aOk := a.(*inverted.SpanExpression)
+		bSpanExpr, bOk := b.(*inverted.SpanExpression)
+		if aOk && bOk {
+			return spanExprsEqual(aSpanExpr, bSpanExpr)
+		}
+		return a == b
+	}
+	return childrenEqual(a.Left, b.Left) && childrenEqual(a.Right, b.Right)
+}
+
+// containsExactSpan returns true if the given spans, sorted by cmpSpans,
+// contain span.
+func containsExactSpan(spans inverted.Spans, span inverted.Span) bool {
+	i := sort.Search(len(spans), func(i int) bool { return cmpSpans(spans[i], span) >= 0 })
+	return i < len(spans) && cmpSpans(spans[i], span) == 0
+}
+
+// collectFactoredSpans appends the FactoredUnionSpans and the spans of the
+// Operands of every node of expr to spans.
+func collectFactoredSpans(expr *inverted.SpanExpression, spans *inverted.Spans) {
+	*spans = append(*spans, expr.FactoredUnionSpans...)
+	for _, operand := range expr.Operands {
+		*spans = append(*spans, operand...)
+	}
+	for _, child := range []inverted.Expression{expr.Left, expr.Right} {
+		if c, ok := child.(*inverted.SpanExpression); ok {
+			collectFactoredSpans(c, spans)
+		}
+	}
+}
+
+// overlapsSpans returns true if span overlaps one of the given spans, which
+// must be sorted and non-overlapping.
+func overlapsSpans(spans inverted.Spans, span inverted.Span) bool {
+	// Find the first span that ends after the start of span.
+	i := sort.Search(len(spans), func(i int) bool {
+		return spans[i].CompareEnd(span.Start) > 0
+	})
+	return i < len(spans) && span.CompareEnd(spans[i].Start) > 0
+}
+
+// PromoteFactoredSpans hoists the spans common to the FactoredUnionSpans of
+// both children of every union and intersection of the given SpanExpression
+// into the FactoredUnionSpans of the node, bottom-up and in place, and returns
+// it, since (A ∪ B) ∩ (A ∪ C) = A ∪ (B ∩ C), and likewise for unions. The
+// converters and And only factor the spans of the children of an intersection
+// when it is constructed, so the spans that a node gains from its children
+// afterwards remain duplicated in the node and its sibling, and are processed
+// twice when the expression is evaluated.
+//
+// If this leaves a child empty, i.e. without FactoredUnionSpans and children,
+// an intersection is reduced to its FactoredUnionSpans, and a union is
+// replaced by its other child, whose FactoredUnionSpans are merged into those
+// of the union. The SpansToRead are unchanged.
+//
+// Nodes with unsorted FactoredUnionSpans (see
+// SpanExpression.UnsortedFactoredUnionSpans) are neither hoisted from nor into,
+// and nodes with children that are not SpanExpressions are left as they are.
+// Expressions whose Ordering is not inverted.OrderByKey are left as they are,
+// since the hoisted spans would be merged by key. The nodes of the expression
+// must not be shared, see Intern.
+func PromoteFactoredSpans(expr *inverted.SpanExpression) *inverted.SpanExpression {
+	if expr == nil || expr.Ordering != inverted.OrderByKey {
+		return expr
+	}
+	promoteFactoredSpans(expr)
+	return expr
+}
+
+// promoteFactoredSpans applies PromoteFactoredSpans to the subtree rooted at
+// expr.
+func promoteFactoredSpans(expr *inverted.SpanExpression) {
+	if expr.Operator != inverted.SetUnion && expr.Operator != inverted.SetIntersection {
+		return
+	}
+	left, leftOk := expr.Left.(*inverted.SpanExpression)
+	right, rightOk := expr.Right.(*inverted.SpanExpression)
+	if !leftOk || !rightOk {
+		return
+	}
+	defer expr.InvalidateCaches()
+	promoteFactoredSpans(left)
+	promoteFactoredSpans(right)
+	if expr.UnsortedFactoredUnionSpans || left.UnsortedFactoredUnionSpans ||
+		right.UnsortedFactoredUnionSpans {
+		return
+	}
+	common := appendCommonSpans(nil, left.FactoredUnionSpans, right.FactoredUnionSpans)
+	if len(common) == 0 {
+		return
+	}
+	// Do not modify FactoredUnionSpans in place, since they may share memory
+	// with SpansToRead.
+	for _, child := range [2]*inverted.SpanExpression{left, right} {
+		child.FactoredUnionSpans = removeSpans(
+			append(inverted.Spans(nil), child.FactoredUnionSpans...), common,
+		)
+		child.InvalidateCaches()
+	}
+	expr.FactoredUnionSpans = mergeSpans(expr.FactoredUnionSpans, common)
+	switch {
+	case expr.Operator == inverted.SetIntersection && (left.IsEmpty() || right.IsEmpty()):
+		expr.Operator = inverted.None
+		expr.Left = nil
+		expr.Right = nil
+	case expr.Operator == inverted.SetUnion && left.IsEmpty():
+		replaceWithChild(expr, right)
+	case expr.Operator == inverted.SetUnion && right.IsEmpty():
+		replaceWithChild(expr, left)
+	}
+}
+
+// TrigramsToSpanExpr returns a SpanExpression for the given encoded trigram
+// keys. If allMustMatch is true, as for LIKE, the expression is the
+// intersection of the trigrams, and otherwise, as for similarity, it is their
+// union. Duplicate trigrams are ignored. If there are no trigrams, the
+// expression is unconstrained, so TrigramsToSpanExpr returns nil and false.
+//
+// The expression is never tight, and it is only unique if there is a single
+// trigram, mirroring rowenc.EncodeTrigramSpans. The union of the trigrams is
+// represented by a single node. The intersection is represented by a balanced
+// tree, rather than a chain, so that the depth of the tree is logarithmic in
+// the number of trigrams of long patterns.
+func TrigramsToSpanExpr(
+	trigramKeys []inverted.EncVal, allMustMatch bool,
+) (_ *inverted.SpanExpression, ok bool) {
+	spans := make(inverted.Spans, len(trigramKeys))
+	for i, key := range trigramKeys {
+		spans[i] = inverted.MakeSingleValSpan(key)
+	}
+	spans = sortAndPruneSpans(spans)
+	switch {
+	case len(spans) == 0:
+		return nil, false
+	case len(spans) == 1:
+		expr := KeySpansToSpanExpr(spans)
+		expr.Unique = true
+		return expr, true
+	case !allMustMatch:
+		return KeySpansToSpanExpr(spans), true
+	}
+	var build func(spans inverted.Spans) *inverted.SpanExpression
+	build = func(spans inverted.Spans) *inverted.SpanExpression {
+		if len(spans) == 1 {
+			return KeySpansToSpanExpr(spans)
+		}
+		mid := len(spans) / 2
+		return And(build(spans[:mid]), build(spans[mid:]))
+	}
+	return build(spans), true
+}
+
+// SpanAsRoachpbSpan reinterprets span as a roachpb.Span, without copying its
+// keys: the Key and EndKey of the returned span alias the Start and End of
+// span, so mutating the bytes of one mutates the other. Both spans exclude
+// their end key. A point span of the inverted index, which has a nil End,
+// contains the keys in [Start, PrefixEnd(Start)), so the EndKey of the
+// returned span is the PrefixEnd of its Key, which is allocated; it is never
+// nil, which would make the roachpb.Span contain only its Key. The keys are
+// not prefixed, so the returned span is a span of inverted keys rather than of
+// index keys; see SpansToReadAsRoachpbSpans for the latter.
+func SpanAsRoachpbSpan(span inverted.Span) roachpb.Span {
+	return roachpb.Span{Key: roachpb.Key(span.Start), EndKey: roachpb.Key(span.EndKey())}
+}
+
+// SpanFromRoachpb reinterprets span as an inverted.Span, without copying its
+// keys, and is the inverse of SpanAsRoachpbSpan: a span whose EndKey is the
+// PrefixEnd of its Key becomes a point span, and the keys of other returned
+// spans alias those of span. A span with a nil EndKey, which only contains its
+// Key, becomes the span [Key, Key.Next()), whose end key is allocated.
+func SpanFromRoachpb(span roachpb.Span) inverted.Span {
+	start := inverted.EncVal(span.Key)
+	if len(span.EndKey) == 0 {
+		return inverted.Span{Start: start, End: inverted.EncVal(span.Key.Next())}
+	}
+	point := inverted.MakePointSpan(start)
+	if point.CompareEnd(inverted.EncVal(span.EndKey)) == 0 {
+		return point
+	}
+	return inverted.Span{Start: start, End: inverted.EncVal(span.EndKey)}
+}
+
+// SpansAsRoachpbSpans is like SpanAsRoachpbSpan, but converts a slice of spans.
+// The returned slice is allocated, but the keys of its spans alias those of
+// spans, except for the end keys of point spans.
+func SpansAsRoachpbSpans(spans inverted.Spans) roachpb.Spans {
+	if spans == nil {
+		return nil
+	}
+	res := make(roachpb.Spans, len(spans))
+	for i := range spans {
+		res[i] = SpanAsRoachpbSpan(spans[i])
+	}
+	return res
+}
+
+// SpansFromRoachpb is like SpanFromRoachpb, but converts a slice of spans. The
+// returned slice is allocated, but the keys of its spans alias those of spans,
+// except for the end keys of spans with a nil EndKey.
+func SpansFromRoachpb(spans roachpb.Spans) inverted.Spans {
+	if spans == nil {
+		return nil
+	}
+	res := make(inverted.Spans, len(spans))
+	for i := range spans {
+		res[i] = SpanFromRoachpb(spans[i])
+	}
+	return res
+}
+
+// SpansToReadAsRoachpbSpans returns the SpansToRead of expr as spans of the
+// index keys, which are the inverted keys preceded by the given index prefix,
+// e.g. the table and index prefix followed by the encoding of the constrained
+// values of the non-inverted prefix columns. The returned spans are sorted,
+// and overlapping or contiguous spans are merged.
+//
+// The end key of a point span is the PrefixEnd of its index key, so that the
+// span includes the index keys of all the rows with the inverted key, which
+// are followed by the primary key columns. An end key of keysbase.KeyMax,
+// which means that the span extends to the end of the inverted keys, is the
+// PrefixEnd of the index prefix.
+func SpansToReadAsRoachpbSpans(expr *inverted.SpanExpression, indexPrefix []byte) roachpb.Spans {
+	if expr == nil {
+		return nil
+	}
+	// Avoid per-span heap allocations for the keys that are not computed by
+	// PrefixEnd. The SpansToRead are visited rather than materialized, in case
+	// they were deferred.
+	numSpans, numBytes := 0, 0
+	_ = expr.VisitSpansToRead(func(span inverted.Span) error {
+		numSpans++
+		numBytes += 2*len(indexPrefix) + len(span.Start) + len(span.End)
+		return nil
+	})
+	if numSpans == 0 {
+		return nil
+	}
+	buf := make([]byte, 0, numBytes)
+	appendKey := func(key []byte) roachpb.Key {
+		n := len(buf)
+		buf = append(append(buf, indexPrefix...), key...)
+		return buf[n:len(buf):len(buf)]
+	}
+	spans := make([]roachpb.Span, 0, numSpans)
+	_ = expr.VisitSpansToRead(func(span inverted.Span) error {
+		s := roachpb.Span{Key: appendKey(span.Start)}
+		switch {
+		case span.IsPoint():
+			s.EndKey = s.Key.PrefixEnd()
+		case bytes.Equal(span.End, keysbase.KeyMax):
+			s.EndKey = roachpb.Key(indexPrefix).PrefixEnd()
+		default:
+			s.EndKey = appendKey(span.End)
+		}
+		spans = append(spans, s)
+		return nil
+	})
+	spans, _ = roachpb.MergeSpans(&spans)
+	return spans
+}
@@ -0,0 +1,702 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package invertedexpr
+
+import (
+	"context"
+	"math"
+	"math/bits"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/geo/geoindex"
+	"github.com/cockroachdb/cockroach/pkg/keysbase"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/sql/inverted"
+	"github.com/cockroachdb/cockroach/pkg/util/encoding"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/randutil"
+	"github.com/stretchr/testify/require"
+)
+
+// randGeoSpanExpr returns a random geoindex.RPKeyExpr over a small key space,
+// and the SpanExpression it is converted to.
+func randGeoSpanExpr(
+	t *testing.T, rng *rand.Rand, maxKey int,
+) (geoindex.RPKeyExpr, *inverted.SpanExpression) {
+	ctx := context.Background()
+	var rpx geoindex.RPKeyExpr
+	var uks geoindex.UnionKeySpans
+	if rng.Intn(4) == 0 {
+		// Use GeoUnionKeySpansToSpanExpr, which returns an expression without
+		// children whose FactoredUnionSpans are also its SpansToRead.
+		for k := 0; k < maxKey; k++ {
+			if rng.Intn(3) == 0 {
+				uks = append(uks, geoindex.KeySpan{Start: geoindex.Key(k), End: geoindex.Key(k)})
+				rpx = append(rpx, geoindex.Key(k))
+				if len(rpx) > 1 {
+					rpx = append(rpx, geoindex.RPSetUnion)
+				}
+			}
+		}
+		if len(uks) > 0 {
+			return rpx, GeoUnionKeySpansToSpanExpr(uks).(*inverted.SpanExpression)
+		}
+	}
+	rpx = randRPKeyExpr(rng, 1+rng.Intn(8), maxKey)
+	expr, err := GeoRPKeyExprToSpanExpr(ctx, rpx)
+	require.NoError(t, err)
+	return rpx, expr.(*inverted.SpanExpression)
+}
+
+// checkRandKeys checks that expr is well-formed, and that it evaluates to
+// expected on random sets of keys.
+func checkRandKeys(
+	t *testing.T,
+	rng *rand.Rand,
+	maxKey int,
+	expr *inverted.SpanExpression,
+	expected func(keys map[geoindex.Key]struct{}) bool,
+) {
+	require.NoError(t, expr.CheckInvariants())
+	for i := 0; i < 20; i++ {
+		keys := make(map[geoindex.Key]struct{})
+		var encKeys []inverted.EncVal
+		for k := 0; k < maxKey; k++ {
+			if rng.Intn(3) == 0 {
+				keys[geoindex.Key(k)] = struct{}{}
+				enc, _ := geoKeyToEncInvertedVal(
+					GeoKeyEncoder{}, geoindex.Key(k), false /* end */, nil)
+				encKeys = append(encKeys, enc)
+			}
+		}
+		require.Equal(t, expected(keys), Evaluate(expr, encKeys), "keys %v", keys)
+	}
+}
+
+func TestAnd(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	rng, _ := randutil.NewTestRand()
+	const maxKey = 8
+
+	_, expr := randGeoSpanExpr(t, rng, maxKey)
+	require.Nil(t, And(nil, nil))
+	require.Empty(t, Diff(expr, And(expr, nil)))
+	require.Empty(t, Diff(expr, And(nil, expr)))
+
+	// An empty expression, such as that of an empty shape, matches no rows, so
+	// the intersection with it is empty.
+	empty := GeoUnionKeySpansToSpanExpr(nil).(*inverted.SpanExpression)
+	require.Same(t, empty, And(empty, expr))
+	require.Same(t, empty, And(expr, empty))
+	require.Same(t, empty, And(nil, empty))
+	checkRandKeys(t, rng, maxKey, empty, func(map[geoindex.Key]struct{}) bool {
+		return false
+	})
+
+	for i := 0; i < 200; i++ {
+		leftRPX, left := randGeoSpanExpr(t, rng, maxKey)
+		rightRPX, right := randGeoSpanExpr(t, rng, maxKey)
+		leftStats, rightStats := left.Stats(), right.Stats()
+		expr := And(left, right)
+		require.True(t, sort.IsSorted(expr.SpansToRead))
+		// Factoring moves spans out of the children, and the cached statistics
+		// of the children must reflect that.
+		if expr.Operator != inverted.None {
+			require.Equal(t, leftStats.NumFactoredSpans+rightStats.NumFactoredSpans,
+				expr.Stats().NumFactoredSpans+len(expr.FactoredUnionSpans))
+		}
+		checkRandKeys(t, rng, maxKey, expr, func(keys map[geoindex.Key]struct{}) bool {
+			return evalRPKeyExpr(leftRPX, keys) && evalRPKeyExpr(rightRPX, keys)
+		})
+	}
+}
+
+func TestOr(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	rng, _ := randutil.NewTestRand()
+	const maxKey = 8
+
+	_, expr := randGeoSpanExpr(t, rng, maxKey)
+	require.Nil(t, Or(nil, nil))
+	require.Empty(t, Diff(expr, Or(expr, nil)))
+	require.Empty(t, Diff(expr, Or(nil, expr)))
+
+	// The union with an empty expression is the other expression.
+	empty := inverted.EmptySpanExpression()
+	require.Same(t, expr, Or(empty, expr))
+	require.Same(t, expr, Or(expr, empty))
+	require.Same(t, empty, Or(empty, nil))
+
+	// Pure unions are merged, and contiguous spans are coalesced.
+	left := GeoUnionKeySpansToSpanExpr(geoindex.UnionKeySpans{{Start: 1, End: 2}, {Start: 6, End: 6}})
+	right := GeoUnionKeySpansToSpanExpr(geoindex.UnionKeySpans{{Start: 3, End: 4}})
+	expr = Or(left.(*inverted.SpanExpression), right.(*inverted.SpanExpression))
+	require.Equal(t, inverted.None, expr.Operator)
+	require.Equal(t,
+		"spans_to_read:<start:\"B\\211\" end:\"B\\215\" > "+
+			"spans_to_read:<start:\"B\\216\" end:\"B\\217\" > "+
+			"node:<"+
+			"factored_union_spans:<start:\"B\\211\" end:\"B\\215\" > "+
+			"factored_union_spans:<start:\"B\\216\" end:\"B\\217\" > > ",
+		expr.ToProto().String())
+	require.Equal(t, 2, expr.Stats().NumFactoredSpans)
+
+	for i := 0; i < 200; i++ {
+		leftRPX, left := randGeoSpanExpr(t, rng, maxKey)
+		rightRPX, right := randGeoSpanExpr(t, rng, maxKey)
+		expr := Or(left, right)
+		require.Equal(t, expr.Stats(), (&inverted.SpanExpression{
+			FactoredUnionSpans: expr.FactoredUnionSpans,
+			Operator:           expr.Operator,
+			Left:               expr.Left,
+			Right:              expr.Right,
+		}).Stats())
+		checkRandKeys(t, rng, maxKey, expr, func(keys map[geoindex.Key]struct{}) bool {
+			return evalRPKeyExpr(leftRPX, keys) || evalRPKeyExpr(rightRPX, keys)
+		})
+	}
+}
+
+func TestUnconstrainedSpanExpr(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	rng, _ := randutil.NewTestRand()
+	const maxKey = 8
+	unconstrained := func() *inverted.SpanExpression {
+		expr := GeoUnionKeySpansToSpanExpr(geoindex.UnionKeySpans{{Start: 0, End: math.MaxUint64}})
+		return expr.(*inverted.SpanExpression)
+	}
+	// anyKey is the evaluation of an unconstrained expression: it contains all
+	// the keys, so it matches any row with a key.
+	anyKey := func(keys map[geoindex.Key]struct{}) bool { return len(keys) > 0 }
+	u := unconstrained()
+	require.True(t, u.Unconstrained)
+	checkRandKeys(t, rng, maxKey, u, anyKey)
+
+	// The intersection with an unconstrained expression is the other
+	// expression, and the union with it is the unconstrained expression.
+	require.Same(t, u, And(u, nil))
+	require.Same(t, u, Or(nil, u))
+	empty := inverted.EmptySpanExpression()
+	require.Same(t, empty, And(u, empty))
+	require.Same(t, u, Or(empty, u))
+	for i := 0; i < 50; i++ {
+		rpx, expr := randGeoSpanExpr(t, rng, maxKey)
+		require.Same(t, expr, And(unconstrained(), expr))
+		require.False(t, expr.Tight)
+		checkRandKeys(t, rng, maxKey, expr, func(keys map[geoindex.Key]struct{}) bool {
+			return evalRPKeyExpr(rpx, keys)
+		})
+		_, expr = randGeoSpanExpr(t, rng, maxKey)
+		require.Same(t, expr, And(expr, unconstrained()))
+		_, expr = randGeoSpanExpr(t, rng, maxKey)
+		u := unconstrained()
+		require.Same(t, u, Or(u, expr))
+		_, expr = randGeoSpanExpr(t, rng, maxKey)
+		u = unconstrained()
+		require.Same(t, u, Or(expr, u))
+	}
+
+	// Simplify removes unconstrained children, or propagates them to their
+	// parents.
+	node := func(
+		op inverted.SetOperator, left, right *inverted.SpanExpression,
+	) *inverted.SpanExpression {
+		return &inverted.SpanExpression{
+			SpansToRead: mergeSpans(left.SpansToRead, right.SpansToRead),
+			Operator:    op,
+			Left:        left,
+			Right:       right,
+		}
+	}
+	for i := 0; i < 50; i++ {
+		rpx, expr := randGeoSpanExpr(t, rng, maxKey)
+		union := Simplify(
+			node(inverted.SetUnion, expr.Copy().(*inverted.SpanExpression), unconstrained()),
+		)
+		require.True(t, union.Unconstrained)
+		require.Equal(t, inverted.None, union.Operator)
+		checkRandKeys(t, rng, maxKey, union, anyKey)
+
+		intersection := Simplify(node(inverted.SetIntersection, unconstrained(), expr))
+		require.False(t, intersection.Unconstrained)
+		checkRandKeys(t, rng, maxKey, intersection, func(keys map[geoindex.Key]struct{}) bool {
+			return evalRPKeyExpr(rpx, keys)
+		})
+	}
+}
+
+// randSpanExprTree returns a random SpanExpression tree over point spans of a
+// small key space, that often contains empty nodes, identical children, and
+// spans that duplicate those of an ancestor.
+func randSpanExprTree(rng *rand.Rand, depth int, maxKey int) *inverted.SpanExpression {
+	expr := &inverted.SpanExpression{}
+	for k := 0; k < maxKey; k++ {
+		if rng.Intn(4) == 0 {
+			key := geoindex.Key(k)
+			span, _ := geoToSpan(
+				GeoKeyEncoder{}, geoindex.KeySpan{Start: key, End: key}, nil)
+			expr.FactoredUnionSpans = append(expr.FactoredUnionSpans, span)
+		}
+	}
+	if depth == 0 || rng.Intn(3) == 0 {
+		return expr
+	}
+	expr.Operator = inverted.SetUnion
+	if rng.Intn(2) == 0 {
+		expr.Operator = inverted.SetIntersection
+	}
+	left := randSpanExprTree(rng, depth-1, maxKey)
+	right := left
+	if rng.Intn(4) != 0 {
+		right = randSpanExprTree(rng, depth-1, maxKey)
+	} else {
+		// Use a copy, so that the children are identical but not the same
+		// object.
+		right = left.Copy().(*inverted.SpanExpression)
+	}
+	expr.Left, expr.Right = left, right
+	return expr
+}
+
+func TestSimplify(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	point := func(k geoindex.Key) inverted.Span {
+		span, _ := geoToSpan(
+			GeoKeyEncoder{}, geoindex.KeySpan{Start: k, End: k}, nil)
+		return span
+	}
+	leaf := func(keys ...geoindex.Key) *inverted.SpanExpression {
+		expr := &inverted.SpanExpression{}
+		for _, k := range keys {
+			expr.FactoredUnionSpans = append(expr.FactoredUnionSpans, point(k))
+		}
+		return expr
+	}
+	node := func(
+		op inverted.SetOperator, left, right *inverted.SpanExpression, keys ...geoindex.Key,
+	) *inverted.SpanExpression {
+		expr := leaf(keys...)
+		expr.Operator, expr.Left, expr.Right = op, left, right
+		var spans inverted.Spans
+		collectFactoredSpans(expr, &spans)
+		expr.SpansToRead = sortAndPruneSpans(spans)
+		return expr
+	}
+
+	t.Run("union with empty child", func(t *testing.T) {
+		expr := Simplify(node(
+			inverted.SetUnion, leaf(), node(inverted.SetIntersection, leaf(2), leaf(3)), 1,
+		))
+		require.Equal(t, inverted.SetIntersection, expr.Operator)
+		require.Equal(t, inverted.Spans{point(1)}, expr.FactoredUnionSpans)
+	})
+
+	t.Run("intersection with empty child", func(t *testing.T) {
+		expr := Simplify(node(inverted.SetIntersection, leaf(2), leaf(), 1))
+		require.Equal(t, inverted.None, expr.Operator)
+		require.Equal(t, inverted.Spans{point(1)}, expr.FactoredUnionSpans)
+		// The spans of the discarded child are no longer read.
+		require.Equal(t, inverted.Spans{point(1)}, expr.SpansToRead)
+	})
+
+	t.Run("identical children", func(t *testing.T) {
+		expr := Simplify(node(inverted.SetUnion,
+			node(inverted.SetIntersection, leaf(2), leaf(3)),
+			node(inverted.SetIntersection, leaf(2), leaf(3)),
+		))
+		require.Equal(t, inverted.SetIntersection, expr.Operator)
+		require.Empty(t, expr.FactoredUnionSpans)
+	})
+
+	t.Run("duplicate of ancestor span", func(t *testing.T) {
+		// 1 ∪ ((1 ∪ 2) ∩ (1 ∪ 3)) is simplified to 1 ∪ (2 ∩ 3).
+		expr := Simplify(node(inverted.SetIntersection, leaf(1, 2), leaf(1, 3), 1))
+		require.Equal(t, inverted.SetIntersection, expr.Operator)
+		left, right := expr.Left.(*inverted.SpanExpression), expr.Right.(*inverted.SpanExpression)
+		require.Equal(t, inverted.Spans{point(2)}, left.FactoredUnionSpans)
+		require.Equal(t, inverted.Spans{point(3)}, right.FactoredUnionSpans)
+	})
+
+	t.Run("random", func(t *testing.T) {
+		rng, _ := randutil.NewTestRand()
+		const maxKey = 8
+		for i := 0; i < 500; i++ {
+			expr := randSpanExprTree(rng, 4 /* depth */, maxKey)
+			var spans inverted.Spans
+			collectFactoredSpans(expr, &spans)
+			expr.SpansToRead = sortAndPruneSpans(spans)
+			require.NoError(t, expr.CheckInvariants())
+			origSpansToRead := append(inverted.Spans(nil), expr.SpansToRead...)
+
+			// Evaluate the original expression over all sets of keys, before it
+			// is modified by Simplify.
+			var expected []bool
+			keySets := make([][]inverted.EncVal, 1<<maxKey)
+			for set := range keySets {
+				for k := 0; k < maxKey; k++ {
+					if set&(1<<k) != 0 {
+						enc, _ := geoKeyToEncInvertedVal(
+							GeoKeyEncoder{}, geoindex.Key(k), false /* end */, nil,
+						)
+						keySets[set] = append(keySets[set], enc)
+					}
+				}
+				expected = append(expected, Evaluate(expr, keySets[set]))
+			}
+
+			expr = Simplify(expr)
+			require.NoError(t, expr.CheckInvariants())
+			for set, keys := range keySets {
+				require.Equal(t, expected[set], Evaluate(expr, keys))
+			}
+			// The SpansToRead only shrink.
+			for _, span := range expr.SpansToRead {
+				require.True(t, origSpansToRead.ContainsKey(span.Start))
+			}
+		}
+	})
+}
+
+func TestPromoteFactoredSpans(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	point := func(k geoindex.Key) inverted.Span {
+		span, _ := geoToSpan(
+			GeoKeyEncoder{}, geoindex.KeySpan{Start: k, End: k}, nil)
+		return span
+	}
+	leaf := func(keys ...geoindex.Key) *inverted.SpanExpression {
+		expr := &inverted.SpanExpression{}
+		for _, k := range keys {
+			expr.FactoredUnionSpans = append(expr.FactoredUnionSpans, point(k))
+		}
+		return expr
+	}
+	node := func(
+		op inverted.SetOperator, left, right *inverted.SpanExpression, keys ...geoindex.Key,
+	) *inverted.SpanExpression {
+		expr := leaf(keys...)
+		expr.Operator, expr.Left, expr.Right = op, left, right
+		var spans inverted.Spans
+		collectFactoredSpans(expr, &spans)
+		expr.SpansToRead = sortAndPruneSpans(spans)
+		return expr
+	}
+
+	t.Run("nested intersection", func(t *testing.T) {
+		// ((1 ∪ 2) ∩ (1 ∪ 3)) ∩ (1 ∪ 4) is promoted to 1 ∪ ((2 ∩ 3) ∩ 4), in
+		// two steps.
+		expr := node(inverted.SetIntersection,
+			node(inverted.SetIntersection, leaf(1, 2), leaf(1, 3)), leaf(1, 4))
+		spansToRead := expr.SpansToRead
+		before := expr.Stats()
+		expr = PromoteFactoredSpans(expr)
+		require.NoError(t, expr.CheckInvariants())
+		require.Equal(t, spansToRead, expr.SpansToRead)
+		require.Equal(t, inverted.Spans{point(1)}, expr.FactoredUnionSpans)
+		left, right := expr.Left.(*inverted.SpanExpression), expr.Right.(*inverted.SpanExpression)
+		require.Empty(t, left.FactoredUnionSpans)
+		require.Equal(t, inverted.Spans{point(4)}, right.FactoredUnionSpans)
+		require.Equal(t,
+			inverted.Spans{point(2)}, left.Left.(*inverted.SpanExpression).FactoredUnionSpans)
+		require.Equal(t,
+			inverted.Spans{point(3)}, left.Right.(*inverted.SpanExpression).FactoredUnionSpans)
+		require.Equal(t, before.NumFactoredSpans-2, expr.Stats().NumFactoredSpans)
+	})
+
+	t.Run("intersection with empty child", func(t *testing.T) {
+		// 1 ∩ (1 ∪ 2) is promoted to 1.
+		expr := PromoteFactoredSpans(node(inverted.SetIntersection, leaf(1), leaf(1, 2)))
+		require.Equal(t, inverted.None, expr.Operator)
+		require.Equal(t, inverted.Spans{point(1)}, expr.FactoredUnionSpans)
+	})
+
+	t.Run("union with empty child", func(t *testing.T) {
+		// 3 ∪ (1 ∪ ((1 ∪ 2) ∩ (1 ∪ 4))) is promoted to 1 ∪ 3 ∪ (2 ∩ 4).
+		expr := PromoteFactoredSpans(node(inverted.SetUnion,
+			leaf(1), node(inverted.SetIntersection, leaf(1, 2), leaf(1, 4)), 3))
+		require.NoError(t, expr.CheckInvariants())
+		require.Equal(t, inverted.SetIntersection, expr.Operator)
+		require.Equal(t, inverted.Spans{point(1), point(3)}, expr.FactoredUnionSpans)
+		require.Equal(t, 3, expr.Stats().NumNodes)
+	})
+
+	t.Run("unsorted spans", func(t *testing.T) {
+		// The spans of children with unsorted spans are not promoted.
+		left := leaf(2, 1)
+		left.UnsortedFactoredUnionSpans = true
+		expr := PromoteFactoredSpans(node(inverted.SetIntersection, left, leaf(1, 3)))
+		require.Empty(t, expr.FactoredUnionSpans)
+		require.Len(t, left.FactoredUnionSpans, 2)
+	})
+
+	t.Run("shared memory", func(t *testing.T) {
+		// The FactoredUnionSpans of the children are not modified in place.
+		left, right := leaf(1, 2), leaf(1, 3)
+		leftSpans := left.FactoredUnionSpans
+		PromoteFactoredSpans(node(inverted.SetIntersection, left, right))
+		require.Equal(t, inverted.Spans{point(1), point(2)}, leftSpans)
+	})
+
+	t.Run("random", func(t *testing.T) {
+		rng, _ := randutil.NewTestRand()
+		const maxKey = 8
+		keySets := make([][]inverted.EncVal, 1<<maxKey)
+		for set := range keySets {
+			for k := 0; k < maxKey; k++ {
+				if set&(1<<k) != 0 {
+					enc, _ := geoKeyToEncInvertedVal(
+						GeoKeyEncoder{}, geoindex.Key(k), false /* end */, nil,
+					)
+					keySets[set] = append(keySets[set], enc)
+				}
+			}
+		}
+		for i := 0; i < 500; i++ {
+			expr := randSpanExprTree(rng, 4 /* depth */, maxKey)
+			var spans inverted.Spans
+			collectFactoredSpans(expr, &spans)
+			expr.SpansToRead = sortAndPruneSpans(spans)
+			require.NoError(t, expr.CheckInvariants())
+			var expected []bool
+			for _, keys := range keySets {
+				expected = append(expected, Evaluate(expr, keys))
+			}
+			before := expr.Stats()
+
+			expr = PromoteFactoredSpans(expr)
+			require.NoError(t, expr.CheckInvariants())
+			for set, keys := range keySets {
+				require.Equal(t, expected[set], Evaluate(expr, keys))
+			}
+			after := expr.Stats()
+			require.LessOrEqual(t, after.NumNodes, before.NumNodes)
+			require.LessOrEqual(t, after.NumFactoredSpans, before.NumFactoredSpans)
+		}
+	})
+}
+
+func TestKeySpansToSpanExpr(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	require.Nil(t, KeySpansToSpanExpr(nil))
+
+	span := func(start, end string) inverted.Span {
+		return inverted.Span{Start: inverted.EncVal(start), End: inverted.EncVal(end)}
+	}
+	// Unsorted, overlapping, contiguous, and duplicate spans.
+	spans := append(
+		inverted.Spans{span("m", "p"), span("a", "c"), span("n", "o"), span("c", "d")},
+		EncodeInvertedSpans([][]byte{[]byte("x"), []byte("f"), []byte("x"), []byte("g")})...,
+	)
+	expr := KeySpansToSpanExpr(spans)
+	require.NoError(t, expr.CheckInvariants())
+	require.Equal(t, inverted.None, expr.Operator)
+	require.Equal(t,
+		inverted.Spans{span("a", "d"), span("f", "h"), span("m", "p"), span("x", "y")},
+		expr.FactoredUnionSpans)
+	require.Equal(t, expr.FactoredUnionSpans, expr.SpansToRead)
+	for _, key := range []string{"a", "c", "f", "g", "g\x00", "n", "o", "x", "x\xff"} {
+		require.True(t, Evaluate(expr, []inverted.EncVal{inverted.EncVal(key)}), "key %q", key)
+	}
+	for _, key := range []string{"d", "e", "h", "p", "y"} {
+		require.False(t, Evaluate(expr, []inverted.EncVal{inverted.EncVal(key)}), "key %q", key)
+	}
+}
+
+func TestEncodeInvertedSpans(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	keys := [][]byte{[]byte("a"), []byte("b\xff"), {0xff}}
+	spans := EncodeInvertedSpans(keys)
+	require.Len(t, spans, len(keys))
+	for i, span := range spans {
+		require.True(t, span.IsSingleVal())
+		require.True(t, span.ContainsKey(keys[i]))
+	}
+	require.Equal(t, inverted.EncVal("c"), spans[1].EndKey())
+}
+
+func TestTrigramsToSpanExpr(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	_, ok := TrigramsToSpanExpr(nil, true /* allMustMatch */)
+	require.False(t, ok)
+	_, ok = TrigramsToSpanExpr(nil, false /* allMustMatch */)
+	require.False(t, ok)
+
+	rng, _ := randutil.NewTestRand()
+	for _, numTrigrams := range []int{1, 2, 3, 10, 500} {
+		for _, allMustMatch := range []bool{true, false} {
+			// Use a small alphabet, so that there are duplicate trigrams.
+			var trigramKeys []inverted.EncVal
+			keySet := make(map[string]struct{})
+			for i := 0; i < numTrigrams; i++ {
+				key := inverted.EncVal{
+					byte('a' + rng.Intn(4)), byte('a' + rng.Intn(4)), byte('a' + rng.Intn(4)),
+				}
+				trigramKeys = append(trigramKeys, key)
+				keySet[string(key)] = struct{}{}
+			}
+			expr, ok := TrigramsToSpanExpr(trigramKeys, allMustMatch)
+			require.True(t, ok)
+			require.NoError(t, expr.CheckInvariants())
+			require.False(t, expr.Tight)
+			require.Equal(t, len(keySet) == 1, expr.Unique)
+			if allMustMatch {
+				require.Equal(t, len(keySet), expr.Stats().NumFactoredSpans)
+				// The tree is balanced.
+				require.LessOrEqual(t, expr.Stats().Depth, bits.Len(uint(len(keySet)))+1)
+			} else {
+				require.Equal(t, inverted.None, expr.Operator)
+			}
+
+			for i := 0; i < 20; i++ {
+				var keys []inverted.EncVal
+				found := 0
+				for key := range keySet {
+					if rng.Intn(8) != 0 {
+						keys = append(keys, inverted.EncVal(key))
+						found++
+					}
+				}
+				expected := found > 0
+				if allMustMatch {
+					expected = found == len(keySet)
+				}
+				require.Equal(t, expected, Evaluate(expr, keys))
+			}
+		}
+	}
+}
+
+func TestSpansToReadAsRoachpbSpans(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	indexPrefix := []byte{0xf0, 0x89, 0x8a}
+	key := func(k uint64) roachpb.Key {
+		key := append(roachpb.Key(nil), indexPrefix...)
+		key = encoding.EncodeGeoInvertedAscending(key)
+		return encoding.EncodeUvarintAscending(key, k)
+	}
+	// The end key of the span of the key math.MaxUint64 is the PrefixEnd of
+	// its index key, since its inverted key cannot be incremented.
+	maxEnd := key(math.MaxUint64).PrefixEnd()
+
+	// The spans of geoindex.UnionKeySpans, which are not point spans.
+	ukExpr := GeoUnionKeySpansToSpanExpr(geoindex.UnionKeySpans{
+		{Start: 1, End: 1}, {Start: 5, End: 6}, {Start: math.MaxUint64 - 1, End: math.MaxUint64},
+	}).(*inverted.SpanExpression)
+	require.Equal(t, roachpb.Spans{
+		{Key: key(1), EndKey: key(2)},
+		{Key: key(5), EndKey: key(7)},
+		{Key: key(math.MaxUint64 - 1), EndKey: maxEnd},
+	}, SpansToReadAsRoachpbSpans(ukExpr, indexPrefix))
+
+	// The point spans of a geoindex.RPKeyExpr. The spans of the contiguous keys
+	// 1 and 2 are merged.
+	rpExpr, err := GeoRPKeyExprToSpanExpr(ctx, geoindex.RPKeyExpr{
+		geoindex.Key(2), geoindex.Key(1), geoindex.RPSetUnion,
+		geoindex.Key(5), geoindex.Key(math.MaxUint64), geoindex.RPSetUnion,
+		geoindex.RPSetIntersection,
+	})
+	require.NoError(t, err)
+	require.Equal(t, roachpb.Spans{
+		{Key: key(1), EndKey: key(3)},
+		{Key: key(5), EndKey: key(6)},
+		{Key: key(math.MaxUint64), EndKey: maxEnd},
+	}, SpansToReadAsRoachpbSpans(rpExpr.(*inverted.SpanExpression), indexPrefix))
+
+	// A span that extends to the end of the inverted keys ends at the PrefixEnd
+	// of the index prefix, and a span without a start key starts at the index
+	// prefix.
+	expr := KeySpansToSpanExpr(inverted.Spans{
+		{Start: inverted.EncVal("a"), End: inverted.EncVal("b")},
+		{Start: inverted.EncVal("c"), End: keysbase.KeyMax},
+	})
+	require.Equal(t, roachpb.Spans{
+		{Key: roachpb.Key("\xf0\x89\x8aa"), EndKey: roachpb.Key("\xf0\x89\x8ab")},
+		{Key: roachpb.Key("\xf0\x89\x8ac"), EndKey: roachpb.Key("\xf0\x89\x8b")},
+	}, SpansToReadAsRoachpbSpans(expr, indexPrefix))
+	expr = KeySpansToSpanExpr(inverted.Spans{inverted.MakePointSpan(nil)})
+	require.Equal(t, roachpb.Spans{
+		{Key: roachpb.Key(indexPrefix), EndKey: roachpb.Key("\xf0\x89\x8b")},
+	}, SpansToReadAsRoachpbSpans(expr, indexPrefix))
+	require.Nil(t, SpansToReadAsRoachpbSpans(nil, indexPrefix))
+}
+
+func TestRoachpbSpanConversions(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	enc := GeoKeyEncoder{}
+	encode := func(k uint64) inverted.EncVal {
+		key, _ := enc.EncodeKey(k, nil)
+		return key
+	}
+	// The end key of the span of math.MaxUint64 is produced by PrefixEnd, and
+	// that of a point span is nil.
+	maxEnd, _ := enc.EncodeEndKey(math.MaxUint64, nil)
+	spans := inverted.Spans{
+		inverted.MakePointSpan(encode(1)),
+		{Start: encode(5), End: encode(7)},
+		{Start: encode(math.MaxUint64), End: maxEnd},
+		{Start: inverted.EncVal("c"), End: keysbase.KeyMax},
+	}
+	rspans := SpansAsRoachpbSpans(spans)
+	require.Len(t, rspans, len(spans))
+	for i, span := range spans {
+		rspan := rspans[i]
+		require.Equal(t, SpanAsRoachpbSpan(span), rspan)
+		require.True(t, rspan.Valid())
+		// The EndKey of a point span is the PrefixEnd of its Key, rather than
+		// nil, which would make the roachpb.Span contain only its Key.
+		require.Equal(t, roachpb.Key(span.EndKey()), rspan.EndKey)
+		// Converting the span there and back keeps it equal. A span that stores
+		// the PrefixEnd of its start key becomes the equivalent point span.
+		require.True(t, span.Equals(SpanFromRoachpb(rspan)))
+		if span.IsPoint() || !span.IsSingleVal() {
+			require.Equal(t, span, SpanFromRoachpb(rspan))
+		} else {
+			require.True(t, SpanFromRoachpb(rspan).IsPoint())
+		}
+		// Both spans contain the same keys.
+		require.True(t, rspan.Contains(roachpb.Span{Key: roachpb.Key(span.Start)}))
+		require.False(t, rspan.ContainsKey(roachpb.Key(span.EndKey())))
+		next := roachpb.Key(span.Start).Next()
+		require.Equal(t, span.ContainsKey(inverted.EncVal(next)), rspan.ContainsKey(next))
+	}
+	fromRspans := SpansFromRoachpb(rspans)
+	require.Len(t, fromRspans, len(spans))
+	for i := range spans {
+		require.True(t, spans[i].Equals(fromRspans[i]))
+	}
+	require.Nil(t, SpansAsRoachpbSpans(nil))
+	require.Nil(t, SpansFromRoachpb(nil))
+
+	// A roachpb.Span without an EndKey only contains its Key.
+	span := SpanFromRoachpb(roachpb.Span{Key: roachpb.Key("c")})
+	require.True(t, span.ContainsKey(inverted.EncVal("c")))
+	require.False(t, span.ContainsKey(inverted.EncVal("c\x00")))
+
+	// The keys are not copied, so mutating the keys of one span mutates those
+	// of the other.
+	SpansFromRoachpb(rspans)[1].End[0] = 0
+	require.Equal(t, byte(0), spans[1].End[0])
+	rspans[1].Key[len(rspans[1].Key)-1]++
+	require.Equal(t, encode(6), spans[1].Start)
+}
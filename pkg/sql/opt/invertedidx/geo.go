@@ -14,6 +14,7 @@ import (
 	"context"
 	"fmt"
 
+	"github.com/cockroachdb/cockroach/pkg/clusterversion"
 	"github.com/cockroachdb/cockroach/pkg/geo"
 	"github.com/cockroachdb/cockroach/pkg/geo/geogfn"
 	// Blank import so projections are initialized correctly.
@@ -63,11 +64,77 @@ func GetGeoIndexRelationship(expr opt.ScalarExpr) (_ geoindex.RelationshipType,
 // getSpanExprForGeoIndexFn is a function that returns a SpanExpression that
 // constrains the given geo index according to the given constant and
 // geospatial relationship. It is implemented by getSpanExprForGeographyIndex
-// and getSpanExprForGeometryIndex and used in extractGeoFilterCondition.
+// and getSpanExprForGeometryIndex and used in extractGeoFilterCondition. The
+// keys of the spans are encoded with the given version of the encoding, see
+// geoInvertedKeyVersion. If the given converter is non-nil, it is used to
+// allocate the SpanExpression, which is then only valid until the converter is
+// reset.
 type getSpanExprForGeoIndexFn func(
-	context.Context, tree.Datum, []tree.Datum, geoindex.RelationshipType, geopb.Config,
+	context.Context,
+	tree.Datum,
+	[]tree.Datum,
+	geoindex.RelationshipType,
+	geopb.Config,
+	encoding.GeoInvertedKeyVersion,
+	*invertedexpr.GeoSpanExprConverter,
 ) inverted.Expression
 
+// geoInvertedKeyVersion returns the version of the encoding of the geo
+// inverted keys of the spans that constrain geo indexes. It is
+// encoding.LatestGeoInvertedKeyVersion, unless not all nodes of the cluster can
+// decode the keys of that version yet, in which case it is
+// encoding.GeoInvertedKeyV1.
+func geoInvertedKeyVersion(
+	ctx context.Context, evalCtx *eval.Context,
+) encoding.GeoInvertedKeyVersion {
+	return geoInvertedKeyVersionForLatest(ctx, evalCtx, encoding.LatestGeoInvertedKeyVersion)
+}
+
+// geoInvertedKeyVersionForLatest implements geoInvertedKeyVersion for the
+// given latest version.
+func geoInvertedKeyVersionForLatest(
+	ctx context.Context, evalCtx *eval.Context, latest encoding.GeoInvertedKeyVersion,
+) encoding.GeoInvertedKeyVersion {
+	if latest >= encoding.GeoInvertedKeyV2 &&
+		!evalCtx.Settings.Version.IsActive(ctx, clusterversion.V24_2_GeoInvertedKeyV2) {
+		return encoding.GeoInvertedKeyV1
+	}
+	return latest
+}
+
+// geoRPKeyExprToSpanExpr converts rpKeyExpr to a SpanExpression whose keys are
+// encoded with keyVersion, using conv if it is non-nil.
+func geoRPKeyExprToSpanExpr(
+	ctx context.Context,
+	conv *invertedexpr.GeoSpanExprConverter,
+	keyVersion encoding.GeoInvertedKeyVersion,
+	rpKeyExpr geoindex.RPKeyExpr,
+) (inverted.Expression, error) {
+	opts := invertedexpr.ConvertOptions{KeyVersion: keyVersion}
+	if conv == nil {
+		return invertedexpr.GeoRPKeyExprToSpanExprWithOptions(ctx, rpKeyExpr, nil /* prefixKey */, opts)
+	}
+	return conv.RPKeyExprToSpanExprWithOptions(ctx, rpKeyExpr, nil /* prefixKey */, opts)
+}
+
+// geoUnionKeySpansToSpanExpr converts unionKeySpans returned by geoindex to a
+// SpanExpression whose keys are encoded with keyVersion. The spans returned by
+// geoindex are sorted, so the conversion does not need to sort them.
+func geoUnionKeySpansToSpanExpr(
+	ctx context.Context,
+	keyVersion encoding.GeoInvertedKeyVersion,
+	unionKeySpans geoindex.UnionKeySpans,
+) inverted.Expression {
+	// The conversion can only fail if ConvertOptions.MaxSpans is set.
+	expr, _ := invertedexpr.GeoUnionKeySpansToSpanExprWithOptions(
+		ctx, unionKeySpans, nil /* prefixKey */, invertedexpr.ConvertOptions{
+			InputSorted: true,
+			KeyVersion:  keyVersion,
+		},
+	)
+	return expr
+}
+
 // getSpanExprForGeographyIndex gets a SpanExpression that constrains the given
 // geography index according to the given constant and geospatial relationship.
 func getSpanExprForGeographyIndex(
@@ -76,6 +143,8 @@ func getSpanExprForGeographyIndex(
 	additionalParams []tree.Datum,
 	relationship geoindex.RelationshipType,
 	indexConfig geopb.Config,
+	keyVersion encoding.GeoInvertedKeyVersion,
+	conv *invertedexpr.GeoSpanExprConverter,
 ) inverted.Expression {
 	geogIdx := geoindex.NewS2GeographyIndex(*indexConfig.S2Geography)
 	geog := d.(*tree.DGeography).Geography
@@ -86,14 +155,14 @@ func getSpanExprForGeographyIndex(
 		if err != nil {
 			panic(err)
 		}
-		return invertedexpr.GeoUnionKeySpansToSpanExpr(unionKeySpans)
+		return geoUnionKeySpansToSpanExpr(ctx, keyVersion, unionKeySpans)
 
 	case geoindex.CoveredBy:
 		rpKeyExpr, err := geogIdx.CoveredBy(ctx, geog)
 		if err != nil {
 			panic(err)
 		}
-		spanExpr, err := invertedexpr.GeoRPKeyExprToSpanExpr(rpKeyExpr)
+		spanExpr, err := geoRPKeyExprToSpanExpr(ctx, conv, keyVersion, rpKeyExpr)
 		if err != nil {
 			panic(err)
 		}
@@ -126,14 +195,14 @@ func getSpanExprForGeographyIndex(
 		if err != nil {
 			panic(err)
 		}
-		return invertedexpr.GeoUnionKeySpansToSpanExpr(unionKeySpans)
+		return geoUnionKeySpansToSpanExpr(ctx, keyVersion, unionKeySpans)
 
 	case geoindex.Intersects:
 		unionKeySpans, err := geogIdx.Intersects(ctx, geog)
 		if err != nil {
 			panic(err)
 		}
-		return invertedexpr.GeoUnionKeySpansToSpanExpr(unionKeySpans)
+		return geoUnionKeySpansToSpanExpr(ctx, keyVersion, unionKeySpans)
 
 	default:
 		panic(errors.AssertionFailedf("unhandled relationship: %v", relationship))
@@ -163,6 +232,8 @@ func getSpanExprForGeometryIndex(
 	additionalParams []tree.Datum,
 	relationship geoindex.RelationshipType,
 	indexConfig geopb.Config,
+	keyVersion encoding.GeoInvertedKeyVersion,
+	conv *invertedexpr.GeoSpanExprConverter,
 ) inverted.Expression {
 	geomIdx := geoindex.NewS2GeometryIndex(*indexConfig.S2Geometry)
 	geom := d.(*tree.DGeometry).Geometry
@@ -173,14 +244,14 @@ func getSpanExprForGeometryIndex(
 		if err != nil {
 			panic(err)
 		}
-		return invertedexpr.GeoUnionKeySpansToSpanExpr(unionKeySpans)
+		return geoUnionKeySpansToSpanExpr(ctx, keyVersion, unionKeySpans)
 
 	case geoindex.CoveredBy:
 		rpKeyExpr, err := geomIdx.CoveredBy(ctx, geom)
 		if err != nil {
 			panic(err)
 		}
-		spanExpr, err := invertedexpr.GeoRPKeyExprToSpanExpr(rpKeyExpr)
+		spanExpr, err := geoRPKeyExprToSpanExpr(ctx, conv, keyVersion, rpKeyExpr)
 		if err != nil {
 			panic(err)
 		}
@@ -192,7 +263,7 @@ func getSpanExprForGeometryIndex(
 		if err != nil {
 			panic(err)
 		}
-		return invertedexpr.GeoUnionKeySpansToSpanExpr(unionKeySpans)
+		return geoUnionKeySpansToSpanExpr(ctx, keyVersion, unionKeySpans)
 
 	case geoindex.DWithin:
 		distance := getDistanceParam(additionalParams)
@@ -200,14 +271,14 @@ func getSpanExprForGeometryIndex(
 		if err != nil {
 			panic(err)
 		}
-		return invertedexpr.GeoUnionKeySpansToSpanExpr(unionKeySpans)
+		return geoUnionKeySpansToSpanExpr(ctx, keyVersion, unionKeySpans)
 
 	case geoindex.Intersects:
 		unionKeySpans, err := geomIdx.Intersects(ctx, geom)
 		if err != nil {
 			panic(err)
 		}
-		return invertedexpr.GeoUnionKeySpansToSpanExpr(unionKeySpans)
+		return geoUnionKeySpansToSpanExpr(ctx, keyVersion, unionKeySpans)
 
 	default:
 		panic(errors.AssertionFailedf("unhandled relationship: %v", relationship))
@@ -635,7 +706,26 @@ func extractGeoFilterCondition(
 	preFilterExpr :=
 		makeExprFromRelationshipAndParams(factory, expr, args, commuteArgs, relationship)
 
-	return getSpanExpr(ctx, d, additionalParams, relationship, index.GeoConfig()),
+	keyVersion := geoInvertedKeyVersion(ctx, factory.EvalContext())
+	spanExpr := getSpanExpr(
+		ctx, d, additionalParams, relationship, index.GeoConfig(), keyVersion, nil, /* conv */
+	)
+	if e, ok := spanExpr.(*inverted.SpanExpression); ok {
+		switch {
+		case e.IsEmpty():
+			// The constant is an empty shape, so the filter matches no rows. An
+			// inverted index scan must read at least one span, so the index
+			// cannot be constrained by the filter, which is applied by another
+			// scan instead.
+			return inverted.NonInvertedColExpression{}, nil
+		case e.Unconstrained:
+			// The covering of the constant is the whole index, so scanning the
+			// index would be no better than scanning the table, and the filter
+			// would still have to be applied to every row.
+			return inverted.NonInvertedColExpression{}, nil
+		}
+	}
+	return spanExpr,
 		&invertedexpr.PreFiltererStateForInvertedFilterer{
 			Expr: preFilterExpr,
 			Col:  arg2.Col,
@@ -932,12 +1022,19 @@ type geoDatumsToInvertedExpr struct {
 	indexConfig  geopb.Config
 	typ          *types.T
 	getSpanExpr  getSpanExprForGeoIndexFn
+	// keyVersion is the version of the encoding of the keys of the computed
+	// SpanExpressions, see geoInvertedKeyVersion.
+	keyVersion encoding.GeoInvertedKeyVersion
 
 	// Non-nil only when it can pre-filter.
 	filterer *PreFilterer
 
 	row   rowenc.EncDatumRow
 	alloc tree.DatumAlloc
+	// spanExprConv is used to allocate the SpanExpressions computed in Convert.
+	// It is reset at the start of each call to Convert, since the returned
+	// SpanExpressionProto does not reference the memory of the converter.
+	spanExprConv invertedexpr.GeoSpanExprConverter
 }
 
 var _ invertedexpr.DatumsToInvertedExpr = &geoDatumsToInvertedExpr{}
@@ -973,6 +1070,7 @@ func NewGeoDatumsToInvertedExpr(
 		evalCtx:     evalCtx,
 		colTypes:    colTypes,
 		indexConfig: config,
+		keyVersion:  geoInvertedKeyVersion(ctx, evalCtx),
 	}
 	if config.IsGeography() {
 		g.typ = types.Geography
@@ -1027,7 +1125,9 @@ func NewGeoDatumsToInvertedExpr(
 			// it for every row.
 			var invertedExpr inverted.Expression
 			if d, ok := nonIndexParam.(tree.Datum); ok {
-				invertedExpr = g.getSpanExpr(ctx, d, additionalParams, relationship, g.indexConfig)
+				invertedExpr = g.getSpanExpr(
+					ctx, d, additionalParams, relationship, g.indexConfig, g.keyVersion, nil, /* conv */
+				)
 			} else if funcExprCount == 1 {
 				// Currently pre-filtering is limited to a single FuncExpr.
 				preFilterRelationship = relationship
@@ -1063,6 +1163,7 @@ func (g *geoDatumsToInvertedExpr) Convert(
 	ctx context.Context, datums rowenc.EncDatumRow,
 ) (*inverted.SpanExpressionProto, interface{}, error) {
 	g.row = datums
+	g.spanExprConv.Reset()
 	g.evalCtx.PushIVarContainer(g)
 	defer g.evalCtx.PopIVarContainer()
 
@@ -1084,7 +1185,9 @@ func (g *geoDatumsToInvertedExpr) Convert(
 			if g.filterer != nil {
 				preFilterState = g.filterer.Bind(d)
 			}
-			return g.getSpanExpr(ctx, d, t.additionalParams, t.relationship, g.indexConfig), nil
+			return g.getSpanExpr(
+				ctx, d, t.additionalParams, t.relationship, g.indexConfig, g.keyVersion, &g.spanExprConv,
+			), nil
 
 		default:
 			return nil, fmt.Errorf("unsupported expression %v", t)
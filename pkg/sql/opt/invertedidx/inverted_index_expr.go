@@ -181,6 +181,10 @@ func TryFilterInvertedIndex(
 	if !ok {
 		return nil, nil, nil, nil, false
 	}
+	// Predicates over the same column, such as multi-shape geospatial
+	// predicates, can produce intersections of unions with a common operand,
+	// which are cheaper to evaluate once the common operand is factored out.
+	spanExpr = normalizeIfBeneficial(spanExpr)
 	if pfState != nil {
 		pfState.Typ = typ
 	}
@@ -188,6 +192,27 @@ func TryFilterInvertedIndex(
 	return spanExpr, constraint, remainingFilters, pfState, true
 }
 
+// normalizeIfBeneficial returns the result of inverted.Normalize on spanExpr
+// if it is cheaper to evaluate than spanExpr, i.e. it has fewer nodes or fewer
+// factored spans for the inverted filterer to add keys to. Otherwise spanExpr
+// is returned.
+func normalizeIfBeneficial(spanExpr *inverted.SpanExpression) *inverted.SpanExpression {
+	before := spanExpr.Stats()
+	if before.NumIntersections == 0 {
+		// Normalize only rewrites intersections.
+		return spanExpr
+	}
+	res := inverted.Normalize(spanExpr, 0 /* maxGrowth */)
+	if res == spanExpr {
+		return spanExpr
+	}
+	after := res.Stats()
+	if after.NumNodes < before.NumNodes || after.NumFactoredSpans < before.NumFactoredSpans {
+		return res
+	}
+	return spanExpr
+}
+
 // TryFilterInvertedIndexBySimilarity attempts to constrain an inverted trigram
 // index using a similarity filter. It returns the constraint and the set of
 // remaining filters which are not "tight" in the constraint. If no constraint
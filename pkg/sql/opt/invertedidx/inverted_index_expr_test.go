@@ -11,8 +11,13 @@
 package invertedidx
 
 import (
+	"context"
 	"testing"
 
+	"github.com/cockroachdb/cockroach/pkg/clusterversion"
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/eval"
+	"github.com/cockroachdb/cockroach/pkg/util/encoding"
 	"github.com/stretchr/testify/require"
 )
 
@@ -107,3 +112,47 @@ func TestSimilarityTrigramsToScan(t *testing.T) {
 		require.Equal(t, tc.expected, res)
 	}
 }
+
+// TestGeoInvertedKeyVersion verifies that the geo inverted keys are only
+// encoded with GeoInvertedKeyV2 once all nodes of the cluster can decode them.
+func TestGeoInvertedKeyVersion(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		version  clusterversion.Key
+		latest   encoding.GeoInvertedKeyVersion
+		expected encoding.GeoInvertedKeyVersion
+	}{
+		{
+			version:  clusterversion.V24_2_GeoInvertedKeyV2 - 1,
+			latest:   encoding.GeoInvertedKeyV1,
+			expected: encoding.GeoInvertedKeyV1,
+		},
+		{
+			version:  clusterversion.V24_2_GeoInvertedKeyV2 - 1,
+			latest:   encoding.GeoInvertedKeyV2,
+			expected: encoding.GeoInvertedKeyV1,
+		},
+		{
+			version:  clusterversion.V24_2_GeoInvertedKeyV2,
+			latest:   encoding.GeoInvertedKeyV1,
+			expected: encoding.GeoInvertedKeyV1,
+		},
+		{
+			version:  clusterversion.V24_2_GeoInvertedKeyV2,
+			latest:   encoding.GeoInvertedKeyV2,
+			expected: encoding.GeoInvertedKeyV2,
+		},
+	} {
+		st := cluster.MakeTestingClusterSettingsWithVersions(
+			clusterversion.Latest.Version(),
+			clusterversion.MinSupported.Version(),
+			false, // initializeVersion
+		)
+		require.NoError(t, clusterversion.Initialize(ctx, tc.version.Version(), &st.SV))
+		evalCtx := eval.NewTestingEvalContext(st)
+		require.Equal(t, tc.expected, geoInvertedKeyVersionForLatest(ctx, evalCtx, tc.latest),
+			"version %s, latest %d", tc.version, tc.latest)
+	}
+	// The version that is currently used can be decoded by all nodes.
+	require.Equal(t, encoding.GeoInvertedKeyV1, encoding.LatestGeoInvertedKeyVersion)
+}
@@ -15,6 +15,7 @@ import (
 	"testing"
 
 	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/inverted"
 	"github.com/cockroachdb/cockroach/pkg/sql/opt"
 	"github.com/cockroachdb/cockroach/pkg/sql/opt/invertedidx"
 	"github.com/cockroachdb/cockroach/pkg/sql/opt/norm"
@@ -1223,3 +1224,83 @@ func TestTryFilterJsonOrArrayIndex(t *testing.T) {
 		}
 	}
 }
+
+func TestTryFilterInvertedIndexNormalize(t *testing.T) {
+	semaCtx := tree.MakeSemaContext(nil /* resolver */)
+	st := cluster.MakeTestingClusterSettings()
+	evalCtx := eval.NewTestingEvalContext(st)
+
+	tc := testcat.New()
+	if _, err := tc.ExecuteDDL(
+		"CREATE TABLE t (a INT[], INVERTED INDEX (a))",
+	); err != nil {
+		t.Fatal(err)
+	}
+	var f norm.Factory
+	f.Init(context.Background(), evalCtx, tc)
+	md := f.Metadata()
+	tn := tree.NewUnqualifiedTableName("t")
+	tab := md.AddTable(tc.Table(tn), tn)
+	arrayOrd := 1
+
+	testCases := []struct {
+		filters string
+		// operator is the operator of the root of the span expression.
+		operator inverted.SetOperator
+		// numFactoredSpans is the number of factored spans in the span
+		// expression.
+		numFactoredSpans int
+	}{
+		{
+			// The intersection of the unions is normalized, since they have a
+			// common operand: the intersection for a @> '{1, 2}' is evaluated
+			// once instead of twice.
+			filters:          "(a @> '{1, 2}' OR a @> '{5}') AND (a @> '{1, 2}' OR a @> '{6}')",
+			operator:         inverted.SetUnion,
+			numFactoredSpans: 4,
+		},
+		{
+			// There is no common operand, so the span expression is not
+			// normalized.
+			filters:          "(a @> '{1, 2}' OR a @> '{5}') AND (a @> '{3, 4}' OR a @> '{6}')",
+			operator:         inverted.SetIntersection,
+			numFactoredSpans: 6,
+		},
+		{
+			// There are no intersections of unions.
+			filters:          "a @> '{1, 2}' AND a @> '{3}'",
+			operator:         inverted.SetIntersection,
+			numFactoredSpans: 3,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("test case: %v", tc)
+		filters := testutils.BuildFilters(t, &f, &semaCtx, evalCtx, tc.filters)
+
+		spanExpr, _, remainingFilters, _, ok := invertedidx.TryFilterInvertedIndex(
+			context.Background(),
+			evalCtx,
+			&f,
+			filters,
+			nil, /* optionalFilters */
+			tab,
+			md.Table(tab).Index(arrayOrd),
+			nil,       /* computedColumns */
+			func() {}, /* checkCancellation */
+		)
+		if !ok {
+			t.Fatalf("For (%s), expected ok=true", tc.filters)
+		}
+		if !spanExpr.Tight || remainingFilters != nil {
+			t.Fatalf("For (%s), expected a tight span expression, got\n%s", tc.filters, spanExpr)
+		}
+		if spanExpr.Operator != tc.operator {
+			t.Errorf("For (%s), expected operator %s, got\n%s", tc.filters, tc.operator, spanExpr)
+		}
+		if n := spanExpr.Stats().NumFactoredSpans; n != tc.numFactoredSpans {
+			t.Errorf("For (%s), expected %d factored spans, got %d:\n%s",
+				tc.filters, tc.numFactoredSpans, n, spanExpr)
+		}
+	}
+}
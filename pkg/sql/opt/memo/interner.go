@@ -663,7 +663,9 @@ func (h *hasher) HashInvertedSpans(val inverted.Spans) {
 	for i := range val {
 		span := &val[i]
 		h.HashBytes(span.Start)
-		h.HashBytes(span.End)
+		// A point span is equal to a span that stores the same end key, so hash
+		// the end key of both.
+		h.HashBytes(span.EndKey())
 	}
 }
 
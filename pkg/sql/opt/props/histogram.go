@@ -438,7 +438,7 @@ func makeSpanFromInvertedSpan(invSpan inverted.Span) *constraint.Span {
 	span.Init(
 		constraint.MakeKey(tree.NewDBytes(tree.DBytes(invSpan.Start))),
 		constraint.IncludeBoundary,
-		constraint.MakeKey(tree.NewDBytes(tree.DBytes(invSpan.End))),
+		constraint.MakeKey(tree.NewDBytes(tree.DBytes(invSpan.EndKey()))),
 		constraint.ExcludeBoundary,
 	)
 	return &span
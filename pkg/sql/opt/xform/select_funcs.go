@@ -869,7 +869,7 @@ func (c *CustomFuncs) GenerateInvertedIndexScans(
 			// generated.
 			return
 		}
-		spansToRead := spanExpr.SpansToRead
+		spansToRead := spanExpr.MaterializeSpansToRead()
 		// Override the filters with remainingFilters. If the index is a
 		// multi-column inverted index, the non-inverted prefix columns are
 		// constrained by the constraint. In this case, it may be possible to
@@ -1594,9 +1594,9 @@ func (c *CustomFuncs) GenerateInvertedIndexZigzagJoins(
 			case inverted.None:
 				// Check that this span expression represents a single-key span that is
 				// guaranteed not to produce duplicate primary keys.
-				if spanExprLocal.Unique && len(spanExprLocal.SpansToRead) == 1 &&
-					spanExprLocal.SpansToRead[0].IsSingleVal() {
-					vals = append(vals, spanExprLocal.SpansToRead[0].Start)
+				spansToRead := spanExprLocal.MaterializeSpansToRead()
+				if spanExprLocal.Unique && len(spansToRead) == 1 && spansToRead[0].IsSingleVal() {
+					vals = append(vals, spansToRead[0].Start)
 					return true
 				}
 
@@ -99,6 +99,28 @@ func intersectSetContainers(a, b setContainer) setContainer {
 	return out
 }
 
+// atLeastKSetContainers returns the elements that are in at least k of the
+// given sets, which must not contain duplicates.
+func atLeastKSetContainers(k int, sets []setContainer) setContainer {
+	var all setContainer
+	for _, s := range sets {
+		all = append(all, s...)
+	}
+	sort.Sort(all)
+	var out setContainer
+	for i := 0; i < len(all); {
+		j := i + 1
+		for j < len(all) && all[j] == all[i] {
+			j++
+		}
+		if j-i >= k {
+			out = append(out, all[i])
+		}
+		i = j
+	}
+	return out
+}
+
 // setExpression follows the structure of SpanExpression.
 type setExpression struct {
 	op inverted.SetOperator
@@ -106,6 +128,10 @@ type setExpression struct {
 	unionSetIndex int
 	left          *setExpression
 	right         *setExpression
+	// For SetAtLeast, k and the indexes in invertedExprEvaluator.sets of the
+	// operands.
+	k                 int
+	operandSetIndexes []int
 }
 
 type invertedSpan = inverted.SpanExpressionProto_Span
@@ -153,6 +179,18 @@ func (ev *invertedExprEvaluator) initSetExpr(expr *spanExpression) *setExpressio
 	if expr.Right != nil {
 		sx.right = ev.initSetExpr(expr.Right)
 	}
+	if expr.Operator == inverted.SetAtLeast {
+		sx.k = int(expr.K)
+		sx.operandSetIndexes = make([]int, len(expr.Operands))
+		for j := range expr.Operands {
+			sx.operandSetIndexes[j] = len(ev.sets)
+			ev.sets = append(ev.sets, nil)
+			if spans := expr.Operands[j].Spans; len(spans) > 0 {
+				ev.spansIndex = append(ev.spansIndex,
+					spansAndSetIndex{spans: spans, setIndex: sx.operandSetIndexes[j]})
+			}
+		}
+	}
 	return sx
 }
 
@@ -209,6 +247,12 @@ func (ev *invertedExprEvaluator) evaluateSetExpr(sx *setExpression) setContainer
 		childrenSet = unionSetContainers(left, right)
 	case inverted.SetIntersection:
 		childrenSet = intersectSetContainers(left, right)
+	case inverted.SetAtLeast:
+		operands := make([]setContainer, len(sx.operandSetIndexes))
+		for i, setIndex := range sx.operandSetIndexes {
+			operands[i] = ev.sets[setIndex]
+		}
+		childrenSet = atLeastKSetContainers(sx.k, operands)
 	}
 	return unionSetContainers(ev.sets[sx.unionSetIndex], childrenSet)
 }
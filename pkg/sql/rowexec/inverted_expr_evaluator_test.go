@@ -134,6 +134,75 @@ func TestSetContainerIntersection(t *testing.T) {
 	}
 }
 
+func TestSetContainerAtLeastK(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	sets := []setContainer{{2, 5, 17, 25}, {2, 12, 17}, {5, 17, 30}}
+	for k, expected := range []setContainer{
+		1: unionSetContainers(unionSetContainers(sets[0], sets[1]), sets[2]),
+		2: {2, 5, 17},
+		3: intersectSetContainers(intersectSetContainers(sets[0], sets[1]), sets[2]),
+		4: nil,
+	} {
+		if k == 0 {
+			continue
+		}
+		require.Equal(t, setToString(expected), setToString(atLeastKSetContainers(k, sets)))
+	}
+	require.Equal(t, "", setToString(atLeastKSetContainers(1, nil)))
+}
+
+// Tests the evaluation of SetAtLeast nodes by batchedInvertedExprEvaluator,
+// and of their expansion into unions and intersections, which is evaluated
+// instead by the nodes of a mixed-version cluster that predate them.
+func TestInvertedExpressionEvaluatorAtLeastK(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	span := func(start, end string) inverted.Span {
+		return inverted.Span{Start: inverted.EncVal(start), End: inverted.EncVal(end)}
+	}
+	indexRows := []keyAndIndex{{"a", 0}, {"b", 1}, {"a", 2}, {"c", 2},
+		{"c", 3}, {"e", 3}, {"e", 4}, {"x", 5}, {"a", 6}, {"aa", 6},
+		{"b", 7}, {"e", 7}}
+	for _, expand := range []bool{false, true} {
+		t.Run(fmt.Sprintf("expand=%t", expand), func(t *testing.T) {
+			batchEval := &batchedInvertedExprEvaluator{}
+			for k := 1; k <= 3; k++ {
+				// The union of [x, y) and the keys in at least k of the operands.
+				expr := inverted.Or(
+					inverted.AtLeastK(k, [][]inverted.Span{
+						{span("a", "c")}, {span("b", "d")}, {span("e", "f")},
+					}),
+					inverted.ExprForSpan(span("x", "y"), true /* tight */),
+				).(*inverted.SpanExpression)
+				require.Equal(t, inverted.SetAtLeast, expr.Operator)
+				if expand {
+					expr = inverted.ExpandAtLeast(expr)
+					require.NotEqual(t, inverted.SetAtLeast, expr.Operator)
+				}
+				batchEval.exprs = append(batchEval.exprs, expr.ToProto())
+			}
+			invertedSpans, err := batchEval.init()
+			require.NoError(t, err)
+			require.Equal(t, "[a, d) [e, f) [x, y) ", spansToString(invertedSpans))
+
+			rand.Shuffle(len(indexRows), func(i, j int) {
+				indexRows[i], indexRows[j] = indexRows[j], indexRows[i]
+			})
+			for _, elem := range indexRows {
+				add, err := batchEval.prepareAddIndexRow(inverted.EncVal(elem.key), nil /* encFull */)
+				require.NoError(t, err)
+				require.Equal(t, true, add)
+				require.NoError(t, batchEval.addIndexRow(elem.index))
+			}
+			require.Equal(t, "0: 0 1 2 3 4 5 6 7 \n1: 1 2 3 5 7 \n2: 5 7 \n",
+				keyIndexesToString(batchEval.evaluate()))
+		})
+	}
+}
+
 type keyAndIndex struct {
 	key   string
 	index int
@@ -300,6 +369,29 @@ func TestInvertedExpressionEvaluator(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, 0, len(invertedSpans))
 	require.Equal(t, "0: \n1: \n", keyIndexesToString(batchBoth.evaluate()))
+
+	// Empty expressions, such as those of empty shapes, read no spans and
+	// evaluate to empty sets, like nil expressions.
+	batchBoth.reset()
+	empty := inverted.EmptySpanExpression().ToProto()
+	require.True(t, empty.IsEmpty())
+	batchBoth.exprs = append(batchBoth.exprs, empty, empty)
+	invertedSpans, err = batchBoth.init()
+	require.NoError(t, err)
+	require.Equal(t, 0, len(invertedSpans))
+	require.Equal(t, "0: \n1: \n", keyIndexesToString(batchBoth.evaluate()))
+	batchBoth.reset()
+	batchBoth.exprs = append(batchBoth.exprs, empty, &protoUnion, empty)
+	_, err = batchBoth.init()
+	require.NoError(t, err)
+	for _, elem := range indexRows {
+		add, err := batchBoth.prepareAddIndexRow(inverted.EncVal(elem.key), nil /* encFull */)
+		require.NoError(t, err)
+		require.Equal(t, true, add)
+		require.NoError(t, batchBoth.addIndexRow(elem.index))
+	}
+	require.Equal(t, "0: \n1: 0 3 4 5 6 7 8 \n2: \n",
+		keyIndexesToString(batchBoth.evaluate()))
 }
 
 // Test fragmentation for routing when multiple expressions in the batch have
@@ -140,6 +140,9 @@ const (
 	jsonArrayKeyDescendingMarker      = jsonTrueKeyDescendingMarker - 1
 	jsonObjectKeyDescendingMarker     = jsonArrayKeyDescendingMarker - 1
 
+	// geoInvertedIndexMarkerV2 is reserved for GeoInvertedKeyV2.
+	geoInvertedIndexMarkerV2 = jsonEmptyArrayKeyDescendingMarker + 1
+
 	// Terminators for JSON Key encoding.
 	jsonKeyTerminator           byte = 0x00
 	jsonKeyDescendingTerminator byte = 0xFF
@@ -1044,9 +1047,63 @@ func EncodeJSONAscending(b []byte) []byte {
 // - iterate over the cellids and append the encoded cellid to the prefix and then the
 //   previously encoded bbox.
 
+// GeoInvertedKeyVersion is the version of the encoding of geo inverted keys.
+// Each version has its own marker, so that decoding can dispatch on the
+// marker. The zero value is the version that is used by default.
+type GeoInvertedKeyVersion int
+
+const (
+	// GeoInvertedKeyV1 is the current encoding of geo inverted keys, which
+	// starts with the geoInvertedIndexMarker.
+	GeoInvertedKeyV1 GeoInvertedKeyVersion = iota
+	// GeoInvertedKeyV2 is reserved for a future encoding of geo inverted keys.
+	// Until that encoding is defined, it only differs from GeoInvertedKeyV1 in
+	// its marker, and must not be used for keys that are written.
+	GeoInvertedKeyV2
+)
+
+// LatestGeoInvertedKeyVersion is the newest version of the encoding of geo
+// inverted keys whose format is defined. Keys of a version newer than
+// GeoInvertedKeyV1 must only be produced once all nodes can decode them, which
+// is determined by the cluster version at the call site.
+const LatestGeoInvertedKeyVersion = GeoInvertedKeyV1
+
+func (v GeoInvertedKeyVersion) marker() byte {
+	switch v {
+	case GeoInvertedKeyV1:
+		return geoInvertedIndexMarker
+	case GeoInvertedKeyV2:
+		return geoInvertedIndexMarkerV2
+	default:
+		panic(errors.AssertionFailedf("unknown geo inverted key version %d", v))
+	}
+}
+
 // EncodeGeoInvertedAscending appends the geoInvertedIndexMarker.
 func EncodeGeoInvertedAscending(b []byte) []byte {
-	return append(b, geoInvertedIndexMarker)
+	return EncodeGeoInvertedAscendingWithVersion(b, GeoInvertedKeyV1)
+}
+
+// EncodeGeoInvertedAscendingWithVersion appends the marker of the given
+// version of the encoding of geo inverted keys.
+func EncodeGeoInvertedAscendingWithVersion(b []byte, version GeoInvertedKeyVersion) []byte {
+	return append(b, version.marker())
+}
+
+// DecodeGeoInvertedKeyVersion returns the version of the encoding of the given
+// geo inverted key, which is determined by its marker.
+func DecodeGeoInvertedKeyVersion(b []byte) (GeoInvertedKeyVersion, error) {
+	if len(b) == 0 {
+		return 0, errors.Errorf("empty geo inverted key")
+	}
+	switch b[0] {
+	case geoInvertedIndexMarker:
+		return GeoInvertedKeyV1, nil
+	case geoInvertedIndexMarkerV2:
+		return GeoInvertedKeyV2, nil
+	default:
+		return 0, errors.Errorf("marker is not geoInvertedIndexMarker")
+	}
 }
 
 // Currently only the lowest bit is used to define the encoding kind and the
@@ -1088,8 +1145,9 @@ func DecodeGeoInvertedKey(b []byte) (loX, loY, hiX, hiY float64, remaining []byt
 		return 0, 0, 0, 0, b,
 			errors.Errorf("inverted key length %d too small", len(b))
 	}
-	if b[0] != geoInvertedIndexMarker {
-		return 0, 0, 0, 0, b, errors.Errorf("marker is not geoInvertedIndexMarker")
+	// All versions currently share the layout that follows the marker.
+	if _, err := DecodeGeoInvertedKeyVersion(b); err != nil {
+		return 0, 0, 0, 0, b, err
 	}
 	b = b[1:]
 	var cellLen int
@@ -2042,7 +2100,7 @@ func PeekLength(b []byte) (int, error) {
 			return 0, err
 		}
 		return 1 + length, nil
-	case geoInvertedIndexMarker:
+	case geoInvertedIndexMarker, geoInvertedIndexMarkerV2:
 		return getGeoInvertedIndexKeyLength(b)
 	case geoMarker:
 		// Expect to reserve at least 8 bytes for int64.
@@ -1481,6 +1481,33 @@ func TestEncodeDecodeGeoInvertedIndex(t *testing.T) {
 	}
 }
 
+func TestGeoInvertedKeyVersion(t *testing.T) {
+	for _, version := range []GeoInvertedKeyVersion{GeoInvertedKeyV1, GeoInvertedKeyV2} {
+		t.Run(fmt.Sprintf("v%d", version+1), func(t *testing.T) {
+			var b []byte
+			b = EncodeGeoInvertedAscendingWithVersion(b, version)
+			b = EncodeUvarintAscending(b, 10000)
+			b = EncodeGeoInvertedBBox(b, 1, 2, 3, 4)
+			decodedVersion, err := DecodeGeoInvertedKeyVersion(b)
+			require.NoError(t, err)
+			require.Equal(t, version, decodedVersion)
+			length, err := PeekLength(b)
+			require.NoError(t, err)
+			require.Equal(t, len(b), length)
+			loX, loY, hiX, hiY, b, err := DecodeGeoInvertedKey(b)
+			require.NoError(t, err)
+			require.Equal(t, []float64{1, 2, 3, 4}, []float64{loX, loY, hiX, hiY})
+			require.Equal(t, 0, len(b))
+		})
+	}
+	require.Equal(t,
+		EncodeGeoInvertedAscending(nil), EncodeGeoInvertedAscendingWithVersion(nil, GeoInvertedKeyV1))
+	_, err := DecodeGeoInvertedKeyVersion(nil)
+	require.Error(t, err)
+	_, err = DecodeGeoInvertedKeyVersion(EncodeJSONAscending(nil))
+	require.Error(t, err)
+}
+
 type testCaseDuration struct {
 	value  duration.Duration
 	expEnc []byte